@@ -0,0 +1,69 @@
+// Command make-invoices writes the work days of the month from the calendar
+// to the timesheets and exports the invoices.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/tsujio/make-invoices/internal/app"
+	"github.com/tsujio/make-invoices/invoices"
+)
+
+// Set at build time by -ldflags "-X main.version=..."
+var version = "dev"
+
+func main() {
+	app.SetVersion(version)
+	if err := run(os.Args[1:]); err != nil {
+		os.Exit(app.ReportError(err))
+	}
+}
+
+// Runs the command of the arguments, returning the error ending it
+func run(args []string) error {
+	if len(args) >= 1 && args[0] == "serve" {
+		return runServe(args[1:])
+	}
+	if len(args) >= 1 {
+		if cmd, ok := app.Subcommand(args[0]); ok {
+			return cmd(args[1:])
+		}
+	}
+	r, err := app.StartRun(args)
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.Close()
+	return makeInvoices(r)
+}
+
+// Makes the invoices of the run with a Runner, as other programs do
+func makeInvoices(r *app.CommandRun) error {
+	runner := invoices.NewRunner(r.Config, r.Client)
+	runner.Options = invoices.Options{
+		Interactive:     r.Options.Interactive,
+		RequireWorkDays: r.Options.RequireWorkDays,
+		DryRun:          r.Options.DryRun,
+	}
+	if r.ExportOnly {
+		if _, err := runner.ExportPDFs(r.Context, r.Month); err != nil {
+			return err
+		}
+	} else {
+		days, err := runner.DetectWorkDays(r.Context, r.Month)
+		if err != nil {
+			return err
+		}
+		if _, err := runner.MakeInvoices(r.Context, r.Month, days); err != nil {
+			return err
+		}
+	}
+
+	if r.Options.DryRun {
+		log.Println("Done (dry run)")
+		return nil
+	}
+	log.Println("Done")
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunFlagErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--log-format", "xml"}, "Unknown --log-format"},
+		{[]string{"--verbose", "--quiet"}, "--verbose and --quiet can't be used together"},
+		{[]string{"--no-such-flag"}, "flag provided but not defined: -no-such-flag"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			// Failures are returned rather than ending the process
+			err := run(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunMonthsBack(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		// The config is read after the month is parsed, and there is none
+		// next to the test binary
+		{[]string{"-1"}, "Failed to open config file"},
+		{[]string{"--", "-1"}, "Failed to open config file"},
+		{[]string{"-1", "--log-format", "xml"}, "Unknown --log-format"},
+		{[]string{"-1x"}, "flag provided but not defined: -1x"},
+		// Revisions are runs for the rest of the process
+		{[]string{"revise", "-2"}, "revise needs --only"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			err := run(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunHelp(t *testing.T) {
+	if err := run([]string{"-h"}); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/app"
+	"github.com/tsujio/make-invoices/invoices"
+)
+
+// Header having the secret in requests to the server
+const serveSecretHeader = "X-Make-Invoices-Secret"
+
+// serveRunRequest is the body of POST /runs
+type serveRunRequest struct {
+	Month  string   `json:"month"`
+	DryRun bool     `json:"dry_run"`
+	Only   []string `json:"only"`
+}
+
+// serveRun is a run started by the server, returned by GET /runs/{id}
+type serveRun struct {
+	ID        string          `json:"id"`
+	Month     string          `json:"month"`
+	DryRun    bool            `json:"dry_run"`
+	Only      []string        `json:"only,omitempty"`
+	Status    string          `json:"status"`
+	ExitCode  int             `json:"exit_code"`
+	Summary   json.RawMessage `json:"summary,omitempty"`
+	Log       string          `json:"log"`
+	CreatedAt time.Time       `json:"created_at"`
+	StartedAt *time.Time      `json:"started_at,omitempty"`
+	EndedAt   *time.Time      `json:"ended_at,omitempty"`
+}
+
+// Statuses of runs
+const (
+	serveQueued    = "queued"
+	serveRunning   = "running"
+	serveSucceeded = "succeeded"
+	serveFailed    = "failed"
+)
+
+type server struct {
+	secret string
+	// Config read at the start, of the timezone of the months requested
+	config *app.Config
+	// Runs are made one at a time, in the order requested
+	runMu sync.Mutex
+	// Summary of the run being made, written by it
+	summary bytes.Buffer
+	mu      sync.Mutex
+	runs    map[string]*serveRun
+	seq     int
+}
+
+// Serves an HTTP API starting runs, for triggering them from other devices
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8754", "address to listen on")
+	allowRemote := fs.Bool("allow-remote", false, "allow listening on addresses other than loopback")
+	fs.Parse(args)
+
+	config, err := app.ReadConfig()
+	if err != nil {
+		return err
+	}
+	if config.Serve == nil || config.Serve.Secret == "" {
+		return app.NewConfigError("serve.secret is required in the config")
+	}
+	host, _, err := net.SplitHostPort(*listen)
+	if err != nil {
+		return app.NewConfigError("Invalid --listen: %v", err)
+	}
+	if !isLoopbackHost(host) && !*allowRemote {
+		return app.NewConfigError("Refusing to listen on %s, which is not a loopback address (use --allow-remote to allow)", *listen)
+	}
+
+	s := newServer(config)
+	// Runs are made in the process as unattended ones, so that they go the
+	// same way as runs from cron
+	app.SetUnattended(&s.summary)
+	// The server runs long enough for the check to finish
+	app.LogUpdateNotice(config)
+	log.Printf("Listening on %s\n", *listen)
+	return http.ListenAndServe(*listen, s.handler())
+}
+
+func newServer(config *app.Config) *server {
+	return &server{secret: config.Serve.Secret, config: config, runs: make(map[string]*serveRun)}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/runs", s.handleRuns)
+	mux.HandleFunc("/runs/", s.handleRun)
+	return s.authorize(mux)
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *server) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(serveSecretHeader)), []byte(s.secret)) != 1 {
+			writeServeError(w, http.StatusUnauthorized, "missing or wrong "+serveSecretHeader)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeServeJSON(w, http.StatusOK, map[string]string{"status": "ok", "version": version})
+}
+
+func (s *server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeServeError(w, http.StatusMethodNotAllowed, "use POST to start a run")
+		return
+	}
+	var req serveRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeServeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+		return
+	}
+	if req.Month == "" {
+		req.Month = "this"
+	}
+	// Relative months are of the time of the request, in the timezone of
+	// the runs
+	month, err := app.ParseMonth(s.config, req.Month, time.Now())
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, fmt.Sprintf("invalid month: %v", err))
+		return
+	}
+	for _, id := range req.Only {
+		if id == "" || strings.Contains(id, ",") {
+			writeServeError(w, http.StatusBadRequest, fmt.Sprintf("invalid spreadsheet ID %q in only", id))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.seq++
+	run := &serveRun{
+		ID:        fmt.Sprintf("%s-%d", time.Now().Format("20060102150405"), s.seq),
+		Month:     month.Format("200601"),
+		DryRun:    req.DryRun,
+		Only:      req.Only,
+		Status:    serveQueued,
+		CreatedAt: time.Now(),
+	}
+	s.runs[run.ID] = run
+	s.mu.Unlock()
+	log.Printf("Queued run %s for %s\n", run.ID, run.Month)
+
+	go s.execute(run, month)
+	writeServeJSON(w, http.StatusAccepted, s.snapshot(run))
+}
+
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeServeError(w, http.StatusMethodNotAllowed, "use GET to see a run")
+		return
+	}
+	s.mu.Lock()
+	run, ok := s.runs[strings.TrimPrefix(r.URL.Path, "/runs/")]
+	s.mu.Unlock()
+	if !ok {
+		writeServeError(w, http.StatusNotFound, "no such run")
+		return
+	}
+	writeServeJSON(w, http.StatusOK, s.snapshot(run))
+}
+
+// Returns a copy of the run, which is updated while running
+func (s *server) snapshot(run *serveRun) serveRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *run
+}
+
+// Makes the run of the month, keeping the logs written meanwhile as its log
+// and the summary it writes
+func (s *server) execute(run *serveRun, month time.Time) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	now := time.Now()
+	s.mu.Lock()
+	run.Status, run.StartedAt = serveRunning, &now
+	s.mu.Unlock()
+	log.Printf("Started run %s for %s\n", run.ID, run.Month)
+
+	var runLog bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(io.MultiWriter(out, &runLog))
+	s.summary.Reset()
+	code := 0
+	if err := makeServeRun(run, month); err != nil {
+		code = app.ReportError(err)
+	}
+	log.SetOutput(out)
+
+	end := time.Now()
+	s.mu.Lock()
+	run.ExitCode, run.Log, run.EndedAt = code, runLog.String(), &end
+	if json.Valid(s.summary.Bytes()) && s.summary.Len() > 0 {
+		run.Summary = json.RawMessage(append([]byte{}, s.summary.Bytes()...))
+	}
+	run.Status = serveSucceeded
+	if code != 0 {
+		run.Status = serveFailed
+	}
+	s.mu.Unlock()
+	log.Printf("Run %s %s (exit code %d)\n", run.ID, run.Status, code)
+}
+
+// Makes the invoices of the month with a Runner, with the config read
+// again as each run of the command does
+func makeServeRun(run *serveRun, month time.Time) error {
+	config, err := app.ReadConfig()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client, err := app.NewClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	runner := invoices.NewRunner(config, client)
+	runner.Options = invoices.Options{RequireWorkDays: true, DryRun: run.DryRun, Only: run.Only}
+	days, err := runner.DetectWorkDays(ctx, month)
+	if err != nil {
+		return err
+	}
+	_, err = runner.MakeInvoices(ctx, month, days)
+	return err
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+}
+
+func writeServeError(w http.ResponseWriter, status int, message string) {
+	writeServeJSON(w, status, map[string]string{"error": message})
+}
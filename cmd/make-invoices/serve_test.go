@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/config"
+)
+
+// Posts the run to the server, returning the status and the run or the
+// error answered
+func postServeRun(t *testing.T, s *server, body string) (int, *serveRun, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(body))
+	req.Header.Set(serveSecretHeader, "secret")
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, req)
+	var answer struct {
+		serveRun
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("answer %q: %v", rec.Body, err)
+	}
+	return rec.Code, &answer.serveRun, answer.Error
+}
+
+// Waits for the run to end, returning it
+func waitServeRun(t *testing.T, s *server, id string) serveRun {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		run := s.runs[id]
+		s.mu.Unlock()
+		if r := s.snapshot(run); r.EndedAt != nil {
+			return r
+		}
+	}
+	t.Fatalf("run %s did not end", id)
+	return serveRun{}
+}
+
+func TestServeRunMonth(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(&config.Config{Serve: &config.ServeConfig{Secret: "secret"}, Timezone: "America/New_York"})
+	now := time.Now().In(loc)
+
+	for body, want := range map[string]string{
+		`{}`:                   now.Format("200601"),
+		`{"month": "-1"}`:      time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, loc).Format("200601"),
+		`{"month": "last"}`:    time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, loc).Format("200601"),
+		`{"month": "2024-05"}`: "202405",
+	} {
+		code, run, message := postServeRun(t, s, body)
+		if code != http.StatusAccepted {
+			t.Fatalf("%s: got %d %s", body, code, message)
+		}
+		if run.Month != want {
+			t.Errorf("%s: got month %s, want %s", body, run.Month, want)
+		}
+		// The run reads the config next to the executable, of which the
+		// test has none
+		ended := waitServeRun(t, s, run.ID)
+		if ended.Status != serveFailed || ended.ExitCode != 2 || !strings.Contains(ended.Log, "Failed to open config file") {
+			t.Errorf("%s: got %s (exit code %d) with log %q", body, ended.Status, ended.ExitCode, ended.Log)
+		}
+	}
+
+	for _, body := range []string{`{"month": "-x"}`, `{"month": "2024-13"}`, `{"only": ["a,b"]}`} {
+		if code, _, message := postServeRun(t, s, body); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s", body, code, message)
+		}
+	}
+}
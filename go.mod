@@ -3,6 +3,10 @@ module github.com/tsujio/make-invoices
 go 1.16
 
 require (
+	github.com/pdfcpu/pdfcpu v0.3.13
+	golang.org/x/net v0.0.0-20220624214902-1bab6f366d9e
 	golang.org/x/oauth2 v0.0.0-20220622183110-fd043fe589d2
+	golang.org/x/text v0.3.7
+	golang.org/x/time v0.3.0
 	google.golang.org/api v0.86.0
 )
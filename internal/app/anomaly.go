@@ -0,0 +1,76 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Work of a month is compared with the average of the months before, by
+// anomaly_threshold_percent, 30 by default
+const (
+	anomalyHistoryMonths = 3
+)
+
+// monthWork is the work made into the sheet of a month
+type monthWork struct {
+	Month    string  `json:"month"`
+	WorkDays int     `json:"work_days"`
+	Hours    float64 `json:"hours"`
+}
+
+// Returns the work of the spreadsheet in the months before the target month
+// recorded in the state, from the latest. Months made before the work was
+// recorded are left out.
+func getWorkHistory(state *State, spreadsheetID string, targetTime time.Time) []monthWork {
+	history := make([]monthWork, 0, anomalyHistoryMonths)
+	for i := 1; i <= anomalyHistoryMonths; i++ {
+		month := targetTime.AddDate(0, -i, 0).Format("200601")
+		c, ok := state.Completed[month][spreadsheetID]
+		if !ok || c.WorkDays == nil {
+			continue
+		}
+		w := monthWork{Month: month, WorkDays: *c.WorkDays}
+		if c.Hours != nil {
+			w.Hours = *c.Hours
+		}
+		history = append(history, w)
+	}
+	return history
+}
+
+// Returns the work days and hours of the month deviating from the averages
+// of the history by more than thresholdPercent. Hours are compared only if
+// the history has them.
+func findWorkAnomalies(current monthWork, history []monthWork, thresholdPercent float64) []string {
+	if len(history) == 0 {
+		return nil
+	}
+	var days, hours float64
+	for _, w := range history {
+		days += float64(w.WorkDays)
+		hours += w.Hours
+	}
+	days /= float64(len(history))
+	hours /= float64(len(history))
+	months := history[0].Month
+	if len(history) > 1 {
+		months = history[len(history)-1].Month + "-" + months
+	}
+
+	anomalies := make([]string, 0)
+	deviation := func(v, average float64) (float64, bool) {
+		if average == 0 {
+			return 0, false
+		}
+		d := (v - average) / average * 100
+		return d, math.Abs(d) > thresholdPercent
+	}
+	if d, ok := deviation(float64(current.WorkDays), days); ok {
+		anomalies = append(anomalies, fmt.Sprintf("%d work days, %+.0f%% from %.1f on average in %s", current.WorkDays, d, days, months))
+	}
+	if d, ok := deviation(current.Hours, hours); ok {
+		anomalies = append(anomalies, fmt.Sprintf("%g hours, %+.0f%% from %.1f on average in %s", current.Hours, d, hours, months))
+	}
+	return anomalies
+}
@@ -0,0 +1,450 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// "make-invoices archive --fiscal-year 2024" copies the outputs of the 12
+// months of the fiscal year starting in fiscal_year_start_month of 2024
+// into a directory of a month each, with an index of the invoices and their
+// totals by client and by quarter in index.csv and index.html. The outputs
+// are the files of the manifests of the months, each checked against its
+// hash; missing and changed files are listed and left out, and the command
+// fails. With --reexport, missing pdfs of month sheets are exported again
+// from the sheets, which are marked as such in the index, since they may
+// differ from the ones sent. With --zip the archive is made a ZIP.
+func runArchive(args []string) error {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	fiscalYear := fs.Int("fiscal-year", 0, "fiscal year like 2024, starting in fiscal_year_start_month of the year")
+	out := fs.String("out", "", "directory of the archive, archive-FY<year> by default")
+	asZip := fs.Bool("zip", false, "make a ZIP of the archive in place of the directory")
+	reexport := fs.Bool("reexport", false, "export missing pdfs of month sheets again")
+	fs.Parse(args)
+	if *fiscalYear == 0 {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices archive --fiscal-year <year> [--out <dir>] [--zip] [--reexport]")
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	loc, err := config.GetLocation()
+	if err != nil {
+		return fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	start := time.Date(*fiscalYear, config.GetFiscalYearStartMonth(), 1, 0, 0, 0, 0, loc)
+	dir := *out
+	if dir == "" {
+		dir = fmt.Sprintf("archive-FY%d", *fiscalYear)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s exists already", dir)
+	}
+	if *asZip {
+		if _, err := os.Stat(dir + ".zip"); err == nil {
+			return fmt.Errorf("%s.zip exists already", dir)
+		}
+	}
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("Failed to load state: %v", err)
+	}
+
+	var ex *archiveExporter
+	if *reexport {
+		if ex, err = newArchiveExporter(config); err != nil {
+			return err
+		}
+	}
+	a := &archive{dir: dir, config: config, state: state, exporter: ex}
+	for i := 0; i < 12; i++ {
+		if err := a.addMonth(start.AddDate(0, i, 0), i/3+1); err != nil {
+			return fmt.Errorf("Failed to archive %s: %v", start.AddDate(0, i, 0).Format("200601"), err)
+		}
+	}
+	if err := a.writeIndex(*fiscalYear, start); err != nil {
+		return fmt.Errorf("Failed to write index: %v", err)
+	}
+
+	dest := dir
+	if *asZip {
+		if err := zipDirectory(dir, dir+".zip", start); err != nil {
+			return fmt.Errorf("Failed to make %s.zip: %v", dir, err)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			logWarnf(log.Default(), "Warning: failed to remove %s: %v\n", dir, err)
+		}
+		dest = dir + ".zip"
+	}
+	log.Printf("Archived %d files of %d invoices of FY%d (%s - %s) to %s\n", a.copied, len(a.invoices), *fiscalYear,
+		start.Format("2006-01"), start.AddDate(0, 11, 0).Format("2006-01"), dest)
+	if len(a.reexported) > 0 {
+		log.Printf("Exported again, which may differ from the files sent:\n  %s\n", strings.Join(a.reexported, "\n  "))
+	}
+	if len(a.problems) > 0 {
+		log.Printf("Files not archived:\n  %s\n", strings.Join(a.problems, "\n  "))
+		return fmt.Errorf("%d files are not archived", len(a.problems))
+	}
+	return nil
+}
+
+// archive is the archive of a fiscal year being made
+type archive struct {
+	dir      string
+	config   *Config
+	state    *State
+	exporter *archiveExporter
+	invoices []*archivedInvoice
+	copied   int
+	// Files exported again, and the ones missing or changed since the
+	// manifests, like "202405: 202405Title.pdf (missing)"
+	reexported []string
+	problems   []string
+}
+
+// archivedInvoice is an invoice of the month of a spreadsheet in the index
+type archivedInvoice struct {
+	Month         string
+	Quarter       int
+	SpreadsheetID string
+	Title         string
+	Client        string
+	InvoiceNumber string
+	Currency      string
+	// Total in the minor units of the currency, nil if unknown
+	Total *int64
+	Files []string
+}
+
+func (inv *archivedInvoice) formatTotal() string {
+	if inv.Total == nil {
+		return ""
+	}
+	return getArchiveCurrency(inv.Currency).formatNumber(*inv.Total)
+}
+
+func getArchiveCurrency(code string) *currency {
+	if cur, ok := currencies[code]; ok {
+		return cur
+	}
+	return defaultCurrency
+}
+
+// Copies the files of the manifest of the month into its directory, and adds
+// its invoices
+func (a *archive) addMonth(t time.Time, quarter int) error {
+	month := t.Format("200601")
+	monthDir := filepath.Join(a.dir, t.Format("2006-01"))
+	if err := os.MkdirAll(monthDir, 0755); err != nil {
+		return err
+	}
+	byID := make(map[string]*archivedInvoice)
+	for id, c := range a.state.Completed[month] {
+		inv := &archivedInvoice{
+			Month:         t.Format("2006-01"),
+			Quarter:       quarter,
+			SpreadsheetID: id,
+			Title:         c.Title,
+			Client:        c.Title,
+			InvoiceNumber: getAssignedInvoiceNumber(a.state, id, t),
+			Currency:      c.Currency,
+			Total:         c.Total,
+		}
+		for _, sc := range a.config.GetSpreadsheets() {
+			if cc := a.config.GetClient(sc); sc.ID == id && cc != nil {
+				inv.Client = cc.Name
+			}
+		}
+		byID[id] = inv
+	}
+
+	d, err := ioutil.ReadFile(getManifestFilePath(t))
+	if os.IsNotExist(err) {
+		if len(byID) > 0 {
+			a.problems = append(a.problems, fmt.Sprintf("%s: %s (missing)", month, getManifestFilePath(t)))
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	} else {
+		var manifest Manifest
+		if err := json.Unmarshal(d, &manifest); err != nil {
+			return fmt.Errorf("failed to decode %s: %v", getManifestFilePath(t), err)
+		}
+		for _, e := range manifest.Files {
+			name, err := a.addFile(e, t, monthDir)
+			if err != nil {
+				return err
+			}
+			if inv := byID[e.SpreadsheetID]; inv != nil && name != "" {
+				inv.Files = append(inv.Files, name)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return byID[ids[i]].InvoiceNumber+byID[ids[i]].Title < byID[ids[j]].InvoiceNumber+byID[ids[j]].Title
+	})
+	for _, id := range ids {
+		a.invoices = append(a.invoices, byID[id])
+	}
+	return nil
+}
+
+// Copies the file of the manifest into the directory if it matches its hash,
+// returning its path in the archive, or "" if it is not archived
+func (a *archive) addFile(e *ManifestEntry, t time.Time, monthDir string) (string, error) {
+	month := t.Format("200601")
+	dest := filepath.Join(monthDir, filepath.Base(e.Path))
+	rel := filepath.ToSlash(filepath.Join(t.Format("2006-01"), filepath.Base(e.Path)))
+	sum, size, err := hashFile(e.Path)
+	switch {
+	case os.IsNotExist(err):
+		if a.exporter != nil && e.SheetID != nil && filepath.Ext(e.Path) == ".pdf" {
+			if err := a.exporter.exportSheetPDF(e.SpreadsheetID, *e.SheetID, dest); err != nil {
+				a.problems = append(a.problems, fmt.Sprintf("%s: %s (missing, failed to export again: %v)", month, e.Path, err))
+				return "", nil
+			}
+			a.reexported = append(a.reexported, fmt.Sprintf("%s: %s", month, e.Path))
+			a.copied++
+			return rel, nil
+		}
+		a.problems = append(a.problems, fmt.Sprintf("%s: %s (missing)", month, e.Path))
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to hash %s: %v", e.Path, err)
+	case sum != e.SHA256 || size != e.Size:
+		a.problems = append(a.problems, fmt.Sprintf("%s: %s (changed since the manifest)", month, e.Path))
+		return "", nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if err := copyFileTo(f, e.Path); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to copy %s: %v", e.Path, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	a.copied++
+	return rel, nil
+}
+
+// archiveTotal is the sum of the totals of the invoices of a client or a
+// quarter in a currency
+type archiveTotal struct {
+	Name     string
+	Currency string
+	Count    int
+	Total    string
+	// Invoices whose totals are unknown
+	Unknown int
+}
+
+// Sums the totals of the invoices by the key
+func sumArchiveTotals(invoices []*archivedInvoice, key func(inv *archivedInvoice) string) []*archiveTotal {
+	sums := make(map[string]int64)
+	totals := make(map[string]*archiveTotal)
+	keys := make([]string, 0)
+	for _, inv := range invoices {
+		k := key(inv) + "\x00" + inv.Currency
+		t, ok := totals[k]
+		if !ok {
+			t = &archiveTotal{Name: key(inv), Currency: inv.Currency}
+			totals[k] = t
+			keys = append(keys, k)
+		}
+		t.Count++
+		if inv.Total == nil {
+			t.Unknown++
+		} else {
+			sums[k] += *inv.Total
+		}
+	}
+	sort.Strings(keys)
+	list := make([]*archiveTotal, 0, len(keys))
+	for _, k := range keys {
+		totals[k].Total = getArchiveCurrency(totals[k].Currency).formatNumber(sums[k])
+		list = append(list, totals[k])
+	}
+	return list
+}
+
+var archiveIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>FY{{.Year}} invoices</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #999; padding: 4px 8px; }
+td.amount { text-align: right; }
+.problem { color: #c00; }
+</style>
+</head>
+<body>
+<h1>FY{{.Year}} ({{.Start}} - {{.End}})</h1>
+{{if .Problems}}<h2 class="problem">Files not archived</h2>
+<ul class="problem">{{range .Problems}}<li>{{.}}</li>{{end}}</ul>
+{{end}}{{if .Reexported}}<h2>Exported again</h2>
+<ul>{{range .Reexported}}<li>{{.}}</li>{{end}}</ul>
+{{end}}<h2>Invoices</h2>
+<table>
+<tr><th>Month</th><th>Client</th><th>Title</th><th>Invoice number</th><th>Currency</th><th>Total</th><th>Files</th></tr>
+{{range .Invoices}}<tr><td>{{.Month}}</td><td>{{.Client}}</td><td>{{.Title}}</td><td>{{.InvoiceNumber}}</td><td>{{.Currency}}</td><td class="amount">{{.FormattedTotal}}</td><td>{{range .Files}}<a href="{{.}}">{{.}}</a><br>{{end}}</td></tr>
+{{end}}</table>
+<h2>By client</h2>
+<table>
+<tr><th>Client</th><th>Currency</th><th>Invoices</th><th>Total</th></tr>
+{{range .ByClient}}<tr><td>{{.Name}}</td><td>{{.Currency}}</td><td>{{.Count}}{{if .Unknown}} ({{.Unknown}} without totals){{end}}</td><td class="amount">{{.Total}}</td></tr>
+{{end}}</table>
+<h2>By quarter</h2>
+<table>
+<tr><th>Quarter</th><th>Currency</th><th>Invoices</th><th>Total</th></tr>
+{{range .ByQuarter}}<tr><td>{{.Name}}</td><td>{{.Currency}}</td><td>{{.Count}}{{if .Unknown}} ({{.Unknown}} without totals){{end}}</td><td class="amount">{{.Total}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Writes index.csv of the invoices and index.html with their totals by
+// client and by quarter
+func (a *archive) writeIndex(year int, start time.Time) error {
+	f, err := os.Create(filepath.Join(a.dir, "index.csv"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"month", "quarter", "client", "title", "spreadsheet_id", "invoice_number", "currency", "total", "files"})
+	for _, inv := range a.invoices {
+		w.Write([]string{inv.Month, "Q" + strconv.Itoa(inv.Quarter), inv.Client, inv.Title, inv.SpreadsheetID, inv.InvoiceNumber, inv.Currency, inv.formatTotal(), strings.Join(inv.Files, " ")})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	type indexInvoice struct {
+		*archivedInvoice
+		FormattedTotal string
+	}
+	invoices := make([]indexInvoice, 0, len(a.invoices))
+	for _, inv := range a.invoices {
+		invoices = append(invoices, indexInvoice{inv, inv.formatTotal()})
+	}
+	h, err := os.Create(filepath.Join(a.dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	if err := archiveIndexTemplate.Execute(h, map[string]interface{}{
+		"Year":       year,
+		"Start":      start.Format("2006-01"),
+		"End":        start.AddDate(0, 11, 0).Format("2006-01"),
+		"Problems":   a.problems,
+		"Reexported": a.reexported,
+		"Invoices":   invoices,
+		"ByClient":   sumArchiveTotals(a.invoices, func(inv *archivedInvoice) string { return inv.Client }),
+		"ByQuarter":  sumArchiveTotals(a.invoices, func(inv *archivedInvoice) string { return "Q" + strconv.Itoa(inv.Quarter) }),
+	}); err != nil {
+		return err
+	}
+	return h.Close()
+}
+
+// Makes a ZIP of the files of the directory, dated the first day of the
+// fiscal year like bundles
+func zipDirectory(dir, zipPath string, start time.Time) error {
+	entries := make(map[string]string)
+	names := make([]string, 0)
+	if err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(filepath.Base(dir), rel))
+		entries[name] = p
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Strings(names)
+	return writeZipFile(zipPath, names, entries, time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC))
+}
+
+// archiveExporter exports the pdfs of month sheets missing from the archive
+type archiveExporter struct {
+	config *Config
+	sht    *sheets.Service
+	drv    *drive.Service
+	client *http.Client
+}
+
+func newArchiveExporter(config *Config) (*archiveExporter, error) {
+	ctx := context.Background()
+	scopes := []string{sheets.SpreadsheetsReadonlyScope, drive.DriveReadonlyScope}
+	// Sheets are exported from copies made by the app, unless by the export
+	// URL
+	if config.ExportMethod != "url" {
+		scopes = append(scopes, drive.DriveFileScope)
+	}
+	client, err := createScopedAPIClient(ctx, config, scopes)
+	if err != nil {
+		return nil, err
+	}
+	s, err := getSession(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveExporter{config: config, sht: s.sheets, drv: s.drive, client: client}, nil
+}
+
+func (ex *archiveExporter) exportSheetPDF(spreadsheetID string, sheetID int64, fileName string) error {
+	spreadsheet, err := getSpreadsheet(ex.sht, spreadsheetID, spreadsheetRunFields)
+	if err != nil {
+		return err
+	}
+	sc := &SpreadsheetConfig{ID: spreadsheetID}
+	for _, s := range ex.config.GetSpreadsheets() {
+		if s.ID == spreadsheetID {
+			sc = s
+		}
+	}
+	pdfOptions, err := getPDFOptions(ex.config, sc)
+	if err != nil {
+		return err
+	}
+	return exportSheet(ex.drv, ex.sht, ex.client, spreadsheet, sheetID, export.Formats["pdf"], fileName, pdfOptions, ex.config, log.Default())
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+var auditLogHeader = []interface{}{"日時", "バージョン", "対象月", "スプレッドシート", "処理", "稼働日数", "実行者", "詳細"}
+
+// Actions of a spreadsheet written to the audit log
+const (
+	auditCreated  = "created tab"
+	auditUpdated  = "updated"
+	auditSkipped  = "skipped"
+	auditFailed   = "failed"
+	auditRevised  = "revised"
+	auditExported = "exported"
+	// Months made before the tool, read back by the backfill command
+	auditBackfilled = "backfilled"
+)
+
+// Appends a row for each spreadsheet of the run to the audit log
+// spreadsheet. Rows are only appended, so the sheet may be sorted or
+// filtered by hand.
+func appendAuditLog(sht *sheets.Service, drv *drive.Service, targetTime time.Time, spreadsheets []*SpreadsheetConfig, workDaysBySpreadsheet map[string][]WorkDay, errs []error, skipped []bool, files *reservedFiles, config *Config) error {
+	operator := getAuditOperator(drv)
+	rows := make([][]interface{}, 0, len(spreadsheets))
+	now := time.Now().Format(time.RFC3339)
+	month := targetTime.Format("2006-01")
+	for i, sc := range spreadsheets {
+		action, detail := auditUpdated, ""
+		switch record := files.records[sc.ID]; {
+		case skipped[i]:
+			action, detail = auditSkipped, errs[i].Error()
+		case errs[i] != nil:
+			action, detail = auditFailed, errs[i].Error()
+		case exportOnly:
+			action = auditExported
+		case record != nil && record.revision > 0:
+			action, detail = auditRevised, fmt.Sprintf("rev%d", record.revision)
+			if record.revisionOf != "" {
+				detail += " of " + record.revisionOf
+				if record.invoiceNumber != record.revisionOf {
+					detail += " as " + record.invoiceNumber
+				}
+			}
+		case record != nil && record.createdSheet:
+			action = auditCreated
+		}
+		rows = append(rows, []interface{}{now, version, month, sc.ID, action, len(workDaysBySpreadsheet[sc.ID]), operator, detail})
+	}
+	return appendAuditRows(sht, rows, config)
+}
+
+// Returns the email address of the user running the tool, or "" if it
+// can't be got
+func getAuditOperator(drv *drive.Service) string {
+	operator := ""
+	if err := callAPI("get user", func(ctx context.Context) error {
+		about, err := drv.About.Get().Fields("user(emailAddress)").Context(ctx).Do()
+		if err == nil && about.User != nil {
+			operator = about.User.EmailAddress
+		}
+		return err
+	}); err != nil {
+		logWarnf(log.Default(), "Warning: failed to get the user for the audit log: %v\n", err)
+	}
+	return operator
+}
+
+// Appends the rows to the audit log, with the header if the sheet is empty
+func appendAuditRows(sht *sheets.Service, rows [][]interface{}, config *Config) error {
+	sheetRange, headerRange := "A:H", "A1:H1"
+	if config.AuditLogSheetName != "" {
+		sheetRange = timesheet.QuoteSheetTitle(config.AuditLogSheetName) + "!" + sheetRange
+		headerRange = timesheet.QuoteSheetTitle(config.AuditLogSheetName) + "!" + headerRange
+	}
+	var first *sheets.ValueRange
+	if err := callAPI("get audit log header", func(ctx context.Context) (err error) {
+		first, err = sht.Spreadsheets.Values.Get(config.AuditLogSpreadsheetID, headerRange).Fields("values").Context(ctx).Do()
+		return
+	}); err != nil {
+		return err
+	}
+	n := len(rows)
+	if len(first.Values) == 0 {
+		rows = append([][]interface{}{auditLogHeader}, rows...)
+	}
+
+	if err := callAPI("append audit log", func(ctx context.Context) error {
+		_, err := sht.Spreadsheets.Values.Append(config.AuditLogSpreadsheetID, sheetRange, &sheets.ValueRange{Values: rows}).
+			ValueInputOption("RAW").
+			InsertDataOption("INSERT_ROWS").
+			Context(ctx).Do()
+		return err
+	}); err != nil {
+		return err
+	}
+	log.Printf("Appended %d rows to the audit log\n", n)
+	return nil
+}
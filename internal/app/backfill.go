@@ -0,0 +1,428 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// "make-invoices backfill --from 202201 --to 202404" reads the month sheets
+// made before the tool was used, by the layout of the config, into the
+// state as the months made, with their invoice numbers, so that the
+// anomalies and the invoice numbers continue from them. The months are
+// appended to the audit log, and to the summary spreadsheet with --summary.
+// Nothing is written to the spreadsheets of the timesheets. Sheets which
+// can't be read are listed and skipped, and months in the state already are
+// kept unless --overwrite.
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := fs.String("from", "", "first month to read like 202201")
+	to := fs.String("to", "last", "last month to read like 202404")
+	summary := fs.Bool("summary", false, "add the months to the summary spreadsheet too")
+	overwrite := fs.Bool("overwrite", false, "replace the months in the state already")
+	fs.BoolVar(&dryRun, "dry-run", false, "print what would be recorded without recording it")
+	fs.Parse(args)
+	if *from == "" {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices backfill --from <month> [--to <month>] [--summary] [--overwrite] [--dry-run]")
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if *summary && config.SummarySpreadsheetID == "" {
+		return newRunError(exitConfigError, "config", "--summary needs summary_spreadsheet_id in the config")
+	}
+	loc, err := config.GetLocation()
+	if err != nil {
+		return fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	first, err := parseMonthArg(*from, time.Now(), loc)
+	if err != nil {
+		return newRunError(exitConfigError, "config", "Failed to parse --from: %v", err)
+	}
+	last, err := parseMonthArg(*to, time.Now(), loc)
+	if err != nil {
+		return newRunError(exitConfigError, "config", "Failed to parse --to: %v", err)
+	}
+	if last.Before(first) {
+		return newRunError(exitConfigError, "config", "--to %s is before --from %s", last.Format("200601"), first.Format("200601"))
+	}
+
+	ctx := context.Background()
+	client, err := createScopedAPIClient(ctx, config, []string{sheets.SpreadsheetsScope, drive.DriveScope})
+	if err != nil {
+		return err
+	}
+	// Only the audit log and the summary spreadsheet may be written
+	writable := map[string]bool{config.AuditLogSpreadsheetID: true}
+	if *summary {
+		writable[config.SummarySpreadsheetID] = true
+	}
+	delete(writable, "")
+	client.Transport = &readOnlyTransport{base: client.Transport, writable: writable}
+	sht, err := sheets.NewService(ctx, getServiceOptions(client, "")...)
+	if err != nil {
+		return fmt.Errorf("Failed to create sheets client: %v", err)
+	}
+	drv, err := drive.NewService(ctx, getServiceOptions(client, "drive/v3/")...)
+	if err != nil {
+		return fmt.Errorf("Failed to create drive client: %v", err)
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("Failed to load state: %v", err)
+	}
+	months := make([]*backfilledMonth, 0)
+	failed := make([]string, 0)
+	for _, sc := range config.GetSpreadsheets() {
+		spreadsheet, err := getSpreadsheet(sht, sc.ID, spreadsheetRunFields)
+		if err != nil {
+			return fmt.Errorf("Failed to get spreadsheet %s: %v", sc.ID, err)
+		}
+		monthSpreadsheet := spreadsheet
+		if sc.TemplateSheet != "" {
+			monthSpreadsheet = timesheet.WithoutSheet(spreadsheet, sc.TemplateSheet)
+		}
+		monthSheets, err := timesheet.MonthSheets(monthSpreadsheet, loc)
+		if err != nil {
+			return fmt.Errorf("Failed to find month sheets of spreadsheet %s: %v", sc.ID, err)
+		}
+		for t := first; !t.After(last); t = t.AddDate(0, 1, 0) {
+			month := t.Format("200601")
+			sheet, ok := monthSheets[month]
+			if !ok {
+				continue
+			}
+			if _, ok := state.Completed[month][sc.ID]; ok && !*overwrite {
+				log.Printf("Kept %s of %s recorded in the state already\n", month, spreadsheet.Properties.Title)
+				continue
+			}
+			m, err := readBackfilledMonth(sht, spreadsheet, sheet.Properties.Title, sc, t, config)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s %s: %v", spreadsheet.Properties.Title, sheet.Properties.Title, err))
+				continue
+			}
+			log.Printf("Read %s of %s: %d days, %s hours, invoice %q\n", month, m.record.title, m.record.workDays, m.record.hours, m.record.invoiceNumber)
+			months = append(months, m)
+		}
+	}
+	if len(failed) > 0 {
+		logWarnf(log.Default(), "Skipped sheets which can't be read:\n%s", strings.Join(failed, "\n"))
+	}
+	if dryRun {
+		log.Printf("Done (dry run): %d months would be recorded\n", len(months))
+		return nil
+	}
+	if len(months) == 0 {
+		log.Println("No months to record")
+		return nil
+	}
+
+	if err := saveBackfilledMonths(months, config); err != nil {
+		return fmt.Errorf("Failed to save state: %v", err)
+	}
+	log.Printf("Recorded %d months in the state\n", len(months))
+	if config.AuditLogSpreadsheetID != "" {
+		operator := getAuditOperator(drv)
+		now := time.Now().Format(time.RFC3339)
+		rows := make([][]interface{}, 0, len(months))
+		for _, m := range months {
+			rows = append(rows, []interface{}{now, version, m.month.Format("2006-01"), m.spreadsheetID, auditBackfilled, m.record.workDays, operator, "sheet " + m.sheetTitle})
+		}
+		if err := appendAuditRows(sht, rows, config); err != nil {
+			return fmt.Errorf("Failed to append to the audit log: %v", err)
+		}
+	}
+	if *summary {
+		// The summary spreadsheet is updated a month at a time, as by runs
+		sort.SliceStable(months, func(i, j int) bool { return months[i].month.Before(months[j].month) })
+		for i := 0; i < len(months); {
+			j := i
+			spreadsheets := make([]*SpreadsheetConfig, 0)
+			files := &reservedFiles{records: make(map[string]*spreadsheetRecord), billing: make(map[string]*billingAmount)}
+			for ; j < len(months) && months[j].month.Equal(months[i].month); j++ {
+				spreadsheets = append(spreadsheets, &SpreadsheetConfig{ID: months[j].spreadsheetID})
+				files.records[months[j].spreadsheetID] = months[j].record
+				if months[j].amount != nil {
+					files.billing[months[j].spreadsheetID] = months[j].amount
+				}
+			}
+			if err := updateSummarySpreadsheet(sht, months[i].month, spreadsheets, make([]error, len(spreadsheets)), files, config); err != nil {
+				return fmt.Errorf("Failed to update the summary spreadsheet: %v", err)
+			}
+			i = j
+		}
+	}
+	return nil
+}
+
+// backfilledMonth is a month sheet made before the tool, read back
+type backfilledMonth struct {
+	spreadsheetID string
+	sheetTitle    string
+	month         time.Time
+	record        *spreadsheetRecord
+	// Billing computed from the days, which is nil without billing or if
+	// the amount cell of the sheet doesn't agree
+	amount *billingAmount
+}
+
+// Reads the work of the month sheet by the layout of the config. The work
+// days are the ones having a time in the work times column, or else a
+// fraction, and totals in the summary cells are taken over the days read.
+func readBackfilledMonth(sht *sheets.Service, spreadsheet *sheets.Spreadsheet, sheetTitle string, sc *SpreadsheetConfig, targetTime time.Time, config *Config) (*backfilledMonth, error) {
+	spreadsheetID := spreadsheet.SpreadsheetId
+	period := getBillingPeriod(config.ForSpreadsheet(sc), targetTime)
+	dateCell, err := timesheet.ResolveA1Range(config.GetDateCell(), spreadsheet.NamedRanges)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve date cell: %v", err)
+	}
+	if err := checkSheetMonth(sht, spreadsheetID, sheetTitle, dateCell, period, targetTime); err != nil {
+		return nil, err
+	}
+	_, columnRuns, err := getColumnRuns(config, spreadsheet.NamedRanges, period.days(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(columnRuns["work times"]) == 0 {
+		return nil, fmt.Errorf("no work times column")
+	}
+
+	// Cells are read unformatted, as times are serial numbers whatever
+	// their formats
+	ranges := make([]string, 0)
+	for _, name := range []string{"work times", "work end times", "work day fractions"} {
+		for _, run := range columnRuns[name] {
+			ranges = append(ranges, run.Range)
+		}
+	}
+	cells := make([]string, 0)
+	if config.Summary != nil {
+		cells = append(cells, config.Summary.TotalDaysCell, config.Summary.TotalHoursCell)
+	} else {
+		cells = append(cells, "", "")
+	}
+	cells = append(cells, config.InvoiceNumberCell, sc.AmountCell)
+	for i, c := range cells {
+		if c == "" {
+			continue
+		}
+		if cells[i], err = timesheet.ResolveA1Range(c, spreadsheet.NamedRanges); err != nil {
+			return nil, fmt.Errorf("failed to resolve cell %s: %v", c, err)
+		}
+		ranges = append(ranges, cells[i])
+	}
+	values, err := getRenderedRangeValues(sht, spreadsheetID, sheetTitle, ranges, "UNFORMATTED_VALUE")
+	if err != nil {
+		return nil, err
+	}
+	valueOf := func(rng string, i int) interface{} {
+		for k, r := range ranges {
+			if r == rng && i < len(values[k]) && len(values[k][i]) > 0 {
+				return values[k][i][0]
+			}
+		}
+		return nil
+	}
+
+	rows := make([]dayRow, period.days())
+	for _, name := range []string{"work times", "work end times", "work day fractions"} {
+		for _, run := range columnRuns[name] {
+			for i := 0; i < run.Count; i++ {
+				v := valueOf(run.Range, i)
+				if v == nil || fmt.Sprint(v) == "" {
+					continue
+				}
+				r := &rows[run.First+i]
+				switch name {
+				case "work times":
+					if clock, ok := parseBackfillClock(v); ok {
+						r.Start = clock
+					} else {
+						// Leave is in the work times column without a column
+						// of its own
+						r.Start, r.onLeave = fmt.Sprint(v), true
+					}
+				case "work end times":
+					clock, ok := parseBackfillClock(v)
+					if !ok {
+						return nil, fmt.Errorf("end time of %s is not a time: %v", period.day(run.First+i).Format("2006-01-02"), v)
+					}
+					r.End = clock
+				case "work day fractions":
+					r.Fraction = fmt.Sprint(v)
+				}
+			}
+		}
+	}
+	for i := range rows {
+		if rows[i].Start == "" && rows[i].End != "" {
+			return nil, fmt.Errorf("%s has an end time without a start time", period.day(i).Format("2006-01-02"))
+		}
+	}
+	breaks, err := getBreakPolicy(config, sc)
+	if err != nil {
+		return nil, err
+	}
+	workDays, _ := strconv.Atoi(countWorkDays(rows))
+	if workDays == 0 {
+		return nil, fmt.Errorf("no work days found")
+	}
+	hours, err := sumWorkHours(rows, breaks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Totals of the sheet are the ones invoiced, so they are taken over the
+	// days read, with a warning
+	if v, ok := valueOf(cells[0], 0).(float64); ok && int(v) != workDays {
+		logWarnf(log.Default(), "Warning: %s has %d work days in %s, while %d days are read\n", sheetTitle, int(v), cells[0], workDays)
+		workDays = int(v)
+	}
+	if v, ok := valueOf(cells[1], 0).(float64); ok && fmt.Sprint(v) != hours {
+		logWarnf(log.Default(), "Warning: %s has %v hours in %s, while %s hours are read\n", sheetTitle, v, cells[1], hours)
+		hours = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	m := &backfilledMonth{
+		spreadsheetID: spreadsheetID,
+		sheetTitle:    sheetTitle,
+		month:         targetTime,
+		record: &spreadsheetRecord{
+			title:    spreadsheet.Properties.Title,
+			workDays: workDays,
+			hours:    hours,
+		},
+	}
+	if v := valueOf(cells[2], 0); v != nil {
+		m.record.invoiceNumber = strings.TrimSpace(fmt.Sprint(v))
+	}
+
+	billing := config.GetBilling(sc)
+	if billing == nil {
+		return m, nil
+	}
+	cur, err := getCurrency(config, sc)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := computeBilling(billing, rows, period, breaks, config.EventKinds, config.GetTax(sc), cur)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute billing: %v", err)
+	}
+	if v, ok := valueOf(cells[3], 0).(float64); ok {
+		if computed, _ := strconv.ParseFloat(cur.formatNumber(amount.Subtotal), 64); math.Abs(v-computed) > 1e-6 {
+			logWarnf(log.Default(), "Warning: %s has %v in %s, while the days read bill %s; amounts are not recorded\n", sheetTitle, v, cells[3], cur.format(amount.Subtotal))
+			return m, nil
+		}
+	}
+	m.amount = amount
+	return m, nil
+}
+
+// Returns a time cell read unformatted as a time of the day like "9:30",
+// the cell having a serial number or the text of a time
+func parseBackfillClock(v interface{}) (string, bool) {
+	var d time.Duration
+	switch v := v.(type) {
+	case float64:
+		if v < 0 || v >= 2 {
+			return "", false
+		}
+		d = time.Duration(math.Round(v*24*60)) * time.Minute
+	case string:
+		parts := strings.Split(strings.TrimSpace(v), ":")
+		if len(parts) == 3 {
+			parts = parts[:2]
+		}
+		var err error
+		if d, err = parseClock(strings.Join(parts, ":")); err != nil {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	return fmt.Sprintf("%d:%02d", int(d.Hours()), int(d.Minutes())%60), true
+}
+
+// Records the months as completed in the state, with their invoice numbers.
+// Numbers assigned already to other months are left out with a warning.
+func saveBackfilledMonths(months []*backfilledMonth, config *Config) error {
+	return updateState(func(state *State) error {
+		if state.Completed == nil {
+			state.Completed = make(map[string]map[string]*CompletedSpreadsheet)
+		}
+		for _, m := range months {
+			month := m.month.Format("200601")
+			if state.Completed[month] == nil {
+				state.Completed[month] = make(map[string]*CompletedSpreadsheet)
+			}
+			workDays := m.record.workDays
+			c := &CompletedSpreadsheet{Title: m.record.title, At: time.Now(), WorkDays: &workDays, Backfilled: true}
+			if hours, err := strconv.ParseFloat(m.record.hours, 64); err == nil {
+				c.Hours = &hours
+			}
+			if m.amount != nil {
+				total := m.amount.Total
+				c.Total, c.Currency = &total, m.amount.Currency.code
+			}
+			state.Completed[month][m.spreadsheetID] = c
+		}
+
+		for _, m := range months {
+			if m.record.invoiceNumber == "" {
+				continue
+			}
+			if state.InvoiceSequence == nil {
+				seq, err := newInvoiceSequence(state, config, m.month.Location())
+				if err != nil {
+					return err
+				}
+				state.InvoiceSequence = seq
+			}
+			seq := state.InvoiceSequence
+			month := m.month.Format("200601")
+			key := m.spreadsheetID + "/" + month
+			if a, ok := seq.Assigned[key]; ok {
+				if a.Number != m.record.invoiceNumber {
+					logWarnf(log.Default(), "Warning: kept invoice number %s of %s of spreadsheet %s, while the sheet has %s\n", a.Number, month, m.spreadsheetID, m.record.invoiceNumber)
+				}
+				continue
+			}
+			taken := false
+			for _, a := range seq.Assigned {
+				if a.Number == m.record.invoiceNumber {
+					logWarnf(log.Default(), "Warning: invoice number %s of %s of spreadsheet %s is assigned to %s of spreadsheet %s already\n", a.Number, month, m.spreadsheetID, a.Month, a.SpreadsheetID)
+					taken = true
+					break
+				}
+			}
+			if taken {
+				continue
+			}
+			n, _ := parseInvoiceSeq(m.record.invoiceNumber)
+			seq.Assigned[key] = &InvoiceAssignment{
+				SpreadsheetID: m.spreadsheetID,
+				Month:         month,
+				Seq:           n,
+				Number:        m.record.invoiceNumber,
+				AssignedAt:    time.Now(),
+			}
+			if y := seq.yearKey(config, m.month); n > seq.Last[y] {
+				seq.Last[y] = n
+			}
+		}
+		return nil
+	})
+}
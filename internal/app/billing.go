@@ -0,0 +1,136 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// billingAmount is the result of billing the rows of a month
+type billingAmount struct {
+	// Amounts are in the minor units of the currency
+	Currency *currency
+	Rate     int64
+	RateUnit string
+	// Days, hours or months billed
+	Quantity string
+	Subtotal int64
+	// Consumption tax and withholding tax, which are zero without tax
+	// settings, and the amount billed after them
+	Tax         int64
+	Withholding int64
+	Total       int64
+}
+
+// Rounds the minutes to multiples of the unit
+func roundMinutes(minutes, unit int64, mode string) int64 {
+	switch mode {
+	case "up":
+		return (minutes + unit - 1) / unit * unit
+	case "down":
+		return minutes / unit * unit
+	case "nearest":
+		// Halves are rounded up
+		return (minutes + unit/2) / unit * unit
+	}
+	return minutes
+}
+
+// Computes the billable quantity and the amounts from the rows of the days of
+// the period. Days of event kinds having rates are billed at them. tax may
+// be nil.
+func computeBilling(b *BillingConfig, rows []dayRow, period billingPeriod, breaks *breakPolicy, kinds []*EventKind, tax *TaxConfig, cur *currency) (*billingAmount, error) {
+	amount, err := computeSubtotal(b, rows, period, breaks, kinds)
+	if err != nil {
+		return nil, err
+	}
+	amount.Currency = cur
+	amount.Total = amount.Subtotal
+	if tax != nil {
+		applyTax(tax, amount)
+	}
+	return amount, nil
+}
+
+// Returns the rate of the day of the row, the one of its event kind if any
+func rateOf(b *BillingConfig, r dayRow, weekday time.Weekday, kinds []*EventKind) int64 {
+	if k := findEventKind(kinds, r.Kind); k != nil && k.Rate != nil {
+		return *k.Rate
+	}
+	return b.Rate.Get(weekday)
+}
+
+func computeSubtotal(b *BillingConfig, rows []dayRow, period billingPeriod, breaks *breakPolicy, kinds []*EventKind) (*billingAmount, error) {
+	rate := b.Rate.DefaultRate()
+	switch b.RateUnit {
+	case "per_day":
+		days, err := strconv.ParseInt(countWorkDays(rows), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		subtotal := rate * days
+		if hasEventKindRates(kinds) {
+			subtotal = 0
+			for i := 0; i < len(rows) && i < period.days(); i++ {
+				if isWorkRow(rows[i]) {
+					subtotal += rateOf(b, rows[i], period.day(i).Weekday(), kinds)
+				}
+			}
+		}
+		return &billingAmount{
+			Rate:     rate,
+			RateUnit: b.RateUnit,
+			Quantity: strconv.FormatInt(days, 10),
+			Subtotal: subtotal,
+		}, nil
+	case "per_month":
+		return &billingAmount{
+			Rate:     rate,
+			RateUnit: b.RateUnit,
+			Quantity: "1",
+			Subtotal: rate,
+		}, nil
+	}
+
+	total, err := sumWorkDuration(rows, breaks)
+	if err != nil {
+		return nil, err
+	}
+	minutes := int64(total / time.Minute)
+	if minutes == 0 && countWorkDays(rows) != "0" {
+		return nil, fmt.Errorf("per_hour rate needs start and end times of the work days")
+	}
+	// Rate times minutes of the days, which are billed at the rates of their
+	// weekdays or event kinds
+	worked, rated := minutes, rate*minutes
+	if b.Rate.ByWeekday() || hasEventKindRates(kinds) {
+		rated = 0
+		for i := 0; i < len(rows) && i < period.days(); i++ {
+			d, err := sumWorkDuration(rows[i:i+1], breaks)
+			if err != nil {
+				return nil, err
+			}
+			rated += rateOf(b, rows[i], period.day(i).Weekday(), kinds) * int64(d/time.Minute)
+		}
+	}
+	if b.HoursRounding != "none" {
+		unit, err := b.RoundingUnit()
+		if err != nil {
+			return nil, err
+		}
+		minutes = roundMinutes(minutes, int64(unit/time.Minute), b.HoursRounding)
+	}
+	if b.MinHours != nil && minutes < int64(*b.MinHours*60) {
+		minutes = int64(*b.MinHours * 60)
+	}
+	if b.MaxHours != nil && minutes > int64(*b.MaxHours*60) {
+		minutes = int64(*b.MaxHours * 60)
+	}
+	return &billingAmount{
+		Rate:     rate,
+		RateUnit: b.RateUnit,
+		Quantity: strconv.FormatFloat(float64(minutes)/60, 'f', -1, 64),
+		// Fractions of a minor unit are rounded half up
+		Subtotal: (rated + rate*(minutes-worked) + 30) / 60,
+	}, nil
+}
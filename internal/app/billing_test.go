@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRoundMinutes(t *testing.T) {
+	tests := []struct {
+		minutes, unit int64
+		// Minutes rounded up, down and to the nearest
+		up, down, nearest int64
+	}{
+		{0, 30, 0, 0, 0},
+		{60, 30, 60, 60, 60},
+		{61, 30, 90, 60, 60},
+		{74, 30, 90, 60, 60},
+		// Halves are rounded up to the nearest
+		{75, 30, 90, 60, 90},
+		{76, 30, 90, 60, 90},
+		{89, 30, 90, 60, 90},
+		{90, 30, 90, 90, 90},
+		// Units of odd minutes have no halves
+		{67, 15, 75, 60, 60},
+		{68, 15, 75, 60, 75},
+		{1, 1, 1, 1, 1},
+	}
+	for _, tt := range tests {
+		for mode, want := range map[string]int64{"up": tt.up, "down": tt.down, "nearest": tt.nearest, "none": tt.minutes} {
+			if got := roundMinutes(tt.minutes, tt.unit, mode); got != want {
+				t.Errorf("%d minutes by %d %s: got %d, want %d", tt.minutes, tt.unit, mode, got, want)
+			}
+		}
+	}
+}
+
+// Tells the hours billed by each rounding around the half of a unit, and
+// that fractions of a minor unit are rounded half up
+func TestComputeSubtotalRounding(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	config := &Config{}
+	period := getBillingPeriod(config, time.Date(2024, 5, 1, 0, 0, 0, 0, loc))
+	breaks, err := getBreakPolicy(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	billing := func(rate, rounding string) *BillingConfig {
+		b := &BillingConfig{RateUnit: "per_hour", HoursRounding: rounding, HoursRoundingUnit: "30m"}
+		if err := json.Unmarshal([]byte(rate), &b.Rate); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	tests := []struct {
+		rate, rounding, end string
+		quantity            string
+		subtotal            int64
+	}{
+		{"3000", "up", "10:14", "1.5", 4500},
+		{"3000", "up", "10:15", "1.5", 4500},
+		{"3000", "up", "10:00", "1", 3000},
+		{"3000", "down", "10:15", "1", 3000},
+		{"3000", "down", "10:29", "1", 3000},
+		{"3000", "nearest", "10:14", "1", 3000},
+		{"3000", "nearest", "10:15", "1.5", 4500},
+		{"3000", "nearest", "10:16", "1.5", 4500},
+		{"3000", "none", "10:15", "1.25", 3750},
+		// 0.48, 0.5 and 1.5 of a minor unit
+		{"1", "none", "9:29", "0.48333333333333334", 0},
+		{"1", "none", "9:30", "0.5", 1},
+		{"1", "none", "10:30", "1.5", 2},
+		{"1", "none", "10:29", "1.4833333333333334", 1},
+	}
+	for _, tt := range tests {
+		rows := []dayRow{{Start: "9:00", End: tt.end}}
+		amount, err := computeSubtotal(billing(tt.rate, tt.rounding), rows, period, breaks, nil)
+		if err != nil {
+			t.Errorf("%s %s to %s: %v", tt.rate, tt.rounding, tt.end, err)
+			continue
+		}
+		if amount.Quantity != tt.quantity || amount.Subtotal != tt.subtotal {
+			t.Errorf("%s %s to %s: got %s hours for %d, want %s hours for %d", tt.rate, tt.rounding, tt.end, amount.Quantity, amount.Subtotal, tt.quantity, tt.subtotal)
+		}
+	}
+}
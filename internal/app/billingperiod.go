@@ -0,0 +1,75 @@
+package app
+
+import (
+	"time"
+)
+
+// billingPeriod is the days billed for a month, from start until end
+// (exclusive). The rows of the day columns are the days of the period.
+type billingPeriod struct {
+	start time.Time
+	end   time.Time
+}
+
+// Returns the day of the month, or the last day of the month if it is
+// shorter, e.g. day 31 of April is 04-30
+func getClampedDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// Returns the billing period of the month of targetTime
+func getBillingPeriod(c *Config, targetTime time.Time) billingPeriod {
+	loc := targetTime.Location()
+	monthStart := time.Date(targetTime.Year(), targetTime.Month(), 1, 0, 0, 0, 0, loc)
+	if c.BillingPeriod == nil || c.BillingPeriod.StartDay <= 1 {
+		return billingPeriod{start: monthStart, end: monthStart.AddDate(0, 1, 0)}
+	}
+	prev := monthStart.AddDate(0, -1, 0)
+	return billingPeriod{
+		start: getClampedDate(prev.Year(), prev.Month(), c.BillingPeriod.StartDay, loc),
+		end:   getClampedDate(monthStart.Year(), monthStart.Month(), c.BillingPeriod.StartDay, loc),
+	}
+}
+
+// Returns whether the period is a calendar month
+func (p billingPeriod) isMonth() bool {
+	return p.start.Day() == 1 && p.end.Equal(p.start.AddDate(0, 1, 0))
+}
+
+// Returns the number of days in the period
+func (p billingPeriod) days() int {
+	n := 0
+	for d := p.start; d.Before(p.end); d = d.AddDate(0, 0, 1) {
+		n++
+	}
+	return n
+}
+
+// Returns the i-th day of the period, from 0
+func (p billingPeriod) day(i int) time.Time {
+	return p.start.AddDate(0, 0, i)
+}
+
+// Returns whether the date of t is in the period
+func (p billingPeriod) contains(t time.Time) bool {
+	t = t.In(p.start.Location())
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, p.start.Location())
+	return !d.Before(p.start) && d.Before(p.end)
+}
+
+// Returns the key of the period in caches, which is the month like "200601"
+// for calendar months
+func (p billingPeriod) key() string {
+	if p.isMonth() {
+		return p.start.Format("200601")
+	}
+	return p.start.Format("20060102") + "-" + p.end.Format("20060102")
+}
+
+// Returns the first and the last day like "2006-01-02 to 2006-01-31"
+func (p billingPeriod) String() string {
+	return p.start.Format("2006-01-02") + " to " + p.end.AddDate(0, 0, -1).Format("2006-01-02")
+}
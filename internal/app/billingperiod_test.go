@@ -0,0 +1,106 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetBillingPeriod(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	tests := []struct {
+		name     string
+		startDay int
+		month    time.Time
+		want     string
+		days     int
+		key      string
+	}{
+		{"calendar month", 0, time.Date(2024, 2, 10, 0, 0, 0, 0, loc), "2024-02-01 to 2024-02-29", 29, "202402"},
+		{"start day 1", 1, time.Date(2023, 2, 1, 0, 0, 0, 0, loc), "2023-02-01 to 2023-02-28", 28, "202302"},
+		{"start day 16", 16, time.Date(2024, 5, 1, 0, 0, 0, 0, loc), "2024-04-16 to 2024-05-15", 30, "20240416-20240516"},
+		{"over the year", 21, time.Date(2024, 1, 1, 0, 0, 0, 0, loc), "2023-12-21 to 2024-01-20", 31, "20231221-20240121"},
+		// The periods starting on the 31st start on the last day of shorter
+		// months
+		{"start day 31 ending in February", 31, time.Date(2023, 2, 1, 0, 0, 0, 0, loc), "2023-01-31 to 2023-02-27", 28, "20230131-20230228"},
+		{"start day 31 after February", 31, time.Date(2023, 3, 1, 0, 0, 0, 0, loc), "2023-02-28 to 2023-03-30", 31, "20230228-20230331"},
+		{"start day 31 ending in a leap February", 31, time.Date(2024, 2, 1, 0, 0, 0, 0, loc), "2024-01-31 to 2024-02-28", 29, "20240131-20240229"},
+		{"start day 31 after a leap February", 31, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), "2024-02-29 to 2024-03-30", 31, "20240229-20240331"},
+		{"start day 30 after February", 30, time.Date(2023, 3, 1, 0, 0, 0, 0, loc), "2023-02-28 to 2023-03-29", 30, "20230228-20230330"},
+		{"start day 31 after April", 31, time.Date(2023, 5, 1, 0, 0, 0, 0, loc), "2023-04-30 to 2023-05-30", 31, "20230430-20230531"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			if tt.startDay > 0 {
+				config.BillingPeriod = &BillingPeriodConfig{StartDay: tt.startDay}
+			}
+			p := getBillingPeriod(config, tt.month)
+			if got := p.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if got := p.days(); got != tt.days {
+				t.Errorf("got %d days, want %d", got, tt.days)
+			}
+			if got := p.key(); got != tt.key {
+				t.Errorf("got key %s, want %s", got, tt.key)
+			}
+			if got := p.day(p.days()-1).AddDate(0, 0, 1); !got.Equal(p.end) {
+				t.Errorf("last day is not before the end")
+			}
+		})
+	}
+}
+
+// Periods of consecutive months have every day once
+func TestGetBillingPeriodContiguous(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	for startDay := 1; startDay <= 31; startDay++ {
+		config := &Config{BillingPeriod: &BillingPeriodConfig{StartDay: startDay}}
+		prev := getBillingPeriod(config, time.Date(2023, 1, 1, 0, 0, 0, 0, loc))
+		for m := 2; m <= 26; m++ {
+			p := getBillingPeriod(config, time.Date(2023, time.Month(m), 1, 0, 0, 0, 0, loc))
+			if !p.start.Equal(prev.end) {
+				t.Fatalf("start day %d: %s does not follow %s", startDay, p, prev)
+			}
+			if p.days() < 28 || p.days() > 31 {
+				t.Fatalf("start day %d: %s has %d days", startDay, p, p.days())
+			}
+			prev = p
+		}
+	}
+}
+
+func TestBillingPeriodContains(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	p := getBillingPeriod((&Config{BillingPeriod: &BillingPeriodConfig{StartDay: 16}}), time.Date(2024, 5, 1, 0, 0, 0, 0, loc))
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2024, 4, 15, 23, 59, 0, 0, loc), false},
+		{time.Date(2024, 4, 16, 0, 0, 0, 0, loc), true},
+		{time.Date(2024, 5, 15, 23, 59, 0, 0, loc), true},
+		{time.Date(2024, 5, 16, 0, 0, 0, 0, loc), false},
+		// Times are compared by their dates in the location of the period
+		{time.Date(2024, 4, 15, 16, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 5, 15, 15, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := p.contains(tt.t); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestBillingPeriodConfigValidate(t *testing.T) {
+	for _, day := range []int{0, 32, -1} {
+		if err := (&BillingPeriodConfig{StartDay: day}).Validate(); err == nil {
+			t.Errorf("start day %d: want error", day)
+		}
+	}
+	for _, day := range []int{1, 15, 31} {
+		if err := (&BillingPeriodConfig{StartDay: day}).Validate(); err != nil {
+			t.Errorf("start day %d: %v", day, err)
+		}
+	}
+}
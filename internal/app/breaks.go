@@ -0,0 +1,81 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// Checks the rules, which are in ascending order of min_hours
+func validateBreakRules(rules []*BreakRule) error {
+	for i, r := range rules {
+		if r.MinHours < 0 {
+			return fmt.Errorf("min_hours must not be negative: %g", r.MinHours)
+		}
+		if r.DeductionMinutes < 0 {
+			return fmt.Errorf("deduction_minutes must not be negative: %d", r.DeductionMinutes)
+		}
+		if i > 0 && r.MinHours <= rules[i-1].MinHours {
+			return fmt.Errorf("rules must be in ascending order of min_hours: %g after %g", r.MinHours, rules[i-1].MinHours)
+		}
+	}
+	return nil
+}
+
+// breakPolicy is the break deducted from each work day in the hours, the
+// totals and hourly billing
+type breakPolicy struct {
+	// break_duration of summary, deducted from every day
+	fixed time.Duration
+	rules []*BreakRule
+}
+
+// Returns the break rules of the spreadsheet, or else the global ones, with
+// break_duration of summary. break_duration and break_rules can't be used
+// together.
+func getBreakPolicy(c *Config, sc *SpreadsheetConfig) (*breakPolicy, error) {
+	p := &breakPolicy{rules: c.BreakRules}
+	if sc != nil && len(sc.BreakRules) > 0 {
+		p.rules = sc.BreakRules
+	}
+	if c.Summary != nil && c.Summary.BreakDuration != "" {
+		d, err := time.ParseDuration(c.Summary.BreakDuration)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse break_duration: %v", err)
+		}
+		p.fixed = d
+	}
+	return p, nil
+}
+
+// Returns the break of a day spanning span. The rules are applied in order,
+// each one the span is over replacing the break of the ones before, so the
+// rule of the largest min_hours below the span wins.
+func (p *breakPolicy) of(span time.Duration) time.Duration {
+	if p == nil {
+		return 0
+	}
+	d := p.fixed
+	for _, r := range p.rules {
+		if span > time.Duration(r.MinHours*float64(time.Hour)) {
+			d = time.Duration(r.DeductionMinutes) * time.Minute
+		}
+	}
+	return d
+}
+
+// Returns the hours worked of a day from start to end less the break, and
+// the break
+func (p *breakPolicy) workDuration(start, end time.Duration) (worked, brk time.Duration) {
+	brk = p.of(end - start)
+	worked = end - start - brk
+	if worked < 0 {
+		worked = 0
+	}
+	return worked, brk
+}
+
+// Formats a break like "1:00" or "0:45"
+func formatBreak(d time.Duration) string {
+	m := int(d / time.Minute)
+	return fmt.Sprintf("%d:%02d", m/60, m%60)
+}
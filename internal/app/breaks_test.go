@@ -0,0 +1,62 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+// Tells the breaks of the contract rules, an hour over 6 hours and 45
+// minutes over 8, at a minute around each min_hours
+func TestBreakPolicyBoundaries(t *testing.T) {
+	p := &breakPolicy{rules: []*BreakRule{{MinHours: 6, DeductionMinutes: 60}, {MinHours: 8, DeductionMinutes: 45}}}
+	tests := []struct {
+		span        time.Duration
+		worked, brk time.Duration
+	}{
+		{5*time.Hour + 59*time.Minute, 5*time.Hour + 59*time.Minute, 0},
+		// A day of exactly min_hours has no break
+		{6 * time.Hour, 6 * time.Hour, 0},
+		{6*time.Hour + time.Minute, 5*time.Hour + 1*time.Minute, time.Hour},
+		{7*time.Hour + 59*time.Minute, 6*time.Hour + 59*time.Minute, time.Hour},
+		{8 * time.Hour, 7 * time.Hour, time.Hour},
+		{8*time.Hour + time.Minute, 7*time.Hour + 16*time.Minute, 45 * time.Minute},
+	}
+	for _, tt := range tests {
+		start := 9 * time.Hour
+		worked, brk := p.workDuration(start, start+tt.span)
+		if worked != tt.worked || brk != tt.brk {
+			t.Errorf("%s: got %s worked with %s break, want %s with %s", tt.span, worked, brk, tt.worked, tt.brk)
+		}
+	}
+
+	// The fixed break of break_duration is deducted below the rules
+	p.fixed = 30 * time.Minute
+	if brk := p.of(6 * time.Hour); brk != 30*time.Minute {
+		t.Errorf("6h with break_duration: got %s break, want 30m", brk)
+	}
+	if brk := (*breakPolicy)(nil).of(10 * time.Hour); brk != 0 {
+		t.Errorf("no policy: got %s break", brk)
+	}
+}
+
+// Tells the hours column and the totals of the days around 6 hours with
+// break_rules
+func TestSumWorkHoursBreakRules(t *testing.T) {
+	config := &Config{BreakRules: []*BreakRule{{MinHours: 6, DeductionMinutes: 60}}}
+	breaks, err := getBreakPolicy(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		end, hours string
+	}{
+		{"14:59", "5.983333333333333"},
+		{"15:00", "6"},
+		{"15:01", "5.016666666666667"},
+	} {
+		hours, err := sumWorkHours([]dayRow{{Start: "9:00", End: tt.end}}, breaks)
+		if err != nil || hours != tt.hours {
+			t.Errorf("9:00-%s: got %s hours (%v), want %s", tt.end, hours, err, tt.hours)
+		}
+	}
+}
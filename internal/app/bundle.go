@@ -0,0 +1,165 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+)
+
+// bundleFile is a file put into a bundle
+type bundleFile struct {
+	path  string
+	title string
+}
+
+// Returns the path of the file in the bundle by the layout
+func formatBundlePath(layout string, targetTime time.Time, f bundleFile) (string, error) {
+	tmpl, err := template.New("layout").Parse(layout)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse layout: %v", err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, struct {
+		Year  int
+		Month int
+		Title string
+		File  string
+	}{targetTime.Year(), int(targetTime.Month()), f.title, filepath.Base(f.path)}); err != nil {
+		return "", fmt.Errorf("failed to format layout: %v", err)
+	}
+	// Files of no spreadsheet, like the combined pdf, leave empty elements
+	name := path.Clean(strings.TrimLeft(b.String(), "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("layout gives invalid path %q for %s", b.String(), f.path)
+	}
+	return name, nil
+}
+
+// Writes the files into the zip by the layout. Every file must exist, so
+// that no bundle misses any of its files. The entries are sorted and dated
+// the first day of the month, so that the same files make the same zip.
+func writeBundle(zipPath, layout string, targetTime time.Time, files []bundleFile) error {
+	entries := make(map[string]string)
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("bundle %s misses %s: %v", zipPath, f.path, err)
+		}
+		name, err := formatBundlePath(layout, targetTime, f)
+		if err != nil {
+			return fmt.Errorf("bundle %s: %v", zipPath, err)
+		}
+		if other, ok := entries[name]; ok {
+			return fmt.Errorf("bundle %s has both %s and %s as %s", zipPath, other, f.path, name)
+		}
+		entries[name] = f.path
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	modified := time.Date(targetTime.Year(), targetTime.Month(), 1, 0, 0, 0, 0, time.UTC)
+	tmp := zipPath + ".tmp"
+	if err := writeZipFile(tmp, names, entries, modified); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write bundle %s: %v", zipPath, err)
+	}
+	if err := os.Rename(tmp, zipPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write bundle %s: %v", zipPath, err)
+	}
+	return nil
+}
+
+func writeZipFile(zipPath string, names []string, entries map[string]string, modified time.Time) error {
+	out, err := os.OpenFile(zipPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	for _, name := range names {
+		h := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified}
+		h.SetMode(0644)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(w, entries[name]); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Reserves the bundle of the spreadsheet, returning "" if there is none or
+// it is skipped by on_existing_output
+func reserveClientBundle(spreadsheetID, title, invoiceNumber string, revision int, targetTime time.Time, files *reservedFiles, config *Config, logger *log.Logger) (string, error) {
+	if config.Bundle == nil || config.Bundle.ClientName == "" {
+		return "", nil
+	}
+	name, err := export.FormatNameTemplate("bundle.client_name", config.Bundle.ClientName, targetTime, title, invoiceNumber)
+	if err != nil {
+		return "", err
+	}
+	name = export.SanitizeFilePath(name)
+	ext := filepath.Ext(name)
+	name = strings.TrimSuffix(name, ext) + revisionSuffix(revision) + ext
+	return files.reserveOutput(name, spreadsheetID, config.OnExistingOutput, logger)
+}
+
+// Makes the bundle of the spreadsheet of the outputs and the week files.
+// Every spreadsheet leaves its files for the month bundle, with or without
+// a bundle of its own.
+func makeClientBundle(spreadsheetID, title string, targetTime time.Time, clientBundle string, outputPaths map[string]string, weekFileNames []string, config *Config, files *reservedFiles, logger *log.Logger) error {
+	// Bundles have the files as they are after the run, the existing ones
+	// for skipped outputs
+	bundleFiles := make([]bundleFile, 0, len(outputPaths)+len(weekFileNames))
+	for key, p := range outputPaths {
+		if key != "zip" {
+			bundleFiles = append(bundleFiles, bundleFile{path: p, title: title})
+		}
+	}
+	for _, name := range weekFileNames {
+		if name != "" {
+			bundleFiles = append(bundleFiles, bundleFile{path: name, title: title})
+		}
+	}
+	files.mu.Lock()
+	files.bundleFiles[spreadsheetID] = bundleFiles
+	files.mu.Unlock()
+	if clientBundle == "" {
+		return nil
+	}
+	if err := writeBundle(clientBundle, config.Bundle.GetClientLayout(), targetTime, bundleFiles); err != nil {
+		return err
+	}
+	logger.Printf("Bundled %d files into %s\n", len(bundleFiles), clientBundle)
+	files.mu.Lock()
+	files.written = append(files.written, &outputFile{path: clientBundle, title: title, spreadsheetID: spreadsheetID})
+	files.mu.Unlock()
+	return nil
+}
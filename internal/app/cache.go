@@ -0,0 +1,95 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCalendarCacheTTL = time.Hour
+
+type calendarCacheEntry struct {
+	FetchedAt  time.Time `json:"fetched_at"`
+	ConfigHash string    `json:"config_hash"`
+	Days       []WorkDay `json:"days"`
+}
+
+// calendarCache keeps work days fetched from calendars per (calendar, month)
+// in the state so that repeated runs don't fetch them again
+type calendarCache struct {
+	ttl        time.Duration
+	refresh    bool
+	configHash string
+	entries    map[string]*calendarCacheEntry
+	hits       int
+	misses     int
+}
+
+// Set when caching is enabled
+var calCache *calendarCache
+
+func newCalendarCache(config *Config, ttl time.Duration, refresh bool) *calendarCache {
+	// Entries become stale when the settings deciding which events match change
+	h := sha256.New()
+	h.Write([]byte(config.WorkDayTitle + "\n"))
+	h.Write([]byte(strings.Join(config.GetCalendarIDs(), ",") + "\n"))
+	h.Write([]byte(config.HolidayCalendarID + "\n"))
+	h.Write([]byte(config.EventColorID + "\n"))
+	h.Write([]byte(config.RequiredAttendeeEmail + "\n"))
+	h.Write([]byte(strconv.FormatBool(config.SkipNeedsAction) + "\n"))
+	for _, r := range config.LocationRules {
+		h.Write([]byte(r.Pattern + "\n"))
+	}
+
+	c := &calendarCache{
+		ttl:        ttl,
+		refresh:    refresh,
+		configHash: hex.EncodeToString(h.Sum(nil)),
+		entries:    make(map[string]*calendarCacheEntry),
+	}
+	// The calendars are fetched without the cache if it can't be read
+	state, err := loadState()
+	if err != nil {
+		logWarnf(log.Default(), "Warning: ignoring calendar cache: %v\n", err)
+	} else if state.CalendarCache != nil {
+		c.entries = state.CalendarCache
+	}
+	return c
+}
+
+func (c *calendarCache) get(key string, loc *time.Location) ([]WorkDay, bool) {
+	e, ok := c.entries[key]
+	if c.refresh || !ok || e.ConfigHash != c.configHash || time.Since(e.FetchedAt) > c.ttl {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	days := make([]WorkDay, 0, len(e.Days))
+	for _, d := range e.Days {
+		d.Date = d.Date.In(loc)
+		days = append(days, d)
+	}
+	return days, true
+}
+
+func (c *calendarCache) put(key string, days []WorkDay) {
+	e := &calendarCacheEntry{
+		FetchedAt:  time.Now(),
+		ConfigHash: c.configHash,
+		Days:       days,
+	}
+	c.entries[key] = e
+	// The next run fetches the calendar again if the entry can't be saved
+	if err := updateState(func(state *State) error {
+		if state.CalendarCache == nil {
+			state.CalendarCache = make(map[string]*calendarCacheEntry)
+		}
+		state.CalendarCache[key] = e
+		return nil
+	}); err != nil {
+		logWarnf(log.Default(), "Warning: failed to save calendar cache: %v\n", err)
+	}
+}
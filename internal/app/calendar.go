@@ -0,0 +1,623 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/calendarsource"
+	"google.golang.org/api/calendar/v3"
+)
+
+// WorkDay is a day with work. Start and End hold the times of the event when
+// it has them and are zero for all-day events. Days of leave have the value
+// written for the leave in Leave. Days read from a work CSV have the hours of
+// the records summed in Worked.
+type WorkDay struct {
+	Date      time.Time
+	Start     time.Time
+	End       time.Time
+	Events    []*calendar.Event
+	Overrides EventOverrides
+	Location  string
+	Source    string
+	Leave     string
+	Worked    time.Duration
+	// Name of the event kind of the day, by the color of its first event
+	Kind string
+	// Number of work CSV records of the day
+	records int
+}
+
+// EventOverrides are key=value lines in an event description that change
+// how the event's day is written, e.g.
+//
+//	start=10:00
+//	end=19:30
+//	note=客先常駐
+//	skip=true
+type EventOverrides struct {
+	Start string
+	End   string
+	Note  string
+	Skip  bool
+}
+
+var overrideLinePattern = regexp.MustCompile(`^([A-Za-z_]+)\s*=\s*(.*)$`)
+var overrideTimePattern = regexp.MustCompile(`^([0-9]{1,2}):([0-5][0-9])$`)
+
+func parseEventOverrides(description string) (EventOverrides, error) {
+	var o EventOverrides
+	description = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n").Replace(description)
+	for _, line := range strings.Split(description, "\n") {
+		m := overrideLinePattern.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		key, value := strings.ToLower(m[1]), strings.TrimSpace(m[2])
+		switch key {
+		case "start", "end":
+			if !overrideTimePattern.MatchString(value) {
+				return o, fmt.Errorf("invalid %s time: %q", key, value)
+			}
+			if key == "start" {
+				o.Start = value
+			} else {
+				o.End = value
+			}
+		case "note":
+			o.Note = value
+		case "skip":
+			skip, err := strconv.ParseBool(value)
+			if err != nil {
+				return o, fmt.Errorf("invalid skip value: %q", value)
+			}
+			o.Skip = skip
+		default:
+			logVerbose("Warning: ignoring unknown key %q in event description\n", key)
+		}
+	}
+	return o, nil
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// Returns the note of the day, which is the note= override if any, or else
+// the first line of the event descriptions other than overrides. Notes
+// longer than maxLength characters are truncated with an ellipsis.
+func (d WorkDay) note(maxLength int) string {
+	note := d.Overrides.Note
+	for _, e := range d.Events {
+		if lines := getDescriptionLines(e); note == "" && len(lines) > 0 {
+			note = lines[0]
+		}
+	}
+	if r := []rune(note); maxLength > 0 && len(r) > maxLength {
+		note = string(r[:maxLength]) + "…"
+	}
+	return note
+}
+
+// Returns the lines of the event descriptions of the day other than
+// overrides, as plain text
+func (d WorkDay) description() string {
+	lines := make([]string, 0)
+	for _, e := range d.Events {
+		lines = append(lines, getDescriptionLines(e)...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the non-empty lines of the description of the event other than
+// overrides, without HTML tags
+func getDescriptionLines(e *calendar.Event) []string {
+	description := strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n").Replace(e.Description)
+	lines := make([]string, 0)
+	for _, line := range strings.Split(htmlTagPattern.ReplaceAllString(description, ""), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !overrideLinePattern.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (d WorkDay) duration() time.Duration {
+	if d.Worked > 0 {
+		return d.Worked
+	}
+	if d.Start.IsZero() || d.End.IsZero() {
+		return 0
+	}
+	return d.End.Sub(d.Start)
+}
+
+// All-day events always count as full days
+func (d WorkDay) isHalfDay(thresholdHours float64) bool {
+	if thresholdHours <= 0 || d.Start.IsZero() || d.End.IsZero() {
+		return false
+	}
+	return d.duration().Hours() < thresholdHours
+}
+
+// Events fetched in the run keyed by calendar and month, so that looking for
+// different kinds of events in a calendar fetches it only once
+var fetchedEvents = make(map[string][]*calendar.Event)
+var fetchedEventsMu sync.Mutex
+
+// Returns the lister of the events of Google calendars for the client,
+// which tests replace with a fake
+var newEventLister = func(ctx context.Context, client *http.Client) (calendarsource.EventLister, error) {
+	s, err := getSession(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return s.events, nil
+}
+
+// Returns the events of the calendar overlapping the billing period
+func fetchCalendarEvents(ctx context.Context, client *http.Client, calendarID string, period billingPeriod) ([]*calendar.Event, error) {
+	fetchedEventsMu.Lock()
+	defer fetchedEventsMu.Unlock()
+	key := calendarID + "/" + period.key()
+	if events, ok := fetchedEvents[key]; ok {
+		metrics.countCacheHit("calendar_events")
+		return events, nil
+	}
+
+	logVerbose("Fetching events of calendar %s in [%s, %s)\n", calendarID, period.start.Format(time.RFC3339), period.end.Format(time.RFC3339))
+	var events []*calendar.Event
+	if isICSSource(calendarID) {
+		var err error
+		events, err = calendarsource.ICS{}.ListEvents(ctx, calendarID, period.start, period.end)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read calendar items from %s: %w", calendarID, err)
+		}
+	} else {
+		lister, err := newEventLister(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		if err := callAPI("calendar events list", func(ctx context.Context) (err error) {
+			events, err = lister.ListEvents(ctx, calendarID, period.start, period.end)
+			return
+		}); err != nil {
+			return nil, fmt.Errorf("Failed to retrieve calendar items from %s: %w", calendarID, err)
+		}
+	}
+
+	fetchedEvents[key] = events
+	return events, nil
+}
+
+// Returns days of events in the calendar matching filter. kind names what is
+// being looked for and distinguishes cached results of the same calendar.
+func getCalendarSchedules(ctx context.Context, client *http.Client, calendarID string, period billingPeriod, kind string, filter func(*calendar.Event) bool) ([]WorkDay, error) {
+	cacheKey := calendarID + "/" + period.key() + "/" + kind
+	if calCache != nil {
+		if days, ok := calCache.get(cacheKey, period.start.Location()); ok {
+			return days, nil
+		}
+	}
+
+	events, err := fetchCalendarEvents(ctx, client, calendarID, period)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]WorkDay, 0)
+	for _, item := range events {
+		if filter != nil && !filter(item) {
+			continue
+		}
+
+		days, err := getEventDays(item, period.start.Location())
+		if err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			if !period.contains(day.Date) {
+				continue
+			}
+			day.Events = []*calendar.Event{item}
+			items = append(items, day)
+		}
+	}
+
+	items = mergeWorkDays(items)
+
+	if calCache != nil {
+		calCache.put(cacheKey, items)
+	}
+
+	return items, nil
+}
+
+// Merges work days having the same date into one, sorted by date. The merged
+// day spans from the earliest start to the latest end of its events.
+func mergeWorkDays(days []WorkDay) []WorkDay {
+	index := make(map[string]int)
+	merged := make([]WorkDay, 0, len(days))
+	for _, d := range days {
+		key := d.Date.Format("2006-01-02")
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, d)
+			continue
+		}
+		w := &merged[i]
+		for _, e := range d.Events {
+			// The same event may be found in several calendars
+			found := false
+			for _, we := range w.Events {
+				if e.Id != "" && e.Id == we.Id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				w.Events = append(w.Events, e)
+			}
+		}
+		if !d.Start.IsZero() && (w.Start.IsZero() || d.Start.Before(w.Start)) {
+			w.Start = d.Start
+		}
+		if !d.End.IsZero() && (w.End.IsZero() || d.End.After(w.End)) {
+			w.End = d.End
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Date.Before(merged[j].Date)
+	})
+	return merged
+}
+
+// Merges work days found in every configured calendar, counting each day once.
+func getWorkDays(ctx context.Context, client *http.Client, config *Config, targetTime time.Time) ([]WorkDay, error) {
+	excludedByColor, excludedByAttendee := 0, 0
+	// Filters other than the title, which apply to the near misses too
+	other := &calendarsource.Filter{ColorID: config.EventColorID, AttendeeEmail: config.RequiredAttendeeEmail, SkipNeedsAction: config.SkipNeedsAction}
+	matchesOtherFilters := func(e *calendar.Event) bool {
+		switch reason := other.Exclusion(e); reason {
+		case "":
+			return true
+		case calendarsource.ExcludedByColor:
+			excludedByColor++
+		case calendarsource.ExcludedByAttendee:
+			excludedByAttendee++
+		default:
+			logVerbose("Skipping event %q at %s (%s)\n", e.Summary, calendarsource.EventStartKey(e), reason)
+		}
+		return false
+	}
+	filter := func(e *calendar.Event) bool {
+		return config.MatchesWorkDayTitle(e.Summary) && matchesOtherFilters(e)
+	}
+
+	all := make([]WorkDay, 0)
+	period := getBillingPeriod(config, targetTime)
+	for _, calendarID := range config.GetCalendarIDs() {
+		days, err := getCalendarSchedules(ctx, client, calendarID, period, config.WorkEventKind(), filter)
+		if err != nil {
+			return nil, err
+		}
+		logVerbose("Found %d matching days in calendar %s\n", len(days), calendarID)
+		all = append(all, days...)
+		// Near misses are looked for in the events even when the work days
+		// are cached, and the ones counted are never cached, being for the
+		// run only
+		events, err := fetchCalendarEvents(ctx, client, calendarID, period)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range acceptNearMisses(events, calendarID, config, period.start.Location()) {
+			if !matchesOtherFilters(e) {
+				continue
+			}
+			eventDays, err := getEventDays(e, period.start.Location())
+			if err != nil {
+				return nil, err
+			}
+			for _, day := range eventDays {
+				if period.contains(day.Date) {
+					day.Events = []*calendar.Event{e}
+					all = append(all, day)
+				}
+			}
+		}
+	}
+	if config.EventColorID != "" {
+		log.Printf("Color filter excluded %d events\n", excludedByColor)
+	}
+	if config.RequiredAttendeeEmail != "" {
+		log.Printf("Attendee filter excluded %d events\n", excludedByAttendee)
+	}
+	workDays := mergeWorkDays(all)
+
+	// Report days having more than one event
+	eventCount, duplicated := 0, false
+	for _, d := range workDays {
+		eventCount += len(d.Events)
+		if len(d.Events) < 2 {
+			continue
+		}
+		duplicated = true
+		descs := make([]string, 0, len(d.Events))
+		for _, e := range d.Events {
+			desc := e.Summary
+			if e.Start.DateTime != "" {
+				desc += " " + e.Start.DateTime
+			}
+			descs = append(descs, fmt.Sprintf("%q", desc))
+		}
+		logWarnf(log.Default(), "Warning: %d work events on %s (using the earliest start and the latest end): %s\n", len(d.Events), d.Date.Format("2006-01-02"), strings.Join(descs, ", "))
+	}
+	log.Printf("Matched %d events on %d distinct days\n", eventCount, len(workDays))
+	if duplicated && strictDuplicates {
+		return nil, fmt.Errorf("Found multiple work events on the same day (strict duplicates mode)")
+	}
+
+	// Apply overrides in event descriptions
+	applied := make([]WorkDay, 0, len(workDays))
+	for _, d := range workDays {
+		for _, e := range d.Events {
+			o, err := parseEventOverrides(e.Description)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse description of event %q on %s: %v", e.Summary, d.Date.Format("2006-01-02"), err)
+			}
+			if o.Start != "" {
+				d.Overrides.Start = o.Start
+			}
+			if o.End != "" {
+				d.Overrides.End = o.End
+			}
+			if o.Note != "" {
+				d.Overrides.Note = o.Note
+			}
+			d.Overrides.Skip = d.Overrides.Skip || o.Skip
+		}
+		if d.Overrides.Skip {
+			log.Printf("Skipping %s (skip=true in event description)\n", d.Date.Format("2006-01-02"))
+			continue
+		}
+		applied = append(applied, d)
+	}
+
+	if len(config.LocationRules) > 0 {
+		if err := resolveLocations(ctx, client, config, targetTime, applied); err != nil {
+			return nil, err
+		}
+	}
+
+	return applied, nil
+}
+
+// Sets the location of each work day using the first location rule matching
+// the title or location of the day's events, or of a working location event
+// (Home, Office, ...) on the same day
+func resolveLocations(ctx context.Context, client *http.Client, config *Config, targetTime time.Time, workDays []WorkDay) error {
+	rules := make([]*regexp.Regexp, 0, len(config.LocationRules))
+	for _, r := range config.LocationRules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("Failed to compile location pattern %q: %v", r.Pattern, err)
+		}
+		rules = append(rules, re)
+	}
+
+	workingLocations := make(map[string][]string)
+	for _, calendarID := range config.GetCalendarIDs() {
+		days, err := getCalendarSchedules(ctx, client, calendarID, getBillingPeriod(config, targetTime), "location", func(e *calendar.Event) bool {
+			return e.EventType == "workingLocation"
+		})
+		if err != nil {
+			return err
+		}
+		for _, d := range days {
+			key := d.Date.Format("2006-01-02")
+			for _, e := range d.Events {
+				workingLocations[key] = append(workingLocations[key], e.Summary)
+			}
+		}
+	}
+
+	for i := range workDays {
+		d := &workDays[i]
+		candidates := make([]string, 0)
+		for _, e := range d.Events {
+			candidates = append(candidates, e.Summary, e.Location)
+		}
+		candidates = append(candidates, workingLocations[d.Date.Format("2006-01-02")]...)
+	rules:
+		for j, re := range rules {
+			for _, c := range candidates {
+				if c != "" && re.MatchString(c) {
+					d.Location = config.LocationRules[j].Value
+					break rules
+				}
+			}
+		}
+		logVerbose("Location of %s: %q\n", d.Date.Format("2006-01-02"), d.Location)
+	}
+	return nil
+}
+
+// Prints what the calendars contain to help finding why no work day matched
+func printWorkDayDiagnostics(ctx context.Context, client *http.Client, config *Config, targetTime time.Time) {
+	seen := make(map[string]bool)
+	counts := make(map[string]int)
+	for _, calendarID := range config.GetCalendarIDs() {
+		days, err := getCalendarSchedules(ctx, client, calendarID, getBillingPeriod(config, targetTime), "all", nil)
+		if err != nil {
+			logWarnf(log.Default(), "Warning: %v\n", err)
+		}
+		for _, d := range days {
+			for _, e := range d.Events {
+				key := calendarID + "/" + e.Id
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				counts[e.Summary]++
+			}
+		}
+	}
+	summaries := make([]string, 0, len(counts))
+	for s := range counts {
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if counts[summaries[i]] != counts[summaries[j]] {
+			return counts[summaries[i]] > counts[summaries[j]]
+		}
+		return summaries[i] < summaries[j]
+	})
+
+	if config.WorkSource == "merge" {
+		sources := make([]string, 0, len(config.WorkSources))
+		for _, s := range config.WorkSources {
+			sources = append(sources, s.String())
+		}
+		log.Printf("Work sources: %s\n", strings.Join(sources, "; "))
+	}
+	if config.WorkSource == "csv" {
+		log.Printf("Work CSV: %s (tags %q)\n", config.WorkCSV.Path, config.WorkCSV.Tags)
+	} else {
+		log.Printf("Calendars: %s\n", strings.Join(config.GetCalendarIDs(), ", "))
+		log.Printf("Work day title filter: %q\n", config.WorkDayTitle)
+		log.Printf("Events in %s: %d\n", getBillingPeriod(config, targetTime), len(seen))
+		if len(summaries) > 10 {
+			summaries = summaries[:10]
+		}
+		for _, s := range summaries {
+			log.Printf("  %q x %d\n", s, counts[s])
+		}
+	}
+
+	// Weekdays which are not holidays, to compare with the work days found
+	holidays, err := getHolidays(ctx, client, config, targetTime)
+	if err != nil {
+		logWarnf(log.Default(), "Warning: %v\n", err)
+	}
+	businessDays := 0
+	period := getBillingPeriod(config, targetTime)
+	for d := period.start; d.Before(period.end); d = d.AddDate(0, 0, 1) {
+		if _, ok := holidays[d.Format("2006-01-02")]; !ok && d.Weekday() != time.Saturday && d.Weekday() != time.Sunday {
+			businessDays++
+		}
+	}
+	log.Printf("Business days in %s: %d (%d holidays)\n", period, businessDays, len(holidays))
+}
+
+// Returns the names of holidays in the billing period keyed by date like
+// "2006-01-02", from the holiday calendar or else the public holidays
+func getHolidays(ctx context.Context, client *http.Client, config *Config, targetTime time.Time) (map[string]string, error) {
+	holidays := make(map[string]string)
+	if config.HolidayCalendarID == "" {
+		public, err := getPublicHolidaysInPeriod(config, targetTime)
+		if err != nil {
+			return nil, err
+		}
+		for date, name := range public {
+			holidays[date] = name
+		}
+		return holidays, nil
+	}
+	days, err := getCalendarSchedules(ctx, client, config.HolidayCalendarID, getBillingPeriod(config, targetTime), "holiday", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range days {
+		holidays[d.Date.Format("2006-01-02")] = d.Events[0].Summary
+	}
+	return holidays, nil
+}
+
+// Removes work days falling on a holiday unless one of the day's events has
+// the override marker in its description
+func excludeHolidays(ctx context.Context, client *http.Client, config *Config, targetTime time.Time, workDays []WorkDay) ([]WorkDay, error) {
+	holidays, err := getHolidays(ctx, client, config, targetTime)
+	if err != nil {
+		return nil, err
+	}
+
+	adjusted := make([]WorkDay, 0, len(workDays))
+	for _, d := range workDays {
+		key := d.Date.Format("2006-01-02")
+		holiday, ok := holidays[key]
+		if !ok {
+			adjusted = append(adjusted, d)
+			continue
+		}
+		overridden := false
+		if config.HolidayOverrideMarker != "" {
+			for _, e := range d.Events {
+				if strings.Contains(e.Description, config.HolidayOverrideMarker) {
+					overridden = true
+					break
+				}
+			}
+		}
+		if overridden {
+			log.Printf("Keeping %s on holiday %s (override marker found)\n", key, holiday)
+			adjusted = append(adjusted, d)
+			continue
+		}
+		log.Printf("Excluding %s (holiday: %s)\n", key, holiday)
+	}
+	return adjusted, nil
+}
+
+// Returns each day an event covers in loc. All-day events span [start, end)
+// by date and timed events longer than 24 hours span every day they touch.
+// Only single-day timed events carry their start and end times.
+func getEventDays(item *calendar.Event, loc *time.Location) ([]WorkDay, error) {
+	if item.Start.DateTime == "" {
+		start, err := time.ParseInLocation("2006-01-02", item.Start.Date, loc)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse calendar date: %v", err)
+		}
+		end := start.AddDate(0, 0, 1)
+		if item.End != nil && item.End.Date != "" {
+			end, err = time.ParseInLocation("2006-01-02", item.End.Date, loc)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse calendar date: %v", err)
+			}
+		}
+		days := []WorkDay{{Date: start}}
+		for d := start.AddDate(0, 0, 1); d.Before(end); d = d.AddDate(0, 0, 1) {
+			days = append(days, WorkDay{Date: d})
+		}
+		return days, nil
+	}
+
+	// Events may carry any offset, so convert into loc before looking at dates
+	start, err := time.Parse(time.RFC3339, item.Start.DateTime)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse calendar datetime: %v", err)
+	}
+	start = start.In(loc)
+	if item.End == nil || item.End.DateTime == "" {
+		return []WorkDay{{Date: start, Start: start}}, nil
+	}
+	end, err := time.Parse(time.RFC3339, item.End.DateTime)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse calendar datetime: %v", err)
+	}
+	end = end.In(loc)
+	if end.Sub(start) <= 24*time.Hour {
+		return []WorkDay{{Date: start, Start: start, End: end}}, nil
+	}
+	days := []WorkDay{{Date: start}}
+	for d := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, loc); d.Before(end); d = d.AddDate(0, 0, 1) {
+		days = append(days, WorkDay{Date: d})
+	}
+	return days, nil
+}
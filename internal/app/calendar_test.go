@@ -0,0 +1,278 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/calendarsource"
+	"google.golang.org/api/calendar/v3"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("Failed to load location %s: %v", name, err)
+	}
+	return loc
+}
+
+// Returns the dates of the days like "2022-06-01", with the times like
+// "2022-06-01 09:00-18:00" for the days having them
+func formatEventDays(days []WorkDay) []string {
+	s := make([]string, 0, len(days))
+	for _, d := range days {
+		v := d.Date.Format("2006-01-02")
+		if !d.Start.IsZero() {
+			v += " " + d.Start.Format("15:04")
+			if !d.End.IsZero() {
+				v += "-" + d.End.Format("15:04")
+			}
+		}
+		s = append(s, v)
+	}
+	return s
+}
+
+func allDayEvent(start, end string) *calendar.Event {
+	return &calendar.Event{
+		Start: &calendar.EventDateTime{Date: start},
+		End:   &calendar.EventDateTime{Date: end},
+	}
+}
+
+func timedEvent(start, end string) *calendar.Event {
+	return &calendar.Event{
+		Start: &calendar.EventDateTime{DateTime: start},
+		End:   &calendar.EventDateTime{DateTime: end},
+	}
+}
+
+type eventDaysTest struct {
+	name  string
+	event *calendar.Event
+	loc   string
+	want  []string
+}
+
+func testEventDays(t *testing.T, tests []eventDaysTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days, err := getEventDays(tt.event, mustLoadLocation(t, tt.loc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := formatEventDays(days)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetEventDaysAllDay(t *testing.T) {
+	testEventDays(t, []eventDaysTest{
+		{
+			name:  "single day",
+			event: allDayEvent("2022-06-01", "2022-06-02"),
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-01"},
+		},
+		{
+			name:  "no end",
+			event: &calendar.Event{Start: &calendar.EventDateTime{Date: "2022-06-01"}},
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-01"},
+		},
+		{
+			name:  "three days with exclusive end",
+			event: allDayEvent("2022-06-01", "2022-06-04"),
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-01", "2022-06-02", "2022-06-03"},
+		},
+		{
+			name:  "over a weekend",
+			event: allDayEvent("2022-06-10", "2022-06-14"),
+			loc:   "UTC",
+			want:  []string{"2022-06-10", "2022-06-11", "2022-06-12", "2022-06-13"},
+		},
+		{
+			name:  "dates are not shifted by the location",
+			event: allDayEvent("2022-06-01", "2022-06-03"),
+			loc:   "America/Los_Angeles",
+			want:  []string{"2022-06-01", "2022-06-02"},
+		},
+	})
+}
+
+func TestGetEventDaysTimezone(t *testing.T) {
+	testEventDays(t, []eventDaysTest{
+		{
+			name:  "offset of the location",
+			event: timedEvent("2022-06-01T09:00:00+09:00", "2022-06-01T18:00:00+09:00"),
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-01 09:00-18:00"},
+		},
+		{
+			name:  "UTC event on the next day in Tokyo",
+			event: timedEvent("2022-06-01T23:00:00Z", "2022-06-02T08:00:00Z"),
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-02 08:00-17:00"},
+		},
+		{
+			name:  "UTC event on the same day in UTC",
+			event: timedEvent("2022-06-01T23:00:00Z", "2022-06-02T08:00:00Z"),
+			loc:   "UTC",
+			want:  []string{"2022-06-01 23:00-08:00"},
+		},
+		{
+			name:  "Tokyo morning is the previous day in UTC",
+			event: timedEvent("2022-06-02T08:00:00+09:00", "2022-06-02T12:00:00+09:00"),
+			loc:   "UTC",
+			want:  []string{"2022-06-01 23:00-03:00"},
+		},
+		{
+			name:  "night shift crossing midnight stays on its start day",
+			event: timedEvent("2022-06-01T22:00:00+09:00", "2022-06-02T06:00:00+09:00"),
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-01 22:00-06:00"},
+		},
+		{
+			name:  "no end",
+			event: &calendar.Event{Start: &calendar.EventDateTime{DateTime: "2022-06-01T01:00:00Z"}},
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-01 10:00"},
+		},
+		{
+			name:  "timed event longer than a day spans every day it touches",
+			event: timedEvent("2022-06-01T15:00:00Z", "2022-06-03T03:00:00Z"),
+			loc:   "Asia/Tokyo",
+			want:  []string{"2022-06-02", "2022-06-03"},
+		},
+		{
+			name:  "timed event longer than a day in UTC",
+			event: timedEvent("2022-06-01T15:00:00Z", "2022-06-03T03:00:00Z"),
+			loc:   "UTC",
+			want:  []string{"2022-06-01", "2022-06-02", "2022-06-03"},
+		},
+	})
+}
+
+func TestGetCalendarSchedulesMonthBoundary(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	period := getBillingPeriod((&Config{}), time.Date(2022, 6, 15, 0, 0, 0, 0, loc))
+	calendarID := "boundary@example.com"
+	// Seeding the events fetched in the run saves calling the API
+	fetchedEventsMu.Lock()
+	fetchedEvents[calendarID+"/"+period.key()] = []*calendar.Event{
+		{Id: "a", Start: &calendar.EventDateTime{Date: "2022-05-30"}, End: &calendar.EventDateTime{Date: "2022-06-02"}},
+		{Id: "b", Start: &calendar.EventDateTime{DateTime: "2022-06-02T23:30:00Z"}, End: &calendar.EventDateTime{DateTime: "2022-06-03T02:00:00Z"}},
+		// 2022-05-31 15:30 in UTC is already in June in Tokyo
+		{Id: "c", Start: &calendar.EventDateTime{DateTime: "2022-05-31T15:30:00Z"}, End: &calendar.EventDateTime{DateTime: "2022-05-31T20:00:00Z"}},
+		// Ends on the first of July in Tokyo
+		{Id: "d", Start: &calendar.EventDateTime{DateTime: "2022-06-30T14:00:00Z"}, End: &calendar.EventDateTime{DateTime: "2022-06-30T18:00:00Z"}},
+		{Id: "e", Start: &calendar.EventDateTime{Date: "2022-06-29"}, End: &calendar.EventDateTime{Date: "2022-07-03"}},
+	}
+	fetchedEventsMu.Unlock()
+	defer func() {
+		fetchedEventsMu.Lock()
+		delete(fetchedEvents, calendarID+"/"+period.key())
+		fetchedEventsMu.Unlock()
+	}()
+
+	days, err := getCalendarSchedules(nil, nil, calendarID, period, "work", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := formatEventDays(days)
+	want := []string{
+		"2022-06-01 00:30-05:00",
+		"2022-06-03 08:30-11:00",
+		"2022-06-29",
+		"2022-06-30 23:00-03:00",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGetWorkDaysPages(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	days, err := getWorkDays(context.Background(), f.client(context.Background()), config, targetTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Events of May come in pages of 2, the one of 05-10 on the third
+	if got := f.requested("GET /calendar/v3/calendars/work/events"); len(got) != 3 {
+		t.Errorf("pages: got %d, want 3", len(got))
+	}
+	want := []string{"2024-05-07 09:00-18:00", "2024-05-08 09:00-18:00", "2024-05-09 10:00-19:00", "2024-05-10 09:00-18:00"}
+	if got := formatEventDays(days); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// fakeEventLister lists the events of each calendar whatever the period
+type fakeEventLister map[string][]*calendar.Event
+
+func (l fakeEventLister) ListEvents(ctx context.Context, calendarID string, start, end time.Time) ([]*calendar.Event, error) {
+	return l[calendarID], nil
+}
+
+func useFakeEventLister(t *testing.T, l fakeEventLister) {
+	t.Helper()
+	saved := newEventLister
+	newEventLister = func(ctx context.Context, client *http.Client) (calendarsource.EventLister, error) {
+		return l, nil
+	}
+	t.Cleanup(func() { newEventLister = saved })
+}
+
+func TestGetWorkDaysFilters(t *testing.T) {
+	config, targetTime := setUpTestRun(t)
+	config.EventColorID = "5"
+	event := func(summary, colorID, date, description string) *calendar.Event {
+		e := timedEvent(date+"T09:00:00+09:00", date+"T18:00:00+09:00")
+		e.Id, e.Summary, e.ColorId, e.Description = date+summary, summary, colorID, description
+		return e
+	}
+	cancelled := event("勤務", "5", "2024-05-10", "")
+	cancelled.Status = "cancelled"
+	useFakeEventLister(t, fakeEventLister{"work": {
+		event("勤務", "5", "2024-05-07", ""),
+		event("勤務", "3", "2024-05-08", ""),
+		event("会議", "5", "2024-05-09", ""),
+		cancelled,
+		event("勤務", "5", "2024-05-13", "skip=true"),
+		event("勤務", "5", "2024-05-14", "start=10:00\n客先常駐"),
+		// Out of the month
+		event("勤務", "5", "2024-06-03", ""),
+	}})
+
+	days, err := getWorkDays(context.Background(), nil, config, targetTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2024-05-07 09:00-18:00", "2024-05-14 09:00-18:00"}
+	if got := formatEventDays(days); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if o := days[1].Overrides; o.Start != "10:00" || days[1].note(0) != "客先常駐" {
+		t.Errorf("got overrides %+v and note %q of the description", o, days[1].note(0))
+	}
+}
@@ -0,0 +1,480 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// cffFont is the CFF table of an OpenType font, read as far as needed to
+// subset it
+type cffFont struct {
+	data []byte
+	// The header and the name, string and global subroutine indexes, which
+	// are kept as they are
+	header, names, strings, globalSubrs []byte
+	top                                 []cffDictEntry
+	charStrings                         [][]byte
+	// Charset and FDSelect, which are kept as they are, if not predefined
+	charset, fdSelect []byte
+	// Private dict with its subroutines of non CID-keyed fonts, and font
+	// dicts of CID-keyed ones having their own
+	private *cffPrivate
+	fonts   []cffFontDict
+	// CIDs of the glyphs of CID-keyed fonts, nil for the others
+	cids []int
+}
+
+type cffFontDict struct {
+	entries []cffDictEntry
+	private *cffPrivate
+}
+
+type cffPrivate struct {
+	entries []cffDictEntry
+	subrs   []byte
+}
+
+// cffDictEntry is an operator of a DICT with its operands. Integer operands
+// are decoded, and the others are kept as the bytes only.
+type cffDictEntry struct {
+	op   int
+	args []int
+	raw  []byte
+}
+
+// DICT operators, those of two bytes being 1200 and the second byte
+const (
+	cffCharset     = 15
+	cffEncoding    = 16
+	cffCharStrings = 17
+	cffPrivateOp   = 18
+	cffSubrs       = 19
+	cffROS         = 1230
+	cffFDArray     = 1236
+	cffFDSelect    = 1237
+)
+
+// Returns the items of the INDEX at the offset and the end of it
+func parseCFFIndex(d []byte, offset int) ([][]byte, int, error) {
+	if offset < 0 || offset+2 > len(d) {
+		return nil, 0, fmt.Errorf("broken index")
+	}
+	count := int(binary.BigEndian.Uint16(d[offset:]))
+	if count == 0 {
+		return nil, offset + 2, nil
+	}
+	if offset+3 > len(d) {
+		return nil, 0, fmt.Errorf("broken index")
+	}
+	offSize := int(d[offset+2])
+	if offSize < 1 || offSize > 4 || offset+3+(count+1)*offSize > len(d) {
+		return nil, 0, fmt.Errorf("broken index")
+	}
+	readOffset := func(i int) int {
+		o := 0
+		for _, b := range d[offset+3+i*offSize : offset+3+(i+1)*offSize] {
+			o = o<<8 | int(b)
+		}
+		return o
+	}
+	base := offset + 3 + (count+1)*offSize - 1
+	items := make([][]byte, count)
+	for i := range items {
+		start, end := base+readOffset(i), base+readOffset(i+1)
+		if start > end || end > len(d) || start <= base {
+			return nil, 0, fmt.Errorf("broken index")
+		}
+		items[i] = d[start:end]
+	}
+	return items, base + readOffset(count), nil
+}
+
+func encodeCFFIndex(items [][]byte) []byte {
+	if len(items) == 0 {
+		return []byte{0, 0}
+	}
+	size := 1
+	for _, item := range items {
+		size += len(item)
+	}
+	offSize := 1
+	for size >= 1<<(8*offSize) {
+		offSize++
+	}
+	b := []byte{byte(len(items) >> 8), byte(len(items)), byte(offSize)}
+	putOffset := func(o int) {
+		for i := offSize - 1; i >= 0; i-- {
+			b = append(b, byte(o>>(8*i)))
+		}
+	}
+	o := 1
+	putOffset(o)
+	for _, item := range items {
+		o += len(item)
+		putOffset(o)
+	}
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func parseCFFDict(d []byte) ([]cffDictEntry, error) {
+	entries := make([]cffDictEntry, 0)
+	var args []int
+	start := 0
+	for i := 0; i < len(d); {
+		b := int(d[i])
+		switch {
+		case b <= 21:
+			op := b
+			i++
+			if b == 12 {
+				if i >= len(d) {
+					return nil, fmt.Errorf("broken dict")
+				}
+				op = 1200 + int(d[i])
+				i++
+			}
+			raw := d[start:i]
+			// The operator itself is not part of the operands
+			if op >= 1200 {
+				raw = raw[:len(raw)-2]
+			} else {
+				raw = raw[:len(raw)-1]
+			}
+			entries = append(entries, cffDictEntry{op: op, args: args, raw: raw})
+			args, start = nil, i
+		case b == 28:
+			if i+3 > len(d) {
+				return nil, fmt.Errorf("broken dict")
+			}
+			args = append(args, int(int16(binary.BigEndian.Uint16(d[i+1:]))))
+			i += 3
+		case b == 29:
+			if i+5 > len(d) {
+				return nil, fmt.Errorf("broken dict")
+			}
+			args = append(args, int(int32(binary.BigEndian.Uint32(d[i+1:]))))
+			i += 5
+		case b == 30:
+			// Reals end with the nibble 0xf
+			for i++; i < len(d); i++ {
+				if d[i]&0x0f == 0x0f || d[i]&0xf0 == 0xf0 {
+					break
+				}
+			}
+			i++
+			args = append(args, 0)
+		case b >= 32 && b <= 246:
+			args = append(args, b-139)
+			i++
+		case b >= 247 && b <= 250:
+			if i+2 > len(d) {
+				return nil, fmt.Errorf("broken dict")
+			}
+			args = append(args, (b-247)*256+int(d[i+1])+108)
+			i += 2
+		case b >= 251 && b <= 254:
+			if i+2 > len(d) {
+				return nil, fmt.Errorf("broken dict")
+			}
+			args = append(args, -(b-251)*256-int(d[i+1])-108)
+			i += 2
+		default:
+			return nil, fmt.Errorf("broken dict")
+		}
+	}
+	return entries, nil
+}
+
+// Encodes the dict, giving the operators in replace the operands of it as
+// integers of five bytes, so that the size doesn't depend on them. The
+// operators of replace without operands are dropped.
+func encodeCFFDict(entries []cffDictEntry, replace map[int][]int) []byte {
+	b := make([]byte, 0)
+	for _, e := range entries {
+		if args, ok := replace[e.op]; ok {
+			if args == nil {
+				continue
+			}
+			for _, a := range args {
+				b = append(b, 29, byte(a>>24), byte(a>>16), byte(a>>8), byte(a))
+			}
+		} else {
+			b = append(b, e.raw...)
+		}
+		if e.op >= 1200 {
+			b = append(b, 12, byte(e.op-1200))
+		} else {
+			b = append(b, byte(e.op))
+		}
+	}
+	return b
+}
+
+func findCFFDictEntry(entries []cffDictEntry, op int) (cffDictEntry, bool) {
+	for _, e := range entries {
+		if e.op == op {
+			return e, true
+		}
+	}
+	return cffDictEntry{}, false
+}
+
+func parseCFFPrivate(d []byte, entries []cffDictEntry) (*cffPrivate, error) {
+	e, ok := findCFFDictEntry(entries, cffPrivateOp)
+	if !ok || len(e.args) != 2 {
+		return nil, fmt.Errorf("no private dict")
+	}
+	size, offset := e.args[0], e.args[1]
+	if size < 0 || offset < 0 || offset+size > len(d) {
+		return nil, fmt.Errorf("broken private dict")
+	}
+	p := &cffPrivate{}
+	var err error
+	if p.entries, err = parseCFFDict(d[offset : offset+size]); err != nil {
+		return nil, err
+	}
+	if e, ok := findCFFDictEntry(p.entries, cffSubrs); ok && len(e.args) == 1 {
+		start := offset + e.args[0]
+		_, end, err := parseCFFIndex(d, start)
+		if err != nil {
+			return nil, fmt.Errorf("broken local subroutines: %v", err)
+		}
+		p.subrs = d[start:end]
+	}
+	return p, nil
+}
+
+// Returns the size of the charset of the glyphs at the offset, and the CIDs
+// of the glyphs if cids
+func parseCFFCharset(d []byte, offset, numGlyphs int) (int, []int, error) {
+	cids := make([]int, 1, numGlyphs)
+	if offset < 0 || offset >= len(d) {
+		return 0, nil, fmt.Errorf("broken charset")
+	}
+	o := offset + 1
+	switch d[offset] {
+	case 0:
+		if o+2*(numGlyphs-1) > len(d) {
+			return 0, nil, fmt.Errorf("broken charset")
+		}
+		for g := 1; g < numGlyphs; g++ {
+			cids = append(cids, int(binary.BigEndian.Uint16(d[o:])))
+			o += 2
+		}
+	case 1, 2:
+		countSize := int(d[offset])
+		for len(cids) < numGlyphs {
+			if o+2+countSize > len(d) {
+				return 0, nil, fmt.Errorf("broken charset")
+			}
+			first := int(binary.BigEndian.Uint16(d[o:]))
+			left := int(d[o+2])
+			if countSize == 2 {
+				left = int(binary.BigEndian.Uint16(d[o+2:]))
+			}
+			o += 2 + countSize
+			for i := 0; i <= left && len(cids) < numGlyphs; i++ {
+				cids = append(cids, first+i)
+			}
+		}
+	default:
+		return 0, nil, fmt.Errorf("unknown charset format %d", d[offset])
+	}
+	return o - offset, cids, nil
+}
+
+// Returns the size of the FDSelect at the offset
+func getCFFFDSelectSize(d []byte, offset, numGlyphs int) (int, error) {
+	if offset < 0 || offset >= len(d) {
+		return 0, fmt.Errorf("broken FDSelect")
+	}
+	switch d[offset] {
+	case 0:
+		return 1 + numGlyphs, nil
+	case 3:
+		if offset+3 > len(d) {
+			return 0, fmt.Errorf("broken FDSelect")
+		}
+		return 1 + 2 + 3*int(binary.BigEndian.Uint16(d[offset+1:])) + 2, nil
+	}
+	return 0, fmt.Errorf("unknown FDSelect format %d", d[offset])
+}
+
+func parseCFF(d []byte, numGlyphs int) (*cffFont, error) {
+	if len(d) < 4 || d[0] != 1 {
+		return nil, fmt.Errorf("unknown version")
+	}
+	c := &cffFont{data: d, header: d[:d[2]]}
+	_, end, err := parseCFFIndex(d, len(c.header))
+	if err != nil {
+		return nil, fmt.Errorf("broken name index: %v", err)
+	}
+	c.names = d[len(c.header):end]
+	tops, topEnd, err := parseCFFIndex(d, end)
+	if err != nil || len(tops) == 0 {
+		return nil, fmt.Errorf("broken top dict index")
+	}
+	if c.top, err = parseCFFDict(tops[0]); err != nil {
+		return nil, err
+	}
+	_, end, err = parseCFFIndex(d, topEnd)
+	if err != nil {
+		return nil, fmt.Errorf("broken string index: %v", err)
+	}
+	c.strings = d[topEnd:end]
+	_, gsubrsEnd, err := parseCFFIndex(d, end)
+	if err != nil {
+		return nil, fmt.Errorf("broken global subroutines: %v", err)
+	}
+	c.globalSubrs = d[end:gsubrsEnd]
+
+	e, ok := findCFFDictEntry(c.top, cffCharStrings)
+	if !ok || len(e.args) != 1 {
+		return nil, fmt.Errorf("no charstrings")
+	}
+	if c.charStrings, _, err = parseCFFIndex(d, e.args[0]); err != nil {
+		return nil, fmt.Errorf("broken charstrings: %v", err)
+	}
+	if len(c.charStrings) != numGlyphs {
+		return nil, fmt.Errorf("%d charstrings for %d glyphs", len(c.charStrings), numGlyphs)
+	}
+
+	_, cidKeyed := findCFFDictEntry(c.top, cffROS)
+	// Charsets of the offsets up to 2 are predefined
+	if e, ok := findCFFDictEntry(c.top, cffCharset); ok && len(e.args) == 1 && e.args[0] > 2 {
+		size, cids, err := parseCFFCharset(d, e.args[0], numGlyphs)
+		if err != nil {
+			return nil, err
+		}
+		c.charset = d[e.args[0] : e.args[0]+size]
+		if cidKeyed {
+			c.cids = cids
+		}
+	} else if cidKeyed {
+		return nil, fmt.Errorf("no charset of CIDs")
+	}
+
+	if !cidKeyed {
+		if c.private, err = parseCFFPrivate(d, c.top); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	e, ok = findCFFDictEntry(c.top, cffFDSelect)
+	if !ok || len(e.args) != 1 {
+		return nil, fmt.Errorf("no FDSelect")
+	}
+	size, err := getCFFFDSelectSize(d, e.args[0], numGlyphs)
+	if err != nil {
+		return nil, err
+	}
+	if e.args[0]+size > len(d) {
+		return nil, fmt.Errorf("broken FDSelect")
+	}
+	c.fdSelect = d[e.args[0] : e.args[0]+size]
+	e, ok = findCFFDictEntry(c.top, cffFDArray)
+	if !ok || len(e.args) != 1 {
+		return nil, fmt.Errorf("no FDArray")
+	}
+	fonts, _, err := parseCFFIndex(d, e.args[0])
+	if err != nil {
+		return nil, fmt.Errorf("broken FDArray: %v", err)
+	}
+	for _, fd := range fonts {
+		entries, err := parseCFFDict(fd)
+		if err != nil {
+			return nil, err
+		}
+		p, err := parseCFFPrivate(d, entries)
+		if err != nil {
+			return nil, err
+		}
+		c.fonts = append(c.fonts, cffFontDict{entries: entries, private: p})
+	}
+	return c, nil
+}
+
+// Encodes the private dict followed by its subroutines
+func (p *cffPrivate) encode() []byte {
+	if p.subrs == nil {
+		return encodeCFFDict(p.entries, nil)
+	}
+	// The subroutines are right after the dict, whose size doesn't depend
+	// on the offset
+	size := len(encodeCFFDict(p.entries, map[int][]int{cffSubrs: {0}}))
+	b := encodeCFFDict(p.entries, map[int][]int{cffSubrs: {size}})
+	return append(b, p.subrs...)
+}
+
+// Returns the dict size of the private dict encoded
+func (p *cffPrivate) dictSize() int {
+	if p.subrs == nil {
+		return len(encodeCFFDict(p.entries, nil))
+	}
+	return len(encodeCFFDict(p.entries, map[int][]int{cffSubrs: {0}}))
+}
+
+// Returns the CFF font having only the charstrings of the glyphs, the others
+// being empty. The subroutines are kept as they are.
+func (c *cffFont) subset(glyphs map[int]bool) ([]byte, error) {
+	const endchar = 14
+	charStrings := make([][]byte, len(c.charStrings))
+	for g, cs := range c.charStrings {
+		if g == 0 || glyphs[g] {
+			charStrings[g] = cs
+		} else {
+			charStrings[g] = []byte{endchar}
+		}
+	}
+	encodedCharStrings := encodeCFFIndex(charStrings)
+
+	// The top dict has the offsets of what follows the indexes, which
+	// are laid out in the order below
+	replace := map[int][]int{cffEncoding: nil, cffCharStrings: {0}}
+	if c.charset != nil {
+		replace[cffCharset] = []int{0}
+	}
+	if c.private != nil {
+		replace[cffPrivateOp] = []int{0, 0}
+	} else {
+		replace[cffFDSelect] = []int{0}
+		replace[cffFDArray] = []int{0}
+	}
+	topSize := len(encodeCFFIndex([][]byte{encodeCFFDict(c.top, replace)}))
+	offset := len(c.header) + len(c.names) + topSize + len(c.strings) + len(c.globalSubrs)
+	rest := make([]byte, 0)
+	add := func(d []byte) int {
+		o := offset + len(rest)
+		rest = append(rest, d...)
+		return o
+	}
+	if c.charset != nil {
+		replace[cffCharset] = []int{add(c.charset)}
+	}
+	if c.fdSelect != nil {
+		replace[cffFDSelect] = []int{add(c.fdSelect)}
+	}
+	replace[cffCharStrings] = []int{add(encodedCharStrings)}
+	if c.private != nil {
+		replace[cffPrivateOp] = []int{c.private.dictSize(), add(c.private.encode())}
+	} else {
+		fonts := make([][]byte, 0, len(c.fonts))
+		for _, fd := range c.fonts {
+			o := add(fd.private.encode())
+			fonts = append(fonts, encodeCFFDict(fd.entries, map[int][]int{cffPrivateOp: {fd.private.dictSize(), o}}))
+		}
+		replace[cffFDArray] = []int{add(encodeCFFIndex(fonts))}
+	}
+
+	b := make([]byte, 0, offset+len(rest))
+	b = append(b, c.header...)
+	b = append(b, c.names...)
+	b = append(b, encodeCFFIndex([][]byte{encodeCFFDict(c.top, replace)})...)
+	b = append(b, c.strings...)
+	b = append(b, c.globalSubrs...)
+	b = append(b, rest...)
+	return b, nil
+}
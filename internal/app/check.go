@@ -0,0 +1,235 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/auth"
+	"github.com/tsujio/make-invoices/internal/calendarsource"
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// checker runs the checks of the check subcommand, counting failures
+type checker struct {
+	failures int
+}
+
+// Prints the result of the check, with the hint on failure
+func (c *checker) report(name string, err error, hint string) bool {
+	if err == nil {
+		log.Printf("PASS %s\n", name)
+		return true
+	}
+	c.failures++
+	log.Printf("FAIL %s: %v\n", name, err)
+	if hint != "" {
+		log.Printf("     %s\n", hint)
+	}
+	return false
+}
+
+func (c *checker) checkWorkCSV(wc *WorkCSVConfig, targetTime time.Time) {
+	d, err := ioutil.ReadFile(resolveConfigPath(wc.Path))
+	if err == nil {
+		_, err = readWorkCSV(wc, d, targetTime.Location())
+	}
+	c.report(fmt.Sprintf("work CSV %s is readable", wc.Path), err, msg("hint_work_csv"))
+}
+
+// Checks the config and access to the calendars, spreadsheets and templates
+// without writing to any of them
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.BoolVar(&verbose, "verbose", false, "print detailed logs")
+	fs.Parse(args)
+
+	// Invalid configs stop here with the reason
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	c := &checker{}
+	c.report("config", nil, "")
+	configureRetry(config)
+	loc, err := config.GetLocation()
+	if err != nil {
+		return fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	now := time.Now().In(loc)
+	targetTime := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+
+	ctx, stop := newRunContext(0)
+	defer stop()
+
+	// The check never starts the authorization flow
+	store := auth.NewTokenStore(getPathSiblingOfExecutable(config.OAuth2TokenFileName))
+	token, granted, err := store.Load()
+	if err == nil && token == nil {
+		err = fmt.Errorf("no token in %s", config.OAuth2TokenFileName)
+	}
+	if missing := auth.MissingScopes(granted, getAPIScopes(config)); err == nil && len(missing) > 0 {
+		err = fmt.Errorf("the token in %s lacks the scopes %s", config.OAuth2TokenFileName, strings.Join(missing, " "))
+	}
+	if !c.report("oauth token", err, msg("hint_authorize")) {
+		return newRunError(exitNeedsAuth, "auth", "%d checks failed", c.failures)
+	}
+	client, err := createAPIClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	drv, err := drive.NewService(ctx, getServiceOptions(client, "drive/v3/")...)
+	if err != nil {
+		return fmt.Errorf("Failed to create drive client: %v", err)
+	}
+	sht, err := sheets.NewService(ctx, getServiceOptions(client, "")...)
+	if err != nil {
+		return fmt.Errorf("Failed to create sheet client: %v", err)
+	}
+	err = callAPI("get user", func(ctx context.Context) error {
+		_, err := drv.About.Get().Fields("user").Context(ctx).Do()
+		return err
+	})
+	if !c.report("token works", err, msg("hint_reauthorize")) {
+		return newRunError(exitNeedsAuth, "auth", "%d checks failed", c.failures)
+	}
+
+	c.checkCalendars(ctx, client, config, targetTime)
+	if config.WorkSource == "csv" {
+		c.checkWorkCSV(config.WorkCSV, targetTime)
+	}
+	for _, s := range config.WorkSources {
+		if config.WorkSource == "merge" && s.Type == "csv" {
+			c.checkWorkCSV(s.GetConfig(config).WorkCSV, targetTime)
+		}
+	}
+	for _, sc := range config.GetSpreadsheets() {
+		c.checkSpreadsheet(sht, drv, sc, targetTime, config)
+	}
+
+	// Output files are written in the working directory
+	f, err := ioutil.TempFile(".", ".make-invoices-check-*")
+	if err == nil {
+		f.Close()
+		err = os.Remove(f.Name())
+	}
+	c.report("output directory is writable", err, msg("hint_output_dir"))
+
+	logMetrics()
+	if c.failures > 0 {
+		return fmt.Errorf("%d checks failed", c.failures)
+	}
+	log.Println("All checks passed")
+	return nil
+}
+
+func (c *checker) checkCalendars(ctx context.Context, client *http.Client, config *Config, targetTime time.Time) {
+	calendarIDs := config.GetCalendarIDs()
+	for _, sc := range config.GetSpreadsheets() {
+		if sc.HasOwnFilters() {
+			calendarIDs = append(calendarIDs, config.ForSpreadsheet(sc).GetCalendarIDs()...)
+		}
+	}
+	checked := make(map[string]bool)
+	var cal *calendar.Service
+	for _, id := range calendarIDs {
+		if checked[id] {
+			continue
+		}
+		checked[id] = true
+		name := fmt.Sprintf("calendar %s is readable", id)
+		if isICSSource(id) {
+			period := getBillingPeriod(config, targetTime)
+			_, err := calendarsource.ICS{}.ListEvents(ctx, id, period.start, period.end)
+			c.report(name, err, msg("hint_calendar_source"))
+			continue
+		}
+		if cal == nil {
+			var err error
+			if cal, err = calendar.NewService(ctx, getServiceOptions(client, "calendar/v3/")...); err != nil {
+				c.report(name, err, "")
+				continue
+			}
+		}
+		err := callAPI("calendar events list", func(ctx context.Context) error {
+			_, err := cal.Events.List(id).MaxResults(1).Context(ctx).Do()
+			return err
+		})
+		c.report(name, err, msg("hint_calendar_id"))
+	}
+}
+
+func (c *checker) checkSpreadsheet(sht *sheets.Service, drv *drive.Service, sc *SpreadsheetConfig, targetTime time.Time, config *Config) {
+	spreadsheet, err := getSpreadsheet(sht, sc.ID, spreadsheetSheetsFields)
+	if !c.report(fmt.Sprintf("spreadsheet %s is accessible", sc.ID), err, msg("hint_spreadsheet")) {
+		return
+	}
+	title := spreadsheet.Properties.Title
+
+	months, err := timesheet.MonthSheets(timesheet.WithoutSheet(spreadsheet, sc.TemplateSheet), targetTime.Location())
+	var latest *sheets.Sheet
+	if err == nil {
+		latestMonth := ""
+		for month, s := range months {
+			if month > latestMonth {
+				latest, latestMonth = s, month
+			}
+		}
+		if latest == nil {
+			err = fmt.Errorf("no sheet titled with a month")
+		}
+	}
+	if c.report(fmt.Sprintf("%s has month sheets", title), err, msg("hint_month_sheets")) && !skipTemplateCheck {
+		check, err := checkTemplateAnchors(sht, sc.ID, latest.Properties.Title, config)
+		if err == nil && len(check.mismatches) > 0 {
+			err = fmt.Errorf("sheet %s does not match: %v", latest.Properties.Title, check.mismatches)
+		}
+		if c.report(fmt.Sprintf("%s has the expected template", title), err, msg("hint_template")) && len(check.skippedColumns) > 0 {
+			log.Printf("WARN %s has no optional columns %s, which are not written\n", title, check.formatSkipped())
+		}
+	}
+
+	// Orphaned copies are only reported
+	err = nil
+	if orphans := findOrphanedCopies(spreadsheet, targetTime.Location()); len(orphans) > 0 {
+		titles := make([]string, 0, len(orphans))
+		for _, o := range orphans {
+			titles = append(titles, o.sheet.Properties.Title)
+		}
+		err = fmt.Errorf("copies of month sheets left by interrupted runs: %s", strings.Join(titles, ", "))
+	}
+	c.report(fmt.Sprintf("%s has no orphaned copies", title), err, msg("hint_orphans"))
+
+	documents, err := config.GetDocuments(sc)
+	if !c.report(fmt.Sprintf("%s document settings", title), err, msg("hint_documents")) {
+		return
+	}
+	for _, dc := range documents {
+		name := fmt.Sprintf("%s template of document %s is readable", title, dc.Key)
+		if dc.Local {
+			_, err := os.Stat(resolveConfigPath(dc.LocalTemplate))
+			if err == nil {
+				_, err = os.Stat(resolveConfigPath(config.InvoiceFontPath))
+			}
+			c.report(name, err, msg("hint_local_template"))
+			continue
+		}
+		err := callAPI("get document template", func(ctx context.Context) error {
+			_, err := drv.Files.Get(dc.TemplateID).Fields("id", "name").SupportsAllDrives(true).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			err = describeDriveError(err, "template "+dc.TemplateID)
+		}
+		c.report(name, err, msg("hint_template_id"))
+	}
+}
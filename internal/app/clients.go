@@ -0,0 +1,60 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Returns the values of the placeholders of the client, which are empty
+// without a client
+func getClientPlaceholders(cc *ClientConfig) map[string]string {
+	if cc == nil {
+		return nil
+	}
+	return map[string]string{
+		"client_name":       cc.Name,
+		"client_department": cc.Department,
+		"client_address":    strings.Join(cc.Address, "\n"),
+		"attention":         cc.Attention(),
+		"payment_terms":     cc.PaymentTerms,
+	}
+}
+
+// "make-invoices clients list" prints the clients with the spreadsheets
+// referencing them, and the spreadsheets having no client
+func runClients(args []string) error {
+	if len(args) < 1 || args[0] != "list" {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices clients list")
+	}
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	spreadsheets := make(map[string][]string)
+	for _, sc := range config.GetSpreadsheets() {
+		spreadsheets[sc.Client] = append(spreadsheets[sc.Client], sc.ID)
+	}
+	keys := make([]string, 0, len(config.Clients))
+	for key := range config.Clients {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, msg("clients_header"))
+	for _, key := range keys {
+		cc := config.Clients[key]
+		ids := spreadsheets[key]
+		if len(ids) == 0 {
+			ids = []string{"-"}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key, cc.Name, cc.Attention(), strings.Join(ids, ", "))
+	}
+	if ids := spreadsheets[""]; len(ids) > 0 {
+		fmt.Fprintf(w, "-\t\t\t%s\n", strings.Join(ids, ", "))
+	}
+	w.Flush()
+	return nil
+}
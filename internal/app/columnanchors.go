@@ -0,0 +1,93 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+func validateColumnAnchors(anchors []*ColumnAnchor, config *Config) error {
+	keys := make(map[string]bool)
+	for _, c := range getAllDayColumns(config) {
+		keys[c.key] = true
+	}
+	columns := make(map[string]bool)
+	for _, a := range anchors {
+		if !keys[a.Column] {
+			return fmt.Errorf("unknown column: %q (must be a range setting like notes_range)", a.Column)
+		}
+		if columns[a.Column] {
+			return fmt.Errorf("column %s is given twice", a.Column)
+		}
+		columns[a.Column] = true
+		if a.Cell == "" || a.Text == "" {
+			return fmt.Errorf("%s: cell and text are required", a.Column)
+		}
+	}
+	return nil
+}
+
+// templateCheck is the result of checking the template of a sheet
+type templateCheck struct {
+	// Anchors of the template and of required columns not containing the
+	// expected text
+	mismatches []string
+	// Optional columns whose anchors don't contain the expected text, by
+	// name, which are not written
+	skippedColumns map[string]string
+}
+
+// Returns the names of the skipped columns sorted
+func (t *templateCheck) skippedNames() []string {
+	names := make([]string, 0, len(t.skippedColumns))
+	for name := range t.skippedColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the mismatches of the skipped columns like "notes (G6: expected
+// ...)"
+func (t *templateCheck) formatSkipped() string {
+	parts := make([]string, 0, len(t.skippedColumns))
+	for _, name := range t.skippedNames() {
+		parts = append(parts, fmt.Sprintf("%s (%s)", name, t.skippedColumns[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Checks the anchors of the configured day columns of the sheet. Only
+// columns having ranges are checked.
+func checkColumnAnchors(sht *sheets.Service, spreadsheetID, sheetTitle string, config *Config, check *templateCheck) error {
+	columns := make([]dayColumn, 0)
+	cells := make([]string, 0)
+	for _, c := range getDayColumns(config) {
+		if a := config.GetColumnAnchor(c.key); a != nil {
+			columns = append(columns, c)
+			cells = append(cells, a.Cell)
+		}
+	}
+	if len(cells) == 0 {
+		return nil
+	}
+	values, err := getAnchorValues(sht, spreadsheetID, sheetTitle, cells)
+	if err != nil {
+		return err
+	}
+	for i, c := range columns {
+		a := config.GetColumnAnchor(c.key)
+		if strings.Contains(values[i], a.Text) {
+			continue
+		}
+		m := fmt.Sprintf("%s: expected %q, actual %q", a.Cell, a.Text, values[i])
+		if a.IsRequired() {
+			check.mismatches = append(check.mismatches, fmt.Sprintf("%s of %s", m, c.name))
+		} else {
+			check.skippedColumns[c.name] = m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"github.com/tsujio/make-invoices/internal/config"
+)
+
+// Types of the config file, named here as the code of the command calls its
+// config values "config"
+type (
+	Config                = config.Config
+	SpreadsheetConfig     = config.SpreadsheetConfig
+	LocationRule          = config.LocationRule
+	WorkDayRule           = config.WorkDayRule
+	BillingConfig         = config.BillingConfig
+	BillingPeriodConfig   = config.BillingPeriodConfig
+	BreakRule             = config.BreakRule
+	BundleConfig          = config.BundleConfig
+	ClientConfig          = config.ClientConfig
+	ColumnAnchor          = config.ColumnAnchor
+	DailyCSVConfig        = config.DailyCSVConfig
+	DeliveryConfig        = config.DeliveryConfig
+	EmailConfig           = config.EmailConfig
+	EventKind             = config.EventKind
+	HolidaysConfig        = config.HolidaysConfig
+	HooksConfig           = config.HooksConfig
+	InvoiceDocumentConfig = config.InvoiceDocumentConfig
+	NonWorkingDaysConfig  = config.NonWorkingDaysConfig
+	NotifyConfig          = config.NotifyConfig
+	PDFOptions            = config.PDFOptions
+	RevisionConfig        = config.RevisionConfig
+	RowLayout             = config.RowLayout
+	ServeConfig           = config.ServeConfig
+	SummaryConfig         = config.SummaryConfig
+	TaxConfig             = config.TaxConfig
+	WorkCSVColumns        = config.WorkCSVColumns
+	WorkCSVConfig         = config.WorkCSVConfig
+	WorkSourceConfig      = config.WorkSourceConfig
+	WeekdayString         = config.WeekdayString
+	WeekdayRate           = config.WeekdayRate
+)
+
+const (
+	deliveryLocal            = config.DeliveryLocal
+	deliveryDriveUpload      = config.DeliveryDriveUpload
+	deliveryEmail            = config.DeliveryEmail
+	deliveryWebhook          = config.DeliveryWebhook
+	workSourceMergeKeepFirst = config.WorkSourceMergeKeepFirst
+	defaultDocumentKey       = config.DefaultDocumentKey
+)
+
+var (
+	isICSSource                = config.IsICSSource
+	parseWeekday               = config.ParseWeekday
+	resolveConfigPath          = config.ResolvePath
+	getPathSiblingOfExecutable = config.PathSiblingOfExecutable
+)
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"minimal", `{}`, ""},
+		{"durations", `{"retry_deadline": "2m", "api_timeout": "30s", "export_timeout": "3m"}`, ""},
+		{"invalid retry_deadline", `{"retry_deadline": "2 minutes"}`, "retry_deadline"},
+		{"invalid api_timeout", `{"api_timeout": "30"}`, "api_timeout"},
+		{"zero api_timeout", `{"api_timeout": "0s"}`, "api_timeout must be positive"},
+		{"invalid export_timeout", `{"export_timeout": "x"}`, "export_timeout"},
+		{"negative export_timeout", `{"export_timeout": "-1m"}`, "export_timeout must be positive"},
+		{"negative requests per second", `{"api_requests_per_second": -1}`, "api_requests_per_second"},
+		{"invalid break_duration", `{"summary": {"break_duration": "1 hour"}}`, "break_duration"},
+		{"timezone", `{"timezone": "America/New_York"}`, ""},
+		{"unknown timezone", `{"timezone": "Mars/Olympus"}`, "timezone"},
+		{
+			"work_day_rule",
+			`{"work_spreadsheets": [{"id": "a", "work_day_rule": {"weekdays": ["mon", "Tue"]}}]}`,
+			"",
+		},
+		{
+			"unknown weekday in work_day_rule",
+			`{"work_spreadsheets": [{"id": "a", "work_day_rule": {"weekdays": ["mon", "monday"]}}]}`,
+			`spreadsheet a: work_day_rule: unknown weekday "monday"`,
+		},
+		{
+			"work_day_rule without weekdays",
+			`{"work_spreadsheets": [{"id": "a", "work_day_rule": {}}]}`,
+			"weekdays is required",
+		},
+		{
+			"withholding in JPY",
+			`{"billing": {"rate": 50000, "rate_unit": "per_day"}, "tax": {"rate": 10, "withholding": true}}`,
+			"",
+		},
+		{
+			"withholding in USD",
+			`{"currency": "USD", "billing": {"rate": 50000, "rate_unit": "per_day"}, "tax": {"rate": 10, "withholding": true}}`,
+			"withholding tax is only for JPY, not USD",
+		},
+		{
+			"withholding of a spreadsheet in USD",
+			`{"billing": {"rate": 50000, "rate_unit": "per_day"}, "work_spreadsheets": [{"id": "a", "currency": "USD", "tax": {"rate": 0, "withholding": true}}]}`,
+			"spreadsheet a: withholding tax is only for JPY, not USD",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readConfigFile(writeTestConfig(t, tt.config))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("readConfigFile: %v", err)
+				}
+				return
+			}
+			var runErr *runError
+			if !errors.As(err, &runErr) {
+				t.Fatalf("got %v, want a run error", err)
+			}
+			if runErr.code != exitConfigError {
+				t.Errorf("got exit code %d, want %d", runErr.code, exitConfigError)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %q, want %q in it", err, tt.wantErr)
+			}
+		})
+	}
+}
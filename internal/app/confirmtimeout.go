@@ -0,0 +1,134 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What prompts answer when nobody does within --confirm-timeout
+const (
+	onTimeoutProceed = "proceed"
+	onTimeoutAbort   = "abort"
+)
+
+// With --confirm-timeout, prompts on a terminal wait for the answer that
+// long with a countdown, then answer by --on-timeout, so that runs left
+// alone don't hang until the next one starts. Prompts with stdin not being
+// a terminal wait as before, --yes and --unattended being the way not to.
+var (
+	confirmTimeout time.Duration
+	onTimeout      string
+)
+
+// Lines of stdin, read by a goroutine once a prompt has a timeout, as a read
+// can't be given up. Every answer after that is read from here, so that no
+// line goes to the abandoned read.
+var (
+	stdinMu    sync.Mutex
+	stdinLines chan string
+)
+
+// Returns the lines of stdin, starting the reader if start is set, or nil
+// if it was not started
+func getStdinLines(start bool) <-chan string {
+	stdinMu.Lock()
+	defer stdinMu.Unlock()
+	if stdinLines == nil && start {
+		stdinLines = readLines(os.Stdin)
+	}
+	return stdinLines
+}
+
+// Returns the lines of r, read by a goroutine until the end of r
+func readLines(r io.Reader) chan string {
+	lines := make(chan string)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	return lines
+}
+
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Reads the answer to the prompt just printed. timedOut tells that nobody
+// answered within --confirm-timeout.
+func readAnswer() (ans string, timedOut bool) {
+	timed := confirmTimeout > 0 && stdinIsTerminal()
+	lines := getStdinLines(timed)
+	if lines == nil {
+		fmt.Scanln(&ans)
+		return strings.TrimSpace(ans), false
+	}
+	if !timed {
+		return strings.TrimSpace(<-lines), false
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	return awaitAnswer(lines, ticker.C, confirmTimeout, os.Stderr)
+}
+
+// Waits for a line for timeout, counted down by ticks of a second, writing
+// the seconds left to out. Lines typed before the prompt are not answers to
+// it.
+func awaitAnswer(lines <-chan string, ticks <-chan time.Time, timeout time.Duration, out io.Writer) (string, bool) {
+	for drained := false; !drained; {
+		select {
+		case _, ok := <-lines:
+			drained = !ok
+		default:
+			drained = true
+		}
+	}
+	left := int((timeout + time.Second - 1) / time.Second)
+	countdown := fmt.Sprintf("[%3ds] ", left)
+	fmt.Fprint(out, countdown)
+	for {
+		select {
+		case line := <-lines:
+			return strings.TrimSpace(line), false
+		case <-ticks:
+			left--
+			if left <= 0 {
+				fmt.Fprintln(out)
+				return "", true
+			}
+			// The countdown is rewritten in place, after the prompt
+			fmt.Fprint(out, strings.Repeat("\b", len(countdown)))
+			countdown = fmt.Sprintf("[%3ds] ", left)
+			fmt.Fprint(out, countdown)
+		}
+	}
+}
+
+// Returns the answer given by the timeout, logging it
+func answerTimeout(logf func(string, ...interface{})) bool {
+	logf("%s\n", msg("answered_timeout_"+onTimeout, confirmTimeout))
+	return onTimeout == onTimeoutProceed
+}
+
+// Reads the authorization code, from the reader of answers if it was
+// started by a prompt
+func readAuthCode() (string, error) {
+	if lines := getStdinLines(false); lines != nil {
+		code, ok := <-lines
+		if !ok {
+			return "", io.EOF
+		}
+		return strings.TrimSpace(code), nil
+	}
+	var code string
+	_, err := fmt.Scan(&code)
+	return code, err
+}
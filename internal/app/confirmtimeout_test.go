@@ -0,0 +1,82 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAnswer struct {
+	ans      string
+	timedOut bool
+}
+
+// Starts waiting for the answer to a prompt of the timeout on the lines of
+// a pipe, the ticks of the clock being sent by the test
+func startTestAwaitAnswer(t *testing.T, timeout time.Duration) (*io.PipeWriter, chan<- time.Time, <-chan testAnswer, *bytes.Buffer) {
+	t.Helper()
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	ticks := make(chan time.Time)
+	answers := make(chan testAnswer, 1)
+	out := new(bytes.Buffer)
+	lines := readLines(pr)
+	go func() {
+		ans, timedOut := awaitAnswer(lines, ticks, timeout, out)
+		answers <- testAnswer{ans, timedOut}
+	}()
+	return pw, ticks, answers, out
+}
+
+// Returns the countdown written after n ticks of a second of a timeout of
+// seconds, like "[  3s] \b\b\b\b\b\b\b[  2s] "
+func testCountdown(seconds, n int) string {
+	var b strings.Builder
+	for i := 0; i <= n; i++ {
+		if i > 0 {
+			b.WriteString("\b\b\b\b\b\b\b")
+		}
+		b.WriteString("[  " + string(rune('0'+seconds-i)) + "s] ")
+	}
+	return b.String()
+}
+
+func TestAwaitAnswer(t *testing.T) {
+	t.Run("answered", func(t *testing.T) {
+		pw, ticks, answers, out := startTestAwaitAnswer(t, 3*time.Second)
+		ticks <- time.Now()
+		if _, err := io.WriteString(pw, " y \n"); err != nil {
+			t.Fatal(err)
+		}
+		if a := <-answers; a != (testAnswer{"y", false}) {
+			t.Errorf("got %+v", a)
+		}
+		if want := testCountdown(3, 1); out.String() != want {
+			t.Errorf("got countdown %q, want %q", out.String(), want)
+		}
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		// Timeouts are counted down from the seconds rounded up
+		_, ticks, answers, out := startTestAwaitAnswer(t, 2500*time.Millisecond)
+		for i := 0; i < 3; i++ {
+			ticks <- time.Now()
+		}
+		if a := <-answers; a != (testAnswer{"", true}) {
+			t.Errorf("got %+v", a)
+		}
+		if want := testCountdown(3, 2) + "\n"; out.String() != want {
+			t.Errorf("got countdown %q, want %q", out.String(), want)
+		}
+	})
+
+	t.Run("stdin closed", func(t *testing.T) {
+		pw, _, answers, _ := startTestAwaitAnswer(t, 3*time.Second)
+		pw.Close()
+		if a := <-answers; a != (testAnswer{"", false}) {
+			t.Errorf("got %+v", a)
+		}
+	})
+}
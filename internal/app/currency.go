@@ -0,0 +1,101 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currency tells how amounts in its minor units, like yen or cents, are
+// written
+type currency struct {
+	code     string
+	symbol   string
+	decimals int
+}
+
+var currencies = map[string]*currency{
+	"JPY": {"JPY", "¥", 0},
+	"USD": {"USD", "$", 2},
+	"EUR": {"EUR", "€", 2},
+	"GBP": {"GBP", "£", 2},
+}
+
+// Amounts of spreadsheets without currency are yen written without the
+// symbol, as before currencies were supported
+var defaultCurrency = &currency{"JPY", "", 0}
+
+// Returns the currency of the spreadsheet, which replaces the global one if
+// any
+func getCurrency(c *Config, sc *SpreadsheetConfig) (*currency, error) {
+	code := sc.Currency
+	if code == "" {
+		code = c.Currency
+	}
+	if code == "" {
+		return defaultCurrency, nil
+	}
+	cur, ok := currencies[strings.ToUpper(code)]
+	if !ok {
+		return nil, fmt.Errorf("unknown currency %q", code)
+	}
+	return cur, nil
+}
+
+// Formats an integer with thousands separators like 123,456
+func formatAmount(amount int64) string {
+	s := strconv.FormatInt(amount, 10)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// Splits the amount in minor units into the major units and the decimals
+func (c *currency) split(amount int64) (neg bool, major int64, minor string) {
+	if amount < 0 {
+		neg, amount = true, -amount
+	}
+	unit := int64(1)
+	for i := 0; i < c.decimals; i++ {
+		unit *= 10
+	}
+	major = amount / unit
+	if c.decimals > 0 {
+		minor = fmt.Sprintf("%0*d", c.decimals, amount%unit)
+	}
+	return
+}
+
+// Formats the amount in minor units for documents and messages, like
+// ¥1,234,567 or $12,345.67
+func (c *currency) format(amount int64) string {
+	neg, major, minor := c.split(amount)
+	s := c.symbol + formatAmount(major)
+	if minor != "" {
+		s += "." + minor
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// Formats the amount in minor units as a plain number for sheet cells, like
+// 12345.67
+func (c *currency) formatNumber(amount int64) string {
+	neg, major, minor := c.split(amount)
+	s := strconv.FormatInt(major, 10)
+	if minor != "" {
+		s += "." + minor
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+)
+
+// Columns of the daily CSV
+var dailyCSVColumns = map[string]func(d *dailyRecord, c *DailyCSVConfig) string{
+	"date":           func(d *dailyRecord, c *DailyCSVConfig) string { return d.date.Format(c.GetDateFormat()) },
+	"weekday":        func(d *dailyRecord, c *DailyCSVConfig) string { return d.date.Format("Mon") },
+	"client":         func(d *dailyRecord, c *DailyCSVConfig) string { return d.client },
+	"spreadsheet_id": func(d *dailyRecord, c *DailyCSVConfig) string { return d.spreadsheetID },
+	"start":          func(d *dailyRecord, c *DailyCSVConfig) string { return formatDailyCSVClock(d.start, c.GetTimeFormat()) },
+	"end":            func(d *dailyRecord, c *DailyCSVConfig) string { return formatDailyCSVClock(d.end, c.GetTimeFormat()) },
+	"break":          func(d *dailyRecord, c *DailyCSVConfig) string { return d.brk },
+	"hours":          func(d *dailyRecord, c *DailyCSVConfig) string { return d.hours },
+	"amount":         func(d *dailyRecord, c *DailyCSVConfig) string { return d.amount },
+	"kind":           func(d *dailyRecord, c *DailyCSVConfig) string { return d.kind },
+	"note":           func(d *dailyRecord, c *DailyCSVConfig) string { return d.note },
+	"location":       func(d *dailyRecord, c *DailyCSVConfig) string { return d.location },
+}
+
+func validateDailyCSV(c *DailyCSVConfig) error {
+	for _, name := range c.GetColumns() {
+		if _, ok := dailyCSVColumns[name]; !ok {
+			return fmt.Errorf("unknown column: %q", name)
+		}
+	}
+	return nil
+}
+
+// Returns the daily CSV settings of the run, or nil without the daily CSV
+func getDailyCSV(c *Config) *DailyCSVConfig {
+	if !c.ExportDailyCSV && dailyCSVPath == "" {
+		return nil
+	}
+	if c.DailyCSV == nil {
+		return &DailyCSVConfig{}
+	}
+	return c.DailyCSV
+}
+
+// Path of the daily CSV of every spreadsheet, given by --daily-csv
+var dailyCSVPath string
+
+// dailyRecord is the work of a day of a spreadsheet, as written to the sheet
+type dailyRecord struct {
+	spreadsheetID string
+	client        string
+	date          time.Time
+	// Times of the day like "9:00", which may be past 24:00
+	start    string
+	end      string
+	brk      string
+	hours    string
+	amount   string
+	kind     string
+	note     string
+	location string
+}
+
+// Returns the records of the work days of the rows, with the amounts by the
+// rate of each day if billed per day or hour
+func getDailyRecords(spreadsheetID, client string, rows []dayRow, period billingPeriod, breaks *breakPolicy, billing *BillingConfig, kinds []*EventKind, cur *currency) ([]*dailyRecord, error) {
+	records := make([]*dailyRecord, 0)
+	for i := 0; i < len(rows) && i < period.days(); i++ {
+		r := rows[i]
+		if !isWorkRow(r) {
+			continue
+		}
+		d := &dailyRecord{
+			spreadsheetID: spreadsheetID,
+			client:        client,
+			date:          period.day(i),
+			start:         r.Start,
+			end:           r.End,
+			kind:          r.Kind,
+			note:          strings.TrimSpace(r.Note + " " + r.DayNote),
+			location:      r.Location,
+		}
+		worked, err := sumWorkDuration(rows[i:i+1], breaks)
+		if err != nil {
+			return nil, err
+		}
+		if r.Start != "" && r.End != "" {
+			start, err := parseClock(r.Start)
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseClock(r.End)
+			if err != nil {
+				return nil, err
+			}
+			_, brk := breaks.workDuration(start, end)
+			d.brk = formatBreak(brk)
+			d.hours = strconv.FormatFloat(worked.Hours(), 'f', -1, 64)
+		}
+		if billing != nil {
+			rate := rateOf(billing, r, d.date.Weekday(), kinds)
+			switch billing.RateUnit {
+			case "per_day":
+				d.amount = cur.formatNumber(rate)
+			case "per_month":
+			default:
+				// Fractions of a minor unit are rounded half up
+				d.amount = cur.formatNumber((rate*int64(worked/time.Minute) + 30) / 60)
+			}
+		}
+		records = append(records, d)
+	}
+	return records, nil
+}
+
+// Formats the time of the day by the layout. Times past 24:00 are written
+// as the ones of the next day, which the work CSV takes as the next day
+// when before the start.
+func formatDailyCSVClock(clock, layout string) string {
+	d, err := parseClock(clock)
+	if err != nil {
+		return clock
+	}
+	return time.Time{}.Add(d % (24 * time.Hour)).Format(layout)
+}
+
+// Writes the records to the file, with a header row of the columns
+func writeDailyCSV(fileName string, records []*dailyRecord, c *DailyCSVConfig) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	columns := c.GetColumns()
+	if err := w.Write(columns); err != nil {
+		return err
+	}
+	for _, d := range records {
+		row := make([]string, 0, len(columns))
+		for _, name := range columns {
+			row = append(row, dailyCSVColumns[name](d, c))
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Reserves the daily CSV of every spreadsheet, returning "" if there is
+// none
+func reserveDailyCSV(targetTime time.Time, config *Config, files *reservedFiles) (string, error) {
+	c := getDailyCSV(config)
+	if c == nil || (c.PerClient && dailyCSVPath == "") {
+		return "", nil
+	}
+	name := dailyCSVPath
+	if name == "" {
+		name = targetTime.Format("200601") + ".daily.csv"
+		if c.Name != "" {
+			var err error
+			if name, err = export.FormatNameTemplate("daily_csv.name", c.Name, targetTime, "", ""); err != nil {
+				return "", err
+			}
+		}
+		name = export.SanitizeFilePath(name)
+	}
+	return files.reserveOutput(name, "the daily CSV", config.OnExistingOutput, log.Default())
+}
+
+// Writes the daily CSV of each spreadsheet with per_client
+func writeClientDailyCSVs(targetTime time.Time, spreadsheets []*SpreadsheetConfig, errs []error, config *Config, files *reservedFiles) error {
+	c := getDailyCSV(config)
+	for i, sc := range spreadsheets {
+		records, ok := files.daily[sc.ID]
+		if errs[i] != nil || !ok {
+			continue
+		}
+		title, invoiceNumber := "", ""
+		if record := files.records[sc.ID]; record != nil {
+			title, invoiceNumber = record.title, record.invoiceNumber
+		}
+		name := targetTime.Format("200601") + title + ".daily.csv"
+		if c.Name != "" {
+			var err error
+			if name, err = export.FormatNameTemplate("daily_csv.name", c.Name, targetTime, title, invoiceNumber); err != nil {
+				return err
+			}
+		}
+		name, err := files.reserveOutput(export.SanitizeFilePath(name), sc.ID, config.OnExistingOutput, log.Default())
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		if err := writeDailyCSV(name, records, c); err != nil {
+			return fmt.Errorf("failed to write daily CSV %s: %v", name, err)
+		}
+		log.Printf("Wrote %d days of %s to %s\n", len(records), title, name)
+		files.written = append(files.written, &outputFile{path: name, title: title, spreadsheetID: sc.ID})
+	}
+	return nil
+}
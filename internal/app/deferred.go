@@ -0,0 +1,42 @@
+package app
+
+import (
+	"fmt"
+	"log"
+)
+
+// deferredUpdate is an update of a sheet not changing the invoice, like the
+// tab color and the order of the sheets, made at the end of the run so that
+// the writes of the values of every spreadsheet go first under the limit of
+// writes
+type deferredUpdate struct {
+	title string
+	// What is updated, like "tab color of sheet 2024/01"
+	name   string
+	update func() error
+	logger *log.Logger
+}
+
+// Defers the update to the end of the run
+func (r *reservedFiles) deferUpdate(u *deferredUpdate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deferred = append(r.deferred, u)
+}
+
+// Makes the deferred updates in the order they were deferred. Updates left
+// when the run is canceled are dropped, being reported as skipped. Failures
+// are warned of, the sheets having the values already.
+func runDeferredUpdates(files *reservedFiles) {
+	for _, u := range files.deferred {
+		if err := runCtx.Err(); err != nil {
+			files.skippedUpdates = append(files.skippedUpdates, fmt.Sprintf("%s of %s (%v)", u.name, u.title, err))
+			continue
+		}
+		if err := u.update(); err != nil {
+			logWarnf(u.logger, "Warning: failed to update %s: %v\n", u.name, err)
+			files.skippedUpdates = append(files.skippedUpdates, fmt.Sprintf("%s of %s (%v)", u.name, u.title, err))
+		}
+	}
+	files.deferred = nil
+}
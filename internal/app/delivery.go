@@ -0,0 +1,349 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+)
+
+// SentEmail is an email of the invoice of a month sent to the client, with
+// the hashes of its attachments by file name. Runs of the month again skip
+// the email if the attachments are the same, and fail it if they changed,
+// unless --resend is given, so that no invoice is sent twice.
+type SentEmail struct {
+	ID     string            `json:"id"`
+	SentAt time.Time         `json:"sent_at"`
+	Files  map[string]string `json:"files,omitempty"`
+}
+
+// UploadedFile is an output uploaded to the client by drive_upload, kept
+// like SentEmail
+type UploadedFile struct {
+	FileID     string    `json:"file_id"`
+	Name       string    `json:"name"`
+	SHA256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Whether the outputs of a spreadsheet reached the client, by email or
+// drive_upload, in the order of precedence
+const (
+	sendStateNotSent = "not_sent"
+	sendStateSkipped = "skipped"
+	sendStateSent    = "sent"
+)
+
+var sendStateOrder = map[string]int{sendStateNotSent: 0, sendStateSkipped: 1, sendStateSent: 2}
+
+// Records the send state of the spreadsheet, the one of a delivery sending
+// the outputs winning over the ones skipping them
+func (f *reservedFiles) setSendState(spreadsheetID, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if current, ok := f.sendStates[spreadsheetID]; !ok || sendStateOrder[state] > sendStateOrder[current] {
+		f.sendStates[spreadsheetID] = state
+	}
+}
+
+// Returns the send state of the spreadsheet to show in summaries
+func formatSendState(files *reservedFiles, spreadsheetID string) string {
+	state, ok := files.sendStates[spreadsheetID]
+	if !ok {
+		state = sendStateNotSent
+	}
+	return msg("send_state_" + state)
+}
+
+// Returns the hashes of the files by name
+func hashFiles(paths []string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, p := range paths {
+		sum, _, err := hashFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %v", p, err)
+		}
+		hashes[filepath.Base(p)] = sum
+	}
+	return hashes, nil
+}
+
+func sameHashes(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, sum := range a {
+		if b[name] != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// driveUpload is an output uploaded by drive_upload, kind being "" for the
+// timesheet pdf and the key of the document for document pdfs
+type driveUpload struct {
+	path string
+	kind string
+}
+
+// deliveryOutputs is what the deliveries of a spreadsheet get
+type deliveryOutputs struct {
+	spreadsheetID string
+	title         string
+	invoiceNumber string
+	revision      int
+	targetTime    time.Time
+	period        billingPeriod
+	workDays      int
+	amount        *billingAmount
+	client        *ClientConfig
+	// Files uploaded by drive_upload, or the bundle with upload_bundle
+	uploads      []driveUpload
+	clientBundle string
+	outputPaths  map[string]string
+}
+
+// Returns the key of the invoice of the month delivered, the revisions being
+// delivered apart from the originals
+func (o *deliveryOutputs) key() string {
+	return o.spreadsheetID + "/" + revisionKey(o.targetTime.Format("200601"), o.revision)
+}
+
+// Delivers the outputs of the spreadsheet in each of its ways. Failed
+// deliveries leave the outputs made, and are reported apart from them.
+func deliverToClient(drv *drive.Service, gml *gmail.Service, sc *SpreadsheetConfig, o *deliveryOutputs, config *Config, files *reservedFiles, record *spreadsheetRecord, logger *log.Logger) {
+	for _, d := range config.GetDeliveries(sc) {
+		status, err := deliver(drv, gml, sc, d, o, config, files, record, logger)
+		if err != nil {
+			status = "failed: " + err.Error()
+			logErrorf(logger, "Failed to deliver by %s: %v\n", d.Type, err)
+		}
+		files.mu.Lock()
+		files.deliveries[o.spreadsheetID] = append(files.deliveries[o.spreadsheetID], d.Type+": "+status)
+		if err != nil {
+			files.deliveryFailed[o.spreadsheetID] = true
+		}
+		files.mu.Unlock()
+	}
+}
+
+// Delivers the outputs in the way, returning the status
+func deliver(drv *drive.Service, gml *gmail.Service, sc *SpreadsheetConfig, d *DeliveryConfig, o *deliveryOutputs, config *Config, files *reservedFiles, record *spreadsheetRecord, logger *log.Logger) (string, error) {
+	switch d.Type {
+	case deliveryLocal:
+		return fmt.Sprintf("kept %d files", len(o.outputPaths)), nil
+	case deliveryDriveUpload:
+		if sandbox {
+			return "skipped in sandbox runs", nil
+		}
+		return deliverToDrive(drv, d, o, config, files, record, logger)
+	case deliveryEmail:
+		if !sendEmailFlag && !draftEmail {
+			return "not sent (use --send-email or --draft)", nil
+		}
+		return deliverByEmail(gml, d.GetEmail(sc), o, files, logger)
+	case deliveryWebhook:
+		return deliverToWebhook(d.URL, o)
+	}
+	return "", fmt.Errorf("unknown delivery type: %q", d.Type)
+}
+
+// Uploads the outputs, replacing the ones uploaded by runs of the month
+// before. Outputs uploaded before as they are now are skipped, and changed
+// ones are only uploaded again with --resend.
+func deliverToDrive(drv *drive.Service, d *DeliveryConfig, o *deliveryOutputs, config *Config, files *reservedFiles, record *spreadsheetRecord, logger *log.Logger) (string, error) {
+	uploads := o.uploads
+	if o.clientBundle != "" && config.Bundle.UploadBundle {
+		uploads = []driveUpload{{path: o.clientBundle, kind: "bundle"}}
+	}
+	state, err := loadState()
+	if err != nil {
+		return "", fmt.Errorf("failed to load state: %v", err)
+	}
+	c := *config
+	c.DriveUploadFolderID = d.GetFolderID(config)
+	links := make([]string, 0, len(uploads))
+	skipped := make([]string, 0)
+	for _, u := range uploads {
+		key := o.key()
+		if u.kind != "" {
+			key += "/" + u.kind
+		}
+		sum, _, err := hashFile(u.path)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %v", u.path, err)
+		}
+		if uploaded := state.Uploads[key]; uploaded != nil && !resend {
+			if uploaded.SHA256 != sum {
+				return "", fmt.Errorf("%s changed since it was uploaded on %s (use --resend to upload it again, or revise for a revised invoice)", u.path, uploaded.UploadedAt.Format("2006-01-02"))
+			}
+			logWarnf(logger, "Skipped uploading %s, uploaded on %s as it is\n", u.path, uploaded.UploadedAt.Format("2006-01-02"))
+			skipped = append(skipped, filepath.Base(u.path))
+			continue
+		}
+		file, err := uploadToDrive(drv, u.path, u.kind, o.spreadsheetID, o.title, o.invoiceNumber, o.revision, o.targetTime, &c, logger)
+		if err != nil {
+			return "", err
+		}
+		logger.Printf("Uploaded %s to drive: %s\n", u.path, file.WebViewLink)
+		files.mu.Lock()
+		files.uploaded = append(files.uploaded, fmt.Sprintf("%s: %s (%s)", u.path, file.Id, file.WebViewLink))
+		record.pdfLink = file.WebViewLink
+		files.mu.Unlock()
+		links = append(links, file.WebViewLink)
+		if err := updateState(func(state *State) error {
+			if state.Uploads == nil {
+				state.Uploads = make(map[string]*UploadedFile)
+			}
+			state.Uploads[key] = &UploadedFile{FileID: file.Id, Name: filepath.Base(u.path), SHA256: sum, UploadedAt: time.Now()}
+			return nil
+		}); err != nil {
+			logWarnf(logger, "Warning: failed to record the upload: %v\n", err)
+		}
+	}
+	parts := make([]string, 0, 2)
+	if len(links) > 0 {
+		files.setSendState(o.spreadsheetID, sendStateSent)
+		parts = append(parts, "uploaded "+strings.Join(links, ", "))
+	}
+	if len(skipped) > 0 {
+		files.setSendState(o.spreadsheetID, sendStateSkipped)
+		parts = append(parts, "skipped "+strings.Join(skipped, ", ")+" (already uploaded)")
+	}
+	if len(parts) == 0 {
+		return "nothing to upload", nil
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// Sends the email, or makes a draft of it with --draft. An invoice sent by
+// a run before is not sent again unless --resend is given, the run failing
+// the email if the attachments changed since.
+func deliverByEmail(gml *gmail.Service, ec *EmailConfig, o *deliveryOutputs, files *reservedFiles, logger *log.Logger) (string, error) {
+	ec = o.client.AddressEmail(ec)
+	attachments := make([]string, 0)
+	for _, a := range getEmailAttachments(ec) {
+		attachments = append(attachments, o.outputPaths[a])
+	}
+	hashes, err := hashFiles(attachments)
+	if err != nil {
+		return "", err
+	}
+	state, err := loadState()
+	if err != nil {
+		return "", fmt.Errorf("failed to load state: %v", err)
+	}
+	// Emails recorded without hashes were sent before they were kept, and
+	// are taken as sent as they are
+	if sent := state.SentEmails[o.key()]; sent != nil && !resend && !draftEmail {
+		if sent.Files != nil && !sameHashes(sent.Files, hashes) {
+			return "", fmt.Errorf("attachments changed since the email was sent on %s (use --resend to send them again, or revise for a revised invoice)", sent.SentAt.Format("2006-01-02"))
+		}
+		status := fmt.Sprintf("skipped, sent on %s as it is", sent.SentAt.Format("2006-01-02"))
+		logger.Printf("Email to %s: %s\n", strings.Join(ec.To, ", "), status)
+		files.setSendState(o.spreadsheetID, sendStateSkipped)
+		return status, nil
+	}
+	id, err := sendEmail(gml, ec, newEmailTemplateData(o.targetTime, o.period, o.title, o.workDays, o.amount, o.client), attachments, draftEmail)
+	if err != nil {
+		return "", err
+	}
+	status := "sent " + id
+	if draftEmail {
+		status = "created draft " + id
+	} else {
+		files.setSendState(o.spreadsheetID, sendStateSent)
+		if err := updateState(func(state *State) error {
+			if state.SentEmails == nil {
+				state.SentEmails = make(map[string]*SentEmail)
+			}
+			state.SentEmails[o.key()] = &SentEmail{ID: id, SentAt: time.Now(), Files: hashes}
+			return nil
+		}); err != nil {
+			logWarnf(logger, "Warning: failed to record the email sent: %v\n", err)
+		}
+	}
+	logger.Printf("Email to %s: %s\n", strings.Join(ec.To, ", "), status)
+	files.mu.Lock()
+	files.emails = append(files.emails, fmt.Sprintf("%s: %s", o.title, status))
+	files.mu.Unlock()
+	return status, nil
+}
+
+type deliveryWebhookFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Posts the outputs to the webhook. The key is the same in runs of the
+// month again, for the receiver to replace what it got before.
+func deliverToWebhook(url string, o *deliveryOutputs) (string, error) {
+	payload := struct {
+		Key           string                 `json:"key"`
+		Month         string                 `json:"month"`
+		SpreadsheetID string                 `json:"spreadsheet_id"`
+		Title         string                 `json:"title"`
+		InvoiceNumber string                 `json:"invoice_number,omitempty"`
+		Revision      int                    `json:"revision,omitempty"`
+		Files         []*deliveryWebhookFile `json:"files"`
+	}{
+		Key:           o.key(),
+		Month:         o.targetTime.Format("200601"),
+		SpreadsheetID: o.spreadsheetID,
+		Title:         o.title,
+		InvoiceNumber: o.invoiceNumber,
+		Revision:      o.revision,
+		Files:         make([]*deliveryWebhookFile, 0, len(o.outputPaths)),
+	}
+	for name, path := range o.outputPaths {
+		sum, size, err := hashFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %v", path, err)
+		}
+		payload.Files = append(payload.Files, &deliveryWebhookFile{Name: name, Path: path, SHA256: sum, Size: size})
+	}
+	sort.Slice(payload.Files, func(i, j int) bool {
+		return payload.Files[i].Name < payload.Files[j].Name
+	})
+	d, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Transport: &retryTransport{base: http.DefaultTransport}}
+	if err := callAPI("post delivery", func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(withAttemptTimeout(ctx, 30*time.Second), http.MethodPost, url, bytes.NewReader(d))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return &httpStatusError{code: resp.StatusCode, status: resp.Status, header: resp.Header}
+		}
+		return nil
+	}); err != nil {
+		return "", fmt.Errorf("failed to post to webhook: %v", err)
+	}
+	return fmt.Sprintf("posted %d files", len(payload.Files)), nil
+}
+
+// Returns the statuses of the deliveries of the spreadsheet in the run
+func formatDeliveries(files *reservedFiles, spreadsheetID string) string {
+	return strings.Join(files.deliveries[spreadsheetID], "; ")
+}
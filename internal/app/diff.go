@@ -0,0 +1,328 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+// cellDiff is a cell whose value would be changed by a write
+type cellDiff struct {
+	Range   string
+	Cell    string
+	Current string
+	New     string
+}
+
+func (d cellDiff) String() string {
+	return fmt.Sprintf("%s: %q -> %q", d.Cell, d.Current, d.New)
+}
+
+// Returns the cells of the ranges whose current values differ from the ones
+// to write. Current values are given both as formulas and as formatted, and
+// either matching the new value makes the cell unchanged, so that rewriting
+// "9:00" to a cell showing "09:00" isn't a change.
+func diffRangeValues(ranges []string, formulas, formatted, values [][][]interface{}) ([]cellDiff, error) {
+	diffs := make([]cellDiff, 0)
+	for i, r := range ranges {
+		c0, r0, err := timesheet.ParseA1Cell(strings.SplitN(r, ":", 2)[0])
+		if err != nil {
+			return nil, err
+		}
+		for row := range values[i] {
+			for col := range values[i][row] {
+				// Nil values leave cells as they are
+				if values[i][row][col] == nil {
+					continue
+				}
+				want := cellString(values[i], row, col)
+				formula := cellString(formulas[i], row, col)
+				shown := cellString(formatted[i], row, col)
+				if sameCellValue(formula, want) || sameCellValue(shown, want) {
+					continue
+				}
+				current := shown
+				if strings.HasPrefix(formula, "=") {
+					current = formula
+				}
+				diffs = append(diffs, cellDiff{
+					Range:   r,
+					Cell:    timesheet.FormatA1Cell(c0+col, r0+row),
+					Current: current,
+					New:     want,
+				})
+			}
+		}
+	}
+	return diffs, nil
+}
+
+func cellString(v [][]interface{}, i, j int) string {
+	if i >= len(v) || j >= len(v[i]) || v[i][j] == nil {
+		return ""
+	}
+	return fmt.Sprint(v[i][j])
+}
+
+// Tells whether a cell value is the same as a value written with
+// USER_ENTERED, allowing different notations of times, dates and numbers
+func sameCellValue(current, want string) bool {
+	current, want = strings.TrimSpace(current), strings.TrimSpace(want)
+	if current == want {
+		return true
+	}
+	if a, err := parseClock(current); err == nil {
+		if b, err := parseClock(want); err == nil {
+			return a == b
+		}
+	}
+	// Dates may be written in either notation by the locale
+	if a, ok := parseCellDate(current); ok {
+		if b, ok := parseCellDate(want); ok {
+			return a.Equal(b)
+		}
+	}
+	// Serial numbers of times may be read back rounded
+	if a, err := strconv.ParseFloat(current, 64); err == nil {
+		if b, err := strconv.ParseFloat(want, 64); err == nil {
+			return math.Abs(a-b) < 1e-9
+		}
+	}
+	return false
+}
+
+func parseCellDate(s string) (time.Time, bool) {
+	for _, layout := range []string{"2006/1/2", "2006-1-2"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Returns the cells of the ranges not having the values written, read back
+// as formulas, which are unformatted values for cells other than formulas,
+// and as formatted. Nil values were not written and are not checked.
+func findUnwrittenCells(ranges []string, formulas, formatted, values [][][]interface{}) ([]cellDiff, error) {
+	unwritten := make([]cellDiff, 0)
+	for i, r := range ranges {
+		c0, r0, err := timesheet.ParseA1Cell(strings.SplitN(r, ":", 2)[0])
+		if err != nil {
+			return nil, err
+		}
+		for row := range values[i] {
+			for col := range values[i][row] {
+				if values[i][row][col] == nil {
+					continue
+				}
+				var unformatted interface{}
+				if row < len(formulas[i]) && col < len(formulas[i][row]) {
+					unformatted = formulas[i][row][col]
+				}
+				want := cellString(values[i], row, col)
+				shown := cellString(formatted[i], row, col)
+				if isWrittenValue(want, unformatted, shown) {
+					continue
+				}
+				unwritten = append(unwritten, cellDiff{
+					Range:   r,
+					Cell:    timesheet.FormatA1Cell(c0+col, r0+row),
+					Current: shown,
+					New:     want,
+				})
+			}
+		}
+	}
+	return unwritten, nil
+}
+
+// Tells whether a cell read back has the value written with USER_ENTERED.
+// Sheets coerce times and dates to serial numbers of days since
+// timesheet.SheetsEpoch, which are read unformatted as numbers like
+// 0.3958333 for "9:30", and show them in the format of the cell, like
+// "09:30:00".
+// Decimals written with a comma in the locale are read as numbers too.
+func isWrittenValue(want string, unformatted interface{}, formatted string) bool {
+	want = strings.TrimSpace(want)
+	if unformatted == nil {
+		return want == ""
+	}
+	if sameCellValue(fmt.Sprint(unformatted), want) || sameCellValue(formatted, want) {
+		return true
+	}
+	serial, ok := unformatted.(float64)
+	if !ok {
+		return false
+	}
+	if d, err := parseClock(want); err == nil {
+		return math.Abs(serial*24*60-d.Minutes()) < 0.5
+	}
+	if t, ok := parseCellDate(want); ok {
+		return math.Abs(serial-t.Sub(timesheet.SheetsEpoch).Hours()/24) < 1e-6
+	}
+	if f, err := strconv.ParseFloat(strings.Replace(want, ",", ".", 1), 64); err == nil {
+		return math.Abs(serial-f) < 1e-9
+	}
+	return false
+}
+
+// Reads back the ranges of the sheet just written and returns the cells not
+// having the values written, e.g. ones the data validation or the
+// protection of the sheet rejected
+func verifyWrittenValues(sht *sheets.Service, spreadsheetID, sheetTitle string, ranges []string, written [][][]interface{}, data []*sheets.ValueRange) ([]cellDiff, error) {
+	formatted, err := getRenderedRangeValues(sht, spreadsheetID, sheetTitle, ranges, "FORMATTED_VALUE")
+	if err != nil {
+		return nil, err
+	}
+	values := make([][][]interface{}, 0, len(data))
+	for _, vr := range data {
+		values = append(values, vr.Values)
+	}
+	return findUnwrittenCells(ranges, written, formatted, values)
+}
+
+func countCells(values [][][]interface{}) int {
+	n := 0
+	for _, v := range values {
+		for _, row := range v {
+			for _, cell := range row {
+				if cell != nil {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// Logs the changed cells of a sheet, summarizing the unchanged ones as a count
+func logCellDiffs(logger *log.Logger, sheetTitle string, diffs []cellDiff, cells int) {
+	logger.Printf("Sheet %s: %d cells to change, %d unchanged\n", sheetTitle, len(diffs), cells-len(diffs))
+	for _, d := range diffs {
+		logger.Printf("  %s\n", d)
+	}
+}
+
+// Patterns of the values the tool writes to day columns
+var dayColumnPatterns = map[string]*regexp.Regexp{
+	"work times":         regexp.MustCompile(`^[0-9]{1,2}:[0-5][0-9](:[0-5][0-9])?$`),
+	"work end times":     regexp.MustCompile(`^[0-9]{1,2}:[0-5][0-9](:[0-5][0-9])?$`),
+	"work day fractions": regexp.MustCompile(`^[0-9]*\.?[0-9]+$`),
+}
+
+// Returns the changed cells whose current values the tool wouldn't have
+// written, like formulas or notes left in the template. patterns maps ranges
+// to the pattern of their values.
+func findUnexpectedCells(diffs []cellDiff, patterns map[string]*regexp.Regexp) []cellDiff {
+	unexpected := make([]cellDiff, 0)
+	for _, d := range diffs {
+		if d.Current == "" {
+			continue
+		}
+		if strings.HasPrefix(d.Current, "=") {
+			unexpected = append(unexpected, d)
+			continue
+		}
+		if p, ok := patterns[d.Range]; ok && !p.MatchString(strings.TrimSpace(d.Current)) {
+			unexpected = append(unexpected, d)
+		}
+	}
+	return unexpected
+}
+
+// sheetGrid is the cells of the ranges written to a sheet not created yet,
+// as the copy of its source would have them after the writes. It previews
+// what the new sheet would show, including the values of the source left in
+// the cells not written, like notes of sparse columns.
+type sheetGrid struct {
+	cells map[string]*gridCell
+	// Cells in the order of the ranges
+	order []string
+}
+
+type gridCell struct {
+	rng     string
+	value   string
+	written bool
+}
+
+// Returns the grid of the cells of the ranges as copied from the source,
+// having the formulas and formatted values of the source
+func newSheetGrid(ranges []string, formulas, formatted, values [][][]interface{}) (*sheetGrid, error) {
+	g := &sheetGrid{cells: make(map[string]*gridCell)}
+	for i, r := range ranges {
+		c0, r0, err := timesheet.ParseA1Cell(strings.SplitN(r, ":", 2)[0])
+		if err != nil {
+			return nil, err
+		}
+		// The ranges written are the extent of the values to write
+		for row := range values[i] {
+			for col := range values[i][row] {
+				cell := timesheet.FormatA1Cell(c0+col, r0+row)
+				v := cellString(formatted[i], row, col)
+				if f := cellString(formulas[i], row, col); strings.HasPrefix(f, "=") {
+					v = f
+				}
+				if _, ok := g.cells[cell]; !ok {
+					g.order = append(g.order, cell)
+				}
+				g.cells[cell] = &gridCell{rng: r, value: v}
+			}
+		}
+	}
+	return g, nil
+}
+
+// Writes the values to the ranges of the grid. Nil values leave cells as
+// they are, as they do in the sheet.
+func (g *sheetGrid) apply(ranges []string, values [][][]interface{}) error {
+	for i, r := range ranges {
+		c0, r0, err := timesheet.ParseA1Cell(strings.SplitN(r, ":", 2)[0])
+		if err != nil {
+			return err
+		}
+		for row := range values[i] {
+			for col := range values[i][row] {
+				if values[i][row][col] == nil {
+					continue
+				}
+				cell := g.cells[timesheet.FormatA1Cell(c0+col, r0+row)]
+				cell.value, cell.written = cellString(values[i], row, col), true
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the cells not written which keep values of the source
+func (g *sheetGrid) keptCells() []cellDiff {
+	kept := make([]cellDiff, 0)
+	for _, name := range g.order {
+		if c := g.cells[name]; !c.written && c.value != "" {
+			kept = append(kept, cellDiff{Range: c.rng, Cell: name, Current: c.value, New: c.value})
+		}
+	}
+	return kept
+}
+
+// Logs the changes of a sheet not created yet like logCellDiffs, labeled
+// with the source, and the values of the source the new sheet would keep
+func logNewSheetDiffs(logger *log.Logger, sheetTitle, source string, diffs []cellDiff, cells int, grid *sheetGrid) {
+	logger.Printf("Sheet %s (new, would be created from %s): %d cells to change, %d unchanged\n", sheetTitle, source, len(diffs), cells-len(diffs))
+	for _, d := range diffs {
+		logger.Printf("  %s\n", d)
+	}
+	if kept := grid.keptCells(); len(kept) > 0 {
+		logger.Printf("Sheet %s would keep %d values of %s in the cells not written:\n", sheetTitle, len(kept), source)
+		for _, d := range kept {
+			logger.Printf("  %s: %q\n", d.Cell, d.Current)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tells the values read back taken as the ones written, one case for each
+// normalization of isWrittenValue
+func TestIsWrittenValue(t *testing.T) {
+	tests := []struct {
+		name        string
+		want        string
+		unformatted interface{}
+		formatted   string
+		written     bool
+	}{
+		{"blank written blank", "", nil, "", true},
+		{"blank rejected", "9:30", nil, "", false},
+		{"same text", "客先", "客先", "客先", true},
+		{"other text", "客先", "在宅", "在宅", false},
+		{"spaces around", " 客先 ", "客先", "客先", true},
+		{"zero-padded time", "9:30", "09:30", "09:30", true},
+		{"other time", "9:30", "09:45", "09:45", false},
+		{"date notation", "2024/05/01", "2024-5-1", "2024-5-1", true},
+		{"number read rounded", "0.3958333333333333", 0.39583333333333331, "0.3958333333", true},
+		{"serial of time", "9:30", 0.3958333333333333, "09:30:00", true},
+		{"serial of other time", "9:30", 0.40625, "09:45:00", false},
+		{"serial of date", "2024/05/01", float64(45413), "5/1/2024", true},
+		{"serial of other date", "2024/05/01", float64(45414), "5/2/2024", false},
+		{"decimal comma", "35,5", 35.5, "35,50", true},
+		{"other decimal comma", "35,5", 35.25, "35,25", false},
+		{"text not number", "35,5", "35,5x", "35,5x", false},
+	}
+	for _, tt := range tests {
+		if got := isWrittenValue(tt.want, tt.unformatted, tt.formatted); got != tt.written {
+			t.Errorf("%s: %q read back as %v %q: got %v, want %v", tt.name, tt.want, tt.unformatted, tt.formatted, got, tt.written)
+		}
+	}
+}
+
+func TestFindUnwrittenCells(t *testing.T) {
+	ranges := []string{"C7:D8"}
+	values := [][][]interface{}{{{"9:00", "18:00"}, {nil, "12:00"}}}
+	formulas := [][][]interface{}{{{0.375, 0.75}, {"=A1", nil}}}
+	formatted := [][][]interface{}{{{"09:00:00", "18:00:00"}, {"", ""}}}
+	got, err := findUnwrittenCells(ranges, formulas, formatted, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cells not written are left out
+	want := []cellDiff{{Range: "C7:D8", Cell: "D8", Current: "", New: "12:00"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
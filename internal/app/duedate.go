@@ -0,0 +1,85 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invoiceDates are the issue and due dates of an invoice with the format
+// they are written in
+type invoiceDates struct {
+	issue  time.Time
+	due    time.Time
+	format string
+}
+
+// Returns the dates of the invoice of the month in the timezone of
+// targetTime. The due date is zero without due_date_rule.
+func getInvoiceDates(c *Config, sc *SpreadsheetConfig, targetTime, now time.Time) (*invoiceDates, error) {
+	issueDate, dueDateRule, dateFormat := c.GetInvoiceDateSettings(sc)
+	issue, err := computeIssueDate(issueDate, targetTime, now)
+	if err != nil {
+		return nil, err
+	}
+	dates := &invoiceDates{issue: issue, format: dateFormat}
+	if dueDateRule != "" {
+		if dates.due, err = computeDueDate(dueDateRule, targetTime, issue); err != nil {
+			return nil, err
+		}
+	}
+	return dates, nil
+}
+
+// Returns the issue date, which is "run_date" (default), or "first_day" or
+// "last_day" of the billed month
+func computeIssueDate(rule string, targetTime, now time.Time) (time.Time, error) {
+	loc := targetTime.Location()
+	switch rule {
+	case "", "run_date":
+		now = now.In(loc)
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc), nil
+	case "first_day":
+		return time.Date(targetTime.Year(), targetTime.Month(), 1, 0, 0, 0, 0, loc), nil
+	case "last_day":
+		return time.Date(targetTime.Year(), targetTime.Month()+1, 0, 0, 0, 0, 0, loc), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown issue_date %q (want run_date, first_day or last_day)", rule)
+}
+
+// Returns the due date by the rule, which is end_of_next_month,
+// specific_day_of_next_month:N (the last day for N beyond it) counted from
+// the billed month, or days_after_issue:N
+func computeDueDate(rule string, targetTime, issue time.Time) (time.Time, error) {
+	loc := targetTime.Location()
+	y, m := targetTime.Year(), targetTime.Month()
+	kind, arg := rule, ""
+	if i := strings.Index(rule, ":"); i >= 0 {
+		kind, arg = rule[:i], rule[i+1:]
+	}
+	n := 0
+	if kind == "specific_day_of_next_month" || kind == "days_after_issue" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid due_date_rule %q (want %s:N)", rule, kind)
+		}
+	} else if arg != "" {
+		return time.Time{}, fmt.Errorf("invalid due_date_rule %q", rule)
+	}
+	switch kind {
+	case "end_of_next_month":
+		return time.Date(y, m+2, 0, 0, 0, 0, 0, loc), nil
+	case "specific_day_of_next_month":
+		if n == 0 {
+			return time.Time{}, fmt.Errorf("invalid due_date_rule %q (days start from 1)", rule)
+		}
+		if last := time.Date(y, m+2, 0, 0, 0, 0, 0, loc).Day(); n > last {
+			n = last
+		}
+		return time.Date(y, m+1, n, 0, 0, 0, 0, loc), nil
+	case "days_after_issue":
+		return issue.AddDate(0, 0, n), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown due_date_rule %q (want end_of_next_month, specific_day_of_next_month:N or days_after_issue:N)", rule)
+}
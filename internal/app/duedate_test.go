@@ -0,0 +1,89 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeDueDate(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+	tests := []struct {
+		name    string
+		rule    string
+		month   time.Time
+		issue   time.Time
+		want    time.Time
+		wantErr bool
+	}{
+		{"end of next month", "end_of_next_month", date(2022, 1, 1), date(2022, 1, 31), date(2022, 2, 28), false},
+		{"end of next month in a leap year", "end_of_next_month", date(2024, 1, 1), date(2024, 1, 31), date(2024, 2, 29), false},
+		{"end of next month over the year", "end_of_next_month", date(2022, 12, 1), date(2022, 12, 31), date(2023, 1, 31), false},
+		{"day of next month", "specific_day_of_next_month:25", date(2022, 5, 1), date(2022, 5, 31), date(2022, 6, 25), false},
+		{"day beyond next month", "specific_day_of_next_month:31", date(2022, 1, 1), date(2022, 1, 31), date(2022, 2, 28), false},
+		{"day beyond next month in a leap year", "specific_day_of_next_month:30", date(2024, 1, 1), date(2024, 1, 31), date(2024, 2, 29), false},
+		{"day of next month over the year", "specific_day_of_next_month:10", date(2022, 12, 1), date(2022, 12, 31), date(2023, 1, 10), false},
+		{"days after issue", "days_after_issue:30", date(2022, 1, 1), date(2022, 1, 31), date(2022, 3, 2), false},
+		{"days after issue on the day", "days_after_issue:0", date(2022, 1, 1), date(2022, 2, 3), date(2022, 2, 3), false},
+		{"day 0", "specific_day_of_next_month:0", date(2022, 1, 1), date(2022, 1, 31), time.Time{}, true},
+		{"negative days", "days_after_issue:-1", date(2022, 1, 1), date(2022, 1, 31), time.Time{}, true},
+		{"missing days", "days_after_issue", date(2022, 1, 1), date(2022, 1, 31), time.Time{}, true},
+		{"argument of end of next month", "end_of_next_month:1", date(2022, 1, 1), date(2022, 1, 31), time.Time{}, true},
+		{"unknown rule", "next_friday", date(2022, 1, 1), date(2022, 1, 31), time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := computeDueDate(tt.rule, tt.month, tt.issue)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("computeDueDate: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+func TestGetInvoiceDates(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	month := time.Date(2022, 1, 1, 0, 0, 0, 0, loc)
+	// Late on the 3rd in UTC is the 4th in Tokyo
+	now := time.Date(2022, 2, 3, 20, 0, 0, 0, time.UTC)
+	config := &Config{IssueDate: "last_day", DueDateRule: "end_of_next_month"}
+	sc := &SpreadsheetConfig{IssueDate: "run_date", DueDateRule: "days_after_issue:10"}
+
+	dates, err := getInvoiceDates(config, &SpreadsheetConfig{}, month, now)
+	if err != nil {
+		t.Fatalf("getInvoiceDates: %v", err)
+	}
+	if got := dates.issue.Format("2006-01-02") + " " + dates.due.Format("2006-01-02"); got != "2022-01-31 2022-02-28" {
+		t.Errorf("got %s with the global settings", got)
+	}
+	if dates.format != "2006/01/02" {
+		t.Errorf("got format %q", dates.format)
+	}
+
+	dates, err = getInvoiceDates(config, sc, month, now)
+	if err != nil {
+		t.Fatalf("getInvoiceDates: %v", err)
+	}
+	if got := dates.issue.Format("2006-01-02") + " " + dates.due.Format("2006-01-02"); got != "2022-02-04 2022-02-14" {
+		t.Errorf("got %s with the settings of the spreadsheet", got)
+	}
+
+	dates, err = getInvoiceDates((&Config{}), &SpreadsheetConfig{}, month, now)
+	if err != nil {
+		t.Fatalf("getInvoiceDates: %v", err)
+	}
+	if !dates.due.IsZero() {
+		t.Errorf("got due date %s without due_date_rule", dates.due)
+	}
+}
@@ -0,0 +1,508 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+const testE2EConfig = `{
+	"calendar_id": "work",
+	"work_day_title": "勤務",
+	"time_source": "event",
+	"holidays": {"source": "none"},
+	"on_existing_output": "overwrite",
+	"work_spreadsheets": [{"id": "timesheet"}]
+}`
+
+// Prepares a run of May 2024 against the fake server in a temporary
+// directory, returning the config of testE2EConfig
+func setUpTestRun(t *testing.T) (*Config, time.Time) {
+	t.Helper()
+	setTestStateFile(t)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfigFile(writeTestConfig(t, testE2EConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	useFastRetry(t)
+	fetchedEventsMu.Lock()
+	savedEvents := fetchedEvents
+	fetchedEvents = make(map[string][]*calendar.Event)
+	fetchedEventsMu.Unlock()
+	t.Cleanup(func() {
+		fetchedEventsMu.Lock()
+		fetchedEvents = savedEvents
+		fetchedEventsMu.Unlock()
+	})
+
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config, time.Date(2024, 5, 1, 0, 0, 0, 0, jst)
+}
+
+// Runs the month of the config against the fake server
+func runTestMonth(t *testing.T, f *fakeAPI, config *Config, targetTime time.Time) error {
+	t.Helper()
+	ctx := context.Background()
+	client := f.client(ctx)
+	workDays, leaveDays, err := resolveRunWorkDays(ctx, client, config, targetTime, false)
+	if err != nil {
+		return err
+	}
+	backup := &Backup{RunID: newRunID(), TargetMonth: targetTime.Format("200601"), CreatedAt: time.Now()}
+	_, err = updateAndDownloadWorkSpreadsheets(ctx, client, targetTime, workDays, leaveDays, make(map[string]string), config, backup)
+	return err
+}
+
+// Tells the work start times written to the month sheet and that its pdf
+// is exported from a copy, which is deleted
+func checkTestMonthWritten(t *testing.T, f *fakeAPI) {
+	t.Helper()
+	for cell, want := range map[string]interface{}{"D7": nil, "D13": "09:00", "D14": "09:00", "D15": "10:00", "D16": "09:00", "D17": nil} {
+		if got := f.value("timesheet", "202405", cell); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", cell, got, want)
+		}
+	}
+	if got := f.requested("GET /drive/v3/files/timesheet-copy-"); len(got) != 1 {
+		t.Errorf("exports: got %v", got)
+	}
+	if got := f.requested("DELETE /drive/v3/files/timesheet-copy-"); len(got) != 1 {
+		t.Errorf("deletions of the copies exported: got %v", got)
+	}
+	matches, err := filepath.Glob("*.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("pdfs: got %v", matches)
+	}
+}
+
+func TestRunMonthSheetExists(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	checkTestMonthWritten(t, f)
+	if got := f.sheetTitles("timesheet"); !reflect.DeepEqual(got, []string{"202405"}) {
+		t.Errorf("sheets: got %v", got)
+	}
+}
+
+func TestRunMonthSheetCopied(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.addEvents("work", "events.json")
+	f.refuseDuplicate = true
+	config, targetTime := setUpTestRun(t)
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	// The copy is renamed and moved to the first after duplicating fails
+	if got := f.requested("POST /v4/spreadsheets/timesheet/sheets/1001:copyTo"); len(got) != 1 {
+		t.Errorf("copies: got %v", got)
+	}
+	if got, want := f.sheetTitles("timesheet"), []string{"202405", "202404"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sheets: got %v, want %v", got, want)
+	}
+	checkTestMonthWritten(t, f)
+	// The sheet copied from is left as it was
+	if got := f.value("timesheet", "202404", "M3"); got != nil {
+		t.Errorf("M3 of 202404: got %v", got)
+	}
+}
+
+func TestRunMonthSheetIDZero(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, map[string]int64{"202405": 0})
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	// The sheet of ID 0 is found rather than made again
+	if got := f.sheetTitles("timesheet"); !reflect.DeepEqual(got, []string{"202405"}) {
+		t.Errorf("sheets: got %v", got)
+	}
+	checkTestMonthWritten(t, f)
+}
+
+func TestRunRetriesTooManyRequests(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	f.throttle("POST /v4/spreadsheets/timesheet/values:batchUpdate", 2)
+	f.throttle("GET /calendar/v3/calendars/work/events", 1)
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.requested("POST /v4/spreadsheets/timesheet/values:batchUpdate (429)"); len(got) != 2 {
+		t.Errorf("throttled updates: got %v", got)
+	}
+	if got := f.requested("GET /calendar/v3/calendars/work/events (429)"); len(got) != 1 {
+		t.Errorf("throttled event lists: got %v", got)
+	}
+	checkTestMonthWritten(t, f)
+}
+
+func TestRunNoWorkDays(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.events["work"] = nil
+	config, targetTime := setUpTestRun(t)
+	err := runTestMonth(t, f, config, targetTime)
+	var runErr *runError
+	if !errors.As(err, &runErr) || runErr.code != exitNoWorkDays {
+		t.Fatalf("got %v, want an error of no work days", err)
+	}
+	if got := f.requested("POST "); len(got) != 0 {
+		t.Errorf("spreadsheet written: %v", got)
+	}
+	if got := f.sheetTitles("timesheet"); !reflect.DeepEqual(got, []string{"202404"}) {
+		t.Errorf("sheets: got %v", got)
+	}
+}
+
+// Sets the tab color and the order of the sheets, which are updated at the
+// end of the run
+func setTestDeferredUpdates(config *Config) {
+	config.TabColor = "#ff0000"
+	config.SheetOrder = "oldest_first"
+}
+
+func TestRunDeferredUpdates(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	setTestDeferredUpdates(config)
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	checkTestMonthWritten(t, f)
+	// The sheet made first is moved after the month before
+	if got, want := f.sheetTitles("timesheet"), []string{"202404", "202405"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sheets: got %v, want %v", got, want)
+	}
+	for _, s := range f.sortedSheets("timesheet") {
+		if colored := s.Properties.TabColorStyle != nil; colored != (s.Properties.Title == "202405") {
+			t.Errorf("sheet %s: got tab color %v", s.Properties.Title, s.Properties.TabColorStyle)
+		}
+	}
+}
+
+func TestRunCanceledSkipsDeferredUpdates(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	setTestDeferredUpdates(config)
+	logs := captureLog(t)
+
+	// The run is canceled by the first request after the values are written
+	ctx, cancel := context.WithCancel(context.Background())
+	savedCtx := runCtx
+	runCtx = ctx
+	t.Cleanup(func() {
+		cancel()
+		runCtx = savedCtx
+	})
+	written := -1
+	f.onRequest = func(request string) {
+		if written >= 0 {
+			cancel()
+		} else if request == "POST /v4/spreadsheets/timesheet/values:batchUpdate" {
+			written = len(f.requests)
+		}
+	}
+
+	err := runTestMonth(t, f, config, targetTime)
+	var runErr *runError
+	if !errors.As(err, &runErr) || runErr.code != exitCanceled {
+		t.Fatalf("got %v, want an error of the run canceled", err)
+	}
+	if written < 0 {
+		t.Fatalf("values not written")
+	}
+	// Neither the tab color nor the order of the sheets is sent
+	if got := f.requested("POST /v4/spreadsheets/timesheet:batchUpdate"); len(got) != 1 {
+		t.Errorf("spreadsheet updates: got %v, want the duplication of the sheet only", got)
+	}
+	if got, want := f.sheetTitles("timesheet"), []string{"202405", "202404"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sheets: got %v, want %v", got, want)
+	}
+	for _, want := range []string{"Skipped sheet updates:", "tab color of sheet 202405 of ", "order of the sheets of "} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log has no %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestRunSendsEmailOnce(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	config.WorkSpreadsheets[0].Email = &EmailConfig{To: []string{"client@example.com"}, Subject: "Invoice of {{.YearMonth}}"}
+	savedSend := sendEmailFlag
+	sendEmailFlag = true
+	t.Cleanup(func() { sendEmailFlag = savedSend })
+
+	sends := func() (int, int) {
+		n := len(f.requested("POST /gmail/v1/users/me/messages/send"))
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return n, f.sent
+	}
+	// The email failing is sent by the run after it, which sends it once
+	f.failSends = 1
+	if err := runTestMonth(t, f, config, targetTime); err == nil {
+		t.Fatalf("got no error of the email failing")
+	}
+	if got, sent := sends(); got != 1 || sent != 0 {
+		t.Fatalf("got %d sends with %d sent, want 1 failed", got, sent)
+	}
+	for run := 2; run <= 3; run++ {
+		if err := runTestMonth(t, f, config, targetTime); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if got, sent := sends(); got != 2 || sent != 1 {
+			t.Fatalf("run %d: got %d sends with %d sent, want the one after the failed one only", run, got, sent)
+		}
+	}
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := state.SentEmails["timesheet/202405"]; sent == nil || sent.ID != "message-1" || len(sent.Files) != 1 {
+		t.Errorf("got email recorded %+v", sent)
+	}
+}
+
+// Tells the values written read back as the dates, times and numbers meant
+// by both value_write_modes, with the strings entered parsed in the locale
+// of the spreadsheet, and that raw_serial formats the cells written as
+// serial numbers
+func TestRunValueWriteModes(t *testing.T) {
+	for _, mode := range []string{valueWriteUserEntered, valueWriteRawSerial} {
+		for _, locale := range []string{"ja_JP", "en_US", "en_GB", "de_DE"} {
+			t.Run(mode+"/"+locale, func(t *testing.T) {
+				f := newFakeAPI(t)
+				f.parseEntered = true
+				f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+				f.spreadsheets["timesheet"].Properties.Locale = locale
+				f.addEvents("work", "events.json")
+				config, targetTime := setUpTestRun(t)
+				config.ValueWriteMode = mode
+				// Breaks of the four days make a decimal of the total hours
+				config.Summary = &SummaryConfig{TotalHoursCell: "H3", BreakDuration: "7m30s"}
+				if err := runTestMonth(t, f, config, targetTime); err != nil {
+					t.Fatal(err)
+				}
+
+				for cell, want := range map[string]interface{}{
+					"M3":  serialDate(targetTime),
+					"D13": 9.0 / 24,
+					"D15": 10.0 / 24,
+					"H3":  35.5,
+				} {
+					if got := f.value("timesheet", "202405", cell); !reflect.DeepEqual(got, want) {
+						t.Errorf("%s: got %#v, want %#v", cell, got, want)
+					}
+				}
+				formats := f.formats["timesheet"][1001]
+				if mode == valueWriteUserEntered {
+					if len(formats) != 0 {
+						t.Errorf("formats: got %v", formats)
+					}
+					return
+				}
+				for cell, want := range map[string]string{"M3": "DATE", "D7": "TIME", "D13": "TIME", "D37": "TIME"} {
+					if got := formats[cell]; got != want {
+						t.Errorf("format of %s: got %q, want %q", cell, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Tells that amount_cell is written with the subtotal of the invoice
+// document, which a dry run logs as the value of {{subtotal}}, with a rate
+// in cents and hours rounded up to quarters
+func TestRunAmountCellMatchesDocument(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	config.Currency = "USD"
+	config.Billing = &BillingConfig{RateUnit: "per_hour", HoursRounding: "up", HoursRoundingUnit: "15m"}
+	if err := json.Unmarshal([]byte(`4321`), &config.Billing.Rate); err != nil {
+		t.Fatal(err)
+	}
+	config.Summary = &SummaryConfig{BreakDuration: "7m"}
+	config.WorkSpreadsheets[0].AmountCell = "H5"
+	config.InvoiceRenderer = "local"
+	config.InvoiceFontPath = filepath.Join(t.TempDir(), "font.ttf")
+	if err := ioutil.WriteFile(config.InvoiceFontPath, newTestTrueType("TestSans"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	config.InvoiceDocument = writeTestLocalTemplate(t, "<p>{{.subtotal}} {{.total}}</p>")
+
+	saved := dryRun
+	dryRun = true
+	t.Cleanup(func() { dryRun = saved })
+	logs := captureLog(t)
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`\{\{subtotal\}\} -> "([^"]*)"`).FindStringSubmatch(logs.String())
+	if m == nil {
+		t.Fatalf("no subtotal of the document in the log:\n%s", logs)
+	}
+	document := m[1]
+
+	dryRun = false
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	cell, ok := f.value("timesheet", "202405", "H5").(float64)
+	if !ok {
+		t.Fatalf("amount_cell: got %#v, want a number", f.value("timesheet", "202405", "H5"))
+	}
+	// Written as a number, which the sheet formats like the document
+	if got := "$" + strconv.FormatFloat(cell, 'f', 2, 64); got != strings.Replace(document, ",", "", -1) {
+		t.Errorf("amount_cell: got %s, want the subtotal %s of the document", got, document)
+	}
+	if !strings.Contains(logs.String(), "Rendered invoice document ") {
+		t.Errorf("no document rendered in the log:\n%s", logs)
+	}
+}
+
+// Tells that the daily CSV read back as a work CSV source has the days of
+// the month, their hours and amounts making the totals of the sheet
+func TestRunDailyCSVRoundTrip(t *testing.T) {
+	f := newFakeAPI(t)
+	f.parseEntered = true
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	config.Billing = &BillingConfig{RateUnit: "per_hour", HoursRounding: "none", HoursRoundingUnit: "1m"}
+	if err := json.Unmarshal([]byte(`3000`), &config.Billing.Rate); err != nil {
+		t.Fatal(err)
+	}
+	config.BreakRules = []*BreakRule{{MinHours: 6, DeductionMinutes: 60}}
+	config.Summary = &SummaryConfig{TotalHoursCell: "H3"}
+	config.WorkSpreadsheets[0].AmountCell = "H5"
+	config.ExportDailyCSV = true
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths of work CSVs are of the directory of the config file
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &WorkSourceConfig{Type: "csv", WorkCSV: &WorkCSVConfig{
+		Path:       filepath.Join(wd, "202405.daily.csv"),
+		Columns:    WorkCSVColumns{Date: "date", Start: "start", End: "end"},
+		TimeFormat: "15:04",
+	}}
+	days, err := newWorkSourceResolver(source, config).resolveWorkDays(context.Background(), f.client(context.Background()), targetTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2024-05-07 csv", "2024-05-08 csv", "2024-05-09 csv", "2024-05-10 csv"}
+	if got := workDaySources(days); !reflect.DeepEqual(got, want) {
+		t.Errorf("days: got %v, want %v", got, want)
+	}
+	breaks, err := getBreakPolicy(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var worked time.Duration
+	for _, d := range days {
+		w, _ := breaks.workDuration(0, d.Worked)
+		worked += w
+	}
+	if got := f.value("timesheet", "202405", "H3"); got != worked.Hours() {
+		t.Errorf("total hours: got %v in the sheet, %v in the daily CSV", got, worked.Hours())
+	}
+
+	// The hours and amounts of the days add up to the totals
+	d, err := ioutil.ReadFile("202405.daily.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(d)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"date", "client", "start", "end", "break", "hours", "amount"}; !reflect.DeepEqual(rows[0], want) {
+		t.Fatalf("header: got %v, want %v", rows[0], want)
+	}
+	var hours, amount float64
+	for _, row := range rows[1:] {
+		h, err := strconv.ParseFloat(row[5], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := strconv.ParseFloat(row[6], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hours, amount = hours+h, amount+a
+	}
+	if hours != worked.Hours() {
+		t.Errorf("hours: got %v, want %v", hours, worked.Hours())
+	}
+	if got := f.value("timesheet", "202405", "H5"); got != amount {
+		t.Errorf("amount: got %v in the sheet, %v in the daily CSV", got, amount)
+	}
+}
+
+// Tells that the timesheet on a shared drive is exported from a copy on
+// the drive, which Drive finds only with supportsAllDrives
+func TestRunMonthSharedDrive(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	f.sharedDrives["timesheet"] = "shared-drive"
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	checkTestMonthWritten(t, f)
+	if got := f.sharedDrives["timesheet-copy-1"]; got != "shared-drive" {
+		t.Errorf("copy exported: got drive %q", got)
+	}
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+type emailTemplateData struct {
+	Year      int
+	Month     int
+	YearMonth string
+	Title     string
+	WorkDays  int
+	// Formatted in the currency, empty if the spreadsheet is not billed
+	Subtotal string
+	Total    string
+	// First and last days of the billing period like 2006-01-02
+	PeriodStart string
+	PeriodEnd   string
+	// Of the client of the spreadsheet, empty without a client
+	ClientName   string
+	Attention    string
+	PaymentTerms string
+}
+
+func formatEmailTemplate(name, text string, data *emailTemplateData) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse email %s: %v", name, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to format email %s: %v", name, err)
+	}
+	return b.String(), nil
+}
+
+// Builds a MIME message of the email with the files attached
+func buildEmailMessage(ec *EmailConfig, subject, body string, attachments []string) ([]byte, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(ec.To, ", "))
+	if len(ec.Cc) > 0 {
+		fmt.Fprintf(&b, "Cc: %s\r\n", strings.Join(ec.Cc, ", "))
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(part, []byte(body))
+
+	for _, path := range attachments {
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment: %v", err)
+		}
+		name := mime.BEncoding.Encode("UTF-8", filepath.Base(path))
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {fmt.Sprintf("%s; name=\"%s\"", contentType, name)},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=\"%s\"", name)},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64Lines(part, d)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Writes base64 in lines of 76 characters as MIME requires
+func writeBase64Lines(w interface{ Write([]byte) (int, error) }, d []byte) {
+	s := base64.StdEncoding.EncodeToString(d)
+	for len(s) > 76 {
+		w.Write([]byte(s[:76] + "\r\n"))
+		s = s[76:]
+	}
+	w.Write([]byte(s + "\r\n"))
+}
+
+// Returns the outputs attached to the email, pdf by default
+func getEmailAttachments(ec *EmailConfig) []string {
+	if len(ec.Attachments) == 0 {
+		return []string{"pdf"}
+	}
+	return ec.Attachments
+}
+
+// Sends the email, or creates a draft of it if draft. Returns the ID of the
+// message or the draft.
+func sendEmail(gml *gmail.Service, ec *EmailConfig, data *emailTemplateData, attachments []string, draft bool) (string, error) {
+	if len(ec.To) == 0 {
+		return "", fmt.Errorf("email has no recipients")
+	}
+	subject, err := formatEmailTemplate("subject", ec.Subject, data)
+	if err != nil {
+		return "", err
+	}
+	body, err := formatEmailTemplate("body", ec.Body, data)
+	if err != nil {
+		return "", err
+	}
+	msg, err := buildEmailMessage(ec, subject, body, attachments)
+	if err != nil {
+		return "", fmt.Errorf("failed to build email: %v", err)
+	}
+	raw := base64.URLEncoding.EncodeToString(msg)
+
+	// Sending is not retried so that the client never gets the email twice
+	if draft {
+		var draft *gmail.Draft
+		if err := callAPI("create draft", func(ctx context.Context) (err error) {
+			draft, err = gml.Users.Drafts.Create("me", &gmail.Draft{
+				Message: &gmail.Message{Raw: raw},
+			}).Context(ctx).Do()
+			return
+		}); err != nil {
+			return "", fmt.Errorf("failed to create draft: %v", err)
+		}
+		return draft.Id, nil
+	}
+	ctx, cancel := context.WithTimeout(runCtx, apiTimeout)
+	defer cancel()
+	sent, err := gml.Users.Messages.Send("me", &gmail.Message{Raw: raw}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %v", err)
+	}
+	return sent.Id, nil
+}
+
+func newEmailTemplateData(targetTime time.Time, period billingPeriod, title string, workDays int, amount *billingAmount, client *ClientConfig) *emailTemplateData {
+	data := &emailTemplateData{
+		Year:        targetTime.Year(),
+		Month:       int(targetTime.Month()),
+		YearMonth:   targetTime.Format("2006-01"),
+		PeriodStart: period.start.Format("2006-01-02"),
+		PeriodEnd:   period.end.AddDate(0, 0, -1).Format("2006-01-02"),
+		Title:       title,
+		WorkDays:    workDays,
+	}
+	if amount != nil {
+		data.Subtotal = amount.Currency.format(amount.Subtotal)
+		data.Total = amount.Currency.format(amount.Total)
+	}
+	if client != nil {
+		data.ClientName, data.Attention, data.PaymentTerms = client.Name, client.Attention(), client.PaymentTerms
+	}
+	return data
+}
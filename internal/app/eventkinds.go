@@ -0,0 +1,104 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+func validateEventKinds(kinds []*EventKind) error {
+	names := make(map[string]bool)
+	colors := make(map[string]string)
+	hasDefault := false
+	for _, k := range kinds {
+		if k.Name == "" {
+			return fmt.Errorf("name is required")
+		}
+		if names[k.Name] {
+			return fmt.Errorf("kind %s is given twice", k.Name)
+		}
+		names[k.Name] = true
+		for _, id := range k.ColorIDs {
+			if other, ok := colors[id]; ok {
+				return fmt.Errorf("color %s is of both %s and %s", id, other, k.Name)
+			}
+			colors[id] = k.Name
+		}
+		if k.Rate != nil && *k.Rate < 0 {
+			return fmt.Errorf("rate of %s must not be negative", k.Name)
+		}
+		if k.Default && hasDefault {
+			return fmt.Errorf("only one kind can be the default")
+		}
+		hasDefault = hasDefault || k.Default
+	}
+	return nil
+}
+
+// Sets the kind of each day by the color of its first event. Days without
+// events, like the ones of the work CSV, are of the default kind.
+func resolveEventKinds(c *Config, days []WorkDay) {
+	if len(c.EventKinds) == 0 {
+		return
+	}
+	for i := range days {
+		d := &days[i]
+		colorID := ""
+		if len(d.Events) > 0 {
+			colorID = d.Events[0].ColorId
+		}
+		kind, ok := c.GetEventKind(colorID)
+		if !ok && len(d.Events) > 0 {
+			as := "no kind"
+			if kind != nil {
+				as = kind.Name
+			}
+			logVerbose("Warning: event %q on %s has color %q of no event kind, taking it as %s\n", d.Events[0].Summary, d.Date.Format("2006-01-02"), colorID, as)
+		}
+		if kind != nil {
+			d.Kind = kind.Name
+		}
+	}
+}
+
+// Returns the kind of the name, or nil if there is none
+func findEventKind(kinds []*EventKind, name string) *EventKind {
+	for _, k := range kinds {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+func hasEventKindRates(kinds []*EventKind) bool {
+	for _, k := range kinds {
+		if k.Rate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts the work days of each kind, like "12 on-site, 6 remote, 1
+// training", in the order of the kinds. Days of no kind are counted last.
+func countEventKinds(rows []dayRow, kinds []*EventKind) string {
+	counts := make(map[string]int)
+	for _, r := range rows {
+		if isWorkRow(r) {
+			counts[r.Kind]++
+		}
+	}
+	parts := make([]string, 0, len(kinds)+1)
+	for _, k := range kinds {
+		if n := counts[k.Name]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, k.Name))
+		}
+	}
+	if n := counts[""]; n > 0 {
+		parts = append(parts, fmt.Sprintf("%d of no kind", n))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Exit codes of runs, for scripts running make-invoices
+const (
+	exitSuccess        = 0
+	exitFailure        = 1 // failures not of the kinds below
+	exitConfigError    = 2 // invalid config or arguments
+	exitPartialSuccess = 3 // some of the spreadsheets failed
+	exitNeedsAuth      = 4 // the user must authorize again
+	exitNoWorkDays     = 5 // fewer work days than min_work_days were found
+	exitCanceled       = 6 // canceled at the prompt or by an interrupt
+)
+
+const exitCodeUsage = `
+Exit codes:
+  0  success
+  1  failure
+  2  invalid config or arguments
+  3  some of the spreadsheets failed
+  4  authorization required (run interactively to authorize)
+  5  too few work days found
+  6  canceled
+`
+
+// Writes the details of failures as JSON to the file, or stderr with "-"
+var errorJSON string
+
+// runError is an error ending the run with its exit code. category names the
+// kind of failure in the error report.
+type runError struct {
+	code     int
+	category string
+	err      error
+	failures []spreadsheetFailure
+}
+
+func newRunError(code int, category string, format string, v ...interface{}) *runError {
+	return &runError{code: code, category: category, err: fmt.Errorf(format, v...)}
+}
+
+func (e *runError) Error() string {
+	return e.err.Error()
+}
+
+func (e *runError) Unwrap() error {
+	return e.err
+}
+
+// spreadsheetFailure is a failed spreadsheet in the error report
+type spreadsheetFailure struct {
+	SpreadsheetID string `json:"spreadsheet_id"`
+	Title         string `json:"title,omitempty"`
+	Step          string `json:"step,omitempty"`
+	Error         string `json:"error"`
+	APICode       int    `json:"api_code,omitempty"`
+}
+
+func newSpreadsheetFailure(sc *SpreadsheetConfig, err error) spreadsheetFailure {
+	f := spreadsheetFailure{SpreadsheetID: sc.ID, Error: err.Error(), APICode: getAPIErrorCode(err)}
+	var se *spreadsheetError
+	if errors.As(err, &se) {
+		f.Title, f.Step, f.Error = se.title, se.step, se.err.Error()
+	}
+	return f
+}
+
+// errorReport is written by --error-json
+type errorReport struct {
+	Category     string               `json:"category"`
+	ExitCode     int                  `json:"exit_code"`
+	Message      string               `json:"message"`
+	APICode      int                  `json:"api_code,omitempty"`
+	Spreadsheets []spreadsheetFailure `json:"spreadsheets,omitempty"`
+}
+
+// Returns the HTTP status code of the API error in err, or 0
+func getAPIErrorCode(err error) int {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		return retrieveErr.Response.StatusCode
+	}
+	return 0
+}
+
+// Returns the exit code and the category of the error ending the run
+func getExitCode(err error) (int, string) {
+	var re *runError
+	if errors.As(err, &re) {
+		return re.code, re.category
+	}
+	if errors.Is(err, context.Canceled) {
+		return exitCanceled, "canceled"
+	}
+	return exitFailure, "failure"
+}
+
+// Logs the error ending the run, writes the error report and returns the exit
+// code. In unattended runs the failure is also posted to the notify webhook
+// unless the spreadsheet results were already.
+func reportRunError(err error) int {
+	code, category := getExitCode(err)
+	logErrorf(log.Default(), "%v", err)
+
+	report := &errorReport{Category: category, ExitCode: code, Message: err.Error(), APICode: getAPIErrorCode(err)}
+	var re *runError
+	if errors.As(err, &re) {
+		report.Spreadsheets = re.failures
+	}
+	if unattended && len(report.Spreadsheets) == 0 && runNotify != nil && runNotify.WebhookURL != "" && !dryRun {
+		notifyRun(runNotify, fmt.Sprintf("❌ make-invoices %s: FAILED: %s\nTook %v", runMonth, err, time.Since(runStart).Round(time.Second)), true)
+	}
+	if errorJSON != "" {
+		if err := writeErrorReport(errorJSON, report); err != nil {
+			logErrorf(log.Default(), "Failed to write error report: %v\n", err)
+		}
+	}
+	return code
+}
+
+func writeErrorReport(path string, report *errorReport) error {
+	d, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	d = append(d, '\n')
+	if path == "-" {
+		_, err := os.Stderr.Write(d)
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+// Prints the usage of the flags with the exit codes
+func printUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(fs.Output(), "Usage: %s [flags] [month]\n\nMonth: %s\n\nFlags:\n", os.Args[0], monthArgForms)
+	fs.PrintDefaults()
+	fmt.Fprint(fs.Output(), exitCodeUsage)
+}
+
+// Returns the error of a config or arguments unusable for the command
+func NewConfigError(format string, a ...interface{}) error {
+	return newRunError(exitConfigError, "config", format, a...)
+}
+
+// Returns the error of flags failed to parse, which were told of with the
+// usage, or nil for -h
+func parseFlagsError(err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return newRunError(exitConfigError, "config", "%v", err)
+}
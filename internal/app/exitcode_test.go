@@ -0,0 +1,56 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestGetExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		code     int
+		category string
+	}{
+		{"failure", errors.New("Failed to load state"), exitFailure, "failure"},
+		{"config", newRunError(exitConfigError, "config", "Unknown --log-format: %q", "xml"), exitConfigError, "config"},
+		{"partial success", newRunError(exitPartialSuccess, "partial_failure", "1 of 2 spreadsheets failed"), exitPartialSuccess, "partial_failure"},
+		{"needs auth", newRunError(exitNeedsAuth, "auth", "No oauth token"), exitNeedsAuth, "auth"},
+		{"no work days", newRunError(exitNoWorkDays, "no_work_days", "Found 0 work days"), exitNoWorkDays, "no_work_days"},
+		{"canceled at the prompt", newRunError(exitCanceled, "canceled", "Canceled"), exitCanceled, "canceled"},
+		{"interrupted", context.Canceled, exitCanceled, "canceled"},
+		{"interrupted calendar", fmt.Errorf("Failed to retrieve calendar items from work: %w", context.Canceled), exitCanceled, "canceled"},
+		{"wrapped run error", fmt.Errorf("archive: %w", newRunError(exitNeedsAuth, "auth", "No oauth token")), exitNeedsAuth, "auth"},
+		{"deadline", context.DeadlineExceeded, exitFailure, "failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, category := getExitCode(tt.err)
+			if code != tt.code || category != tt.category {
+				t.Errorf("got %d %q, want %d %q", code, category, tt.code, tt.category)
+			}
+		})
+	}
+}
+
+func TestSubcommandUsageExitCode(t *testing.T) {
+	for name, args := range map[string][]string{
+		"rollback":      nil,
+		"verify":        nil,
+		"promote":       nil,
+		"state":         nil,
+		"clients":       {"show"},
+		"lint-template": nil,
+		"archive":       nil,
+		"backfill":      nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := subcommands[name](args)
+			if code, _ := getExitCode(err); code != exitConfigError {
+				t.Errorf("got %d (%v), want %d", code, err, exitConfigError)
+			}
+		})
+	}
+}
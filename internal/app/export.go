@@ -0,0 +1,324 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Returns the formats to export the spreadsheet in, pdf unless configured
+func getExportFormats(c *Config, sc *SpreadsheetConfig) ([]*export.Format, error) {
+	names := c.ExportFormats
+	if sc != nil && len(sc.ExportFormats) > 0 {
+		names = sc.ExportFormats
+	}
+	if len(names) == 0 {
+		names = []string{"pdf"}
+	}
+	formats := make([]*export.Format, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		f, ok := export.Formats[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown export format: %q (must be pdf, xlsx, csv, ods or values_csv)", name)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("duplicate export format: %q", name)
+		}
+		seen[f.Name] = true
+		formats = append(formats, f)
+	}
+	return formats, nil
+}
+
+var pdfSizes = []string{"letter", "tabloid", "legal", "statement", "executive", "folio", "A3", "A4", "A5", "B4", "B5"}
+
+var pdfHorizontalAlignments = []string{"LEFT", "CENTER", "RIGHT"}
+
+// Returns the pdf options of the spreadsheet, whose options override the
+// global ones one by one, or nil if there are none
+func getPDFOptions(c *Config, sc *SpreadsheetConfig) (*PDFOptions, error) {
+	var o PDFOptions
+	for _, src := range []*PDFOptions{c.ExportPDFOptions, sc.PdfOptions()} {
+		if src == nil {
+			continue
+		}
+		if src.Size != "" {
+			o.Size = src.Size
+		}
+		if src.HorizontalAlignment != "" {
+			o.HorizontalAlignment = src.HorizontalAlignment
+		}
+		for _, p := range []struct{ dst, src **bool }{
+			{&o.Portrait, &src.Portrait}, {&o.FitWidth, &src.FitWidth}, {&o.Gridlines, &src.Gridlines}, {&o.PrintTitle, &src.PrintTitle},
+		} {
+			if *p.src != nil {
+				*p.dst = *p.src
+			}
+		}
+		for _, p := range []struct{ dst, src **float64 }{
+			{&o.TopMargin, &src.TopMargin}, {&o.BottomMargin, &src.BottomMargin}, {&o.LeftMargin, &src.LeftMargin}, {&o.RightMargin, &src.RightMargin},
+		} {
+			if *p.src != nil {
+				*p.dst = *p.src
+			}
+		}
+	}
+	if sc != nil && sc.PrintRange != "" {
+		rows, cols, err := timesheet.A1RangeSize(sc.PrintRange)
+		if err != nil || !strings.Contains(sc.PrintRange, ":") || rows < 1 || cols < 1 {
+			return nil, fmt.Errorf("invalid print_range: %q (must be like A1:N40)", sc.PrintRange)
+		}
+		o.PrintRange = sc.PrintRange
+	}
+	if o == (PDFOptions{}) {
+		return nil, nil
+	}
+	// The Drive API exports pdfs without options
+	if c.ExportMethod != "url" {
+		return nil, fmt.Errorf("export_pdf_options and print_range need export_method \"url\"")
+	}
+
+	if o.Size != "" {
+		found := false
+		for _, size := range pdfSizes {
+			if strings.EqualFold(o.Size, size) {
+				o.Size, found = size, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown pdf size: %q (must be one of %s)", o.Size, strings.Join(pdfSizes, ", "))
+		}
+	}
+	if o.HorizontalAlignment != "" {
+		o.HorizontalAlignment = strings.ToUpper(o.HorizontalAlignment)
+		found := false
+		for _, a := range pdfHorizontalAlignments {
+			found = found || o.HorizontalAlignment == a
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown pdf horizontal_alignment: %q (must be one of %s)", o.HorizontalAlignment, strings.Join(pdfHorizontalAlignments, ", "))
+		}
+	}
+	for _, m := range []*float64{o.TopMargin, o.BottomMargin, o.LeftMargin, o.RightMargin} {
+		if m != nil && (*m < 0 || *m > 5) {
+			return nil, fmt.Errorf("pdf margin must be between 0 and 5 inches: %v", *m)
+		}
+	}
+	return &o, nil
+}
+
+// Returns the query parameters of the export URL for the options
+func getPDFQuery(o *PDFOptions) string {
+	q := make([]string, 0)
+	if o.Size != "" {
+		q = append(q, "size="+o.Size)
+	}
+	for _, p := range []struct {
+		name  string
+		value *bool
+	}{{"portrait", o.Portrait}, {"fitw", o.FitWidth}, {"gridlines", o.Gridlines}, {"printtitle", o.PrintTitle}} {
+		if p.value != nil {
+			q = append(q, fmt.Sprintf("%s=%t", p.name, *p.value))
+		}
+	}
+	for _, p := range []struct {
+		name  string
+		value *float64
+	}{{"top_margin", o.TopMargin}, {"bottom_margin", o.BottomMargin}, {"left_margin", o.LeftMargin}, {"right_margin", o.RightMargin}} {
+		if p.value != nil {
+			q = append(q, fmt.Sprintf("%s=%s", p.name, strconv.FormatFloat(*p.value, 'f', -1, 64)))
+		}
+	}
+	if o.HorizontalAlignment != "" {
+		q = append(q, "horizontal_alignment="+o.HorizontalAlignment)
+	}
+	// Without ir and ic, the rows and columns of the range are repeated
+	// on every page
+	if o.PrintRange != "" {
+		q = append(q, "range="+url.QueryEscape(o.PrintRange), "ir=false", "ic=false")
+	}
+	return strings.Join(q, "&")
+}
+
+// Checks that print_range starts in the sheet, so that the pdf is not blank
+func checkPrintRange(rng string, props *sheets.GridProperties) error {
+	col, row, err := timesheet.ParseA1Cell(strings.SplitN(rng, ":", 2)[0])
+	if err != nil {
+		return fmt.Errorf("invalid print_range: %v", err)
+	}
+	if props != nil && (int64(row) >= props.RowCount || int64(col) >= props.ColumnCount) {
+		return fmt.Errorf("print_range %s is out of the sheet of %d rows and %d columns", rng, props.RowCount, props.ColumnCount)
+	}
+	return nil
+}
+
+// Exports the sheet to fileName by the Drive API. pdf and csv have only the
+// sheet, and are exported from a copy of the spreadsheet having only the
+// sheet visible, since the Drive API exports every visible sheet, or only
+// the first in csv. xlsx and ods exports have the whole file. With
+// export_method "url", every format is exported by the export URL of the
+// spreadsheet instead, which is not a documented API but takes the pdf
+// options.
+func exportSheet(drv *drive.Service, sht *sheets.Service, client *http.Client, spreadsheet *sheets.Spreadsheet, sheetID int64, format *export.Format, fileName string, pdfOptions *PDFOptions, config *Config, logger *log.Logger) error {
+	start := time.Now()
+	if err := exportSpreadsheet(drv, sht, client, spreadsheet, sheetID, format, fileName, pdfOptions, config, logger); err != nil {
+		return fmt.Errorf("spreadsheet %q (%s): %v", spreadsheet.Properties.Title, spreadsheet.SpreadsheetId, err)
+	}
+	logAt(logger, levelInfo, []logAttr{{"format", format.Name}, {"file", fileName}, {"duration_ms", time.Since(start).Milliseconds()}},
+		"Exported %s\n", fileName)
+	return nil
+}
+
+func exportSpreadsheet(drv *drive.Service, sht *sheets.Service, client *http.Client, spreadsheet *sheets.Spreadsheet, sheetID int64, format *export.Format, fileName string, pdfOptions *PDFOptions, config *Config, logger *log.Logger) error {
+	spreadsheetID := spreadsheet.SpreadsheetId
+	if format.Name == "values_csv" {
+		return exportValuesCSV(sht, spreadsheetID, sheetID, fileName, config)
+	}
+	switch config.ExportMethod {
+	case "", "drive":
+	case "url":
+	default:
+		return fmt.Errorf("unknown export_method: %q (must be drive or url)", config.ExportMethod)
+	}
+
+	query := ""
+	if format.Name == "pdf" && pdfOptions != nil {
+		query = getPDFQuery(pdfOptions)
+	}
+	exporter := newExporter(drv, sht, client, format, config.ExportMethod)
+	if u, ok := exporter.(*export.URL); ok && verbose {
+		logger.Printf("Exporting %s from %s\n", format.Name, u.Location(spreadsheetID, sheetID, format, query))
+	}
+	err := download(func(ctx context.Context, header http.Header) (*http.Response, error) {
+		return exporter.Export(ctx, spreadsheetID, sheetID, format, query, header)
+	}, format, fileName, logger)
+	if _, ok := exporter.(*export.URL); !ok && err != nil {
+		err = describeDriveError(err, "spreadsheet "+spreadsheetID)
+	}
+	return err
+}
+
+// Returns the exporter of the format, the export URL for method "url", or
+// the Drive API from a copy having only the sheet for the formats of only
+// the sheet, or the Drive API. Tests replace it with a fake.
+var newExporter = func(drv *drive.Service, sht *sheets.Service, client *http.Client, format *export.Format, method string) export.Exporter {
+	switch {
+	case method == "url":
+		return &export.URL{Client: client, Base: exportURLBase}
+	case format.SheetOnly:
+		return &export.DriveSheet{Drive: drv, Sheets: sht, OnDeleteError: func(copyID string, err error) {
+			logWarnf(log.Default(), "Warning: failed to delete %s, the copy of the spreadsheet made for the export: %v\n", copyID, err)
+		}}
+	}
+	return &export.Drive{Service: drv}
+}
+
+// Base of export URLs of spreadsheets, which tests point at a fake server
+var exportURLBase = "https://docs.google.com/"
+
+// Time limit of each export request, set by export_timeout
+var exportTimeout = 60 * time.Second
+
+// Streams a download to fileName through a temporary file, so that fileName
+// is written only with content of the format
+func download(get func(ctx context.Context, header http.Header) (*http.Response, error), format *export.Format, fileName string, logger *log.Logger) error {
+	tmp := fileName + ".part"
+	defer os.Remove(tmp)
+	var contentType string
+	var written int64
+	resumable := false
+	// Requests are retried by the transport, with their own timeout instead
+	// of api_timeout, and downloads broken after the response here
+	ctx := withAttemptTimeout(context.WithValue(runCtx, callNameKey{}, "export spreadsheet"), exportTimeout)
+	once := func() (broken bool, err error) {
+		// Resume a broken download if the server supports range requests
+		header := make(http.Header)
+		if resumable && written > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+		}
+		resp, err := get(ctx, header)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		flag := os.O_WRONLY | os.O_CREATE
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && header.Get("Range") != "":
+			flag |= os.O_APPEND
+			if verbose {
+				logger.Printf("Resuming %s download from %d bytes\n", format.Name, written)
+			}
+		case resp.StatusCode == http.StatusOK:
+			flag |= os.O_TRUNC
+			written = 0
+			contentType = resp.Header.Get("Content-Type")
+		default:
+			return false, &httpStatusError{code: resp.StatusCode, status: resp.Status, header: resp.Header}
+		}
+		resumable = resp.Header.Get("Accept-Ranges") == "bytes"
+		f, err := os.OpenFile(tmp, flag, 0666)
+		if err != nil {
+			return false, err
+		}
+		n, err := io.Copy(f, resp.Body)
+		written += n
+		if verbose {
+			logger.Printf("Downloaded %d bytes of %s\n", written, format.Name)
+		}
+		if err != nil {
+			f.Close()
+			return true, err
+		}
+		return false, f.Close()
+	}
+	for attempt := 1; ; attempt++ {
+		broken, err := once()
+		if err == nil {
+			break
+		}
+		if runCtx.Err() != nil {
+			return fmt.Errorf("failed to export spreadsheet: export spreadsheet canceled: %w", err)
+		}
+		if retryable, _ := isRetryableError(err); !broken || !retryable || attempt >= retrySettings.maxAttempts {
+			return fmt.Errorf("failed to export spreadsheet: %w", err)
+		}
+		metrics.countRetry()
+		logVerbose("Retrying the broken download of %s (attempt %d failed: %v)\n", format.Name, attempt, err)
+	}
+
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	d := make([]byte, 512)
+	n, _ := io.ReadFull(f, d)
+	f.Close()
+	d = d[:n]
+	if err := format.Check(contentType, d, written); err != nil {
+		if verbose {
+			head := d
+			if len(head) > 200 {
+				head = head[:200]
+			}
+			logger.Printf("Exported content starts with: %q\n", head)
+		}
+		return err
+	}
+	if err := os.Rename(tmp, fileName); err != nil {
+		return fmt.Errorf("failed to save spreadsheet %s: %v", format.Name, err)
+	}
+	return nil
+}
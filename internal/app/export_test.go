@@ -0,0 +1,106 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsujio/make-invoices/internal/export"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// fakeExporter responds to every export with the content, keeping the
+// queries of the exports
+type fakeExporter struct {
+	contentType string
+	content     []byte
+	queries     []string
+}
+
+func (f *fakeExporter) Export(ctx context.Context, spreadsheetID string, sheetID int64, format *export.Format, query string, header http.Header) (*http.Response, error) {
+	f.queries = append(f.queries, query)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {f.contentType}},
+		Body:       ioutil.NopCloser(bytes.NewReader(f.content)),
+	}, nil
+}
+
+func useFakeExporter(t *testing.T, f *fakeExporter) {
+	t.Helper()
+	saved := newExporter
+	newExporter = func(drv *drive.Service, sht *sheets.Service, client *http.Client, format *export.Format, method string) export.Exporter {
+		return f
+	}
+	t.Cleanup(func() { newExporter = saved })
+}
+
+func TestExportSpreadsheet(t *testing.T) {
+	spreadsheet := &sheets.Spreadsheet{SpreadsheetId: "ss", Properties: &sheets.SpreadsheetProperties{Title: "timesheet"}}
+	pdf := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte{' '}, 2048)...)
+	tests := []struct {
+		name        string
+		contentType string
+		content     []byte
+		options     *PDFOptions
+		wantQuery   string
+		wantErr     bool
+	}{
+		{"pdf", "application/pdf", pdf, nil, "", false},
+		{"pdf with the options", "application/pdf", pdf, &PDFOptions{Size: "A4"}, "size=A4", false},
+		{"sign in page", "text/html", []byte("<html></html>"), nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeExporter{contentType: tt.contentType, content: tt.content}
+			useFakeExporter(t, f)
+			fileName := filepath.Join(t.TempDir(), "invoice.pdf")
+			logger := log.New(ioutil.Discard, "", 0)
+			err := exportSpreadsheet(nil, nil, nil, spreadsheet, 0, export.Formats["pdf"], fileName, tt.options, &Config{}, logger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exportSpreadsheet() = %v, want error %v", err, tt.wantErr)
+			}
+			if len(f.queries) != 1 || f.queries[0] != tt.wantQuery {
+				t.Errorf("got queries %q, want [%q]", f.queries, tt.wantQuery)
+			}
+			b, err := ioutil.ReadFile(fileName)
+			if tt.wantErr {
+				if !os.IsNotExist(err) {
+					t.Errorf("want no file of the failed export, got %v", err)
+				}
+				return
+			}
+			if !bytes.Equal(b, tt.content) {
+				t.Errorf("got %d bytes, want %d", len(b), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestGetPDFOptionsExportMethod(t *testing.T) {
+	portrait := true
+	for _, tt := range []struct {
+		name    string
+		config  *Config
+		sc      *SpreadsheetConfig
+		wantErr bool
+	}{
+		{"no options", &Config{}, &SpreadsheetConfig{}, false},
+		{"options by the export URL", &Config{ExportMethod: "url", ExportPDFOptions: &PDFOptions{Portrait: &portrait}}, &SpreadsheetConfig{}, false},
+		{"options by Drive", &Config{ExportPDFOptions: &PDFOptions{Portrait: &portrait}}, &SpreadsheetConfig{}, true},
+		{"print range by Drive", &Config{ExportMethod: "drive"}, &SpreadsheetConfig{PrintRange: "A1:N40"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := getPDFOptions(tt.config, tt.sc); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
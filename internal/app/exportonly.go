@@ -0,0 +1,171 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/sheets/v4"
+)
+
+// "make-invoices export <month>", or --export-only, exports the month sheets
+// as they are, for sheets whose formatting was tweaked by hand after the
+// values were written. The calendar is not read and nothing is written to
+// the sheets, which must exist. Invoice documents and week sheets are not
+// made again, the existing document pdfs being bundled and attached as they
+// are.
+var exportOnly bool
+
+// Exports the month sheet of the spreadsheet, then uploads, bundles and
+// delivers the outputs as runs do
+func exportWorkSpreadsheet(sht *sheets.Service, drv *drive.Service, gml *gmail.Service, client *http.Client, sc *SpreadsheetConfig, targetTime time.Time, config *Config, files *reservedFiles, logger *log.Logger, progress *spreadsheetError) error {
+	spreadsheetID := sc.ID
+	spreadsheet, err := getSpreadsheet(sht, spreadsheetID, spreadsheetRunFields)
+	if err != nil {
+		return fmt.Errorf("failed to get spreadsheet: %v", err)
+	}
+	title := spreadsheet.Properties.Title
+	logger.SetPrefix("[" + title + "] ")
+	progress.title = title
+
+	progress.setStep("check outputs")
+	formats, err := getExportFormats(config, sc)
+	if err != nil {
+		return err
+	}
+	pdfOptions, err := getPDFOptions(config, sc)
+	if err != nil {
+		return err
+	}
+	stem := targetTime.Format("200601") + title
+	fileNames, outputPaths, err := reserveFormatOutputs(stem, spreadsheetID, formats, files, config, logger)
+	if err != nil {
+		return err
+	}
+	documents, err := config.GetDocuments(sc)
+	if err != nil {
+		return err
+	}
+	for _, dc := range documents {
+		name := files.safeFileName(stem, "."+dc.Key+".pdf")
+		if _, err := os.Stat(name); err == nil {
+			outputPaths[dc.Key+"_pdf"] = name
+		}
+	}
+	// The invoice number is the one assigned by the run of the month, if
+	// any, and the work the one recorded by it
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("failed to load state: %v", err)
+	}
+	invoiceNumber := getAssignedInvoiceNumber(state, spreadsheetID, targetTime)
+	workDays := 0
+	if c := state.Completed[targetTime.Format("200601")][spreadsheetID]; c != nil && c.WorkDays != nil {
+		workDays = *c.WorkDays
+	}
+	clientBundle, err := reserveClientBundle(spreadsheetID, title, invoiceNumber, 0, targetTime, files, config, logger)
+	if err != nil {
+		return err
+	}
+	if clientBundle != "" {
+		outputPaths["zip"] = clientBundle
+	}
+	if err := checkEmailAttachments(sc, outputPaths, config); err != nil {
+		return err
+	}
+
+	progress.setStep("locate sheet")
+	// The sheet is never created, as it would have no values
+	monthSpreadsheet := spreadsheet
+	if sc.TemplateSheet != "" {
+		monthSpreadsheet = timesheet.WithoutSheet(spreadsheet, sc.TemplateSheet)
+	}
+	months, err := timesheet.MonthSheets(monthSpreadsheet, targetTime.Location())
+	if err != nil {
+		return err
+	}
+	sheet, ok := months[targetTime.Format("200601")]
+	if !ok {
+		return fmt.Errorf("no sheet of %s to export (export doesn't create sheets)", targetTime.Format("200601"))
+	}
+	sheetID := sheet.Properties.SheetId
+	if sc.Period == weeklyPeriod {
+		logger.Printf("Week sheets are not exported again, only sheet %s\n", sheet.Properties.Title)
+	}
+	if dryRun {
+		logger.Printf("Sheet %s would be exported\n", sheet.Properties.Title)
+		return nil
+	}
+
+	progress.setStep("export")
+	for i, f := range formats {
+		if fileNames[i] == "" {
+			continue
+		}
+		if err := exportSheet(drv, sht, client, spreadsheet, sheetID, f, fileNames[i], pdfOptions, config, logger); err != nil {
+			return err
+		}
+		files.mu.Lock()
+		files.written = append(files.written, &outputFile{path: fileNames[i], title: title, spreadsheetID: spreadsheetID, sheetID: &sheetID})
+		files.mu.Unlock()
+	}
+	record := &spreadsheetRecord{
+		title:         title,
+		workDays:      workDays,
+		invoiceNumber: invoiceNumber,
+	}
+	files.mu.Lock()
+	files.pdfs[spreadsheetID] = outputPaths["pdf"]
+	for _, dc := range documents {
+		if p, ok := outputPaths[dc.Key+"_pdf"]; ok && dc.IncludeInCombinedPDF {
+			files.invoicePDFs[spreadsheetID] = append(files.invoicePDFs[spreadsheetID], p)
+		}
+	}
+	files.records[spreadsheetID] = record
+	files.mu.Unlock()
+
+	progress.setStep("make bundle")
+	if err := makeClientBundle(spreadsheetID, title, targetTime, clientBundle, outputPaths, nil, config, files, logger); err != nil {
+		return err
+	}
+
+	// Only the pdf of the sheet is uploaded again, the documents being as
+	// uploaded by the run
+	uploads := make([]driveUpload, 0)
+	for i, f := range formats {
+		if f.Name == "pdf" && fileNames[i] != "" {
+			uploads = append(uploads, driveUpload{path: fileNames[i]})
+		}
+	}
+	delivery := &deliveryOutputs{
+		spreadsheetID: spreadsheetID,
+		title:         title,
+		invoiceNumber: invoiceNumber,
+		targetTime:    targetTime,
+		period:        getBillingPeriod(config.ForSpreadsheet(sc), targetTime),
+		workDays:      workDays,
+		client:        config.GetClient(sc),
+		uploads:       uploads,
+		clientBundle:  clientBundle,
+		outputPaths:   outputPaths,
+	}
+	if err := deliverOutputs(drv, gml, sc, delivery, fileNames, config, files, record, logger, progress); err != nil {
+		return err
+	}
+
+	progress.setStep("lock sheet")
+	if config.ProtectAfterExport {
+		if own, _ := getSheetProtections(sheet); len(own) == 0 {
+			if err := protectSheet(sht, spreadsheetID, sheetID, config.ProtectionWarningOnly); err != nil {
+				return err
+			}
+			logger.Printf("Locked sheet %s\n", sheet.Properties.Title)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,919 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// fakeAPI is a server answering the requests of runs to Calendar, Sheets,
+// Drive and the export URL from the fixtures in testdata/fakeapi, keeping the
+// values written to the sheets
+type fakeAPI struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu           sync.Mutex
+	spreadsheets map[string]*sheets.Spreadsheet
+	// Values of the cells of each spreadsheet by sheet title and cell, like
+	// "D7"
+	values map[string]map[string]map[string]interface{}
+	// Events of each calendar, given by pages of pageSize
+	events   map[string][]*calendar.Event
+	pageSize int
+	// Whether duplicateSheet requests fail, making sheets copied by copyTo
+	refuseDuplicate bool
+	// Responses of 429 given to the next requests of the prefix, like
+	// "POST /v4/spreadsheets/"
+	throttled map[string]int
+	// Requests answered, like "GET /calendar/v3/calendars/work/events"
+	requests []string
+	// Spreadsheets copied by Drive
+	copies int
+	// Called with each request before it is answered, if set
+	onRequest func(request string)
+	// Emails sent, and the sends failing next with 500
+	sent      int
+	failSends int
+	// Whether values entered as USER_ENTERED are kept as Sheets parses them
+	// in the locale of the spreadsheet, dates and times as serial numbers and
+	// decimals as numbers
+	parseEntered bool
+	// Number format types of the cells of each spreadsheet by sheet ID and
+	// cell, like "DATE", set by repeatCell requests
+	formats map[string]map[int64]map[string]string
+	// Shared drives having the files by ID. Like in Drive, requests without
+	// supportsAllDrives don't find the files on shared drives, and lists
+	// leave them out unless they include the drive.
+	sharedDrives map[string]string
+	// Folders of Drive in the order created, and the parameters of the
+	// lists of files
+	folders    []*drive.File
+	driveLists []url.Values
+	// Documents answered by Docs in turn, the last one to the gets after,
+	// and the requests of the batch updates of each
+	documents  map[string][]*docs.Document
+	docUpdates map[string][][]*docs.Request
+}
+
+// Starts the fake server, pointing the services of the package at it
+func newFakeAPI(t *testing.T) *fakeAPI {
+	t.Helper()
+	f := &fakeAPI{
+		t:            t,
+		spreadsheets: make(map[string]*sheets.Spreadsheet),
+		values:       make(map[string]map[string]map[string]interface{}),
+		events:       make(map[string][]*calendar.Event),
+		pageSize:     2,
+		throttled:    make(map[string]int),
+		formats:      make(map[string]map[int64]map[string]string),
+		sharedDrives: make(map[string]string),
+		documents:    make(map[string][]*docs.Document),
+		docUpdates:   make(map[string][][]*docs.Request),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	savedEndpoint, savedExport := apiEndpoint, exportURLBase
+	apiEndpoint, exportURLBase = f.server.URL+"/", f.server.URL+"/"
+	t.Cleanup(func() { apiEndpoint, exportURLBase = savedEndpoint, savedExport })
+	return f
+}
+
+// Returns a client of the server with a stub token, going through the
+// transport of runs
+func (f *fakeAPI) client(ctx context.Context) *http.Client {
+	base := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 0)}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, base)
+	return oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"}))
+}
+
+func readFakeAPIFixture(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	d, err := ioutil.ReadFile(filepath.Join("testdata", "fakeapi", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(d, v); err != nil {
+		t.Fatalf("failed to decode %s: %v", name, err)
+	}
+}
+
+// fakeSpreadsheetFixture is a spreadsheet with the values of its sheets
+type fakeSpreadsheetFixture struct {
+	Spreadsheet *sheets.Spreadsheet               `json:"spreadsheet"`
+	Values      map[string]map[string]interface{} `json:"values"`
+}
+
+// Adds the spreadsheet of the fixture with the ID, renaming its sheets
+// like {"202404": "202405"} and changing their IDs like {"202405": 0}
+func (f *fakeAPI) addSpreadsheet(id, fixture string, titles map[string]string, sheetIDs map[string]int64) {
+	var fx fakeSpreadsheetFixture
+	readFakeAPIFixture(f.t, fixture, &fx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := fx.Spreadsheet
+	s.SpreadsheetId = id
+	values := make(map[string]map[string]interface{})
+	for _, sh := range s.Sheets {
+		old := sh.Properties.Title
+		if title, ok := titles[old]; ok {
+			sh.Properties.Title = title
+		}
+		if sheetID, ok := sheetIDs[sh.Properties.Title]; ok {
+			sh.Properties.SheetId = sheetID
+		}
+		values[sh.Properties.Title] = fx.Values[old]
+		if values[sh.Properties.Title] == nil {
+			values[sh.Properties.Title] = make(map[string]interface{})
+		}
+	}
+	f.spreadsheets[id] = s
+	f.values[id] = values
+}
+
+// Adds the folder of Drive under the parent, on the shared drive of driveID
+// if it is not empty
+func (f *fakeAPI) addDriveFolder(id, parent, driveID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.folders = append(f.folders, &drive.File{Id: id, Name: id, Parents: []string{parent}, DriveId: driveID})
+	if driveID != "" {
+		f.sharedDrives[id] = driveID
+	}
+}
+
+// Adds the documents of the fixtures, answered in turn to the gets of the
+// document of the ID
+func (f *fakeAPI) addDocuments(id string, fixtures ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fixture := range fixtures {
+		var doc docs.Document
+		readFakeAPIFixture(f.t, fixture, &doc)
+		f.documents[id] = append(f.documents[id], &doc)
+	}
+}
+
+// Adds the events of the fixture to the calendar
+func (f *fakeAPI) addEvents(calendarID, fixture string) {
+	var events []*calendar.Event
+	readFakeAPIFixture(f.t, fixture, &events)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events[calendarID] = append(f.events[calendarID], events...)
+}
+
+// Answers the next n requests of the prefix with 429
+func (f *fakeAPI) throttle(prefix string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.throttled[prefix] = n
+}
+
+// Returns the requests answered which have the prefix
+func (f *fakeAPI) requested(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := make([]string, 0)
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// Returns the titles of the sheets of the spreadsheet in order
+func (f *fakeAPI) sheetTitles(id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	titles := make([]string, 0)
+	for _, sh := range f.sortedSheets(id) {
+		titles = append(titles, sh.Properties.Title)
+	}
+	return titles
+}
+
+// Returns the value of the cell like "D7" of the sheet
+func (f *fakeAPI) value(id, title, cell string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values[id][title][cell]
+}
+
+func (f *fakeAPI) sortedSheets(id string) []*sheets.Sheet {
+	s := f.spreadsheets[id]
+	sort.SliceStable(s.Sheets, func(i, j int) bool {
+		return s.Sheets[i].Properties.Index < s.Sheets[j].Properties.Index
+	})
+	return s.Sheets
+}
+
+func (f *fakeAPI) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Errorf("failed to encode response: %v", err)
+	}
+}
+
+func writeFakeAPIError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, code, message)
+}
+
+func (f *fakeAPI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	request := r.Method + " " + r.URL.Path
+	for prefix, n := range f.throttled {
+		if n > 0 && strings.HasPrefix(request, prefix) {
+			f.throttled[prefix]--
+			f.requests = append(f.requests, request+" (429)")
+			w.Header().Set("Retry-After", "0")
+			writeFakeAPIError(w, http.StatusTooManyRequests, "Quota exceeded")
+			return
+		}
+	}
+	f.requests = append(f.requests, request)
+	if f.onRequest != nil {
+		f.onRequest(request)
+	}
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		writeFakeAPIError(w, http.StatusUnauthorized, "no token")
+		return
+	}
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/calendar/v3/calendars/"):
+		f.serveEvents(w, r)
+	case strings.HasPrefix(path, "/spreadsheets/d/") && strings.HasSuffix(path, "/export"):
+		f.serveExport(w, r)
+	case strings.HasPrefix(path, "/v4/spreadsheets/"):
+		f.serveSheets(w, r)
+	case path == "/drive/v3/files" && r.Method == http.MethodGet:
+		f.serveDriveList(w, r)
+	case path == "/drive/v3/files" && r.Method == http.MethodPost:
+		f.serveDriveFolderCreate(w, r)
+	case strings.HasPrefix(path, "/drive/v3/files/"):
+		f.serveDriveFile(w, r)
+	case strings.HasPrefix(path, "/v1/documents/"):
+		f.serveDocuments(w, r)
+	case path == "/gmail/v1/users/me/messages/send" && r.Method == http.MethodPost:
+		if f.failSends > 0 {
+			f.failSends--
+			writeFakeAPIError(w, http.StatusInternalServerError, "Backend Error")
+			return
+		}
+		f.sent++
+		f.writeJSON(w, map[string]string{"id": fmt.Sprintf("message-%d", f.sent)})
+	default:
+		f.t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		writeFakeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Answers events.list by pages of pageSize events
+func (f *fakeAPI) serveEvents(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/calendar/v3/calendars/"), "/")
+	if len(parts) != 2 || parts[1] != "events" || r.Method != http.MethodGet {
+		f.t.Errorf("unexpected calendar request: %s %s", r.Method, r.URL)
+		writeFakeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	events, ok := f.events[parts[0]]
+	if !ok {
+		writeFakeAPIError(w, http.StatusNotFound, "no calendar "+parts[0])
+		return
+	}
+	q := r.URL.Query()
+	timeMin, _ := time.Parse(time.RFC3339, q.Get("timeMin"))
+	timeMax, _ := time.Parse(time.RFC3339, q.Get("timeMax"))
+	matched := make([]*calendar.Event, 0)
+	for _, e := range events {
+		start, end := fakeEventTime(e.Start), fakeEventTime(e.End)
+		if (q.Get("timeMin") == "" || end.After(timeMin)) && (q.Get("timeMax") == "" || start.Before(timeMax)) {
+			matched = append(matched, e)
+		}
+	}
+	offset := 0
+	if token := q.Get("pageToken"); token != "" {
+		offset, _ = strconv.Atoi(token)
+	}
+	resp := &calendar.Events{Kind: "calendar#events", TimeZone: "Asia/Tokyo"}
+	end := offset + f.pageSize
+	if end < len(matched) {
+		resp.NextPageToken = strconv.Itoa(end)
+	} else {
+		end = len(matched)
+	}
+	if offset < end {
+		resp.Items = matched[offset:end]
+	}
+	f.writeJSON(w, resp)
+}
+
+func fakeEventTime(t *calendar.EventDateTime) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	if t.DateTime != "" {
+		d, _ := time.Parse(time.RFC3339, t.DateTime)
+		return d
+	}
+	jst := time.FixedZone("JST", 9*60*60)
+	d, _ := time.ParseInLocation("2006-01-02", t.Date, jst)
+	return d
+}
+
+// Exports are pdfs of A4 pages, enough of them not to be taken as broken
+func (f *fakeAPI) serveExport(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/spreadsheets/d/"), "/export")
+	if _, ok := f.spreadsheets[id]; !ok {
+		writeFakeAPIError(w, http.StatusNotFound, "no spreadsheet "+id)
+		return
+	}
+	if r.URL.Query().Get("format") != "pdf" {
+		f.t.Errorf("unexpected export: %s", r.URL)
+		writeFakeAPIError(w, http.StatusBadRequest, "unexpected format")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	a4 := [2]int{595, 842}
+	w.Write(newTestPDF(a4, a4, a4))
+}
+
+// Answers the gets of documents with the documents added, and keeps the
+// requests of batch updates
+func (f *fakeAPI) serveDocuments(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/documents/")
+	update := strings.HasSuffix(id, ":batchUpdate") && r.Method == http.MethodPost
+	id = strings.TrimSuffix(id, ":batchUpdate")
+	documents := f.documents[id]
+	if len(documents) == 0 {
+		writeFakeAPIError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	switch {
+	case update:
+		var req docs.BatchUpdateDocumentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.docUpdates[id] = append(f.docUpdates[id], req.Requests)
+		f.writeJSON(w, &docs.BatchUpdateDocumentResponse{DocumentId: id})
+	case r.Method == http.MethodGet:
+		f.writeJSON(w, documents[0])
+		if len(documents) > 1 {
+			f.documents[id] = documents[1:]
+		}
+	default:
+		f.t.Errorf("unexpected docs request: %s %s", r.Method, r.URL)
+		writeFakeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Returns the folder of the ID, or nil if there is none
+func (f *fakeAPI) folder(id string) *drive.File {
+	for _, folder := range f.folders {
+		if folder.Id == id {
+			return folder
+		}
+	}
+	return nil
+}
+
+var fakeFolderQuery = regexp.MustCompile(`^'([^']*)' in parents and name = '([^']*)' and mimeType = 'application/vnd.google-apps.folder' and trashed = false$`)
+
+// Answers lists of the folders of a name under a parent, in the order
+// created. Other lists find nothing, so that no sandbox copies are left to
+// clean up.
+func (f *fakeAPI) serveDriveList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f.driveLists = append(f.driveLists, q)
+	list := &drive.FileList{Files: make([]*drive.File, 0)}
+	if m := fakeFolderQuery.FindStringSubmatch(q.Get("q")); m != nil {
+		driveID := f.sharedDrives[m[1]]
+		included := driveID == "" || q.Get("supportsAllDrives") == "true" && q.Get("includeItemsFromAllDrives") == "true" &&
+			(q.Get("corpora") == "allDrives" || q.Get("corpora") == "drive" && q.Get("driveId") == driveID)
+		for _, folder := range f.folders {
+			if included && folder.Parents[0] == m[1] && folder.Name == m[2] {
+				list.Files = append(list.Files, &drive.File{Id: folder.Id})
+			}
+		}
+	}
+	f.writeJSON(w, list)
+}
+
+// Creates the folder, on the shared drive of its parent if any
+func (f *fakeAPI) serveDriveFolderCreate(w http.ResponseWriter, r *http.Request) {
+	var folder drive.File
+	if err := json.NewDecoder(r.Body).Decode(&folder); err != nil {
+		writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if folder.MimeType != "application/vnd.google-apps.folder" || len(folder.Parents) != 1 {
+		f.t.Errorf("unexpected drive file created: %+v", folder)
+		writeFakeAPIError(w, http.StatusBadRequest, "not a folder")
+		return
+	}
+	parent := folder.Parents[0]
+	driveID := f.sharedDrives[parent]
+	if driveID != "" && r.URL.Query().Get("supportsAllDrives") != "true" {
+		writeFakeAPIError(w, http.StatusNotFound, "File not found: "+parent)
+		return
+	}
+	folder.Id = fmt.Sprintf("folder-%d", len(f.folders)+1)
+	folder.DriveId = driveID
+	f.folders = append(f.folders, &folder)
+	if driveID != "" {
+		f.sharedDrives[folder.Id] = driveID
+	}
+	f.writeJSON(w, &drive.File{Id: folder.Id})
+}
+
+// Answers the gets of folders and the copies, exports and deletions of
+// spreadsheets by Drive. Copies are spreadsheets with IDs like
+// "timesheet-copy-1", and exports are pdfs of the visible sheets, which
+// must be the first one only as in exports of a sheet.
+func (f *fakeAPI) serveDriveFile(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/drive/v3/files/"), "/")
+	id := parts[0]
+	folder := f.folder(id)
+	if _, ok := f.spreadsheets[id]; !ok && folder == nil {
+		writeFakeAPIError(w, http.StatusNotFound, "File not found: "+id)
+		return
+	}
+	// Exports have no supportsAllDrives
+	export := len(parts) == 2 && parts[1] == "export"
+	if f.sharedDrives[id] != "" && !export && r.URL.Query().Get("supportsAllDrives") != "true" {
+		writeFakeAPIError(w, http.StatusNotFound, "File not found: "+id)
+		return
+	}
+	switch {
+	case folder != nil && len(parts) == 1 && r.Method == http.MethodGet:
+		f.writeJSON(w, &drive.File{Id: folder.Id, DriveId: folder.DriveId})
+	case len(parts) == 2 && parts[1] == "copy" && r.Method == http.MethodPost:
+		f.copies++
+		copyID := fmt.Sprintf("%s-copy-%d", id, f.copies)
+		var s sheets.Spreadsheet
+		b, _ := json.Marshal(f.spreadsheets[id])
+		json.Unmarshal(b, &s)
+		s.SpreadsheetId = copyID
+		f.spreadsheets[copyID] = &s
+		if driveID := f.sharedDrives[id]; driveID != "" {
+			f.sharedDrives[copyID] = driveID
+		}
+		f.values[copyID] = make(map[string]map[string]interface{})
+		for title, values := range f.values[id] {
+			f.values[copyID][title] = make(map[string]interface{})
+			for cell, v := range values {
+				f.values[copyID][title][cell] = v
+			}
+		}
+		f.writeJSON(w, map[string]string{"id": copyID})
+	case export && r.Method == http.MethodGet:
+		if r.URL.Query().Get("mimeType") != "application/pdf" {
+			f.t.Errorf("unexpected export: %s", r.URL)
+			writeFakeAPIError(w, http.StatusBadRequest, "unexpected mimeType")
+			return
+		}
+		for i, sh := range f.sortedSheets(id) {
+			if !sh.Properties.Hidden && i != 0 {
+				f.t.Errorf("export of %s has sheet %s visible at %d", id, sh.Properties.Title, i)
+			}
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		a4 := [2]int{595, 842}
+		w.Write(newTestPDF(a4, a4, a4))
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(f.spreadsheets, id)
+		delete(f.values, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.t.Errorf("unexpected drive request: %s %s", r.Method, r.URL)
+		writeFakeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (f *fakeAPI) serveSheets(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v4/spreadsheets/")
+	id := rest
+	if i := strings.IndexAny(rest, "/:"); i >= 0 {
+		id, rest = rest[:i], rest[i:]
+	} else {
+		rest = ""
+	}
+	if _, ok := f.spreadsheets[id]; !ok {
+		writeFakeAPIError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	switch {
+	case rest == "" && r.Method == http.MethodGet && len(r.URL.Query()["ranges"]) > 0:
+		s, err := f.gridFormats(id, r.URL.Query()["ranges"])
+		if err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.writeJSON(w, s)
+	case rest == "" && r.Method == http.MethodGet:
+		f.sortedSheets(id)
+		f.writeJSON(w, f.spreadsheets[id])
+	case rest == ":batchUpdate" && r.Method == http.MethodPost:
+		f.serveBatchUpdate(w, r, id)
+	case strings.HasPrefix(rest, "/sheets/") && strings.HasSuffix(rest, ":copyTo"):
+		f.serveCopyTo(w, r, id, strings.TrimSuffix(strings.TrimPrefix(rest, "/sheets/"), ":copyTo"))
+	case rest == "/values:batchGet" && r.Method == http.MethodGet:
+		resp := &sheets.BatchGetValuesResponse{SpreadsheetId: id}
+		for _, rng := range r.URL.Query()["ranges"] {
+			vr, err := f.getValues(id, rng)
+			if err != nil {
+				writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			resp.ValueRanges = append(resp.ValueRanges, vr)
+		}
+		f.writeJSON(w, resp)
+	case rest == "/values:batchUpdate" && r.Method == http.MethodPost:
+		var req sheets.BatchUpdateValuesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		resp := &sheets.BatchUpdateValuesResponse{SpreadsheetId: id}
+		for _, vr := range req.Data {
+			if f.parseEntered && req.ValueInputOption == "USER_ENTERED" {
+				f.enterValues(id, vr.Values)
+			}
+			if err := f.setValues(id, vr.Range, vr.Values); err != nil {
+				writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			resp.TotalUpdatedCells += int64(len(vr.Values))
+		}
+		f.writeJSON(w, resp)
+	case strings.HasPrefix(rest, "/values/") && r.Method == http.MethodGet:
+		vr, err := f.getValues(id, strings.TrimPrefix(rest, "/values/"))
+		if err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.writeJSON(w, vr)
+	case strings.HasPrefix(rest, "/values/") && r.Method == http.MethodPut:
+		var vr sheets.ValueRange
+		if err := json.NewDecoder(r.Body).Decode(&vr); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		rng := strings.TrimPrefix(rest, "/values/")
+		if err := f.setValues(id, rng, vr.Values); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.writeJSON(w, &sheets.UpdateValuesResponse{SpreadsheetId: id, UpdatedRange: rng})
+	default:
+		f.t.Errorf("unexpected sheets request: %s %s", r.Method, r.URL)
+		writeFakeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Copies the sheet as the last one titled like "Copy of 202404"
+func (f *fakeAPI) serveCopyTo(w http.ResponseWriter, r *http.Request, id, sheetID string) {
+	var req sheets.CopySheetToAnotherSpreadsheetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.DestinationSpreadsheetId != id {
+		f.t.Errorf("sheet copied to another spreadsheet %s", req.DestinationSpreadsheetId)
+	}
+	source, err := strconv.ParseInt(sheetID, 10, 64)
+	if err != nil {
+		writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	props, err := f.copySheet(id, source, "", int64(len(f.spreadsheets[id].Sheets)))
+	if err != nil {
+		writeFakeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	f.writeJSON(w, props)
+}
+
+// Adds a copy of the sheet with its values at the index, titled like
+// "Copy of 202404" if title is empty
+func (f *fakeAPI) copySheet(id string, sheetID int64, title string, index int64) (*sheets.SheetProperties, error) {
+	s := f.spreadsheets[id]
+	var source *sheets.Sheet
+	next := int64(1)
+	for _, sh := range s.Sheets {
+		if sh.Properties.SheetId == sheetID {
+			source = sh
+		}
+		if sh.Properties.SheetId >= next {
+			next = sh.Properties.SheetId + 1
+		}
+	}
+	if source == nil {
+		return nil, fmt.Errorf("no sheet %d", sheetID)
+	}
+	if title == "" {
+		title = "Copy of " + source.Properties.Title
+	}
+	if _, ok := f.values[id][title]; ok {
+		return nil, fmt.Errorf("A sheet with the name \"%s\" already exists. Please enter another name.", title)
+	}
+	props := *source.Properties
+	props.SheetId = next * 1000
+	props.Title = title
+	props.Index = int64(len(s.Sheets))
+	s.Sheets = append(s.Sheets, &sheets.Sheet{Properties: &props})
+	values := make(map[string]interface{})
+	for cell, v := range f.values[id][source.Properties.Title] {
+		values[cell] = v
+	}
+	f.values[id][title] = values
+	if err := f.updateSheetProperties(id, &sheets.UpdateSheetPropertiesRequest{Properties: &sheets.SheetProperties{SheetId: props.SheetId, Index: index}, Fields: "index"}); err != nil {
+		return nil, err
+	}
+	return &props, nil
+}
+
+// Applies the sheet duplications and property updates of the batch,
+// accepting the other requests as they are. Duplications are refused while
+// refuseDuplicate, as they are for some sheets.
+func (f *fakeAPI) serveBatchUpdate(w http.ResponseWriter, r *http.Request, id string) {
+	var req sheets.BatchUpdateSpreadsheetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := &sheets.BatchUpdateSpreadsheetResponse{SpreadsheetId: id}
+	for _, rq := range req.Requests {
+		reply := &sheets.Response{}
+		if d := rq.DuplicateSheet; d != nil {
+			if f.refuseDuplicate {
+				writeFakeAPIError(w, http.StatusBadRequest, "Invalid requests[0].duplicateSheet: the sheet can't be duplicated.")
+				return
+			}
+			props, err := f.copySheet(id, d.SourceSheetId, d.NewSheetName, d.InsertSheetIndex)
+			if err != nil {
+				writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			reply.DuplicateSheet = &sheets.DuplicateSheetResponse{Properties: props}
+		}
+		if u := rq.UpdateSheetProperties; u != nil {
+			if err := f.updateSheetProperties(id, u); err != nil {
+				writeFakeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if c := rq.RepeatCell; c != nil && c.Cell.UserEnteredFormat != nil && c.Cell.UserEnteredFormat.NumberFormat != nil {
+			g := c.Range
+			if f.formats[id] == nil {
+				f.formats[id] = make(map[int64]map[string]string)
+			}
+			if f.formats[id][g.SheetId] == nil {
+				f.formats[id][g.SheetId] = make(map[string]string)
+			}
+			for r := g.StartRowIndex; r < g.EndRowIndex; r++ {
+				for col := g.StartColumnIndex; col < g.EndColumnIndex; col++ {
+					f.formats[id][g.SheetId][timesheet.FormatA1Cell(int(col), int(r))] = c.Cell.UserEnteredFormat.NumberFormat.Type
+				}
+			}
+		}
+		resp.Replies = append(resp.Replies, reply)
+	}
+	f.writeJSON(w, resp)
+}
+
+func (f *fakeAPI) updateSheetProperties(id string, u *sheets.UpdateSheetPropertiesRequest) error {
+	s := f.spreadsheets[id]
+	var target *sheets.Sheet
+	for _, sh := range s.Sheets {
+		if sh.Properties.SheetId == u.Properties.SheetId {
+			target = sh
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no sheet %d", u.Properties.SheetId)
+	}
+	for _, field := range strings.Split(u.Fields, ",") {
+		switch strings.TrimSpace(field) {
+		case "title":
+			for _, sh := range s.Sheets {
+				if sh != target && sh.Properties.Title == u.Properties.Title {
+					return fmt.Errorf("A sheet with the name \"%s\" already exists. Please enter another name.", u.Properties.Title)
+				}
+			}
+			f.values[id][u.Properties.Title] = f.values[id][target.Properties.Title]
+			delete(f.values[id], target.Properties.Title)
+			target.Properties.Title = u.Properties.Title
+		case "index":
+			// Sheets after the new index move back
+			ordered := f.sortedSheets(id)
+			for i, sh := range ordered {
+				if sh == target {
+					ordered = append(ordered[:i:i], ordered[i+1:]...)
+					break
+				}
+			}
+			index := int(u.Properties.Index)
+			if index > len(ordered) {
+				index = len(ordered)
+			}
+			ordered = append(ordered[:index:index], append([]*sheets.Sheet{target}, ordered[index:]...)...)
+			for i, sh := range ordered {
+				sh.Properties.Index = int64(i)
+			}
+		case "hidden":
+			target.Properties.Hidden = u.Properties.Hidden
+		case "tabColor", "tabColorStyle":
+			target.Properties.TabColor = u.Properties.TabColor
+			target.Properties.TabColorStyle = u.Properties.TabColorStyle
+		}
+	}
+	return nil
+}
+
+// Parses a range like "'202405'!D7:D37" into the sheet title and the
+// corners of the cells, the whole sheet if the range has no cells
+func (f *fakeAPI) parseRange(id, rng string) (title string, c1, r1, c2, r2 int, err error) {
+	title, cells := rng, ""
+	if i := strings.LastIndex(rng, "!"); i >= 0 {
+		title, cells = rng[:i], rng[i+1:]
+	}
+	if strings.HasPrefix(title, "'") {
+		title = strings.ReplaceAll(strings.Trim(title, "'"), "''", "'")
+	}
+	if _, ok := f.values[id][title]; !ok {
+		return "", 0, 0, 0, 0, fmt.Errorf("Unable to parse range: %s", rng)
+	}
+	if cells == "" {
+		c2, r2 = 25, 99
+		return
+	}
+	parts := strings.SplitN(cells, ":", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	if c1, r1, err = timesheet.ParseA1Cell(parts[0]); err != nil {
+		return
+	}
+	c2, r2, err = timesheet.ParseA1Cell(parts[1])
+	return
+}
+
+func (f *fakeAPI) getValues(id, rng string) (*sheets.ValueRange, error) {
+	title, c1, r1, c2, r2, err := f.parseRange(id, rng)
+	if err != nil {
+		return nil, err
+	}
+	// Trailing empty rows and cells are left out like by the API
+	rows := make([][]interface{}, 0)
+	for r := r1; r <= r2; r++ {
+		row := make([]interface{}, 0)
+		for c := c1; c <= c2; c++ {
+			row = append(row, f.values[id][title][timesheet.FormatA1Cell(c, r)])
+		}
+		for len(row) > 0 && (row[len(row)-1] == nil || row[len(row)-1] == "") {
+			row = row[:len(row)-1]
+		}
+		for i := range row {
+			if row[i] == nil {
+				row[i] = ""
+			}
+		}
+		rows = append(rows, row)
+	}
+	for len(rows) > 0 && len(rows[len(rows)-1]) == 0 {
+		rows = rows[:len(rows)-1]
+	}
+	return &sheets.ValueRange{Range: rng, MajorDimension: "ROWS", Values: rows}, nil
+}
+
+func (f *fakeAPI) setValues(id, rng string, values [][]interface{}) error {
+	title, c1, r1, _, _, err := f.parseRange(id, rng)
+	if err != nil {
+		return err
+	}
+	for i, row := range values {
+		for j, v := range row {
+			cell := timesheet.FormatA1Cell(c1+j, r1+i)
+			if v == nil || v == "" {
+				delete(f.values[id][title], cell)
+				continue
+			}
+			f.values[id][title][cell] = v
+		}
+	}
+	return nil
+}
+
+// Returns the spreadsheet having the number formats of the cells of the
+// ranges as the grid data of its first sheet, one for each range
+func (f *fakeAPI) gridFormats(id string, ranges []string) (*sheets.Spreadsheet, error) {
+	sheet := &sheets.Sheet{}
+	for _, rng := range ranges {
+		title, c1, r1, c2, r2, err := f.parseRange(id, rng)
+		if err != nil {
+			return nil, err
+		}
+		var formats map[string]string
+		for _, sh := range f.spreadsheets[id].Sheets {
+			if sh.Properties.Title == title {
+				formats = f.formats[id][sh.Properties.SheetId]
+			}
+		}
+		data := &sheets.GridData{StartRow: int64(r1), StartColumn: int64(c1)}
+		for r := r1; r <= r2; r++ {
+			row := &sheets.RowData{}
+			for c := c1; c <= c2; c++ {
+				cell := &sheets.CellData{}
+				if t, ok := formats[timesheet.FormatA1Cell(c, r)]; ok {
+					cell.UserEnteredFormat = &sheets.CellFormat{NumberFormat: &sheets.NumberFormat{Type: t}}
+				}
+				row.Values = append(row.Values, cell)
+			}
+			data.RowData = append(data.RowData, row)
+		}
+		sheet.Data = append(sheet.Data, data)
+	}
+	return &sheets.Spreadsheet{SpreadsheetId: id, Sheets: []*sheets.Sheet{sheet}}, nil
+}
+
+// Patterns of the strings Sheets parses as dates, times and decimals
+var (
+	fakeEnteredYMD     = regexp.MustCompile(`^(\d{4})[-/](\d{1,2})[-/](\d{1,2})$`)
+	fakeEnteredDMY     = regexp.MustCompile(`^(\d{1,2})[/.](\d{1,2})[/.](\d{4})$`)
+	fakeEnteredTime    = regexp.MustCompile(`^(\d{1,3}):(\d{2})$`)
+	fakeEnteredDecimal = map[bool]*regexp.Regexp{
+		false: regexp.MustCompile(`^-?\d+(\.\d+)?$`),
+		true:  regexp.MustCompile(`^-?\d+(,\d+)?$`),
+	}
+)
+
+// Replaces the strings of the values with what Sheets keeps of them
+// entered in the locale of the spreadsheet: dates and times by their serial
+// numbers and decimals by numbers. Day first dates are read month first in
+// en_US, and decimals have a comma in de_DE and fr_FR.
+func (f *fakeAPI) enterValues(id string, values [][]interface{}) {
+	locale := f.spreadsheets[id].Properties.Locale
+	comma := locale == "de_DE" || locale == "fr_FR"
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	serial := func(y, m, d int) interface{} {
+		t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+		if t.Month() != time.Month(m) || t.Day() != d {
+			return nil
+		}
+		return t.Sub(timesheet.SheetsEpoch).Hours() / 24
+	}
+	for _, row := range values {
+		for i, v := range row {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			var entered interface{}
+			if m := fakeEnteredYMD.FindStringSubmatch(s); m != nil {
+				entered = serial(atoi(m[1]), atoi(m[2]), atoi(m[3]))
+			} else if m := fakeEnteredDMY.FindStringSubmatch(s); m != nil {
+				if locale == "en_US" {
+					m[1], m[2] = m[2], m[1]
+				}
+				entered = serial(atoi(m[3]), atoi(m[2]), atoi(m[1]))
+			} else if m := fakeEnteredTime.FindStringSubmatch(s); m != nil {
+				entered = float64(atoi(m[1])*60+atoi(m[2])) / (24 * 60)
+			} else if fakeEnteredDecimal[comma].MatchString(s) {
+				entered, _ = strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+			}
+			if entered != nil {
+				row[i] = entered
+			}
+		}
+	}
+}
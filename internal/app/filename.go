@@ -0,0 +1,23 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/tsujio/make-invoices/internal/export"
+)
+
+// Returns the safe file name of stem and ext for the run. If it is the same
+// as the one of another name, a hash of the original name is added to it.
+func (r *reservedFiles) safeFileName(stem, ext string) string {
+	original := stem + ext
+	name := export.SanitizeFileName(stem, ext)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if o, ok := r.originals[name]; ok && o != original {
+		sum := sha256.Sum256([]byte(original))
+		name = export.SanitizeFileName(stem, "-"+hex.EncodeToString(sum[:4])+ext)
+	}
+	r.originals[name] = original
+	return name
+}
@@ -0,0 +1,191 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+// Public holidays of Japan published by the Cabinet Office, in Shift_JIS
+const defaultHolidaysSource = "https://www8.cao.go.jp/chosei/shukujitsu/syukujitsu.csv"
+
+const defaultHolidaysCacheTTL = 30 * 24 * time.Hour
+
+// Snapshot of the Cabinet Office's CSV, used when it can't be fetched
+//
+//go:embed syukujitsu.csv
+var embeddedHolidaysCSV []byte
+
+// Holidays of the CSV keyed by date like "2006-01-02", loaded once in the run
+var (
+	publicHolidays     map[string]string
+	publicHolidaysErr  error
+	publicHolidaysOnce sync.Once
+)
+
+// Returns the names of the public holidays keyed by date like "2006-01-02",
+// or nil if disabled
+func getPublicHolidays(config *Config) (map[string]string, error) {
+	hc := config.Holidays
+	if hc == nil {
+		hc = &HolidaysConfig{}
+	}
+	if hc.Source == "none" {
+		return nil, nil
+	}
+	publicHolidaysOnce.Do(func() {
+		publicHolidays, publicHolidaysErr = loadPublicHolidays(hc)
+	})
+	if publicHolidaysErr != nil {
+		return nil, fmt.Errorf("Failed to load holidays: %v", publicHolidaysErr)
+	}
+	return publicHolidays, nil
+}
+
+func loadPublicHolidays(hc *HolidaysConfig) (map[string]string, error) {
+	source := hc.Source
+	if source == "" {
+		source = defaultHolidaysSource
+	}
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		d, err := ioutil.ReadFile(resolveConfigPath(source))
+		if err != nil {
+			return nil, err
+		}
+		return parseHolidaysCSV(d, hc.Encoding)
+	}
+
+	ttl := defaultHolidaysCacheTTL
+	if hc.CacheTTL != "" {
+		ttl, _ = time.ParseDuration(hc.CacheTTL)
+	}
+	cachePath := getPathSiblingOfExecutable("holidays_cache.csv")
+	fi, statErr := os.Stat(cachePath)
+	if statErr == nil && time.Since(fi.ModTime()) < ttl {
+		if d, err := ioutil.ReadFile(cachePath); err == nil {
+			if holidays, err := parseHolidaysCSV(d, hc.Encoding); err == nil {
+				return holidays, nil
+			}
+		}
+	}
+
+	d, err := fetchHolidaysCSV(source)
+	if err == nil {
+		var holidays map[string]string
+		if holidays, err = parseHolidaysCSV(d, hc.Encoding); err == nil {
+			if err := ioutil.WriteFile(cachePath, d, 0644); err != nil {
+				logWarnf(log.Default(), "Warning: failed to cache holidays: %v\n", err)
+			}
+			return holidays, nil
+		}
+	}
+
+	// Offline, a stale cache is better than the snapshot
+	logWarnf(log.Default(), "Warning: failed to fetch holidays from %s: %v\n", source, err)
+	if statErr == nil {
+		if d, err := ioutil.ReadFile(cachePath); err == nil {
+			if holidays, err := parseHolidaysCSV(d, hc.Encoding); err == nil {
+				log.Printf("Using holidays cached at %s\n", fi.ModTime().Format("2006-01-02"))
+				return holidays, nil
+			}
+		}
+	}
+	if hc.Source != "" {
+		return nil, err
+	}
+	log.Println("Using the built-in holidays")
+	return parseHolidaysCSV(embeddedHolidaysCSV, "")
+}
+
+func fetchHolidaysCSV(source string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(runCtx, apiTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Parses the CSV of holidays having a header row. Text which is not valid
+// UTF-8 is taken as Shift_JIS unless the encoding is given.
+func parseHolidaysCSV(d []byte, encoding string) (map[string]string, error) {
+	if encoding == "shift_jis" || (encoding == "" && !utf8.Valid(d)) {
+		decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode holidays: %v", err)
+		}
+		d = decoded
+	}
+	d = bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))
+	r := csv.NewReader(bytes.NewReader(d))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse holidays: %v", err)
+	}
+	holidays := make(map[string]string)
+	for i, record := range records {
+		if i == 0 || len(record) < 2 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		date, err := time.Parse("2006/1/2", strings.TrimSpace(record[0]))
+		if err != nil {
+			if date, err = time.Parse("2006-01-02", strings.TrimSpace(record[0])); err != nil {
+				return nil, fmt.Errorf("failed to parse holidays: line %d: %v", i+1, err)
+			}
+		}
+		holidays[date.Format("2006-01-02")] = strings.TrimSpace(record[1])
+	}
+	if len(holidays) == 0 {
+		return nil, fmt.Errorf("no holidays in the CSV")
+	}
+	return holidays, nil
+}
+
+// Returns the public holidays in the billing period of the month
+func getPublicHolidaysInPeriod(config *Config, targetTime time.Time) (map[string]string, error) {
+	all, err := getPublicHolidays(config)
+	if err != nil || all == nil {
+		return nil, err
+	}
+	period := getBillingPeriod(config, targetTime)
+	holidays := make(map[string]string)
+	for d := period.start; d.Before(period.end); d = d.AddDate(0, 0, 1) {
+		key := d.Format("2006-01-02")
+		if name, ok := all[key]; ok {
+			holidays[key] = name
+		}
+	}
+	// Years not published yet have no holidays at all
+	if len(holidays) == 0 {
+		year := period.end.AddDate(0, 0, -1).Format("2006-")
+		for key := range all {
+			if strings.HasPrefix(key, year) {
+				return holidays, nil
+			}
+		}
+		logWarnf(log.Default(), "Warning: no holidays are known for %s\n", period.end.AddDate(0, 0, -1).Format("2006"))
+	}
+	return holidays, nil
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type hookSpreadsheet struct {
+	SpreadsheetID string   `json:"spreadsheet_id"`
+	Title         string   `json:"title,omitempty"`
+	WorkDays      int      `json:"work_days"`
+	Outputs       []string `json:"outputs,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	// Set if the spreadsheet is billed, with the amounts in the minor units
+	// of the currency and the total formatted like $12,345.67
+	Currency         string `json:"currency,omitempty"`
+	TotalText        string `json:"total_text,omitempty"`
+	RateUnit         string `json:"rate_unit,omitempty"`
+	BillableQuantity string `json:"billable_quantity,omitempty"`
+	Subtotal         *int64 `json:"subtotal,omitempty"`
+	Tax              *int64 `json:"tax,omitempty"`
+	Withholding      *int64 `json:"withholding,omitempty"`
+	Total            *int64 `json:"total,omitempty"`
+	// Set if the billing period is not the calendar month
+	PeriodStart string `json:"period_start,omitempty"`
+	PeriodEnd   string `json:"period_end,omitempty"`
+	// Work of the months before, and how the month differs from it
+	History   []monthWork `json:"history,omitempty"`
+	Anomalies []string    `json:"anomalies,omitempty"`
+	// Statuses of the deliveries of the outputs, like "email: sent <ID>"
+	Deliveries []string `json:"deliveries,omitempty"`
+	// not_sent, sent or skipped if sent before as it is
+	SendState string `json:"send_state,omitempty"`
+	// Work of each day, with the daily CSV
+	Days []*hookDay `json:"days,omitempty"`
+}
+
+// hookDay is a work day in the run summary, as written to the daily CSV
+type hookDay struct {
+	Date     string `json:"date"`
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Break    string `json:"break,omitempty"`
+	Hours    string `json:"hours,omitempty"`
+	Amount   string `json:"amount,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	Note     string `json:"note,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+func (s *hookSpreadsheet) setBilling(amount *billingAmount) {
+	if amount == nil {
+		return
+	}
+	s.Currency = amount.Currency.code
+	s.TotalText = amount.Currency.format(amount.Total)
+	s.RateUnit = amount.RateUnit
+	s.BillableQuantity = amount.Quantity
+	s.Subtotal = &amount.Subtotal
+	s.Tax = &amount.Tax
+	s.Withholding = &amount.Withholding
+	s.Total = &amount.Total
+}
+
+type hookRunSummary struct {
+	Month        string             `json:"month"`
+	Spreadsheets []*hookSpreadsheet `json:"spreadsheets"`
+	Outputs      []string           `json:"outputs"`
+	Duration     string             `json:"duration"`
+	Metrics      *metricsSummary    `json:"metrics"`
+}
+
+// Runs the hook command with the input on stdin and the variables added to
+// the environment, logging its output
+func runHook(name string, command []string, input interface{}, env map[string]string, logger *log.Logger) error {
+	if len(command) == 0 {
+		return nil
+	}
+	d, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s hook input: %v", name, err)
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(d)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s hook: %v", name, err)
+	}
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{stdout, stderr} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			s := bufio.NewScanner(r)
+			for s.Scan() {
+				logger.Printf("[%s hook] %s\n", name, s.Text())
+			}
+		}(r)
+	}
+	wg.Wait()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s hook failed: %v", name, err)
+	}
+	return nil
+}
+
+func runPostExportHook(hooks *HooksConfig, targetTime time.Time, spreadsheetID, title string, workDays int, amount *billingAmount, outputs []string, pdfPath string, logger *log.Logger) error {
+	s := &hookSpreadsheet{
+		SpreadsheetID: spreadsheetID,
+		Title:         title,
+		WorkDays:      workDays,
+		Outputs:       outputs,
+	}
+	s.setBilling(amount)
+	err := runHook("post_export", hooks.PostExport, s, map[string]string{
+		"MONTH":          targetTime.Format("200601"),
+		"PDF_PATH":       pdfPath,
+		"SPREADSHEET_ID": spreadsheetID,
+		"WORK_DAYS":      strconv.Itoa(workDays),
+	}, logger)
+	if err != nil && !hooks.FailsOnError() {
+		logger.Printf("Ignoring failure: %v\n", err)
+		return nil
+	}
+	return err
+}
+
+func buildHookRunSummary(targetTime time.Time, spreadsheets []*SpreadsheetConfig, workDaysBySpreadsheet map[string][]WorkDay, errs []error, files *reservedFiles) *hookRunSummary {
+	summary := &hookRunSummary{
+		Month:        targetTime.Format("200601"),
+		Spreadsheets: make([]*hookSpreadsheet, 0, len(spreadsheets)),
+		Outputs:      make([]string, 0, len(files.written)),
+		Duration:     time.Since(runStart).Round(time.Second).String(),
+		Metrics:      metrics.summary(),
+	}
+	for i, sc := range spreadsheets {
+		s := &hookSpreadsheet{
+			SpreadsheetID: sc.ID,
+			WorkDays:      len(workDaysBySpreadsheet[sc.ID]),
+		}
+		if period, ok := files.periods[sc.ID]; ok {
+			s.PeriodStart = period.start.Format("2006-01-02")
+			s.PeriodEnd = period.end.AddDate(0, 0, -1).Format("2006-01-02")
+		}
+		if errs[i] != nil {
+			s.Error = errs[i].Error()
+		} else {
+			s.setBilling(files.billing[sc.ID])
+		}
+		s.History = files.history[sc.ID]
+		s.Anomalies = files.anomalies[sc.ID]
+		s.Deliveries = files.deliveries[sc.ID]
+		for _, d := range files.daily[sc.ID] {
+			s.Days = append(s.Days, &hookDay{
+				Date:     d.date.Format("2006-01-02"),
+				Start:    d.start,
+				End:      d.end,
+				Break:    d.brk,
+				Hours:    d.hours,
+				Amount:   d.amount,
+				Kind:     d.kind,
+				Note:     d.note,
+				Location: d.location,
+			})
+		}
+		if errs[i] == nil {
+			s.SendState = sendStateNotSent
+			if state, ok := files.sendStates[sc.ID]; ok {
+				s.SendState = state
+			}
+		}
+		summary.Spreadsheets = append(summary.Spreadsheets, s)
+	}
+	for _, o := range files.written {
+		summary.Outputs = append(summary.Outputs, o.path)
+	}
+	return summary
+}
+
+func runPostRunHook(hooks *HooksConfig, targetTime time.Time, spreadsheets []*SpreadsheetConfig, workDaysBySpreadsheet map[string][]WorkDay, errs []error, files *reservedFiles) error {
+	summary := buildHookRunSummary(targetTime, spreadsheets, workDaysBySpreadsheet, errs, files)
+	workDays := 0
+	for _, s := range summary.Spreadsheets {
+		workDays += s.WorkDays
+	}
+	err := runHook("post_run", hooks.PostRun, summary, map[string]string{
+		"MONTH":     summary.Month,
+		"WORK_DAYS": strconv.Itoa(workDays),
+	}, log.Default())
+	if err != nil && !hooks.FailsOnError() {
+		log.Printf("Ignoring failure: %v\n", err)
+		return nil
+	}
+	return err
+}
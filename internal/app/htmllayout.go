@@ -0,0 +1,940 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// Local templates are laid out as slices stacked down the pages: lines of
+// text, rows of tables and the edges of boxes. Each slice is put on a page
+// as a whole, so pages break between lines and rows.
+
+const (
+	opText = iota
+	opRect
+	opLine
+)
+
+// drawOp is what is drawn, at points from the top left of its slice or page
+type drawOp struct {
+	kind int
+	x, y float64
+	// Size of rects
+	w, h float64
+	// End and width of lines
+	x2, y2    float64
+	lineWidth float64
+	color     pdfColor
+	// Text on the baseline at y
+	text         string
+	glyphs       []int
+	size         float64
+	bold, italic bool
+	underline    bool
+}
+
+func (op drawOp) moved(dx, dy float64) drawOp {
+	op.x, op.y = op.x+dx, op.y+dy
+	op.x2, op.y2 = op.x2+dx, op.y2+dy
+	return op
+}
+
+type layoutSlice struct {
+	height float64
+	ops    []drawOp
+	// Baseline of the line of text, 0 for slices of other kinds
+	baseline float64
+	// Margins are collapsed with adjacent ones and dropped at the top of
+	// pages
+	spacer    bool
+	pageBreak bool
+}
+
+// htmlLayout lays out a document in the font, keeping the glyphs used
+// with the runes they show
+type htmlLayout struct {
+	font  *sfntFont
+	sheet *styleSheet
+	used  map[int]rune
+}
+
+// Lays out the HTML on pages of the local pdf layout, returning what is
+// drawn on each page
+func layoutHTML(text string, font *sfntFont) ([][]drawOp, map[int]rune, error) {
+	doc, err := html.Parse(strings.NewReader(text))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse html: %v", err)
+	}
+	l := &htmlLayout{font: font, sheet: &styleSheet{}, used: make(map[int]rune)}
+	var root *html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "html":
+				root = n
+			case "style":
+				if n.FirstChild != nil {
+					parseStyleSheet(n.FirstChild.Data, l.sheet)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	if root == nil {
+		return nil, nil, fmt.Errorf("no html element")
+	}
+	s := computeStyle(root, newRootStyle(), l.sheet, nil)
+	slices := l.layoutBlock(root, s, localPDFMargin, localPDFPageWidth-2*localPDFMargin, 0)
+	return paginate(slices), l.used, nil
+}
+
+// Puts the slices on pages
+func paginate(slices []layoutSlice) [][]drawOp {
+	top, bottom := float64(localPDFMargin), float64(localPDFPageHeight-localPDFMargin)
+	pages := [][]drawOp{{}}
+	y, spacer := top, 0.0
+	newPage := func() {
+		pages = append(pages, []drawOp{})
+		y, spacer = top, 0
+	}
+	for _, sl := range slices {
+		if sl.pageBreak {
+			if y > top {
+				newPage()
+			}
+			continue
+		}
+		if sl.spacer && len(sl.ops) == 0 {
+			spacer = math.Max(spacer, sl.height)
+			continue
+		}
+		if y > top {
+			y += spacer
+		}
+		spacer = 0
+		if y+sl.height > bottom && y > top {
+			newPage()
+		}
+		page := len(pages) - 1
+		for _, op := range sl.ops {
+			pages[page] = append(pages[page], op.moved(0, y))
+		}
+		y += sl.height
+	}
+	return pages
+}
+
+// Returns the content width of the box in the containing width, or -1 if
+// it has no width
+func (s *boxStyle) contentWidth(containing float64) float64 {
+	if s.width >= 0 {
+		return s.width
+	}
+	if s.widthPercent >= 0 {
+		return containing * s.widthPercent / 100
+	}
+	return -1
+}
+
+// Lays out the block element in the width from x, with its margins. The
+// index is the number of the element in its list, if a list item.
+func (l *htmlLayout) layoutBlock(n *html.Node, s *boxStyle, x, width float64, index int) []layoutSlice {
+	if s.display == "table" {
+		return l.layoutTable(n, s, x, width)
+	}
+	edges := s.border(sideLeft) + s.border(sideRight) + s.padding[sideLeft] + s.padding[sideRight]
+	ml := s.margin[sideLeft]
+	boxWidth := width - s.margin[sideLeft] - s.margin[sideRight]
+	if w := s.contentWidth(width); w >= 0 {
+		boxWidth = w + edges
+		ml = s.alignBox(width, boxWidth)
+	}
+	contentX := x + ml + s.border(sideLeft) + s.padding[sideLeft]
+	content := l.layoutContent(n, s, contentX, boxWidth-edges)
+	if s.display == "list-item" {
+		l.addListMarker(content, s, contentX, index)
+	}
+	return l.decorate(content, s, x+ml, boxWidth)
+}
+
+// Returns the left margin of the box of the width in the containing width,
+// centering or aligning it right with auto margins
+func (s *boxStyle) alignBox(width, boxWidth float64) float64 {
+	free := width - s.margin[sideLeft] - s.margin[sideRight] - boxWidth
+	switch {
+	case free <= 0:
+		return s.margin[sideLeft]
+	case s.autoMargin[sideLeft] && s.autoMargin[sideRight]:
+		return s.margin[sideLeft] + free/2
+	case s.autoMargin[sideLeft]:
+		return s.margin[sideLeft] + free
+	}
+	return s.margin[sideLeft]
+}
+
+func isBlockLevel(s *boxStyle) bool {
+	return s.display != "inline" && s.display != "none"
+}
+
+// Lays out the children of the element in the content width from x
+func (l *htmlLayout) layoutContent(n *html.Node, s *boxStyle, x, width float64) []layoutSlice {
+	slices := make([]layoutSlice, 0)
+	items := make([]inlineItem, 0)
+	flush := func() {
+		slices = append(slices, l.layoutInline(items, s, x, width)...)
+		items = items[:0]
+	}
+	index := 0
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			cs := computeStyle(c, s, l.sheet, nil)
+			if isBlockLevel(cs) {
+				flush()
+				if cs.display == "list-item" {
+					index++
+				}
+				slices = append(slices, l.layoutBlock(c, cs, x, width, index)...)
+				continue
+			}
+		}
+		l.collectInline(c, s, &items)
+	}
+	flush()
+	return slices
+}
+
+// Adds the margins, borders, paddings and background of the box of the
+// width from x to its content
+func (l *htmlLayout) decorate(content []layoutSlice, s *boxStyle, x, width float64) []layoutSlice {
+	slices := make([]layoutSlice, 0, len(content)+5)
+	if s.breakBefore {
+		slices = append(slices, layoutSlice{pageBreak: true})
+	}
+	if s.margin[sideTop] > 0 {
+		slices = append(slices, layoutSlice{height: s.margin[sideTop], spacer: true})
+	}
+	bt, bb := s.border(sideTop), s.border(sideBottom)
+	decorated := s.background != nil || s.border(sideLeft) > 0 || s.border(sideRight) > 0
+	// Edges of the top and the bottom have the borders drawn in the middle
+	// of them
+	edge := func(height, border, borderY float64) layoutSlice {
+		sl := l.sides(layoutSlice{height: height}, s, x, width)
+		if border > 0 {
+			sl.ops = append(sl.ops, drawOp{kind: opLine, x: x, y: borderY, x2: x + width, y2: borderY, lineWidth: border, color: s.borderColorOf(sideTop)})
+		}
+		return sl
+	}
+	if h := bt + s.padding[sideTop]; h > 0 {
+		slices = append(slices, edge(h, bt, bt/2))
+	}
+	for _, c := range content {
+		if decorated && !c.pageBreak {
+			c = l.sides(c, s, x, width)
+		}
+		slices = append(slices, c)
+	}
+	if h := bb + s.padding[sideBottom]; h > 0 {
+		slices = append(slices, edge(h, bb, h-bb/2))
+	}
+	if s.margin[sideBottom] > 0 {
+		slices = append(slices, layoutSlice{height: s.margin[sideBottom], spacer: true})
+	}
+	return slices
+}
+
+// Draws the background and the side borders of the box of the width from x
+// along the slice
+func (l *htmlLayout) sides(sl layoutSlice, s *boxStyle, x, width float64) layoutSlice {
+	ops := make([]drawOp, 0, len(sl.ops)+3)
+	if s.background != nil {
+		ops = append(ops, drawOp{kind: opRect, x: x, y: 0, w: width, h: sl.height, color: *s.background})
+	}
+	ops = append(ops, sl.ops...)
+	if b := s.border(sideLeft); b > 0 {
+		ops = append(ops, drawOp{kind: opLine, x: x + b/2, y: 0, x2: x + b/2, y2: sl.height, lineWidth: b, color: s.borderColorOf(sideLeft)})
+	}
+	if b := s.border(sideRight); b > 0 {
+		ops = append(ops, drawOp{kind: opLine, x: x + width - b/2, y: 0, x2: x + width - b/2, y2: sl.height, lineWidth: b, color: s.borderColorOf(sideRight)})
+	}
+	sl.ops = ops
+	if len(ops) > 0 {
+		sl.spacer = false
+	}
+	return sl
+}
+
+// Draws the marker of the list item left of its first line
+func (l *htmlLayout) addListMarker(content []layoutSlice, s *boxStyle, x float64, index int) {
+	var marker string
+	switch s.listStyle {
+	case "none":
+		return
+	case "decimal":
+		marker = strconv.Itoa(index) + "."
+	case "circle":
+		marker = l.firstInFont("◦", "○", "o")
+	case "square":
+		marker = l.firstInFont("▪", "■", "-")
+	default:
+		marker = l.firstInFont("•", "・", "-")
+	}
+	for i := range content {
+		if content[i].baseline == 0 {
+			continue
+		}
+		op := l.textOp(marker, s)
+		op.x = x - op.w - s.fontSize/2
+		op.y = content[i].baseline
+		content[i].ops = append(content[i].ops, op)
+		return
+	}
+}
+
+// Returns the first of the texts which the font has the glyphs of
+func (l *htmlLayout) firstInFont(texts ...string) string {
+	for _, t := range texts {
+		ok := true
+		for _, r := range t {
+			if l.font.glyph(r) == 0 {
+				ok = false
+			}
+		}
+		if ok {
+			return t
+		}
+	}
+	return texts[len(texts)-1]
+}
+
+// Returns the text op of the text in the style at the origin, its width
+// being in w
+func (l *htmlLayout) textOp(text string, s *boxStyle) drawOp {
+	op := drawOp{kind: opText, text: text, size: s.fontSize, bold: s.bold, italic: s.italic, color: s.color}
+	for _, r := range text {
+		g := l.glyph(r)
+		op.glyphs = append(op.glyphs, g)
+		op.w += l.runeWidth(g, s)
+	}
+	return op
+}
+
+func (l *htmlLayout) glyph(r rune) int {
+	g := l.font.glyph(r)
+	if _, ok := l.used[g]; !ok {
+		l.used[g] = r
+	}
+	return g
+}
+
+func (l *htmlLayout) runeWidth(g int, s *boxStyle) float64 {
+	return float64(l.font.width(g)) * s.fontSize / 1000
+}
+
+// inlineItem is text in its style, or a line break
+type inlineItem struct {
+	text  string
+	style *boxStyle
+	br    bool
+}
+
+// Collects the text of the inline node in the style of its parent. Blocks
+// in inline elements are taken as lines of their own.
+func (l *htmlLayout) collectInline(n *html.Node, parent *boxStyle, items *[]inlineItem) {
+	switch n.Type {
+	case html.TextNode:
+		*items = append(*items, inlineItem{text: n.Data, style: parent})
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	s := computeStyle(n, parent, l.sheet, nil)
+	if s.display == "none" {
+		return
+	}
+	if n.Data == "br" {
+		*items = append(*items, inlineItem{br: true, style: s})
+		return
+	}
+	block := isBlockLevel(s)
+	if block {
+		*items = append(*items, inlineItem{br: true, style: s})
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		l.collectInline(c, s, items)
+	}
+	if block {
+		*items = append(*items, inlineItem{br: true, style: s})
+	}
+}
+
+type styledRune struct {
+	r     rune
+	g     int
+	width float64
+	style *boxStyle
+}
+
+// inlineAtom is a piece of text which lines don't break in: a word, a
+// character of CJK text or a space
+type inlineAtom struct {
+	runes []styledRune
+	width float64
+	// Spaces which are dropped at the ends of lines
+	space bool
+	br    bool
+}
+
+// Lines don't start with these, nor end with the opening ones
+const (
+	noLineStart = "、。，．・：；？！ー）」』】〕〉》〙〗’”ゝゞヽヾぁぃぅぇぉっゃゅょゎァィゥェォッャュョヮヵヶ々〻‐゠–〜?!),.:;%"
+	noLineEnd   = "（「『【〔〈《〘〖‘“(["
+)
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) ||
+		(r >= 0x3000 && r <= 0x303f) || (r >= 0xff00 && r <= 0xffef)
+}
+
+// Tells whether a line may break between the characters, which are not
+// spaces
+func canBreakBetween(prev, next rune) bool {
+	if !isCJK(prev) && !isCJK(next) {
+		return false
+	}
+	return !strings.ContainsRune(noLineStart, next) && !strings.ContainsRune(noLineEnd, prev)
+}
+
+// Splits the items into atoms, collapsing white space unless in pre
+func (l *htmlLayout) inlineAtoms(items []inlineItem) []inlineAtom {
+	atoms := make([]inlineAtom, 0)
+	// Index of the word being added to, or -1
+	word := -1
+	lastSpace := true
+	br := func(s *boxStyle) {
+		atoms = append(atoms, inlineAtom{br: true, runes: []styledRune{{style: s}}})
+		word, lastSpace = -1, true
+	}
+	add := func(r rune, s *boxStyle) {
+		g := l.glyph(r)
+		sr := styledRune{r: r, g: g, width: l.runeWidth(g, s), style: s}
+		if r == ' ' {
+			atoms = append(atoms, inlineAtom{runes: []styledRune{sr}, width: sr.width, space: !s.pre})
+			word = -1
+			return
+		}
+		if word < 0 || canBreakBetween(atoms[word].runes[len(atoms[word].runes)-1].r, r) {
+			atoms = append(atoms, inlineAtom{})
+			word = len(atoms) - 1
+		}
+		atoms[word].runes = append(atoms[word].runes, sr)
+		atoms[word].width += sr.width
+	}
+	for _, item := range items {
+		if item.br {
+			br(item.style)
+			continue
+		}
+		pre := item.style.pre
+		for _, r := range item.text {
+			switch {
+			case pre && r == '\n':
+				br(item.style)
+			case pre && r == '\t':
+				for i := 0; i < 4; i++ {
+					add(' ', item.style)
+				}
+			case pre && r == '\r':
+			case pre:
+				add(r, item.style)
+			case unicode.IsSpace(r) && r != 0xa0 && r != 0x3000:
+				if !lastSpace {
+					add(' ', item.style)
+				}
+				lastSpace = true
+			default:
+				add(r, item.style)
+				lastSpace = false
+			}
+		}
+	}
+	return atoms
+}
+
+// Lays out the items in lines of the width from x, aligned by the style of
+// their block
+func (l *htmlLayout) layoutInline(items []inlineItem, s *boxStyle, x, width float64) []layoutSlice {
+	atoms := l.inlineAtoms(items)
+	slices := make([]layoutSlice, 0)
+	line := make([]inlineAtom, 0)
+	lineWidth := 0.0
+	hasText := func() bool {
+		for _, a := range line {
+			if !a.space {
+				return true
+			}
+		}
+		return false
+	}
+	emit := func(forced bool) {
+		// Spaces at the end are dropped
+		for len(line) > 0 && line[len(line)-1].space {
+			lineWidth -= line[len(line)-1].width
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 || forced {
+			slices = append(slices, l.lineSlice(line, lineWidth, s, x, width))
+		}
+		line, lineWidth = make([]inlineAtom, 0), 0
+	}
+	for len(atoms) > 0 {
+		a := atoms[0]
+		atoms = atoms[1:]
+		switch {
+		case a.br:
+			emit(true)
+			continue
+		case a.space && len(line) == 0:
+			continue
+		}
+		if lineWidth+a.width > width && hasText() {
+			emit(false)
+			if a.space {
+				continue
+			}
+		}
+		// Words longer than lines are broken anywhere
+		if a.width > width && len(line) == 0 && len(a.runes) > 1 {
+			split := make([]inlineAtom, 0, len(a.runes)+len(atoms))
+			for _, r := range a.runes {
+				split = append(split, inlineAtom{runes: []styledRune{r}, width: r.width})
+			}
+			atoms = append(split, atoms...)
+			continue
+		}
+		line = append(line, a)
+		lineWidth += a.width
+	}
+	emit(false)
+	return slices
+}
+
+// Returns the heights above and below the baseline of text in the style
+func (l *htmlLayout) lineExtent(s *boxStyle) (float64, float64) {
+	ascent := float64(l.font.scale(l.font.ascent)) / 1000 * s.fontSize
+	descent := -float64(l.font.scale(l.font.descent)) / 1000 * s.fontSize
+	height := s.fontSize * s.lineHeight
+	above := (height-ascent-descent)/2 + ascent
+	return above, height - above
+}
+
+// Makes the slice of the line of the atoms, which have the width in total
+func (l *htmlLayout) lineSlice(line []inlineAtom, lineWidth float64, s *boxStyle, x, width float64) layoutSlice {
+	above, below := l.lineExtent(s)
+	for _, a := range line {
+		for _, r := range a.runes {
+			ra, rb := l.lineExtent(r.style)
+			above, below = math.Max(above, ra), math.Max(below, rb)
+		}
+	}
+	switch s.textAlign {
+	case "right":
+		x += math.Max(0, width-lineWidth)
+	case "center":
+		x += math.Max(0, (width-lineWidth)/2)
+	}
+	sl := layoutSlice{height: above + below, baseline: above}
+	var op *drawOp
+	flush := func() {
+		if op == nil {
+			return
+		}
+		sl.ops = append(sl.ops, *op)
+		if op.underline {
+			y := above + op.size*0.12
+			sl.ops = append(sl.ops, drawOp{kind: opLine, x: op.x, y: y, x2: op.x + op.w, y2: y, lineWidth: op.size * 0.06, color: op.color})
+		}
+		op = nil
+	}
+	for _, a := range line {
+		for _, r := range a.runes {
+			st := r.style
+			if op == nil || op.size != st.fontSize || op.bold != st.bold || op.italic != st.italic || op.color != st.color || op.underline != st.underline {
+				flush()
+				op = &drawOp{kind: opText, x: x, y: above, size: st.fontSize, bold: st.bold, italic: st.italic, color: st.color, underline: st.underline}
+			}
+			op.text += string(r.r)
+			op.glyphs = append(op.glyphs, r.g)
+			op.w += r.width
+			x += r.width
+		}
+	}
+	flush()
+	return sl
+}
+
+type tableCell struct {
+	n     *html.Node
+	style *boxStyle
+	col   int
+	span  int
+}
+
+type tableRow struct {
+	style *boxStyle
+	cells []*tableCell
+}
+
+// tableColumn has the widths of the content of the cells in the column,
+// the fixed one being -1 if not given
+type tableColumn struct {
+	min, max, fixed float64
+}
+
+// Returns the rows of the table in order and its caption, if any
+func (l *htmlLayout) tableRows(n *html.Node, s *boxStyle) ([]tableRow, *html.Node) {
+	rows := make([]tableRow, 0)
+	var caption *html.Node
+	addRow := func(tr *html.Node, parent *boxStyle) {
+		row := tableRow{style: computeStyle(tr, parent, l.sheet, n)}
+		col := 0
+		for c := tr.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || (c.Data != "td" && c.Data != "th") {
+				continue
+			}
+			span := 1
+			if v, ok := getAttr(c, "colspan"); ok {
+				if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && i > 1 {
+					span = i
+				}
+			}
+			cs := computeStyle(c, row.style, l.sheet, n)
+			if cs.display == "none" {
+				continue
+			}
+			row.cells = append(row.cells, &tableCell{n: c, style: cs, col: col, span: span})
+			col += span
+		}
+		rows = append(rows, row)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.Data {
+		case "caption":
+			caption = c
+		case "tr":
+			addRow(c, s)
+		case "thead", "tbody", "tfoot":
+			gs := computeStyle(c, s, l.sheet, n)
+			for r := c.FirstChild; r != nil; r = r.NextSibling {
+				if r.Type == html.ElementNode && r.Data == "tr" {
+					addRow(r, gs)
+				}
+			}
+		}
+	}
+	return rows, caption
+}
+
+// Returns the columns of the rows, measuring the cells, whose widths in
+// percent are of the containing width
+func (l *htmlLayout) tableColumns(rows []tableRow, containing float64) []tableColumn {
+	cols := make([]tableColumn, 0)
+	for _, row := range rows {
+		for _, c := range row.cells {
+			for len(cols) < c.col+c.span {
+				cols = append(cols, tableColumn{fixed: -1})
+			}
+		}
+	}
+	// Cells spanning columns are measured after the others, widening the
+	// columns if needed
+	for _, spanning := range []bool{false, true} {
+		for _, row := range rows {
+			for _, c := range row.cells {
+				if (c.span > 1) != spanning {
+					continue
+				}
+				edges := c.style.horizontalEdges()
+				min, max := l.measure(c.n, c.style)
+				min, max = min+edges, max+edges
+				fixed := -1.0
+				// Widths in percent are of no width when measuring
+				if w := c.style.contentWidth(containing); w >= 0 {
+					fixed = math.Max(w+edges, min)
+				}
+				if !spanning {
+					col := &cols[c.col]
+					col.min, col.max = math.Max(col.min, min), math.Max(col.max, max)
+					if fixed >= 0 {
+						col.fixed = math.Max(col.fixed, fixed)
+					}
+					continue
+				}
+				spanned := cols[c.col : c.col+c.span]
+				sumMin, sumMax := 0.0, 0.0
+				for _, col := range spanned {
+					sumMin, sumMax = sumMin+col.min, sumMax+col.max
+				}
+				for i := range spanned {
+					if min > sumMin {
+						spanned[i].min += (min - sumMin) / float64(c.span)
+					}
+					if max > sumMax {
+						spanned[i].max += (max - sumMax) / float64(c.span)
+					}
+				}
+			}
+		}
+	}
+	for i := range cols {
+		cols[i].max = math.Max(cols[i].max, cols[i].min)
+	}
+	return cols
+}
+
+// Returns the widths of the columns filling the width, which is the widest
+// of the columns' unless given
+func distributeColumns(cols []tableColumn, width float64, given bool) []float64 {
+	widths := make([]float64, len(cols))
+	sum, sumMax, sumAuto := 0.0, 0.0, 0.0
+	for i, col := range cols {
+		if col.fixed >= 0 {
+			widths[i] = col.fixed
+			sumMax += col.fixed
+		} else {
+			widths[i] = col.min
+			sumMax += col.max
+			sumAuto += col.max
+		}
+		sum += widths[i]
+	}
+	if !given {
+		width = math.Min(width, sumMax)
+	}
+	free := width - sum
+	if free <= 0 {
+		return widths
+	}
+	// Auto columns are widened to their widest first, then all the columns
+	// share what is left in proportion to their widths
+	growable := 0.0
+	for i, col := range cols {
+		if col.fixed < 0 {
+			growable += col.max - widths[i]
+		}
+	}
+	if growable > 0 {
+		ratio := math.Min(1, free/growable)
+		for i, col := range cols {
+			if col.fixed < 0 {
+				grow := (col.max - widths[i]) * ratio
+				widths[i] += grow
+				free -= grow
+			}
+		}
+	}
+	if free > 1e-9 {
+		total, share := 0.0, make([]float64, len(cols))
+		for i, col := range cols {
+			if sumAuto == 0 || col.fixed < 0 {
+				share[i] = math.Max(widths[i], 1)
+				total += share[i]
+			}
+		}
+		for i := range widths {
+			widths[i] += free * share[i] / total
+		}
+	}
+	return widths
+}
+
+// Returns the ops of the slices stacked from the top and their height.
+// Spacers are collapsed and dropped at the ends.
+func stackSlices(slices []layoutSlice) ([]drawOp, float64) {
+	ops := make([]drawOp, 0)
+	y, spacer := 0.0, 0.0
+	for _, sl := range slices {
+		if sl.pageBreak {
+			continue
+		}
+		if sl.spacer && len(sl.ops) == 0 {
+			spacer = math.Max(spacer, sl.height)
+			continue
+		}
+		if y > 0 {
+			y += spacer
+		}
+		spacer = 0
+		for _, op := range sl.ops {
+			ops = append(ops, op.moved(0, y))
+		}
+		y += sl.height
+	}
+	return ops, y
+}
+
+// Lays out the table in the width from x. Each row is a slice, so pages
+// break between rows.
+func (l *htmlLayout) layoutTable(n *html.Node, s *boxStyle, x, width float64) []layoutSlice {
+	rows, caption := l.tableRows(n, s)
+	edges := s.border(sideLeft) + s.border(sideRight) + s.padding[sideLeft] + s.padding[sideRight]
+	available := width - s.margin[sideLeft] - s.margin[sideRight] - edges
+	cols := l.tableColumns(rows, available)
+	given := false
+	if w := s.contentWidth(available); w >= 0 {
+		available, given = w, true
+	}
+	widths := distributeColumns(cols, available, given)
+	contentWidth := 0.0
+	for _, w := range widths {
+		contentWidth += w
+	}
+	boxWidth := contentWidth + edges
+	boxX := x + s.alignBox(width, boxWidth)
+	contentX := boxX + s.border(sideLeft) + s.padding[sideLeft]
+
+	slices := make([]layoutSlice, 0, len(rows)+1)
+	for _, row := range rows {
+		type placed struct {
+			c      *tableCell
+			x, w   float64
+			ops    []drawOp
+			height float64
+		}
+		cells := make([]placed, 0, len(row.cells))
+		height := 0.0
+		for _, c := range row.cells {
+			cx := contentX
+			for _, w := range widths[:c.col] {
+				cx += w
+			}
+			cw := 0.0
+			for _, w := range widths[c.col : c.col+c.span] {
+				cw += w
+			}
+			cs := c.style
+			inner := cw - cs.border(sideLeft) - cs.border(sideRight) - cs.padding[sideLeft] - cs.padding[sideRight]
+			ops, h := stackSlices(l.layoutContent(c.n, cs, cx+cs.border(sideLeft)+cs.padding[sideLeft], inner))
+			cells = append(cells, placed{c: c, x: cx, w: cw, ops: ops, height: h})
+			height = math.Max(height, h+cs.border(sideTop)+cs.padding[sideTop]+cs.padding[sideBottom]+cs.border(sideBottom))
+		}
+		sl := layoutSlice{height: height}
+		if row.style.background != nil {
+			sl.ops = append(sl.ops, drawOp{kind: opRect, x: contentX, y: 0, w: contentWidth, h: height, color: *row.style.background})
+		}
+		for _, p := range cells {
+			cs := p.c.style
+			if cs.background != nil {
+				sl.ops = append(sl.ops, drawOp{kind: opRect, x: p.x, y: 0, w: p.w, h: height, color: *cs.background})
+			}
+			top := cs.border(sideTop) + cs.padding[sideTop]
+			free := height - top - p.height - cs.padding[sideBottom] - cs.border(sideBottom)
+			switch cs.verticalAlign {
+			case "top", "baseline":
+			case "bottom":
+				top += free
+			default:
+				top += free / 2
+			}
+			for _, op := range p.ops {
+				sl.ops = append(sl.ops, op.moved(0, top))
+			}
+		}
+		// Borders are drawn over the backgrounds of the cells next to them
+		for _, p := range cells {
+			cs := p.c.style
+			if b := cs.border(sideTop); b > 0 {
+				sl.ops = append(sl.ops, drawOp{kind: opLine, x: p.x, y: b / 2, x2: p.x + p.w, y2: b / 2, lineWidth: b, color: cs.borderColorOf(sideTop)})
+			}
+			if b := cs.border(sideBottom); b > 0 {
+				sl.ops = append(sl.ops, drawOp{kind: opLine, x: p.x, y: height - b/2, x2: p.x + p.w, y2: height - b/2, lineWidth: b, color: cs.borderColorOf(sideBottom)})
+			}
+			if b := cs.border(sideLeft); b > 0 {
+				sl.ops = append(sl.ops, drawOp{kind: opLine, x: p.x + b/2, y: 0, x2: p.x + b/2, y2: height, lineWidth: b, color: cs.borderColorOf(sideLeft)})
+			}
+			if b := cs.border(sideRight); b > 0 {
+				sl.ops = append(sl.ops, drawOp{kind: opLine, x: p.x + p.w - b/2, y: 0, x2: p.x + p.w - b/2, y2: height, lineWidth: b, color: cs.borderColorOf(sideRight)})
+			}
+		}
+		slices = append(slices, sl)
+	}
+
+	// The caption is put above the box of the table, on the same page as
+	// the table if it starts on a new one
+	if caption == nil {
+		return l.decorate(slices, s, boxX, boxWidth)
+	}
+	table := *s
+	table.breakBefore = false
+	captioned := make([]layoutSlice, 0)
+	if s.breakBefore {
+		captioned = append(captioned, layoutSlice{pageBreak: true})
+	}
+	cs := computeStyle(caption, s, l.sheet, nil)
+	captioned = append(captioned, l.layoutBlock(caption, cs, boxX, boxWidth, 0)...)
+	return append(captioned, l.decorate(slices, &table, boxX, boxWidth)...)
+}
+
+// Returns the narrowest and the widest widths of the content of the
+// element, which are of its longest word and its longest line
+func (l *htmlLayout) measure(n *html.Node, s *boxStyle) (float64, float64) {
+	if s.display == "table" {
+		rows, _ := l.tableRows(n, s)
+		min, max := 0.0, 0.0
+		for _, col := range l.tableColumns(rows, -1) {
+			if col.fixed >= 0 {
+				min, max = min+col.fixed, max+col.fixed
+				continue
+			}
+			min, max = min+col.min, max+col.max
+		}
+		return min, max
+	}
+	min, max := 0.0, 0.0
+	items := make([]inlineItem, 0)
+	flush := func() {
+		line := 0.0
+		for _, a := range l.inlineAtoms(items) {
+			if a.br {
+				line = 0
+				continue
+			}
+			if !a.space {
+				min = math.Max(min, a.width)
+			}
+			line += a.width
+			max = math.Max(max, line)
+		}
+		items = items[:0]
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			cs := computeStyle(c, s, l.sheet, nil)
+			if isBlockLevel(cs) {
+				flush()
+				cmin, cmax := l.measure(c, cs)
+				if cs.width >= 0 {
+					cmin, cmax = math.Max(cmin, cs.width), cs.width
+				}
+				edges := cs.horizontalEdges()
+				min, max = math.Max(min, cmin+edges), math.Max(max, math.Max(cmin, cmax)+edges)
+				continue
+			}
+		}
+		l.collectInline(c, s, &items)
+	}
+	flush()
+	return min, max
+}
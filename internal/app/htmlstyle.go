@@ -0,0 +1,749 @@
+package app
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Styles of local templates. A subset of CSS is supported: style attributes
+// and <style> elements with selectors of elements, classes and IDs, which
+// may be of descendants, and the properties of text, boxes and tables
+// laid out by htmllayout.go.
+
+type pdfColor struct {
+	r, g, b float64
+}
+
+// boxStyle is the computed style of an element
+type boxStyle struct {
+	// Inherited
+	fontSize   float64
+	bold       bool
+	italic     bool
+	underline  bool
+	color      pdfColor
+	textAlign  string
+	lineHeight float64
+	pre        bool
+	listStyle  string
+
+	display       string
+	margin        [4]float64
+	autoMargin    [4]bool
+	padding       [4]float64
+	borderWidth   [4]float64
+	borderStyle   [4]string
+	borderColor   [4]*pdfColor
+	background    *pdfColor
+	width         float64
+	widthPercent  float64
+	verticalAlign string
+	breakBefore   bool
+}
+
+// Sides of margins, paddings and borders in the order of CSS
+const (
+	sideTop = iota
+	sideRight
+	sideBottom
+	sideLeft
+)
+
+// Returns the width of the border of the side, which is 0 without a style
+func (s *boxStyle) border(side int) float64 {
+	switch s.borderStyle[side] {
+	case "", "none", "hidden":
+		return 0
+	}
+	return s.borderWidth[side]
+}
+
+func (s *boxStyle) borderColorOf(side int) pdfColor {
+	if c := s.borderColor[side]; c != nil {
+		return *c
+	}
+	return s.color
+}
+
+// Returns the horizontal margins, borders and paddings
+func (s *boxStyle) horizontalEdges() float64 {
+	return s.margin[sideLeft] + s.margin[sideRight] + s.border(sideLeft) + s.border(sideRight) + s.padding[sideLeft] + s.padding[sideRight]
+}
+
+func newRootStyle() *boxStyle {
+	return &boxStyle{
+		fontSize:   localPDFFontSize,
+		textAlign:  "left",
+		lineHeight: 1.4,
+		listStyle:  "disc",
+		display:    "block",
+		// No width is given
+		width:        -1,
+		widthPercent: -1,
+	}
+}
+
+// Returns the style of the child element inheriting the style
+func (s *boxStyle) inherit() *boxStyle {
+	return &boxStyle{
+		fontSize:      s.fontSize,
+		bold:          s.bold,
+		italic:        s.italic,
+		underline:     s.underline,
+		color:         s.color,
+		textAlign:     s.textAlign,
+		lineHeight:    s.lineHeight,
+		pre:           s.pre,
+		listStyle:     s.listStyle,
+		display:       "inline",
+		widthPercent:  -1,
+		width:         -1,
+		verticalAlign: "middle",
+	}
+}
+
+var blockElements = map[string]bool{
+	"html": true, "body": true, "div": true, "p": true, "section": true, "article": true,
+	"header": true, "footer": true, "main": true, "nav": true, "aside": true, "address": true,
+	"blockquote": true, "center": true, "pre": true, "hr": true, "ul": true, "ol": true,
+	"dl": true, "dt": true, "dd": true, "figure": true, "figcaption": true, "caption": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+var hiddenElements = map[string]bool{
+	"head": true, "title": true, "style": true, "script": true, "meta": true, "link": true,
+	"template": true, "img": true,
+}
+
+// Applies the style of the browsers to the element
+func (s *boxStyle) applyDefaults(tag string) {
+	em := s.fontSize
+	switch {
+	case hiddenElements[tag]:
+		s.display = "none"
+	case blockElements[tag]:
+		s.display = "block"
+	case tag == "li":
+		s.display = "list-item"
+	case tag == "table":
+		s.display = "table"
+	case tag == "tr":
+		s.display = "table-row"
+	case tag == "td" || tag == "th":
+		s.display = "table-cell"
+	case tag == "thead" || tag == "tbody" || tag == "tfoot":
+		s.display = "table-row-group"
+	}
+	switch tag {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		scale := map[string]float64{"h1": 2, "h2": 1.5, "h3": 1.17, "h4": 1, "h5": 0.83, "h6": 0.67}[tag]
+		margin := map[string]float64{"h1": 0.67, "h2": 0.83, "h3": 1, "h4": 1.33, "h5": 1.67, "h6": 2.33}[tag]
+		s.fontSize = em * scale
+		s.bold = true
+		s.margin[sideTop], s.margin[sideBottom] = margin*s.fontSize, margin*s.fontSize
+	case "p", "dl", "pre", "figure":
+		s.margin[sideTop], s.margin[sideBottom] = em, em
+	case "blockquote":
+		s.margin = [4]float64{em, 30, em, 30}
+	case "ul", "ol":
+		s.margin[sideTop], s.margin[sideBottom] = em, em
+		s.padding[sideLeft] = 30
+		if tag == "ol" {
+			s.listStyle = "decimal"
+		} else {
+			s.listStyle = "disc"
+		}
+	case "dd":
+		s.margin[sideLeft] = 30
+	case "b", "strong", "th", "dt":
+		s.bold = true
+	case "i", "em", "cite", "var", "address":
+		s.italic = true
+	case "u", "ins":
+		s.underline = true
+	case "small":
+		s.fontSize = em * 0.83
+	case "big":
+		s.fontSize = em * 1.2
+	case "center":
+		s.textAlign = "center"
+	case "hr":
+		s.margin[sideTop], s.margin[sideBottom] = em/2, em/2
+		s.borderStyle[sideTop], s.borderWidth[sideTop] = "solid", 0.75
+		s.borderColor[sideTop] = &pdfColor{0.5, 0.5, 0.5}
+	case "caption":
+		s.textAlign = "center"
+	}
+	if tag == "th" {
+		s.textAlign = "center"
+	}
+	if tag == "td" || tag == "th" {
+		s.padding = [4]float64{0.75, 0.75, 0.75, 0.75}
+	}
+	if tag == "pre" {
+		s.pre = true
+	}
+}
+
+func getAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// Applies the attributes of HTML giving styles, like align and width. The
+// table is the one of cells and rows, if any.
+func (s *boxStyle) applyAttributes(n *html.Node, table *html.Node) {
+	if v, ok := getAttr(n, "align"); ok {
+		v = strings.ToLower(v)
+		if n.Data == "table" {
+			switch v {
+			case "center":
+				s.autoMargin[sideLeft], s.autoMargin[sideRight] = true, true
+			case "right":
+				s.autoMargin[sideLeft] = true
+			}
+		} else {
+			s.textAlign = v
+		}
+	}
+	if v, ok := getAttr(n, "valign"); ok {
+		s.verticalAlign = strings.ToLower(v)
+	}
+	if v, ok := getAttr(n, "bgcolor"); ok {
+		if c, ok := parseColor(v); ok {
+			s.background = &c
+		}
+	}
+	if v, ok := getAttr(n, "width"); ok && (n.Data == "table" || n.Data == "td" || n.Data == "th") {
+		s.setWidth(strings.TrimSpace(v), "px")
+	}
+	if table == nil {
+		if n.Data == "table" {
+			if v, ok := getAttr(n, "border"); ok {
+				w := 1.0
+				if b, err := strconv.ParseFloat(v, 64); err == nil {
+					w = b
+				}
+				for i := range s.borderWidth {
+					s.borderWidth[i], s.borderStyle[i] = w*0.75, "solid"
+				}
+			}
+		}
+		return
+	}
+	if n.Data == "td" || n.Data == "th" {
+		if v, ok := getAttr(table, "border"); ok && v != "0" {
+			for i := range s.borderWidth {
+				s.borderWidth[i], s.borderStyle[i] = 0.75, "solid"
+			}
+		}
+		if v, ok := getAttr(table, "cellpadding"); ok {
+			if p, err := strconv.ParseFloat(v, 64); err == nil {
+				s.padding = [4]float64{p * 0.75, p * 0.75, p * 0.75, p * 0.75}
+			}
+		}
+	}
+}
+
+// Sets the width of a length, whose unit is the default one if none
+func (s *boxStyle) setWidth(v, unit string) {
+	if strings.HasSuffix(v, "%") {
+		if p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64); err == nil {
+			s.width, s.widthPercent = -1, p
+		}
+		return
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		v += unit
+	}
+	if l, ok := parseLength(v, s.fontSize); ok {
+		s.width, s.widthPercent = l, -1
+	}
+}
+
+// Returns the length in points of the CSS length, like "12px" or "1.5em"
+func parseLength(v string, fontSize float64) (float64, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "0" {
+		return 0, true
+	}
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"px", 0.75}, {"pt", 1}, {"mm", 72 / 25.4}, {"cm", 72 / 2.54}, {"in", 72},
+		{"rem", localPDFFontSize}, {"em", fontSize}, {"%", fontSize / 100},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(v, u.suffix), 64)
+			if err != nil {
+				return 0, false
+			}
+			return f * u.scale, true
+		}
+	}
+	switch v {
+	case "thin":
+		return 0.75, true
+	case "medium":
+		return 2.25, true
+	case "thick":
+		return 3.75, true
+	}
+	return 0, false
+}
+
+var colorNames = map[string]pdfColor{
+	"black": {0, 0, 0}, "white": {1, 1, 1}, "gray": {0.5, 0.5, 0.5}, "grey": {0.5, 0.5, 0.5},
+	"silver": {0.75, 0.75, 0.75}, "lightgray": {0.83, 0.83, 0.83}, "lightgrey": {0.83, 0.83, 0.83},
+	"darkgray": {0.66, 0.66, 0.66}, "red": {1, 0, 0}, "maroon": {0.5, 0, 0}, "green": {0, 0.5, 0},
+	"blue": {0, 0, 1}, "navy": {0, 0, 0.5}, "yellow": {1, 1, 0}, "orange": {1, 0.65, 0},
+	"purple": {0.5, 0, 0.5}, "teal": {0, 0.5, 0.5},
+}
+
+// Returns the color of "#rgb", "#rrggbb", "rgb(r, g, b)" or a name
+func parseColor(v string) (pdfColor, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if c, ok := colorNames[v]; ok {
+		return c, true
+	}
+	if strings.HasPrefix(v, "#") {
+		h := v[1:]
+		if len(h) == 3 {
+			h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+		}
+		if len(h) != 6 {
+			return pdfColor{}, false
+		}
+		n, err := strconv.ParseUint(h, 16, 32)
+		if err != nil {
+			return pdfColor{}, false
+		}
+		return pdfColor{float64(n>>16) / 255, float64(n>>8&0xff) / 255, float64(n&0xff) / 255}, true
+	}
+	if strings.HasPrefix(v, "rgb(") && strings.HasSuffix(v, ")") {
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(v, "rgb("), ")"), ",")
+		if len(parts) != 3 {
+			return pdfColor{}, false
+		}
+		var c [3]float64
+		for i, p := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return pdfColor{}, false
+			}
+			c[i] = f / 255
+		}
+		return pdfColor{c[0], c[1], c[2]}, true
+	}
+	return pdfColor{}, false
+}
+
+// Returns the values of the sides of a shorthand like margin, which has one
+// to four values
+func expandSides(values []string) [4]string {
+	switch len(values) {
+	case 1:
+		return [4]string{values[0], values[0], values[0], values[0]}
+	case 2:
+		return [4]string{values[0], values[1], values[0], values[1]}
+	case 3:
+		return [4]string{values[0], values[1], values[2], values[1]}
+	}
+	return [4]string{values[0], values[1], values[2], values[3]}
+}
+
+var sideNames = []string{"top", "right", "bottom", "left"}
+
+// Applies the declaration of the property. The parent is the style of the
+// parent element, which relative font sizes are of.
+func (s *boxStyle) apply(prop, value string, parent *boxStyle) {
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+	lower := strings.ToLower(value)
+	fields := strings.Fields(lower)
+	if len(fields) == 0 {
+		return
+	}
+	switch prop {
+	case "font-size":
+		sizes := map[string]float64{"xx-small": 0.6, "x-small": 0.75, "small": 0.89, "medium": 1, "large": 1.2, "x-large": 1.5, "xx-large": 2}
+		if f, ok := sizes[lower]; ok {
+			s.fontSize = localPDFFontSize * f
+		} else if lower == "smaller" {
+			s.fontSize = parent.fontSize * 0.83
+		} else if lower == "larger" {
+			s.fontSize = parent.fontSize * 1.2
+		} else if l, ok := parseLength(lower, parent.fontSize); ok {
+			s.fontSize = l
+		}
+	case "font-weight":
+		if n, err := strconv.Atoi(lower); err == nil {
+			s.bold = n >= 600
+		} else {
+			s.bold = lower == "bold" || lower == "bolder"
+		}
+	case "font-style":
+		s.italic = lower == "italic" || lower == "oblique"
+	case "text-decoration", "text-decoration-line":
+		s.underline = strings.Contains(lower, "underline")
+	case "color":
+		if c, ok := parseColor(lower); ok {
+			s.color = c
+		}
+	case "background", "background-color":
+		for _, f := range fields {
+			if c, ok := parseColor(f); ok {
+				s.background = &c
+			} else if f == "none" || f == "transparent" {
+				s.background = nil
+			}
+		}
+	case "text-align":
+		switch lower {
+		case "right", "end":
+			s.textAlign = "right"
+		case "center":
+			s.textAlign = "center"
+		default:
+			s.textAlign = "left"
+		}
+	case "line-height":
+		if lower == "normal" {
+			s.lineHeight = 1.2
+		} else if f, err := strconv.ParseFloat(lower, 64); err == nil {
+			s.lineHeight = f
+		} else if l, ok := parseLength(lower, s.fontSize); ok && s.fontSize > 0 {
+			s.lineHeight = l / s.fontSize
+		}
+	case "white-space":
+		s.pre = strings.HasPrefix(lower, "pre")
+	case "display":
+		switch lower {
+		case "none", "block", "inline", "list-item", "table", "table-row", "table-cell", "table-row-group":
+			s.display = lower
+		case "inline-block", "inline-flex":
+			s.display = "inline"
+		case "flex", "grid":
+			s.display = "block"
+		}
+	case "list-style", "list-style-type":
+		for _, f := range fields {
+			switch f {
+			case "none", "disc", "circle", "square", "decimal":
+				s.listStyle = f
+			}
+		}
+	case "width":
+		if lower != "auto" {
+			s.setWidth(lower, "")
+		}
+	case "vertical-align":
+		s.verticalAlign = lower
+	case "page-break-before", "break-before":
+		s.breakBefore = lower == "always" || lower == "page"
+	case "margin", "padding":
+		for i, v := range expandSides(fields) {
+			s.applySide(prop, i, v)
+		}
+	case "border", "border-top", "border-right", "border-bottom", "border-left":
+		for i := range sideNames {
+			if prop == "border" || prop == "border-"+sideNames[i] {
+				s.applyBorder(i, fields)
+			}
+		}
+	case "border-width", "border-style", "border-color":
+		for i, v := range expandSides(fields) {
+			s.applySide(prop, i, v)
+		}
+	default:
+		for i, side := range sideNames {
+			for _, p := range []string{"margin", "padding", "border-width", "border-style", "border-color"} {
+				name := p + "-" + side
+				if strings.HasPrefix(p, "border-") {
+					name = "border-" + side + strings.TrimPrefix(p, "border")
+				}
+				if prop == name {
+					s.applySide(p, i, lower)
+				}
+			}
+		}
+	}
+}
+
+func (s *boxStyle) applySide(prop string, side int, v string) {
+	switch prop {
+	case "margin":
+		if v == "auto" {
+			s.autoMargin[side], s.margin[side] = true, 0
+		} else if l, ok := parseLength(v, s.fontSize); ok {
+			s.autoMargin[side], s.margin[side] = false, l
+		}
+	case "padding":
+		if l, ok := parseLength(v, s.fontSize); ok && l >= 0 {
+			s.padding[side] = l
+		}
+	case "border-width":
+		if l, ok := parseLength(v, s.fontSize); ok && l >= 0 {
+			s.borderWidth[side] = l
+		}
+	case "border-style":
+		s.borderStyle[side] = v
+		if s.borderWidth[side] == 0 {
+			s.borderWidth[side] = 2.25
+		}
+	case "border-color":
+		if c, ok := parseColor(v); ok {
+			s.borderColor[side] = &c
+		}
+	}
+}
+
+// Applies the values of a border shorthand, like "1px solid #000", to the
+// side
+func (s *boxStyle) applyBorder(side int, values []string) {
+	s.borderWidth[side], s.borderStyle[side], s.borderColor[side] = 2.25, "none", nil
+	for _, v := range values {
+		if l, ok := parseLength(v, s.fontSize); ok {
+			s.borderWidth[side] = l
+		} else if c, ok := parseColor(v); ok {
+			s.borderColor[side] = &c
+		} else {
+			s.borderStyle[side] = v
+		}
+	}
+}
+
+// Returns the declarations of a style attribute or a rule as pairs of the
+// property and the value
+func parseDeclarations(text string) [][2]string {
+	decls := make([][2]string, 0)
+	for _, d := range strings.Split(text, ";") {
+		i := strings.Index(d, ":")
+		if i < 0 {
+			continue
+		}
+		prop := strings.ToLower(strings.TrimSpace(d[:i]))
+		if prop != "" {
+			decls = append(decls, [2]string{prop, d[i+1:]})
+		}
+	}
+	return decls
+}
+
+// cssSelector is a compound selector like "td.amount", with the ones of the
+// ancestors for descendant selectors
+type cssSelector struct {
+	tag       string
+	id        string
+	classes   []string
+	ancestors []*cssSelector
+}
+
+type cssRule struct {
+	selector    *cssSelector
+	specificity int
+	order       int
+	decls       [][2]string
+}
+
+type styleSheet struct {
+	rules []*cssRule
+}
+
+// Returns the compound selector, or nil if it has what is not supported,
+// like attributes and pseudo classes
+func parseCompoundSelector(text string) *cssSelector {
+	sel := &cssSelector{}
+	for text != "" {
+		end := strings.IndexAny(text[1:], ".#")
+		part := text
+		if end >= 0 {
+			part, text = text[:end+1], text[end+1:]
+		} else {
+			text = ""
+		}
+		switch {
+		case strings.HasPrefix(part, "."):
+			sel.classes = append(sel.classes, part[1:])
+		case strings.HasPrefix(part, "#"):
+			sel.id = part[1:]
+		case part == "*":
+		default:
+			sel.tag = strings.ToLower(part)
+		}
+		if strings.ContainsAny(part, ":[>+~()") {
+			return nil
+		}
+	}
+	return sel
+}
+
+func (sel *cssSelector) specificity() int {
+	n := len(sel.classes) * 10
+	if sel.id != "" {
+		n += 100
+	}
+	if sel.tag != "" {
+		n++
+	}
+	for _, a := range sel.ancestors {
+		n += a.specificity()
+	}
+	return n
+}
+
+func (sel *cssSelector) matchesElement(n *html.Node) bool {
+	if sel.tag != "" && sel.tag != n.Data {
+		return false
+	}
+	if sel.id != "" {
+		if id, _ := getAttr(n, "id"); id != sel.id {
+			return false
+		}
+	}
+	if len(sel.classes) > 0 {
+		v, _ := getAttr(n, "class")
+		classes := strings.Fields(v)
+		for _, c := range sel.classes {
+			found := false
+			for _, have := range classes {
+				if have == c {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (sel *cssSelector) matches(n *html.Node) bool {
+	if !sel.matchesElement(n) {
+		return false
+	}
+	// Ancestors are matched from the nearest one
+	a := n.Parent
+	for i := len(sel.ancestors) - 1; i >= 0; i-- {
+		for a != nil && (a.Type != html.ElementNode || !sel.ancestors[i].matchesElement(a)) {
+			a = a.Parent
+		}
+		if a == nil {
+			return false
+		}
+		a = a.Parent
+	}
+	return true
+}
+
+// Parses the style sheet, skipping at-rules like @media and the rules of
+// selectors not supported
+func parseStyleSheet(text string, sheet *styleSheet) {
+	for {
+		start := strings.Index(text, "/*")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start+2:], "*/")
+		if end < 0 {
+			text = text[:start]
+			break
+		}
+		text = text[:start] + text[start+2+end+2:]
+	}
+	for {
+		open := strings.Index(text, "{")
+		if open < 0 {
+			return
+		}
+		prelude := strings.TrimSpace(text[:open])
+		// Blocks of at-rules may have blocks in them
+		depth, end := 0, -1
+		for i := open; i < len(text); i++ {
+			if text[i] == '{' {
+				depth++
+			} else if text[i] == '}' {
+				depth--
+				if depth == 0 {
+					end = i
+					break
+				}
+			}
+		}
+		if end < 0 {
+			return
+		}
+		body := text[open+1 : end]
+		text = text[end+1:]
+		if strings.HasPrefix(prelude, "@") {
+			continue
+		}
+		decls := parseDeclarations(body)
+		for _, s := range strings.Split(prelude, ",") {
+			parts := strings.Fields(s)
+			if len(parts) == 0 {
+				continue
+			}
+			compounds := make([]*cssSelector, 0, len(parts))
+			for _, p := range parts {
+				if c := parseCompoundSelector(p); c != nil {
+					compounds = append(compounds, c)
+				}
+			}
+			if len(compounds) != len(parts) {
+				continue
+			}
+			sel := compounds[len(compounds)-1]
+			sel.ancestors = compounds[:len(compounds)-1]
+			sheet.rules = append(sheet.rules, &cssRule{selector: sel, specificity: sel.specificity(), order: len(sheet.rules), decls: decls})
+		}
+	}
+}
+
+// Returns the declarations of the rules matching the element, in the order
+// to be applied
+func (sheet *styleSheet) declarations(n *html.Node) [][2]string {
+	matched := make([]*cssRule, 0)
+	for _, r := range sheet.rules {
+		if r.selector.matches(n) {
+			matched = append(matched, r)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].specificity != matched[j].specificity {
+			return matched[i].specificity < matched[j].specificity
+		}
+		return matched[i].order < matched[j].order
+	})
+	decls := make([][2]string, 0)
+	for _, r := range matched {
+		decls = append(decls, r.decls...)
+	}
+	return decls
+}
+
+// Returns the style of the element, whose parent has the style. The table
+// is the one of cells and rows, if any.
+func computeStyle(n *html.Node, parent *boxStyle, sheet *styleSheet, table *html.Node) *boxStyle {
+	s := parent.inherit()
+	s.applyDefaults(n.Data)
+	s.applyAttributes(n, table)
+	for _, d := range sheet.declarations(n) {
+		s.apply(d[0], d[1], parent)
+	}
+	if v, ok := getAttr(n, "style"); ok {
+		for _, d := range parseDeclarations(v) {
+			s.apply(d[0], d[1], parent)
+		}
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Messages shown to people, by locale. Logs meant to be parsed, like the
+// JSON summary and the error report, are not translated.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// Messages of the locale in use, falling back to the English ones
+var (
+	messages        map[string]string
+	defaultMessages = mustLoadMessages("en")
+)
+
+func mustLoadMessages(locale string) map[string]string {
+	d, err := localeFiles.ReadFile("locales/" + locale + ".json")
+	if err != nil {
+		panic(err)
+	}
+	m := make(map[string]string)
+	if err := json.Unmarshal(d, &m); err != nil {
+		panic(fmt.Sprintf("locales/%s.json: %v", locale, err))
+	}
+	return m
+}
+
+// Returns whether the locale has messages
+func isKnownLocale(locale string) bool {
+	_, err := localeFiles.ReadFile("locales/" + locale + ".json")
+	return err == nil
+}
+
+// Sets the locale of the messages. Without one in the config, it is taken
+// from the environment like LANG=ja_JP.UTF-8, and is English otherwise.
+func setLocale(locale string) {
+	if locale == "" {
+		locale = detectLocale()
+	}
+	messages = mustLoadMessages(locale)
+}
+
+func detectLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		if lang := strings.ToLower(strings.SplitN(strings.SplitN(v, ".", 2)[0], "_", 2)[0]); isKnownLocale(lang) {
+			return lang
+		}
+		return "en"
+	}
+	return "en"
+}
+
+// Returns the message of the key formatted with v
+func msg(key string, v ...interface{}) string {
+	format, ok := messages[key]
+	if !ok {
+		format = defaultMessages[key]
+	}
+	if len(v) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, v...)
+}
+
+// Returns the month like "May 2024", or "2024年5月" in Japanese
+func formatLocalMonth(t time.Time) string {
+	return t.Format(msg("month_format"))
+}
@@ -0,0 +1,267 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+)
+
+// App property marking generated documents, so that re-runs replace them
+const driveDocumentProperty = "make-invoices-document"
+
+// Returns the values of the placeholders in the templates like
+// {{billing_month}}, shared by the documents of the spreadsheet. The
+// amounts are left out if the spreadsheet is not billed. Values of data
+// are added for the keys having no computed values.
+func getInvoicePlaceholders(targetTime time.Time, period billingPeriod, rows []dayRow, invoiceNumber string, amount *billingAmount, dates *invoiceDates, client *ClientConfig, data map[string]string, breaks *breakPolicy, revision *invoiceRevision) (map[string]string, error) {
+	hours, err := sumWorkHours(rows, breaks)
+	if err != nil {
+		return nil, err
+	}
+	placeholders := map[string]string{
+		"billing_month":  fmt.Sprintf("%d年%d月", targetTime.Year(), targetTime.Month()),
+		"work_days":      countWorkDays(rows),
+		"total_hours":    hours,
+		"invoice_number": invoiceNumber,
+		"issue_date":     dates.issue.Format(dates.format),
+		"period_start":   period.start.Format(dates.format),
+		"period_end":     period.end.AddDate(0, 0, -1).Format(dates.format),
+	}
+	if !dates.due.IsZero() {
+		placeholders["due_date"] = dates.due.Format(dates.format)
+	}
+	if amount != nil {
+		cur := amount.Currency
+		placeholders["currency"] = cur.code
+		placeholders["rate"] = cur.format(amount.Rate)
+		placeholders["billable_quantity"] = amount.Quantity
+		placeholders["subtotal"] = cur.format(amount.Subtotal)
+		placeholders["tax"] = cur.format(amount.Tax)
+		placeholders["withholding"] = cur.format(amount.Withholding)
+		placeholders["total"] = cur.format(amount.Total)
+		placeholders["amount"] = cur.format(amount.Total)
+	}
+	for k, v := range getRevisionPlaceholders(revision) {
+		placeholders[k] = v
+	}
+	for k, v := range getClientPlaceholders(client) {
+		placeholders[k] = v
+	}
+	for k, v := range data {
+		if _, ok := placeholders[k]; !ok {
+			placeholders[k] = v
+		}
+	}
+	return placeholders, nil
+}
+
+func logInvoicePlaceholders(logger *log.Logger, placeholders map[string]string) {
+	keys := make([]string, 0, len(placeholders))
+	for k := range placeholders {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		logger.Printf("  {{%s}} -> %q\n", k, placeholders[k])
+	}
+}
+
+var placeholderPattern = regexp.MustCompile(`\{\{([^{}]+)\}\}`)
+
+// Returns the placeholders found in the text of the template, including
+// its headers, footers and footnotes
+func getTemplatePlaceholders(dcs *docs.Service, templateID string) ([]string, error) {
+	var doc *docs.Document
+	if err := callAPI("get document template", func(ctx context.Context) (err error) {
+		doc, err = dcs.Documents.Get(templateID).Context(ctx).Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get document template %s: %v", templateID, err)
+	}
+	var b strings.Builder
+	var walk func(content []*docs.StructuralElement)
+	walk = func(content []*docs.StructuralElement) {
+		for _, e := range content {
+			switch {
+			case e.Paragraph != nil:
+				// A placeholder may be split into runs of different styles
+				for _, pe := range e.Paragraph.Elements {
+					if pe.TextRun != nil {
+						b.WriteString(pe.TextRun.Content)
+					}
+				}
+				b.WriteString("\n")
+			case e.Table != nil:
+				for _, row := range e.Table.TableRows {
+					for _, cell := range row.TableCells {
+						walk(cell.Content)
+					}
+				}
+			case e.TableOfContents != nil:
+				walk(e.TableOfContents.Content)
+			}
+		}
+	}
+	if doc.Body != nil {
+		walk(doc.Body.Content)
+	}
+	for _, h := range doc.Headers {
+		walk(h.Content)
+	}
+	for _, f := range doc.Footers {
+		walk(f.Content)
+	}
+	for _, f := range doc.Footnotes {
+		walk(f.Content)
+	}
+	found := make(map[string]bool)
+	names := make([]string, 0)
+	for _, m := range placeholderPattern.FindAllStringSubmatch(b.String(), -1) {
+		if !found[m[1]] {
+			found[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names, nil
+}
+
+// Fails if the template has placeholders without values, since replacing
+// them would leave them in the document silently. The ones of known are told
+// apart from unknown ones by the settings they need, as lint-template does.
+func checkTemplatePlaceholders(dcs *docs.Service, dc *InvoiceDocumentConfig, placeholders map[string]string, known map[string]string) error {
+	names, err := getTemplatePlaceholders(dcs, dc.TemplateID)
+	if err != nil {
+		return err
+	}
+	missing := make([]string, 0)
+	for _, n := range names {
+		if _, ok := placeholders[n]; !ok && n != workTablePlaceholder && n != workReportPlaceholder {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) > 0 {
+		l := lintTemplatePlaceholders(missing, known)
+		return fmt.Errorf("template of document %s has placeholders without values: %s", dc.Key, strings.Join(append(l.unknown, l.unset...), ", "))
+	}
+	return nil
+}
+
+// Makes the document of the month by copying the template and replacing
+// the placeholders and the work table. A document made by a previous run
+// for the month is trashed. Returns the new document.
+func createInvoiceDocument(drv *drive.Service, dcs *docs.Service, spreadsheetID, title string, targetTime time.Time, revision int, placeholders map[string]string, workTable [][]string, report []workReportEntry, dc *InvoiceDocumentConfig, logger *log.Logger) (*drive.File, error) {
+	name, err := export.FormatNameTemplate("document name", dc.NameTemplate(), targetTime, title, placeholders["invoice_number"])
+	if err != nil {
+		return nil, err
+	}
+	name += revisionSuffix(revision)
+	// Documents other than the invoice are told apart by their keys, and
+	// revisions by their numbers
+	month := revisionKey(targetTime.Format("200601"), revision)
+	if dc.Key != defaultDocumentKey {
+		month += "/" + dc.Key
+	}
+
+	var list *drive.FileList
+	if err := callAPI("find document", func(ctx context.Context) (err error) {
+		list, err = drv.Files.List().
+			Q(fmt.Sprintf("appProperties has { key='%s' and value='%s' } and appProperties has { key='%s' and value='%s' } and trashed = false",
+				driveDocumentProperty, escapeDriveQuery(month), driveSpreadsheetProperty, escapeDriveQuery(spreadsheetID))).
+			Corpora("allDrives").
+			SupportsAllDrives(true).
+			IncludeItemsFromAllDrives(true).
+			Fields("files(id)").
+			Context(ctx).
+			Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to find document %s: %v", dc.Key, err)
+	}
+	for _, f := range list.Files {
+		if err := callAPI("trash document", func(ctx context.Context) error {
+			_, err := drv.Files.Update(f.Id, &drive.File{Trashed: true}).SupportsAllDrives(true).Context(ctx).Do()
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to trash previous document %s: %v", dc.Key, err)
+		}
+		logger.Printf("Trashed previous %s document %s\n", dc.Key, f.Id)
+	}
+
+	file := &drive.File{
+		Name: name,
+		AppProperties: map[string]string{
+			driveDocumentProperty:    month,
+			driveSpreadsheetProperty: spreadsheetID,
+		},
+	}
+	if dc.FolderID != "" {
+		file.Parents = []string{dc.FolderID}
+	}
+	var doc *drive.File
+	if err := callAPI("copy document template", func(ctx context.Context) (err error) {
+		doc, err = drv.Files.Copy(dc.TemplateID, file).
+			SupportsAllDrives(true).
+			Fields("id", "name", "webViewLink").
+			Context(ctx).
+			Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to copy template of document %s: %v", dc.Key, describeDriveError(err, "template "+dc.TemplateID))
+	}
+
+	if dc.Report {
+		if err := fillWorkReport(dcs, doc.Id, report); err != nil {
+			return nil, fmt.Errorf("failed to fill document %s: %v", dc.Key, err)
+		}
+	} else if err := fillWorkTable(dcs, doc.Id, workTable); err != nil {
+		return nil, fmt.Errorf("failed to fill work table of document %s: %v", dc.Key, err)
+	}
+
+	keys := make([]string, 0, len(placeholders))
+	for k := range placeholders {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	requests := make([]*docs.Request, 0, len(keys))
+	for _, k := range keys {
+		requests = append(requests, &docs.Request{
+			ReplaceAllText: &docs.ReplaceAllTextRequest{
+				ContainsText: &docs.SubstringMatchCriteria{
+					Text:      "{{" + k + "}}",
+					MatchCase: true,
+				},
+				ReplaceText:     placeholders[k],
+				ForceSendFields: []string{"ReplaceText"},
+			},
+		})
+	}
+	if err := callAPI("fill document", func(ctx context.Context) error {
+		_, err := dcs.Documents.BatchUpdate(doc.Id, &docs.BatchUpdateDocumentRequest{
+			Requests: requests,
+		}).Context(ctx).Do()
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to fill document %s: %v", dc.Key, err)
+	}
+	return doc, nil
+}
+
+// Exports the document to a pdf
+func exportDocumentPDF(drv *drive.Service, docID, fileName string, logger *log.Logger) error {
+	return download(func(ctx context.Context, header http.Header) (*http.Response, error) {
+		call := drv.Files.Export(docID, "application/pdf").Context(ctx)
+		for k := range header {
+			call.Header().Set(k, header.Get(k))
+		}
+		return call.Download()
+	}, export.Formats["pdf"], fileName, logger)
+}
@@ -0,0 +1,233 @@
+package app
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const defaultInvoiceNumberFormat = `{{.Year}}-{{printf "%03d" .Seq}}`
+
+// InvoiceSequence is the sequence of invoice numbers shared by all
+// spreadsheets. Last has the last number of each year like "2024" if the
+// numbers restart every year, or of "" otherwise. Assigned maps keys like
+// "<spreadsheet ID>/202405" to their numbers, so that re-running a month
+// keeps its number.
+type InvoiceSequence struct {
+	Last     map[string]int                `json:"last"`
+	Assigned map[string]*InvoiceAssignment `json:"assigned"`
+}
+
+type InvoiceAssignment struct {
+	SpreadsheetID string `json:"spreadsheet_id"`
+	Month         string `json:"month"`
+	Seq           int    `json:"seq"`
+	Number        string `json:"number"`
+	// Revision of the invoice of the month the number is of, 0 for the
+	// original
+	Revision   int       `json:"revision,omitempty"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+type SpreadsheetInvoiceSequence struct {
+	Last     int            `json:"last"`
+	Assigned map[string]int `json:"assigned"`
+}
+
+// Returns the invoice number assigned to the month of the spreadsheet, or ""
+// if there is none
+func getAssignedInvoiceNumber(state *State, spreadsheetID string, targetTime time.Time) string {
+	if state.InvoiceSequence == nil {
+		return ""
+	}
+	if a, ok := state.InvoiceSequence.Assigned[spreadsheetID+"/"+targetTime.Format("200601")]; ok {
+		return a.Number
+	}
+	return ""
+}
+
+// Returns the invoice number of the month of the spreadsheet, assigning the
+// next number of the shared sequence if the month has none. Without a
+// sequence in the state, it starts after the numbers of older versions and
+// the one taken from derive. The assignment is saved unless in dry runs.
+func assignInvoiceNumber(spreadsheetID string, targetTime time.Time, config *Config, derive func() (int, error)) (string, error) {
+	return assignInvoiceNumberOf(spreadsheetID, targetTime, 0, config, derive)
+}
+
+// Returns the invoice number of the revision of the month, 0 being the
+// original, assigning the next number if it has none
+func assignInvoiceNumberOf(spreadsheetID string, targetTime time.Time, revision int, config *Config, derive func() (int, error)) (string, error) {
+	// The state is saved only unless in dry runs, so it is not updated with
+	// updateState
+	unlock, err := lockState()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	path := getStateFilePath()
+	state, err := readStateFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to load state: %v", err)
+	}
+	month := targetTime.Format("200601")
+	key := spreadsheetID + "/" + revisionKey(month, revision)
+	seq := state.InvoiceSequence
+	if seq == nil {
+		if seq, err = newInvoiceSequence(state, config, targetTime.Location()); err != nil {
+			return "", err
+		}
+		state.InvoiceSequence = seq
+		if _, ok := seq.Assigned[key]; !ok {
+			last, err := derive()
+			if err != nil {
+				return "", err
+			}
+			if y := seq.yearKey(config, targetTime); last > seq.Last[y] {
+				seq.Last[y] = last
+			}
+		}
+	}
+	if a, ok := seq.Assigned[key]; ok {
+		return a.Number, nil
+	}
+	year := seq.yearKey(config, targetTime)
+	seq.Last[year]++
+	number, err := formatInvoiceNumber(config, targetTime, seq.Last[year])
+	if err != nil {
+		return "", err
+	}
+	for _, a := range seq.Assigned {
+		if a.Number == number {
+			return "", fmt.Errorf("invoice number %s is already assigned to %s of spreadsheet %s", number, a.Month, a.SpreadsheetID)
+		}
+	}
+	seq.Assigned[key] = &InvoiceAssignment{
+		SpreadsheetID: spreadsheetID,
+		Month:         month,
+		Seq:           seq.Last[year],
+		Number:        number,
+		Revision:      revision,
+		AssignedAt:    time.Now(),
+	}
+	if !dryRun {
+		if err := writeStateFile(path, state); err != nil {
+			return "", fmt.Errorf("failed to save state: %v", err)
+		}
+	}
+	return number, nil
+}
+
+// Returns a new sequence having the numbers of older versions in the state
+func newInvoiceSequence(state *State, config *Config, loc *time.Location) (*InvoiceSequence, error) {
+	seq := &InvoiceSequence{Last: make(map[string]int), Assigned: make(map[string]*InvoiceAssignment)}
+	for id, s := range state.InvoiceNumbers {
+		for m, n := range s.Assigned {
+			t, err := time.ParseInLocation("200601", m, loc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid month %q in state: %v", m, err)
+			}
+			number, err := formatInvoiceNumber(config, t, n)
+			if err != nil {
+				return nil, err
+			}
+			seq.Assigned[id+"/"+m] = &InvoiceAssignment{SpreadsheetID: id, Month: m, Seq: n, Number: number}
+			if y := seq.yearKey(config, t); n > seq.Last[y] {
+				seq.Last[y] = n
+			}
+		}
+	}
+	return seq, nil
+}
+
+func (s *InvoiceSequence) yearKey(config *Config, targetTime time.Time) string {
+	if !config.InvoiceNumberYearlyReset {
+		return ""
+	}
+	return strconv.Itoa(targetTime.Year())
+}
+
+func formatInvoiceNumber(config *Config, targetTime time.Time, seq int) (string, error) {
+	format := config.InvoiceNumberFormat
+	if format == "" {
+		format = defaultInvoiceNumberFormat
+	}
+	tmpl, err := template.New("invoice_number").Parse(format)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse invoice_number_format: %v", err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, struct {
+		Year  int
+		Month int
+		Seq   int
+	}{targetTime.Year(), int(targetTime.Month()), seq}); err != nil {
+		return "", fmt.Errorf("failed to format invoice number: %v", err)
+	}
+	return b.String(), nil
+}
+
+// Lists the invoice numbers assigned so far
+func runNumbers(args []string) error {
+	fs := flag.NewFlagSet("numbers", flag.ExitOnError)
+	month := fs.String("month", "", "list only the numbers of the month like 202405 or last")
+	fs.Parse(args)
+
+	config := configureStateFile()
+	if *month != "" {
+		loc, err := config.GetLocation()
+		if err != nil {
+			return fmt.Errorf("Failed to load timezone: %v", err)
+		}
+		t, err := parseMonthArg(*month, time.Now(), loc)
+		if err != nil {
+			return newRunError(exitConfigError, "config", "Failed to parse --month: %v", err)
+		}
+		*month = t.Format("200601")
+	}
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("Failed to load state: %v", err)
+	}
+	if state.InvoiceSequence == nil {
+		log.Println("No invoice numbers assigned yet")
+		return nil
+	}
+	assignments := make([]*InvoiceAssignment, 0, len(state.InvoiceSequence.Assigned))
+	for _, a := range state.InvoiceSequence.Assigned {
+		if *month == "" || a.Month == *month {
+			assignments = append(assignments, a)
+		}
+	}
+	sort.Slice(assignments, func(i, j int) bool {
+		if assignments[i].Month != assignments[j].Month {
+			return assignments[i].Month < assignments[j].Month
+		}
+		return assignments[i].Seq < assignments[j].Seq
+	})
+	for _, a := range assignments {
+		if a.Revision > 0 {
+			fmt.Printf("%s\t%s\t%s\trev%d\n", a.Month, a.Number, a.SpreadsheetID, a.Revision)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", a.Month, a.Number, a.SpreadsheetID)
+	}
+	return nil
+}
+
+var trailingNumberPattern = regexp.MustCompile(`([0-9]+)\D*$`)
+
+// Returns the sequence number in an invoice number like "2024-013"
+func parseInvoiceSeq(s string) (int, bool) {
+	m := trailingNumberPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(m[1])
+	return n, err == nil
+}
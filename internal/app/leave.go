@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/calendarsource"
+	"google.golang.org/api/calendar/v3"
+)
+
+// Returns days of events titled like the keys of leave_titles, having the
+// values to write in Leave. Leave days are not work days and are left out
+// of the totals and the billing.
+func getLeaveDays(ctx context.Context, client *http.Client, config *Config, targetTime time.Time) ([]WorkDay, error) {
+	if len(config.LeaveTitles) == 0 {
+		return nil, nil
+	}
+	h := sha256.Sum256([]byte(strings.Join(config.GetLeaveTitles(), "\n")))
+	kind := "leave:" + hex.EncodeToString(h[:])[:8]
+	all := make([]WorkDay, 0)
+	for _, calendarID := range config.GetCalendarIDs() {
+		days, err := getCalendarSchedules(ctx, client, calendarID, getBillingPeriod(config, targetTime), kind, func(e *calendar.Event) bool {
+			_, ok := config.LeaveTitles[strings.TrimSpace(e.Summary)]
+			return ok && calendarsource.SkipReason(e, config.SkipNeedsAction) == ""
+		})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, days...)
+	}
+	days := mergeWorkDays(all)
+	for i := range days {
+		days[i].Leave = config.LeaveTitles[strings.TrimSpace(days[i].Events[0].Summary)]
+		days[i].Source = "leave event"
+	}
+	if len(days) > 0 {
+		log.Printf("Found %d leave days\n", len(days))
+	}
+	return days, nil
+}
+
+// Returns the work days without the days of leave. With a weekday rule the
+// leave replaces the work day, while work events on a day of leave are kept
+// with a warning, as the leave may be for a part of the day.
+func applyLeaveDays(workDays, leaveDays []WorkDay, byRule bool) []WorkDay {
+	leaves := make(map[string]string)
+	for _, d := range leaveDays {
+		leaves[d.Date.Format("2006-01-02")] = d.Leave
+	}
+	kept := make([]WorkDay, 0, len(workDays))
+	for _, d := range workDays {
+		key := d.Date.Format("2006-01-02")
+		leave, ok := leaves[key]
+		if !ok {
+			kept = append(kept, d)
+			continue
+		}
+		if byRule && d.Source == "weekday rule" {
+			log.Printf("Excluding %s (leave: %s)\n", key, leave)
+			continue
+		}
+		logWarnf(log.Default(), "Warning: %s has both work and leave (%s)\n", key, leave)
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+// Returns the pattern of the values of the work times column, which has
+// the leave values in it unless leave_range is set
+func getWorkTimesPattern(c *Config) *regexp.Regexp {
+	p := dayColumnPatterns["work times"]
+	if c.LeaveRange != "" || len(c.LeaveTitles) == 0 {
+		return p
+	}
+	values := make([]string, 0, len(c.LeaveTitles))
+	for _, title := range c.GetLeaveTitles() {
+		values = append(values, regexp.QuoteMeta(c.LeaveTitles[title]))
+	}
+	return regexp.MustCompile(p.String() + `|^(` + strings.Join(values, "|") + `)$`)
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// Runs made by other programs through package invoices prompt only if
+// interactive. Prompts of the others are answered no, as in unattended
+// runs.
+var libraryRun bool
+
+// Runs of other programs are made one at a time, as they share the state of
+// the package
+var libraryMu sync.Mutex
+
+// Runs writing only the values of the sheets, which reserve no outputs and
+// are done with a spreadsheet once its values are written and verified.
+// The sheets are exported by export runs afterwards.
+var writeOnly bool
+
+// RunOptions are the options of the runs of other programs
+type RunOptions struct {
+	// Prompt on the terminal as the command does, instead of answering no
+	Interactive bool
+	// Fail the work days of spreadsheets having fewer than min_work_days
+	RequireWorkDays bool
+	// Show the changes to the sheets without making them
+	DryRun bool
+	// IDs of the only spreadsheets to process, every one if empty
+	Only []string
+}
+
+// Makes fn a run of another program for the month with the context and
+// the options, returning its error. fn is given the config of the
+// spreadsheets to process.
+func runLibrary(ctx context.Context, config *Config, targetTime time.Time, opts RunOptions, fn func(config *Config) error) error {
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	// Failures ending the run are notified as of the month
+	runNotify, runMonth = config.Notify, targetTime.Format("200601")
+	savedCtx, savedWriteOnly, savedExportOnly, savedDryRun := runCtx, writeOnly, exportOnly, dryRun
+	libraryRun, runCtx, dryRun = !opts.Interactive, ctx, opts.DryRun
+	defer func() {
+		libraryRun, runCtx, writeOnly, exportOnly, dryRun = false, savedCtx, savedWriteOnly, savedExportOnly, savedDryRun
+	}()
+	// Every run has its own session and events, as the spreadsheets and the
+	// calendars may have changed since the last one
+	sessionMu.Lock()
+	currentSession = nil
+	sessionMu.Unlock()
+	fetchedEventsMu.Lock()
+	fetchedEvents = make(map[string][]*calendar.Event)
+	fetchedEventsMu.Unlock()
+
+	// The config of the caller keeps its spreadsheets
+	if len(opts.Only) > 0 {
+		selected := *config
+		if err := selectSpreadsheets(&selected, append([]string{}, opts.Only...)); err != nil {
+			return newRunError(exitConfigError, "config", "Failed to select spreadsheets: %v", err)
+		}
+		config = &selected
+	}
+	if err := checkOnExistingOutput(config); err != nil {
+		return err
+	}
+	configureRetry(config)
+	return fn(config)
+}
+
+// Returns the first day of the month of t in the timezone of the config,
+// the months of runs
+func getLibraryMonth(config *Config, t time.Time) (time.Time, error) {
+	loc, err := config.GetLocation()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc), nil
+}
+
+// Reads and validates the config file at path
+func LoadConfig(path string) (*Config, error) {
+	return readConfigFile(path)
+}
+
+// Reads and validates config.json next to the executable, as the command
+// does
+func ReadConfig() (*Config, error) {
+	return readConfig()
+}
+
+// Returns the first day of the month of the argument of the command, like
+// 202405, last or -1, in the timezone of the config
+func ParseMonth(config *Config, arg string, now time.Time) (time.Time, error) {
+	loc, err := config.GetLocation()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseMonthArg(arg, now, loc)
+}
+
+// Returns the client of the scopes of the Google APIs the config uses,
+// with the token saved by the command. The authorization flow is started
+// on the terminal unless unattended.
+func NewClient(ctx context.Context, config *Config) (*http.Client, error) {
+	return createAPIClient(ctx, config)
+}
+
+// Makes the runs of the process unattended as --unattended does, for
+// servers making runs: the authorization flow is never started, prompts
+// are answered no and failures ending runs are notified. The summaries of
+// the runs are written to summaries as JSON.
+func SetUnattended(summaries io.Writer) {
+	unattended, assumeYes, summaryOutput = true, true, summaries
+}
+
+// Starts checking for a newer release as unattended runs do, logging the
+// notice once found
+func LogUpdateNotice(config *Config) {
+	go startUpdateCheck(config, true)(time.Minute)
+}
+
+// Returns the work days and the days of leave of the month of each
+// spreadsheet of the config, by spreadsheet ID. Spreadsheets may have no
+// work days unless opts.RequireWorkDays.
+func DetectWorkDays(ctx context.Context, client *http.Client, config *Config, month time.Time, opts RunOptions) (workDays, leaveDays map[string][]WorkDay, err error) {
+	targetTime, err := getLibraryMonth(config, month)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Runs of other programs start here, the command's with the process
+	if !opts.Interactive {
+		runStart = time.Now()
+	}
+	err = runLibrary(ctx, config, targetTime, opts, func(config *Config) error {
+		endCalendar := timePhase("calendar")
+		defer endCalendar()
+		workDays, leaveDays, err = resolveRunWorkDays(ctx, client, config, targetTime, !opts.RequireWorkDays)
+		if err != nil {
+			return err
+		}
+		if calCache != nil {
+			if calCache.misses == 0 {
+				log.Println("Calendar data came from cache")
+			} else if calCache.hits > 0 {
+				log.Printf("Calendar data partly came from cache (%d cached, %d fetched)\n", calCache.hits, calCache.misses)
+			}
+		}
+		return nil
+	})
+	return workDays, leaveDays, err
+}
+
+// Writes the work days and the days of leave to the month sheets of the
+// spreadsheets of the config, without exporting them, returning the
+// result of each spreadsheet
+func UpdateTimesheets(ctx context.Context, client *http.Client, config *Config, month time.Time, workDays, leaveDays map[string][]WorkDay, opts RunOptions) (results []*SpreadsheetResult, err error) {
+	targetTime, err := getLibraryMonth(config, month)
+	if err != nil {
+		return nil, err
+	}
+	err = runLibrary(ctx, config, targetTime, opts, func(config *Config) error {
+		writeOnly = true
+		results, err = writeRun(ctx, client, config, targetTime, workDays, leaveDays)
+		return err
+	})
+	return results, err
+}
+
+// Writes the work days and the days of leave to the month sheets of the
+// spreadsheets of the config and exports them, as runs of the command do,
+// returning the result of each spreadsheet
+func MakeInvoices(ctx context.Context, client *http.Client, config *Config, month time.Time, workDays, leaveDays map[string][]WorkDay, opts RunOptions) (results []*SpreadsheetResult, err error) {
+	targetTime, err := getLibraryMonth(config, month)
+	if err != nil {
+		return nil, err
+	}
+	err = runLibrary(ctx, config, targetTime, opts, func(config *Config) error {
+		results, err = writeRun(ctx, client, config, targetTime, workDays, leaveDays)
+		return err
+	})
+	return results, err
+}
+
+// Writes the days with the holidays of the month, logging how to undo the
+// run once it succeeded
+func writeRun(ctx context.Context, client *http.Client, config *Config, targetTime time.Time, workDays, leaveDays map[string][]WorkDay) ([]*SpreadsheetResult, error) {
+	// Holidays are marked in the weekday column
+	endCalendar := timePhase("calendar")
+	holidays, err := getRunHolidays(ctx, client, config, targetTime)
+	endCalendar()
+	if err != nil {
+		return nil, err
+	}
+	backup, err := newBackup(targetTime.Format("200601"))
+	if err != nil {
+		return nil, err
+	}
+	results, err := updateAndDownloadWorkSpreadsheets(ctx, client, targetTime, workDays, leaveDays, holidays, config, backup)
+	if err != nil || dryRun {
+		return results, err
+	}
+	if writeOnly {
+		log.Println("Wrote spreadsheets")
+	} else {
+		log.Println("Exported spreadsheets")
+	}
+	if sandbox {
+		log.Printf("Run ID: %s (to apply to the spreadsheets after review, run: make-invoices promote %s)\n", backup.RunID, backup.RunID)
+	} else {
+		log.Printf("Run ID: %s (to undo, run: make-invoices rollback %s)\n", backup.RunID, backup.RunID)
+	}
+	return results, nil
+}
+
+// Exports the month sheets of the spreadsheets of the config in their
+// export formats, pdf unless configured, and delivers them as export runs
+// do, returning the result of each spreadsheet
+func ExportPDFs(ctx context.Context, client *http.Client, config *Config, month time.Time, opts RunOptions) (results []*SpreadsheetResult, err error) {
+	targetTime, err := getLibraryMonth(config, month)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Interactive {
+		runStart = time.Now()
+	}
+	err = runLibrary(ctx, config, targetTime, opts, func(config *Config) error {
+		exportOnly = true
+		backup := &Backup{
+			RunID:       newRunID(),
+			TargetMonth: targetTime.Format("200601"),
+			CreatedAt:   time.Now(),
+		}
+		results, err = updateAndDownloadWorkSpreadsheets(ctx, client, targetTime, nil, nil, make(map[string]string), config, backup)
+		if err == nil && !dryRun {
+			// Exports write nothing to undo
+			log.Println("Exported spreadsheets")
+		}
+		return err
+	})
+	return results, err
+}
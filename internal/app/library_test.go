@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLibraryRunWritesThenExports(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	ctx := context.Background()
+	client := f.client(ctx)
+
+	workDays, leaveDays, err := DetectWorkDays(ctx, client, config, targetTime, RunOptions{})
+	if err != nil {
+		t.Fatalf("DetectWorkDays: %v", err)
+	}
+	if got := len(workDays["timesheet"]); got != 4 {
+		t.Fatalf("work days: got %d, want 4", got)
+	}
+
+	results, err := UpdateTimesheets(ctx, client, config, targetTime, workDays, leaveDays, RunOptions{})
+	if err != nil {
+		t.Fatalf("UpdateTimesheets: %v", err)
+	}
+	if len(results) != 1 || results[0].Err != nil || len(results[0].Files) != 0 {
+		t.Fatalf("got results %+v", results[0])
+	}
+	if got := f.value("timesheet", "202405", "D15"); got != "10:00" {
+		t.Errorf("D15: got %v, want 10:00", got)
+	}
+	if got := f.requested("POST /drive/v3/files/timesheet/copy"); len(got) != 0 {
+		t.Errorf("exports of UpdateTimesheets: got %v", got)
+	}
+
+	results, err = ExportPDFs(ctx, client, config, targetTime, RunOptions{})
+	if err != nil {
+		t.Fatalf("ExportPDFs: %v", err)
+	}
+	if len(results) != 1 || results[0].Err != nil || len(results[0].Files) != 1 {
+		t.Fatalf("got results %+v", results[0])
+	}
+	if _, err := os.Stat(results[0].Files[0]); err != nil {
+		t.Errorf("pdf: %v", err)
+	}
+}
+
+func TestLibraryRunAnswersPromptsNo(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.addEvents("work", "events.json")
+	// The new sheet gets a formula of the template in a cell to write,
+	// which runs ask before overwriting
+	f.values["timesheet"]["202404"]["D13"] = "=NOW()"
+	config, targetTime := setUpTestRun(t)
+	ctx := context.Background()
+	client := f.client(ctx)
+
+	// Prompts would take the answer on stdin
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.WriteString("y\n")
+	w.Close()
+	savedStdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() { os.Stdin = savedStdin })
+
+	workDays, leaveDays, err := DetectWorkDays(ctx, client, config, targetTime, RunOptions{})
+	if err != nil {
+		t.Fatalf("DetectWorkDays: %v", err)
+	}
+	results, err := UpdateTimesheets(ctx, client, config, targetTime, workDays, leaveDays, RunOptions{})
+	if err == nil || len(results) != 1 || results[0].Err == nil {
+		t.Fatalf("want the spreadsheet failed, got %v", err)
+	}
+	if !strings.Contains(results[0].Err.Error(), "not written by the tool") || results[0].Step != "check values" {
+		t.Errorf("got error %q at step %q", results[0].Err, results[0].Step)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "y\n" {
+		t.Errorf("stdin was read, left %q", b)
+	}
+}
+
+func TestLibraryRunReturnsFatal(t *testing.T) {
+	// The calendar is not found, which ends command runs
+	f := newFakeAPI(t)
+	config, targetTime := setUpTestRun(t)
+	ctx := context.Background()
+
+	_, _, err := DetectWorkDays(ctx, f.client(ctx), config, targetTime, RunOptions{})
+	if err == nil || !strings.Contains(err.Error(), "Failed to retrieve calendar items from work") {
+		t.Fatalf("got %v", err)
+	}
+	if libraryRun {
+		t.Error("libraryRun is left set")
+	}
+}
+
+func TestLibraryRunCanceled(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	config, targetTime := setUpTestRun(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := ExportPDFs(ctx, f.client(context.Background()), config, targetTime, RunOptions{})
+	if err == nil || len(results) != 1 || results[0].Err == nil || !strings.Contains(results[0].Err.Error(), "not processed") {
+		t.Fatalf("got %v, results %+v", err, results)
+	}
+	if got := f.requested("POST /drive/v3/files/timesheet/copy"); len(got) != 0 {
+		t.Errorf("exports: got %v", got)
+	}
+	if matches, _ := filepath.Glob("*.pdf"); len(matches) != 0 {
+		t.Errorf("pdfs: got %v", matches)
+	}
+	if runCtx != context.Background() {
+		t.Error("runCtx is left as the one of the run")
+	}
+}
+
+func TestLibraryMakeInvoices(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	ctx := context.Background()
+	client := f.client(ctx)
+
+	workDays, leaveDays, err := DetectWorkDays(ctx, client, config, targetTime, RunOptions{RequireWorkDays: true})
+	if err != nil {
+		t.Fatalf("DetectWorkDays: %v", err)
+	}
+	results, err := MakeInvoices(ctx, client, config, targetTime, workDays, leaveDays, RunOptions{})
+	if err != nil {
+		t.Fatalf("MakeInvoices: %v", err)
+	}
+	if len(results) != 1 || results[0].Err != nil || len(results[0].Files) != 1 {
+		t.Fatalf("got results %+v", results[0])
+	}
+	checkTestMonthWritten(t, f)
+}
+
+func TestLibraryRunRequiresWorkDays(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.events["work"] = nil
+	config, targetTime := setUpTestRun(t)
+	ctx := context.Background()
+
+	workDays, _, err := DetectWorkDays(ctx, f.client(ctx), config, targetTime, RunOptions{})
+	if err != nil || len(workDays["timesheet"]) != 0 {
+		t.Fatalf("got %v, %v", workDays, err)
+	}
+	_, _, err = DetectWorkDays(ctx, f.client(ctx), config, targetTime, RunOptions{RequireWorkDays: true})
+	if code, _ := getExitCode(err); code != exitNoWorkDays {
+		t.Errorf("got %d (%v), want %d", code, err, exitNoWorkDays)
+	}
+}
+
+func TestLibraryRunOnly(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", map[string]string{"202404": "202405"}, nil)
+	config, targetTime := setUpTestRun(t)
+	ctx := context.Background()
+
+	if _, err := ExportPDFs(ctx, f.client(ctx), config, targetTime, RunOptions{Only: []string{"other"}}); err == nil || !strings.Contains(err.Error(), "spreadsheet other is not in the config") {
+		t.Fatalf("got %v", err)
+	}
+	results, err := ExportPDFs(ctx, f.client(ctx), config, targetTime, RunOptions{Only: []string{"timesheet"}, DryRun: true})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("got %v, results %+v", err, results)
+	}
+	if got := len(config.GetSpreadsheets()); got != 1 {
+		t.Errorf("spreadsheets of the config: got %d, want 1", got)
+	}
+	if dryRun {
+		t.Error("dryRun is left set")
+	}
+}
+
+func TestLibraryMonthTimezone(t *testing.T) {
+	for timezone, want := range map[string]string{"": "2024-05-01 00:00 JST", "America/New_York": "2024-05-01 00:00 EDT"} {
+		month, err := getLibraryMonth(&Config{Timezone: timezone}, time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := month.Format("2006-01-02 15:04 MST"); got != want {
+			t.Errorf("%q: got %s, want %s", timezone, got, want)
+		}
+	}
+}
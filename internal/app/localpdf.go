@@ -0,0 +1,262 @@
+package app
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Layout of pdfs rendered locally, in points on A4 paper
+const (
+	localPDFPageWidth  = 595
+	localPDFPageHeight = 842
+	localPDFMargin     = 56
+	localPDFFontSize   = 10.5
+)
+
+// Returns the data given to local templates, which has the same values as
+// the placeholders of the Docs renderer, like {{.amount}}, and the rows of
+// the work table as {{.work_table}}
+func getLocalTemplateData(placeholders map[string]string, workTable [][]string) map[string]interface{} {
+	data := make(map[string]interface{}, len(placeholders)+1)
+	for k, v := range placeholders {
+		data[k] = v
+	}
+	data[workTablePlaceholder] = workTable
+	return data
+}
+
+// Executes the local template of the document, which is HTML. Values are
+// escaped, and missing ones are errors like placeholders without values in
+// Docs templates.
+func executeLocalTemplate(dc *InvoiceDocumentConfig, data map[string]interface{}) (string, error) {
+	path := resolveConfigPath(dc.LocalTemplate)
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse local template of document %s: %v", dc.Key, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to execute local template of document %s: %v", dc.Key, err)
+	}
+	return b.String(), nil
+}
+
+// Renders the local template of the document to a pdf with the glyphs of
+// the font used embedded. The index is of the font in a collection (.ttc).
+func renderLocalPDF(dc *InvoiceDocumentConfig, data map[string]interface{}, fontPath string, fontIndex int, fileName string) error {
+	text, err := executeLocalTemplate(dc, data)
+	if err != nil {
+		return err
+	}
+	fontData, err := ioutil.ReadFile(resolveConfigPath(fontPath))
+	if err != nil {
+		return fmt.Errorf("failed to read font: %v", err)
+	}
+	font, err := parseFont(fontData, fontIndex)
+	if err != nil {
+		return fmt.Errorf("failed to read font %s: %v", fontPath, err)
+	}
+	d, err := makeHTMLPDF(text, font)
+	if err != nil {
+		return fmt.Errorf("failed to render local template of document %s: %v", dc.Key, err)
+	}
+	tmp := fileName + ".part"
+	defer os.Remove(tmp)
+	if err := ioutil.WriteFile(tmp, d, 0666); err != nil {
+		return fmt.Errorf("failed to save %s: %v", fileName, err)
+	}
+	return os.Rename(tmp, fileName)
+}
+
+func pdfStream(dict string, data []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, " << %s /Length %d >>\nstream\n", dict, len(data))
+	b.Write(data)
+	b.WriteString("\nendstream")
+	return b.Bytes()
+}
+
+func compress(d []byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	if _, err := zw.Write(d); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Returns the tag of the subset of the glyphs, which prefixes the font
+// name like "ABCDEF+"
+func getSubsetTag(glyphs []int) string {
+	h := fnv.New32a()
+	for _, g := range glyphs {
+		fmt.Fprintf(h, "%d,", g)
+	}
+	n := h.Sum32()
+	tag := make([]byte, 6)
+	for i := range tag {
+		tag[i] = byte('A' + n%26)
+		n /= 26
+	}
+	return string(tag)
+}
+
+// Writes the content stream drawing the ops, which are at points from the
+// top left of the page
+func writePageContent(b *bytes.Buffer, ops []drawOp, font *sfntFont) {
+	for _, op := range ops {
+		c := op.color
+		switch op.kind {
+		case opRect:
+			fmt.Fprintf(b, "q %.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f Q\n", c.r, c.g, c.b, op.x, localPDFPageHeight-op.y-op.h, op.w, op.h)
+		case opLine:
+			fmt.Fprintf(b, "q %.2f w %.3f %.3f %.3f RG %.2f %.2f m %.2f %.2f l S Q\n", op.lineWidth, c.r, c.g, c.b, op.x, localPDFPageHeight-op.y, op.x2, localPDFPageHeight-op.y2)
+		case opText:
+			fmt.Fprintf(b, "q BT /F1 %.2f Tf %.3f %.3f %.3f rg ", op.size, c.r, c.g, c.b)
+			// The font has no bold nor italic faces, so they are made by
+			// stroking the outlines and slanting the glyphs
+			if op.bold {
+				fmt.Fprintf(b, "2 Tr %.3f w %.3f %.3f %.3f RG ", op.size*0.03, c.r, c.g, c.b)
+			}
+			skew := 0.0
+			if op.italic {
+				skew = 0.2
+			}
+			fmt.Fprintf(b, "1 0 %g 1 %.2f %.2f Tm <", skew, op.x, localPDFPageHeight-op.y)
+			for _, g := range op.glyphs {
+				fmt.Fprintf(b, "%04X", font.cid(g))
+			}
+			b.WriteString("> Tj ET Q\n")
+		}
+	}
+}
+
+// Makes a pdf of the HTML in the font, embedding a subset of it with the
+// glyphs used as a CID font
+func makeHTMLPDF(text string, font *sfntFont) ([]byte, error) {
+	const catalogNum, pagesNum, fontNum, cidFontNum, descriptorNum, fontFileNum, toUnicodeNum = 1, 2, 3, 4, 5, 6, 7
+	next := 8
+	objects := make(map[int][]byte)
+
+	pages, used, err := layoutHTML(text, font)
+	if err != nil {
+		return nil, err
+	}
+	kids := make([]string, 0, len(pages))
+	for _, ops := range pages {
+		var content bytes.Buffer
+		writePageContent(&content, ops, font)
+		d, err := compress(content.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		pageNum, contentNum := next, next+1
+		next += 2
+		objects[pageNum] = []byte(fmt.Sprintf(" << /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 %d 0 R >> >> /Contents %d 0 R >> ",
+			pagesNum, localPDFPageWidth, localPDFPageHeight, fontNum, contentNum))
+		objects[contentNum] = pdfStream("/Filter /FlateDecode", d)
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageNum))
+	}
+
+	// .notdef is drawn for runes not in the font
+	if _, ok := used[0]; !ok {
+		used[0] = 0xfffd
+	}
+	glyphs := make([]int, 0, len(used))
+	subset := make(map[int]bool, len(used))
+	for g := range used {
+		glyphs = append(glyphs, g)
+		subset[g] = true
+	}
+	sort.Slice(glyphs, func(i, j int) bool {
+		return font.cid(glyphs[i]) < font.cid(glyphs[j])
+	})
+	var widths, toUnicode bytes.Buffer
+	for _, g := range glyphs {
+		fmt.Fprintf(&widths, "%d [%d] ", font.cid(g), font.width(g))
+	}
+	toUnicode.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	// bfchar blocks have at most 100 entries
+	for i := 0; i < len(glyphs); i += 100 {
+		end := i + 100
+		if end > len(glyphs) {
+			end = len(glyphs)
+		}
+		fmt.Fprintf(&toUnicode, "%d beginbfchar\n", end-i)
+		for _, g := range glyphs[i:end] {
+			fmt.Fprintf(&toUnicode, "<%04X> <", font.cid(g))
+			for _, u := range utf16.Encode([]rune{used[g]}) {
+				fmt.Fprintf(&toUnicode, "%04X", u)
+			}
+			toUnicode.WriteString(">\n")
+		}
+		toUnicode.WriteString("endbfchar\n")
+	}
+	toUnicode.WriteString("endcmap\nCMapName currentdict /CMapResource defineresource pop\nend\nend")
+
+	program, err := font.subset(subset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subset font: %v", err)
+	}
+	compressed, err := compress(program)
+	if err != nil {
+		return nil, err
+	}
+	name := getSubsetTag(glyphs) + "+" + font.name
+	cidFont := "/Subtype /CIDFontType2 /CIDToGIDMap /Identity"
+	fontFile := fmt.Sprintf("/FontFile2 %d 0 R", fontFileNum)
+	fontFileDict := fmt.Sprintf("/Filter /FlateDecode /Length1 %d", len(program))
+	if font.cff != nil {
+		cidFont = "/Subtype /CIDFontType0"
+		fontFile = fmt.Sprintf("/FontFile3 %d 0 R", fontFileNum)
+		fontFileDict = "/Filter /FlateDecode /Subtype /CIDFontType0C"
+	}
+
+	objects[catalogNum] = []byte(fmt.Sprintf(" << /Type /Catalog /Pages %d 0 R >> ", pagesNum))
+	objects[pagesNum] = []byte(fmt.Sprintf(" << /Type /Pages /Kids [%s] /Count %d >> ", strings.Join(kids, " "), len(kids)))
+	objects[fontNum] = []byte(fmt.Sprintf(" << /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >> ",
+		name, cidFontNum, toUnicodeNum))
+	objects[cidFontNum] = []byte(fmt.Sprintf(" << /Type /Font %s /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /W [%s] >> ",
+		cidFont, name, descriptorNum, widths.String()))
+	objects[descriptorNum] = []byte(fmt.Sprintf(" << /Type /FontDescriptor /FontName /%s /Flags 4 /FontBBox [%d %d %d %d] /ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 %s >> ",
+		name, font.scale(font.bbox[0]), font.scale(font.bbox[1]), font.scale(font.bbox[2]), font.scale(font.bbox[3]),
+		font.scale(font.ascent), font.scale(font.descent), font.scale(font.capHeight), fontFile))
+	objects[fontFileNum] = pdfStream(fontFileDict, compressed)
+	objects[toUnicodeNum] = pdfStream("", toUnicode.Bytes())
+	return writePDF(objects, next, catalogNum), nil
+}
+
+// Writes the objects numbered from 1 to next-1 with the xref table
+func writePDF(objects map[int][]byte, next, catalogNum int) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, next)
+	for n := 1; n < next; n++ {
+		offsets[n] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj", n)
+		b.Write(objects[n])
+		b.WriteString("\nendobj\n")
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", next)
+	for n := 1; n < next; n++ {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offsets[n])
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", next, catalogNum, xref)
+	return b.Bytes()
+}
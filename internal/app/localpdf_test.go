@@ -0,0 +1,273 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+const testLocalTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<style>
+h1 { text-align: center; font-size: 18pt; }
+.work td { padding: 2px 4px; }
+td.hours { text-align: right; }
+</style>
+</head>
+<body>
+<h1>請求書</h1>
+<p>{{.client_name}} 御中</p>
+<p>下記の通りご請求申し上げます。</p>
+<table class="work" border="1" width="100%">
+<tr><th>日</th><th>時間</th><th>備考</th></tr>
+{{range .work_table}}<tr><td>{{index . 0}}</td><td class="hours">{{index . 1}}</td><td>{{index . 2}}</td></tr>
+{{end}}</table>
+<p>合計金額 <b>{{.amount}}</b> 円</p>
+</body>
+</html>
+`
+
+func getTestLocalTemplateData() map[string]interface{} {
+	return getLocalTemplateData(
+		map[string]string{"client_name": "株式会社<A&B>", "amount": "100,000"},
+		[][]string{{"1", "8:00", "作業"}, {"2", "7:30", "<b>x</b>"}},
+	)
+}
+
+func writeTestLocalTemplate(t *testing.T, text string) *InvoiceDocumentConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "invoice.html")
+	if err := ioutil.WriteFile(path, []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return &InvoiceDocumentConfig{Key: "invoice", LocalTemplate: path}
+}
+
+// Returns the texts drawn on the pages, in order
+func getTestTexts(pages [][]drawOp) [][]drawOp {
+	texts := make([][]drawOp, len(pages))
+	for i, ops := range pages {
+		for _, op := range ops {
+			if op.kind == opText {
+				texts[i] = append(texts[i], op)
+			}
+		}
+	}
+	return texts
+}
+
+func TestExecuteLocalTemplate(t *testing.T) {
+	dc := writeTestLocalTemplate(t, testLocalTemplate)
+	text, err := executeLocalTemplate(dc, getTestLocalTemplateData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"株式会社&lt;A&amp;B&gt; 御中", "&lt;b&gt;x&lt;/b&gt;", "<b>100,000</b>"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("no %q in\n%s", want, text)
+		}
+	}
+
+	data := getTestLocalTemplateData()
+	delete(data, "amount")
+	if _, err := executeLocalTemplate(dc, data); err == nil {
+		t.Error("no error for a missing value")
+	}
+}
+
+func TestRenderLocalPDF(t *testing.T) {
+	dir := t.TempDir()
+	fonts := []struct {
+		name  string
+		data  []byte
+		index int
+		file  string
+	}{
+		{"ttf", newTestTrueType("TestSans"), 0, "/FontFile2"},
+		{"otf", newTestOpenType("TestMincho"), 0, "/FontFile3"},
+		{"ttc", newTestCollection(newTestOpenType("TestMincho"), newTestTrueType("TestGothic")), 1, "/FontFile2"},
+	}
+	for _, c := range fonts {
+		t.Run(c.name, func(t *testing.T) {
+			fontPath := filepath.Join(dir, "font."+c.name)
+			if err := ioutil.WriteFile(fontPath, c.data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			fileName := filepath.Join(dir, c.name+".pdf")
+			dc := writeTestLocalTemplate(t, testLocalTemplate)
+			if err := renderLocalPDF(dc, getTestLocalTemplateData(), fontPath, c.index, fileName); err != nil {
+				t.Fatal(err)
+			}
+			conf := pdfcpu.NewDefaultConfiguration()
+			conf.ValidationMode = pdfcpu.ValidationRelaxed
+			if err := api.ValidateFile(fileName, conf); err != nil {
+				t.Fatalf("invalid pdf: %v", err)
+			}
+
+			d, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			font, err := parseFont(c.data, c.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(d), c.file) {
+				t.Errorf("font is not embedded as %s", c.file)
+			}
+			// Text is extracted through the ToUnicode map keyed by CIDs
+			for _, r := range "請求書御中<&>" {
+				entry := fmt.Sprintf("<%04X> <%04X>", font.cid(font.glyph(r)), r)
+				if !strings.Contains(string(d), entry) {
+					t.Errorf("no ToUnicode entry %s of %q", entry, r)
+				}
+			}
+			if entry := fmt.Sprintf("<%04X> <", font.cid(font.glyph('税'))); strings.Contains(string(d), entry) {
+				t.Errorf("ToUnicode has an entry of a glyph not used")
+			}
+		})
+	}
+}
+
+func TestLayoutHTMLTemplate(t *testing.T) {
+	font, err := parseFont(newTestTrueType("TestSans"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := writeTestLocalTemplate(t, testLocalTemplate)
+	text, err := executeLocalTemplate(dc, getTestLocalTemplateData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, used, err := layoutHTML(text, font)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 {
+		t.Fatalf("pages: got %d, want 1", len(pages))
+	}
+	texts := make(map[string]drawOp)
+	for _, op := range getTestTexts(pages)[0] {
+		texts[op.text] = op
+	}
+	for _, want := range []string{"請求書", "株式会社<A&B> 御中", "<b>x</b>", "100,000"} {
+		if _, ok := texts[want]; !ok {
+			t.Errorf("no text %q in %v", want, texts)
+		}
+	}
+	if op := texts["100,000"]; !op.bold {
+		t.Errorf("amount is not bold")
+	}
+	if op := texts["<b>x</b>"]; op.bold {
+		t.Errorf("value of the data is taken as an element")
+	}
+	if op := texts["請求書"]; math.Abs(op.x+op.w/2-localPDFPageWidth/2.0) > 0.01 || op.size != 18 {
+		t.Errorf("heading is not centered in 18pt: %+v", op)
+	}
+	// Cells of the hours are aligned right in the middle column
+	hours, note := texts["8:00"], texts["作業"]
+	if hours.x+hours.w > note.x || note.x-(hours.x+hours.w) > 10 {
+		t.Errorf("hours are not aligned right: %+v before %+v", hours, note)
+	}
+	for g, r := range used {
+		if font.glyph(r) != g {
+			t.Errorf("glyph %d is used for %q", g, r)
+		}
+	}
+}
+
+func TestLayoutHTMLLineBreaks(t *testing.T) {
+	font, err := parseFont(newTestTrueType("TestSans"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lines have 46 characters of 10.5pt in the width of 483pt
+	perLine := int((localPDFPageWidth - 2*localPDFMargin) / localPDFFontSize)
+	for _, c := range []struct {
+		name string
+		html string
+		want []string
+	}{
+		{
+			"cjk",
+			"<p>" + strings.Repeat("請", perLine+3) + "</p>",
+			[]string{strings.Repeat("請", perLine), "請請請"},
+		},
+		{
+			"no line start",
+			"<p>" + strings.Repeat("請", perLine) + "。次</p>",
+			[]string{strings.Repeat("請", perLine-1), "請。次"},
+		},
+		{
+			"no line end",
+			"<p>" + strings.Repeat("請", perLine-1) + "「書」</p>",
+			[]string{strings.Repeat("請", perLine-1), "「書」"},
+		},
+		{
+			"words",
+			"<p>" + strings.Repeat("abcdefghi ", 20) + "</p>",
+			[]string{strings.TrimSpace(strings.Repeat("abcdefghi ", 9)), strings.TrimSpace(strings.Repeat("abcdefghi ", 9)), "abcdefghi abcdefghi"},
+		},
+		{
+			"pre",
+			"<pre>a  b\n\tc</pre>",
+			[]string{"a  b", "    c"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pages, _, err := layoutHTML("<html><body>"+c.html+"</body></html>", font)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := make([]string, 0)
+			for _, op := range getTestTexts(pages)[0] {
+				lines = append(lines, op.text)
+			}
+			if strings.Join(lines, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(c.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLayoutHTMLPages(t *testing.T) {
+	font, err := parseFont(newTestTrueType("TestSans"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, _, err := layoutHTML(`<html><body><div>請求書</div><div style="page-break-before: always">備考</div></body></html>`, font)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := getTestTexts(pages)
+	if len(texts) != 2 || len(texts[0]) != 1 || texts[0][0].text != "請求書" || len(texts[1]) != 1 || texts[1][0].text != "備考" {
+		t.Fatalf("got pages %+v", texts)
+	}
+
+	// Rows of long tables are continued on the next pages
+	rows := strings.Repeat("<tr><td>作業</td><td>8:00</td></tr>", 100)
+	pages, _, err = layoutHTML("<html><body><table>"+rows+"</table></body></html>", font)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts = getTestTexts(pages)
+	n := 0
+	for _, ops := range texts {
+		for _, op := range ops {
+			if op.y > localPDFPageHeight-localPDFMargin {
+				t.Errorf("text below the margin: %+v", op)
+			}
+		}
+		n += len(ops)
+	}
+	if len(pages) < 2 || n != 200 {
+		t.Errorf("got %d texts on %d pages", n, len(pages))
+	}
+}
@@ -0,0 +1,272 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logFormat string
+	quiet     bool
+	logFile   string
+)
+
+// Per-spreadsheet loggers prefix their messages with "[<id>] "
+var logPrefixPattern = regexp.MustCompile(`^\[([^\]]+)\] `)
+
+// Levels of log records
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+// logAttr is an attribute of a log record besides its message, like the
+// range written
+type logAttr struct {
+	key   string
+	value interface{}
+}
+
+// logRecordWriter turns the lines of the standard logger into records of
+// info level, and the messages of logAt into records of their level and
+// attributes. In json format each record is written as a line of JSON with
+// the attributes as fields, otherwise as the text of its message. Records
+// below the level of the console are dropped there, while the log file gets
+// all of them.
+type logRecordWriter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	file    *rotatingFile
+	json    bool
+	quiet   bool
+	verbose bool
+	month   string
+}
+
+type logRecord struct {
+	Time          string `json:"time"`
+	Level         string `json:"level"`
+	Month         string `json:"month,omitempty"`
+	SpreadsheetID string `json:"spreadsheet_id,omitempty"`
+	Msg           string `json:"msg"`
+}
+
+// Logs the message of the format to the logger at the level with the
+// attributes. Without the writer of records, only the message is logged,
+// and debug ones only with --verbose.
+func logAt(logger *log.Logger, level string, attrs []logAttr, format string, v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	w, ok := logger.Writer().(*logRecordWriter)
+	if !ok {
+		if level != levelDebug || verbose {
+			logger.Println(msg)
+		}
+		return
+	}
+	id := ""
+	if m := logPrefixPattern.FindStringSubmatch(logger.Prefix()); m != nil {
+		id = m[1]
+	}
+	w.write(level, id, msg, attrs)
+}
+
+// Logs the message of the format at warn level
+func logWarnf(logger *log.Logger, format string, v ...interface{}) {
+	logAt(logger, levelWarn, nil, format, v...)
+}
+
+// Logs the message of the format at error level
+func logErrorf(logger *log.Logger, format string, v ...interface{}) {
+	logAt(logger, levelError, nil, format, v...)
+}
+
+func (w *logRecordWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	id := ""
+	if m := logPrefixPattern.FindStringSubmatch(line); m != nil {
+		id = m[1]
+		line = line[len(m[0]):]
+	}
+	if err := w.write(levelInfo, id, line, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *logRecordWriter) write(level, id, msg string, attrs []logAttr) error {
+	console := true
+	switch {
+	case level == levelDebug && !w.verbose:
+		console = false
+	case w.quiet && level != levelError && level != levelWarn:
+		console = false
+	}
+	if !console && w.file == nil {
+		return nil
+	}
+
+	var b bytes.Buffer
+	if w.json {
+		d, err := json.Marshal(logRecord{
+			Time:          time.Now().Format(time.RFC3339Nano),
+			Level:         level,
+			Month:         w.month,
+			SpreadsheetID: id,
+			Msg:           msg,
+		})
+		if err != nil {
+			return err
+		}
+		// Attributes follow the fields of every record
+		b.Write(d[:len(d)-1])
+		for _, a := range attrs {
+			k, err := json.Marshal(a.key)
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(a.value)
+			if err != nil {
+				return err
+			}
+			b.WriteByte(',')
+			b.Write(k)
+			b.WriteByte(':')
+			b.Write(v)
+		}
+		b.WriteString("}\n")
+	} else {
+		b.WriteString(time.Now().Format("2006/01/02 15:04:05 "))
+		if id != "" {
+			b.WriteString("[" + id + "] ")
+		}
+		b.WriteString(msg + "\n")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		// The run goes on without the file if it can't be written
+		if err := w.file.write(b.Bytes()); err != nil {
+			fmt.Fprintf(w.out, "Warning: stopped writing log file: %v\n", err)
+			w.file.close()
+			w.file = nil
+		}
+	}
+	if console {
+		if _, err := w.out.Write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets up the standard logger for --log-format, --quiet and the log file.
+// Loggers made from log.Writer() and log.Flags() afterwards write through it
+// too.
+func setupLogging(targetTime time.Time, config *Config) {
+	w := &logRecordWriter{
+		out:     log.Writer(),
+		json:    logFormat == "json",
+		quiet:   quiet,
+		verbose: verbose,
+		month:   targetTime.Format("200601"),
+	}
+	path := logFile
+	if path == "" && config.LogFile != "" {
+		path = resolveConfigPath(config.LogFile)
+	}
+	if path != "" {
+		f, err := openRotatingFile(path, config.LogFileMaxSize, config.LogFileKeep)
+		if err != nil {
+			logWarnf(log.Default(), "Warning: not writing log file: %v\n", err)
+		} else {
+			w.file = f
+		}
+	}
+	// Records have their own time
+	log.SetFlags(0)
+	log.SetOutput(w)
+}
+
+// Size of log files rotated by default
+const defaultLogFileMaxSize = 10 << 20
+
+// rotatingFile is a log file which is renamed to <path>.1 when it grows over
+// maxSize, keeping keep files renamed before as <path>.2 and so on
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultLogFileMaxSize
+	}
+	if keep <= 0 {
+		keep = 5
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) write(p []byte) error {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) close() {
+	r.f.Close()
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+// Decodes the JSON lines of the records
+func decodeLogRecords(t *testing.T, b []byte) []map[string]interface{} {
+	t.Helper()
+	records := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("record %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestLogRecordWriterJSON(t *testing.T) {
+	var out bytes.Buffer
+	w := &logRecordWriter{out: &out, json: true, verbose: true, month: "202405"}
+	logger := log.New(w, "[timesheet] ", log.Lmsgprefix)
+
+	logAt(logger, levelInfo, []logAttr{{"range", []string{"'202405'!D7:D37"}}, {"duration_ms", int64(12)}}, "Wrote %d ranges of sheet %s\n", 1, "202405")
+	logAt(log.New(w, "", 0), levelDebug, []logAttr{{"attempt", 2}}, "Retrying get spreadsheet\n")
+	logWarnf(logger, "Warning: template of sheet %s has no optional columns\n", "202405")
+	logErrorf(logger, "Failed: %v\n", "quota")
+	// Lines of the standard logger are info, whatever they start with
+	log.New(w, "[timesheet] ", log.Lmsgprefix).Printf("Failed to look like an error\n")
+
+	records := decodeLogRecords(t, out.Bytes())
+	want := []map[string]interface{}{
+		{"level": "info", "month": "202405", "spreadsheet_id": "timesheet", "msg": "Wrote 1 ranges of sheet 202405", "range": []interface{}{"'202405'!D7:D37"}, "duration_ms": 12.0},
+		{"level": "debug", "month": "202405", "msg": "Retrying get spreadsheet", "attempt": 2.0},
+		{"level": "warn", "month": "202405", "spreadsheet_id": "timesheet", "msg": "Warning: template of sheet 202405 has no optional columns"},
+		{"level": "error", "month": "202405", "spreadsheet_id": "timesheet", "msg": "Failed: quota"},
+		{"level": "info", "month": "202405", "spreadsheet_id": "timesheet", "msg": "Failed to look like an error"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %s", len(records), len(want), out.String())
+	}
+	for i, r := range records {
+		if _, ok := r["time"].(string); !ok {
+			t.Errorf("record %d has no time: %v", i, r)
+		}
+		delete(r, "time")
+		if !jsonEqual(r, want[i]) {
+			t.Errorf("record %d: got %v, want %v", i, r, want[i])
+		}
+	}
+}
+
+func jsonEqual(a, b map[string]interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+func TestLogRecordWriterConsoleLevels(t *testing.T) {
+	tests := []struct {
+		name           string
+		quiet, verbose bool
+		want           []string
+	}{
+		{"default", false, false, []string{"info", "warn", "error"}},
+		{"quiet", true, false, []string{"warn", "error"}},
+		{"verbose", false, true, []string{"debug", "info", "warn", "error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := &logRecordWriter{out: &out, json: true, quiet: tt.quiet, verbose: tt.verbose}
+			logger := log.New(w, "", 0)
+			for _, level := range []string{levelDebug, levelInfo, levelWarn, levelError} {
+				logAt(logger, level, nil, "%s message\n", level)
+			}
+			got := make([]string, 0)
+			for _, r := range decodeLogRecords(t, out.Bytes()) {
+				got = append(got, r["level"].(string))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got levels %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The main events of a run have their attributes in the records
+func TestRunLogRecords(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addSpreadsheet("timesheet", "spreadsheet.json", nil, nil)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+	var out bytes.Buffer
+	savedOutput, savedFlags := log.Writer(), log.Flags()
+	log.SetFlags(0)
+	log.SetOutput(&logRecordWriter{out: &out, json: true, month: "202405"})
+	t.Cleanup(func() {
+		log.SetOutput(savedOutput)
+		log.SetFlags(savedFlags)
+	})
+	savedYes := assumeYes
+	assumeYes = true
+	t.Cleanup(func() { assumeYes = savedYes })
+
+	if err := runTestMonth(t, f, config, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]map[string]interface{})
+	for _, r := range decodeLogRecords(t, out.Bytes()) {
+		msg := r["msg"].(string)
+		for _, prefix := range []string{"Found 4 work days", "Creating sheet", "Wrote 2 ranges", "Exported"} {
+			if strings.HasPrefix(msg, prefix) {
+				found[prefix] = r
+			}
+		}
+	}
+	for prefix, keys := range map[string][]string{
+		"Found 4 work days": {"work_days"},
+		"Creating sheet":    {"spreadsheet_id", "sheet", "source_sheet"},
+		"Wrote 2 ranges":    {"spreadsheet_id", "sheet", "range", "duration_ms"},
+		"Exported":          {"spreadsheet_id", "format", "file", "duration_ms"},
+	} {
+		r, ok := found[prefix]
+		if !ok {
+			t.Errorf("no record of %q in %s", prefix, out.String())
+			continue
+		}
+		for _, k := range keys {
+			if _, ok := r[k]; !ok {
+				t.Errorf("record of %q has no %s: %v", prefix, k, r)
+			}
+		}
+	}
+	if r := found["Wrote 2 ranges"]; r != nil {
+		if ranges, _ := r["range"].([]interface{}); len(ranges) != 2 || ranges[1] != "D7:D37" {
+			t.Errorf("got ranges %v", r["range"])
+		}
+	}
+}
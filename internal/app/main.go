@@ -0,0 +1,1747 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/auth"
+	"github.com/tsujio/make-invoices/internal/export"
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Version of the command, given to Main
+var version = "dev"
+
+var verbose bool
+
+var strictDuplicates bool
+var strictTemplate bool
+
+var skipTemplateCheck bool
+
+var noVerify bool
+
+var force bool
+
+var concurrency int
+
+var applyRetentionFlag bool
+
+var dryRun bool
+
+var onExistingOutput string
+
+var sendEmailFlag bool
+
+var draftEmail bool
+
+// Sends and uploads outputs again even if the ones of the invoice were sent
+// before, changed or not
+var resend bool
+
+// Logs the message at debug level, which goes to the log file even if not
+// verbose
+func logVerbose(format string, v ...interface{}) {
+	logAt(log.Default(), levelDebug, nil, format, v...)
+}
+
+// Reads and validates the config
+func readConfig() (*Config, error) {
+	return readConfigFile(getPathSiblingOfExecutable("config.json"))
+}
+
+func readConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to open config file: %v", err)
+	}
+	defer f.Close()
+	var config Config
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to decode config file: %v", err)
+	}
+	if err := config.NormalizeRefs(); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	if err := config.LoadClients(); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	for key, cc := range config.Clients {
+		if err := cc.Validate(); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: client %s: %v", key, err)
+		}
+	}
+	if _, err := getExportFormats(&config, nil); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	if _, err := getPDFOptions(&config, nil); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	if config.Billing != nil {
+		if err := config.Billing.Validate(); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: billing: %v", err)
+		}
+	}
+	if config.Tax != nil {
+		if err := config.Tax.Validate(); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: tax: %v", err)
+		}
+	}
+	if err := config.WorkStartTime.Validate(); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: work_start_time: %v", err)
+	}
+	if err := config.WorkEndTime.Validate(); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: work_end_time: %v", err)
+	}
+	if config.Locale != "" && !isKnownLocale(config.Locale) {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: unknown locale %q (want en or ja)", config.Locale)
+	}
+	setLocale(config.Locale)
+	if _, err := config.GetLocation(); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: timezone: %v", err)
+	}
+	switch config.ValueWriteMode {
+	case "", valueWriteUserEntered, valueWriteRawSerial:
+	default:
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: unknown value_write_mode %q (want user_entered or raw_serial)", config.ValueWriteMode)
+	}
+	switch config.WorkSource {
+	case "", "calendar":
+	case "csv":
+		if config.WorkCSV == nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: work_csv is required for work_source csv")
+		}
+		if err := config.WorkCSV.Validate(); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: work_csv: %v", err)
+		}
+	case "merge":
+		if err := config.ValidateWorkSources(); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+		}
+	default:
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: unknown work_source %q (want calendar, csv or merge)", config.WorkSource)
+	}
+	if config.Holidays != nil {
+		if err := config.Holidays.Validate(); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: holidays: %v", err)
+		}
+	}
+	if config.BillingPeriod != nil {
+		if err := config.BillingPeriod.Validate(); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: billing_period: %v", err)
+		}
+	}
+	if _, err := config.GetSandboxMaxAge(); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	if _, err := getRequestDurations(&config); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	if config.APIRequestsPerSecond < 0 {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: api_requests_per_second must not be negative")
+	}
+	if config.Summary != nil && config.Summary.BreakDuration != "" {
+		if _, err := time.ParseDuration(config.Summary.BreakDuration); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: failed to parse break_duration of summary: %v", err)
+		}
+	}
+	if config.FiscalYearStartMonth < 0 || config.FiscalYearStartMonth > 12 {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: fiscal_year_start_month must be a month")
+	}
+	if config.RemindDay < 0 || config.RemindDay > 31 {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: remind_day must be a day of the month")
+	}
+	if err := validateBreakRules(config.BreakRules); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: break_rules: %v", err)
+	}
+	if err := validateEventKinds(config.EventKinds); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: event_kinds: %v", err)
+	}
+	if err := validateColumnAnchors(config.ColumnAnchors, &config); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: column_anchors: %v", err)
+	}
+	if config.DailyCSV != nil {
+		if err := validateDailyCSV(config.DailyCSV); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: daily_csv: %v", err)
+		}
+	}
+	if config.NonWorkingDays != nil {
+		if err := validateNonWorkingDays(config.NonWorkingDays); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: non_working_days: %v", err)
+		}
+	}
+	if _, err := getInvoiceDates(&config, &SpreadsheetConfig{}, time.Now(), time.Now()); err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	cur, err := getCurrency(&config, &SpreadsheetConfig{})
+	if err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: %v", err)
+	}
+	if config.Tax != nil && config.Tax.Withholding && cur.code != "JPY" {
+		return nil, newRunError(exitConfigError, "config", "Failed to load config file: withholding tax is only for JPY, not %s", cur.code)
+	}
+	for _, sc := range config.WorkSpreadsheets {
+		if _, err := getExportFormats(&config, sc); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: %v", sc.ID, err)
+		}
+		if _, err := getPDFOptions(&config, sc); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: %v", sc.ID, err)
+		}
+		if sc.Billing != nil {
+			if err := sc.Billing.Validate(); err != nil {
+				return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: billing: %v", sc.ID, err)
+			}
+		}
+		if sc.Tax != nil {
+			if err := sc.Tax.Validate(); err != nil {
+				return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: tax: %v", sc.ID, err)
+			}
+		}
+		if sc.BillingPeriod != nil {
+			if err := sc.BillingPeriod.Validate(); err != nil {
+				return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: billing_period: %v", sc.ID, err)
+			}
+		}
+		if _, err := config.GetDocuments(sc); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: %v", sc.ID, err)
+		}
+		if _, err := getInvoiceDates(&config, sc, time.Now(), time.Now()); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: %v", sc.ID, err)
+		}
+		cur, err := getCurrency(&config, sc)
+		if err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: %v", sc.ID, err)
+		}
+		// Withholding tax is computed in yen
+		if tax := config.GetTax(sc); tax != nil && tax.Withholding && cur.code != "JPY" {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: withholding tax is only for JPY, not %s", sc.ID, cur.code)
+		}
+		if sc.WorkDayRule != nil {
+			if err := sc.WorkDayRule.Validate(); err != nil {
+				return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: work_day_rule: %v", sc.ID, err)
+			}
+		}
+		if err := validateBreakRules(sc.BreakRules); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: break_rules: %v", sc.ID, err)
+		}
+		hasBreakRules := len(config.BreakRules) > 0 || len(sc.BreakRules) > 0
+		if hasBreakRules && config.Summary != nil && config.Summary.BreakDuration != "" {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: break_rules and break_duration of summary can't be used together", sc.ID)
+		}
+		if sc.Period != "" && sc.Period != "monthly" && sc.Period != weeklyPeriod {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: unknown period: %q (must be monthly or weekly)", sc.ID, sc.Period)
+		}
+		if sc.Client != "" && config.Clients[sc.Client] == nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: undefined client %q", sc.ID, sc.Client)
+		}
+		if err := config.ValidateDeliveries(sc); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: %v", sc.ID, err)
+		}
+		if sc.IncludeOutOfMonthDays && sc.Period != weeklyPeriod {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: include_out_of_month_days is only for period weekly", sc.ID)
+		}
+		if b := config.GetBilling(sc); b != nil && b.RateUnit == "per_month" && hasEventKindRates(config.EventKinds) {
+			return nil, newRunError(exitConfigError, "config", "Failed to load config file: spreadsheet %s: rates of event_kinds are only for per_day and per_hour rates", sc.ID)
+		}
+	}
+	stateFile = config.StateFile
+	return &config, nil
+}
+
+// Returns the scopes of the run for the config
+func getAPIScopes(config *Config) []string {
+	scopes := []string{
+		"https://www.googleapis.com/auth/spreadsheets",
+		"https://www.googleapis.com/auth/drive",
+	}
+	if config.NeedsCalendarScope() {
+		scopes = append(scopes, calendar.CalendarReadonlyScope)
+	}
+	// Drafts need the compose scope, which also allows sending
+	if draftEmail {
+		scopes = append(scopes, gmail.GmailComposeScope)
+	} else if sendEmailFlag {
+		scopes = append(scopes, gmail.GmailSendScope)
+	}
+	return scopes
+}
+
+func createAPIClient(ctx context.Context, config *Config) (*http.Client, error) {
+	return createScopedAPIClient(ctx, config, getAPIScopes(config))
+}
+
+// Returns the client of the scopes. A token of more scopes is used as is,
+// and a token lacking some of them is authorized again for the scopes it
+// has and the missing ones.
+func createScopedAPIClient(ctx context.Context, config *Config, scopes []string) (*http.Client, error) {
+	// Replays need no credentials
+	if replayDir != "" {
+		t, err := newReplayTransport(replayDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load recorded requests: %v", err)
+		}
+		log.Printf("Replaying requests recorded in %s\n", replayDir)
+		return &http.Client{Transport: newRateLimitTransport(t, 0)}, nil
+	}
+
+	// Get oauth token
+	store := auth.NewTokenStore(getPathSiblingOfExecutable(config.OAuth2TokenFileName))
+	token, granted, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load oauth token: %v", err)
+	}
+	missing := auth.MissingScopes(granted, scopes)
+	if token != nil && len(missing) > 0 {
+		if unattended {
+			return nil, newRunError(exitNeedsAuth, "auth", "Oauth token in %s lacks the scopes %s; run make-invoices interactively to authorize them", config.OAuth2TokenFileName, strings.Join(missing, " "))
+		}
+		fmt.Printf("The oauth token lacks the scopes %s, authorize again.\n", strings.Join(missing, " "))
+		// The new token replaces the saved one, so it keeps what that had
+		scopes = append(append([]string{}, granted...), missing...)
+		token = nil
+	}
+
+	// Create OAuth2 config
+	cred, err := ioutil.ReadFile(getPathSiblingOfExecutable(config.CredentialsFileName))
+	if err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to read credentials file: %v", err)
+	}
+	oauth2Conf, err := google.ConfigFromJSON(cred, scopes...)
+	if err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to make oauth2 config from json: %v", err)
+	}
+
+	if token == nil {
+		if unattended {
+			return nil, newRunError(exitNeedsAuth, "auth", "No oauth token in %s; run make-invoices interactively to authorize", config.OAuth2TokenFileName)
+		}
+		// From web
+		authURL := oauth2Conf.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+		fmt.Printf("Go to the following link in your browser then type the authorization code: \n%v\n", authURL)
+		fmt.Printf("Code: ")
+		authCode, err := readAuthCode()
+		if err != nil {
+			return nil, newRunError(exitNeedsAuth, "auth", "Unable to read authorization code: %v", err)
+		}
+		tok, err := oauth2Conf.Exchange(ctx, authCode)
+		if err != nil {
+			return nil, newRunError(exitNeedsAuth, "auth", "Unable to retrieve token from web: %w", err)
+		}
+		granted = auth.GrantedScopes(tok, scopes)
+		// Scopes left unchecked on the consent screen fail the requests
+		// needing them later
+		if missing := auth.MissingScopes(granted, scopes); len(missing) > 0 {
+			return nil, newRunError(exitNeedsAuth, "auth", "The scopes %s were not granted; authorize again allowing them", strings.Join(missing, " "))
+		}
+		if err := store.Save(tok, granted); err != nil {
+			return nil, fmt.Errorf("Unable to cache oauth token: %v", err)
+		}
+		token = tok
+	}
+
+	// Connections are given up on before api_timeout if the server doesn't
+	// answer at all
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if recordDir != "" {
+		t, err := newRecordTransport(transport, recordDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create record directory: %v", err)
+		}
+		log.Printf("Recording requests to %s\n", recordDir)
+		transport = t
+	}
+	limiter := newRateLimitTransport(transport, config.APIRequestsPerSecond)
+	if perMinute := config.GetSheetsWritesPerMinute(); perMinute > 0 {
+		limiter.writes = newWriteLimiter(perMinute)
+	}
+	base := &http.Client{Transport: limiter}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, base)
+	ts := auth.NewSavingTokenSource(ctx, oauth2Conf, store, granted, token)
+	// A token which can't be refreshed fails every request, so it is found
+	// out before starting
+	if _, err := ts.Token(); err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			if unattended {
+				return nil, newRunError(exitNeedsAuth, "auth", "Failed to refresh oauth token; run make-invoices interactively to authorize again: %w", err)
+			}
+			return nil, newRunError(exitNeedsAuth, "auth", "Failed to refresh oauth token (delete %s to authorize again): %w", config.OAuth2TokenFileName, err)
+		}
+		return nil, fmt.Errorf("Failed to get oauth token: %w", err)
+	}
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token, ts)), nil
+}
+
+// Returns the context of the run, which is canceled on interrupts and after
+// the deadline if it is not zero
+func newRunContext(deadline time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		stopSignals := stop
+		stop = func() {
+			cancel()
+			stopSignals()
+		}
+	}
+	runCtx = ctx
+	return ctx, stop
+}
+
+var defaultWeekdayNames = []string{"日", "月", "火", "水", "木", "金", "土"}
+
+// Returns the weekday written for a date, like "月", followed by
+// holiday_marker on holidays
+func formatWeekday(c *Config, date time.Time, holidays map[string]string) string {
+	names := c.WeekdayNames
+	if len(names) != 7 {
+		names = defaultWeekdayNames
+	}
+	format := c.WeekdayFormat
+	if format == "" {
+		format = "%s"
+	}
+	s := fmt.Sprintf(format, names[date.Weekday()])
+	if _, ok := holidays[date.Format("2006-01-02")]; ok {
+		s += c.HolidayMarker
+	}
+	return s
+}
+
+// dayRow holds the values written to a day's row of the timesheet
+type dayRow struct {
+	Start    string
+	End      string
+	Fraction string
+	Note     string
+	Location string
+	Weekday  string
+	DayNote  string
+	Leave    string
+	Break    string
+	Kind     string
+	// Set on days of leave without work, which are not counted as work
+	onLeave bool
+}
+
+// dayColumn is a column of the timesheet having a row for each day
+type dayColumn struct {
+	name string
+	// The setting of the range, which keys column_anchors
+	key   string
+	rng   string
+	value func(dayRow) string
+}
+
+// Day columns written only on days having values
+var sparseDayColumns = map[string]bool{
+	"notes": true,
+}
+
+// Returns the configured day columns with ranges of 31 rows
+func getDayColumns(config *Config) []dayColumn {
+	columns := make([]dayColumn, 0)
+	for _, c := range getAllDayColumns(config) {
+		if c.rng != "" {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// Returns the day columns, configured or not
+func getAllDayColumns(config *Config) []dayColumn {
+	return []dayColumn{
+		{"work times", "work_start_time_range", config.GetWorkStartTimeRange(), func(r dayRow) string { return r.Start }},
+		{"work end times", "work_end_time_range", config.WorkEndTimeRange, func(r dayRow) string { return r.End }},
+		{"work day fractions", "day_fraction_range", config.DayFractionRange, func(r dayRow) string { return r.Fraction }},
+		{"remarks", "remarks_range", config.RemarksRange, func(r dayRow) string { return r.Note }},
+		{"locations", "location_range", config.LocationRange, func(r dayRow) string { return r.Location }},
+		{"weekdays", "weekday_range", config.WeekdayRange, func(r dayRow) string { return r.Weekday }},
+		{"notes", "notes_range", config.NotesRange, func(r dayRow) string { return r.DayNote }},
+		{"leave", "leave_range", config.LeaveRange, func(r dayRow) string { return r.Leave }},
+		{"breaks", "break_range", config.BreakRange, func(r dayRow) string { return r.Break }},
+		{"kinds", "event_kind_range", config.EventKindRange, func(r dayRow) string {
+			if k := findEventKind(config.EventKinds, r.Kind); k != nil {
+				return k.CellValue()
+			}
+			return ""
+		}},
+	}
+}
+
+// Returns the configured day columns but the skipped ones, with the blocks
+// of rowCount rows of each by its range and the row layout
+func getColumnRuns(config *Config, namedRanges []*sheets.NamedRange, rowCount int, skippedColumns map[string]string) ([]dayColumn, map[string][]timesheet.Run, error) {
+	var dayRows []int
+	if config.RowLayout != nil {
+		var err error
+		if dayRows, err = config.RowLayout.Resolve(rowCount); err != nil {
+			return nil, nil, err
+		}
+	}
+	columns := make([]dayColumn, 0)
+	columnRuns := make(map[string][]timesheet.Run)
+	for _, c := range getDayColumns(config) {
+		if _, ok := skippedColumns[c.name]; ok {
+			continue
+		}
+		rng, err := timesheet.ResolveA1Range(c.rng, namedRanges)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve range of %s: %v", c.name, err)
+		}
+		// With a row layout, only the column of the range is used
+		if dayRows != nil {
+			columnRuns[c.name], err = timesheet.DayRuns(rng, dayRows)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse range of %s: %v", c.name, err)
+			}
+			columns = append(columns, c)
+			continue
+		}
+		if rng != c.rng {
+			rows, _, err := timesheet.A1RangeSize(rng)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse range of %s: %v", c.name, err)
+			}
+			if rows < rowCount {
+				return nil, nil, fmt.Errorf("range %s of %s has %d rows, which is fewer than %d days to write", c.rng, c.name, rows, rowCount)
+			}
+		}
+		rng, err = timesheet.ResizeA1Range(rng, rowCount)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse range of %s: %v", c.name, err)
+		}
+		columnRuns[c.name] = []timesheet.Run{{Range: rng, First: 0, Count: rowCount}}
+		columns = append(columns, c)
+	}
+	return columns, columnRuns, nil
+}
+
+// Returns rowCount rows having the days of the period from the first
+func buildDayRows(period billingPeriod, rowCount int, workDays, leaveDays []WorkDay, holidays map[string]string, config *Config, breaks *breakPolicy, sheetLoc *time.Location) []dayRow {
+	rows := make([]dayRow, rowCount)
+	for i := 0; i < period.days(); i++ {
+		date := period.day(i)
+		for _, d := range workDays {
+			if d.Date.Format("2006-01-02") == date.Format("2006-01-02") {
+				rows[i] = getDayRow(d, config, sheetLoc)
+				break
+			}
+		}
+		// Leave without work goes in the work times column unless there is
+		// a leave column
+		for _, d := range leaveDays {
+			if d.Date.Format("2006-01-02") != date.Format("2006-01-02") {
+				continue
+			}
+			if rows[i] == (dayRow{}) {
+				rows[i].onLeave = true
+				if config.LeaveRange == "" {
+					rows[i].Start = d.Leave
+				}
+			}
+			rows[i].Leave = d.Leave
+			break
+		}
+		// Weekdays are written for every day, since a copied sheet has the
+		// ones of the previous month
+		rows[i].Weekday = formatWeekday(config, date, holidays)
+		// The break is written for the days having both times
+		if config.BreakRange != "" && rows[i].Start != "" && rows[i].End != "" && !rows[i].onLeave {
+			start, err1 := parseClock(rows[i].Start)
+			end, err2 := parseClock(rows[i].End)
+			if err1 == nil && err2 == nil {
+				_, brk := breaks.workDuration(start, end)
+				rows[i].Break = formatBreak(brk)
+			}
+		}
+	}
+	return rows
+}
+
+// Description overrides beat event times, which beat config defaults.
+func getDayRow(d WorkDay, config *Config, loc *time.Location) dayRow {
+	r := dayRow{
+		Start:    config.WorkStartTime.Get(d.Date.Weekday()),
+		End:      config.WorkEndTime.Get(d.Date.Weekday()),
+		Fraction: "1",
+	}
+	if d.isHalfDay(config.HalfDayThresholdHours) {
+		r.Fraction = "0.5"
+		if config.HalfDayStartTime != "" {
+			r.Start = config.HalfDayStartTime
+		}
+	}
+	if config.TimeSource == "event" {
+		if !d.Start.IsZero() {
+			r.Start = d.Start.In(loc).Format("15:04")
+		}
+		if !d.End.IsZero() {
+			var remainder string
+			r.End, remainder = formatEndTime(d.Start, d.End, loc, config.ExtendedHours)
+			if remainder != "" {
+				r.Note = "ends " + remainder + " next day"
+			}
+		}
+	}
+	if d.Overrides.Start != "" {
+		r.Start = d.Overrides.Start
+	}
+	if d.Overrides.End != "" {
+		r.End = d.Overrides.End
+	}
+	if d.Overrides.Note != "" {
+		r.Note = d.Overrides.Note
+	}
+	r.Location = config.LocationDefault
+	if d.Location != "" {
+		r.Location = d.Location
+	}
+	if config.NotesRange != "" {
+		r.DayNote = d.note(config.NotesMaxLength)
+	}
+	r.Kind = d.Kind
+	return r
+}
+
+// Formats the end of a shift starting on the day of start. Ends past midnight
+// are written as extended hours like "26:00", or clamped to "24:00" with the
+// end time on the next day returned as remainder.
+func formatEndTime(start, end time.Time, loc *time.Location, extended bool) (value, remainder string) {
+	start, end = start.In(loc), end.In(loc)
+	startDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	minutes := int(end.Sub(startDay).Minutes())
+	if minutes < 24*60 {
+		return end.Format("15:04"), ""
+	}
+	if extended || minutes == 24*60 {
+		return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60), ""
+	}
+	return "24:00", end.Format("15:04")
+}
+
+// Returns the most recent month sheet before the target month, searching
+// back at most copy_source_max_months_back months (12 by default)
+func findCopySourceSheet(spreadsheet *sheets.Spreadsheet, targetTime time.Time, config *Config) (*sheets.Sheet, error) {
+	maxMonthsBack := config.CopySourceMaxMonthsBack
+	if maxMonthsBack <= 0 {
+		maxMonthsBack = 12
+	}
+	limit := targetTime.AddDate(0, -maxMonthsBack, 0)
+
+	months, err := timesheet.MonthSheets(spreadsheet, targetTime.Location())
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine sheet to copy: %v", err)
+	}
+	var copyFrom *sheets.Sheet
+	var copyFromMonth time.Time
+	titles := make([]string, 0, len(spreadsheet.Sheets))
+	for _, s := range spreadsheet.Sheets {
+		titles = append(titles, s.Properties.Title)
+	}
+	for _, s := range months {
+		month, _ := timesheet.ParseMonthTitle(s.Properties.Title, targetTime.Location())
+		if !month.Before(targetTime) {
+			continue
+		}
+		if copyFrom == nil || month.After(copyFromMonth) {
+			copyFrom, copyFromMonth = s, month
+		}
+	}
+	if copyFrom == nil {
+		return nil, fmt.Errorf("failed to determine sheet to copy: no month sheet before %s (sheets: %s)", targetTime.Format("200601"), strings.Join(titles, ", "))
+	}
+	if copyFromMonth.Before(limit) {
+		return nil, fmt.Errorf("failed to determine sheet to copy: latest month sheet %s is more than %d months old (see copy_source_max_months_back)", copyFrom.Properties.Title, maxMonthsBack)
+	}
+	return copyFrom, nil
+}
+
+// Duplicates the source sheet as the first sheet titled title. If a sheet
+// of the title was created meanwhile, it is returned with created false.
+func createMonthSheet(sht *sheets.Service, spreadsheetID string, source *sheets.Sheet, title string) (sheetID int64, created bool, err error) {
+	var resp *sheets.BatchUpdateSpreadsheetResponse
+	err = callAPI("duplicate sheet", func(ctx context.Context) (err error) {
+		resp, err = sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: []*sheets.Request{{
+				DuplicateSheet: &sheets.DuplicateSheetRequest{
+					SourceSheetId:    source.Properties.SheetId,
+					NewSheetName:     title,
+					InsertSheetIndex: 0,
+					ForceSendFields:  []string{"SourceSheetId", "InsertSheetIndex"},
+				},
+			}},
+		}).Context(ctx).Do()
+		return
+	})
+	if err == nil {
+		return resp.Replies[0].DuplicateSheet.Properties.SheetId, true, nil
+	}
+	// Requests rejected as invalid are the sheet of the title existing, or
+	// duplicating being refused for the source, which copying may not be.
+	// Other errors are not worked around.
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		return 0, false, fmt.Errorf("failed to duplicate sheet: %w", err)
+	}
+	spreadsheet, getErr := getSpreadsheet(sht, spreadsheetID, spreadsheetSheetsFields)
+	if getErr != nil {
+		return 0, false, fmt.Errorf("failed to get spreadsheet: %v", getErr)
+	}
+	for _, s := range spreadsheet.Sheets {
+		if s.Properties.Title == title {
+			return s.Properties.SheetId, false, nil
+		}
+	}
+	logVerbose("Failed to duplicate sheet, copying it instead: %v\n", err)
+
+	// Copy within the spreadsheet, then rename and move the copy
+	var dest *sheets.SheetProperties
+	if err := callAPI("copy sheet", func(ctx context.Context) (err error) {
+		dest, err = sht.Spreadsheets.Sheets.CopyTo(spreadsheetID, source.Properties.SheetId, &sheets.CopySheetToAnotherSpreadsheetRequest{
+			DestinationSpreadsheetId: spreadsheetID,
+		}).Context(ctx).Do()
+		return
+	}); err != nil {
+		return 0, false, fmt.Errorf("failed to copy sheet: %v", err)
+	}
+	if err := callAPI("update sheet properties", func(ctx context.Context) error {
+		_, err := sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: []*sheets.Request{{
+				UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+					Fields: "title,index",
+					Properties: &sheets.SheetProperties{
+						SheetId: dest.SheetId,
+						Title:   title,
+						Index:   0,
+					},
+				},
+			}},
+		}).Context(ctx).Do()
+		return err
+	}); err != nil {
+		return 0, false, fmt.Errorf("failed to update sheet position: %v", err)
+	}
+	return dest.SheetId, true, nil
+}
+
+// Returns the values of the cells of the sheet, "" for empty ones
+func getAnchorValues(sht *sheets.Service, spreadsheetID, sheetTitle string, cells []string) ([]string, error) {
+	ranges := make([]string, 0, len(cells))
+	for _, cell := range cells {
+		ranges = append(ranges, timesheet.QuoteSheetTitle(sheetTitle)+"!"+cell)
+	}
+	var got [][][]interface{}
+	if err := callAPI("get template anchors", func(ctx context.Context) (err error) {
+		got, err = newSheetReaderWriter(sht).GetValues(ctx, spreadsheetID, ranges, "FORMATTED_VALUE")
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get template anchors: %v", err)
+	}
+	values := make([]string, len(cells))
+	for i := range cells {
+		if i < len(got) {
+			if v := got[i]; len(v) > 0 && len(v[0]) > 0 {
+				values[i] = fmt.Sprint(v[0][0])
+			}
+		}
+	}
+	return values, nil
+}
+
+// Returns the anchor cells of the sheet not containing the expected text,
+// with the optional columns whose anchors don't. An empty template_anchors
+// disables the check of the template, not the one of column_anchors.
+func checkTemplateAnchors(sht *sheets.Service, spreadsheetID, sheetTitle string, config *Config) (*templateCheck, error) {
+	check := &templateCheck{mismatches: make([]string, 0), skippedColumns: make(map[string]string)}
+	anchors, cells := config.GetTemplateAnchors()
+	if len(cells) > 0 {
+		values, err := getAnchorValues(sht, spreadsheetID, sheetTitle, cells)
+		if err != nil {
+			return nil, err
+		}
+		for i, cell := range cells {
+			if !strings.Contains(values[i], anchors[cell]) {
+				check.mismatches = append(check.mismatches, fmt.Sprintf("%s: expected %q, actual %q", cell, anchors[cell], values[i]))
+			}
+		}
+	}
+	if err := checkColumnAnchors(sht, spreadsheetID, sheetTitle, config, check); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// Prompts are serialized as spreadsheets are processed in parallel
+var promptMu sync.Mutex
+
+func confirm(logger *log.Logger, prompt string) bool {
+	// Nobody answers in unattended runs, nor in runs of other programs
+	if unattended {
+		logger.Printf("%s%s\n", prompt, msg("answered_unattended"))
+		return false
+	}
+	if libraryRun {
+		logger.Printf("%s%s\n", prompt, msg("answered_library"))
+		return false
+	}
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	logger.Print(prompt)
+	ans, timedOut := readAnswer()
+	if timedOut {
+		return answerTimeout(logger.Printf)
+	}
+	return strings.ToLower(ans) == "y"
+}
+
+// reservedFiles keeps spreadsheets processed in parallel from writing the
+// same output file
+type reservedFiles struct {
+	mu     sync.Mutex
+	owners map[string]string
+	// Names of the files before made safe, by the safe names
+	originals map[string]string
+	// Output files written and skipped by on_existing_output, with the reasons
+	written []*outputFile
+	skipped []string
+	// pdf of each spreadsheet and its documents, merged into the combined pdf
+	pdfs        map[string]string
+	invoicePDFs map[string][]string
+	// Files of each spreadsheet put into the bundles
+	bundleFiles map[string][]bundleFile
+	// Files uploaded to drive, with the file IDs and links
+	uploaded []string
+	// Emails sent or drafted, with the message or draft IDs
+	emails []string
+	// Statuses of the deliveries of each spreadsheet, and the spreadsheets
+	// of which some failed
+	deliveries     map[string][]string
+	deliveryFailed map[string]bool
+	// Whether the outputs of each spreadsheet were sent to the client
+	sendStates map[string]string
+	// Work of each day of each spreadsheet, for the daily CSV
+	daily map[string][]*dailyRecord
+	// Invoice documents made, with the document IDs and links
+	documents []string
+	// Billing of each spreadsheet
+	billing map[string]*billingAmount
+	// Billing periods of the spreadsheets not billing calendar months
+	periods map[string]billingPeriod
+	// What each spreadsheet made, for the summary spreadsheet
+	records map[string]*spreadsheetRecord
+	// Layouts of the sheets written, saved when the spreadsheets succeed
+	fingerprints map[string]*TemplateFingerprint
+	// Copies of sandbox runs, with the links
+	sandboxes []string
+	// Work of the months before of each spreadsheet, and how the month
+	// differs from it
+	history   map[string][]monthWork
+	anomalies map[string][]string
+	// Updates made at the end of the run, and the ones dropped or failed
+	deferred       []*deferredUpdate
+	skippedUpdates []string
+}
+
+func (r *reservedFiles) reserve(name, owner string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if o, ok := r.owners[name]; ok {
+		return fmt.Errorf("output file %s is also written for spreadsheet %s", name, o)
+	}
+	r.owners[name] = owner
+	return nil
+}
+
+// Reserves the output file following on_existing_output if it already
+// exists. Returns "" if the file is to be skipped.
+func (r *reservedFiles) reserveOutput(name, owner, onExisting string, logger *log.Logger) (string, error) {
+	// Runs writing only the values make no outputs
+	if writeOnly {
+		return "", nil
+	}
+	if _, err := os.Stat(name); err != nil {
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to check output file %s: %v", name, err)
+		}
+		return name, r.reserve(name, owner)
+	}
+	switch onExisting {
+	case "overwrite":
+		logger.Printf("Overwriting existing output file %s\n", name)
+		return name, r.reserve(name, owner)
+	case "skip":
+		logger.Printf("Skipping existing output file %s\n", name)
+		r.mu.Lock()
+		r.skipped = append(r.skipped, fmt.Sprintf("%s (already exists)", name))
+		r.mu.Unlock()
+		return "", nil
+	case "suffix":
+		ext := filepath.Ext(name)
+		for i := 2; ; i++ {
+			n := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+			if _, err := os.Stat(n); err == nil {
+				continue
+			}
+			if err := r.reserve(n, owner); err != nil {
+				continue
+			}
+			logger.Printf("Output file %s exists, writing %s instead\n", name, n)
+			return n, nil
+		}
+	default:
+		return "", fmt.Errorf("output file %s already exists (set on_existing_output or use --force to overwrite)", name)
+	}
+}
+
+// Reserves the output of each format, returning the files to write, "" for
+// skipped ones, and the files having the output of each format, which are
+// the existing files for skipped ones, to be merged and attached as they are
+func reserveFormatOutputs(stem, spreadsheetID string, formats []*export.Format, files *reservedFiles, config *Config, logger *log.Logger) ([]string, map[string]string, error) {
+	fileNames := make([]string, 0, len(formats))
+	outputPaths := make(map[string]string)
+	for _, f := range formats {
+		name := files.safeFileName(stem, "."+f.Ext)
+		if name != stem+"."+f.Ext {
+			logger.Printf("Writing %s as %s\n", stem+"."+f.Ext, name)
+		}
+		reserved, err := files.reserveOutput(name, spreadsheetID, config.OnExistingOutput, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileNames = append(fileNames, reserved)
+		outputPaths[f.Name] = name
+		if reserved != "" {
+			outputPaths[f.Name] = reserved
+		}
+	}
+	return fileNames, outputPaths, nil
+}
+
+// Checks that the attachments of the email deliveries are among the outputs
+func checkEmailAttachments(sc *SpreadsheetConfig, outputPaths map[string]string, config *Config) error {
+	if !sendEmailFlag && !draftEmail {
+		return nil
+	}
+	for _, ec := range config.GetDeliveryEmails(sc) {
+		for _, a := range getEmailAttachments(ec) {
+			if a == "zip" {
+				if config.Bundle == nil || config.Bundle.ClientName == "" {
+					return fmt.Errorf("email attachment zip needs bundle.client_name")
+				}
+				continue
+			}
+			if _, ok := outputPaths[a]; !ok {
+				return fmt.Errorf("email attachment %s is not in export_formats", a)
+			}
+		}
+	}
+	return nil
+}
+
+// Hands the outputs to the hooks and delivers them to the client once all
+// of them are ready
+func deliverOutputs(drv *drive.Service, gml *gmail.Service, sc *SpreadsheetConfig, o *deliveryOutputs, fileNames []string, config *Config, files *reservedFiles, record *spreadsheetRecord, logger *log.Logger, progress *spreadsheetError) error {
+	progress.setStep("run hooks")
+	if config.Hooks != nil && len(config.Hooks.PostExport) > 0 {
+		outputs := make([]string, 0, len(fileNames))
+		for _, name := range fileNames {
+			if name != "" {
+				outputs = append(outputs, name)
+			}
+		}
+		if err := runPostExportHook(config.Hooks, o.targetTime, sc.ID, o.title, o.workDays, o.amount, outputs, o.outputPaths["pdf"], logger); err != nil {
+			return err
+		}
+	}
+
+	progress.setStep("deliver")
+	deliverToClient(drv, gml, sc, o, config, files, record, logger)
+	return nil
+}
+
+func updateAndDownloadWorkSpreadsheets(ctx context.Context, client *http.Client, targetTime time.Time, workDaysBySpreadsheet, leaveDaysBySpreadsheet map[string][]WorkDay, holidays map[string]string, config *Config, backup *Backup) ([]*SpreadsheetResult, error) {
+	s, err := getSession(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	sht, drv, dcs := s.sheets, s.drive, s.docs
+	var gml *gmail.Service
+	if sendEmailFlag || draftEmail {
+		if gml, err = gmail.NewService(ctx, getServiceOptions(client, "")...); err != nil {
+			return nil, fmt.Errorf("Failed to create gmail client: %v", err)
+		}
+	}
+	if !dryRun && !exportOnly {
+		if err := cleanUpSandboxCopies(drv, config); err != nil {
+			logWarnf(log.Default(), "Warning: failed to clean up sandbox copies: %v\n", err)
+		}
+	}
+
+	// Spreadsheets are processed in parallel up to --concurrency at a time
+	n := concurrency
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	files := &reservedFiles{owners: make(map[string]string), originals: make(map[string]string), pdfs: make(map[string]string), invoicePDFs: make(map[string][]string), bundleFiles: make(map[string][]bundleFile), deliveries: make(map[string][]string), deliveryFailed: make(map[string]bool), sendStates: make(map[string]string), daily: make(map[string][]*dailyRecord), billing: make(map[string]*billingAmount), periods: make(map[string]billingPeriod), records: make(map[string]*spreadsheetRecord), fingerprints: make(map[string]*TemplateFingerprint), history: make(map[string][]monthWork), anomalies: make(map[string][]string)}
+	spreadsheets := config.GetSpreadsheets()
+
+	// Fail before writing anything if the combined pdf can't be written
+	combinedFileName := ""
+	// Revisions are of some of the spreadsheets, so they make none
+	if config.CombinedPDFName != "" && !dryRun && !revise {
+		name, err := export.FormatNameTemplate("combined_pdf_name", config.CombinedPDFName, targetTime, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get combined pdf name: %v", err)
+		}
+		if combinedFileName, err = files.reserveOutput(export.SanitizeFilePath(name), "the combined pdf", config.OnExistingOutput, log.Default()); err != nil {
+			return nil, fmt.Errorf("Failed to reserve combined pdf: %v", err)
+		}
+	}
+	monthBundle := ""
+	if config.Bundle != nil && config.Bundle.MonthName != "" && !dryRun && !revise {
+		name, err := export.FormatNameTemplate("bundle.month_name", config.Bundle.MonthName, targetTime, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get month bundle name: %v", err)
+		}
+		if monthBundle, err = files.reserveOutput(export.SanitizeFilePath(name), "the month bundle", config.OnExistingOutput, log.Default()); err != nil {
+			return nil, fmt.Errorf("Failed to reserve month bundle: %v", err)
+		}
+	}
+	dailyCSV := ""
+	if !dryRun && !revise && !exportOnly {
+		if dailyCSV, err = reserveDailyCSV(targetTime, config, files); err != nil {
+			return nil, fmt.Errorf("Failed to reserve daily CSV: %v", err)
+		}
+	}
+	for _, sc := range spreadsheets {
+		if period := getBillingPeriod(config.ForSpreadsheet(sc), targetTime); !period.isMonth() {
+			files.periods[sc.ID] = period
+		}
+	}
+	errs := make([]error, len(spreadsheets))
+	skipped := make([]bool, len(spreadsheets))
+	endSpreadsheets := timePhase("spreadsheets")
+	var wg sync.WaitGroup
+	for i, sc := range spreadsheets {
+		wg.Add(1)
+		go func(i int, sc *SpreadsheetConfig) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			logger := log.New(log.Writer(), "["+sc.ID+"] ", log.Flags()|log.Lmsgprefix)
+			// Spreadsheets waiting when the run is interrupted are not started
+			if err := runCtx.Err(); err != nil {
+				errs[i] = fmt.Errorf("not processed: %v", err)
+				skipped[i] = true
+				logErrorf(logger, "Failed: %v\n", errs[i])
+				return
+			}
+			errs[i] = updateAndDownloadWorkSpreadsheet(sht, drv, dcs, gml, client, sc, targetTime, workDaysBySpreadsheet[sc.ID], leaveDaysBySpreadsheet[sc.ID], holidays, config, backup, files, logger)
+			if errs[i] != nil {
+				logErrorf(logger, "Failed: %v\n", errs[i])
+			}
+		}(i, sc)
+	}
+	wg.Wait()
+	runDeferredUpdates(files)
+	endSpreadsheets()
+	results := getSpreadsheetResults(spreadsheets, errs, files)
+
+	// The combined pdf has every spreadsheet in the config order, so it is
+	// made only when all of them succeeded
+	combined := false
+	if combinedFileName != "" {
+		pdfs := make([]string, 0, len(spreadsheets))
+		for i, sc := range spreadsheets {
+			if errs[i] != nil {
+				pdfs = nil
+				logWarnf(log.Default(), "Skipped combined pdf %s as a spreadsheet failed\n", combinedFileName)
+				files.skipped = append(files.skipped, fmt.Sprintf("%s (a spreadsheet failed)", combinedFileName))
+				break
+			}
+			if files.pdfs[sc.ID] == "" {
+				pdfs = nil
+				logWarnf(log.Default(), "Skipped combined pdf %s as spreadsheet %s is not exported in pdf\n", combinedFileName, sc.ID)
+				files.skipped = append(files.skipped, fmt.Sprintf("%s (spreadsheet %s has no pdf)", combinedFileName, sc.ID))
+				break
+			}
+			pdfs = append(pdfs, files.pdfs[sc.ID])
+			pdfs = append(pdfs, files.invoicePDFs[sc.ID]...)
+		}
+		if pdfs != nil {
+			if err := mergePDFFiles(pdfs, combinedFileName); err != nil {
+				return results, fmt.Errorf("Failed to make combined pdf: %v", err)
+			}
+			log.Printf("Merged %d pdfs into %s\n", len(pdfs), combinedFileName)
+			files.written = append(files.written, &outputFile{path: combinedFileName})
+			combined = true
+		}
+	}
+
+	// The month bundle is made only when all spreadsheets succeeded, so
+	// that it has the files of every one of them
+	if monthBundle != "" {
+		var bundleFiles []bundleFile
+		for i, sc := range spreadsheets {
+			if errs[i] != nil {
+				bundleFiles = nil
+				logWarnf(log.Default(), "Skipped month bundle %s as a spreadsheet failed\n", monthBundle)
+				files.skipped = append(files.skipped, fmt.Sprintf("%s (a spreadsheet failed)", monthBundle))
+				break
+			}
+			bundleFiles = append(bundleFiles, files.bundleFiles[sc.ID]...)
+		}
+		if bundleFiles != nil {
+			if combined {
+				bundleFiles = append(bundleFiles, bundleFile{path: combinedFileName})
+			}
+			if err := writeBundle(monthBundle, config.Bundle.GetMonthLayout(), targetTime, bundleFiles); err != nil {
+				return results, fmt.Errorf("Failed to make month bundle: %v", err)
+			}
+			log.Printf("Bundled %d files into %s\n", len(bundleFiles), monthBundle)
+			files.written = append(files.written, &outputFile{path: monthBundle})
+		}
+	}
+
+	// The daily CSV of every spreadsheet is written only when all of them
+	// succeeded, like the combined pdf
+	if dailyCSV != "" {
+		var records []*dailyRecord
+		for i, sc := range spreadsheets {
+			if errs[i] != nil {
+				records = nil
+				logWarnf(log.Default(), "Skipped daily CSV %s as a spreadsheet failed\n", dailyCSV)
+				files.skipped = append(files.skipped, fmt.Sprintf("%s (a spreadsheet failed)", dailyCSV))
+				break
+			}
+			records = append(records, files.daily[sc.ID]...)
+		}
+		if records != nil {
+			if err := writeDailyCSV(dailyCSV, records, getDailyCSV(config)); err != nil {
+				return results, fmt.Errorf("Failed to write daily CSV %s: %v", dailyCSV, err)
+			}
+			log.Printf("Wrote %d days to %s\n", len(records), dailyCSV)
+			files.written = append(files.written, &outputFile{path: dailyCSV})
+		}
+	} else if c := getDailyCSV(config); c != nil && c.PerClient && !dryRun && !revise && !exportOnly {
+		if err := writeClientDailyCSVs(targetTime, spreadsheets, errs, config, files); err != nil {
+			return results, fmt.Errorf("Failed to write daily CSVs: %v", err)
+		}
+	}
+
+	if len(files.written) > 0 {
+		paths := make([]string, 0, len(files.written))
+		for _, o := range files.written {
+			paths = append(paths, o.path)
+		}
+		log.Printf("Output files:\n%s", strings.Join(paths, "\n"))
+		if err := writeManifest(targetTime, files.written, files.records); err != nil {
+			return results, fmt.Errorf("Failed to write manifest: %v", err)
+		}
+		log.Printf("Wrote manifest %s\n", getManifestFilePath(targetTime))
+	}
+	if len(files.skipped) > 0 {
+		logWarnf(log.Default(), "Skipped output files:\n%s", strings.Join(files.skipped, "\n"))
+	}
+	if len(files.skippedUpdates) > 0 {
+		logWarnf(log.Default(), "Skipped sheet updates:\n%s", strings.Join(files.skippedUpdates, "\n"))
+	}
+	if len(files.uploaded) > 0 {
+		log.Printf("Uploaded to drive:\n%s", strings.Join(files.uploaded, "\n"))
+	}
+	if len(files.documents) > 0 {
+		log.Printf("Invoice documents:\n%s", strings.Join(files.documents, "\n"))
+	}
+	if len(files.emails) > 0 {
+		log.Printf("Emails:\n%s", strings.Join(files.emails, "\n"))
+	}
+	if len(files.sandboxes) > 0 {
+		log.Printf("Sandbox copies to review:\n%s", strings.Join(files.sandboxes, "\n"))
+	}
+	// The summary spreadsheet gets the numbers after every spreadsheet is
+	// done, so that they are final. Sandbox runs are not recorded.
+	if config.SummarySpreadsheetID != "" && !dryRun && !sandbox && !exportOnly {
+		if err := updateSummarySpreadsheet(sht, targetTime, spreadsheets, errs, files, config); err != nil {
+			logWarnf(log.Default(), "Warning: failed to update the summary spreadsheet: %v\n", err)
+		}
+	}
+	if config.AuditLogSpreadsheetID != "" && !dryRun && !sandbox {
+		if err := appendAuditLog(sht, drv, targetTime, spreadsheets, workDaysBySpreadsheet, errs, skipped, files, config); err != nil {
+			logWarnf(log.Default(), "Warning: failed to append to the audit log: %v\n", err)
+		}
+	}
+	logMetrics()
+	if err := appendMetricsFile(targetTime); err != nil {
+		logErrorf(log.Default(), "Failed to write metrics file: %v\n", err)
+	}
+
+	failed := make([]string, 0)
+	failures := make([]spreadsheetFailure, 0)
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", spreadsheets[i].ID, err))
+			failures = append(failures, newSpreadsheetFailure(spreadsheets[i], err))
+		}
+	}
+	var hookErr error
+	if config.Hooks != nil && len(config.Hooks.PostRun) > 0 && !dryRun {
+		hookErr = runPostRunHook(config.Hooks, targetTime, spreadsheets, workDaysBySpreadsheet, errs, files)
+	}
+	if config.Notify != nil && config.Notify.WebhookURL != "" && !dryRun {
+		notifyRun(config.Notify, buildRunSummary(targetTime, spreadsheets, workDaysBySpreadsheet, errs, files), len(failed) > 0 || hookErr != nil || len(files.deliveryFailed) > 0)
+	}
+	if unattended {
+		printRunSummaryJSON(buildHookRunSummary(targetTime, spreadsheets, workDaysBySpreadsheet, errs, files))
+	} else {
+		logSpreadsheetResults(spreadsheets, errs, files)
+	}
+	if !dryRun && !sandbox {
+		if err := saveLastRun(targetTime, spreadsheets, errs, files); err != nil {
+			logErrorf(log.Default(), "Failed to save the result of the run: %v\n", err)
+		}
+	}
+	if len(failed) > 0 {
+		err := newRunError(exitFailure, "spreadsheets", "Failed to process %d of %d spreadsheets:\n%s", len(failed), len(spreadsheets), strings.Join(failed, "\n"))
+		if errors.Is(runCtx.Err(), context.Canceled) {
+			err.code, err.category = exitCanceled, "canceled"
+		} else if len(failed) < len(spreadsheets) {
+			err.code, err.category = exitPartialSuccess, "partial_failure"
+		}
+		err.failures = failures
+		return results, err
+	}
+	if hookErr != nil {
+		return results, fmt.Errorf("Failed to run hook: %v", hookErr)
+	}
+	// The outputs were made for every spreadsheet, but did not reach some
+	// of the clients
+	if len(files.deliveryFailed) > 0 {
+		undelivered := make([]string, 0, len(files.deliveryFailed))
+		for _, sc := range spreadsheets {
+			if files.deliveryFailed[sc.ID] {
+				undelivered = append(undelivered, fmt.Sprintf("%s: %s", sc.ID, formatDeliveries(files, sc.ID)))
+			}
+		}
+		return results, newRunError(exitPartialSuccess, "delivery", "Failed to deliver the outputs of %d of %d spreadsheets:\n%s", len(undelivered), len(spreadsheets), strings.Join(undelivered, "\n"))
+	}
+	return results, nil
+}
+
+// spreadsheetError is the error of a spreadsheet with the step that failed
+type spreadsheetError struct {
+	title     string
+	step      string
+	stepStart time.Time
+	err       error
+}
+
+// Moves on to the step, adding the time of the last one to the metrics
+func (e *spreadsheetError) setStep(step string) {
+	metrics.addPhase("spreadsheet/"+e.step, time.Since(e.stepStart))
+	e.step, e.stepStart = step, time.Now()
+}
+
+func (e *spreadsheetError) Error() string {
+	return e.err.Error()
+}
+
+func (e *spreadsheetError) Unwrap() error {
+	return e.err
+}
+
+// Processes the spreadsheet, returning a *spreadsheetError on failure
+func updateAndDownloadWorkSpreadsheet(sht *sheets.Service, drv *drive.Service, dcs *docs.Service, gml *gmail.Service, client *http.Client, sc *SpreadsheetConfig, targetTime time.Time, workDays, leaveDays []WorkDay, holidays map[string]string, config *Config, backup *Backup, files *reservedFiles, logger *log.Logger) error {
+	progress := &spreadsheetError{step: "get spreadsheet", stepStart: time.Now()}
+	// Sandbox runs do everything the same way on a copy
+	if sandbox {
+		copied, err := createSandboxCopy(drv, sc.ID, backup.RunID, config)
+		if err != nil {
+			progress.err = err
+			return progress
+		}
+		logger.Printf("Writing to sandbox copy %s\n", copied.WebViewLink)
+		files.mu.Lock()
+		files.sandboxes = append(files.sandboxes, fmt.Sprintf("%s: %s", sc.ID, copied.WebViewLink))
+		files.mu.Unlock()
+		c := *sc
+		c.SandboxID = copied.Id
+		sc = &c
+	}
+	var err error
+	if exportOnly {
+		err = exportWorkSpreadsheet(sht, drv, gml, client, sc, targetTime, config, files, logger, progress)
+	} else {
+		err = processWorkSpreadsheet(sht, drv, dcs, gml, client, sc, targetTime, workDays, leaveDays, holidays, config, backup, files, logger, progress)
+	}
+	metrics.addPhase("spreadsheet/"+progress.step, time.Since(progress.stepStart))
+	if err != nil {
+		progress.err = err
+		return progress
+	}
+	// The layout written to is the one to compare later runs with
+	files.mu.Lock()
+	fingerprint := files.fingerprints[sc.ID]
+	files.mu.Unlock()
+	if fingerprint != nil && !dryRun && !sandbox {
+		if err := saveTemplateFingerprint(sc.ID, fingerprint); err != nil {
+			logWarnf(logger, "Warning: failed to save the template fingerprint: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// Subcommands taking the arguments after their name
+var subcommands = map[string]func(args []string) error{
+	"rollback":      runRollback,
+	"verify":        runVerify,
+	"check":         runCheck,
+	"numbers":       runNumbers,
+	"promote":       runPromote,
+	"state":         runState,
+	"remind":        runRemind,
+	"report":        runReport,
+	"backfill":      runBackfill,
+	"self-update":   runSelfUpdate,
+	"archive":       runArchive,
+	"clients":       runClients,
+	"lint-template": runLintTemplate,
+}
+
+// Sets the version of the command, told by serve and self-update
+func SetVersion(v string) {
+	version = v
+}
+
+// Returns the subcommand of the name, which takes the arguments after it
+func Subcommand(name string) (func(args []string) error, bool) {
+	cmd, ok := subcommands[name]
+	return cmd, ok
+}
+
+// Logs the error ending the command, writes the error report and returns
+// the exit code of the process
+func ReportError(err error) int {
+	return reportRunError(err)
+}
+
+// Sets on_existing_output to its default, fail or overwrite with --force,
+// and checks it
+func checkOnExistingOutput(config *Config) error {
+	switch config.OnExistingOutput {
+	case "":
+		config.OnExistingOutput = "fail"
+		if force {
+			config.OnExistingOutput = "overwrite"
+		}
+	case "fail", "skip", "suffix", "overwrite":
+	default:
+		return newRunError(exitConfigError, "config", "Unknown on_existing_output: %q (must be fail, skip, suffix or overwrite)", config.OnExistingOutput)
+	}
+	return nil
+}
+
+// Returns the holidays to mark in the weekday column, for the days of every
+// billing period
+func getRunHolidays(ctx context.Context, client *http.Client, config *Config, targetTime time.Time) (map[string]string, error) {
+	if config.WeekdayRange == "" || config.HolidayMarker == "" {
+		return make(map[string]string), nil
+	}
+	holidays, err := getHolidays(ctx, client, config, targetTime)
+	if err != nil {
+		return nil, err
+	}
+	add := func(c *Config, month time.Time) error {
+		h, err := getHolidays(ctx, client, c, month)
+		for date, name := range h {
+			holidays[date] = name
+		}
+		return err
+	}
+	for _, sc := range config.GetSpreadsheets() {
+		if sc.BillingPeriod != nil {
+			if err := add(config.ForSpreadsheet(sc), targetTime); err != nil {
+				return nil, err
+			}
+		}
+		if sc.Period == weeklyPeriod && sc.IncludeOutOfMonthDays {
+			for _, month := range []time.Time{targetTime.AddDate(0, -1, 0), targetTime.AddDate(0, 1, 0)} {
+				if err := add(config.ForSpreadsheet(sc), month); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return holidays, nil
+}
+
+// Returns the work days and the leave days of the month of each
+// spreadsheet to process. Spreadsheets with fewer work days than
+// min_work_days fail the run unless allowEmpty.
+func resolveRunWorkDays(ctx context.Context, client *http.Client, config *Config, targetTime time.Time, allowEmpty bool) (map[string][]WorkDay, map[string][]WorkDay, error) {
+	// Spreadsheets having the same calendars and filters share the result
+	calendarResolver := &calendarWorkDayResolver{config: config}
+	calendarResolvers := make(map[string]*calendarWorkDayResolver)
+	csvResolvers := make(map[string]*csvWorkDayResolver)
+	mergedResolvers := make(map[string]*mergedWorkDayResolver)
+	workDays := make(map[string][]WorkDay)
+	leaveDays := make(map[string][]WorkDay)
+	minWorkDays := config.MinWorkDays
+	if minWorkDays < 1 {
+		minWorkDays = 1
+	}
+	ownFilters := false
+	// Exports write nothing from the calendar
+	calendarSpreadsheets := config.GetSpreadsheets()
+	if exportOnly {
+		calendarSpreadsheets = nil
+	}
+	for _, sc := range calendarSpreadsheets {
+		scConfig, resolver := config, workDayResolver(calendarResolver)
+		if sc.HasOwnFilters() {
+			ownFilters = true
+			scConfig = config.ForSpreadsheet(sc)
+			key := strings.Join(scConfig.GetCalendarIDs(), ",") + "/" + scConfig.WorkEventKind() + "/" + getBillingPeriod(scConfig, targetTime).key()
+			if _, ok := calendarResolvers[key]; !ok {
+				calendarResolvers[key] = &calendarWorkDayResolver{config: scConfig}
+			}
+			resolver = calendarResolvers[key]
+		}
+		// The work CSV is read once for each billing period
+		if config.WorkSource == "csv" {
+			key := getBillingPeriod(scConfig, targetTime).key()
+			if _, ok := csvResolvers[key]; !ok {
+				csvResolvers[key] = &csvWorkDayResolver{config: scConfig}
+			}
+			resolver = csvResolvers[key]
+		}
+		if config.WorkSource == "merge" {
+			key := strings.Join(scConfig.GetCalendarIDs(), ",") + "/" + scConfig.WorkEventKind() + "/" + getBillingPeriod(scConfig, targetTime).key()
+			if _, ok := mergedResolvers[key]; !ok {
+				mergedResolvers[key] = &mergedWorkDayResolver{config: scConfig}
+			}
+			resolver = mergedResolvers[key]
+		}
+		days, err := newWorkDayResolver(scConfig, sc, resolver).resolveWorkDays(ctx, client, targetTime)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolveEventKinds(scConfig, days)
+		leaves, err := getLeaveDays(ctx, client, scConfig, targetTime)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(leaves) > 0 {
+			days = applyLeaveDays(days, leaves, sc.WorkDayRule != nil)
+			leaveDays[sc.ID] = leaves
+		}
+		if len(days) < minWorkDays && !allowEmpty {
+			printWorkDayDiagnostics(ctx, client, scConfig, targetTime)
+			return nil, nil, newRunError(exitNoWorkDays, "no_work_days", "Found %d work days for spreadsheet %s, fewer than %d; check the calendar and the work day title (use --allow-empty to proceed anyway)", len(days), sc.ID, minWorkDays)
+		}
+		workDays[sc.ID] = days
+		// Week sheets may have the days of the adjacent months
+		if sc.Period == weeklyPeriod && sc.IncludeOutOfMonthDays {
+			outOfMonth, err := resolveOutOfMonthDays(ctx, client, scConfig, sc, targetTime)
+			if err != nil {
+				return nil, nil, err
+			}
+			setOutOfMonthDays(sc, outOfMonth)
+		}
+	}
+
+	// With filters per spreadsheet, days matching the global filters may be
+	// counted by none of the spreadsheets
+	if ownFilters {
+		for _, sc := range config.GetSpreadsheets() {
+			log.Printf("Spreadsheet %s: %d work days\n", sc.ID, len(workDays[sc.ID]))
+		}
+		if (config.WorkDayTitle != "" || len(config.WorkDayTitles) > 0) && config.WorkSource != "csv" {
+			counted := make(map[string]bool)
+			for _, days := range workDays {
+				for _, d := range days {
+					counted[d.Date.Format("2006-01-02")] = true
+				}
+			}
+			uncounted := make([]string, 0)
+			days, err := calendarResolver.resolveWorkDays(ctx, client, targetTime)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, d := range days {
+				if !counted[d.Date.Format("2006-01-02")] {
+					uncounted = append(uncounted, d.Date.Format("2006-01-02"))
+				}
+			}
+			if len(uncounted) > 0 {
+				logWarnf(log.Default(), "Warning: %d work days are counted by no spreadsheet: %s\n", len(uncounted), strings.Join(uncounted, ", "))
+			}
+		}
+	}
+	return workDays, leaveDays, nil
+}
+
+// CommandRun is a run of the command set up from its arguments, whose
+// invoices are made through package invoices
+type CommandRun struct {
+	Config  *Config
+	Client  *http.Client
+	Context context.Context
+	// First day of the month of the run
+	Month time.Time
+	// Runs of export export the month sheets without reading the calendar
+	ExportOnly bool
+	// Options of the runs of the flags
+	Options RunOptions
+	stop    func()
+	// Prints the notice of a newer version, if any
+	printUpdateNotice func(wait time.Duration)
+}
+
+// Ends the run, stopping its context
+func (r *CommandRun) Close() {
+	r.printUpdateNotice(updateNoticeWait)
+	r.stop()
+}
+
+// Sets up the run of the arguments of the command, like "revise 202404
+// --only <ID>", parsing the flags, reading the config, asking for the month
+// and creating the API client. It returns nil if there is nothing to run.
+func StartRun(args []string) (*CommandRun, error) {
+	// Revisions are runs taking the flags of runs
+	if len(args) >= 1 && args[0] == "revise" {
+		revise = true
+		args = args[1:]
+	}
+	// So are exports, which are the same as runs with --export-only
+	if len(args) >= 1 && args[0] == "export" {
+		exportOnly = true
+		args = args[1:]
+	}
+	// Months are taken in the timezone of the config, now or as given.
+	// Months like -1 are taken before the flags, which they would be parsed
+	// as.
+	monthArg := ""
+	if len(args) >= 1 && monthsBackPattern.MatchString(args[0]) {
+		monthArg, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("make-invoices", flag.ContinueOnError)
+	fs.BoolVar(&verbose, "verbose", false, "print detailed logs")
+	fs.BoolVar(&quiet, "quiet", false, "log only warnings and errors")
+	fs.StringVar(&logFormat, "log-format", "text", "format of logs written to stderr: text or json")
+	fs.BoolVar(&dryRun, "dry-run", false, "show changes to the sheets without making them")
+	fs.BoolVar(&sandbox, "sandbox", false, "write to copies of the spreadsheets in sandbox_folder_id, to be promoted to the spreadsheets after review")
+	fs.IntVar(&concurrency, "concurrency", 3, "number of spreadsheets processed at a time")
+	fs.BoolVar(&force, "force", false, "overwrite values in the sheets, sheets locked by a previous run and existing output files")
+	fs.BoolVar(&strictDuplicates, "strict-duplicates", false, "abort when a day has more than one work event")
+	fs.BoolVar(&strictTemplate, "strict-template", false, "abort when the template changed since the last successful run")
+	fs.BoolVar(&applyRetentionFlag, "apply-retention", false, "delete or archive month sheets older than retention_months")
+	fs.BoolVar(&skipTemplateCheck, "skip-template-check", false, "write values without checking the template layout")
+	fs.BoolVar(&cleanupOrphans, "cleanup-orphans", false, "delete copies of month sheets left by interrupted runs, like \"Copy of 202403\", if they have the work times of their sources")
+	fs.BoolVar(&noVerify, "no-verify", false, "export without reading back the values written to the sheets")
+	fs.StringVar(&onExistingOutput, "on-existing-output", "", "what to do with existing output files: fail, skip, suffix or overwrite (overrides on_existing_output)")
+	fs.BoolVar(&sendEmailFlag, "send-email", false, "send the outputs to the email recipients of each spreadsheet")
+	fs.BoolVar(&draftEmail, "draft", false, "create gmail drafts of the emails instead of sending them")
+	fs.StringVar(&dailyCSVPath, "daily-csv", "", "write the work of each day of every spreadsheet to the CSV file (overrides daily_csv.name and per_client)")
+	fs.BoolVar(&resend, "resend", false, "send and upload the outputs even if the ones of the month were sent before")
+	fs.BoolVar(&exportOnly, "export-only", exportOnly, "export the existing month sheets again without reading the calendar or writing values")
+	fs.StringVar(&notifyOn, "notify-on", "always", "when to post the run summary to the notify webhook: always, failure or success")
+	allowEmpty := fs.Bool("allow-empty", false, "proceed even if no work days are found")
+	useCache := fs.Bool("cache", false, "reuse calendar results cached by recent runs")
+	deadline := fs.Duration("deadline", 0, "give up API calls still running after this long, e.g. 30m (0 for no limit)")
+	fs.BoolVar(&assumeYes, "yes", false, "start without asking to confirm the month")
+	fs.DurationVar(&confirmTimeout, "confirm-timeout", 0, "answer prompts on a terminal by --on-timeout after waiting this long, e.g. 30s (0 to wait forever)")
+	fs.StringVar(&onTimeout, "on-timeout", onTimeoutProceed, "how prompts timed out by --confirm-timeout are answered: proceed or abort")
+	fs.BoolVar(&unattended, "unattended", false, "run without any prompts, e.g. from cron: implies --yes, never starts the authorization flow, prints the run summary as JSON and notifies failures")
+	fs.StringVar(&logFile, "log-file", "", "also write logs to the file, with debug logs (overrides log_file)")
+	fs.StringVar(&metricsFile, "metrics-file", "", "append the metrics of the run to the file as a line of JSON")
+	fs.StringVar(&recordDir, "record", "", "save every API request and response to the directory, with credentials scrubbed")
+	fs.StringVar(&replayDir, "replay", "", "answer API requests with the ones saved by --record in the directory instead of the network")
+	onlyFailed := fs.Bool("only-failed", false, "process only the spreadsheets that failed in the last run for the month")
+	only := fs.String("only", "", "process only the spreadsheets of the IDs, separated by commas")
+	refresh := fs.Bool("refresh", false, "fetch calendar results again even if cached")
+	fs.BoolVar(refresh, "no-cache", false, "same as --refresh")
+	fs.StringVar(&errorJSON, "error-json", "", "write the details of failures as JSON to the file, or stderr with -")
+	fs.Usage = func() { printUsage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return nil, parseFlagsError(err)
+	}
+	if monthArg == "" && fs.NArg() >= 1 {
+		monthArg = fs.Arg(0)
+		// Flags may follow the month, as in "revise 202404 --only <ID>"
+		if revise || exportOnly {
+			if err := fs.Parse(fs.Args()[1:]); err != nil {
+				return nil, parseFlagsError(err)
+			}
+		}
+	}
+	if revise {
+		if monthArg == "" {
+			return nil, newRunError(exitConfigError, "config", "Usage: make-invoices revise <month> --only <IDs> [flags]")
+		}
+		if *only == "" {
+			return nil, newRunError(exitConfigError, "config", "revise needs --only with the spreadsheets to revise")
+		}
+		force = true
+	}
+	if monthArg == "" {
+		monthArg = "this"
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return nil, newRunError(exitConfigError, "config", "Unknown --log-format: %q (must be text or json)", logFormat)
+	}
+	if recordDir != "" && replayDir != "" {
+		return nil, newRunError(exitConfigError, "config", "--record and --replay can't be used together")
+	}
+	if verbose && quiet {
+		return nil, newRunError(exitConfigError, "config", "--verbose and --quiet can't be used together")
+	}
+	if sandbox && dryRun {
+		return nil, newRunError(exitConfigError, "config", "--sandbox and --dry-run can't be used together")
+	}
+	if onTimeout != onTimeoutProceed && onTimeout != onTimeoutAbort {
+		return nil, newRunError(exitConfigError, "config", "--on-timeout must be proceed or abort, not %q", onTimeout)
+	}
+	if exportOnly && (sandbox || revise) {
+		return nil, newRunError(exitConfigError, "config", "export can't be used with --sandbox or revise")
+	}
+	if sandbox && (sendEmailFlag || draftEmail) {
+		return nil, newRunError(exitConfigError, "config", "--sandbox can't send emails")
+	}
+	if notifyOn != "always" && notifyOn != "failure" && notifyOn != "success" {
+		return nil, newRunError(exitConfigError, "config", "Unknown --notify-on: %q (must be always, failure or success)", notifyOn)
+	}
+
+	// The config is read first for the timezone of the month and the locale
+	// of the prompt
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	loc, err := config.GetLocation()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	targetTime, err := parseMonthArg(monthArg, time.Now(), loc)
+	if err != nil {
+		return nil, newRunError(exitConfigError, "config", "Failed to parse date parameter: %v", err)
+	}
+
+	if assumeYes || unattended {
+		log.Printf("Making invoices for %s\n", targetTime.Format("200601"))
+	} else {
+		log.Print(msg("confirm_month", formatLocalMonth(targetTime)))
+		ans, timedOut := readAnswer()
+		if timedOut {
+			if !answerTimeout(log.Printf) {
+				return nil, newRunError(exitCanceled, "canceled", "Canceled")
+			}
+		} else if ans != "" && strings.ToLower(ans) != "y" {
+			return nil, newRunError(exitCanceled, "canceled", "Canceled")
+		}
+	}
+
+	ctx, stop := newRunContext(*deadline)
+	r := &CommandRun{
+		Config:            config,
+		Context:           ctx,
+		Month:             targetTime,
+		ExportOnly:        exportOnly,
+		Options:           RunOptions{Interactive: true, RequireWorkDays: !*allowEmpty, DryRun: dryRun},
+		stop:              stop,
+		printUpdateNotice: func(time.Duration) {},
+	}
+	// The run ends here unless it is returned with its client
+	defer func() {
+		if r.Client == nil {
+			r.Close()
+		}
+	}()
+	runNotify, runMonth = config.Notify, targetTime.Format("200601")
+	setupLogging(targetTime, config)
+
+	log.Println("Loaded config")
+	r.printUpdateNotice = startUpdateCheck(config, unattended)
+
+	if *onlyFailed {
+		if err := selectFailedSpreadsheets(config, targetTime); err != nil {
+			return nil, fmt.Errorf("Failed to select failed spreadsheets: %v", err)
+		}
+		if len(config.GetSpreadsheets()) == 0 {
+			log.Println("No spreadsheets failed in the last run")
+			return nil, nil
+		}
+		log.Printf("Processing %d spreadsheets failed in the last run\n", len(config.GetSpreadsheets()))
+	}
+	if *only != "" {
+		if err := selectSpreadsheets(config, strings.Split(*only, ",")); err != nil {
+			return nil, newRunError(exitConfigError, "config", "Failed to select spreadsheets: %v", err)
+		}
+		log.Printf("Processing %d spreadsheets\n", len(config.GetSpreadsheets()))
+	}
+
+	// Existing output files make the spreadsheet fail unless told otherwise
+	if onExistingOutput != "" {
+		config.OnExistingOutput = onExistingOutput
+	}
+	if err := checkOnExistingOutput(config); err != nil {
+		return nil, err
+	}
+
+	configureRetry(config)
+
+	endAuth := timePhase("auth")
+	client, err := createAPIClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	endAuth()
+
+	if *useCache || config.CalendarCacheTTL != "" {
+		ttl := defaultCalendarCacheTTL
+		if config.CalendarCacheTTL != "" {
+			ttl, err = time.ParseDuration(config.CalendarCacheTTL)
+			if err != nil {
+				return nil, newRunError(exitConfigError, "config", "Failed to parse calendar_cache_ttl: %v", err)
+			}
+		}
+		calCache = newCalendarCache(config, ttl, *refresh)
+	}
+
+	r.Client = client
+	return r, nil
+}
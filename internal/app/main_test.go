@@ -0,0 +1,131 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBuildDayRows(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	config := &Config{}
+	if err := json.Unmarshal([]byte(`"9:00"`), &config.WorkStartTime); err != nil {
+		t.Fatal(err)
+	}
+	period := getBillingPeriod(config, time.Date(2022, 2, 1, 0, 0, 0, 0, loc))
+	workDays := []WorkDay{
+		{Date: time.Date(2022, 1, 31, 0, 0, 0, 0, loc)},
+		{Date: time.Date(2022, 2, 1, 0, 0, 0, 0, loc)},
+		{Date: time.Date(2022, 2, 28, 0, 0, 0, 0, loc)},
+		{Date: time.Date(2022, 3, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, rowCount := range []int{28, 31} {
+		rows := buildDayRows(period, rowCount, workDays, nil, nil, config, nil, loc)
+		if len(rows) != rowCount {
+			t.Fatalf("got %d rows, want %d", len(rows), rowCount)
+		}
+		for i, r := range rows {
+			wantStart := ""
+			if i == 0 || i == 27 {
+				wantStart = "9:00"
+			}
+			if r.Start != wantStart {
+				t.Errorf("%d rows: row %d has start %q, want %q", rowCount, i, r.Start, wantStart)
+			}
+			// Rows after the last day of the month are left empty
+			if (r.Weekday == "") != (i >= 28) {
+				t.Errorf("%d rows: row %d has weekday %q", rowCount, i, r.Weekday)
+			}
+		}
+	}
+}
+
+func TestGetColumnRuns(t *testing.T) {
+	config := &Config{RemarksRange: "H7:H37"}
+	tests := []struct {
+		rowCount int
+		want     map[string]string
+	}{
+		{28, map[string]string{"work times": "D7:D34", "remarks": "H7:H34"}},
+		{30, map[string]string{"work times": "D7:D36", "remarks": "H7:H36"}},
+		{31, map[string]string{"work times": "D7:D37", "remarks": "H7:H37"}},
+	}
+	for _, tt := range tests {
+		columns, runs, err := getColumnRuns(config, nil, tt.rowCount, nil)
+		if err != nil {
+			t.Fatalf("getColumnRuns: %v", err)
+		}
+		if len(columns) != len(tt.want) {
+			t.Fatalf("%d rows: got %d columns, want %d", tt.rowCount, len(columns), len(tt.want))
+		}
+		for name, want := range tt.want {
+			r := runs[name]
+			if len(r) != 1 || r[0].Range != want || r[0].Count != tt.rowCount {
+				t.Errorf("%d rows: runs of %s are %+v, want %s", tt.rowCount, name, r, want)
+			}
+		}
+	}
+}
+
+func TestFormatEndTime(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	start := time.Date(2022, 6, 1, 21, 0, 0, 0, loc)
+	tests := []struct {
+		name          string
+		end           time.Time
+		extended      bool
+		wantValue     string
+		wantRemainder string
+	}{
+		{"same day", time.Date(2022, 6, 1, 23, 59, 0, 0, loc), false, "23:59", ""},
+		{"midnight", time.Date(2022, 6, 2, 0, 0, 0, 0, loc), false, "24:00", ""},
+		{"midnight extended", time.Date(2022, 6, 2, 0, 0, 0, 0, loc), true, "24:00", ""},
+		{"midnight in another timezone", time.Date(2022, 6, 1, 15, 0, 0, 0, time.UTC), false, "24:00", ""},
+		{"past midnight", time.Date(2022, 6, 2, 2, 30, 0, 0, loc), false, "24:00", "02:30"},
+		{"past midnight extended", time.Date(2022, 6, 2, 2, 30, 0, 0, loc), true, "26:30", ""},
+		{"a minute past midnight", time.Date(2022, 6, 2, 0, 1, 0, 0, loc), false, "24:00", "00:01"},
+		{"a minute past midnight extended", time.Date(2022, 6, 2, 0, 1, 0, 0, loc), true, "24:01", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, remainder := formatEndTime(start, tt.end, loc, tt.extended)
+			if value != tt.wantValue || remainder != tt.wantRemainder {
+				t.Errorf("got %q %q, want %q %q", value, remainder, tt.wantValue, tt.wantRemainder)
+			}
+		})
+	}
+}
+
+func TestBuildDayRowsOvernight(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	for _, tt := range []struct {
+		extended  bool
+		end       time.Time
+		wantEnd   string
+		wantNote  string
+		wantHours string
+	}{
+		{false, time.Date(2022, 6, 2, 0, 0, 0, 0, loc), "24:00", "", "3"},
+		{true, time.Date(2022, 6, 2, 2, 0, 0, 0, loc), "26:00", "", "5"},
+		{false, time.Date(2022, 6, 2, 2, 0, 0, 0, loc), "24:00", "ends 02:00 next day", "3"},
+	} {
+		config := &Config{TimeSource: "event", ExtendedHours: tt.extended}
+		period := getBillingPeriod(config, time.Date(2022, 6, 1, 0, 0, 0, 0, loc))
+		breaks, err := getBreakPolicy(config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The shift is of the day it starts
+		workDays := []WorkDay{{Date: time.Date(2022, 6, 1, 0, 0, 0, 0, loc), Start: time.Date(2022, 6, 1, 21, 0, 0, 0, loc), End: tt.end}}
+		rows := buildDayRows(period, period.days(), workDays, nil, nil, config, breaks, loc)
+		if r := rows[0]; r.Start != "21:00" || r.End != tt.wantEnd || r.Note != tt.wantNote {
+			t.Errorf("ending %s: got row %s-%s %q, want 21:00-%s %q", tt.end.Format("01/02 15:04"), r.Start, r.End, r.Note, tt.wantEnd, tt.wantNote)
+		}
+		if rows[1].Start != "" {
+			t.Errorf("ending %s: got row of the next day %+v", tt.end.Format("01/02 15:04"), rows[1])
+		}
+		if hours, err := sumWorkHours(rows, breaks); err != nil || hours != tt.wantHours {
+			t.Errorf("ending %s: got %s hours (%v), want %s", tt.end.Format("01/02 15:04"), hours, err, tt.wantHours)
+		}
+	}
+}
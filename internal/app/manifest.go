@@ -0,0 +1,175 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Manifest records the output files of a run so that they can be verified
+// later. Files are sorted by path so that manifests diff cleanly.
+type Manifest struct {
+	TargetMonth string           `json:"target_month"`
+	Version     string           `json:"version"`
+	CreatedAt   time.Time        `json:"created_at"`
+	Files       []*ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Path          string `json:"path"`
+	SHA256        string `json:"sha256"`
+	Size          int64  `json:"size"`
+	Title         string `json:"title,omitempty"`
+	SpreadsheetID string `json:"spreadsheet_id,omitempty"`
+	SheetID       *int64 `json:"sheet_id,omitempty"`
+	WorkDays      *int   `json:"work_days,omitempty"`
+	// Revision of the invoice the file is of, and the invoice number of the
+	// original
+	Revision   int    `json:"revision,omitempty"`
+	RevisionOf string `json:"revision_of,omitempty"`
+}
+
+// outputFile is an output file written in the run
+type outputFile struct {
+	path string
+	// Title of the spreadsheet, which may differ from the file name
+	title         string
+	spreadsheetID string
+	sheetID       *int64
+	workDays      *int
+}
+
+func getManifestFilePath(targetTime time.Time) string {
+	return fmt.Sprintf("manifest-%s.json", targetTime.Format("200601"))
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// Writes the manifest of the outputs of the run. Revisions keep the files
+// of the manifest written before, so that it has the originals too, and so
+// do exports, keeping the work days of the files exported again.
+func writeManifest(targetTime time.Time, outputs []*outputFile, records map[string]*spreadsheetRecord) error {
+	manifest := &Manifest{
+		TargetMonth: targetTime.Format("200601"),
+		Version:     version,
+		CreatedAt:   time.Now(),
+		Files:       make([]*ManifestEntry, 0, len(outputs)),
+	}
+	written := make(map[string]bool)
+	for _, o := range outputs {
+		written[o.path] = true
+	}
+	previousWorkDays := make(map[string]*int)
+	if revise || exportOnly {
+		d, err := ioutil.ReadFile(getManifestFilePath(targetTime))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read manifest: %v", err)
+		}
+		if err == nil {
+			var previous Manifest
+			if err := json.Unmarshal(d, &previous); err != nil {
+				return fmt.Errorf("failed to decode manifest: %v", err)
+			}
+			for _, e := range previous.Files {
+				previousWorkDays[e.Path] = e.WorkDays
+				if !written[e.Path] {
+					manifest.Files = append(manifest.Files, e)
+				}
+			}
+		}
+	}
+	for _, o := range outputs {
+		sum, size, err := hashFile(o.path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %v", o.path, err)
+		}
+		entry := &ManifestEntry{
+			Path:          o.path,
+			SHA256:        sum,
+			Size:          size,
+			Title:         o.title,
+			SpreadsheetID: o.spreadsheetID,
+			SheetID:       o.sheetID,
+			WorkDays:      o.workDays,
+		}
+		if entry.WorkDays == nil {
+			entry.WorkDays = previousWorkDays[o.path]
+		}
+		if record := records[o.spreadsheetID]; record != nil && o.spreadsheetID != "" {
+			entry.Revision, entry.RevisionOf = record.revision, record.revisionOf
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	d, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(getManifestFilePath(targetTime), append(d, '\n'), 0666); err != nil {
+		return fmt.Errorf("failed to save manifest: %v", err)
+	}
+	return nil
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices verify <manifest>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("Failed to open manifest: %v", err)
+	}
+	defer f.Close()
+	var manifest Manifest
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return fmt.Errorf("Failed to decode manifest: %v", err)
+	}
+
+	problems := 0
+	for _, e := range manifest.Files {
+		sum, size, err := hashFile(e.Path)
+		switch {
+		case os.IsNotExist(err):
+			logErrorf(log.Default(), "Missing: %s\n", e.Path)
+			problems++
+		case err != nil:
+			logErrorf(log.Default(), "Failed to hash %s: %v\n", e.Path, err)
+			problems++
+		case sum != e.SHA256 || size != e.Size:
+			logErrorf(log.Default(), "Mismatch: %s (sha256 %s, %d bytes in manifest; sha256 %s, %d bytes now)\n", e.Path, e.SHA256, e.Size, sum, size)
+			problems++
+		default:
+			logVerbose("OK: %s\n", e.Path)
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d of %d files don't match the manifest", problems, len(manifest.Files))
+	}
+	log.Printf("All %d files match the manifest\n", len(manifest.Files))
+	return nil
+}
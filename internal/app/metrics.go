@@ -0,0 +1,238 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricsFile string
+
+// runMetrics counts the API requests of the run, by the shared transport,
+// and the time taken by each phase
+type runMetrics struct {
+	mu              sync.Mutex
+	requests        map[string]int64
+	bytesDownloaded int64
+	retries         int64
+	throttled       int64
+	throttleWait    time.Duration
+	// Waits for the bucket of writes to Sheets, and the time of requests
+	// until their responses, summed over the requests made in parallel
+	writeLimited   int64
+	writeLimitWait time.Duration
+	network        time.Duration
+	phases         map[string]time.Duration
+	// Requests not made as their results were kept in the run
+	cacheHits map[string]int64
+}
+
+var metrics = &runMetrics{
+	requests:  make(map[string]int64),
+	phases:    make(map[string]time.Duration),
+	cacheHits: make(map[string]int64),
+}
+
+// metricsSummary is the metrics as logged and written to the metrics file.
+// Durations are in milliseconds.
+type metricsSummary struct {
+	Month           string           `json:"month,omitempty"`
+	Time            string           `json:"time,omitempty"`
+	Requests        map[string]int64 `json:"requests"`
+	BytesDownloaded int64            `json:"bytes_downloaded"`
+	Retries         int64            `json:"retries"`
+	Throttled       int64            `json:"throttled"`
+	ThrottleWaitMS  int64            `json:"throttle_wait_ms"`
+	WriteLimited    int64            `json:"write_limited"`
+	WriteLimitMS    int64            `json:"write_limit_wait_ms"`
+	NetworkMS       int64            `json:"network_ms"`
+	PhasesMS        map[string]int64 `json:"phases_ms"`
+	TotalMS         int64            `json:"total_ms"`
+	CacheHits       map[string]int64 `json:"cache_hits,omitempty"`
+}
+
+// Returns the API of the request, telling reads and writes of Sheets apart
+// as they have separate quotas. APIs are told by the paths, which are the
+// same on endpoints other than Google's.
+func getAPIService(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/export"):
+		return "export"
+	case strings.HasPrefix(path, "/v4/spreadsheets"):
+		if req.Method == http.MethodGet {
+			return "sheets_read"
+		}
+		return "sheets_write"
+	case strings.HasPrefix(path, "/calendar/"):
+		return "calendar"
+	case strings.HasPrefix(path, "/drive/"), strings.HasPrefix(path, "/upload/drive/"):
+		return "drive"
+	case strings.HasPrefix(path, "/v1/documents"):
+		return "docs"
+	case strings.HasPrefix(path, "/gmail/"), strings.HasPrefix(path, "/upload/gmail/"):
+		return "gmail"
+	case req.URL.Host == "oauth2.googleapis.com", path == "/token":
+		return "auth"
+	}
+	return "other"
+}
+
+func (m *runMetrics) countRequest(req *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[getAPIService(req)]++
+}
+
+func (m *runMetrics) countCacheHit(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cacheHits[name]++
+}
+
+func (m *runMetrics) countRetry() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries++
+}
+
+func (m *runMetrics) countThrottle(wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.throttled++
+	m.throttleWait += wait
+}
+
+func (m *runMetrics) countWriteLimitWait(wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeLimited++
+	m.writeLimitWait += wait
+}
+
+func (m *runMetrics) addNetworkTime(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.network += d
+}
+
+func (m *runMetrics) addPhase(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.phases[name] += d
+}
+
+// Starts timing the phase, which ends when the returned function is called
+func timePhase(name string) func() {
+	start := time.Now()
+	return func() {
+		metrics.addPhase(name, time.Since(start))
+	}
+}
+
+// countingReader counts the bytes of response bodies read
+type countingReader struct {
+	io.ReadCloser
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	metrics.mu.Lock()
+	metrics.bytesDownloaded += int64(n)
+	metrics.mu.Unlock()
+	return n, err
+}
+
+func (m *runMetrics) summary() *metricsSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &metricsSummary{
+		Requests:        make(map[string]int64, len(m.requests)),
+		BytesDownloaded: m.bytesDownloaded,
+		Retries:         m.retries,
+		Throttled:       m.throttled,
+		ThrottleWaitMS:  m.throttleWait.Milliseconds(),
+		WriteLimited:    m.writeLimited,
+		WriteLimitMS:    m.writeLimitWait.Milliseconds(),
+		NetworkMS:       m.network.Milliseconds(),
+		PhasesMS:        make(map[string]int64, len(m.phases)),
+		TotalMS:         time.Since(runStart).Milliseconds(),
+	}
+	for k, v := range m.requests {
+		s.Requests[k] = v
+	}
+	for k, v := range m.phases {
+		s.PhasesMS[k] = v.Milliseconds()
+	}
+	if len(m.cacheHits) > 0 {
+		s.CacheHits = make(map[string]int64, len(m.cacheHits))
+		for k, v := range m.cacheHits {
+			s.CacheHits[k] = v
+		}
+	}
+	return s
+}
+
+func formatCounts(counts map[string]int64, format func(int64) string) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+" "+format(counts[k]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func logMetrics() {
+	s := metrics.summary()
+	total := int64(0)
+	for _, n := range s.Requests {
+		total += n
+	}
+	count := func(n int64) string { return fmt.Sprint(n) }
+	ms := func(n int64) string { return (time.Duration(n) * time.Millisecond).Round(time.Millisecond).String() }
+	log.Printf("API requests: %d (%s), %d bytes downloaded, retries: %d, throttled: %d (waited %s)\n",
+		total, formatCounts(s.Requests, count), s.BytesDownloaded, s.Retries, s.Throttled, ms(s.ThrottleWaitMS))
+	log.Printf("Waited %s on the network, %s on the limit of writes (%d writes delayed)\n", ms(s.NetworkMS), ms(s.WriteLimitMS), s.WriteLimited)
+	if len(s.CacheHits) > 0 {
+		saved := int64(0)
+		for _, n := range s.CacheHits {
+			saved += n
+		}
+		log.Printf("API requests saved by caches: %d (%s)\n", saved, formatCounts(s.CacheHits, count))
+	}
+	log.Printf("Time: %s (%s)\n", ms(s.TotalMS), formatCounts(s.PhasesMS, ms))
+}
+
+// Appends the metrics of the run to --metrics-file as a line of JSON
+func appendMetricsFile(targetTime time.Time) error {
+	if metricsFile == "" {
+		return nil
+	}
+	s := metrics.summary()
+	s.Month = targetTime.Format("200601")
+	s.Time = runStart.Format(time.RFC3339)
+	d, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(metricsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(d, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+const monthArgForms = `202405, 2024-05, 2024/05, 2024年5月, "last" or "previous" for the previous month, "this" or "current", or -N for N months back`
+
+// Month arguments of N months back, like -1
+var monthsBackPattern = regexp.MustCompile(`^-[0-9]+$`)
+
+// Parses the month argument to the first day of the month in loc. Besides
+// the forms of month titles, it may be relative to now.
+func parseMonthArg(arg string, now time.Time, loc *time.Location) (time.Time, error) {
+	now = now.In(loc)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	switch arg {
+	case "this", "current":
+		return thisMonth, nil
+	case "last", "previous":
+		return thisMonth.AddDate(0, -1, 0), nil
+	}
+	if strings.HasPrefix(arg, "-") {
+		if n, err := strconv.Atoi(arg[1:]); err == nil && n >= 0 {
+			return thisMonth.AddDate(0, -n, 0), nil
+		}
+	}
+	if t, ok := timesheet.ParseMonthTitle(arg, loc); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid month %q (accepted: %s)", arg, monthArgForms)
+}
+
+// Checks that the existing sheet is of the month by its title and by the
+// date in its date cell, if any, which is the first day of the billing
+// period. A sheet of another month, e.g. copied by hand and renamed, is not
+// to be filled as the month's.
+func checkSheetMonth(sht *sheets.Service, spreadsheetID, sheetTitle, dateCell string, period billingPeriod, targetTime time.Time) error {
+	loc := targetTime.Location()
+	if month, ok := timesheet.ParseMonthTitle(sheetTitle, loc); !ok || month.Format("200601") != targetTime.Format("200601") {
+		return fmt.Errorf("title of sheet %s is not of %s", sheetTitle, targetTime.Format("200601"))
+	}
+	values, err := getRenderedRangeValues(sht, spreadsheetID, sheetTitle, []string{dateCell}, "UNFORMATTED_VALUE")
+	if err != nil {
+		return err
+	}
+	if len(values[0]) == 0 || len(values[0][0]) == 0 {
+		return nil
+	}
+	month, ok := timesheet.ParseCellMonth(values[0][0][0], loc)
+	if !ok {
+		return nil
+	}
+	if want := period.start.Format("200601"); month.Format("200601") != want {
+		return fmt.Errorf("sheet %s has a date of %s in the date cell %s, not of %s (the sheet may be of another month)", sheetTitle, month.Format("200601"), dateCell, want)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+func newTestSpreadsheet(sheetIDs map[string]int64, titles ...string) *sheets.Spreadsheet {
+	s := &sheets.Spreadsheet{}
+	for _, title := range titles {
+		s.Sheets = append(s.Sheets, &sheets.Sheet{
+			Properties: &sheets.SheetProperties{SheetId: sheetIDs[title], Title: title},
+		})
+	}
+	return s
+}
+
+func TestFindCopySourceSheet(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	target := time.Date(2022, 6, 1, 0, 0, 0, 0, loc)
+	tests := []struct {
+		name      string
+		titles    []string
+		ids       map[string]int64
+		config    Config
+		wantTitle string
+		wantErr   bool
+	}{
+		{
+			name:      "latest month before the target with ID 0",
+			titles:    []string{"Summary", "202204", "202205"},
+			ids:       map[string]int64{"Summary": 7, "202204": 3, "202205": 0},
+			wantTitle: "202205",
+		},
+		{
+			name:      "later months are not copied",
+			titles:    []string{"202207", "202203"},
+			ids:       map[string]int64{"202207": 0, "202203": 1},
+			wantTitle: "202203",
+		},
+		{
+			name:    "no month sheet before the target",
+			titles:  []string{"Summary", "202207"},
+			wantErr: true,
+		},
+		{
+			name:    "too old",
+			titles:  []string{"202201"},
+			config:  Config{CopySourceMaxMonthsBack: 3},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := findCopySourceSheet(newTestSpreadsheet(tt.ids, tt.titles...), target, &tt.config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got sheet %s", s.Properties.Title)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findCopySourceSheet: %v", err)
+			}
+			if s.Properties.Title != tt.wantTitle || s.Properties.SheetId != tt.ids[tt.wantTitle] {
+				t.Fatalf("got sheet %s (%d), want %s (%d)", s.Properties.Title, s.Properties.SheetId, tt.wantTitle, tt.ids[tt.wantTitle])
+			}
+		})
+	}
+}
+
+func TestLocateSheet(t *testing.T) {
+	loc := time.FixedZone("JST", 9*60*60)
+	target := time.Date(2022, 6, 1, 0, 0, 0, 0, loc)
+	gid := int64(7)
+	tests := []struct {
+		name      string
+		titles    []string
+		sc        SpreadsheetConfig
+		wantFound bool
+		wantTitle string
+		wantErr   bool
+	}{
+		{
+			name:      "sheet of the month with ID 0",
+			titles:    []string{"202205", "202206"},
+			wantFound: true,
+			wantTitle: "202206",
+		},
+		{
+			name:      "latest month sheet copied",
+			titles:    []string{"202204", "202205"},
+			wantTitle: "202205",
+		},
+		{
+			name:      "template sheet copied",
+			titles:    []string{"202205", "Template"},
+			sc:        SpreadsheetConfig{TemplateSheet: "Template"},
+			wantTitle: "Template",
+		},
+		{
+			name:    "no template sheet",
+			titles:  []string{"202205"},
+			sc:      SpreadsheetConfig{TemplateSheet: "Template"},
+			wantErr: true,
+		},
+		{
+			name:      "sheet of the spreadsheet URL copied",
+			titles:    []string{"Summary", "Timesheet"},
+			sc:        SpreadsheetConfig{GIDHint: &gid},
+			wantTitle: "Timesheet",
+		},
+		{
+			name:    "nothing to copy",
+			titles:  []string{"Summary"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := map[string]int64{"202206": 0, "202205": 1, "202204": 2, "Template": 3, "Summary": 4, "Timesheet": gid}
+			w := &workSpreadsheet{
+				sc:          &tt.sc,
+				config:      &Config{},
+				logger:      log.New(io.Discard, "", 0),
+				progress:    &spreadsheetError{},
+				targetTime:  target,
+				spreadsheet: newTestSpreadsheet(ids, tt.titles...),
+			}
+			err := w.locateSheet()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got found %v", w.found)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("locateSheet: %v", err)
+			}
+			if w.found != tt.wantFound || w.layoutSheet().Properties.Title != tt.wantTitle {
+				t.Fatalf("got found %v, sheet %s, want %v, %s", w.found, w.layoutSheet().Properties.Title, tt.wantFound, tt.wantTitle)
+			}
+			if w.found && w.targetSheetID != ids[tt.wantTitle] {
+				t.Errorf("got sheet ID %d, want %d", w.targetSheetID, ids[tt.wantTitle])
+			}
+			if w.sheetTitle != "202206" {
+				t.Errorf("got sheet title %s, want 202206", w.sheetTitle)
+			}
+		})
+	}
+}
+
+// fakeSheetReaderWriter has the values of ranges like "'202405'!M3", and
+// keeps the values written
+type fakeSheetReaderWriter struct {
+	spreadsheet *sheets.Spreadsheet
+	values      map[string][][]interface{}
+	written     []*sheets.ValueRange
+}
+
+func (f *fakeSheetReaderWriter) GetSpreadsheet(ctx context.Context, spreadsheetID string, fields googleapi.Field) (*sheets.Spreadsheet, error) {
+	return f.spreadsheet, nil
+}
+
+func (f *fakeSheetReaderWriter) GetValues(ctx context.Context, spreadsheetID string, ranges []string, valueRenderOption string) ([][][]interface{}, error) {
+	values := make([][][]interface{}, 0, len(ranges))
+	for _, r := range ranges {
+		values = append(values, f.values[r])
+	}
+	return values, nil
+}
+
+func (f *fakeSheetReaderWriter) UpdateValues(ctx context.Context, spreadsheetID string, data []*sheets.ValueRange) error {
+	f.written = append(f.written, data...)
+	return nil
+}
+
+func useFakeSheetReaderWriter(t *testing.T, f *fakeSheetReaderWriter) {
+	t.Helper()
+	saved := newSheetReaderWriter
+	newSheetReaderWriter = func(sht *sheets.Service) timesheet.SheetReaderWriter { return f }
+	t.Cleanup(func() { newSheetReaderWriter = saved })
+}
+
+func TestCheckSheetMonth(t *testing.T) {
+	loc := time.FixedZone("JST", 9*60*60)
+	target := time.Date(2024, 5, 1, 0, 0, 0, 0, loc)
+	period := getBillingPeriod(&Config{}, target)
+	tests := []struct {
+		name    string
+		title   string
+		date    interface{}
+		wantErr bool
+	}{
+		{"date of the month", "202405", 45413.0, false},
+		{"date text of the month", "2024年5月", "2024/5/1", false},
+		{"no date", "202405", nil, false},
+		{"date of another month", "202405", 45383.0, true},
+		{"title of another month", "202404", 45413.0, true},
+		{"title of no month", "Summary", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSheetReaderWriter{values: map[string][][]interface{}{}}
+			if tt.date != nil {
+				f.values["'"+tt.title+"'!M3"] = [][]interface{}{{tt.date}}
+			}
+			useFakeSheetReaderWriter(t, f)
+			err := checkSheetMonth(nil, "timesheet", tt.title, "M3", period, target)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSheetMonth() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckTemplateAnchors(t *testing.T) {
+	f := &fakeSheetReaderWriter{values: map[string][][]interface{}{
+		"'202405'!C6": {{"日付"}},
+		"'202405'!D6": {{"時刻"}},
+	}}
+	useFakeSheetReaderWriter(t, f)
+	check, err := checkTemplateAnchors(nil, "timesheet", "202405", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`D6: expected "開始", actual "時刻"`}; !reflect.DeepEqual(check.mismatches, want) {
+		t.Errorf("got %q, want %q", check.mismatches, want)
+	}
+	if len(check.skippedColumns) != 0 {
+		t.Errorf("got skipped columns %v, want none", check.skippedColumns)
+	}
+}
+
+// Values of the sheet are built in the order of the ranges, with a row for
+// each day of the runs
+func TestBuildData(t *testing.T) {
+	w := &workSpreadsheet{
+		targetTime: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		period:     billingPeriod{start: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), end: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		sheetTitle: "202405",
+		cellWriter: newValueWriter("", "ja_JP"),
+		dateCell:   "M3",
+		columns: []dayColumn{
+			{name: "start time", value: func(r dayRow) string { return r.Start }},
+			{name: "location", value: func(r dayRow) string { return r.Location }},
+		},
+		columnRuns: map[string][]timesheet.Run{
+			"start time": {{Range: "D7:D8", First: 0, Count: 2}},
+			"location":   {{Range: "H7:H7", First: 0, Count: 1}, {Range: "H9:H9", First: 1, Count: 1}},
+		},
+		invoiceNumberCell: "B2",
+		invoiceNumber:     "2024-001",
+		rows:              []dayRow{{Start: "09:00", Location: "在宅"}, {}},
+	}
+	if err := w.buildData(); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][][]interface{})
+	ranges := make([]string, 0)
+	for _, vr := range w.data {
+		got[vr.Range] = vr.Values
+		ranges = append(ranges, vr.Range)
+	}
+	if want := []string{"'202405'!M3", "'202405'!D7:D8", "'202405'!H7:H7", "'202405'!H9:H9", "'202405'!B2"}; !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("got ranges %q, want %q", ranges, want)
+	}
+	want := map[string][][]interface{}{
+		"'202405'!M3":    {{"2024/05/01"}},
+		"'202405'!D7:D8": {{"09:00"}, {""}},
+		"'202405'!H7:H7": {{"在宅"}},
+		"'202405'!H9:H9": {{""}},
+		"'202405'!B2":    {{"2024-001"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
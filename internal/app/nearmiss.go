@@ -0,0 +1,157 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tsujio/make-invoices/internal/calendarsource"
+	"golang.org/x/text/width"
+	"google.golang.org/api/calendar/v3"
+)
+
+// Events whose titles nearly match the work day titles, like "出勤 " or
+// "出勒" for "出勤", are listed when work days are found, as a typo would
+// lose the day silently. Interactive runs ask whether to count them as
+// work days, for the run only, and other runs only warn of them. The
+// decisions are in the run summary.
+var (
+	nearMissMu sync.Mutex
+	// Decisions on the events, by calendar and event ID, so that each is
+	// asked once however many spreadsheets have the calendar
+	nearMissDecided map[string]bool
+	// Decisions for the run summary, like "2024-05-01 "出勒" (included)"
+	nearMissDecisions []string
+)
+
+// Normalizes the title for comparison: full width letters and digits and
+// half width katakana to their usual widths, and spaces collapsed
+func normalizeTitle(s string) string {
+	s = width.Fold.String(s)
+	return strings.Join(strings.FieldsFunc(s, unicode.IsSpace), " ")
+}
+
+// Returns the edit distance of a and b in runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Tells whether the summary nearly matches one of the work day titles:
+// the same after normalizing, or within an edit of titles shorter than 6
+// characters and two of longer ones
+func nearlyMatchesWorkDayTitle(c *Config, summary string) bool {
+	titles := c.WorkDayTitles
+	if c.WorkDayTitle != "" || len(titles) == 0 {
+		titles = append([]string{c.WorkDayTitle}, titles...)
+	}
+	s := normalizeTitle(summary)
+	for _, title := range titles {
+		t := normalizeTitle(title)
+		if t == "" {
+			continue
+		}
+		if s == t {
+			return true
+		}
+		limit := 1
+		if utf8.RuneCountInString(t) >= 6 {
+			limit = 2
+		}
+		if editDistance(s, t) <= limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the events of the calendar nearly matching the work day titles
+// which the run counts as work days. Events not decided yet are listed, and
+// asked about in interactive runs.
+func acceptNearMisses(events []*calendar.Event, calendarID string, config *Config, loc *time.Location) []*calendar.Event {
+	nearMissMu.Lock()
+	defer nearMissMu.Unlock()
+	if nearMissDecided == nil {
+		nearMissDecided = make(map[string]bool)
+	}
+	found := make([]*calendar.Event, 0)
+	for _, e := range events {
+		if config.MatchesWorkDayTitle(e.Summary) || !nearlyMatchesWorkDayTitle(config, e.Summary) {
+			continue
+		}
+		if _, ok := nearMissDecided[calendarID+"/"+e.Id]; ok {
+			continue
+		}
+		found = append(found, e)
+	}
+	if len(found) > 0 {
+		logWarnf(log.Default(), "Warning: %d events in calendar %s nearly match the work day title:\n", len(found), calendarID)
+		for _, e := range found {
+			logWarnf(log.Default(), "  %s %q\n", formatEventDate(e, loc), e.Summary)
+		}
+		include := false
+		if !assumeYes && !unattended {
+			include = confirm(log.Default(), msg("confirm_near_miss"))
+		}
+		for _, e := range found {
+			nearMissDecided[calendarID+"/"+e.Id] = include
+			decision := msg("near_miss_flagged")
+			if include {
+				decision = msg("near_miss_included")
+			}
+			nearMissDecisions = append(nearMissDecisions, fmt.Sprintf("%s %q (%s)", formatEventDate(e, loc), e.Summary, decision))
+		}
+	}
+	accepted := make([]*calendar.Event, 0)
+	for _, e := range events {
+		if nearMissDecided[calendarID+"/"+e.Id] {
+			accepted = append(accepted, e)
+		}
+	}
+	return accepted
+}
+
+// Returns the date of the first day of the event
+func formatEventDate(e *calendar.Event, loc *time.Location) string {
+	if days, err := getEventDays(e, loc); err == nil && len(days) > 0 {
+		return days[0].Date.Format("2006-01-02")
+	}
+	return calendarsource.EventStartKey(e)
+}
+
+// Returns the decisions on the near misses of the run
+func getNearMissDecisions() []string {
+	nearMissMu.Lock()
+	defer nearMissMu.Unlock()
+	return append([]string{}, nearMissDecisions...)
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+func validateNonWorkingDays(c *NonWorkingDaysConfig) error {
+	if len(c.Colors) == 0 && c.MarkerRange == "" {
+		return fmt.Errorf("colors or marker_range is required")
+	}
+	for _, s := range c.Colors {
+		if _, err := parseHexColor(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the indexes of the rows of runs having one of the background
+// colors. Only the cells of the runs are fetched with their formats.
+func getShadedDayRows(sht *sheets.Service, spreadsheetID, sheetTitle string, runs []timesheet.Run, colors []string) (map[int]bool, error) {
+	targets := make([]*sheets.Color, 0, len(colors))
+	for _, s := range colors {
+		c, err := parseHexColor(s)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, c)
+	}
+	a1Ranges := make([]string, 0, len(runs))
+	for _, run := range runs {
+		a1Ranges = append(a1Ranges, timesheet.QuoteSheetTitle(sheetTitle)+"!"+run.Range)
+	}
+	var spreadsheet *sheets.Spreadsheet
+	if err := callAPI("get cell formats", func(ctx context.Context) (err error) {
+		spreadsheet, err = sht.Spreadsheets.Get(spreadsheetID).
+			Ranges(a1Ranges...).
+			IncludeGridData(true).
+			Fields(googleapi.Field("sheets.data.rowData.values.effectiveFormat.backgroundColor")).
+			Context(ctx).Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get cell formats: %v", err)
+	}
+	if len(spreadsheet.Sheets) == 0 {
+		return nil, fmt.Errorf("no sheet %s", sheetTitle)
+	}
+
+	// The grid data are in the order of the ranges. Trailing rows without
+	// formats may be left out.
+	data := spreadsheet.Sheets[0].Data
+	shaded := make(map[int]bool)
+	for i, run := range runs {
+		if i >= len(data) {
+			break
+		}
+		for j, row := range data[i].RowData {
+			if j >= run.Count || len(row.Values) == 0 || row.Values[0].EffectiveFormat == nil {
+				continue
+			}
+			bg := row.Values[0].EffectiveFormat.BackgroundColor
+			for _, c := range targets {
+				if bg != nil && isSameColor(bg, c) {
+					shaded[run.First+j] = true
+				}
+			}
+		}
+	}
+	return shaded, nil
+}
+
+// Tells whether the colors are the same. Colors read back from the API may
+// differ by rounding.
+func isSameColor(a, b *sheets.Color) bool {
+	near := func(x, y float64) bool { return math.Abs(x-y) < 0.5/255 }
+	return near(a.Red, b.Red) && near(a.Green, b.Green) && near(a.Blue, b.Blue)
+}
+
+// Returns the indexes of the rows of the marker column having values
+func getMarkedDayRows(sht *sheets.Service, spreadsheetID, sheetTitle string, runs []timesheet.Run) (map[int]bool, error) {
+	ranges := make([]string, 0, len(runs))
+	for _, run := range runs {
+		ranges = append(ranges, run.Range)
+	}
+	values, err := getRenderedRangeValues(sht, spreadsheetID, sheetTitle, ranges, "FORMATTED_VALUE")
+	if err != nil {
+		return nil, err
+	}
+	marked := make(map[int]bool)
+	for i, run := range runs {
+		for j := 0; j < run.Count; j++ {
+			if strings.TrimSpace(cellString(values[i], j, 0)) != "" {
+				marked[run.First+j] = true
+			}
+		}
+	}
+	return marked, nil
+}
+
+// Returns the dates of the work days on rows the sheet marks as non-working
+func findWorkOnNonWorkingDays(sht *sheets.Service, spreadsheetID, sheetTitle string, workRuns, markerRuns []timesheet.Run, period billingPeriod, workDays []WorkDay, c *NonWorkingDaysConfig) ([]string, error) {
+	marked := make(map[int]bool)
+	if len(c.Colors) > 0 {
+		shaded, err := getShadedDayRows(sht, spreadsheetID, sheetTitle, workRuns, c.Colors)
+		if err != nil {
+			return nil, err
+		}
+		for i := range shaded {
+			marked[i] = true
+		}
+	}
+	if len(markerRuns) > 0 {
+		rows, err := getMarkedDayRows(sht, spreadsheetID, sheetTitle, markerRuns)
+		if err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			marked[i] = true
+		}
+	}
+
+	working := make(map[string]bool)
+	for _, d := range workDays {
+		working[d.Date.Format("2006-01-02")] = true
+	}
+	conflicts := make([]string, 0)
+	for i := 0; i < period.days(); i++ {
+		date := period.day(i)
+		if marked[i] && working[date.Format("2006-01-02")] {
+			conflicts = append(conflicts, date.Format("2006-01-02 (Mon)"))
+		}
+	}
+	return conflicts, nil
+}
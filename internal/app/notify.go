@@ -0,0 +1,110 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var notifyOn string
+
+// Start of the run, for the duration in the notification
+var runStart = time.Now()
+
+func buildRunSummary(targetTime time.Time, spreadsheets []*SpreadsheetConfig, workDaysBySpreadsheet map[string][]WorkDay, errs []error, files *reservedFiles) string {
+	failures := 0
+	for _, err := range errs {
+		if err != nil {
+			failures++
+		}
+	}
+	var b strings.Builder
+	if failures > 0 {
+		fmt.Fprintln(&b, msg("summary_failed", formatLocalMonth(targetTime), failures, len(spreadsheets)))
+	} else {
+		fmt.Fprintln(&b, msg("summary_done", formatLocalMonth(targetTime), len(spreadsheets)))
+	}
+	for i, sc := range spreadsheets {
+		if errs[i] != nil {
+			fmt.Fprintln(&b, msg("summary_spreadsheet_failed", sc.ID, errs[i]))
+		} else {
+			// Amounts are labeled by their currencies rather than summed
+			total := ""
+			if amount := files.billing[sc.ID]; amount != nil {
+				total = msg("summary_total", amount.Currency.code, amount.Currency.format(amount.Total))
+			}
+			period := ""
+			if p, ok := files.periods[sc.ID]; ok {
+				period = msg("summary_period", p)
+			}
+			fmt.Fprintln(&b, msg("summary_spreadsheet_done", sc.ID, len(workDaysBySpreadsheet[sc.ID]), period, total))
+			for _, a := range files.anomalies[sc.ID] {
+				fmt.Fprintln(&b, msg("summary_anomaly", a))
+			}
+			fmt.Fprintln(&b, msg("summary_send_state", formatSendState(files, sc.ID)))
+			for _, d := range files.deliveries[sc.ID] {
+				fmt.Fprintln(&b, msg("summary_delivery", d))
+			}
+		}
+	}
+	if decisions := getNearMissDecisions(); len(decisions) > 0 {
+		fmt.Fprintln(&b, msg("summary_near_misses"))
+		for _, d := range decisions {
+			fmt.Fprintf(&b, "- %s\n", d)
+		}
+	}
+	if len(files.written) > 0 {
+		fmt.Fprintln(&b, msg("summary_output_files"))
+		for _, o := range files.written {
+			fmt.Fprintf(&b, "- %s\n", o.path)
+		}
+	}
+	b.WriteString(msg("summary_took", time.Since(runStart).Round(time.Second)))
+	return b.String()
+}
+
+// Posts the run summary to the webhook. Failing to post is only logged
+// so that it doesn't change the result of the run.
+func notifyRun(nc *NotifyConfig, summary string, failed bool) {
+	switch {
+	case notifyOn == "failure" && !failed, notifyOn == "success" && failed:
+		return
+	}
+	field := nc.MessageField
+	if field == "" {
+		field = "text"
+	}
+	d, err := json.Marshal(map[string]string{field: summary})
+	if err != nil {
+		logErrorf(log.Default(), "Failed to encode notification: %v\n", err)
+		return
+	}
+	// Notifications are posted even after the run is canceled, to tell it
+	client := &http.Client{Transport: &retryTransport{base: http.DefaultTransport}}
+	ctx := withAttemptTimeout(context.WithValue(context.Background(), callNameKey{}, "post notification"), 30*time.Second)
+	if err := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, nc.WebhookURL, bytes.NewReader(d))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return &httpStatusError{code: resp.StatusCode, status: resp.Status, header: resp.Header}
+		}
+		return nil
+	}(); err != nil {
+		logErrorf(log.Default(), "Failed to post notification: %v\n", err)
+		return
+	}
+	logVerbose("Posted notification\n")
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Titles Sheets gives to copies of sheets, in English and Japanese, maybe
+// numbered like "Copy of 202403 2". Copies of month sheets left by
+// interrupted runs keep these titles.
+var orphanedCopyPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^Copy of (.+?)(?: [0-9]+)?$`),
+	regexp.MustCompile(`^(.+?) のコピー(?: [0-9]+)?$`),
+}
+
+var cleanupOrphans bool
+
+// orphanedCopy is a copy of a month sheet never renamed. source is nil if
+// the sheet it was copied from is gone.
+type orphanedCopy struct {
+	sheet       *sheets.Sheet
+	sourceTitle string
+	source      *sheets.Sheet
+}
+
+// Returns the sheets titled as copies of month sheets
+func findOrphanedCopies(spreadsheet *sheets.Spreadsheet, loc *time.Location) []orphanedCopy {
+	orphans := make([]orphanedCopy, 0)
+	for _, s := range spreadsheet.Sheets {
+		for _, p := range orphanedCopyPatterns {
+			m := p.FindStringSubmatch(s.Properties.Title)
+			if m == nil {
+				continue
+			}
+			if _, ok := timesheet.ParseMonthTitle(m[1], loc); !ok {
+				continue
+			}
+			o := orphanedCopy{sheet: s, sourceTitle: m[1]}
+			for _, src := range spreadsheet.Sheets {
+				if src.Properties.Title == m[1] {
+					o.source = src
+				}
+			}
+			orphans = append(orphans, o)
+			break
+		}
+	}
+	return orphans
+}
+
+// Tells whether the copy has the values of its source in the work times
+// column, which is what a copy left by a run has. Copies without their
+// source are never taken as such.
+func isUnchangedCopy(sht *sheets.Service, spreadsheetID string, o orphanedCopy, config *Config, namedRanges []*sheets.NamedRange) (bool, error) {
+	if o.source == nil {
+		return false, nil
+	}
+	rng, err := timesheet.ResolveA1Range(config.GetWorkStartTimeRange(), namedRanges)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve work times range: %v", err)
+	}
+	copied, err := getRangeValues(sht, spreadsheetID, o.sheet.Properties.Title, []string{rng})
+	if err != nil {
+		return false, err
+	}
+	source, err := getRangeValues(sht, spreadsheetID, o.sourceTitle, []string{rng})
+	if err != nil {
+		return false, err
+	}
+	return equalRangeValues(copied[0], source[0]), nil
+}
+
+// Reports the orphaned copies of the spreadsheet, deleting the ones having
+// the values of their sources with --cleanup-orphans. Returns the
+// spreadsheet without the sheets deleted.
+func cleanUpOrphanedCopies(sht *sheets.Service, spreadsheetID string, spreadsheet *sheets.Spreadsheet, loc *time.Location, config *Config, logger *log.Logger) (*sheets.Spreadsheet, error) {
+	orphans := findOrphanedCopies(spreadsheet, loc)
+	if len(orphans) == 0 {
+		return spreadsheet, nil
+	}
+	if !cleanupOrphans {
+		logger.Printf("Found %d copies of month sheets left by interrupted runs (use --cleanup-orphans to delete them):\n", len(orphans))
+		for _, o := range orphans {
+			logger.Printf("  %s\n", o.sheet.Properties.Title)
+		}
+		return spreadsheet, nil
+	}
+	for _, o := range orphans {
+		title := o.sheet.Properties.Title
+		unchanged, err := isUnchangedCopy(sht, spreadsheetID, o, config, spreadsheet.NamedRanges)
+		if err != nil {
+			return nil, err
+		}
+		if !unchanged {
+			if o.source == nil {
+				logger.Printf("Keeping sheet %s, as there is no sheet %s to compare it with\n", title, o.sourceTitle)
+			} else {
+				logger.Printf("Keeping sheet %s, which has work times other than the ones of %s\n", title, o.sourceTitle)
+			}
+			continue
+		}
+		if dryRun {
+			logger.Printf("Sheet %s would be deleted as a copy of %s\n", title, o.sourceTitle)
+			continue
+		}
+		if err := callAPI("delete sheet", func(ctx context.Context) error {
+			_, err := sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+				Requests: []*sheets.Request{{
+					DeleteSheet: &sheets.DeleteSheetRequest{
+						SheetId: o.sheet.Properties.SheetId,
+					},
+				}},
+			}).Context(ctx).Do()
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to delete sheet %s: %v", title, err)
+		}
+		logger.Printf("Deleted sheet %s, a copy of %s\n", title, o.sourceTitle)
+		spreadsheet = timesheet.WithoutSheet(spreadsheet, title)
+	}
+	return spreadsheet, nil
+}
@@ -0,0 +1,30 @@
+package app
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+func init() {
+	// pdfcpu would otherwise write its configuration under the user's
+	// config directory, which merging doesn't need
+	api.DisableConfigDir()
+}
+
+// Merges the pdf files into fileName through a temporary file. Every page
+// keeps its own size, so sheets of different paper sizes can be merged.
+func mergePDFFiles(fileNames []string, fileName string) error {
+	conf := pdfcpu.NewDefaultConfiguration()
+	// The exports are not to be rejected for details of the pdf spec they
+	// don't follow strictly
+	conf.ValidationMode = pdfcpu.ValidationRelaxed
+	tmp := fileName + ".part"
+	defer os.Remove(tmp)
+	if err := api.MergeCreateFile(fileNames, tmp, conf); err != nil {
+		return fmt.Errorf("failed to merge pdfs: %v", err)
+	}
+	return os.Rename(tmp, fileName)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// Returns a pdf of a page of each size in points, each showing its number
+func newTestPDF(sizes ...[2]int) []byte {
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", ""}
+	kids := ""
+	font := 3 + 2*len(sizes)
+	for i, size := range sizes {
+		page, content := 3+2*i, 4+2*i
+		kids += fmt.Sprintf("%d 0 R ", page)
+		stream := fmt.Sprintf("BT /F1 24 Tf 72 72 Td (Page %d) Tj ET", i+1)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 %d 0 R >> >> /Contents %d 0 R >>", size[0], size[1], font, content),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(sizes))
+	objects = append(objects, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, o := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
+
+func TestMergePDFFiles(t *testing.T) {
+	a4 := [2]int{595, 842}
+	a4Landscape := [2]int{842, 595}
+	letter := [2]int{612, 792}
+	dir := t.TempDir()
+	sources := [][][2]int{{a4}, {a4Landscape, letter}, {a4}}
+	fileNames := make([]string, 0, len(sources))
+	want := make([][2]int, 0)
+	for i, sizes := range sources {
+		name := filepath.Join(dir, fmt.Sprintf("%d.pdf", i))
+		if err := ioutil.WriteFile(name, newTestPDF(sizes...), 0666); err != nil {
+			t.Fatal(err)
+		}
+		fileNames = append(fileNames, name)
+		want = append(want, sizes...)
+	}
+
+	merged := filepath.Join(dir, "merged.pdf")
+	if err := mergePDFFiles(fileNames, merged); err != nil {
+		t.Fatalf("mergePDFFiles: %v", err)
+	}
+	dims, err := api.PageDimsFile(merged)
+	if err != nil {
+		t.Fatalf("failed to read merged pdf: %v", err)
+	}
+	if len(dims) != len(want) {
+		t.Fatalf("got %d pages, want %d", len(dims), len(want))
+	}
+	for i, d := range dims {
+		if int(d.Width) != want[i][0] || int(d.Height) != want[i][1] {
+			t.Errorf("page %d is %vx%v, want %dx%d", i+1, d.Width, d.Height, want[i][0], want[i][1])
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.part")); len(matches) > 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+}
+
+func TestMergePDFFilesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.pdf")
+	invalid := filepath.Join(dir, "invalid.pdf")
+	if err := ioutil.WriteFile(valid, newTestPDF([2]int{595, 842}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(invalid, []byte("<html>not a pdf</html>"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	merged := filepath.Join(dir, "merged.pdf")
+	if err := mergePDFFiles([]string{valid, invalid}, merged); err == nil {
+		t.Fatalf("want error")
+	}
+	if _, err := ioutil.ReadFile(merged); err == nil {
+		t.Errorf("merged pdf written for invalid input")
+	}
+}
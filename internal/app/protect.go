@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Protections added by the tool are told apart from others by the description
+const protectionDescriptionPrefix = "Locked by make-invoices"
+
+func isOwnProtection(pr *sheets.ProtectedRange) bool {
+	return strings.HasPrefix(pr.Description, protectionDescriptionPrefix)
+}
+
+// Returns the protected ranges of the sheet added by the tool, and the
+// descriptions of the others which block writes
+func getSheetProtections(sheet *sheets.Sheet) (own []*sheets.ProtectedRange, others []string) {
+	for _, pr := range sheet.ProtectedRanges {
+		if isOwnProtection(pr) {
+			own = append(own, pr)
+		} else if !pr.WarningOnly {
+			others = append(others, fmt.Sprintf("%q", pr.Description))
+		}
+	}
+	return
+}
+
+// Returns the protected ranges of the sheet added by the tool, fetched from
+// the spreadsheet, e.g. the ones copied along with a sheet
+func getOwnProtections(sht *sheets.Service, spreadsheetID string, sheetID int64) ([]*sheets.ProtectedRange, error) {
+	spreadsheet, err := getSpreadsheet(sht, spreadsheetID, "sheets(properties.sheetId,protectedRanges)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get protected ranges: %v", err)
+	}
+	for _, s := range spreadsheet.Sheets {
+		if s.Properties.SheetId == sheetID {
+			own, _ := getSheetProtections(s)
+			return own, nil
+		}
+	}
+	return nil, nil
+}
+
+func unprotectSheet(sht *sheets.Service, spreadsheetID string, protectedRanges []*sheets.ProtectedRange) error {
+	if len(protectedRanges) == 0 {
+		return nil
+	}
+	requests := make([]*sheets.Request, 0, len(protectedRanges))
+	for _, pr := range protectedRanges {
+		requests = append(requests, &sheets.Request{
+			DeleteProtectedRange: &sheets.DeleteProtectedRangeRequest{
+				ProtectedRangeId: pr.ProtectedRangeId,
+			},
+		})
+	}
+	if err := callAPI("unprotect sheet", func(ctx context.Context) error {
+		_, err := sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: requests,
+		}).Context(ctx).Do()
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to unprotect sheet: %v", err)
+	}
+	return nil
+}
+
+func protectSheet(sht *sheets.Service, spreadsheetID string, sheetID int64, warningOnly bool) error {
+	if err := callAPI("protect sheet", func(ctx context.Context) error {
+		_, err := sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: []*sheets.Request{{
+				AddProtectedRange: &sheets.AddProtectedRangeRequest{
+					ProtectedRange: &sheets.ProtectedRange{
+						Range: &sheets.GridRange{
+							SheetId:         sheetID,
+							ForceSendFields: []string{"SheetId"},
+						},
+						Description: fmt.Sprintf("%s on %s", protectionDescriptionPrefix, time.Now().Format("2006-01-02")),
+						WarningOnly: warningOnly,
+					},
+				},
+			}},
+		}).Context(ctx).Do()
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to protect sheet: %v", err)
+	}
+	return nil
+}
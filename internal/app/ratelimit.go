@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitTransport spaces out requests to at most rate per second over all
+// the API clients, and writes to Sheets by the limiter of writes. Quotas of
+// Google APIs are per user, e.g. 60 writes per minute for Sheets, which the
+// spreadsheets processed in parallel share. Requests are also retried, and
+// counted in the metrics here.
+type rateLimitTransport struct {
+	base     http.RoundTripper
+	requests *rate.Limiter
+	writes   *rate.Limiter
+}
+
+func newRateLimitTransport(base http.RoundTripper, perSecond float64) *rateLimitTransport {
+	t := &rateLimitTransport{base: base}
+	if perSecond > 0 {
+		t.requests = rate.NewLimiter(rate.Limit(perSecond), 1)
+	}
+	return t
+}
+
+// Writes per minute are let through in bursts of a tenth of them, as the
+// writes of a spreadsheet come together
+func newWriteLimiter(perMinute int) *rate.Limiter {
+	burst := perMinute / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), burst)
+}
+
+// Waits for the turn of the request by the limiter, returning how long it
+// waited. Requests reserve their turns ahead, so that they are served in
+// order, and give them back if their context is done first.
+func waitLimiter(ctx context.Context, l *rate.Limiter) (time.Duration, error) {
+	r := l.Reserve()
+	wait := r.Delay()
+	if wait == 0 {
+		return 0, nil
+	}
+	if err := sleepContext(ctx, wait); err != nil {
+		r.Cancel()
+		return 0, err
+	}
+	return wait, nil
+}
+
+// Sends the request, retrying it as retryRoundTrip does with each attempt
+// waiting for its turn
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return retryRoundTrip(req, t.roundTrip)
+}
+
+func (t *rateLimitTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	metrics.countRequest(req)
+	if t.writes != nil && getAPIService(req) == "sheets_write" {
+		wait, err := waitLimiter(req.Context(), t.writes)
+		if err != nil {
+			return nil, err
+		}
+		if wait > 0 {
+			metrics.countWriteLimitWait(wait)
+		}
+	}
+	if t.requests != nil {
+		wait, err := waitLimiter(req.Context(), t.requests)
+		if err != nil {
+			return nil, err
+		}
+		if wait > 0 {
+			metrics.countThrottle(wait)
+		}
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	metrics.addNetworkTime(time.Since(start))
+	// A write which failed may still have been made
+	invalidateWrittenSpreadsheet(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingReader{resp.Body}
+	return resp, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteLimiter(t *testing.T) {
+	// 1200 writes per minute are one per 50ms in bursts of 120
+	const interval = 50 * time.Millisecond
+	tests := []struct {
+		name string
+		// Writes taken at once before the ones measured, and the time
+		// after them
+		drain int
+		sleep time.Duration
+		// Whether each of the writes measured waits
+		waits []bool
+	}{
+		{"burst", 0, 0, repeatBool(false, 120)},
+		{"after the burst", 120, 0, []bool{true, true}},
+		{"refilled", 120, 2*interval + interval/2, []bool{false, false, true}},
+		{"refilled no more than the burst", 0, 2 * interval, append(repeatBool(false, 120), true)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newWriteLimiter(1200)
+			if l.Burst() != 120 {
+				t.Fatalf("got burst %d, want 120", l.Burst())
+			}
+			for i := 0; i < tt.drain; i++ {
+				l.Reserve()
+			}
+			time.Sleep(tt.sleep)
+			for i, want := range tt.waits {
+				wait, err := waitLimiter(context.Background(), l)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (wait > 0) != want {
+					t.Errorf("write %d waited %v, want waiting %v", i, wait, want)
+				}
+				if wait > interval+interval/2 {
+					t.Errorf("write %d waited %v, longer than %v", i, wait, interval)
+				}
+			}
+		})
+	}
+}
+
+func repeatBool(v bool, n int) []bool {
+	s := make([]bool, n)
+	for i := range s {
+		s[i] = v
+	}
+	return s
+}
+
+func TestNewWriteLimiterBurst(t *testing.T) {
+	for _, tt := range []struct{ perMinute, burst int }{{1, 1}, {9, 1}, {10, 1}, {50, 5}, {60, 6}, {600, 60}} {
+		if got := newWriteLimiter(tt.perMinute).Burst(); got != tt.burst {
+			t.Errorf("%d per minute: got burst %d, want %d", tt.perMinute, got, tt.burst)
+		}
+	}
+}
+
+func TestWaitLimiterCanceled(t *testing.T) {
+	l := newWriteLimiter(60)
+	for i := 0; i < 6; i++ {
+		l.Reserve()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := waitLimiter(ctx, l); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("waited %v after the context was done", d)
+	}
+	// The canceled write gives its turn back, so the next one waits for
+	// one write, not two
+	r := l.Reserve()
+	defer r.Cancel()
+	if d := r.Delay(); d > time.Second {
+		t.Errorf("next write waits %v", d)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper of a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	sent := make([]string, 0)
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, req.Method+" "+req.URL.Host)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	})
+	transport := newRateLimitTransport(base, 0)
+	transport.writes = newWriteLimiter(60)
+	do := func(ctx context.Context, method, url string) error {
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// The burst of 6 writes goes at once, and reads are not limited by it
+	for i := 0; i < 6; i++ {
+		if err := do(context.Background(), http.MethodPost, "https://sheets.googleapis.com/v4/spreadsheets/a:batchUpdate"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := do(context.Background(), http.MethodGet, "https://sheets.googleapis.com/v4/spreadsheets/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := do(context.Background(), http.MethodPost, "https://www.googleapis.com/drive/v3/files/a/copy"); err != nil {
+		t.Fatal(err)
+	}
+	// The next write waits a second, longer than its request may
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := do(ctx, http.MethodPost, "https://sheets.googleapis.com/v4/spreadsheets/a:batchUpdate"); err == nil {
+		t.Fatalf("write beyond the limit was not held")
+	}
+	if len(sent) != 8 {
+		t.Errorf("sent %d requests, want 8: %v", len(sent), sent)
+	}
+}
+
+func TestRateLimitTransportRequests(t *testing.T) {
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	})
+	// 20 requests per second are spaced by 50ms
+	transport := newRateLimitTransport(base, 20)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://www.googleapis.com/calendar/v3/calendars/a/events", nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if d := time.Since(start); d < 140*time.Millisecond {
+		t.Errorf("4 requests took %v, want at least 150ms", d)
+	}
+}
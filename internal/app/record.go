@@ -0,0 +1,235 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Directories given by --record and --replay
+var (
+	recordDir string
+	replayDir string
+)
+
+// recordedExchange is a request and its response saved by --record. Bodies
+// which are not text are saved in separate files named by the *File fields.
+type recordedExchange struct {
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeader   http.Header `json:"request_header"`
+	RequestBody     string      `json:"request_body,omitempty"`
+	RequestBodyFile string      `json:"request_body_file,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeader  http.Header `json:"response_header"`
+	Body            string      `json:"body,omitempty"`
+	BodyFile        string      `json:"body_file,omitempty"`
+}
+
+const scrubbed = "[scrubbed]"
+
+// Query parameters and headers that carry credentials
+var secretQueryParams = []string{"access_token", "key"}
+var secretHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+func scrubURL(u *url.URL) string {
+	c := *u
+	q := c.Query()
+	for _, p := range secretQueryParams {
+		if q.Get(p) != "" {
+			q.Set(p, scrubbed)
+		}
+	}
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+func scrubHeader(h http.Header) http.Header {
+	c := h.Clone()
+	for _, k := range secretHeaders {
+		if c.Get(k) != "" {
+			c.Set(k, scrubbed)
+		}
+	}
+	return c
+}
+
+// Requests for tokens have secrets in both bodies, which are not saved
+func isTokenRequest(u *url.URL) bool {
+	return u.Host == "oauth2.googleapis.com" || strings.HasSuffix(u.Path, "/token")
+}
+
+func isTextBody(contentType string) bool {
+	return contentType == "" || strings.Contains(contentType, "json") || strings.HasPrefix(contentType, "text/")
+}
+
+// recordTransport saves every request and its response to numbered files in
+// dir
+type recordTransport struct {
+	base http.RoundTripper
+	dir  string
+	mu   sync.Mutex
+	n    int
+}
+
+func newRecordTransport(base http.RoundTripper, dir string) (*recordTransport, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &recordTransport{base: base, dir: dir}, nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n++
+	name := fmt.Sprintf("%04d", t.n)
+	e := &recordedExchange{
+		Method:         req.Method,
+		URL:            scrubURL(req.URL),
+		RequestHeader:  scrubHeader(req.Header),
+		Status:         resp.StatusCode,
+		ResponseHeader: scrubHeader(resp.Header),
+	}
+	if isTokenRequest(req.URL) {
+		reqBody, body = []byte(scrubbed), []byte(scrubbed)
+	}
+	if e.RequestBody, e.RequestBodyFile, err = t.saveBody(name+".request", req.Header.Get("Content-Type"), reqBody); err != nil {
+		return nil, err
+	}
+	if e.Body, e.BodyFile, err = t.saveBody(name+".response", resp.Header.Get("Content-Type"), body); err != nil {
+		return nil, err
+	}
+	d, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(t.dir, name+".json"), d, 0600); err != nil {
+		return nil, fmt.Errorf("failed to record request: %v", err)
+	}
+	return resp, nil
+}
+
+// Returns the body as text, or saves it to a file and returns the name
+func (t *recordTransport) saveBody(name, contentType string, body []byte) (string, string, error) {
+	if isTextBody(contentType) {
+		return string(body), "", nil
+	}
+	if err := ioutil.WriteFile(filepath.Join(t.dir, name), body, 0600); err != nil {
+		return "", "", fmt.Errorf("failed to record body: %v", err)
+	}
+	return "", name, nil
+}
+
+// unexpectedReplayError is returned for requests not recorded, which are
+// never retried
+type unexpectedReplayError struct {
+	method string
+	url    string
+}
+
+func (e *unexpectedReplayError) Error() string {
+	return fmt.Sprintf("unexpected request in replay: %s %s", e.method, e.url)
+}
+
+// replayTransport answers requests with the responses recorded in dir
+// without touching the network. Each request gets the first unused response
+// recorded for the same method and URL, as concurrent requests may come in
+// another order than they were recorded.
+type replayTransport struct {
+	dir       string
+	mu        sync.Mutex
+	exchanges []*recordedExchange
+	used      []bool
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "[0-9][0-9][0-9][0-9]*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no recorded requests in %s", dir)
+	}
+	sort.Strings(names)
+	t := &replayTransport{dir: dir}
+	for _, name := range names {
+		d, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		e := &recordedExchange{}
+		if err := json.Unmarshal(d, e); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		t.exchanges = append(t.exchanges, e)
+	}
+	t.used = make([]bool, len(t.exchanges))
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	u := scrubURL(req.URL)
+	t.mu.Lock()
+	var e *recordedExchange
+	for i, r := range t.exchanges {
+		if !t.used[i] && r.Method == req.Method && r.URL == u {
+			t.used[i] = true
+			e = r
+			break
+		}
+	}
+	t.mu.Unlock()
+	if e == nil {
+		return nil, &unexpectedReplayError{method: req.Method, url: u}
+	}
+	body := []byte(e.Body)
+	if e.BodyFile != "" {
+		var err error
+		if body, err = ioutil.ReadFile(filepath.Join(t.dir, e.BodyFile)); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.ResponseHeader,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
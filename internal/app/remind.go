@@ -0,0 +1,133 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Reminds of the invoices of the previous month not made yet, for a daily
+// cron. From remind_day of the month on, the spreadsheets not completed in
+// the state are posted to the webhook of notify and emailed to
+// remind_email_to. Nothing is printed or sent when all are made.
+func runRemind(args []string) error {
+	fs := flag.NewFlagSet("remind", flag.ExitOnError)
+	fs.Parse(args)
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if config.RemindDay == 0 {
+		return newRunError(exitConfigError, "config", "remind_day is required in the config")
+	}
+	hasWebhook := config.Notify != nil && config.Notify.WebhookURL != ""
+	if !hasWebhook && len(config.RemindEmailTo) == 0 {
+		return newRunError(exitConfigError, "config", "notify.webhook_url or remind_email_to is required to remind")
+	}
+	loc, err := config.GetLocation()
+	if err != nil {
+		return fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	now := time.Now().In(loc)
+	if now.Day() < config.RemindDay {
+		return nil
+	}
+	targetTime, err := parseMonthArg("last", now, loc)
+	if err != nil {
+		return fmt.Errorf("Failed to get the previous month: %v", err)
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("Failed to load state: %v", err)
+	}
+	spreadsheets := config.GetSpreadsheets()
+	pending := getPendingSpreadsheets(state, spreadsheets, targetTime)
+	if len(pending) == 0 {
+		return nil
+	}
+	reminder := buildReminder(state, targetTime, pending, len(spreadsheets))
+
+	if hasWebhook {
+		notifyRun(config.Notify, reminder, true)
+	}
+	if len(config.RemindEmailTo) > 0 {
+		if err := emailReminder(config, msg("remind_subject", formatLocalMonth(targetTime)), reminder); err != nil {
+			return fmt.Errorf("Failed to email the reminder: %v", err)
+		}
+	}
+	log.Printf("Reminded of %d spreadsheets not made for %s\n", len(pending), targetTime.Format("200601"))
+	return nil
+}
+
+// Returns the IDs of the spreadsheets not completed for the month
+func getPendingSpreadsheets(state *State, spreadsheets []*SpreadsheetConfig, targetTime time.Time) []string {
+	completed := state.Completed[targetTime.Format("200601")]
+	pending := make([]string, 0)
+	for _, sc := range spreadsheets {
+		if _, ok := completed[sc.ID]; !ok {
+			pending = append(pending, sc.ID)
+		}
+	}
+	return pending
+}
+
+// Builds the reminder listing the spreadsheets by their titles in the
+// latest months completed, with the command making them
+func buildReminder(state *State, targetTime time.Time, pending []string, total int) string {
+	titles := getCompletedTitles(state)
+
+	var b strings.Builder
+	fmt.Fprintln(&b, msg("remind_pending", formatLocalMonth(targetTime), len(pending), total))
+	for _, id := range pending {
+		if title, ok := titles[id]; ok {
+			fmt.Fprintf(&b, "- %s (%s)\n", title, id)
+		} else {
+			fmt.Fprintf(&b, "- %s\n", id)
+		}
+	}
+	command := "make-invoices"
+	if exe, err := os.Executable(); err == nil {
+		command = exe
+	}
+	if len(pending) < total {
+		command += " --only " + strings.Join(pending, ",")
+	}
+	command += " " + targetTime.Format("200601")
+	b.WriteString(msg("remind_command", command))
+	return b.String()
+}
+
+// Emails the reminder through gmail. Only the send scope is needed, so the
+// token may have no access to the sheets.
+func emailReminder(config *Config, subject, body string) error {
+	// Reminders run from cron, which never authorizes
+	unattended = true
+	ctx := context.Background()
+	client, err := createScopedAPIClient(ctx, config, []string{gmail.GmailSendScope})
+	if err != nil {
+		return err
+	}
+	gml, err := gmail.NewService(ctx, getServiceOptions(client, "")...)
+	if err != nil {
+		return fmt.Errorf("failed to create gmail client: %v", err)
+	}
+	m, err := buildEmailMessage(&EmailConfig{To: config.RemindEmailTo}, subject, body, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build email: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if _, err := gml.Users.Messages.Send("me", &gmail.Message{Raw: base64.URLEncoding.EncodeToString(m)}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// "make-invoices report [month]" prints the work of each spreadsheet of the
+// month so far, and the work and billing projected by the days scheduled
+// for the rest of it. Only the work sources are read, with the filters,
+// holidays and leave of runs, so only the calendar scope is needed. Days
+// before today are the ones worked so far.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report in JSON")
+	fs.Parse(args)
+	monthArg := "this"
+	if fs.NArg() >= 1 {
+		monthArg = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	// Near misses of the work day title are only warned of, as a report
+	// asks nothing
+	assumeYes = true
+	loc, err := config.GetLocation()
+	if err != nil {
+		return fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	now := time.Now().In(loc)
+	targetTime, err := parseMonthArg(monthArg, now, loc)
+	if err != nil {
+		return newRunError(exitConfigError, "config", "Failed to parse date parameter: %v", err)
+	}
+
+	ctx := context.Background()
+	client, err := createScopedAPIClient(ctx, config, []string{calendar.CalendarReadonlyScope})
+	if err != nil {
+		return err
+	}
+	// Nothing may be written by a report, whatever the token allows
+	client.Transport = &readOnlyTransport{base: client.Transport}
+
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("Failed to load state: %v", err)
+	}
+	titles := getCompletedTitles(state)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	reports := make([]*spreadsheetReport, 0)
+	for _, sc := range config.GetSpreadsheets() {
+		r, err := reportSpreadsheet(ctx, client, config.ForSpreadsheet(sc), sc, targetTime, today)
+		if err != nil {
+			return fmt.Errorf("Failed to report spreadsheet %s: %v", sc.ID, err)
+		}
+		r.Title = titles[sc.ID]
+		reports = append(reports, r)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			return fmt.Errorf("Failed to write report: %v", err)
+		}
+		return nil
+	}
+	fmt.Println(msg("report_title", formatLocalMonth(targetTime), today.Format("2006-01-02")))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, msg("report_header"))
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%d\t%s\t%s\n", r.SpreadsheetID, r.Title, r.Period, r.DaysSoFar, r.HoursSoFar, r.AmountSoFar, r.ProjectedDays, r.ProjectedHours, r.ProjectedAmount)
+	}
+	w.Flush()
+	return nil
+}
+
+// spreadsheetReport is the work of a spreadsheet in the report
+type spreadsheetReport struct {
+	SpreadsheetID string `json:"spreadsheet_id"`
+	// Title in the latest month made, if any
+	Title  string `json:"title,omitempty"`
+	Period string `json:"period"`
+	// Work of the days before today, and of every day scheduled in the
+	// period. Hours are of the days having both times.
+	DaysSoFar      int    `json:"days_so_far"`
+	HoursSoFar     string `json:"hours_so_far"`
+	ProjectedDays  int    `json:"projected_days"`
+	ProjectedHours string `json:"projected_hours"`
+	// Amounts billed for the work, formatted in the currency, which are
+	// empty without billing
+	AmountSoFar     string `json:"amount_so_far,omitempty"`
+	ProjectedAmount string `json:"projected_amount,omitempty"`
+}
+
+// Resolves the work days of the spreadsheet as runs do, and counts the ones
+// before today and all of them
+func reportSpreadsheet(ctx context.Context, client *http.Client, config *Config, sc *SpreadsheetConfig, targetTime, today time.Time) (*spreadsheetReport, error) {
+	var events workDayResolver = &calendarWorkDayResolver{config: config}
+	switch config.WorkSource {
+	case "csv":
+		events = &csvWorkDayResolver{config: config}
+	case "merge":
+		events = &mergedWorkDayResolver{config: config}
+	}
+	days, err := newWorkDayResolver(config, sc, events).resolveWorkDays(ctx, client, targetTime)
+	if err != nil {
+		return nil, err
+	}
+	resolveEventKinds(config, days)
+	leaves, err := getLeaveDays(ctx, client, config, targetTime)
+	if err != nil {
+		return nil, err
+	}
+	if len(leaves) > 0 {
+		days = applyLeaveDays(days, leaves, sc.WorkDayRule != nil)
+	}
+
+	period := getBillingPeriod(config, targetTime)
+	breaks, err := getBreakPolicy(config, sc)
+	if err != nil {
+		return nil, err
+	}
+	rows := buildDayRows(period, period.days(), days, leaves, nil, config, breaks, targetTime.Location())
+	soFar := make([]dayRow, len(rows))
+	for i := range rows {
+		if period.day(i).Before(today) {
+			soFar[i] = rows[i]
+		}
+	}
+	r := &spreadsheetReport{
+		SpreadsheetID: sc.ID,
+		Period:        period.String(),
+	}
+	if r.HoursSoFar, err = sumWorkHours(soFar, breaks); err != nil {
+		return nil, err
+	}
+	if r.ProjectedHours, err = sumWorkHours(rows, breaks); err != nil {
+		return nil, err
+	}
+	r.DaysSoFar, _ = strconv.Atoi(countWorkDays(soFar))
+	r.ProjectedDays, _ = strconv.Atoi(countWorkDays(rows))
+
+	billing := config.GetBilling(sc)
+	if billing == nil {
+		return r, nil
+	}
+	cur, err := getCurrency(config, sc)
+	if err != nil {
+		return nil, err
+	}
+	tax := config.GetTax(sc)
+	amount, err := computeBilling(billing, soFar, period, breaks, config.EventKinds, tax, cur)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute billing: %v", err)
+	}
+	r.AmountSoFar = cur.format(amount.Total)
+	if amount, err = computeBilling(billing, rows, period, breaks, config.EventKinds, tax, cur); err != nil {
+		return nil, fmt.Errorf("failed to compute billing: %v", err)
+	}
+	r.ProjectedAmount = cur.format(amount.Total)
+	return r, nil
+}
+
+// Returns the titles of the spreadsheets in the latest months completed
+func getCompletedTitles(state *State) map[string]string {
+	months := make([]string, 0, len(state.Completed))
+	for month := range state.Completed {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+	titles := make(map[string]string)
+	for _, month := range months {
+		for id, c := range state.Completed[month] {
+			if c.Title != "" {
+				titles[id] = c.Title
+			}
+		}
+	}
+	return titles
+}
+
+// readOnlyTransport refuses requests other than reads, so that a command
+// which must write nothing can't, even by a bug. Only the spreadsheets of
+// writable may be written, if any.
+type readOnlyTransport struct {
+	base     http.RoundTripper
+	writable map[string]bool
+}
+
+func (t *readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && !t.writable[getRequestSpreadsheetID(req)] {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("refused %s request: the command reads only", req.Method)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Returns the ID of the spreadsheet of a Sheets API request, or ""
+func getRequestSpreadsheetID(req *http.Request) string {
+	rest := strings.TrimPrefix(req.URL.Path, "/v4/spreadsheets/")
+	if rest == req.URL.Path {
+		return ""
+	}
+	if i := strings.IndexAny(rest, "/:"); i >= 0 {
+		return rest[:i]
+	}
+	return rest
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadOnlyTransport(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &readOnlyTransport{base: http.DefaultTransport}}
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		t.Run(method, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			req, err := http.NewRequest(method, server.URL+"/v4/spreadsheets/abc:batchUpdate", strings.NewReader(`{"requests": []}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatalf("%s was not refused", method)
+			}
+			if !strings.Contains(err.Error(), "refused "+method) {
+				t.Errorf("got %v", err)
+			}
+			if n := atomic.LoadInt32(&requests); n != 0 {
+				t.Errorf("server got %d requests", n)
+			}
+		})
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		t.Run(method, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			req, err := http.NewRequest(method, server.URL+"/v4/spreadsheets/abc", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("%s: %v", method, err)
+			}
+			resp.Body.Close()
+			if n := atomic.LoadInt32(&requests); n != 1 {
+				t.Errorf("server got %d requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestReadOnlyTransportWritable(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &readOnlyTransport{base: http.DefaultTransport, writable: map[string]bool{"summary": true}}}
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"/v4/spreadsheets/summary/values:batchUpdate", true},
+		{"/v4/spreadsheets/summary:batchUpdate", true},
+		{"/v4/spreadsheets/other:batchUpdate", false},
+		{"/v4/spreadsheets/summary2/values:batchUpdate", false},
+		// Other APIs have no spreadsheet to be written
+		{"/drive/v3/files/summary", false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&requests, 0)
+		resp, err := client.Post(server.URL+tt.path, "application/json", strings.NewReader("{}"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tt.allowed {
+			t.Errorf("POST %s: got error %v, want allowed %v", tt.path, err, tt.allowed)
+		}
+		want := int32(0)
+		if tt.allowed {
+			want = 1
+		}
+		if n := atomic.LoadInt32(&requests); n != want {
+			t.Errorf("POST %s: server got %d requests, want %d", tt.path, n, want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// LastRun records the spreadsheets that failed in the last run so that
+// --only-failed can run them again
+type LastRun struct {
+	Month  string   `json:"month"`
+	Failed []string `json:"failed"`
+}
+
+// Logs a table of the result of each spreadsheet, with the deliveries of
+// its outputs
+func logSpreadsheetResults(spreadsheets []*SpreadsheetConfig, errs []error, files *reservedFiles) {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, msg("results_header"))
+	for i, sc := range spreadsheets {
+		if errs[i] == nil {
+			fmt.Fprintf(w, "%s\t\t%s\t\t%s\t%s\n", sc.ID, msg("result_ok"), formatSendState(files, sc.ID), formatDeliveries(files, sc.ID))
+			continue
+		}
+		title, step := "", ""
+		var se *spreadsheetError
+		if errors.As(errs[i], &se) {
+			title, step = se.title, se.step
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\t\n", sc.ID, title, msg("result_failed"), step)
+	}
+	w.Flush()
+	log.Printf("%s\n%s", msg("results"), b.String())
+}
+
+// SpreadsheetResult is the result of a spreadsheet of a run
+type SpreadsheetResult struct {
+	ID    string
+	Title string
+	// Step which failed, like "write values"
+	Step string
+	// Output files written for the spreadsheet
+	Files []string
+	Err   error
+}
+
+// Returns the result of each spreadsheet of the run
+func getSpreadsheetResults(spreadsheets []*SpreadsheetConfig, errs []error, files *reservedFiles) []*SpreadsheetResult {
+	results := make([]*SpreadsheetResult, 0, len(spreadsheets))
+	for i, sc := range spreadsheets {
+		r := &SpreadsheetResult{ID: sc.ID, Files: make([]string, 0), Err: errs[i]}
+		var se *spreadsheetError
+		if errors.As(errs[i], &se) {
+			r.Title, r.Step = se.title, se.step
+		} else if record := files.records[sc.ID]; record != nil {
+			r.Title = record.title
+		}
+		for _, o := range files.written {
+			if o.spreadsheetID == sc.ID {
+				r.Files = append(r.Files, o.path)
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// CompletedSpreadsheet is a spreadsheet made successfully for a month
+type CompletedSpreadsheet struct {
+	Title string    `json:"title"`
+	At    time.Time `json:"at"`
+	// Work made into the sheet, compared with by the following months
+	WorkDays *int     `json:"work_days,omitempty"`
+	Hours    *float64 `json:"hours,omitempty"`
+	// Total invoiced in the minor units of the currency, if billed
+	Total    *int64 `json:"total,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	// Whether the month was read from a sheet made before by backfill
+	Backfilled bool `json:"backfilled,omitempty"`
+}
+
+// Records the failed spreadsheets of the run in the state, and the
+// succeeded ones as completed for the month
+func saveLastRun(targetTime time.Time, spreadsheets []*SpreadsheetConfig, errs []error, files *reservedFiles) error {
+	month := targetTime.Format("200601")
+	if exportOnly {
+		return saveExports(month, spreadsheets, errs)
+	}
+	return updateState(func(state *State) error {
+		run := &LastRun{Month: month, Failed: make([]string, 0)}
+		if state.Completed == nil {
+			state.Completed = make(map[string]map[string]*CompletedSpreadsheet)
+		}
+		if state.Completed[month] == nil {
+			state.Completed[month] = make(map[string]*CompletedSpreadsheet)
+		}
+		for i, sc := range spreadsheets {
+			if errs[i] != nil {
+				run.Failed = append(run.Failed, sc.ID)
+				continue
+			}
+			// Spreadsheets not delivered are run again by --only-failed,
+			// while they are made for the month
+			if files.deliveryFailed[sc.ID] {
+				run.Failed = append(run.Failed, sc.ID)
+			}
+			c := &CompletedSpreadsheet{At: time.Now()}
+			if record := files.records[sc.ID]; record != nil {
+				c.Title = record.title
+				workDays := record.workDays
+				c.WorkDays = &workDays
+				if hours, err := strconv.ParseFloat(record.hours, 64); err == nil {
+					c.Hours = &hours
+				}
+			}
+			if amount := files.billing[sc.ID]; amount != nil {
+				total := amount.Total
+				c.Total, c.Currency = &total, amount.Currency.code
+			}
+			state.Completed[month][sc.ID] = c
+			if record := files.records[sc.ID]; record != nil && record.revision > 0 {
+				if state.Revisions == nil {
+					state.Revisions = make(map[string]map[string]int)
+				}
+				if state.Revisions[month] == nil {
+					state.Revisions[month] = make(map[string]int)
+				}
+				state.Revisions[month][sc.ID] = record.revision
+			}
+		}
+		state.LastRun = run
+		return nil
+	})
+}
+
+// Records the spreadsheets exported by the export command, leaving the
+// last run and the completed months as the runs writing the values left
+// them
+func saveExports(month string, spreadsheets []*SpreadsheetConfig, errs []error) error {
+	return updateState(func(state *State) error {
+		if state.Exported == nil {
+			state.Exported = make(map[string]map[string]time.Time)
+		}
+		if state.Exported[month] == nil {
+			state.Exported[month] = make(map[string]time.Time)
+		}
+		for i, sc := range spreadsheets {
+			if errs[i] == nil {
+				state.Exported[month][sc.ID] = time.Now()
+			}
+		}
+		return nil
+	})
+}
+
+// Leaves only the spreadsheets that failed in the last run for the month in
+// the config
+func selectFailedSpreadsheets(config *Config, targetTime time.Time) error {
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("failed to load state: %v", err)
+	}
+	month := targetTime.Format("200601")
+	if state.LastRun == nil || state.LastRun.Month != month {
+		return fmt.Errorf("no run for %s is recorded", month)
+	}
+	failed := make(map[string]bool)
+	for _, id := range state.LastRun.Failed {
+		failed[id] = true
+	}
+	keepSpreadsheets(config, failed)
+	return nil
+}
+
+// Leaves only the spreadsheets of the IDs in the config
+func selectSpreadsheets(config *Config, ids []string) error {
+	selected := make(map[string]bool)
+	for i := range ids {
+		ids[i] = strings.TrimSpace(ids[i])
+		selected[ids[i]] = true
+	}
+	known := make(map[string]bool)
+	for _, sc := range config.GetSpreadsheets() {
+		known[sc.ID] = true
+	}
+	for _, id := range ids {
+		if !known[id] {
+			return fmt.Errorf("spreadsheet %s is not in the config", id)
+		}
+	}
+	keepSpreadsheets(config, selected)
+	return nil
+}
+
+func keepSpreadsheets(config *Config, keep map[string]bool) {
+	ids := make([]string, 0)
+	for _, id := range config.WorkSpreadsheetIDs {
+		if keep[id] {
+			ids = append(ids, id)
+		}
+	}
+	spreadsheets := make([]*SpreadsheetConfig, 0)
+	for _, sc := range config.WorkSpreadsheets {
+		if keep[sc.ID] {
+			spreadsheets = append(spreadsheets, sc)
+		}
+	}
+	config.WorkSpreadsheetIDs, config.WorkSpreadsheets = ids, spreadsheets
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Returns the month sheets older than retention_months before the target
+// month. Sheets whose titles aren't months are never returned.
+func getExpiredSheets(spreadsheet *sheets.Spreadsheet, targetTime time.Time, config *Config) []*sheets.Sheet {
+	cutoff := targetTime.AddDate(0, -config.RetentionMonths, 0)
+	expired := make([]*sheets.Sheet, 0)
+	for _, s := range spreadsheet.Sheets {
+		month, ok := timesheet.ParseMonthTitle(s.Properties.Title, targetTime.Location())
+		if !ok {
+			continue
+		}
+		if month.Before(cutoff) {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+// Deletes or archives the expired month sheets, or only lists them unless
+// --apply-retention is given or in dry runs
+func applyRetention(sht *sheets.Service, spreadsheet *sheets.Spreadsheet, targetTime time.Time, config *Config, logger *log.Logger) error {
+	if config.RetentionMonths == 0 {
+		return nil
+	}
+	if config.RetentionMonths < 0 {
+		return fmt.Errorf("retention_months must be 1 or greater")
+	}
+	action := config.RetentionAction
+	if action != "delete" && action != "archive" {
+		return fmt.Errorf("unknown retention_action: %q (must be delete or archive)", action)
+	}
+	if action == "archive" && config.ArchiveSpreadsheetID == "" {
+		return fmt.Errorf("archive_spreadsheet_id is required to archive sheets")
+	}
+
+	expired := getExpiredSheets(spreadsheet, targetTime, config)
+	if !applyRetentionFlag || dryRun {
+		for _, s := range expired {
+			logger.Printf("Sheet %s would be %sd (use --apply-retention to do so)\n", s.Properties.Title, action)
+		}
+		return nil
+	}
+
+	for _, s := range expired {
+		if action == "archive" {
+			var dest *sheets.SheetProperties
+			if err := callAPI("archive sheet", func(ctx context.Context) (err error) {
+				dest, err = sht.Spreadsheets.Sheets.CopyTo(spreadsheet.SpreadsheetId, s.Properties.SheetId, &sheets.CopySheetToAnotherSpreadsheetRequest{
+					DestinationSpreadsheetId: config.ArchiveSpreadsheetID,
+				}).Context(ctx).Do()
+				return
+			}); err != nil {
+				return fmt.Errorf("failed to archive sheet %s: %v", s.Properties.Title, err)
+			}
+			if err := callAPI("rename archived sheet", func(ctx context.Context) error {
+				_, err := sht.Spreadsheets.BatchUpdate(config.ArchiveSpreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+					Requests: []*sheets.Request{{
+						UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+							Fields: "title",
+							Properties: &sheets.SheetProperties{
+								SheetId: dest.SheetId,
+								Title:   spreadsheet.Properties.Title + " " + s.Properties.Title,
+							},
+						},
+					}},
+				}).Context(ctx).Do()
+				return err
+			}); err != nil {
+				return fmt.Errorf("failed to rename archived sheet %s: %v", s.Properties.Title, err)
+			}
+		}
+		if err := callAPI("delete sheet", func(ctx context.Context) error {
+			_, err := sht.Spreadsheets.BatchUpdate(spreadsheet.SpreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
+				Requests: []*sheets.Request{{
+					DeleteSheet: &sheets.DeleteSheetRequest{
+						SheetId: s.Properties.SheetId,
+					},
+				}},
+			}).Context(ctx).Do()
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to delete sheet %s: %v", s.Properties.Title, err)
+		}
+		logger.Printf("Sheet %s was %sd\n", s.Properties.Title, action)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+type retryPolicy struct {
+	maxAttempts int
+	deadline    time.Duration
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// Context of the run, which is canceled on interrupts or the run deadline,
+// and the timeout of each API call made in it
+var (
+	runCtx     = context.Background()
+	apiTimeout = 60 * time.Second
+)
+
+var retrySettings = retryPolicy{
+	maxAttempts: 5,
+	deadline:    2 * time.Minute,
+	baseDelay:   time.Second,
+	maxDelay:    32 * time.Second,
+}
+
+// httpStatusError is the error of responses of raw HTTP requests, which is
+// told retryable like API errors
+type httpStatusError struct {
+	code   int
+	status string
+	header http.Header
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.status)
+}
+
+// Tells whether err is worth retrying, and how long the server asked to wait
+func isRetryableError(err error) (bool, time.Duration) {
+	var code int
+	var header http.Header
+	var apiErr *googleapi.Error
+	var statusErr *httpStatusError
+	var replayErr *unexpectedReplayError
+	switch {
+	case errors.As(err, &replayErr):
+		return false, 0
+	case errors.As(err, &apiErr):
+		code, header = apiErr.Code, apiErr.Header
+	case errors.As(err, &statusErr):
+		code, header = statusErr.code, statusErr.header
+	default:
+		// Transient network errors
+		var netErr net.Error
+		if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) ||
+			strings.Contains(err.Error(), "connection reset") {
+			return true, 0
+		}
+		return false, 0
+	}
+
+	if code != http.StatusTooManyRequests && code < 500 {
+		return false, 0
+	}
+	var wait time.Duration
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			wait = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			wait = time.Until(t)
+		}
+	}
+	return true, wait
+}
+
+// Context keys of the name of the API call made, and of the timeout of its
+// requests
+type (
+	callNameKey       struct{}
+	attemptTimeoutKey struct{}
+)
+
+// Makes the API call named like "get spreadsheet" in the run, giving fn the
+// context of its requests, which the transports of the API clients retry.
+// The error tells the call if the run is canceled meanwhile.
+func callAPI(name string, fn func(ctx context.Context) error) error {
+	err := fn(context.WithValue(runCtx, callNameKey{}, name))
+	if err != nil && runCtx.Err() != nil {
+		return fmt.Errorf("%s canceled: %w", name, err)
+	}
+	return err
+}
+
+// Returns the context of requests timing out after d each, instead of
+// api_timeout
+func withAttemptTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, attemptTimeoutKey{}, d)
+}
+
+// Tells whether the request may be made again after an attempt which may
+// have been made, as it leaves the same result whatever times it is made.
+// Writes of values and clears are, while appends, batch updates of
+// spreadsheets, copies and creations make something again each time.
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		path := req.URL.Path
+		return strings.HasSuffix(path, "/values:batchUpdate") || strings.HasSuffix(path, ":clear") || strings.HasSuffix(path, "/values:batchClear")
+	}
+	return false
+}
+
+// Tells whether the failure of the request came before it was made: 429
+// responses, and connections which could not be made
+func isUnsentFailure(resp *http.Response, err error) bool {
+	if err == nil {
+		return resp.StatusCode == http.StatusTooManyRequests
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Sends the request by send until it succeeds, retrying rate limit errors,
+// server errors and transient network errors with exponential backoff.
+// Requests which a failure may have made, like appends, are retried only
+// when it was not. Each attempt times out after api_timeout, and nothing is
+// retried once the context of the request is done.
+func retryRoundTrip(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	ctx := req.Context()
+	name, _ := ctx.Value(callNameKey{}).(string)
+	if name == "" {
+		name = req.Method + " " + req.URL.Host + req.URL.Path
+	}
+	timeout, ok := ctx.Value(attemptTimeoutKey{}).(time.Duration)
+	if !ok {
+		timeout = apiTimeout
+	}
+	// Bodies which can't be read again are sent once
+	resendable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	idempotent := isIdempotentRequest(req)
+	start := time.Now()
+	delay := retrySettings.baseDelay
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		r := req.WithContext(attemptCtx)
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			r.Body = body
+		}
+		resp, err := send(r)
+		if err != nil && ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%s timed out after %v: %w", name, timeout, err)
+		}
+		// The response of the last attempt tells the failure to the caller
+		finish := func() (*http.Response, error) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		if (err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500) || ctx.Err() != nil {
+			return finish()
+		}
+		failure := err
+		if failure == nil {
+			failure = &httpStatusError{code: resp.StatusCode, status: resp.Status, header: resp.Header}
+		}
+		retryable, wait := isRetryableError(failure)
+		if !retryable || !resendable || !(idempotent || isUnsentFailure(resp, err)) || attempt >= retrySettings.maxAttempts {
+			return finish()
+		}
+		if wait == 0 {
+			// Full jitter
+			wait = time.Duration(rand.Int63n(int64(delay))) + delay/2
+		}
+		if time.Since(start)+wait > retrySettings.deadline {
+			return finish()
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+		metrics.countRetry()
+		logAt(log.Default(), levelDebug, []logAttr{{"attempt", attempt}, {"wait_ms", wait.Milliseconds()}},
+			"Retrying %s in %v (attempt %d failed: %v)\n", name, wait.Round(time.Millisecond), attempt, failure)
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, fmt.Errorf("%s canceled: %w", name, failure)
+		}
+		if delay *= 2; delay > retrySettings.maxDelay {
+			delay = retrySettings.maxDelay
+		}
+	}
+}
+
+// cancelingBody cancels the context of the attempt which got the response
+// once the body is closed
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryTransport retries the requests of clients other than the API ones,
+// like the ones posting to webhooks
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return retryRoundTrip(req, t.base.RoundTrip)
+}
+
+// requestDurations are retry_deadline, api_timeout and export_timeout,
+// which are zero if not set
+type requestDurations struct {
+	retryDeadline time.Duration
+	apiTimeout    time.Duration
+	exportTimeout time.Duration
+}
+
+func getRequestDurations(c *Config) (*requestDurations, error) {
+	d := &requestDurations{}
+	for _, s := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"retry_deadline", c.RetryDeadline, &d.retryDeadline},
+		{"api_timeout", c.APITimeout, &d.apiTimeout},
+		{"export_timeout", c.ExportTimeout, &d.exportTimeout},
+	} {
+		if s.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(s.value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", s.name, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("%s must be positive", s.name)
+		}
+		*s.dst = v
+	}
+	return d, nil
+}
+
+// Applies the retry and timeout settings, which readConfig has checked
+func configureRetry(config *Config) {
+	if config.RetryMaxAttempts > 0 {
+		retrySettings.maxAttempts = config.RetryMaxAttempts
+	}
+	d, err := getRequestDurations(config)
+	if err != nil {
+		return
+	}
+	if d.retryDeadline > 0 {
+		retrySettings.deadline = d.retryDeadline
+	}
+	if d.apiTimeout > 0 {
+		apiTimeout = d.apiTimeout
+	}
+	if d.exportTimeout > 0 {
+		exportTimeout = d.exportTimeout
+	}
+}
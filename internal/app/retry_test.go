@@ -0,0 +1,181 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Uses retry settings of short delays in the test
+func useFastRetry(t *testing.T) {
+	t.Helper()
+	saved := retrySettings
+	retrySettings.baseDelay, retrySettings.maxDelay = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { retrySettings = saved })
+}
+
+func TestRetryRoundTrip(t *testing.T) {
+	useFastRetry(t)
+	tests := []struct {
+		name, method, path string
+		status             int
+		// Requests the server gets, the first failing with the status
+		want int
+	}{
+		{"get on a server error", http.MethodGet, "/v4/spreadsheets/ss", http.StatusInternalServerError, 2},
+		{"write of values on a server error", http.MethodPost, "/v4/spreadsheets/ss/values:batchUpdate", http.StatusServiceUnavailable, 2},
+		{"append on a server error", http.MethodPost, "/v4/spreadsheets/ss/values/A1:append", http.StatusInternalServerError, 1},
+		{"append on a rate limit error", http.MethodPost, "/v4/spreadsheets/ss/values/A1:append", http.StatusTooManyRequests, 2},
+		{"batch update on a server error", http.MethodPost, "/v4/spreadsheets/ss:batchUpdate", http.StatusBadGateway, 1},
+		{"get on a client error", http.MethodGet, "/v4/spreadsheets/ss", http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := 0
+			bodies := make([]string, 0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got++
+				b := new(strings.Builder)
+				if r.Body != nil {
+					buf := make([]byte, 64)
+					n, _ := r.Body.Read(buf)
+					b.Write(buf[:n])
+				}
+				bodies = append(bodies, b.String())
+				if got == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(tt.status)
+				}
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 0)}
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(`{"values": [[1]]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got != tt.want {
+				t.Errorf("got %d requests, want %d", got, tt.want)
+			}
+			if tt.want > 1 && resp.StatusCode != http.StatusOK {
+				t.Errorf("got status %d of the retried request", resp.StatusCode)
+			}
+			if tt.want == 1 && resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			for i, b := range bodies {
+				if b != `{"values": [[1]]}` {
+					t.Errorf("request %d got body %q", i+1, b)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryRoundTripTimeout(t *testing.T) {
+	useFastRetry(t)
+	savedTimeout := apiTimeout
+	apiTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { apiTimeout = savedTimeout })
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/v4/spreadsheets/ss", retrySettings.maxAttempts},
+		// The append may have been made before the timeout
+		{http.MethodPost, "/v4/spreadsheets/ss/values/A1:append", 1},
+	} {
+		var got int32
+		done := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&got, 1)
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		}))
+		client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 0)}
+		err := callAPI("get values", func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, tt.method, server.URL+tt.path, strings.NewReader("{}"))
+			if err != nil {
+				return err
+			}
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		})
+		close(done)
+		server.Close()
+		if err == nil || !strings.Contains(err.Error(), "get values timed out after 20ms") {
+			t.Errorf("%s %s: got %v", tt.method, tt.path, err)
+		}
+		if got := int(atomic.LoadInt32(&got)); got != tt.want {
+			t.Errorf("%s %s: got %d requests, want %d", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// Tells that a call to a server answering after the deadline of the call,
+// or after the one of the run, fails with the deadline error named by the
+// operation
+func TestCallAPIDeadline(t *testing.T) {
+	useFastRetry(t)
+	savedTimeout, savedEndpoint, savedCtx := apiTimeout, apiEndpoint, runCtx
+	t.Cleanup(func() { apiTimeout, apiEndpoint, runCtx = savedTimeout, savedEndpoint, savedCtx })
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(10 * time.Second):
+		case <-done:
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(done) })
+	apiEndpoint = server.URL + "/"
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 0)}
+	sht, err := sheets.NewService(context.Background(), getServiceOptions(client, "")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		timeout  time.Duration
+		deadline time.Duration
+		want     string
+	}{
+		{"api_timeout", 20 * time.Millisecond, 0, "get spreadsheet timed out after 20ms"},
+		{"deadline of the run", time.Minute, 50 * time.Millisecond, "get spreadsheet canceled"},
+	} {
+		apiTimeout = tt.timeout
+		ctx, stop := newRunContext(tt.deadline)
+		start := time.Now()
+		_, err := getSpreadsheet(sht, "slow-"+strings.ReplaceAll(tt.name, " ", "-"), "spreadsheetId")
+		elapsed := time.Since(start)
+		stop()
+		if err == nil || !strings.Contains(err.Error(), tt.want) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: got %v, want %q of a deadline error", tt.name, err, tt.want)
+		}
+		if elapsed > 5*time.Second {
+			t.Errorf("%s: gave up after %v", tt.name, elapsed)
+		}
+		if tt.deadline > 0 && ctx.Err() != context.DeadlineExceeded {
+			t.Errorf("%s: got run context error %v", tt.name, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// "make-invoices revise <month> --only <ID>" makes a corrected invoice of a
+// month already made, running the month again as with --force. Outputs of
+// revisions are named apart from the originals like "202404A社-rev2.pdf",
+// the original being the first revision.
+var revise bool
+
+// invoiceRevision is a revised invoice made in the run
+type invoiceRevision struct {
+	number int
+	// Invoice number of the original, which the revision has too unless
+	// new_number
+	originalNumber string
+	text           string
+}
+
+// Returns the suffix of the outputs of the revision, none for the original
+func revisionSuffix(revision int) string {
+	if revision == 0 {
+		return ""
+	}
+	return "-rev" + strconv.Itoa(revision)
+}
+
+// Returns the key of the month of the revision, for the files in drive and
+// the invoice numbers, so that the ones of the original are kept
+func revisionKey(month string, revision int) string {
+	if revision == 0 {
+		return month
+	}
+	return month + "/rev" + strconv.Itoa(revision)
+}
+
+// Returns the next revision of the invoice of the month, 2 for the first
+// revision after the original
+func getNextRevision(spreadsheetID string, targetTime time.Time) (int, error) {
+	state, err := loadState()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load state: %v", err)
+	}
+	last := state.Revisions[targetTime.Format("200601")][spreadsheetID]
+	if last < 1 {
+		last = 1
+	}
+	return last + 1, nil
+}
+
+// Returns the text marking the revision, written to the revision cell and
+// to the {{revision}} placeholder
+func (r *invoiceRevision) getText(rc *RevisionConfig) string {
+	if !rc.NewNumber || r.originalNumber == "" {
+		return rc.GetMarker()
+	}
+	return rc.GetMarker() + " " + msg("revision_of", r.originalNumber)
+}
+
+// Returns the placeholders of the revision, empty for the originals
+func getRevisionPlaceholders(r *invoiceRevision) map[string]string {
+	if r == nil {
+		return map[string]string{"revision": "", "revision_number": "", "original_invoice_number": ""}
+	}
+	return map[string]string{
+		"revision":                r.text,
+		"revision_number":         strconv.Itoa(r.number),
+		"original_invoice_number": r.originalNumber,
+	}
+}
+
+// Returns the invoice number of the revision and the one of the original.
+// The revision has the number of the original unless new_number, with
+// which it is assigned the next number of the sequence, kept for the
+// revision like the ones of months.
+func assignRevisionNumber(spreadsheetID string, targetTime time.Time, revision int, rc *RevisionConfig, config *Config) (number, original string, err error) {
+	state, err := loadState()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load state: %v", err)
+	}
+	original = getAssignedInvoiceNumber(state, spreadsheetID, targetTime)
+	if original == "" {
+		return "", "", fmt.Errorf("no invoice number is assigned to %s of spreadsheet %s to revise", targetTime.Format("200601"), spreadsheetID)
+	}
+	if !rc.NewNumber {
+		return original, original, nil
+	}
+	number, err = assignInvoiceNumberOf(spreadsheetID, targetTime, revision, config, func() (int, error) {
+		return 0, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return number, original, nil
+}
@@ -0,0 +1,320 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/fileutil"
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+type Backup struct {
+	mu sync.Mutex
+
+	RunID       string         `json:"run_id"`
+	TargetMonth string         `json:"target_month"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Sheets      []*SheetBackup `json:"sheets"`
+	// Sandbox runs write to copies of the spreadsheets, which are promoted
+	// to the spreadsheets by the recorded values
+	Sandbox bool `json:"sandbox,omitempty"`
+}
+
+type SheetBackup struct {
+	SpreadsheetID string         `json:"spreadsheet_id"`
+	SheetID       int64          `json:"sheet_id"`
+	SheetTitle    string         `json:"sheet_title"`
+	Created       bool           `json:"created"`
+	Ranges        []*RangeBackup `json:"ranges"`
+	// Spreadsheet the sandbox copy was made of
+	SourceSpreadsheetID string `json:"source_spreadsheet_id,omitempty"`
+}
+
+type RangeBackup struct {
+	Range    string          `json:"range"`
+	Previous [][]interface{} `json:"previous"`
+	Written  [][]interface{} `json:"written"`
+	// Values sent to the range, as entered by users
+	Values [][]interface{} `json:"values,omitempty"`
+}
+
+// Returns the ID of a new run, the time it starts with a random suffix, as
+// runs of other programs may start in the same second
+func newRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(b)
+}
+
+// Returns the backup of a new run of the month, whose file is created at
+// once so that no other run has the same ID. Dry runs write no backup.
+func newBackup(targetMonth string) (*Backup, error) {
+	for attempts := 1; ; attempts++ {
+		backup := &Backup{
+			RunID:       newRunID(),
+			TargetMonth: targetMonth,
+			CreatedAt:   time.Now(),
+			Sandbox:     sandbox,
+		}
+		if dryRun {
+			return backup, nil
+		}
+		err := createBackupFile(backup)
+		if err == nil {
+			return backup, nil
+		}
+		if !os.IsExist(err) || attempts >= 3 {
+			return nil, fmt.Errorf("Failed to create backup file: %v", err)
+		}
+	}
+}
+
+// Creates the file of the backup, failing if it exists
+func createBackupFile(backup *Backup) error {
+	path := getBackupFilePath(backup.RunID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	d, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func getBackupFilePath(runID string) string {
+	return getPathSiblingOfExecutable(filepath.Join("backups", runID+".json"))
+}
+
+func saveBackup(backup *Backup) error {
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	path := getBackupFilePath(backup.RunID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Failed to create backup directory: %v", err)
+	}
+	d, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode backup: %v", err)
+	}
+	// A run interrupted while saving keeps the backup saved before
+	if err := fileutil.WriteFileAtomic(path, d); err != nil {
+		return fmt.Errorf("Failed to save backup file: %v", err)
+	}
+	return nil
+}
+
+func loadBackup(runID string) (*Backup, error) {
+	f, err := os.Open(getBackupFilePath(runID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open backup file: %v", err)
+	}
+	defer f.Close()
+	var backup Backup
+	if err := json.NewDecoder(f).Decode(&backup); err != nil {
+		return nil, fmt.Errorf("Failed to decode backup file: %v", err)
+	}
+	return &backup, nil
+}
+
+// Reads ranges as formulas so that restoring them keeps formula cells intact
+func getRangeValues(sht *sheets.Service, spreadsheetID, sheetTitle string, ranges []string) ([][][]interface{}, error) {
+	return getRenderedRangeValues(sht, spreadsheetID, sheetTitle, ranges, "FORMULA")
+}
+
+func getRenderedRangeValues(sht *sheets.Service, spreadsheetID, sheetTitle string, ranges []string, valueRenderOption string) ([][][]interface{}, error) {
+	a1Ranges := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		a1Ranges = append(a1Ranges, timesheet.QuoteSheetTitle(sheetTitle)+"!"+r)
+	}
+	var values [][][]interface{}
+	if err := callAPI("get values", func(ctx context.Context) (err error) {
+		values, err = newSheetReaderWriter(sht).GetValues(ctx, spreadsheetID, a1Ranges, valueRenderOption)
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get sheet values: %v", err)
+	}
+	return values, nil
+}
+
+func equalRangeValues(a, b [][]interface{}) bool {
+	cell := func(v [][]interface{}, i, j int) string {
+		if i >= len(v) || j >= len(v[i]) || v[i][j] == nil {
+			return ""
+		}
+		return fmt.Sprint(v[i][j])
+	}
+	rows := len(a)
+	if len(b) > rows {
+		rows = len(b)
+	}
+	for i := 0; i < rows; i++ {
+		cols := 0
+		if i < len(a) {
+			cols = len(a[i])
+		}
+		if i < len(b) && len(b[i]) > cols {
+			cols = len(b[i])
+		}
+		for j := 0; j < cols; j++ {
+			if cell(a, i, j) != cell(b, i, j) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Pads values to the full size of the range so that trailing cells omitted by the API get cleared
+func padRangeValues(values [][]interface{}, rows, cols int) [][]interface{} {
+	padded := make([][]interface{}, 0, rows)
+	for i := 0; i < rows; i++ {
+		r := make([]interface{}, 0, cols)
+		for j := 0; j < cols; j++ {
+			if i < len(values) && j < len(values[i]) && values[i][j] != nil {
+				r = append(r, values[i][j])
+			} else {
+				r = append(r, "")
+			}
+		}
+		padded = append(padded, r)
+	}
+	return padded
+}
+
+func rollback(ctx context.Context, client *http.Client, backup *Backup, force bool) error {
+	sht, err := sheets.NewService(ctx, getServiceOptions(client, "")...)
+	if err != nil {
+		return fmt.Errorf("Failed to create sheet client: %v", err)
+	}
+
+	// Check that nobody edited the sheets since the run
+	for _, sb := range backup.Sheets {
+		ranges := make([]string, 0, len(sb.Ranges))
+		for _, rb := range sb.Ranges {
+			ranges = append(ranges, rb.Range)
+		}
+		current, err := getRangeValues(sht, sb.SpreadsheetID, sb.SheetTitle, ranges)
+		if err != nil {
+			return fmt.Errorf("Failed to check values: %v", err)
+		}
+		for i, rb := range sb.Ranges {
+			if rb.Written == nil || equalRangeValues(current[i], rb.Written) {
+				continue
+			}
+			if !force {
+				return fmt.Errorf("Values of %s!%s in spreadsheet %s were changed after the run (use --force to roll back anyway)", sb.SheetTitle, rb.Range, sb.SpreadsheetID)
+			}
+			log.Printf("Values of %s!%s in spreadsheet %s were changed after the run, rolling back anyway\n", sb.SheetTitle, rb.Range, sb.SpreadsheetID)
+		}
+	}
+
+	for _, sb := range backup.Sheets {
+		// Offer to delete the sheet if it was created in the run
+		if sb.Created {
+			log.Printf("Sheet %s in spreadsheet %s was created by the run. Delete it? (y/N): ", sb.SheetTitle, sb.SpreadsheetID)
+			var ans string
+			fmt.Scanln(&ans)
+			if strings.ToLower(strings.TrimSpace(ans)) == "y" {
+				if err := callAPI("delete sheet", func(ctx context.Context) error {
+					_, err := sht.Spreadsheets.BatchUpdate(sb.SpreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+						Requests: []*sheets.Request{{
+							DeleteSheet: &sheets.DeleteSheetRequest{
+								SheetId: sb.SheetID,
+							},
+						}},
+					}).Context(ctx).Do()
+					return err
+				}); err != nil {
+					return fmt.Errorf("Failed to delete sheet: %v", err)
+				}
+				log.Printf("Deleted sheet %s in spreadsheet %s\n", sb.SheetTitle, sb.SpreadsheetID)
+				continue
+			}
+		}
+
+		// Restore previous values
+		data := make([]*sheets.ValueRange, 0, len(sb.Ranges))
+		for _, rb := range sb.Ranges {
+			rows, cols, err := timesheet.A1RangeSize(rb.Range)
+			if err != nil {
+				return fmt.Errorf("Failed to parse backup range: %v", err)
+			}
+			data = append(data, &sheets.ValueRange{
+				Range:  timesheet.QuoteSheetTitle(sb.SheetTitle) + "!" + rb.Range,
+				Values: padRangeValues(rb.Previous, rows, cols),
+			})
+		}
+		if err := callAPI("restore values", func(ctx context.Context) error {
+			return newSheetReaderWriter(sht).UpdateValues(ctx, sb.SpreadsheetID, data)
+		}); err != nil {
+			return fmt.Errorf("Failed to restore sheet values: %v", err)
+		}
+		log.Printf("Restored sheet %s in spreadsheet %s\n", sb.SheetTitle, sb.SpreadsheetID)
+	}
+	return nil
+}
+
+func runRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	force := fs.Bool("force", false, "roll back even if values were changed after the run")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices rollback <run-id> [--force]")
+	}
+	runID := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	backup, err := loadBackup(runID)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := newRunContext(0)
+	defer stop()
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Loaded config")
+
+	configureRetry(config)
+
+	client, err := createAPIClient(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if err := rollback(ctx, client, backup, *force); err != nil {
+		return err
+	}
+
+	logMetrics()
+
+	log.Println("Done")
+	return nil
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewRunIDUnique(t *testing.T) {
+	ids := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newRunID()
+		if ids[id] {
+			t.Fatalf("run ID %s made twice", id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestNewBackupCreatesFile(t *testing.T) {
+	dir := t.TempDir()
+	saved := getPathSiblingOfExecutable
+	getPathSiblingOfExecutable = func(name string) string { return filepath.Join(dir, name) }
+	t.Cleanup(func() { getPathSiblingOfExecutable = saved })
+
+	backup, err := newBackup("202405")
+	if err != nil {
+		t.Fatalf("newBackup: %v", err)
+	}
+	// The run is recorded before it writes anything
+	loaded, err := loadBackup(backup.RunID)
+	if err != nil {
+		t.Fatalf("loadBackup: %v", err)
+	}
+	if loaded.TargetMonth != "202405" || len(loaded.Sheets) != 0 {
+		t.Errorf("got %+v", loaded)
+	}
+	// Another run of the same ID doesn't take the file
+	if err := createBackupFile(&Backup{RunID: backup.RunID}); !os.IsExist(err) {
+		t.Errorf("got %v, want the file existing", err)
+	}
+}
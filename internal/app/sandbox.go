@@ -0,0 +1,254 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// App properties marking the copies of sandbox runs
+const (
+	sandboxProperty      = "make_invoices_sandbox"
+	sandboxRunIDProperty = "make_invoices_run_id"
+)
+
+var sandbox bool
+
+// Copies the spreadsheet into sandbox_folder_id for a sandbox run. The copy
+// is titled apart from the spreadsheet, which also names the outputs apart.
+func createSandboxCopy(drv *drive.Service, spreadsheetID, runID string, config *Config) (*drive.File, error) {
+	var source *drive.File
+	if err := callAPI("get spreadsheet file", func(ctx context.Context) (err error) {
+		source, err = drv.Files.Get(spreadsheetID).SupportsAllDrives(true).Fields("name").Context(ctx).Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get spreadsheet file: %v", describeDriveError(err, "spreadsheet "+spreadsheetID))
+	}
+	f := &drive.File{
+		Name:          fmt.Sprintf("%s (sandbox %s)", source.Name, runID),
+		AppProperties: map[string]string{sandboxProperty: "true", sandboxRunIDProperty: runID},
+	}
+	if config.SandboxFolderID != "" {
+		f.Parents = []string{config.SandboxFolderID}
+	}
+	what := "the folder of spreadsheet " + spreadsheetID
+	if config.SandboxFolderID != "" {
+		what = "sandbox_folder_id " + config.SandboxFolderID
+	}
+	var copied *drive.File
+	if err := callAPI("copy spreadsheet", func(ctx context.Context) (err error) {
+		copied, err = drv.Files.Copy(spreadsheetID, f).SupportsAllDrives(true).Fields("id", "webViewLink").Context(ctx).Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to copy spreadsheet: %v", describeDriveError(err, what))
+	}
+	return copied, nil
+}
+
+// Trashes the sandbox copies older than sandbox_max_age
+func cleanUpSandboxCopies(drv *drive.Service, config *Config) error {
+	maxAge, err := config.GetSandboxMaxAge()
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("appProperties has { key='%s' and value='true' } and createdTime < '%s' and trashed = false",
+		sandboxProperty, time.Now().Add(-maxAge).UTC().Format(time.RFC3339))
+	var list *drive.FileList
+	if err := callAPI("list sandbox copies", func(ctx context.Context) (err error) {
+		list, err = drv.Files.List().Q(q).
+			Corpora("allDrives").
+			SupportsAllDrives(true).
+			IncludeItemsFromAllDrives(true).
+			Fields("files(id,name)").
+			Context(ctx).Do()
+		return
+	}); err != nil {
+		return fmt.Errorf("failed to list sandbox copies: %v", err)
+	}
+	for _, f := range list.Files {
+		if err := callAPI("trash sandbox copy", func(ctx context.Context) error {
+			_, err := drv.Files.Update(f.Id, &drive.File{Trashed: true}).SupportsAllDrives(true).Context(ctx).Do()
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to trash sandbox copy %s: %v", f.Name, err)
+		}
+		log.Printf("Trashed sandbox copy %s\n", f.Name)
+	}
+	return nil
+}
+
+// Writes the values written to the sandbox copies by the run to the
+// spreadsheets, as a run of its own which can be rolled back
+func runPromote(args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	force := fs.Bool("force", false, "promote even if the sheets were changed after the sandbox run")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices promote <run-id> [--force]")
+	}
+	runID := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	sandboxBackup, err := loadBackup(runID)
+	if err != nil {
+		return err
+	}
+	if !sandboxBackup.Sandbox {
+		return fmt.Errorf("Run %s is not a sandbox run", runID)
+	}
+
+	ctx, stop := newRunContext(0)
+	defer stop()
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	configureRetry(config)
+
+	client, err := createAPIClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	sht, err := sheets.NewService(ctx, getServiceOptions(client, "")...)
+	if err != nil {
+		return fmt.Errorf("Failed to create sheet client: %v", err)
+	}
+	loc, err := config.GetLocation()
+	if err != nil {
+		return fmt.Errorf("Failed to load timezone: %v", err)
+	}
+	targetTime, err := time.ParseInLocation("200601", sandboxBackup.TargetMonth, loc)
+	if err != nil {
+		return fmt.Errorf("Invalid month of run %s: %v", runID, err)
+	}
+
+	backup, err := newBackup(sandboxBackup.TargetMonth)
+	if err != nil {
+		return err
+	}
+	for _, sb := range sandboxBackup.Sheets {
+		if err := promoteSheet(sht, sb, targetTime, backup, config, *force); err != nil {
+			return fmt.Errorf("Failed to promote sheet %s to spreadsheet %s: %v", sb.SheetTitle, sb.SourceSpreadsheetID, err)
+		}
+		log.Printf("Promoted sheet %s to spreadsheet %s\n", sb.SheetTitle, sb.SourceSpreadsheetID)
+	}
+
+	logMetrics()
+
+	log.Printf("Run ID: %s (to undo, run: make-invoices rollback %s)\n", backup.RunID, backup.RunID)
+	return nil
+}
+
+// Writes the values of the sheet of the sandbox run to the spreadsheet it
+// was copied from. The sheet is created as in runs if it is missing, and
+// the values are written only if the sheet has the ones the copy had.
+func promoteSheet(sht *sheets.Service, sb *SheetBackup, targetTime time.Time, backup *Backup, config *Config, force bool) error {
+	if sb.SourceSpreadsheetID == "" {
+		return fmt.Errorf("no spreadsheet is recorded for the copy %s", sb.SpreadsheetID)
+	}
+	ranges := make([]string, 0, len(sb.Ranges))
+	data := make([]*sheets.ValueRange, 0, len(sb.Ranges))
+	for _, rb := range sb.Ranges {
+		if rb.Values == nil {
+			return fmt.Errorf("no values are recorded for %s", rb.Range)
+		}
+		ranges = append(ranges, rb.Range)
+		data = append(data, &sheets.ValueRange{Range: timesheet.QuoteSheetTitle(sb.SheetTitle) + "!" + rb.Range, Values: rb.Values})
+	}
+
+	spreadsheet, err := getSpreadsheet(sht, sb.SourceSpreadsheetID, spreadsheetSheetsFields)
+	if err != nil {
+		return fmt.Errorf("failed to get spreadsheet: %v", err)
+	}
+	var sheetID int64
+	found, created := false, false
+	for _, s := range spreadsheet.Sheets {
+		if s.Properties.Title == sb.SheetTitle {
+			sheetID, found = s.Properties.SheetId, true
+		}
+	}
+	if !found {
+		copyFrom, err := findPromoteCopySource(spreadsheet, targetTime, config)
+		if err != nil {
+			return err
+		}
+		log.Printf("Creating sheet %s from %s\n", sb.SheetTitle, copyFrom.Properties.Title)
+		if sheetID, created, err = createMonthSheet(sht, sb.SourceSpreadsheetID, copyFrom, sb.SheetTitle); err != nil {
+			return err
+		}
+	}
+
+	previous, err := getRangeValues(sht, sb.SourceSpreadsheetID, sb.SheetTitle, ranges)
+	if err != nil {
+		return err
+	}
+	for i, rb := range sb.Ranges {
+		if equalRangeValues(previous[i], rb.Previous) {
+			continue
+		}
+		if !force {
+			return fmt.Errorf("values of %s!%s differ from the ones of the sandbox copy (use --force to promote anyway)", sb.SheetTitle, rb.Range)
+		}
+		log.Printf("Values of %s!%s differ from the ones of the sandbox copy, promoting anyway\n", sb.SheetTitle, rb.Range)
+	}
+
+	sheetBackup := &SheetBackup{
+		SpreadsheetID: sb.SourceSpreadsheetID,
+		SheetID:       sheetID,
+		SheetTitle:    sb.SheetTitle,
+		Created:       created,
+	}
+	for i, values := range previous {
+		sheetBackup.Ranges = append(sheetBackup.Ranges, &RangeBackup{
+			Range:    ranges[i],
+			Previous: values,
+			Values:   sb.Ranges[i].Values,
+		})
+	}
+	backup.Sheets = append(backup.Sheets, sheetBackup)
+	if err := saveBackup(backup); err != nil {
+		return err
+	}
+
+	if err := callAPI("update values", func(ctx context.Context) error {
+		return newSheetReaderWriter(sht).UpdateValues(ctx, sb.SourceSpreadsheetID, data)
+	}); err != nil {
+		return fmt.Errorf("failed to set values to sheet: %v", err)
+	}
+
+	written, err := getRangeValues(sht, sb.SourceSpreadsheetID, sb.SheetTitle, ranges)
+	if err != nil {
+		return err
+	}
+	for i, values := range written {
+		sheetBackup.Ranges[i].Written = values
+	}
+	if err := saveBackup(backup); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns the sheet to copy for the month, the template sheet or the latest
+// month sheet as in runs
+func findPromoteCopySource(spreadsheet *sheets.Spreadsheet, targetTime time.Time, config *Config) (*sheets.Sheet, error) {
+	for _, sc := range config.GetSpreadsheets() {
+		if sc.ID != spreadsheet.SpreadsheetId || sc.TemplateSheet == "" {
+			continue
+		}
+		for _, s := range spreadsheet.Sheets {
+			if s.Properties.Title == sc.TemplateSheet {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("no template sheet %s in the spreadsheet", sc.TemplateSheet)
+	}
+	return findCopySourceSheet(spreadsheet, targetTime, config)
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tsujio/make-invoices/internal/calendarsource"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// session is what the process keeps for the API client: the services made
+// with it, and the spreadsheets got by getSpreadsheet, which are dropped on
+// any write to the spreadsheet. Commands other than runs have no session,
+// and get spreadsheets every time.
+type session struct {
+	client   *http.Client
+	sheets   *sheets.Service
+	drive    *drive.Service
+	docs     *docs.Service
+	calendar *calendar.Service
+	events   calendarsource.EventLister
+
+	mu sync.Mutex
+	// Spreadsheets by ID and fields
+	spreadsheets map[string]*sheets.Spreadsheet
+	// Writes to each spreadsheet, and to all of them, so that a spreadsheet
+	// got while it was written is not kept
+	generations map[string]int
+	epoch       int
+}
+
+var (
+	currentSession *session
+	sessionMu      sync.Mutex
+)
+
+// Endpoint of the APIs instead of the ones of Google if not empty, like
+// "http://127.0.0.1:8080/", which tests point at a fake server
+var apiEndpoint string
+
+// Returns the options of services of the client. The path is the one of
+// the service under apiEndpoint, like "calendar/v3/".
+func getServiceOptions(client *http.Client, path string) []option.ClientOption {
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if apiEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(apiEndpoint+path))
+	}
+	return opts
+}
+
+// Returns the session of the client, made on the first call
+func getSession(ctx context.Context, client *http.Client) (*session, error) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if currentSession != nil && currentSession.client == client {
+		return currentSession, nil
+	}
+	s := &session{
+		client:       client,
+		spreadsheets: make(map[string]*sheets.Spreadsheet),
+		generations:  make(map[string]int),
+	}
+	var err error
+	if s.sheets, err = sheets.NewService(ctx, getServiceOptions(client, "")...); err != nil {
+		return nil, fmt.Errorf("Failed to create sheet client: %v", err)
+	}
+	if s.drive, err = drive.NewService(ctx, getServiceOptions(client, "drive/v3/")...); err != nil {
+		return nil, fmt.Errorf("Failed to create drive client: %v", err)
+	}
+	if s.docs, err = docs.NewService(ctx, getServiceOptions(client, "")...); err != nil {
+		return nil, fmt.Errorf("Failed to create docs client: %v", err)
+	}
+	if s.calendar, err = calendar.NewService(ctx, getServiceOptions(client, "calendar/v3/")...); err != nil {
+		return nil, fmt.Errorf("Failed to create calendar client: %v", err)
+	}
+	s.events = &calendarsource.Google{Service: s.calendar}
+	currentSession = s
+	return s, nil
+}
+
+func getCurrentSession() *session {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	return currentSession
+}
+
+func spreadsheetCacheKey(spreadsheetID string, fields googleapi.Field) string {
+	return spreadsheetID + "/" + string(fields)
+}
+
+// Returns a copy of the spreadsheet got with the fields, and the writes to
+// it so far
+func (s *session) getCachedSpreadsheet(spreadsheetID string, fields googleapi.Field) (*sheets.Spreadsheet, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spreadsheet, ok := s.spreadsheets[spreadsheetCacheKey(spreadsheetID, fields)]
+	if !ok {
+		return nil, s.generations[spreadsheetID] + s.epoch
+	}
+	metrics.countCacheHit("spreadsheets_get")
+	return copySpreadsheet(spreadsheet), s.generations[spreadsheetID] + s.epoch
+}
+
+// Keeps the spreadsheet unless it was written since generation
+func (s *session) cacheSpreadsheet(spreadsheetID string, fields googleapi.Field, generation int, spreadsheet *sheets.Spreadsheet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generations[spreadsheetID]+s.epoch != generation {
+		return
+	}
+	s.spreadsheets[spreadsheetCacheKey(spreadsheetID, fields)] = copySpreadsheet(spreadsheet)
+}
+
+// Drops the spreadsheets got of the ID, or all of them if the ID is empty
+func (s *session) invalidateSpreadsheet(spreadsheetID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if spreadsheetID == "" {
+		s.epoch++
+		s.spreadsheets = make(map[string]*sheets.Spreadsheet)
+		return
+	}
+	s.generations[spreadsheetID]++
+	for key := range s.spreadsheets {
+		if strings.HasPrefix(key, spreadsheetID+"/") {
+			delete(s.spreadsheets, key)
+		}
+	}
+}
+
+// Callers may change the spreadsheets they get, so the cache has copies of
+// its own
+func copySpreadsheet(spreadsheet *sheets.Spreadsheet) *sheets.Spreadsheet {
+	d, err := json.Marshal(spreadsheet)
+	if err != nil {
+		panic(err)
+	}
+	c := &sheets.Spreadsheet{}
+	if err := json.Unmarshal(d, c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Drops the spreadsheet written by the request from the cache. Every write
+// to Sheets, of values too, goes through here from the shared transport.
+func invalidateWrittenSpreadsheet(req *http.Request) {
+	const prefix = "/v4/spreadsheets/"
+	if req.Method == http.MethodGet || !strings.HasPrefix(req.URL.Path, prefix) {
+		return
+	}
+	s := getCurrentSession()
+	if s == nil {
+		return
+	}
+	// Sheets copied to other spreadsheets change spreadsheets not in the
+	// path
+	if strings.HasSuffix(req.URL.Path, ":copyTo") {
+		s.invalidateSpreadsheet("")
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, prefix)
+	if i := strings.IndexAny(id, "/:"); i >= 0 {
+		id = id[:i]
+	}
+	s.invalidateSpreadsheet(id)
+}
+
+// Checks right before writing that the sheet still has the title, as a
+// cached spreadsheet may not have the changes made by hand during the run
+func checkSheetUnchanged(sht *sheets.Service, spreadsheetID string, sheetID int64, title string) error {
+	var spreadsheet *sheets.Spreadsheet
+	if err := callAPI("get spreadsheet", func(ctx context.Context) (err error) {
+		spreadsheet, err = newSheetReaderWriter(sht).GetSpreadsheet(ctx, spreadsheetID, "sheets.properties(sheetId,title)")
+		return
+	}); err != nil {
+		return fmt.Errorf("failed to get spreadsheet: %v", err)
+	}
+	for _, s := range spreadsheet.Sheets {
+		if s.Properties.SheetId != sheetID {
+			continue
+		}
+		if s.Properties.Title != title {
+			return fmt.Errorf("sheet %s was renamed to %s during the run, not writing", title, s.Properties.Title)
+		}
+		return nil
+	}
+	return fmt.Errorf("sheet %s was deleted during the run, not writing", title)
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Returns the sheets in the order of sheet_order. Month sheets are sorted
+// by month, and the others keep their relative order in front of them, or
+// behind them with non_month_sheets "back".
+func getSortedSheets(props []*sheets.SheetProperties, config *Config) ([]*sheets.SheetProperties, error) {
+	if config.SheetOrder != "newest_first" && config.SheetOrder != "oldest_first" {
+		return nil, fmt.Errorf("unknown sheet_order: %q (must be newest_first, oldest_first or none)", config.SheetOrder)
+	}
+	if config.NonMonthSheets != "" && config.NonMonthSheets != "front" && config.NonMonthSheets != "back" {
+		return nil, fmt.Errorf("unknown non_month_sheets: %q (must be front or back)", config.NonMonthSheets)
+	}
+
+	months := make([]*sheets.SheetProperties, 0)
+	others := make([]*sheets.SheetProperties, 0)
+	monthOf := make(map[int64]time.Time)
+	for _, p := range props {
+		if month, ok := timesheet.ParseMonthTitle(p.Title, time.UTC); ok {
+			months = append(months, p)
+			monthOf[p.SheetId] = month
+		} else {
+			others = append(others, p)
+		}
+	}
+	sort.SliceStable(months, func(i, j int) bool {
+		if config.SheetOrder == "newest_first" {
+			return monthOf[months[i].SheetId].After(monthOf[months[j].SheetId])
+		}
+		return monthOf[months[i].SheetId].Before(monthOf[months[j].SheetId])
+	})
+	if config.NonMonthSheets == "back" {
+		return append(months, others...), nil
+	}
+	return append(others, months...), nil
+}
+
+// Moves the sheets out of the place of sheet_order
+func sortSheets(sht *sheets.Service, spreadsheetID string, config *Config, logger *log.Logger) error {
+	if config.SheetOrder == "" || config.SheetOrder == "none" {
+		return nil
+	}
+
+	spreadsheet, err := getSpreadsheet(sht, spreadsheetID, "sheets.properties(sheetId,title,index)")
+	if err != nil {
+		return fmt.Errorf("failed to get sheets: %v", err)
+	}
+	current := make([]*sheets.SheetProperties, 0, len(spreadsheet.Sheets))
+	for _, s := range spreadsheet.Sheets {
+		current = append(current, s.Properties)
+	}
+	sort.SliceStable(current, func(i, j int) bool { return current[i].Index < current[j].Index })
+	sorted, err := getSortedSheets(current, config)
+	if err != nil {
+		return err
+	}
+
+	// Each sheet is moved forward to its place in turn, so that the sheets
+	// before it are already in place
+	requests := make([]*sheets.Request, 0)
+	for i, p := range sorted {
+		if current[i].SheetId == p.SheetId {
+			continue
+		}
+		for j := i + 1; j < len(current); j++ {
+			if current[j].SheetId == p.SheetId {
+				copy(current[i+1:j+1], current[i:j])
+				current[i] = p
+				break
+			}
+		}
+		if dryRun {
+			logger.Printf("Sheet %s would be moved to position %d\n", p.Title, i+1)
+			continue
+		}
+		requests = append(requests, &sheets.Request{
+			UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+				Fields: "index",
+				Properties: &sheets.SheetProperties{
+					SheetId:         p.SheetId,
+					Index:           int64(i),
+					ForceSendFields: []string{"SheetId", "Index"},
+				},
+			},
+		})
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	if err := callAPI("sort sheets", func(ctx context.Context) error {
+		_, err := sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: requests,
+		}).Context(ctx).Do()
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to sort sheets: %v", err)
+	}
+	logger.Printf("Moved %d sheets into order\n", len(requests))
+	return nil
+}
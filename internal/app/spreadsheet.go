@@ -0,0 +1,91 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Fields of spreadsheets got by Spreadsheets.Get. The API returns every
+// sheet with all of its formats by default, which takes long for
+// spreadsheets of many sheets, so spreadsheets are always got with the
+// fields used.
+const (
+	// What runs use: the sheets, their locks, and the named ranges
+	spreadsheetRunFields googleapi.Field = "spreadsheetId,properties(title,timeZone,locale),namedRanges,sheets(properties,protectedRanges)"
+	// The titles of the spreadsheet and of the sheets
+	spreadsheetSheetsFields googleapi.Field = "spreadsheetId,properties.title,sheets.properties"
+)
+
+// Returns the reader and writer of the timesheets of the service, which
+// tests replace with a fake
+var newSheetReaderWriter = func(sht *sheets.Service) timesheet.SheetReaderWriter {
+	return &timesheet.Google{Service: sht}
+}
+
+// Spreadsheets whose full size was logged, in verbose runs
+var spreadsheetSizesLogged sync.Map
+
+// Gets the spreadsheet with only the fields. Verbose runs log the size of
+// the response and, once for each spreadsheet, of the full spreadsheet.
+func getSpreadsheet(sht *sheets.Service, spreadsheetID string, fields googleapi.Field) (*sheets.Spreadsheet, error) {
+	// Runs keep the spreadsheets got until they are written
+	s := getCurrentSession()
+	generation := 0
+	if s != nil {
+		var cached *sheets.Spreadsheet
+		if cached, generation = s.getCachedSpreadsheet(spreadsheetID, fields); cached != nil {
+			return cached, nil
+		}
+	}
+	var spreadsheet *sheets.Spreadsheet
+	if err := callAPI("get spreadsheet", func(ctx context.Context) (err error) {
+		spreadsheet, err = newSheetReaderWriter(sht).GetSpreadsheet(ctx, spreadsheetID, fields)
+		return
+	}); err != nil {
+		return nil, err
+	}
+	if verbose {
+		logSpreadsheetSizes(sht, spreadsheetID, fields, spreadsheet)
+	}
+	if s != nil {
+		s.cacheSpreadsheet(spreadsheetID, fields, generation, spreadsheet)
+	}
+	return spreadsheet, nil
+}
+
+// Logs the size of the spreadsheet got with the fields against the one of
+// the full spreadsheet. Sizes are the ones of the decoded responses encoded
+// again, as the responses are compressed.
+func logSpreadsheetSizes(sht *sheets.Service, spreadsheetID string, fields googleapi.Field, spreadsheet *sheets.Spreadsheet) {
+	size := func(s *sheets.Spreadsheet) int {
+		d, _ := json.Marshal(s)
+		return len(d)
+	}
+	if _, logged := spreadsheetSizesLogged.LoadOrStore(spreadsheetID, true); logged {
+		logVerbose("Got spreadsheet %s with fields %s: %d bytes\n", spreadsheetID, fields, size(spreadsheet))
+		return
+	}
+	var full *sheets.Spreadsheet
+	if err := callAPI("get full spreadsheet", func(ctx context.Context) (err error) {
+		full, err = sht.Spreadsheets.Get(spreadsheetID).Context(ctx).Do()
+		return
+	}); err != nil {
+		logVerbose("Got spreadsheet %s with fields %s: %d bytes (failed to get the full spreadsheet: %v)\n", spreadsheetID, fields, size(spreadsheet), err)
+		return
+	}
+	restricted, total := size(spreadsheet), size(full)
+	logVerbose("Got spreadsheet %s with fields %s: %d bytes, %s of the full %d bytes\n", spreadsheetID, fields, restricted, formatPercent(restricted, total), total)
+}
+
+func formatPercent(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
@@ -0,0 +1,373 @@
+package app
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/fileutil"
+)
+
+// State is what the tool keeps between runs in state.json, or state_file,
+// with a section for each feature. Files of older schema versions are
+// migrated when loaded.
+type State struct {
+	SchemaVersion   int              `json:"schema_version"`
+	InvoiceSequence *InvoiceSequence `json:"invoice_sequence"`
+	// Sequences of each spreadsheet kept by older versions, from which the
+	// shared sequence is started
+	InvoiceNumbers map[string]*SpreadsheetInvoiceSequence `json:"invoice_numbers,omitempty"`
+	// IDs of drive folders and files cached by uploads
+	DriveFolders map[string]string `json:"drive_folders"`
+	DriveFiles   map[string]string `json:"drive_files"`
+	LastRun      *LastRun          `json:"last_run,omitempty"`
+	// Spreadsheets made successfully in each month like "202405", which
+	// the remind command looks for
+	Completed map[string]map[string]*CompletedSpreadsheet `json:"completed,omitempty"`
+	// Layouts of the sheets of each spreadsheet written last
+	TemplateFingerprints map[string]*TemplateFingerprint `json:"template_fingerprints,omitempty"`
+	// Last revision of the invoice of each month by spreadsheet, made by
+	// the revise command
+	Revisions map[string]map[string]int `json:"revisions,omitempty"`
+	// When the month sheets of each month were last exported again by the
+	// export command, by spreadsheet
+	Exported map[string]map[string]time.Time `json:"exported,omitempty"`
+	// Emails of the invoices sent to the clients, keyed like
+	// "<spreadsheet ID>/202405"
+	SentEmails map[string]*SentEmail `json:"sent_emails,omitempty"`
+	// Outputs uploaded to the clients by drive_upload, keyed like
+	// "<spreadsheet ID>/202405" with the kind of the document if any
+	Uploads map[string]*UploadedFile `json:"uploads,omitempty"`
+	// Work days fetched from calendars, keyed like
+	// "<calendar ID>/<billing period>/<kind>"
+	CalendarCache map[string]*calendarCacheEntry `json:"calendar_cache,omitempty"`
+	// Last check for updates
+	UpdateCheck *updateCheck `json:"update_check,omitempty"`
+}
+
+const stateSchemaVersion = 2
+
+// Migrations of the sections of the state file of the path, the index being
+// the version migrated from. Files written before schema_version are of
+// version 0.
+var stateMigrations = []func(path string, sections map[string]json.RawMessage) error{
+	// Version 1 only added schema_version
+	func(path string, sections map[string]json.RawMessage) error { return nil },
+	migrateStateFiles,
+}
+
+// Version 2 keeps the calendar cache and the update check, which were files
+// of their own, in the state. The files are removed once taken in.
+func migrateStateFiles(path string, sections map[string]json.RawMessage) error {
+	files := []struct {
+		section string
+		path    string
+	}{
+		{"calendar_cache", getPathSiblingOfExecutable("calendar_cache.json")},
+		{"update_check", filepath.Join(filepath.Dir(path), "update_check.json")},
+	}
+	for _, f := range files {
+		d, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		// Both are only caches, so broken ones are dropped
+		if _, ok := sections[f.section]; !ok && json.Valid(d) {
+			sections[f.section] = json.RawMessage(d)
+		}
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateFile is state_file of the config, if any
+var stateFile string
+
+// The state is read and written by one goroutine at a time in the run, and
+// by one run at a time with the lock file
+var stateMu sync.Mutex
+
+func getStateFilePath() string {
+	if stateFile == "" {
+		return getPathSiblingOfExecutable("state.json")
+	}
+	if filepath.IsAbs(stateFile) {
+		return stateFile
+	}
+	return getPathSiblingOfExecutable(stateFile)
+}
+
+// Takes the lock of the state in the run and among runs, returning the
+// function releasing it
+func lockState() (func(), error) {
+	stateMu.Lock()
+	unlock, err := fileutil.AcquireLockFile(getStateFilePath()+".lock", "state file")
+	if err != nil {
+		stateMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		stateMu.Unlock()
+	}, nil
+}
+
+// Returns the state
+func loadState() (*State, error) {
+	unlock, err := lockState()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return readStateFile(getStateFilePath())
+}
+
+// Saves the state changed by fn, which is given the state saved last. The
+// state is not saved if fn fails.
+func updateState(fn func(state *State) error) error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path := getStateFilePath()
+	state, err := readStateFile(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+	return writeStateFile(path, state)
+}
+
+// Reads the state file, migrating it to the current schema version. The
+// file before the migration is kept with the .bak suffix.
+func readStateFile(path string) (*State, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{SchemaVersion: stateSchemaVersion}, nil
+		}
+		return nil, err
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(d, &sections); err != nil {
+		return nil, fmt.Errorf("failed to decode %s (run make-invoices state repair): %v", path, err)
+	}
+	version, err := getStateSchemaVersion(sections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s (run make-invoices state repair): %v", path, err)
+	}
+	if version > stateSchemaVersion {
+		return nil, fmt.Errorf("%s is of schema version %d, newer than %d of this version of the tool", path, version, stateSchemaVersion)
+	}
+	if version < stateSchemaVersion {
+		if err := fileutil.WriteFileAtomic(path+".bak", d); err != nil {
+			return nil, fmt.Errorf("failed to back up state before migration: %v", err)
+		}
+		if d, err = migrateState(path, sections, version); err != nil {
+			return nil, err
+		}
+	}
+	state := &State{}
+	if err := json.Unmarshal(d, state); err != nil {
+		return nil, fmt.Errorf("failed to decode %s (run make-invoices state repair): %v", path, err)
+	}
+	if version < stateSchemaVersion {
+		if err := writeStateFile(path, state); err != nil {
+			return nil, fmt.Errorf("failed to save migrated state: %v", err)
+		}
+		log.Printf("Migrated %s from schema version %d to %d, keeping the file before as %s.bak\n", path, version, stateSchemaVersion, path)
+	}
+	return state, nil
+}
+
+func getStateSchemaVersion(sections map[string]json.RawMessage) (int, error) {
+	version := 0
+	if v, ok := sections["schema_version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return 0, fmt.Errorf("invalid schema_version: %v", err)
+		}
+	}
+	return version, nil
+}
+
+// Migrates the sections of the state file of the path from the version to
+// the current one, returning the state encoded
+func migrateState(path string, sections map[string]json.RawMessage, version int) ([]byte, error) {
+	for v := version; v < stateSchemaVersion; v++ {
+		if err := stateMigrations[v](path, sections); err != nil {
+			return nil, fmt.Errorf("failed to migrate state from schema version %d: %v", v, err)
+		}
+	}
+	sections["schema_version"] = json.RawMessage(fmt.Sprint(stateSchemaVersion))
+	return json.Marshal(sections)
+}
+
+// Saves the state through a temporary file so that an interrupted save
+// doesn't lose assigned numbers
+func writeStateFile(path string, state *State) error {
+	state.SchemaVersion = stateSchemaVersion
+	d, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(path, d)
+}
+
+// Reads state_file of the config for the state commands, which work
+// without a valid config too, returning the config or an empty one
+func configureStateFile() *Config {
+	config, err := readConfig()
+	if err != nil {
+		logWarnf(log.Default(), "Warning: using the default state file, as the config can't be read: %v\n", err)
+		return &Config{}
+	}
+	stateFile = config.StateFile
+	return config
+}
+
+// Shows or repairs the state
+func runState(args []string) error {
+	if len(args) < 1 {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices state show [section] | state repair")
+	}
+	configureStateFile()
+	switch args[0] {
+	case "show":
+		return runStateShow(args[1:])
+	case "repair":
+		return runStateRepair(args[1:])
+	default:
+		return newRunError(exitConfigError, "config", "Unknown state command: %s (must be show or repair)", args[0])
+	}
+}
+
+// Prints the state, or a section of it like "invoice_sequence"
+func runStateShow(args []string) error {
+	fs := flag.NewFlagSet("state show", flag.ExitOnError)
+	fs.Parse(args)
+
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("Failed to load state: %v", err)
+	}
+	d, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed to encode state: %v", err)
+	}
+	var v interface{}
+	if fs.NArg() >= 1 {
+		var sections map[string]json.RawMessage
+		if err := json.Unmarshal(d, &sections); err != nil {
+			return fmt.Errorf("Failed to encode state: %v", err)
+		}
+		section, ok := sections[fs.Arg(0)]
+		if !ok {
+			names := make([]string, 0, len(sections))
+			for name := range sections {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return newRunError(exitConfigError, "config", "No section %s in the state (sections: %v)", fs.Arg(0), names)
+		}
+		v = section
+	} else {
+		v = state
+	}
+	d, err = json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode state: %v", err)
+	}
+	log.Printf("State file %s, schema version %d\n", getStateFilePath(), state.SchemaVersion)
+	fmt.Println(string(d))
+	return nil
+}
+
+// Rewrites a state file which can't be loaded, from its .bak if it can't
+// be decoded at all, dropping the sections which can't be. The file before
+// the repair is kept with the .corrupt suffix.
+func runStateRepair(args []string) error {
+	fs := flag.NewFlagSet("state repair", flag.ExitOnError)
+	fs.Parse(args)
+
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path := getStateFilePath()
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("No state file %s to repair\n", path)
+			return nil
+		}
+		return fmt.Errorf("Failed to read state: %v", err)
+	}
+	if _, err := readStateFile(path); err == nil {
+		log.Printf("State file %s has no problems\n", path)
+		return nil
+	}
+
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(d, &sections); err != nil {
+		log.Printf("State file %s can't be decoded: %v\n", path, err)
+		sections = nil
+		if bak, err := ioutil.ReadFile(path + ".bak"); err == nil && json.Unmarshal(bak, &sections) == nil {
+			log.Printf("Restoring the sections of %s.bak\n", path)
+		} else {
+			log.Println("Starting with an empty state")
+			sections = make(map[string]json.RawMessage)
+		}
+	}
+	version, err := getStateSchemaVersion(sections)
+	if err != nil || version > stateSchemaVersion {
+		log.Printf("Dropping schema_version %s\n", sections["schema_version"])
+		delete(sections, "schema_version")
+		version = 0
+	}
+	// Sections are decoded one by one so that a broken one loses only
+	// itself. Migrations run on the sections left.
+	for name, section := range sections {
+		one, err := json.Marshal(map[string]json.RawMessage{name: section})
+		if err != nil {
+			return fmt.Errorf("Failed to encode section %s: %v", name, err)
+		}
+		if err := json.Unmarshal(one, &State{}); err != nil {
+			log.Printf("Dropping section %s: %v\n", name, err)
+			delete(sections, name)
+		}
+	}
+	repaired, err := migrateState(path, sections, version)
+	if err != nil {
+		return err
+	}
+	state := &State{}
+	if err := json.Unmarshal(repaired, state); err != nil {
+		return fmt.Errorf("Failed to decode repaired state: %v", err)
+	}
+
+	corrupt := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102150405"))
+	if err := fileutil.WriteFileAtomic(corrupt, d); err != nil {
+		return fmt.Errorf("Failed to keep the state before the repair: %v", err)
+	}
+	if err := writeStateFile(path, state); err != nil {
+		return fmt.Errorf("Failed to save repaired state: %v", err)
+	}
+	log.Printf("Repaired %s, keeping the file before as %s\n", path, corrupt)
+	return nil
+}
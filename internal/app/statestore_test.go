@@ -0,0 +1,231 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Points the state at a file in a temporary directory, returning its path
+func setTestStateFile(t *testing.T) string {
+	t.Helper()
+	saved := stateFile
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	t.Cleanup(func() { stateFile = saved })
+	return stateFile
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadStateFileNone(t *testing.T) {
+	path := setTestStateFile(t)
+	state, err := readStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.SchemaVersion != stateSchemaVersion {
+		t.Errorf("schema version = %d, want %d", state.SchemaVersion, stateSchemaVersion)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file is written by reading: %v", err)
+	}
+}
+
+// Files written before schema_version are migrated, taking in the update
+// check kept in a file of its own
+func TestReadStateFileMigrateV0(t *testing.T) {
+	path := setTestStateFile(t)
+	v0 := `{"invoice_numbers": {"sheet": {"last": 3, "assigned": {"202404": 3}}}, "drive_folders": {"2024": "folder"}}`
+	writeTestFile(t, path, v0)
+	checkPath := filepath.Join(filepath.Dir(path), "update_check.json")
+	writeTestFile(t, checkPath, `{"checked_at": "2024-05-01T00:00:00Z", "latest": "v1.2.0"}`)
+
+	state, err := readStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.SchemaVersion != stateSchemaVersion {
+		t.Errorf("schema version = %d, want %d", state.SchemaVersion, stateSchemaVersion)
+	}
+	if s := state.InvoiceNumbers["sheet"]; s == nil || s.Last != 3 || s.Assigned["202404"] != 3 {
+		t.Errorf("invoice_numbers = %+v, want kept", s)
+	}
+	if state.DriveFolders["2024"] != "folder" {
+		t.Errorf("drive_folders = %v, want kept", state.DriveFolders)
+	}
+	if c := state.UpdateCheck; c == nil || c.Latest != "v1.2.0" || !c.CheckedAt.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("update_check = %+v, want taken from update_check.json", c)
+	}
+	if _, err := os.Stat(checkPath); !os.IsNotExist(err) {
+		t.Errorf("update_check.json is left after the migration: %v", err)
+	}
+	if d, err := ioutil.ReadFile(path + ".bak"); err != nil || string(d) != v0 {
+		t.Errorf("backup = %q, %v; want the file before the migration", d, err)
+	}
+
+	// The migrated state is saved
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved State
+	if err := json.Unmarshal(d, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.SchemaVersion != stateSchemaVersion || saved.UpdateCheck == nil {
+		t.Errorf("saved state = %s, want migrated", d)
+	}
+}
+
+func TestReadStateFileNewer(t *testing.T) {
+	path := setTestStateFile(t)
+	writeTestFile(t, path, `{"schema_version": 99}`)
+	if _, err := readStateFile(path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("readStateFile() = %v, want an error of the newer version", err)
+	}
+}
+
+// Concurrent writers lose none of the updates of each other
+func TestUpdateStateConcurrent(t *testing.T) {
+	setTestStateFile(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- updateState(func(state *State) error {
+				if state.Revisions == nil {
+					state.Revisions = make(map[string]map[string]int)
+				}
+				if state.Revisions["sheet"] == nil {
+					state.Revisions["sheet"] = make(map[string]int)
+				}
+				state.Revisions["sheet"]["202405"]++
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := state.Revisions["sheet"]["202405"]; n != 20 {
+		t.Errorf("revision = %d, want 20", n)
+	}
+}
+
+func TestRunStateRepair(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		bak     string
+		check   func(t *testing.T, state *State)
+		corrupt bool
+	}{
+		{
+			name:  "broken section",
+			state: `{"schema_version": 2, "drive_folders": 3, "drive_files": {"a.pdf": "file"}}`,
+			check: func(t *testing.T, state *State) {
+				if state.DriveFolders != nil || state.DriveFiles["a.pdf"] != "file" {
+					t.Errorf("state = %+v, want drive_folders dropped and drive_files kept", state)
+				}
+			},
+			corrupt: true,
+		},
+		{
+			name:  "not decodable",
+			state: `{"schema_version": 2, "drive_files": {`,
+			bak:   `{"drive_files": {"b.pdf": "bak"}}`,
+			check: func(t *testing.T, state *State) {
+				if state.DriveFiles["b.pdf"] != "bak" {
+					t.Errorf("state = %+v, want restored from .bak", state)
+				}
+			},
+			corrupt: true,
+		},
+		{
+			name:  "not decodable without backup",
+			state: `[`,
+			check: func(t *testing.T, state *State) {
+				if state.DriveFiles != nil {
+					t.Errorf("state = %+v, want empty", state)
+				}
+			},
+			corrupt: true,
+		},
+		{
+			name:  "invalid schema_version",
+			state: `{"schema_version": "x", "drive_files": {"c.pdf": "file"}}`,
+			check: func(t *testing.T, state *State) {
+				if state.DriveFiles["c.pdf"] != "file" {
+					t.Errorf("state = %+v, want drive_files kept", state)
+				}
+			},
+			corrupt: true,
+		},
+		{
+			name:  "no problems",
+			state: `{"schema_version": 2, "drive_files": {"d.pdf": "file"}}`,
+			check: func(t *testing.T, state *State) {
+				if state.DriveFiles["d.pdf"] != "file" {
+					t.Errorf("state = %+v, want kept", state)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := setTestStateFile(t)
+			writeTestFile(t, path, tt.state)
+			if tt.bak != "" {
+				writeTestFile(t, path+".bak", tt.bak)
+			}
+			if err := runStateRepair(nil); err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := readStateFile(path)
+			if err != nil {
+				t.Fatalf("state after repair can't be read: %v", err)
+			}
+			if state.SchemaVersion != stateSchemaVersion {
+				t.Errorf("schema version = %d, want %d", state.SchemaVersion, stateSchemaVersion)
+			}
+			tt.check(t, state)
+			corrupt, err := filepath.Glob(path + ".corrupt-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.corrupt {
+				if len(corrupt) != 0 {
+					t.Errorf("state without problems is kept as %v", corrupt)
+				}
+				return
+			}
+			if len(corrupt) != 1 {
+				t.Fatalf("files kept before the repair = %v, want one", corrupt)
+			}
+			if d, err := ioutil.ReadFile(corrupt[0]); err != nil || string(d) != tt.state {
+				t.Errorf("file kept before the repair = %q, %v; want %q", d, err, tt.state)
+			}
+		})
+	}
+}
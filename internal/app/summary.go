@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+// summaryCell is a cell of the timesheet having a total of the day rows
+type summaryCell struct {
+	name  string
+	cell  string
+	value func([]dayRow) (string, error)
+}
+
+// Returns the configured summary cells. The billing may be nil if no
+// amount cell is configured, and the tax may be nil. Amounts are written
+// as plain numbers in the major units of the currency.
+func getSummaryCells(config *Config, period billingPeriod, billing *BillingConfig, tax *TaxConfig, cur *currency, breaks *breakPolicy) []summaryCell {
+	sc := config.Summary
+	if sc == nil {
+		return nil
+	}
+	formulaOr := func(formula string, f func([]dayRow) (string, error)) func([]dayRow) (string, error) {
+		if formula != "" {
+			return func([]dayRow) (string, error) { return formula, nil }
+		}
+		return f
+	}
+	amountOf := func(f func(*billingAmount) int64) func([]dayRow) (string, error) {
+		return func(rows []dayRow) (string, error) {
+			amount, err := computeBilling(billing, rows, period, breaks, config.EventKinds, tax, cur)
+			if err != nil {
+				return "", fmt.Errorf("failed to compute billing: %v", err)
+			}
+			return cur.formatNumber(f(amount)), nil
+		}
+	}
+	cells := make([]summaryCell, 0)
+	for _, c := range []summaryCell{
+		{"total days", sc.TotalDaysCell, formulaOr(sc.TotalDaysFormula, func(rows []dayRow) (string, error) {
+			return countWorkDays(rows), nil
+		})},
+		{"total hours", sc.TotalHoursCell, formulaOr(sc.TotalHoursFormula, func(rows []dayRow) (string, error) {
+			return sumWorkHours(rows, breaks)
+		})},
+		{"subtotal", sc.SubtotalCell, amountOf(func(a *billingAmount) int64 { return a.Subtotal })},
+		{"tax", sc.TaxCell, amountOf(func(a *billingAmount) int64 { return a.Tax })},
+		{"withholding", sc.WithholdingCell, amountOf(func(a *billingAmount) int64 { return a.Withholding })},
+		{"total", sc.TotalCell, amountOf(func(a *billingAmount) int64 { return a.Total })},
+	} {
+		if c.cell != "" {
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
+
+func countWorkDays(rows []dayRow) string {
+	n := 0
+	for _, r := range rows {
+		if isWorkRow(r) {
+			n++
+		}
+	}
+	return strconv.Itoa(n)
+}
+
+// Tells whether the row is of a work day
+func isWorkRow(r dayRow) bool {
+	// Weekdays are written on every day
+	r.Weekday = ""
+	return r != (dayRow{}) && !r.onLeave
+}
+
+// Sums the hours from start to end of the rows minus a break for each day.
+// Rows without both times are not counted.
+func sumWorkHours(rows []dayRow, breaks *breakPolicy) (string, error) {
+	d, err := sumWorkDuration(rows, breaks)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(d.Hours(), 'f', -1, 64), nil
+}
+
+// Fails on times which are not times of day, like ones written in the
+// descriptions of events
+func sumWorkDuration(rows []dayRow, breaks *breakPolicy) (time.Duration, error) {
+	var total time.Duration
+	for _, r := range rows {
+		if r.Start == "" || r.End == "" || r.onLeave {
+			continue
+		}
+		start, err := parseClock(r.Start)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compute total hours: %v", err)
+		}
+		end, err := parseClock(r.End)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compute total hours: %v", err)
+		}
+		worked, _ := breaks.workDuration(start, end)
+		total += worked
+	}
+	return total, nil
+}
+
+// Parses a time of day like "9:30", allowing extended hours like "26:00"
+func parseClock(s string) (time.Duration, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m >= 60 {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Sets a currency number format like "¥#,##0" to the cells of the range
+func setCurrencyFormat(sht *sheets.Service, spreadsheetID string, sheetID int64, rng, pattern string) error {
+	return setNumberFormat(sht, spreadsheetID, sheetID, rng, &sheets.NumberFormat{Type: "CURRENCY", Pattern: pattern})
+}
+
+// Sets the number format to the cells of the range
+func setNumberFormat(sht *sheets.Service, spreadsheetID string, sheetID int64, rng string, format *sheets.NumberFormat) error {
+	parts := strings.SplitN(rng, ":", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	c1, r1, err := timesheet.ParseA1Cell(parts[0])
+	if err != nil {
+		return err
+	}
+	c2, r2, err := timesheet.ParseA1Cell(parts[1])
+	if err != nil {
+		return err
+	}
+	return callAPI("set number format", func(ctx context.Context) error {
+		_, err := sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: []*sheets.Request{{
+				RepeatCell: &sheets.RepeatCellRequest{
+					Range: &sheets.GridRange{
+						SheetId:          sheetID,
+						StartRowIndex:    int64(r1),
+						EndRowIndex:      int64(r2 + 1),
+						StartColumnIndex: int64(c1),
+						EndColumnIndex:   int64(c2 + 1),
+						ForceSendFields:  []string{"SheetId", "StartRowIndex", "StartColumnIndex"},
+					},
+					Cell: &sheets.CellData{
+						UserEnteredFormat: &sheets.CellFormat{
+							NumberFormat: format,
+						},
+					},
+					Fields: "userEnteredFormat.numberFormat",
+				},
+			}},
+		}).Context(ctx).Do()
+		return err
+	})
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGetSummaryCells(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	config := &Config{Summary: &SummaryConfig{
+		TotalDaysCell:  "M40",
+		TotalHoursCell: "M41",
+		TotalCell:      "M42",
+	}}
+	period := getBillingPeriod(config, time.Date(2022, 6, 1, 0, 0, 0, 0, loc))
+	billing := &BillingConfig{RateUnit: "per_hour", HoursRounding: "none"}
+	if err := json.Unmarshal([]byte(`3000`), &billing.Rate); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := getCurrency(config, &SpreadsheetConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaks, err := getBreakPolicy(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := getSummaryCells(config, period, billing, nil, cur, breaks)
+
+	values := func(rows []dayRow) ([]string, error) {
+		v := make([]string, 0, len(cells))
+		for _, c := range cells {
+			s, err := c.value(rows)
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, s)
+		}
+		return v, nil
+	}
+	got, err := values([]dayRow{{Start: "9:00", End: "18:00"}, {}, {Start: "10:00", End: "12:30"}})
+	if err != nil {
+		t.Fatalf("value: %v", err)
+	}
+	if want := []string{"2", "11.5", "34500"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Times which are not times of day fail the cells instead of the run
+	if _, err := values([]dayRow{{Start: "9:00", End: "18時"}}); err == nil {
+		t.Errorf("want error for an invalid end time")
+	}
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+var summarySheetHeader = []interface{}{"月", "取引先", "稼働日数", "稼働時間", "金額", "消費税", "請求書番号", "請求書PDF"}
+
+// spreadsheetRecord is what a spreadsheet made in the run, written to the
+// summary spreadsheet
+type spreadsheetRecord struct {
+	title         string
+	workDays      int
+	hours         string
+	invoiceNumber string
+	// Drive link of the invoice pdf, or of the timesheet pdf if there is
+	// no invoice document
+	pdfLink string
+	// Whether the sheet of the month was created in the run
+	createdSheet bool
+	// Revision made by the revise command, and the invoice number of the
+	// original
+	revision   int
+	revisionOf string
+}
+
+// Adds or updates a row of the month for each succeeded spreadsheet in the
+// summary spreadsheet. Rows are keyed by the month and the title of the
+// spreadsheet, so runs of the month again update the rows.
+func updateSummarySpreadsheet(sht *sheets.Service, targetTime time.Time, spreadsheets []*SpreadsheetConfig, errs []error, files *reservedFiles, config *Config) error {
+	sheetRange := "A:H"
+	if config.SummarySheetName != "" {
+		sheetRange = timesheet.QuoteSheetTitle(config.SummarySheetName) + "!A:H"
+	}
+	month := targetTime.Format("2006-01")
+
+	var existing *sheets.ValueRange
+	if err := callAPI("get summary rows", func(ctx context.Context) (err error) {
+		existing, err = sht.Spreadsheets.Values.Get(config.SummarySpreadsheetID, sheetRange).Fields("values").Context(ctx).Do()
+		return
+	}); err != nil {
+		return err
+	}
+	rowsByKey := make(map[string]int)
+	for i, row := range existing.Values {
+		if len(row) >= 2 {
+			rowsByKey[fmt.Sprint(row[0])+"/"+fmt.Sprint(row[1])] = i + 1
+		}
+	}
+
+	appended := make([][]interface{}, 0)
+	header := 0
+	if len(existing.Values) == 0 {
+		appended = append(appended, summarySheetHeader)
+		header = 1
+	}
+	updated := make([]*sheets.ValueRange, 0)
+	for i, sc := range spreadsheets {
+		record := files.records[sc.ID]
+		if errs[i] != nil || record == nil {
+			continue
+		}
+		row := []interface{}{month, record.title, record.workDays, parseSummaryNumber(record.hours), "", "", record.invoiceNumber, record.pdfLink}
+		if amount := files.billing[sc.ID]; amount != nil {
+			row[4] = parseSummaryNumber(amount.Currency.formatNumber(amount.Subtotal))
+			row[5] = parseSummaryNumber(amount.Currency.formatNumber(amount.Tax))
+		}
+		if n, ok := rowsByKey[month+"/"+record.title]; ok {
+			rng := fmt.Sprintf("A%d:H%d", n, n)
+			if config.SummarySheetName != "" {
+				rng = timesheet.QuoteSheetTitle(config.SummarySheetName) + "!" + rng
+			}
+			updated = append(updated, &sheets.ValueRange{Range: rng, Values: [][]interface{}{row}})
+		} else {
+			appended = append(appended, row)
+		}
+	}
+
+	if len(updated) > 0 {
+		if err := callAPI("update summary rows", func(ctx context.Context) error {
+			_, err := sht.Spreadsheets.Values.BatchUpdate(config.SummarySpreadsheetID, &sheets.BatchUpdateValuesRequest{
+				ValueInputOption: "RAW",
+				Data:             updated,
+			}).Context(ctx).Do()
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if len(appended) > 0 {
+		if err := callAPI("append summary rows", func(ctx context.Context) error {
+			_, err := sht.Spreadsheets.Values.Append(config.SummarySpreadsheetID, sheetRange, &sheets.ValueRange{Values: appended}).
+				ValueInputOption("RAW").
+				InsertDataOption("INSERT_ROWS").
+				Context(ctx).Do()
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	log.Printf("Updated %d and added %d rows in the summary spreadsheet\n", len(updated), len(appended)-header)
+	return nil
+}
+
+// Returns the number in s as a number cell, or s if it is not a number
+func parseSummaryNumber(s string) interface{} {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
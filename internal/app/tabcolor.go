@@ -0,0 +1,59 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Parses a color like "#4285f4"
+func parseHexColor(s string) (*sheets.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("invalid color: %q (must be like #4285f4)", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color: %q (must be like #4285f4)", s)
+	}
+	return &sheets.Color{
+		Red:   float64(v>>16&0xff) / 255,
+		Green: float64(v>>8&0xff) / 255,
+		Blue:  float64(v&0xff) / 255,
+	}, nil
+}
+
+// Tells whether a sheet's tab color is c. Colors read back from the API may
+// differ by rounding.
+func isTabColor(props *sheets.SheetProperties, c *sheets.Color) bool {
+	if props.TabColorStyle == nil || props.TabColorStyle.RgbColor == nil {
+		return false
+	}
+	return isSameColor(props.TabColorStyle.RgbColor, c)
+}
+
+func setTabColor(sht *sheets.Service, spreadsheetID string, sheetID int64, c *sheets.Color) error {
+	if err := callAPI("set tab color", func(ctx context.Context) error {
+		_, err := sht.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: []*sheets.Request{{
+				UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+					Fields: "tabColorStyle",
+					Properties: &sheets.SheetProperties{
+						SheetId: sheetID,
+						TabColorStyle: &sheets.ColorStyle{
+							RgbColor: c,
+						},
+						ForceSendFields: []string{"SheetId"},
+					},
+				},
+			}},
+		}).Context(ctx).Do()
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to set tab color: %v", err)
+	}
+	return nil
+}
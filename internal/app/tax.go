@@ -0,0 +1,34 @@
+package app
+
+// Withholding tax is 10.21% up to this amount and 20.42% above it
+const withholdingTierAmount = 1000000
+
+// Divides the non-negative n by d, rounding the quotient by the mode
+func divideYen(n, d int64, mode string) int64 {
+	switch mode {
+	case "up":
+		return (n + d - 1) / d
+	case "half_up":
+		return (n + d/2) / d
+	}
+	return n / d
+}
+
+// Returns the withholding tax of the amount, with fractions of a yen
+// rounded down
+func computeWithholding(amount int64) int64 {
+	if amount <= withholdingTierAmount {
+		return amount * 1021 / 10000
+	}
+	return withholdingTierAmount*1021/10000 + (amount-withholdingTierAmount)*2042/10000
+}
+
+// Sets the tax, the withholding and the total of the amount
+func applyTax(t *TaxConfig, amount *billingAmount) {
+	amount.Tax = divideYen(amount.Subtotal*t.Rate, 100, t.Rounding)
+	amount.Withholding = 0
+	if t.Withholding {
+		amount.Withholding = computeWithholding(amount.Subtotal)
+	}
+	amount.Total = amount.Subtotal + amount.Tax - amount.Withholding
+}
@@ -0,0 +1,84 @@
+package app
+
+import "testing"
+
+func TestComputeWithholding(t *testing.T) {
+	tests := []struct {
+		amount int64
+		want   int64
+	}{
+		{0, 0},
+		{9, 0},
+		{10, 1},
+		{100000, 10210},
+		{333333, 34033},
+		{999999, 102099},
+		{1000000, 102100},
+		// 20.42% applies only to the part above ¥1,000,000
+		{1000001, 102100},
+		{1000005, 102101},
+		{1000100, 102120},
+		{1500000, 204200},
+		{2000000, 306300},
+	}
+	for _, tt := range tests {
+		if got := computeWithholding(tt.amount); got != tt.want {
+			t.Errorf("computeWithholding(%d) = %d, want %d", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestTaxApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		tax      TaxConfig
+		subtotal int64
+		want     billingAmount
+	}{
+		{"down by default", TaxConfig{Rate: 10}, 12345, billingAmount{Tax: 1234, Total: 13579}},
+		{"down", TaxConfig{Rate: 10, Rounding: "down"}, 12349, billingAmount{Tax: 1234, Total: 13583}},
+		{"up", TaxConfig{Rate: 10, Rounding: "up"}, 12341, billingAmount{Tax: 1235, Total: 13576}},
+		{"up exact", TaxConfig{Rate: 10, Rounding: "up"}, 12340, billingAmount{Tax: 1234, Total: 13574}},
+		{"half_up below half", TaxConfig{Rate: 10, Rounding: "half_up"}, 12344, billingAmount{Tax: 1234, Total: 13578}},
+		{"half_up at half", TaxConfig{Rate: 10, Rounding: "half_up"}, 12345, billingAmount{Tax: 1235, Total: 13580}},
+		{"reduced rate", TaxConfig{Rate: 8, Rounding: "half_up"}, 1111, billingAmount{Tax: 89, Total: 1200}},
+		{"zero rate", TaxConfig{Rate: 0, Rounding: "up"}, 1111, billingAmount{Tax: 0, Total: 1111}},
+		{
+			"withholding at the tier",
+			TaxConfig{Rate: 10, Withholding: true},
+			1000000,
+			billingAmount{Tax: 100000, Withholding: 102100, Total: 997900},
+		},
+		{
+			"withholding above the tier",
+			TaxConfig{Rate: 10, Withholding: true},
+			1200000,
+			billingAmount{Tax: 120000, Withholding: 142940, Total: 1177060},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount := &billingAmount{Subtotal: tt.subtotal, Withholding: 1}
+			applyTax(&tt.tax, amount)
+			if amount.Tax != tt.want.Tax || amount.Withholding != tt.want.Withholding || amount.Total != tt.want.Total {
+				t.Errorf("got tax %d, withholding %d, total %d, want %d, %d, %d", amount.Tax, amount.Withholding, amount.Total, tt.want.Tax, tt.want.Withholding, tt.want.Total)
+			}
+		})
+	}
+}
+
+func TestTaxValidate(t *testing.T) {
+	for _, tt := range []struct {
+		tax     TaxConfig
+		wantErr bool
+	}{
+		{TaxConfig{Rate: 10}, false},
+		{TaxConfig{Rate: 10, Rounding: "half_up"}, false},
+		{TaxConfig{Rate: -1}, true},
+		{TaxConfig{Rate: 10, Rounding: "nearest"}, true},
+	} {
+		if err := tt.tax.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate %+v: got %v, want error %v", tt.tax, err, tt.wantErr)
+		}
+	}
+}
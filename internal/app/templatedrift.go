@@ -0,0 +1,75 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// TemplateFingerprint is the layout of the sheet written by the last
+// successful run of a spreadsheet: the size of the grid and the values of
+// the anchor cells
+type TemplateFingerprint struct {
+	Sheet     string            `json:"sheet"`
+	Rows      int64             `json:"rows"`
+	Columns   int64             `json:"columns"`
+	Cells     map[string]string `json:"cells"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+func getTemplateFingerprint(sht *sheets.Service, spreadsheetID string, sheet *sheets.Sheet, config *Config) (*TemplateFingerprint, error) {
+	f := &TemplateFingerprint{Sheet: sheet.Properties.Title, Cells: make(map[string]string), UpdatedAt: time.Now()}
+	if gp := sheet.Properties.GridProperties; gp != nil {
+		f.Rows, f.Columns = gp.RowCount, gp.ColumnCount
+	}
+	_, cells := config.GetTemplateAnchors()
+	if len(cells) == 0 {
+		return f, nil
+	}
+	values, err := getAnchorValues(sht, spreadsheetID, sheet.Properties.Title, cells)
+	if err != nil {
+		return nil, err
+	}
+	for i, cell := range cells {
+		f.Cells[cell] = values[i]
+	}
+	return f, nil
+}
+
+// Returns how the layout differs from the one of the last successful run of
+// the spreadsheet, or nothing if there was none
+func compareTemplateFingerprint(spreadsheetID string, f *TemplateFingerprint) []string {
+	state, err := loadState()
+	if err != nil || state.TemplateFingerprints[spreadsheetID] == nil {
+		return nil
+	}
+	last := state.TemplateFingerprints[spreadsheetID]
+	changes := make([]string, 0)
+	if last.Rows != f.Rows || last.Columns != f.Columns {
+		changes = append(changes, fmt.Sprintf("grid: %d rows x %d columns in %s, now %d x %d", last.Rows, last.Columns, last.Sheet, f.Rows, f.Columns))
+	}
+	cells := make([]string, 0, len(last.Cells))
+	for cell := range last.Cells {
+		cells = append(cells, cell)
+	}
+	sort.Strings(cells)
+	// Cells newly added to template_anchors are not changes of the template
+	for _, cell := range cells {
+		if v, ok := f.Cells[cell]; ok && v != last.Cells[cell] {
+			changes = append(changes, fmt.Sprintf("%s: %q in %s, now %q", cell, last.Cells[cell], last.Sheet, v))
+		}
+	}
+	return changes
+}
+
+func saveTemplateFingerprint(spreadsheetID string, f *TemplateFingerprint) error {
+	return updateState(func(state *State) error {
+		if state.TemplateFingerprints == nil {
+			state.TemplateFingerprints = make(map[string]*TemplateFingerprint)
+		}
+		state.TemplateFingerprints[spreadsheetID] = f
+		return nil
+	})
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/docs/v1"
+)
+
+// Placeholders the tool fills in the documents, with the setting each needs
+// to have a value, if any. Revision placeholders are empty outside
+// revisions.
+var documentPlaceholderSettings = map[string]string{
+	"billing_month":           "",
+	"work_days":               "",
+	"total_hours":             "",
+	"invoice_number":          "",
+	"issue_date":              "",
+	"period_start":            "",
+	"period_end":              "",
+	"revision":                "",
+	"revision_number":         "",
+	"original_invoice_number": "",
+	"due_date":                "due_date_rule",
+	"currency":                "billing",
+	"rate":                    "billing",
+	"billable_quantity":       "billing",
+	"subtotal":                "billing",
+	"tax":                     "billing",
+	"withholding":             "billing",
+	"total":                   "billing",
+	"amount":                  "billing",
+	"client_name":             "client",
+	"client_department":       "client",
+	"client_address":          "client",
+	"attention":               "client",
+	"payment_terms":           "client",
+}
+
+// Returns the placeholders the document of the spreadsheet may have, with
+// the settings missing for their values, which are "" for the ones filled
+func getDocumentPlaceholders(c *Config, sc *SpreadsheetConfig, dc *InvoiceDocumentConfig) map[string]string {
+	_, dueDateRule, _ := c.GetInvoiceDateSettings(sc)
+	billed := c.GetBilling(sc) != nil
+	client := c.GetClient(sc) != nil
+	known := make(map[string]string)
+	for name, setting := range documentPlaceholderSettings {
+		if (setting == "due_date_rule" && dueDateRule != "") || (setting == "billing" && billed) || (setting == "client" && client) {
+			setting = ""
+		}
+		known[name] = setting
+	}
+	for k := range sc.DocumentData {
+		known[k] = ""
+	}
+	if dc.Report {
+		known[workReportPlaceholder] = ""
+	} else {
+		known[workTablePlaceholder] = ""
+	}
+	return known
+}
+
+// templateLint is how the placeholders of a template compare with the ones
+// of the document
+type templateLint struct {
+	// Placeholders the tool never fills, like typos
+	unknown []string
+	// Placeholders needing settings which are not set, like "{{amount}}
+	// (needs billing)"
+	unset []string
+	// Placeholders filled but not in the template
+	unused []string
+}
+
+func lintTemplatePlaceholders(names []string, known map[string]string) *templateLint {
+	l := &templateLint{}
+	found := make(map[string]bool)
+	for _, n := range names {
+		found[n] = true
+		setting, ok := known[n]
+		switch {
+		case !ok:
+			l.unknown = append(l.unknown, "{{"+n+"}}")
+		case setting != "":
+			l.unset = append(l.unset, fmt.Sprintf("{{%s}} (needs %s)", n, setting))
+		}
+	}
+	for n, setting := range known {
+		if !found[n] && setting == "" {
+			l.unused = append(l.unused, "{{"+n+"}}")
+		}
+	}
+	sort.Strings(l.unused)
+	return l
+}
+
+// "make-invoices lint-template <document ID or config ref>" compares the
+// placeholders of document templates with the ones the config fills. The
+// config ref is a document key like "invoice", or one of a spreadsheet like
+// "<spreadsheet ID>/invoice", checking the templates of the documents of
+// the key; other arguments are taken as the IDs of templates, checked as the
+// invoice of the top level settings. Fails if any template has
+// unknown placeholders.
+func runLintTemplate(args []string) error {
+	fs := flag.NewFlagSet("lint-template", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return newRunError(exitConfigError, "config", "Usage: make-invoices lint-template <document ID or config ref>")
+	}
+	ref := fs.Arg(0)
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	type target struct {
+		label string
+		sc    *SpreadsheetConfig
+		dc    *InvoiceDocumentConfig
+	}
+	targets := make([]target, 0)
+	for _, sc := range config.GetSpreadsheets() {
+		documents, err := config.GetDocuments(sc)
+		if err != nil {
+			return fmt.Errorf("Invalid documents of spreadsheet %s: %v", sc.ID, err)
+		}
+		for _, dc := range documents {
+			if dc.Local {
+				continue
+			}
+			if ref == dc.Key || ref == sc.ID+"/"+dc.Key || ref == dc.TemplateID {
+				targets = append(targets, target{sc.ID + "/" + dc.Key, sc, dc})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		targets = append(targets, target{ref, &SpreadsheetConfig{}, &InvoiceDocumentConfig{Key: defaultDocumentKey, TemplateID: ref}})
+	}
+
+	ctx := context.Background()
+	client, err := createScopedAPIClient(ctx, config, []string{docs.DocumentsReadonlyScope})
+	if err != nil {
+		return err
+	}
+	dcs, err := docs.NewService(ctx, getServiceOptions(client, "")...)
+	if err != nil {
+		return fmt.Errorf("Failed to create docs client: %v", err)
+	}
+
+	failed := false
+	for _, t := range targets {
+		names, err := getTemplatePlaceholders(dcs, t.dc.TemplateID)
+		if err != nil {
+			return fmt.Errorf("Failed to read template of %s: %v", t.label, err)
+		}
+		l := lintTemplatePlaceholders(names, getDocumentPlaceholders(config, t.sc, t.dc))
+		fmt.Printf("%s (template %s): %d placeholders\n", t.label, t.dc.TemplateID, len(names))
+		if len(l.unknown) > 0 {
+			fmt.Printf("  unknown: %s\n", strings.Join(l.unknown, ", "))
+			failed = true
+		}
+		if len(l.unset) > 0 {
+			fmt.Printf("  not set in the config: %s\n", strings.Join(l.unset, ", "))
+		}
+		if len(l.unused) > 0 {
+			fmt.Printf("  unused: %s\n", strings.Join(l.unused, ", "))
+		}
+	}
+	if failed {
+		return fmt.Errorf("Templates have unknown placeholders")
+	}
+	return nil
+}
@@ -0,0 +1,504 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// sfntFont has what is needed to embed a font in pdfs. Fonts with TrueType
+// outlines (.ttf) and with CFF ones (.otf) are read, and collections (.ttc)
+// by the index of the font in them.
+type sfntFont struct {
+	tables     map[string][]byte
+	name       string
+	unitsPerEm int
+	bbox       [4]int
+	ascent     int
+	descent    int
+	capHeight  int
+	numGlyphs  int
+	advances   []int
+	bearings   []int
+	// cmap subtable mapping runes to glyphs
+	cmapFormat int
+	cmap       []byte
+	// CFF outlines, nil for TrueType ones
+	cff *cffFont
+}
+
+// Reads the font, or the font of the index in a collection
+func parseFont(data []byte, index int) (*sfntFont, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("too short for a font")
+	}
+	offset := 0
+	if string(data[:4]) == "ttcf" {
+		count := int(binary.BigEndian.Uint32(data[8:]))
+		if index < 0 || index >= count {
+			return nil, fmt.Errorf("no font of index %d in the collection of %d fonts", index, count)
+		}
+		if 12+4*index+4 > len(data) {
+			return nil, fmt.Errorf("broken font collection")
+		}
+		offset = int(binary.BigEndian.Uint32(data[12+4*index:]))
+		if offset+12 > len(data) {
+			return nil, fmt.Errorf("broken font collection")
+		}
+	} else if index != 0 {
+		return nil, fmt.Errorf("font index %d is given, but the font is not a collection", index)
+	}
+	cff := false
+	switch string(data[offset : offset+4]) {
+	case "\x00\x01\x00\x00", "true":
+	case "OTTO":
+		cff = true
+	default:
+		return nil, fmt.Errorf("not a TrueType or OpenType font")
+	}
+
+	// Offsets of tables are from the start of the file, also in collections
+	tables := make(map[string][]byte)
+	n := int(binary.BigEndian.Uint16(data[offset+4:]))
+	for i := 0; i < n; i++ {
+		r := offset + 12 + 16*i
+		if r+16 > len(data) {
+			return nil, fmt.Errorf("broken table directory")
+		}
+		o := int(binary.BigEndian.Uint32(data[r+8:]))
+		length := int(binary.BigEndian.Uint32(data[r+12:]))
+		if o < 0 || length < 0 || o+length > len(data) {
+			return nil, fmt.Errorf("broken table %q", data[r:r+4])
+		}
+		tables[string(data[r:r+4])] = data[o : o+length]
+	}
+	required := []string{"head", "hhea", "hmtx", "maxp", "cmap"}
+	if cff {
+		if _, ok := tables["CFF "]; !ok {
+			if _, ok := tables["CFF2"]; ok {
+				return nil, fmt.Errorf("variable fonts with CFF2 outlines are not supported")
+			}
+		}
+		required = append(required, "CFF ")
+	} else {
+		required = append(required, "loca", "glyf")
+	}
+	for _, t := range required {
+		if _, ok := tables[t]; !ok {
+			return nil, fmt.Errorf("no %s table", strings.TrimSpace(t))
+		}
+	}
+	head, hhea, hmtx, maxp := tables["head"], tables["hhea"], tables["hmtx"], tables["maxp"]
+	if len(head) < 54 || len(hhea) < 36 || len(maxp) < 6 {
+		return nil, fmt.Errorf("broken font header")
+	}
+	f := &sfntFont{
+		tables:     tables,
+		name:       getFontName(tables["name"]),
+		unitsPerEm: int(binary.BigEndian.Uint16(head[18:])),
+		ascent:     int(int16(binary.BigEndian.Uint16(hhea[4:]))),
+		descent:    int(int16(binary.BigEndian.Uint16(hhea[6:]))),
+		numGlyphs:  int(binary.BigEndian.Uint16(maxp[4:])),
+	}
+	if f.unitsPerEm == 0 {
+		return nil, fmt.Errorf("broken font header")
+	}
+	for i := range f.bbox {
+		f.bbox[i] = int(int16(binary.BigEndian.Uint16(head[36+2*i:])))
+	}
+	f.capHeight = f.ascent
+	if os2 := tables["OS/2"]; len(os2) >= 90 && binary.BigEndian.Uint16(os2) >= 2 {
+		f.capHeight = int(int16(binary.BigEndian.Uint16(os2[88:])))
+	}
+
+	numMetrics := int(binary.BigEndian.Uint16(hhea[34:]))
+	if numMetrics == 0 || numMetrics > f.numGlyphs || len(hmtx) < 4*numMetrics+2*(f.numGlyphs-numMetrics) {
+		return nil, fmt.Errorf("broken hmtx table")
+	}
+	f.advances = make([]int, f.numGlyphs)
+	f.bearings = make([]int, f.numGlyphs)
+	for i := range f.advances {
+		if i < numMetrics {
+			f.advances[i] = int(binary.BigEndian.Uint16(hmtx[4*i:]))
+			f.bearings[i] = int(int16(binary.BigEndian.Uint16(hmtx[4*i+2:])))
+		} else {
+			f.advances[i] = f.advances[numMetrics-1]
+			f.bearings[i] = int(int16(binary.BigEndian.Uint16(hmtx[4*numMetrics+2*(i-numMetrics):])))
+		}
+	}
+
+	// Unicode subtables are preferred, the full repertoire ones first
+	cmap := tables["cmap"]
+	if len(cmap) < 4 {
+		return nil, fmt.Errorf("broken cmap table")
+	}
+	best := -1
+	for i := 0; i < int(binary.BigEndian.Uint16(cmap[2:])); i++ {
+		r := 4 + 8*i
+		if r+8 > len(cmap) {
+			break
+		}
+		platform, encoding := binary.BigEndian.Uint16(cmap[r:]), binary.BigEndian.Uint16(cmap[r+2:])
+		o := int(binary.BigEndian.Uint32(cmap[r+4:]))
+		if o+4 > len(cmap) {
+			continue
+		}
+		format := int(binary.BigEndian.Uint16(cmap[o:]))
+		unicode := platform == 0 || (platform == 3 && (encoding == 1 || encoding == 10))
+		if !unicode || (format != 4 && format != 12) {
+			continue
+		}
+		if format > best {
+			best = format
+			f.cmapFormat, f.cmap = format, cmap[o:]
+		}
+	}
+	if f.cmap == nil {
+		return nil, fmt.Errorf("no unicode cmap")
+	}
+
+	if cff {
+		c, err := parseCFF(tables["CFF "], f.numGlyphs)
+		if err != nil {
+			return nil, fmt.Errorf("broken CFF table: %v", err)
+		}
+		f.cff = c
+	}
+	return f, nil
+}
+
+// Returns the PostScript name of the font, which is used as its name in
+// pdfs
+func getFontName(name []byte) string {
+	if len(name) >= 6 {
+		count := int(binary.BigEndian.Uint16(name[2:]))
+		storage := int(binary.BigEndian.Uint16(name[4:]))
+		for i := 0; i < count; i++ {
+			r := 6 + 12*i
+			if r+12 > len(name) {
+				break
+			}
+			platform := binary.BigEndian.Uint16(name[r:])
+			if binary.BigEndian.Uint16(name[r+6:]) != 6 {
+				continue
+			}
+			length := int(binary.BigEndian.Uint16(name[r+8:]))
+			offset := storage + int(binary.BigEndian.Uint16(name[r+10:]))
+			if offset+length > len(name) {
+				continue
+			}
+			s := name[offset : offset+length]
+			var text string
+			if platform == 3 || platform == 0 {
+				u := make([]uint16, 0, len(s)/2)
+				for j := 0; j+1 < len(s); j += 2 {
+					u = append(u, binary.BigEndian.Uint16(s[j:]))
+				}
+				text = string(utf16.Decode(u))
+			} else {
+				text = string(s)
+			}
+			// Names in pdfs can't have delimiters
+			text = strings.Map(func(r rune) rune {
+				if r <= ' ' || r > '~' || strings.ContainsRune("()<>[]{}/%#", r) {
+					return -1
+				}
+				return r
+			}, text)
+			if text != "" {
+				return text
+			}
+		}
+	}
+	return "EmbeddedFont"
+}
+
+// Returns the glyph of the rune, or 0 (the missing glyph) if the font has
+// none
+func (f *sfntFont) glyph(r rune) int {
+	c := f.cmap
+	u16 := func(o int) int {
+		if o+2 > len(c) {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(c[o:]))
+	}
+	u32 := func(o int) int {
+		if o+4 > len(c) {
+			return 0
+		}
+		return int(binary.BigEndian.Uint32(c[o:]))
+	}
+	g := 0
+	if f.cmapFormat == 12 {
+		// Only the groups in the table, whatever a broken count says
+		groups := u32(12)
+		if n := (len(c) - 16) / 12; groups > n {
+			groups = n
+		}
+		for i := 0; i < groups; i++ {
+			s := 16 + 12*i
+			if start, end := u32(s), u32(s+4); int(r) >= start && int(r) <= end {
+				g = u32(s+8) + int(r) - start
+				break
+			}
+		}
+	} else if r <= 0xffff {
+		segments := u16(6) / 2
+		ends, starts := 14, 16+2*segments
+		deltas, rangeOffsets := starts+2*segments, starts+4*segments
+		for i := 0; i < segments; i++ {
+			if int(r) > u16(ends+2*i) {
+				continue
+			}
+			start := u16(starts + 2*i)
+			if int(r) < start {
+				break
+			}
+			delta := u16(deltas + 2*i)
+			ro := u16(rangeOffsets + 2*i)
+			if ro == 0 {
+				g = (int(r) + delta) & 0xffff
+			} else if g = u16(rangeOffsets + 2*i + ro + 2*(int(r)-start)); g != 0 {
+				g = (g + delta) & 0xffff
+			}
+			break
+		}
+	}
+	if g >= f.numGlyphs {
+		return 0
+	}
+	return g
+}
+
+// Returns the advance width of the glyph in thousandths of the font size
+func (f *sfntFont) width(glyph int) int {
+	if glyph >= len(f.advances) {
+		return 0
+	}
+	return f.advances[glyph] * 1000 / f.unitsPerEm
+}
+
+// Scales font units to thousandths of the font size
+func (f *sfntFont) scale(v int) int {
+	return v * 1000 / f.unitsPerEm
+}
+
+// Returns the CID showing the glyph in pdfs. CID-keyed CFF fonts have
+// their own CIDs, and the glyph IDs are used for the others.
+func (f *sfntFont) cid(glyph int) int {
+	if f.cff != nil && f.cff.cids != nil && glyph < len(f.cff.cids) {
+		return f.cff.cids[glyph]
+	}
+	return glyph
+}
+
+// Returns the font program having only the outlines of the glyphs, to be
+// embedded in pdfs: a TrueType font, or the CFF font for CFF outlines.
+// Glyph IDs are kept, so the glyphs not used are left empty.
+func (f *sfntFont) subset(glyphs map[int]bool) ([]byte, error) {
+	if f.cff != nil {
+		return f.cff.subset(glyphs)
+	}
+	return f.subsetTrueType(glyphs)
+}
+
+// Flags of components of composite glyphs
+const (
+	glyfArgWords       = 0x0001
+	glyfScale          = 0x0008
+	glyfMoreComponents = 0x0020
+	glyfXYScale        = 0x0040
+	glyfTwoByTwo       = 0x0080
+)
+
+func (f *sfntFont) subsetTrueType(glyphs map[int]bool) ([]byte, error) {
+	head, loca, glyf := f.tables["head"], f.tables["loca"], f.tables["glyf"]
+	longLoca := binary.BigEndian.Uint16(head[50:]) == 1
+	glyphData := func(g int) ([]byte, error) {
+		var start, end int
+		if longLoca {
+			if 4*g+8 > len(loca) {
+				return nil, fmt.Errorf("broken loca table")
+			}
+			start, end = int(binary.BigEndian.Uint32(loca[4*g:])), int(binary.BigEndian.Uint32(loca[4*g+4:]))
+		} else {
+			if 2*g+4 > len(loca) {
+				return nil, fmt.Errorf("broken loca table")
+			}
+			start, end = 2*int(binary.BigEndian.Uint16(loca[2*g:])), 2*int(binary.BigEndian.Uint16(loca[2*g+2:]))
+		}
+		if start > end || end > len(glyf) {
+			return nil, fmt.Errorf("broken glyph %d", g)
+		}
+		return glyf[start:end], nil
+	}
+
+	// Composite glyphs need the glyphs they are made of
+	used := map[int]bool{0: true}
+	queue := make([]int, 0, len(glyphs))
+	for g := range glyphs {
+		if g < f.numGlyphs {
+			queue = append(queue, g)
+		}
+	}
+	for len(queue) > 0 {
+		g := queue[0]
+		queue = queue[1:]
+		if used[g] && g != 0 {
+			continue
+		}
+		used[g] = true
+		d, err := glyphData(g)
+		if err != nil {
+			return nil, err
+		}
+		if len(d) < 10 || int16(binary.BigEndian.Uint16(d)) >= 0 {
+			continue
+		}
+		for o := 10; o+4 <= len(d); {
+			flags := binary.BigEndian.Uint16(d[o:])
+			if c := int(binary.BigEndian.Uint16(d[o+2:])); c < f.numGlyphs && !used[c] {
+				queue = append(queue, c)
+			}
+			o += 4
+			if flags&glyfArgWords != 0 {
+				o += 4
+			} else {
+				o += 2
+			}
+			switch {
+			case flags&glyfScale != 0:
+				o += 2
+			case flags&glyfXYScale != 0:
+				o += 4
+			case flags&glyfTwoByTwo != 0:
+				o += 8
+			}
+			if flags&glyfMoreComponents == 0 {
+				break
+			}
+		}
+	}
+
+	// The glyphs after the last one used are dropped
+	n := 0
+	for g := range used {
+		if g+1 > n {
+			n = g + 1
+		}
+	}
+	newGlyf := make([]byte, 0)
+	newLoca := make([]byte, 4*(n+1))
+	hmtx := make([]byte, 4*n)
+	for g := 0; g < n; g++ {
+		binary.BigEndian.PutUint32(newLoca[4*g:], uint32(len(newGlyf)))
+		if used[g] {
+			d, err := glyphData(g)
+			if err != nil {
+				return nil, err
+			}
+			newGlyf = append(newGlyf, d...)
+			for len(newGlyf)%4 != 0 {
+				newGlyf = append(newGlyf, 0)
+			}
+		}
+		binary.BigEndian.PutUint16(hmtx[4*g:], uint16(f.advances[g]))
+		binary.BigEndian.PutUint16(hmtx[4*g+2:], uint16(int16(f.bearings[g])))
+	}
+	binary.BigEndian.PutUint32(newLoca[4*n:], uint32(len(newGlyf)))
+
+	newHead := append([]byte{}, head...)
+	binary.BigEndian.PutUint32(newHead[8:], 0)
+	binary.BigEndian.PutUint16(newHead[50:], 1)
+	hhea := append([]byte{}, f.tables["hhea"]...)
+	binary.BigEndian.PutUint16(hhea[34:], uint16(n))
+	maxp := append([]byte{}, f.tables["maxp"]...)
+	binary.BigEndian.PutUint16(maxp[4:], uint16(n))
+	tables := map[string][]byte{
+		"head": newHead,
+		"hhea": hhea,
+		"maxp": maxp,
+		"hmtx": hmtx,
+		"loca": newLoca,
+		"glyf": newGlyf,
+	}
+	// Pdfs map CIDs to glyphs without cmap, but some readers don't take
+	// fonts without one, so an empty one is given
+	tables["cmap"] = []byte{
+		0, 0, 0, 1, 0, 3, 0, 1, 0, 0, 0, 12,
+		0, 4, 0, 24, 0, 0, 0, 2, 0, 2, 0, 0, 0, 0,
+		0xff, 0xff, 0, 0, 0xff, 0xff, 0, 1, 0, 0,
+	}
+	// The names of the glyphs in post are dropped
+	post := make([]byte, 32)
+	copy(post, f.tables["post"])
+	binary.BigEndian.PutUint32(post, 0x00030000)
+	tables["post"] = post
+	// Hinting programs are kept as the glyphs may use them, and OS/2 for
+	// the metrics some readers take from it
+	for _, t := range []string{"cvt ", "fpgm", "prep", "OS/2"} {
+		if d, ok := f.tables[t]; ok {
+			tables[t] = d
+		}
+	}
+	return writeSFNT(0x00010000, tables), nil
+}
+
+func sfntChecksum(d []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(d); i += 4 {
+		var b [4]byte
+		copy(b[:], d[i:])
+		sum += binary.BigEndian.Uint32(b[:])
+	}
+	return sum
+}
+
+// Writes the tables as a font of the version, setting the checksum
+// adjustment of the head table
+func writeSFNT(version uint32, tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for t := range tables {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	n := len(tags)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= n {
+		entrySelector++
+	}
+	searchRange := 16 << entrySelector
+
+	header := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(header, version)
+	binary.BigEndian.PutUint16(header[4:], uint16(n))
+	binary.BigEndian.PutUint16(header[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(header[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(header[10:], uint16(16*n-searchRange))
+	body := make([]byte, 0)
+	headOffset := -1
+	for i, t := range tags {
+		d := tables[t]
+		offset := len(header) + len(body)
+		if t == "head" {
+			headOffset = offset
+		}
+		r := header[12+16*i:]
+		copy(r, t)
+		binary.BigEndian.PutUint32(r[4:], sfntChecksum(d))
+		binary.BigEndian.PutUint32(r[8:], uint32(offset))
+		binary.BigEndian.PutUint32(r[12:], uint32(len(d)))
+		body = append(body, d...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	font := append(header, body...)
+	if headOffset >= 0 {
+		binary.BigEndian.PutUint32(font[headOffset+8:], 0xb1b0afba-sfntChecksum(font))
+	}
+	return font
+}
@@ -0,0 +1,434 @@
+package app
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"testing"
+	"unicode/utf16"
+)
+
+// Runes of the test fonts. The glyph of the rune at i is i+1, and the
+// glyph after them is a component of the glyph of testCompositeRune.
+var testFontRunes = []rune(" !\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~" +
+	"請求書御中合計金額円作業日時間税込小備考株式会社様下記の通りご申し上げます。、（）「」・ー")
+
+const testCompositeRune = '計'
+
+func testFontWidth(r rune) int {
+	if r < 0x80 {
+		return 500
+	}
+	return 1000
+}
+
+func putU16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func putU32(b []byte, v int) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Returns the tables of the test fonts but the outlines, which have the
+// glyphs numbered
+func newTestFontTables(name string, numGlyphs int) map[string][]byte {
+	head := make([]byte, 54)
+	binary.BigEndian.PutUint32(head, 0x00010000)
+	binary.BigEndian.PutUint32(head[12:], 0x5f0f3cf5)
+	binary.BigEndian.PutUint16(head[18:], 1000)
+	for i, v := range []int{0, -120, 1000, 880} {
+		binary.BigEndian.PutUint16(head[36+2*i:], uint16(int16(v)))
+	}
+	binary.BigEndian.PutUint16(head[50:], 1)
+
+	hhea := make([]byte, 36)
+	binary.BigEndian.PutUint32(hhea, 0x00010000)
+	binary.BigEndian.PutUint16(hhea[4:], 880)
+	binary.BigEndian.PutUint16(hhea[6:], uint16(0x10000-120))
+	binary.BigEndian.PutUint16(hhea[34:], uint16(numGlyphs))
+
+	maxp := putU16(putU32(nil, 0x00005000), numGlyphs)
+
+	hmtx := make([]byte, 0, 4*numGlyphs)
+	hmtx = putU16(putU16(hmtx, 1000), 0)
+	for g := 1; g < numGlyphs; g++ {
+		w := 1000
+		if g <= len(testFontRunes) {
+			w = testFontWidth(testFontRunes[g-1])
+		}
+		hmtx = putU16(putU16(hmtx, w), 0)
+	}
+
+	// Format 12 subtable of a group for each rune
+	runes := append([]rune{}, testFontRunes...)
+	glyphs := make(map[rune]int, len(runes))
+	for i, r := range runes {
+		glyphs[r] = i + 1
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	sub := putU16(putU16(nil, 12), 0)
+	sub = putU32(putU32(putU32(sub, 16+12*len(runes)), 0), len(runes))
+	for _, r := range runes {
+		sub = putU32(putU32(putU32(sub, int(r)), int(r)), glyphs[r])
+	}
+	cmap := putU32(putU16(putU16(putU16(putU16(nil, 0), 1), 3), 10), 12)
+	cmap = append(cmap, sub...)
+
+	var nameUTF16 []byte
+	for _, u := range utf16.Encode([]rune(name)) {
+		nameUTF16 = putU16(nameUTF16, int(u))
+	}
+	nameTable := putU16(putU16(putU16(nil, 0), 1), 6+12)
+	for _, v := range []int{3, 1, 0x409, 6, len(nameUTF16), 0} {
+		nameTable = putU16(nameTable, v)
+	}
+	nameTable = append(nameTable, nameUTF16...)
+
+	return map[string][]byte{"head": head, "hhea": hhea, "maxp": maxp, "hmtx": hmtx, "cmap": cmap, "name": nameTable}
+}
+
+// Returns a TrueType font of squares with a composite glyph
+func newTestTrueType(name string) []byte {
+	numGlyphs := len(testFontRunes) + 2
+	component := numGlyphs - 1
+	square := []byte{0, 1}
+	for _, v := range []int{100, 0, 700, 700} {
+		square = putU16(square, v)
+	}
+	square = putU16(putU16(square, 3), 0)
+	square = append(square, 1, 1, 1, 1)
+	for _, v := range []int{100, 600, 0, -600, 0, 0, 700, 0} {
+		square = putU16(square, int(uint16(int16(v))))
+	}
+	composite := []byte{0xff, 0xff}
+	for _, v := range []int{100, 0, 700, 700} {
+		composite = putU16(composite, v)
+	}
+	composite = putU16(putU16(composite, glyfArgWords|0x0002), component)
+	composite = putU16(putU16(composite, 0), 0)
+
+	var glyf, loca []byte
+	for g := 0; g < numGlyphs; g++ {
+		loca = putU32(loca, len(glyf))
+		switch {
+		case g == 0:
+		case g <= len(testFontRunes) && testFontRunes[g-1] == testCompositeRune:
+			glyf = append(glyf, composite...)
+		case g <= len(testFontRunes) && testFontRunes[g-1] == ' ':
+		default:
+			glyf = append(glyf, square...)
+		}
+	}
+	loca = putU32(loca, len(glyf))
+	tables := newTestFontTables(name, numGlyphs)
+	tables["glyf"], tables["loca"] = glyf, loca
+	return writeSFNT(0x00010000, tables)
+}
+
+// CIDs of the glyphs of the test OpenType font, which are not their IDs
+func testCFFCID(g int) int {
+	if g == 0 {
+		return 0
+	}
+	return 1000 + 3*g
+}
+
+func cffInt(v int) []byte {
+	return []byte{29, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// Returns an OpenType font of a CID-keyed CFF, whose glyphs call a local
+// subroutine
+func newTestOpenType(name string) []byte {
+	numGlyphs := len(testFontRunes) + 1
+	header := []byte{1, 0, 4, 4}
+	names := encodeCFFIndex([][]byte{[]byte(name)})
+	strings := encodeCFFIndex([][]byte{[]byte("Adobe"), []byte("Identity")})
+	globalSubrs := encodeCFFIndex(nil)
+	charset := []byte{0}
+	for g := 1; g < numGlyphs; g++ {
+		charset = putU16(charset, testCFFCID(g))
+	}
+	fdSelect := append([]byte{0}, make([]byte, numGlyphs)...)
+	charStrings := make([][]byte, numGlyphs)
+	charStrings[0] = []byte{14}
+	for g := 1; g < numGlyphs; g++ {
+		// 100 0 rmoveto, call the subroutine 0, endchar
+		charStrings[g] = []byte{239, 139, 21, 32, 10, 14}
+	}
+	encodedCharStrings := encodeCFFIndex(charStrings)
+	// 500 0 rlineto 0 500 rlineto return
+	subrs := encodeCFFIndex([][]byte{{248, 136, 139, 5, 139, 248, 136, 5, 11}})
+	private := append(cffInt(6), 19)
+	private = append(private, subrs...)
+
+	top := func(charsetOffset, fdSelectOffset, charStringsOffset, fdArrayOffset int) []byte {
+		d := []byte{28, 1, 135, 28, 1, 136, 139, 12, 30}
+		d = append(append(d, cffInt(charsetOffset)...), cffCharset)
+		d = append(append(d, cffInt(fdSelectOffset)...), 12, 37)
+		d = append(append(d, cffInt(charStringsOffset)...), cffCharStrings)
+		d = append(append(d, cffInt(fdArrayOffset)...), 12, 36)
+		return d
+	}
+	offset := len(header) + len(names) + len(encodeCFFIndex([][]byte{top(0, 0, 0, 0)})) + len(strings) + len(globalSubrs)
+	charsetOffset := offset
+	fdSelectOffset := charsetOffset + len(charset)
+	charStringsOffset := fdSelectOffset + len(fdSelect)
+	privateOffset := charStringsOffset + len(encodedCharStrings)
+	fdArrayOffset := privateOffset + len(private)
+	fontDict := append(append(cffInt(6), cffInt(privateOffset)...), cffPrivateOp)
+
+	var cff []byte
+	for _, d := range [][]byte{
+		header, names, encodeCFFIndex([][]byte{top(charsetOffset, fdSelectOffset, charStringsOffset, fdArrayOffset)}),
+		strings, globalSubrs, charset, fdSelect, encodedCharStrings, private, encodeCFFIndex([][]byte{fontDict}),
+	} {
+		cff = append(cff, d...)
+	}
+	tables := newTestFontTables(name, numGlyphs)
+	tables["CFF "] = cff
+	return writeSFNT(0x4f54544f, tables)
+}
+
+// Returns a collection of the fonts, moving their tables
+func newTestCollection(fonts ...[]byte) []byte {
+	d := putU32(putU32([]byte("ttcf"), 0x00010000), len(fonts))
+	offset := len(d) + 4*len(fonts)
+	for _, f := range fonts {
+		d = putU32(d, offset)
+		offset += len(f)
+	}
+	for _, f := range fonts {
+		base := len(d)
+		f = append([]byte{}, f...)
+		for i := 0; i < int(binary.BigEndian.Uint16(f[4:])); i++ {
+			r := f[12+16*i+8:]
+			binary.BigEndian.PutUint32(r, binary.BigEndian.Uint32(r)+uint32(base))
+		}
+		d = append(d, f...)
+	}
+	return d
+}
+
+func getTestGlyph(t *testing.T, f *sfntFont, r rune) int {
+	t.Helper()
+	g := f.glyph(r)
+	if g == 0 {
+		t.Fatalf("no glyph of %q", r)
+	}
+	return g
+}
+
+func TestParseFont(t *testing.T) {
+	ttf := newTestTrueType("TestSans")
+	otf := newTestOpenType("TestMincho")
+	ttc := newTestCollection(newTestTrueType("TestGothic"), otf)
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		index int
+		want  string
+		cff   bool
+	}{
+		{"ttf", ttf, 0, "TestSans", false},
+		{"otf", otf, 0, "TestMincho", true},
+		{"ttc 0", ttc, 0, "TestGothic", false},
+		{"ttc 1", ttc, 1, "TestMincho", true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := parseFont(c.data, c.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.name != c.want {
+				t.Errorf("name: got %q, want %q", f.name, c.want)
+			}
+			if (f.cff != nil) != c.cff {
+				t.Errorf("cff: got %v, want %v", f.cff != nil, c.cff)
+			}
+			if g := getTestGlyph(t, f, '請'); f.width(g) != 1000 {
+				t.Errorf("width of 請: got %d", f.width(g))
+			}
+			if g := getTestGlyph(t, f, 'A'); f.width(g) != 500 {
+				t.Errorf("width of A: got %d", f.width(g))
+			}
+			if g := f.glyph('漢'); g != 0 {
+				t.Errorf("glyph of a rune not in the font: got %d", g)
+			}
+		})
+	}
+	if _, err := parseFont(ttc, 2); err == nil {
+		t.Error("no error for an index out of the collection")
+	}
+	if _, err := parseFont(ttf, 1); err == nil {
+		t.Error("no error for an index of a font not a collection")
+	}
+}
+
+// Returns the glyph data of the subset TrueType font by glyph. Subsets
+// have no cmap, so they are not read by parseFont.
+func getTestGlyphs(t *testing.T, d []byte) [][]byte {
+	t.Helper()
+	tables := make(map[string][]byte)
+	for i := 0; i < int(binary.BigEndian.Uint16(d[4:])); i++ {
+		r := d[12+16*i:]
+		o, length := binary.BigEndian.Uint32(r[8:]), binary.BigEndian.Uint32(r[12:])
+		tables[string(r[:4])] = d[o : o+length]
+	}
+	loca, glyf := tables["loca"], tables["glyf"]
+	glyphs := make([][]byte, binary.BigEndian.Uint16(tables["maxp"][4:]))
+	for g := range glyphs {
+		glyphs[g] = glyf[binary.BigEndian.Uint32(loca[4*g:]):binary.BigEndian.Uint32(loca[4*g+4:])]
+	}
+	return glyphs
+}
+
+func TestSubsetTrueType(t *testing.T) {
+	f, err := parseFont(newTestTrueType("TestSans"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seikyu, a := getTestGlyph(t, f, '請'), getTestGlyph(t, f, 'A')
+	d, err := f.subset(map[int]bool{seikyu: true, a: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	glyphs := getTestGlyphs(t, d)
+	if len(glyphs) != seikyu+1 {
+		t.Errorf("glyphs: got %d, want %d up to the last one used", len(glyphs), seikyu+1)
+	}
+	for g, data := range glyphs {
+		if used := g == seikyu || g == a; used != (len(data) > 0) {
+			t.Errorf("glyph %d: got %d bytes", g, len(data))
+		}
+	}
+	if len(d) >= len(newTestTrueType("TestSans")) {
+		t.Errorf("subset of %d bytes is not smaller than the font", len(d))
+	}
+
+	composite := getTestGlyph(t, f, testCompositeRune)
+	d, err = f.subset(map[int]bool{composite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	glyphs = getTestGlyphs(t, d)
+	component := f.numGlyphs - 1
+	if len(glyphs) != component+1 || len(glyphs[component]) == 0 || len(glyphs[composite]) == 0 {
+		t.Errorf("subset with a composite glyph has no component")
+	}
+}
+
+func TestSubsetCFF(t *testing.T) {
+	f, err := parseFont(newTestOpenType("TestMincho"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seikyu := getTestGlyph(t, f, '請')
+	if got, want := f.cid(seikyu), testCFFCID(seikyu); got != want {
+		t.Errorf("cid: got %d, want %d", got, want)
+	}
+	d, err := f.subset(map[int]bool{seikyu: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseCFF(d, f.numGlyphs)
+	if err != nil {
+		t.Fatalf("subset is broken: %v", err)
+	}
+	for g, cs := range c.charStrings[1:] {
+		g++
+		if used := g == seikyu; used != (len(cs) > 1) {
+			t.Errorf("charstring of glyph %d: got %v", g, cs)
+		}
+	}
+	for g := range c.cids {
+		if c.cids[g] != testCFFCID(g) {
+			t.Errorf("cid of glyph %d: got %d", g, c.cids[g])
+		}
+	}
+	if len(c.fonts) != 1 || len(c.fonts[0].private.subrs) == 0 {
+		t.Errorf("local subroutines are not kept")
+	}
+}
+
+// Reads the font and uses it as pdfs do, returning the panic if any. Errors
+// are what broken fonts should give.
+func useBrokenTestFont(d []byte, index int) (panicked interface{}) {
+	defer func() {
+		panicked = recover()
+	}()
+	f, err := parseFont(d, index)
+	if err != nil {
+		return nil
+	}
+	glyphs := make(map[int]bool)
+	for _, r := range testFontRunes {
+		g := f.glyph(r)
+		f.width(g)
+		f.cid(g)
+		glyphs[g] = true
+	}
+	f.subset(glyphs)
+	return nil
+}
+
+func TestParseBrokenFont(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		index int
+	}{
+		{"ttf", newTestTrueType("TestSans"), 0},
+		{"otf", newTestOpenType("TestMincho"), 0},
+		{"ttc", newTestCollection(newTestTrueType("TestGothic"), newTestOpenType("TestMincho")), 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for n := 0; n < len(c.data); n++ {
+				if p := useBrokenTestFont(c.data[:n], c.index); p != nil {
+					t.Fatalf("font cut at %d bytes: panic: %v", n, p)
+				}
+			}
+			// Bytes changed at random, the same ones in every run
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < 5000; i++ {
+				d := append([]byte{}, c.data...)
+				changed := make([]int, 1+rnd.Intn(8))
+				for j := range changed {
+					changed[j] = rnd.Intn(len(d))
+					d[changed[j]] = byte(rnd.Intn(256))
+				}
+				if p := useBrokenTestFont(d, c.index); p != nil {
+					t.Fatalf("font with bytes %v changed: panic: %v", changed, p)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBrokenFontTables(t *testing.T) {
+	// Groups of a format 12 cmap are only the ones in the table
+	cmap := make([]byte, 16+12)
+	binary.BigEndian.PutUint32(cmap[12:], 0xffffffff)
+	binary.BigEndian.PutUint32(cmap[16:], 'A')
+	binary.BigEndian.PutUint32(cmap[20:], 'Z')
+	binary.BigEndian.PutUint32(cmap[24:], 1)
+	f := &sfntFont{cmap: cmap, cmapFormat: 12, numGlyphs: 30}
+	if g := f.glyph('B'); g != 2 {
+		t.Errorf("got glyph %d, want 2", g)
+	}
+	if g := f.glyph('a'); g != 0 {
+		t.Errorf("got glyph %d, want 0", g)
+	}
+
+	// Offsets in DICTs may be negative
+	if _, _, err := parseCFFIndex(make([]byte, 8), -4); err == nil {
+		t.Errorf("got no error of an index at -4")
+	}
+	if _, _, err := parseCFFCharset(make([]byte, 8), -4, 2); err == nil {
+		t.Errorf("got no error of a charset at -4")
+	}
+	if _, err := getCFFFDSelectSize(make([]byte, 8), -4, 2); err == nil {
+		t.Errorf("got no error of an FDSelect at -4")
+	}
+}
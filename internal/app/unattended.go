@@ -0,0 +1,32 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+)
+
+var (
+	assumeYes  bool
+	unattended bool
+)
+
+// Notification settings and month of the run, for failures ending the run
+var (
+	runNotify *NotifyConfig
+	runMonth  string
+)
+
+// Where unattended runs write their summaries, stdout unless made by serve
+var summaryOutput io.Writer = os.Stdout
+
+// Writes the summary of the run as JSON, which unattended runs print
+// instead of the table of results
+func printRunSummaryJSON(summary *hookRunSummary) {
+	e := json.NewEncoder(summaryOutput)
+	e.SetIndent("", "  ")
+	if err := e.Encode(summary); err != nil {
+		logErrorf(log.Default(), "Failed to write run summary: %v\n", err)
+	}
+}
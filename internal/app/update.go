@@ -0,0 +1,325 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With check_updates, runs look for a newer release on GitHub at most once a
+// day and print a line if there is one, and self-update installs it. The
+// check never delays or fails runs, and is skipped in unattended runs and
+// serve unless check_updates_unattended. Without check_updates neither does
+// anything.
+const (
+	updateCheckInterval = 24 * time.Hour
+	updateCheckTimeout  = 5 * time.Second
+	// How long runs wait at the end for the check not done yet
+	updateNoticeWait = time.Second
+)
+
+// updateCheck is the last check for updates, kept in the state
+type updateCheck struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Latest    string    `json:"latest"`
+}
+
+// githubRelease is the part of a release of the GitHub API used
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name               string `json:"name"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func getLatestRelease(ctx context.Context, repository string) (*githubRelease, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", repository), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "make-invoices/"+version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get the latest release of %s: %s", repository, resp.Status)
+	}
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("failed to decode the latest release: %v", err)
+	}
+	return &release, nil
+}
+
+// Tells whether the version like "v1.2.3" is newer than the current one.
+// Versions not of numbers, like "dev" builds, are never compared.
+func isNewerVersion(latest, current string) bool {
+	parse := func(v string) ([]int, bool) {
+		v = strings.SplitN(strings.TrimPrefix(v, "v"), "-", 2)[0]
+		parts := strings.Split(v, ".")
+		nums := make([]int, 0, len(parts))
+		for _, p := range parts {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, false
+			}
+			nums = append(nums, n)
+		}
+		return nums, true
+	}
+	l, ok := parse(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parse(current)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(l) || i < len(c); i++ {
+		var a, b int
+		if i < len(l) {
+			a = l[i]
+		}
+		if i < len(c) {
+			b = c[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
+
+// Starts checking for updates in the background if check_updates, returning
+// the function printing a line if a newer version is released. It waits for
+// the check for the duration at most, so that runs ending before the check
+// still tell of the release while a slow check never holds them up. headless
+// runs, like unattended ones and serve, check only with
+// check_updates_unattended.
+func startUpdateCheck(config *Config, headless bool) func(wait time.Duration) {
+	if !config.CheckUpdates || (headless && !config.CheckUpdatesUnattended) {
+		return func(time.Duration) {}
+	}
+	notice := make(chan string, 1)
+	go func() {
+		defer close(notice)
+		latest, err := getLatestVersion(config)
+		if err != nil {
+			logVerbose("Failed to check for updates: %v\n", err)
+			return
+		}
+		if isNewerVersion(latest, version) {
+			notice <- fmt.Sprintf("make-invoices %s is released (running %s); run \"make-invoices self-update\" to update", latest, version)
+		}
+	}()
+	return func(wait time.Duration) {
+		select {
+		case line, ok := <-notice:
+			if ok {
+				log.Println(line)
+			}
+		case <-time.After(wait):
+			logVerbose("Gave up waiting for the check for updates\n")
+		}
+	}
+}
+
+// Returns the latest version, asking GitHub if not checked within a day
+func getLatestVersion(config *Config) (string, error) {
+	if state, err := loadState(); err == nil && state.UpdateCheck != nil && time.Since(state.UpdateCheck.CheckedAt) < updateCheckInterval {
+		return state.UpdateCheck.Latest, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+	release, err := getLatestRelease(ctx, config.GetUpdateRepository())
+	if err != nil {
+		return "", err
+	}
+	if err := updateState(func(state *State) error {
+		state.UpdateCheck = &updateCheck{CheckedAt: time.Now(), Latest: release.TagName}
+		return nil
+	}); err != nil {
+		logVerbose("Failed to save the update check: %v\n", err)
+	}
+	return release.TagName, nil
+}
+
+// "make-invoices self-update" replaces the executable with the one of the
+// latest release for the OS and architecture, named like
+// "make-invoices_linux_amd64", after checking its SHA-256 published in
+// checksums.txt or in the file of the name with ".sha256". The executable
+// replaced is kept with ".old".
+func runSelfUpdate(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "update without asking")
+	fs.Parse(args)
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if !config.CheckUpdates {
+		return newRunError(exitConfigError, "config", "self-update needs check_updates in the config")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	release, err := getLatestRelease(ctx, config.GetUpdateRepository())
+	if err != nil {
+		return fmt.Errorf("Failed to check for updates: %v", err)
+	}
+	if !isNewerVersion(release.TagName, version) {
+		log.Printf("make-invoices %s is the latest (latest release %s)\n", version, release.TagName)
+		return nil
+	}
+
+	name := fmt.Sprintf("make-invoices_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	assets := make(map[string]string)
+	for _, a := range release.Assets {
+		assets[a.Name] = a.BrowserDownloadURL
+	}
+	url, ok := assets[name]
+	if !ok {
+		return fmt.Errorf("Release %s has no %s", release.TagName, name)
+	}
+	want, err := getPublishedChecksum(ctx, assets, name)
+	if err != nil {
+		return fmt.Errorf("Failed to get the checksum of %s: %v", name, err)
+	}
+	if !*yes && !confirm(log.Default(), msg("confirm_self_update", version, release.TagName)) {
+		log.Println("Canceled")
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Failed to get executable path: %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("Failed to get executable path: %v", err)
+	}
+	// The download is written next to the executable, so that renaming it
+	// over the executable replaces it at once
+	tmp := exe + ".new"
+	if err := downloadUpdate(ctx, url, tmp, want); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to download %s: %v", name, err)
+	}
+	backup := exe + ".old"
+	if err := copyExecutable(exe, backup); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to back up %s: %v", exe, err)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to replace %s: %v", exe, err)
+	}
+	log.Printf("Updated make-invoices from %s to %s (previous executable kept as %s)\n", version, release.TagName, backup)
+	return nil
+}
+
+// Returns the SHA-256 of the asset published in checksums.txt, or in the
+// asset of its name with ".sha256"
+func getPublishedChecksum(ctx context.Context, assets map[string]string, name string) (string, error) {
+	for _, file := range []string{"checksums.txt", name + ".sha256"} {
+		url, ok := assets[file]
+		if !ok {
+			continue
+		}
+		body, err := getReleaseFile(ctx, url)
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		s := bufio.NewScanner(body)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 1 && file != "checksums.txt" {
+				return strings.ToLower(fields[0]), nil
+			}
+			if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+		if err := s.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%s has no checksum of %s", file, name)
+	}
+	return "", fmt.Errorf("the release publishes no checksums")
+}
+
+func getReleaseFile(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "make-invoices/"+version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to get %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Downloads the executable to the file, failing unless it has the SHA-256
+func downloadUpdate(ctx context.Context, url, fileName, want string) error {
+	body, err := getReleaseFile(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), body); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch: sha256 %s, published %s", got, want)
+	}
+	return f.Close()
+}
+
+// Copies the executable with its mode
+func copyExecutable(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := copyFileTo(f, src); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &b
+}
+
+func setTestVersion(t *testing.T, v string) {
+	t.Helper()
+	saved := version
+	version = v
+	t.Cleanup(func() { version = saved })
+}
+
+// Saves the check of the latest version as done just now, so that GitHub is
+// not asked
+func saveTestUpdateCheck(t *testing.T, latest string) {
+	t.Helper()
+	if err := updateState(func(state *State) error {
+		state.UpdateCheck = &updateCheck{CheckedAt: time.Now(), Latest: latest}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateNotice(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		latest string
+		notice bool
+	}{
+		{"newer", &Config{CheckUpdates: true}, "v1.1.0", true},
+		{"same", &Config{CheckUpdates: true}, "v1.0.0", false},
+		{"disabled", &Config{}, "v1.1.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestStateFile(t)
+			setTestVersion(t, "v1.0.0")
+			saveTestUpdateCheck(t, tt.latest)
+			out := captureLog(t)
+			startUpdateCheck(tt.config, false)(time.Minute)
+			got := strings.Contains(out.String(), "make-invoices "+tt.latest+" is released")
+			if got != tt.notice {
+				t.Errorf("log = %q, want notice %v", out, tt.notice)
+			}
+		})
+	}
+}
+
+// The run doesn't wait long for the check which hasn't finished
+func TestUpdateNoticeWait(t *testing.T) {
+	setTestStateFile(t)
+	setTestVersion(t, "v1.0.0")
+	saveTestUpdateCheck(t, "v1.1.0")
+	out := captureLog(t)
+	// The check waits for the state
+	unlock, err := lockState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	printNotice := startUpdateCheck(&Config{CheckUpdates: true}, false)
+	start := time.Now()
+	printNotice(50 * time.Millisecond)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %v for the check, want 50ms", d)
+	}
+	if strings.Contains(out.String(), "is released") {
+		t.Errorf("log = %q, want no notice before the check", out)
+	}
+	unlock()
+	printNotice(time.Minute)
+	if !strings.Contains(out.String(), "make-invoices v1.1.0 is released") {
+		t.Errorf("log = %q, want the notice after the check", out)
+	}
+}
+
+func TestIsNewerVersion(t *testing.T) {
+	tests := []struct {
+		latest, current string
+		want            bool
+	}{
+		{"v1.1.0", "v1.0.0", true},
+		{"v1.0.0", "v1.0.0", false},
+		{"v1.0.0", "v1.1.0", false},
+		{"v1.10.0", "v1.9.0", true},
+		{"v2", "v1.9.9", true},
+		{"v1.0.1", "v1.0", true},
+		{"v1.1.0-rc1", "v1.0.0", true},
+		{"v1.1.0", "dev", false},
+		{"latest", "v1.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := isNewerVersion(tt.latest, tt.current); got != tt.want {
+			t.Errorf("isNewerVersion(%q, %q) = %v, want %v", tt.latest, tt.current, got, tt.want)
+		}
+	}
+}
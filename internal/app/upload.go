@@ -0,0 +1,375 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const driveFolderMimeType = "application/vnd.google-apps.folder"
+
+// App properties marking uploaded files, so that re-runs update them
+const (
+	driveMonthProperty       = "make-invoices"
+	driveSpreadsheetProperty = "make-invoices-spreadsheet"
+)
+
+// Folders are looked up and created one at a time so that spreadsheets
+// processed in parallel don't create the same folder twice
+var driveFolderMu sync.Mutex
+
+func escapeDriveQuery(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// IDs of drive folders and uploaded files are cached in the state, keyed
+// by the parent and the name for folders, and by the spreadsheet and the
+// month for files
+func getCachedDriveID(folder bool, key string) string {
+	state, err := loadState()
+	if err != nil {
+		return ""
+	}
+	if folder {
+		return state.DriveFolders[key]
+	}
+	return state.DriveFiles[key]
+}
+
+// Caches the ID, or removes the cached one if id is empty
+func cacheDriveID(folder bool, key, id string) error {
+	if err := updateState(func(state *State) error {
+		m := &state.DriveFiles
+		if folder {
+			m = &state.DriveFolders
+		}
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+		if id == "" {
+			delete(*m, key)
+		} else {
+			(*m)[key] = id
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	return nil
+}
+
+func isNotFoundError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// Reasons of 403 errors for files the account can see but not change, as
+// on shared drives it is not a member of with enough access
+var drivePermissionReasons = map[string]bool{
+	"insufficientFilePermissions": true,
+	"insufficientPermissions":     true,
+	"teamDriveMembershipRequired": true,
+	"forbidden":                   true,
+}
+
+// Tells what to do about the file of the error. Drive answers 404 for
+// files the account can't see at all, including files on shared drives
+// it is not a member of, and 403 for files it can't change.
+func describeDriveError(err error, what string) error {
+	var apiErr *googleapi.Error
+	var statusErr *httpStatusError
+	code, reason := 0, ""
+	switch {
+	case errors.As(err, &apiErr):
+		code = apiErr.Code
+		if len(apiErr.Errors) > 0 {
+			reason = apiErr.Errors[0].Reason
+		}
+	case errors.As(err, &statusErr):
+		code = statusErr.code
+	default:
+		return err
+	}
+	switch {
+	case code == http.StatusNotFound:
+		return fmt.Errorf("%s was not found; check the ID, and if it is on a shared drive, that the authorized account is added to the drive: %w", what, err)
+	case code == http.StatusForbidden && (reason == "" || drivePermissionReasons[reason]):
+		return fmt.Errorf("the authorized account can't change %s; add it to the shared drive as a contributor or share the file with it as an editor: %w", what, err)
+	}
+	return err
+}
+
+// Returns the folder at the slash separated path under parentID, creating
+// missing folders. Cached folder IDs are ignored with refresh.
+func getDriveFolder(drv *drive.Service, parentID, path string, refresh bool, logger *log.Logger) (string, error) {
+	driveFolderMu.Lock()
+	defer driveFolderMu.Unlock()
+	id := parentID
+	// The folders are on the shared drive of the parent, if any, which is
+	// got only if a folder is looked up
+	var sharedDrive *string
+	for _, name := range strings.Split(path, "/") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		key := id + "/" + name
+		if cached := getCachedDriveID(true, key); cached != "" && !refresh {
+			id = cached
+			continue
+		}
+		if sharedDrive == nil {
+			driveID, err := getSharedDriveID(drv, parentID)
+			if err != nil {
+				return "", err
+			}
+			sharedDrive = &driveID
+		}
+		folderID, err := findOrCreateDriveFolder(drv, id, *sharedDrive, name, logger)
+		if err != nil {
+			return "", err
+		}
+		if err := cacheDriveID(true, key, folderID); err != nil {
+			return "", err
+		}
+		id = folderID
+	}
+	return id, nil
+}
+
+// Returns the ID of the shared drive having the file, or "" if it is not on
+// a shared drive
+func getSharedDriveID(drv *drive.Service, fileID string) (string, error) {
+	var file *drive.File
+	if err := callAPI("get drive folder", func(ctx context.Context) (err error) {
+		file, err = drv.Files.Get(fileID).SupportsAllDrives(true).Fields("driveId").Context(ctx).Do()
+		return
+	}); err != nil {
+		return "", fmt.Errorf("failed to get drive folder: %v", describeDriveError(err, "drive folder "+fileID))
+	}
+	return file.DriveId, nil
+}
+
+// Returns the oldest folder of the name under parentID, which is on the
+// shared drive of driveID if it is not empty, creating it if missing. If
+// another run created the folder at the same time, the one created here is
+// removed so that both runs use the oldest.
+func findOrCreateDriveFolder(drv *drive.Service, parentID, driveID, name string, logger *log.Logger) (string, error) {
+	find := func() (string, error) {
+		var list *drive.FileList
+		if err := callAPI("find drive folder", func(ctx context.Context) (err error) {
+			call := drv.Files.List().
+				Q(fmt.Sprintf("'%s' in parents and name = '%s' and mimeType = '%s' and trashed = false", escapeDriveQuery(parentID), escapeDriveQuery(name), driveFolderMimeType)).
+				OrderBy("createdTime").
+				SupportsAllDrives(true).
+				Fields("files(id)")
+			// Searches of all drives may leave files out, so the shared
+			// drive is searched alone
+			if driveID != "" {
+				call = call.Corpora("drive").DriveId(driveID).IncludeItemsFromAllDrives(true)
+			} else {
+				call = call.Corpora("user")
+			}
+			list, err = call.Context(ctx).Do()
+			return
+		}); err != nil {
+			return "", fmt.Errorf("failed to find drive folder %s: %v", name, describeDriveError(err, "drive folder "+parentID))
+		}
+		if len(list.Files) == 0 {
+			return "", nil
+		}
+		return list.Files[0].Id, nil
+	}
+
+	if id, err := find(); err != nil || id != "" {
+		return id, err
+	}
+	var folder *drive.File
+	if err := callAPI("create drive folder", func(ctx context.Context) (err error) {
+		folder, err = drv.Files.Create(&drive.File{
+			Name:     name,
+			MimeType: driveFolderMimeType,
+			Parents:  []string{parentID},
+		}).SupportsAllDrives(true).Fields("id").Context(ctx).Do()
+		return
+	}); err != nil {
+		return "", fmt.Errorf("failed to create drive folder %s: %v", name, describeDriveError(err, "drive folder "+parentID))
+	}
+	logger.Printf("Created drive folder %s\n", name)
+
+	oldest, err := find()
+	if err != nil {
+		return "", err
+	}
+	if oldest != "" && oldest != folder.Id {
+		if err := callAPI("delete drive folder", func(ctx context.Context) error {
+			return drv.Files.Delete(folder.Id).SupportsAllDrives(true).Context(ctx).Do()
+		}); err != nil {
+			return "", fmt.Errorf("failed to delete duplicate drive folder %s: %v", name, err)
+		}
+		logger.Printf("Drive folder %s was also created by another run, using the older one\n", name)
+		return oldest, nil
+	}
+	return folder.Id, nil
+}
+
+// Uploads the pdf to the drive folder, updating the file uploaded by a
+// previous run for the same month and spreadsheet in place if any, so
+// that links to it keep working. kind tells other pdfs than the timesheet
+// apart, e.g. "invoice".
+func uploadToDrive(drv *drive.Service, fileName, kind, spreadsheetID, title, invoiceNumber string, revision int, targetTime time.Time, config *Config, logger *log.Logger) (*drive.File, error) {
+	name := filepath.Base(fileName)
+	if config.DriveUploadName != "" && kind == "" {
+		var err error
+		if name, err = export.FormatNameTemplate("drive_upload_name", config.DriveUploadName, targetTime, title, invoiceNumber); err != nil {
+			return nil, err
+		}
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + revisionSuffix(revision) + ext
+	}
+
+	// A cached folder may have been deleted, so the upload is tried again
+	// with the folders looked up
+	for refresh := false; ; refresh = true {
+		folderID := config.DriveUploadFolderID
+		if config.DriveUploadSubfolder != "" {
+			path, err := export.FormatNameTemplate("drive_upload_subfolder", config.DriveUploadSubfolder, targetTime, title, invoiceNumber)
+			if err != nil {
+				return nil, err
+			}
+			if folderID, err = getDriveFolder(drv, folderID, path, refresh, logger); err != nil {
+				return nil, err
+			}
+		}
+		// Revisions are uploaded apart from the originals
+		file, err := uploadFileToDrive(drv, fileName, name, kind, folderID, spreadsheetID, revisionKey(targetTime.Format("200601"), revision))
+		if err != nil && isNotFoundError(err) && !refresh && config.DriveUploadSubfolder != "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %s to drive: %v", fileName, describeDriveError(err, "drive folder "+folderID))
+		}
+		return file, nil
+	}
+}
+
+func uploadFileToDrive(drv *drive.Service, fileName, name, kind, folderID, spreadsheetID, month string) (*drive.File, error) {
+	fileKey := spreadsheetID + "/" + month
+	monthProperty := driveMonthProperty
+	if kind != "" {
+		fileKey += "/" + kind
+		monthProperty += "-" + kind
+	}
+	existing, err := findUploadedFile(drv, fileKey, monthProperty, spreadsheetID, month)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := "application/pdf"
+	if filepath.Ext(fileName) == ".zip" {
+		contentType = "application/zip"
+	}
+	var file *drive.File
+	// The media is streamed from the file, so the upload is sent once. A file
+	// made by an upload which failed is found and replaced by the next run.
+	if err := callAPI("upload file", func(ctx context.Context) error {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if existing != nil {
+			call := drv.Files.Update(existing.Id, &drive.File{Name: name}).
+				Media(f, googleapi.ContentType(contentType)).
+				SupportsAllDrives(true).
+				Fields("id", "webViewLink")
+			// Files are moved when the folder changed, keeping their IDs
+			if !containsString(existing.Parents, folderID) {
+				call = call.AddParents(folderID).RemoveParents(strings.Join(existing.Parents, ","))
+			}
+			file, err = call.Context(ctx).Do()
+		} else {
+			file, err = drv.Files.Create(&drive.File{
+				Name:    name,
+				Parents: []string{folderID},
+				AppProperties: map[string]string{
+					monthProperty:            month,
+					driveSpreadsheetProperty: spreadsheetID,
+				},
+			}).
+				Media(f, googleapi.ContentType(contentType)).
+				SupportsAllDrives(true).
+				Fields("id", "webViewLink").
+				Context(ctx).
+				Do()
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := cacheDriveID(false, fileKey, file.Id); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Returns the file uploaded by a previous run, from the cached ID or by
+// the app properties, or nil if there is none
+func findUploadedFile(drv *drive.Service, fileKey, monthProperty, spreadsheetID, month string) (*drive.File, error) {
+	if id := getCachedDriveID(false, fileKey); id != "" {
+		var file *drive.File
+		err := callAPI("get uploaded file", func(ctx context.Context) (err error) {
+			file, err = drv.Files.Get(id).SupportsAllDrives(true).Fields("id", "trashed", "parents").Context(ctx).Do()
+			return
+		})
+		if err == nil && !file.Trashed {
+			return file, nil
+		}
+		if err != nil && !isNotFoundError(err) {
+			return nil, fmt.Errorf("failed to get uploaded file: %v", err)
+		}
+		if err := cacheDriveID(false, fileKey, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	var list *drive.FileList
+	if err := callAPI("find uploaded file", func(ctx context.Context) (err error) {
+		list, err = drv.Files.List().
+			Q(fmt.Sprintf("appProperties has { key='%s' and value='%s' } and appProperties has { key='%s' and value='%s' } and trashed = false",
+				monthProperty, month, driveSpreadsheetProperty, escapeDriveQuery(spreadsheetID))).
+			Corpora("allDrives").
+			SupportsAllDrives(true).
+			IncludeItemsFromAllDrives(true).
+			OrderBy("createdTime").
+			Fields("files(id, parents)").
+			Context(ctx).
+			Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to find uploaded file: %v", err)
+	}
+	if len(list.Files) == 0 {
+		return nil, nil
+	}
+	return list.Files[0], nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Tells that folders under a folder of My Drive and of a shared drive are
+// created once, and are looked up in the shared drive alone
+func TestGetDriveFolderSharedDrive(t *testing.T) {
+	for _, driveID := range []string{"", "shared-drive"} {
+		t.Run("drive "+driveID, func(t *testing.T) {
+			f := newFakeAPI(t)
+			setTestStateFile(t)
+			useFastRetry(t)
+			f.addDriveFolder("invoices", "root", driveID)
+			ctx := context.Background()
+			drv, err := drive.NewService(ctx, getServiceOptions(f.client(ctx), "drive/v3/")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger := log.New(ioutil.Discard, "", 0)
+
+			id, err := getDriveFolder(drv, "invoices", "2024/05", false, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(f.folders) != 3 || id != f.folders[2].Id || f.folders[2].Parents[0] != f.folders[1].Id {
+				t.Fatalf("got folder %s of folders %v", id, f.folders)
+			}
+			for _, folder := range f.folders[1:] {
+				if folder.DriveId != driveID {
+					t.Errorf("folder %s: got drive %q, want %q", folder.Name, folder.DriveId, driveID)
+				}
+			}
+			// The folders made are found again
+			again, err := getDriveFolder(drv, "invoices", "2024/05", true, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != id || len(f.folders) != 3 {
+				t.Errorf("got folder %s again with %d folders", again, len(f.folders))
+			}
+
+			if len(f.driveLists) == 0 {
+				t.Fatal("no folders looked up")
+			}
+			for _, q := range f.driveLists {
+				if q.Get("supportsAllDrives") != "true" {
+					t.Errorf("list without supportsAllDrives: %v", q)
+				}
+				if driveID == "" && (q.Get("corpora") != "user" || q.Get("driveId") != "") {
+					t.Errorf("list of My Drive: got corpora %q and driveId %q", q.Get("corpora"), q.Get("driveId"))
+				}
+				if driveID != "" && (q.Get("corpora") != "drive" || q.Get("driveId") != driveID || q.Get("includeItemsFromAllDrives") != "true") {
+					t.Errorf("list of the shared drive: got corpora %q, driveId %q and includeItemsFromAllDrives %q",
+						q.Get("corpora"), q.Get("driveId"), q.Get("includeItemsFromAllDrives"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Returns the cell as text, with dates and times, which are serial numbers
+// in unformatted values, written like 2024-05-01 and 09:00
+func cellCSVValue(c *sheets.CellData) string {
+	v := c.EffectiveValue
+	switch {
+	case v == nil:
+		return ""
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.ErrorValue != nil:
+		return c.FormattedValue
+	case v.NumberValue != nil:
+		n := *v.NumberValue
+		var kind string
+		if c.EffectiveFormat != nil && c.EffectiveFormat.NumberFormat != nil {
+			kind = c.EffectiveFormat.NumberFormat.Type
+		}
+		// Rounded to minutes to absorb floating point errors
+		minutes := int64(math.Round(n * 24 * 60))
+		t := timesheet.SheetsEpoch.Add(time.Duration(minutes) * time.Minute)
+		switch kind {
+		case "DATE":
+			return t.Format("2006-01-02")
+		case "TIME":
+			// Durations like total hours may exceed 24 hours
+			return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+		case "DATE_TIME":
+			return t.Format("2006-01-02 15:04")
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return ""
+}
+
+// Writes the values of the used range of the sheet to fileName as csv
+func exportValuesCSV(sht *sheets.Service, spreadsheetID string, sheetID int64, fileName string, config *Config) error {
+	delimiter := ','
+	if config.ValuesCSVDelimiter != "" {
+		r, size := utf8.DecodeRuneInString(config.ValuesCSVDelimiter)
+		if size != len(config.ValuesCSVDelimiter) || r == '"' || r == '\r' || r == '\n' {
+			return fmt.Errorf("invalid values_csv_delimiter: %q", config.ValuesCSVDelimiter)
+		}
+		delimiter = r
+	}
+
+	var resp *sheets.Spreadsheet
+	if err := callAPI("get sheet values", func(ctx context.Context) (err error) {
+		resp, err = sht.Spreadsheets.GetByDataFilter(spreadsheetID, &sheets.GetSpreadsheetByDataFilterRequest{
+			DataFilters: []*sheets.DataFilter{{
+				GridRange: &sheets.GridRange{
+					SheetId:         sheetID,
+					ForceSendFields: []string{"SheetId"},
+				},
+			}},
+			IncludeGridData: true,
+		}).Fields("sheets.data.rowData.values(effectiveValue,effectiveFormat.numberFormat.type,formattedValue)").Context(ctx).Do()
+		return
+	}); err != nil {
+		return fmt.Errorf("failed to get sheet values: %v", err)
+	}
+
+	records := make([][]string, 0)
+	for _, s := range resp.Sheets {
+		for _, data := range s.Data {
+			for _, row := range data.RowData {
+				record := make([]string, 0, len(row.Values))
+				for _, c := range row.Values {
+					record = append(record, cellCSVValue(c))
+				}
+				records = append(records, record)
+			}
+		}
+	}
+	// Rows are padded so that every record has the same number of fields
+	cols := 0
+	for _, r := range records {
+		if len(r) > cols {
+			cols = len(r)
+		}
+	}
+	for i := range records {
+		for len(records[i]) < cols {
+			records[i] = append(records[i], "")
+		}
+	}
+
+	tmp := fileName + ".part"
+	defer os.Remove(tmp)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to save values csv: %v", err)
+	}
+	if config.ValuesCSVBOM {
+		f.WriteString("\ufeff")
+	}
+	w := csv.NewWriter(f)
+	w.Comma = delimiter
+	w.WriteAll(records)
+	if err := w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save values csv: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to save values csv: %v", err)
+	}
+	return os.Rename(tmp, fileName)
+}
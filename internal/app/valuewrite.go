@@ -0,0 +1,166 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/sheets/v4"
+)
+
+// How values are written to the sheets by value_write_mode. user_entered
+// writes strings the sheet parses as if typed, rendered for the locale of
+// the spreadsheet: dates in ISO form unless the locale reads year first
+// dates with slashes, and decimals with a comma in locales having it.
+// raw_serial writes dates and times as serial numbers and numbers as
+// numbers, which no locale parses, formatting the date cell and the time
+// columns as dates and times unless they are already.
+const (
+	valueWriteUserEntered = "user_entered"
+	valueWriteRawSerial   = "raw_serial"
+)
+
+// Kinds of the values of the day columns and totals, by name
+var valueKinds = map[string]string{
+	"work times":         "time",
+	"work end times":     "time",
+	"breaks":             "time",
+	"work day fractions": "number",
+	"total days":         "number",
+	"total hours":        "number",
+}
+
+// Languages of the locales writing decimals with a comma, and of the ones
+// writing dates year first with slashes like "2024/05/01"
+var (
+	decimalCommaLanguages = map[string]bool{"de": true, "fr": true, "es": true, "it": true, "pt": true, "nl": true, "ru": true, "pl": true, "cs": true, "sv": true, "da": true, "fi": true, "nb": true, "tr": true, "id": true, "vi": true, "uk": true}
+	slashYMDLanguages     = map[string]bool{"ja": true, "zh": true, "ko": true}
+)
+
+// valueWriter renders the values written to the sheets of a spreadsheet
+type valueWriter struct {
+	mode   string
+	locale string
+}
+
+func newValueWriter(mode, locale string) *valueWriter {
+	if mode == "" {
+		mode = valueWriteUserEntered
+	}
+	return &valueWriter{mode: mode, locale: locale}
+}
+
+// Returns the language of the locale like "en" of "en_US"
+func (w *valueWriter) language() string {
+	return strings.ToLower(strings.SplitN(strings.SplitN(w.locale, "_", 2)[0], "-", 2)[0])
+}
+
+// Returns the value of the date
+func (w *valueWriter) date(t time.Time) interface{} {
+	if w.mode == valueWriteRawSerial {
+		return serialDate(t)
+	}
+	if w.locale == "" || slashYMDLanguages[w.language()] {
+		return t.Format("2006/01/02")
+	}
+	return t.Format("2006-01-02")
+}
+
+// Returns the value of the cell of the kind of the name. Values of other
+// kinds, formulas and values not parsed as their kinds are written as they
+// are.
+func (w *valueWriter) cell(name, v string) interface{} {
+	switch valueKinds[name] {
+	case "time":
+		d, err := parseClock(v)
+		if err != nil || w.mode != valueWriteRawSerial {
+			return v
+		}
+		return d.Hours() / 24
+	case "number":
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return v
+		}
+		if w.mode == valueWriteRawSerial {
+			return f
+		}
+		if decimalCommaLanguages[w.language()] {
+			return strings.Replace(v, ".", ",", 1)
+		}
+	}
+	return v
+}
+
+// Returns the serial number of the day, in days since timesheet.SheetsEpoch
+func serialDate(t time.Time) float64 {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.Sub(timesheet.SheetsEpoch).Hours() / 24
+}
+
+// Number formats set to the cells written as serial numbers, by kind
+var serialNumberFormats = map[string]*sheets.NumberFormat{
+	"date": {Type: "DATE", Pattern: "yyyy-mm-dd"},
+	"time": {Type: "TIME", Pattern: "[h]:mm"},
+}
+
+// Formats the ranges of serial numbers of each kind as dates or times, but
+// the ones having date or time formats already, so that the format of the
+// template is kept
+func formatSerialCells(sht *sheets.Service, spreadsheetID, sheetTitle string, sheetID int64, rangesByKind map[string][]string, logger *log.Logger) error {
+	kinds := make([]string, 0)
+	a1Ranges := make([]string, 0)
+	for _, kind := range []string{"date", "time"} {
+		for _, r := range rangesByKind[kind] {
+			kinds = append(kinds, kind)
+			a1Ranges = append(a1Ranges, timesheet.QuoteSheetTitle(sheetTitle)+"!"+r)
+		}
+	}
+	if len(a1Ranges) == 0 {
+		return nil
+	}
+	var spreadsheet *sheets.Spreadsheet
+	if err := callAPI("get number formats", func(ctx context.Context) (err error) {
+		spreadsheet, err = sht.Spreadsheets.Get(spreadsheetID).
+			Ranges(a1Ranges...).
+			Fields("sheets(data(rowData(values(userEnteredFormat(numberFormat(type)))))").
+			Context(ctx).
+			Do()
+		return
+	}); err != nil {
+		return fmt.Errorf("failed to get number formats: %v", err)
+	}
+	if len(spreadsheet.Sheets) == 0 || len(spreadsheet.Sheets[0].Data) != len(a1Ranges) {
+		return fmt.Errorf("failed to get number formats: unexpected response")
+	}
+	for i, data := range spreadsheet.Sheets[0].Data {
+		if hasDateTimeFormat(data) {
+			continue
+		}
+		rng := strings.SplitN(a1Ranges[i], "!", 2)[1]
+		if err := setNumberFormat(sht, spreadsheetID, sheetID, rng, serialNumberFormats[kinds[i]]); err != nil {
+			return fmt.Errorf("failed to format %s: %v", rng, err)
+		}
+		logger.Printf("Formatted %s as %s\n", rng, strings.ToLower(serialNumberFormats[kinds[i]].Type))
+	}
+	return nil
+}
+
+// Tells whether any cell of the grid has a date or time format
+func hasDateTimeFormat(data *sheets.GridData) bool {
+	for _, row := range data.RowData {
+		for _, v := range row.Values {
+			if f := v.UserEnteredFormat; f != nil && f.NumberFormat != nil {
+				switch f.NumberFormat.Type {
+				case "DATE", "TIME", "DATE_TIME":
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Spreadsheets of period "weekly" also get a sheet for each ISO week
+// overlapping the billing period, copied from the month sheet and exported
+// to a pdf of its own. The billing is still of the whole month sheet.
+const weeklyPeriod = "weekly"
+
+// weekSheet is a week sheet of the month, having the days of period
+type weekSheet struct {
+	title  string
+	period billingPeriod
+}
+
+// Returns the ISO weeks overlapping the billing period, titled like
+// "2024W19". Unless includeOutOfMonth, weeks spanning the start or the end
+// of the period have only the days in it and are titled with the month too,
+// like "2024W18-202405", as the other month has a sheet of the same week.
+func getWeekSheets(month billingPeriod, targetTime time.Time, includeOutOfMonth bool) []weekSheet {
+	weeks := make([]weekSheet, 0)
+	// ISO weeks start on Monday
+	start := month.start.AddDate(0, 0, -((int(month.start.Weekday()) + 6) % 7))
+	for ; start.Before(month.end); start = start.AddDate(0, 0, 7) {
+		year, week := start.ISOWeek()
+		w := weekSheet{
+			title:  fmt.Sprintf("%dW%02d", year, week),
+			period: billingPeriod{start: start, end: start.AddDate(0, 0, 7)},
+		}
+		if !includeOutOfMonth && (w.period.start.Before(month.start) || w.period.end.After(month.end)) {
+			if w.period.start.Before(month.start) {
+				w.period.start = month.start
+			}
+			if w.period.end.After(month.end) {
+				w.period.end = month.end
+			}
+			w.title += "-" + targetTime.Format("200601")
+		}
+		weeks = append(weeks, w)
+	}
+	return weeks
+}
+
+// outOfMonthDays are the work and leave days of the months before and after
+// the target month, for the days of the week sheets out of it
+type outOfMonthDays struct {
+	workDays  []WorkDay
+	leaveDays []WorkDay
+}
+
+// Days of the adjacent months of the spreadsheets, resolved with the work
+// days of the run
+var resolvedOutOfMonthDays = make(map[*SpreadsheetConfig]*outOfMonthDays)
+var resolvedOutOfMonthDaysMu sync.Mutex
+
+func setOutOfMonthDays(sc *SpreadsheetConfig, days *outOfMonthDays) {
+	resolvedOutOfMonthDaysMu.Lock()
+	defer resolvedOutOfMonthDaysMu.Unlock()
+	resolvedOutOfMonthDays[sc] = days
+}
+
+// Returns the days of the adjacent months of the spreadsheet, which has none
+// unless they were resolved
+func getOutOfMonthDays(sc *SpreadsheetConfig) *outOfMonthDays {
+	resolvedOutOfMonthDaysMu.Lock()
+	defer resolvedOutOfMonthDaysMu.Unlock()
+	if days, ok := resolvedOutOfMonthDays[sc]; ok {
+		return days
+	}
+	return &outOfMonthDays{}
+}
+
+// Returns the days of the months before and after the target month
+func resolveOutOfMonthDays(ctx context.Context, client *http.Client, config *Config, sc *SpreadsheetConfig, targetTime time.Time) (*outOfMonthDays, error) {
+	days := &outOfMonthDays{}
+	for _, month := range []time.Time{targetTime.AddDate(0, -1, 0), targetTime.AddDate(0, 1, 0)} {
+		// Resolvers keep the days of one month, so each month has its own
+		var events workDayResolver = &calendarWorkDayResolver{config: config}
+		switch config.WorkSource {
+		case "csv":
+			events = &csvWorkDayResolver{config: config}
+		case "merge":
+			events = &mergedWorkDayResolver{config: config}
+		}
+		workDays, err := newWorkDayResolver(config, sc, events).resolveWorkDays(ctx, client, month)
+		if err != nil {
+			return nil, err
+		}
+		resolveEventKinds(config, workDays)
+		leaves, err := getLeaveDays(ctx, client, config, month)
+		if err != nil {
+			return nil, err
+		}
+		if len(leaves) > 0 {
+			workDays = applyLeaveDays(workDays, leaves, sc.WorkDayRule != nil)
+			days.leaveDays = append(days.leaveDays, leaves...)
+		}
+		days.workDays = append(days.workDays, workDays...)
+	}
+	return days, nil
+}
+
+// Reserves the pdf of each week sheet, named like the outputs of the month
+func reserveWeekOutputs(weeks []weekSheet, spreadsheetID, title string, files *reservedFiles, config *Config, logger *log.Logger) ([]string, error) {
+	fileNames := make([]string, 0, len(weeks))
+	for _, w := range weeks {
+		stem := w.title + title
+		name := files.safeFileName(stem, ".pdf")
+		if name != stem+".pdf" {
+			logger.Printf("Writing %s as %s\n", stem+".pdf", name)
+		}
+		reserved, err := files.reserveOutput(name, spreadsheetID, config.OnExistingOutput, logger)
+		if err != nil {
+			return nil, err
+		}
+		fileNames = append(fileNames, reserved)
+	}
+	return fileNames, nil
+}
+
+// weekLayout is the layout of the month sheet, which the week sheets share
+// as copies of it
+type weekLayout struct {
+	dateCell     string
+	columns      []dayColumn
+	columnRuns   map[string][]timesheet.Run
+	rowCount     int
+	summaryCells []summaryCell
+	breaks       *breakPolicy
+	values       *valueWriter
+	// Cells of the month only, like the invoice number, cleared in the
+	// week sheets
+	monthCells []string
+}
+
+// Writes the days of each week to its sheet, created from the month sheet
+// if missing, and exports the week sheets to the reserved files. Values of
+// existing week sheets are replaced, as they are the tool's own copies.
+func writeWeekSheets(sht *sheets.Service, drv *drive.Service, client *http.Client, sheetsID, spreadsheetID string, monthSheet *sheets.Sheet, weeks []weekSheet, fileNames []string, layout *weekLayout, workDays, leaveDays []WorkDay, holidays map[string]string, sheetLoc *time.Location, pdfOptions *PDFOptions, config *Config, backup *Backup, files *reservedFiles, logger *log.Logger) error {
+	spreadsheet, err := getSpreadsheet(sht, sheetsID, spreadsheetSheetsFields)
+	if err != nil {
+		return fmt.Errorf("failed to get spreadsheet: %v", err)
+	}
+	sheetIDs := make([]int64, len(weeks))
+	for i, w := range weeks {
+		found := false
+		for _, s := range spreadsheet.Sheets {
+			if s.Properties.Title == w.title {
+				sheetIDs[i], found = s.Properties.SheetId, true
+			}
+		}
+		created := false
+		if !found {
+			logger.Printf("Creating sheet %s from %s\n", w.title, monthSheet.Properties.Title)
+			if sheetIDs[i], created, err = createMonthSheet(sht, sheetsID, monthSheet, w.title); err != nil {
+				return err
+			}
+		}
+		if err := writeWeekSheet(sht, sheetsID, spreadsheetID, sheetIDs[i], created, w, layout, workDays, leaveDays, holidays, sheetLoc, config, backup); err != nil {
+			return fmt.Errorf("failed to write week sheet %s: %v", w.title, err)
+		}
+		logger.Printf("Wrote sheet %s (%s to %s)\n", w.title, w.period.start.Format("01/02"), w.period.end.AddDate(0, 0, -1).Format("01/02"))
+	}
+
+	for i, w := range weeks {
+		if fileNames[i] == "" {
+			continue
+		}
+		if err := exportSheet(drv, sht, client, spreadsheet, sheetIDs[i], export.Formats["pdf"], fileNames[i], pdfOptions, config, logger); err != nil {
+			return err
+		}
+		n := 0
+		for _, d := range workDays {
+			if w.period.contains(d.Date) {
+				n++
+			}
+		}
+		id := sheetIDs[i]
+		files.mu.Lock()
+		files.written = append(files.written, &outputFile{path: fileNames[i], title: spreadsheet.Properties.Title + " " + w.title, spreadsheetID: spreadsheetID, sheetID: &id, workDays: &n})
+		files.mu.Unlock()
+	}
+	return nil
+}
+
+// Writes the days of the week in the rows of the month sheet layout. Rows
+// after the week are cleared, as the sheet is a copy of the month sheet.
+func writeWeekSheet(sht *sheets.Service, sheetsID, spreadsheetID string, sheetID int64, created bool, w weekSheet, layout *weekLayout, workDays, leaveDays []WorkDay, holidays map[string]string, sheetLoc *time.Location, config *Config, backup *Backup) error {
+	rows := buildDayRows(w.period, layout.rowCount, workDays, leaveDays, holidays, config, layout.breaks, sheetLoc)
+	ranges := []string{layout.dateCell}
+	data := []*sheets.ValueRange{timesheet.CellValue(w.title, layout.dateCell, layout.values.date(w.period.start))}
+	for _, c := range layout.columns {
+		for _, run := range layout.columnRuns[c.name] {
+			ranges = append(ranges, run.Range)
+			data = append(data, timesheet.RunValues(w.title, run, func(day int) interface{} {
+				return layout.values.cell(c.name, c.value(rows[day]))
+			}))
+		}
+	}
+	for _, c := range layout.summaryCells {
+		// Amounts are billed by the month sheet only
+		v := ""
+		if c.name == "total days" || c.name == "total hours" {
+			var err error
+			if v, err = c.value(rows); err != nil {
+				return fmt.Errorf("failed to compute %s: %v", c.name, err)
+			}
+		}
+		ranges = append(ranges, c.cell)
+		data = append(data, timesheet.CellValue(w.title, c.cell, layout.values.cell(c.name, v)))
+	}
+	for _, cell := range layout.monthCells {
+		ranges = append(ranges, cell)
+		data = append(data, timesheet.CellValue(w.title, cell, ""))
+	}
+
+	previous, err := getRangeValues(sht, sheetsID, w.title, ranges)
+	if err != nil {
+		return err
+	}
+	sheetBackup := &SheetBackup{
+		SpreadsheetID: sheetsID,
+		SheetID:       sheetID,
+		SheetTitle:    w.title,
+		Created:       created,
+	}
+	if sheetsID != spreadsheetID {
+		sheetBackup.SourceSpreadsheetID = spreadsheetID
+	}
+	for i, values := range previous {
+		sheetBackup.Ranges = append(sheetBackup.Ranges, &RangeBackup{
+			Range:    ranges[i],
+			Previous: values,
+			Values:   data[i].Values,
+		})
+	}
+	backup.mu.Lock()
+	backup.Sheets = append(backup.Sheets, sheetBackup)
+	backup.mu.Unlock()
+	if err := saveBackup(backup); err != nil {
+		return err
+	}
+
+	if err := callAPI("update values", func(ctx context.Context) error {
+		return newSheetReaderWriter(sht).UpdateValues(ctx, sheetsID, data)
+	}); err != nil {
+		return fmt.Errorf("failed to set values to sheet (%s): %v", strings.Join(ranges, ", "), err)
+	}
+
+	written, err := getRangeValues(sht, sheetsID, w.title, ranges)
+	if err != nil {
+		return err
+	}
+	backup.mu.Lock()
+	for i, values := range written {
+		sheetBackup.Ranges[i].Written = values
+	}
+	backup.mu.Unlock()
+	if err := saveBackup(backup); err != nil {
+		return err
+	}
+
+	if !noVerify {
+		unwritten, err := verifyWrittenValues(sht, sheetsID, w.title, ranges, written, data)
+		if err != nil {
+			return err
+		}
+		if len(unwritten) > 0 {
+			cells := make([]string, 0, len(unwritten))
+			for _, d := range unwritten {
+				cells = append(cells, fmt.Sprintf("%s: %q, written %q", d.Cell, d.Current, d.New))
+			}
+			return fmt.Errorf("cells don't have the values written, not exporting (use --no-verify to export anyway): %s", strings.Join(cells, "; "))
+		}
+	}
+	return nil
+}
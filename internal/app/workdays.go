@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/calendarsource"
+	"google.golang.org/api/calendar/v3"
+)
+
+// workDayResolver decides the work days written to a spreadsheet
+type workDayResolver interface {
+	resolveWorkDays(ctx context.Context, client *http.Client, targetTime time.Time) ([]WorkDay, error)
+}
+
+// Returns the resolver of the spreadsheet. events finds the days worked,
+// from the calendars or the work CSV.
+func newWorkDayResolver(config *Config, sc *SpreadsheetConfig, events workDayResolver) workDayResolver {
+	if sc.WorkDayRule != nil {
+		return &ruleWorkDayResolver{config: config, rule: sc.WorkDayRule, events: events}
+	}
+	return events
+}
+
+// calendarWorkDayResolver finds work days by work day events in the
+// calendars. The result is shared by every spreadsheet using it.
+type calendarWorkDayResolver struct {
+	config   *Config
+	workDays []WorkDay
+	resolved bool
+}
+
+func (r *calendarWorkDayResolver) resolveWorkDays(ctx context.Context, client *http.Client, targetTime time.Time) ([]WorkDay, error) {
+	if r.resolved {
+		return r.workDays, nil
+	}
+
+	workDays, err := getWorkDays(ctx, client, r.config, targetTime)
+	if err != nil {
+		return nil, err
+	}
+	rawWorkDayCount := len(workDays)
+	if r.config.HolidayCalendarID != "" {
+		if workDays, err = excludeHolidays(ctx, client, r.config, targetTime, workDays); err != nil {
+			return nil, err
+		}
+	}
+	for i := range workDays {
+		workDays[i].Source = "calendar event"
+	}
+
+	if r.config.HolidayCalendarID != "" {
+		logAt(log.Default(), levelInfo, []logAttr{{"work_days", len(workDays)}}, "Found %d work days (%d before excluding holidays)\n", len(workDays), rawWorkDayCount)
+	} else {
+		logAt(log.Default(), levelInfo, []logAttr{{"work_days", len(workDays)}}, "Found %d work days\n", len(workDays))
+		// Work events are kept on public holidays, which may be worked
+		holidays, err := getHolidays(ctx, client, r.config, targetTime)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range workDays {
+			if name, ok := holidays[d.Date.Format("2006-01-02")]; ok {
+				logWarnf(log.Default(), "Warning: work day %s is a holiday (%s)\n", d.Date.Format("2006-01-02"), name)
+			}
+		}
+	}
+
+	r.workDays, r.resolved = workDays, true
+	return workDays, nil
+}
+
+// ruleWorkDayResolver makes every day of the configured weekdays a work day,
+// except for absences and holidays, and optionally adds days having work
+// day events
+type ruleWorkDayResolver struct {
+	config *Config
+	rule   *WorkDayRule
+	events workDayResolver
+}
+
+func (r *ruleWorkDayResolver) resolveWorkDays(ctx context.Context, client *http.Client, targetTime time.Time) ([]WorkDay, error) {
+	weekdays := make(map[time.Weekday]bool)
+	for _, name := range r.rule.Weekdays {
+		if wd, ok := parseWeekday(name); ok {
+			weekdays[wd] = true
+		}
+	}
+
+	// Days of the weekdays
+	workDays := make([]WorkDay, 0)
+	period := getBillingPeriod(r.config, targetTime)
+	for d := period.start; d.Before(period.end); d = d.AddDate(0, 0, 1) {
+		if weekdays[d.Weekday()] {
+			workDays = append(workDays, WorkDay{Date: d, Source: "weekday rule"})
+		}
+	}
+
+	// Minus absences
+	if r.rule.AbsenceTitle != "" {
+		absences := make(map[string]bool)
+		for _, calendarID := range r.config.GetCalendarIDs() {
+			days, err := getCalendarSchedules(ctx, client, calendarID, period, "absence:"+r.rule.AbsenceTitle, func(e *calendar.Event) bool {
+				return e.Summary == r.rule.AbsenceTitle && calendarsource.SkipReason(e, r.config.SkipNeedsAction) == ""
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range days {
+				absences[d.Date.Format("2006-01-02")] = true
+			}
+		}
+		present := make([]WorkDay, 0, len(workDays))
+		for _, d := range workDays {
+			if absences[d.Date.Format("2006-01-02")] {
+				log.Printf("Excluding %s (absence)\n", d.Date.Format("2006-01-02"))
+				continue
+			}
+			present = append(present, d)
+		}
+		workDays = present
+	}
+
+	// Minus holidays
+	workDays, err := excludeHolidays(ctx, client, r.config, targetTime, workDays)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plus days with work day events
+	if r.rule.IncludeWorkDayEvents {
+		days, err := r.events.resolveWorkDays(ctx, client, targetTime)
+		if err != nil {
+			return nil, err
+		}
+		workDays = mergeWorkDays(append(workDays, days...))
+	}
+
+	log.Printf("Found %d work days by weekday rule\n", len(workDays))
+	for _, d := range workDays {
+		log.Printf("  %s (%s) %s\n", d.Date.Format("2006-01-02"), d.Date.Format("Mon"), d.Source)
+	}
+
+	return workDays, nil
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"google.golang.org/api/docs/v1"
+)
+
+// Marks the paragraph of work report templates replaced with an entry for
+// each work day, which is the date in bold followed by what was done
+const workReportPlaceholder = "work_report"
+
+// workReportEntry is the entry of a work day in the work report
+type workReportEntry struct {
+	date time.Time
+	text string
+}
+
+// Returns the entries of the work days, having the event descriptions or
+// else defaultEntry. Days without either have only the date.
+func getWorkReportEntries(workDays []WorkDay, defaultEntry string) []workReportEntry {
+	entries := make([]workReportEntry, 0, len(workDays))
+	for _, d := range workDays {
+		text := d.description()
+		if text == "" {
+			text = defaultEntry
+		}
+		entries = append(entries, workReportEntry{date: d.Date, text: text})
+	}
+	return entries
+}
+
+// Returns the length of s in the UTF-16 code units Docs indexes count
+func docsTextLength(s string) int64 {
+	return int64(len(utf16.Encode([]rune(s))))
+}
+
+// Replaces the marker paragraph of the document with the entries. The text
+// is inserted at once at the marker, and the dates are made bold by their
+// offsets from it.
+func fillWorkReport(dcs *docs.Service, docID string, entries []workReportEntry) error {
+	doc, err := getDocument(dcs, docID)
+	if err != nil {
+		return err
+	}
+	var marker *docs.StructuralElement
+	for _, e := range doc.Body.Content {
+		if e.Paragraph != nil && strings.TrimSpace(getElementsText([]*docs.StructuralElement{e})) == "{{"+workReportPlaceholder+"}}" {
+			marker = e
+			break
+		}
+	}
+	if marker == nil {
+		return fmt.Errorf("no paragraph of {{%s}} in the document", workReportPlaceholder)
+	}
+
+	var b strings.Builder
+	dates := make([]*docs.Range, 0, len(entries))
+	offset := int64(0)
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteString("\n")
+			offset++
+		}
+		date := e.date.Format("2006/01/02") + " (" + defaultWeekdayNames[e.date.Weekday()] + ")"
+		dates = append(dates, &docs.Range{StartIndex: marker.StartIndex + offset, EndIndex: marker.StartIndex + offset + docsTextLength(date)})
+		b.WriteString(date)
+		offset += docsTextLength(date)
+		if e.text != "" {
+			b.WriteString("\n" + e.text)
+			offset += 1 + docsTextLength(e.text)
+		}
+	}
+
+	// The newline ending the marker paragraph is kept
+	requests := []*docs.Request{{
+		DeleteContentRange: &docs.DeleteContentRangeRequest{
+			Range: &docs.Range{StartIndex: marker.StartIndex, EndIndex: marker.EndIndex - 1},
+		},
+	}}
+	if b.Len() > 0 {
+		requests = append(requests, &docs.Request{
+			InsertText: &docs.InsertTextRequest{
+				Text:     b.String(),
+				Location: &docs.Location{Index: marker.StartIndex},
+			},
+		})
+		// The inserted text takes the style of the marker, which may be bold
+		requests = append(requests, &docs.Request{
+			UpdateTextStyle: &docs.UpdateTextStyleRequest{
+				Range:     &docs.Range{StartIndex: marker.StartIndex, EndIndex: marker.StartIndex + offset},
+				TextStyle: &docs.TextStyle{Bold: false, ForceSendFields: []string{"Bold"}},
+				Fields:    "bold",
+			},
+		})
+	}
+	for _, r := range dates {
+		requests = append(requests, &docs.Request{
+			UpdateTextStyle: &docs.UpdateTextStyleRequest{
+				Range:     r,
+				TextStyle: &docs.TextStyle{Bold: true},
+				Fields:    "bold",
+			},
+		})
+	}
+	if err := batchUpdateDocument(dcs, docID, requests); err != nil {
+		return fmt.Errorf("failed to write work report: %v", err)
+	}
+	return nil
+}
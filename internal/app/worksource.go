@@ -0,0 +1,267 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// workCSVRecord is a row of a work CSV
+type workCSVRecord struct {
+	start time.Time
+	end   time.Time
+}
+
+// Reads the records of the CSV in loc. Every malformed row is reported with
+// its line number.
+func readWorkCSV(c *WorkCSVConfig, d []byte, loc *time.Location) ([]workCSVRecord, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header: %v", err)
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	columns := map[string]string{"date": c.Columns.Date, "start": c.Columns.Start, "end": c.Columns.End, "tags": c.Columns.Tags}
+	for name, title := range columns {
+		if _, ok := index[title]; title != "" && !ok {
+			return nil, fmt.Errorf("no column %q for %s in the header", title, name)
+		}
+	}
+	tags := make(map[string]bool)
+	for _, t := range c.Tags {
+		tags[t] = true
+	}
+
+	records := make([]workCSVRecord, 0)
+	problems := make([]string, 0)
+	// Lines are counted from the header, as exported CSVs have no line
+	// breaks in the values
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(title string) string {
+			if i := index[title]; i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		if strings.Join(row, "") == "" {
+			continue
+		}
+		if len(tags) > 0 && !hasWorkCSVTag(get(c.Columns.Tags), tags) {
+			continue
+		}
+		date, err := time.ParseInLocation(c.GetDateFormat(), get(c.Columns.Date), loc)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: date: %v", line, err))
+			continue
+		}
+		start, err := parseWorkCSVTime(date, get(c.Columns.Start), c.GetTimeFormat())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: start: %v", line, err))
+			continue
+		}
+		end, err := parseWorkCSVTime(date, get(c.Columns.End), c.GetTimeFormat())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: end: %v", line, err))
+			continue
+		}
+		if end.Before(start) {
+			end = end.AddDate(0, 0, 1)
+		}
+		records = append(records, workCSVRecord{start: start, end: end})
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%d malformed rows:\n%s", len(problems), strings.Join(problems, "\n"))
+	}
+	return records, nil
+}
+
+// Returns the time of the day of date
+func parseWorkCSVTime(date time.Time, value, format string) (time.Time, error) {
+	t, err := time.Parse(format, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(), t.Hour(), t.Minute(), t.Second(), 0, date.Location()), nil
+}
+
+func hasWorkCSVTag(value string, tags map[string]bool) bool {
+	for _, t := range strings.Split(value, ",") {
+		if tags[strings.TrimSpace(t)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Aggregates the records in the billing period by day, from the earliest
+// start to the latest end, with the hours of the records summed
+func aggregateWorkCSVRecords(records []workCSVRecord, period billingPeriod) []WorkDay {
+	days := make([]WorkDay, 0)
+	index := make(map[string]int)
+	for _, rec := range records {
+		if !period.contains(rec.start) {
+			continue
+		}
+		key := rec.start.Format("2006-01-02")
+		i, ok := index[key]
+		if !ok {
+			i = len(days)
+			index[key] = i
+			days = append(days, WorkDay{
+				Date:   time.Date(rec.start.Year(), rec.start.Month(), rec.start.Day(), 0, 0, 0, 0, rec.start.Location()),
+				Start:  rec.start,
+				End:    rec.end,
+				Source: "csv",
+			})
+		}
+		d := &days[i]
+		if rec.start.Before(d.Start) {
+			d.Start = rec.start
+		}
+		if rec.end.After(d.End) {
+			d.End = rec.end
+		}
+		d.Worked += rec.end.Sub(rec.start)
+		d.records++
+	}
+	// Sorted like work days from calendars
+	return mergeWorkDays(days)
+}
+
+// csvWorkDayResolver finds work days in the work CSV. The result is shared
+// by every spreadsheet using it.
+type csvWorkDayResolver struct {
+	config   *Config
+	workDays []WorkDay
+	resolved bool
+}
+
+func (r *csvWorkDayResolver) resolveWorkDays(ctx context.Context, client *http.Client, targetTime time.Time) ([]WorkDay, error) {
+	if r.resolved {
+		return r.workDays, nil
+	}
+
+	c := r.config.WorkCSV
+	d, err := ioutil.ReadFile(resolveConfigPath(c.Path))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read work CSV: %v", err)
+	}
+	records, err := readWorkCSV(c, d, targetTime.Location())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read work CSV %s: %v", c.Path, err)
+	}
+	period := getBillingPeriod(r.config, targetTime)
+	workDays := aggregateWorkCSVRecords(records, period)
+
+	log.Printf("Found %d work days in %s (%d rows in the file)\n", len(workDays), c.Path, len(records))
+	for _, d := range workDays {
+		log.Printf("  %s (%s) %s-%s %gh (%d rows)\n", d.Date.Format("2006-01-02"), d.Date.Format("Mon"),
+			d.Start.Format("15:04"), d.End.Format("15:04"), d.Worked.Hours(), d.records)
+	}
+
+	r.workDays, r.resolved = workDays, true
+	return workDays, nil
+}
+
+// Returns the resolver of the source
+func newWorkSourceResolver(s *WorkSourceConfig, config *Config) workDayResolver {
+	cc := s.GetConfig(config)
+	switch s.Type {
+	case "csv":
+		return &csvWorkDayResolver{config: cc}
+	case "rule":
+		return &ruleWorkDayResolver{config: cc, rule: s.Rule, events: &calendarWorkDayResolver{config: cc}}
+	}
+	return &calendarWorkDayResolver{config: cc}
+}
+
+// mergedWorkDayResolver finds work days in each of work_sources, in order.
+// With work_source_merge "override", the default, the day of a later
+// source replaces the one of an earlier source on the same date, and with
+// "keep_first" the earlier one is kept. The result is shared by every
+// spreadsheet using it.
+type mergedWorkDayResolver struct {
+	config   *Config
+	workDays []WorkDay
+	resolved bool
+}
+
+func (r *mergedWorkDayResolver) resolveWorkDays(ctx context.Context, client *http.Client, targetTime time.Time) ([]WorkDay, error) {
+	if r.resolved {
+		return r.workDays, nil
+	}
+
+	sources := make([][]WorkDay, 0, len(r.config.WorkSources))
+	for _, s := range r.config.WorkSources {
+		days, err := newWorkSourceResolver(s, r.config).resolveWorkDays(ctx, client, targetTime)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Found %d work days in %s\n", len(days), s)
+		sources = append(sources, days)
+	}
+	override := r.config.WorkSourceMerge != workSourceMergeKeepFirst
+	workDays, duplicates := mergeSourceWorkDays(sources, override)
+	if len(duplicates) > 0 {
+		taken := "last"
+		if !override {
+			taken = "first"
+		}
+		logVerbose("Work days found by several sources, taking the ones of the %s: %s\n", taken, strings.Join(duplicates, ", "))
+	}
+	log.Printf("Found %d work days in %d sources (%d found by several)\n", len(workDays), len(sources), len(duplicates))
+
+	r.workDays, r.resolved = workDays, true
+	return workDays, nil
+}
+
+// Merges the work days of the sources by date, sorted. With override, the
+// day of a later source replaces the one of an earlier source, otherwise
+// the earlier one is kept. Dates found by several sources are returned
+// too.
+func mergeSourceWorkDays(sources [][]WorkDay, override bool) ([]WorkDay, []string) {
+	index := make(map[string]int)
+	merged := make([]WorkDay, 0)
+	duplicates := make([]string, 0)
+	for _, days := range sources {
+		for _, d := range days {
+			key := d.Date.Format("2006-01-02")
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged)
+				merged = append(merged, d)
+				continue
+			}
+			if !containsString(duplicates, key) {
+				duplicates = append(duplicates, key)
+			}
+			if override {
+				merged[i] = d
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Date.Before(merged[j].Date)
+	})
+	sort.Strings(duplicates)
+	return merged, duplicates
+}
@@ -0,0 +1,208 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testWorkCSV = "\xef\xbb\xbfDate,Start,End,Tags\n" +
+	"2024-05-08,10:00:00,12:00:00,client\n" +
+	"2024-05-08,13:00:00,15:30:00,\"client, meeting\"\n" +
+	"\n" +
+	"2024-05-20,22:00:00,02:00:00,client\n" +
+	"2024-05-21,09:00:00,17:00:00,internal\n" +
+	"2024-06-03,09:00:00,17:00:00,client\n"
+
+// Writes the work CSV to a temporary directory, returning its config
+func writeTestWorkCSV(t *testing.T, content string) *WorkCSVConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "work.csv")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &WorkCSVConfig{
+		Path:    path,
+		Columns: WorkCSVColumns{Date: "Date", Start: "Start", End: "End", Tags: "Tags"},
+		Tags:    []string{"client"},
+	}
+}
+
+// Returns the dates of the days with their sources, like
+// "2024-05-07 calendar event"
+func workDaySources(days []WorkDay) []string {
+	got := make([]string, 0, len(days))
+	for _, d := range days {
+		got = append(got, d.Date.Format("2006-01-02")+" "+d.Source)
+	}
+	return got
+}
+
+func TestReadWorkCSV(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	c := writeTestWorkCSV(t, testWorkCSV)
+	records, err := readWorkCSV(c, []byte(testWorkCSV), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, r := range records {
+		got = append(got, r.start.Format("01-02 15:04")+"/"+r.end.Format("01-02 15:04"))
+	}
+	// Rows of other tags are left out, and ends before the start are on the
+	// next day
+	want := []string{"05-08 10:00/05-08 12:00", "05-08 13:00/05-08 15:30", "05-20 22:00/05-21 02:00", "06-03 09:00/06-03 17:00"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	broken := "Date,Start,End,Tags\n2024-05-08,10:00:00,12:00:00,client\n2024/05/09,10:00:00,12:00:00,client\n2024-05-10,10:00,12:00:00,client\n"
+	if _, err := readWorkCSV(c, []byte(broken), loc); err == nil || !strings.Contains(err.Error(), "2 malformed rows") ||
+		!strings.Contains(err.Error(), "line 3: date") || !strings.Contains(err.Error(), "line 4: start") {
+		t.Errorf("malformed rows: got %v", err)
+	}
+	if _, err := readWorkCSV(c, []byte("Day,Start,End,Tags\n"), loc); err == nil || !strings.Contains(err.Error(), `no column "Date" for date`) {
+		t.Errorf("missing column: got %v", err)
+	}
+}
+
+func TestAggregateWorkCSVRecords(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Tokyo")
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 5, day, hour, min, 0, 0, loc)
+	}
+	records := []workCSVRecord{
+		{start: at(20, 22, 0), end: at(21, 2, 0)},
+		{start: at(8, 13, 0), end: at(8, 15, 30)},
+		{start: at(8, 10, 0), end: at(8, 12, 0)},
+		{start: at(31, 23, 0), end: at(32, 1, 0)},
+		{start: at(32, 9, 0), end: at(32, 17, 0)},
+	}
+	period := billingPeriod{start: at(1, 0, 0), end: at(32, 0, 0)}
+	days := aggregateWorkCSVRecords(records, period)
+	got := make([]string, 0)
+	for _, d := range days {
+		got = append(got, d.Date.Format("01-02")+" "+d.Start.Format("15:04")+"-"+d.End.Format("15:04")+" "+d.Worked.String()+" "+d.Source)
+	}
+	// Records are of the day they start on, in the period
+	want := []string{"05-08 10:00-15:30 4h30m0s csv", "05-20 22:00-02:00 4h0m0s csv", "05-31 23:00-01:00 2h0m0s csv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if days[0].records != 2 {
+		t.Errorf("records of 05-08: got %d, want 2", days[0].records)
+	}
+}
+
+// Tells the days found by each type of work source of May 2024
+func TestWorkSources(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addEvents("work", "events.json")
+	config, targetTime := setUpTestRun(t)
+
+	ics := filepath.Join(t.TempDir(), "work.ics")
+	if err := ioutil.WriteFile(ics, []byte("BEGIN:VCALENDAR\r\n"+
+		"BEGIN:VEVENT\r\nUID:a\r\nSUMMARY:勤務\r\nDTSTART:20240514T000000Z\r\nDTEND:20240514T090000Z\r\nEND:VEVENT\r\n"+
+		"BEGIN:VEVENT\r\nUID:b\r\nSUMMARY:会議\r\nDTSTART:20240515T000000Z\r\nDTEND:20240515T010000Z\r\nEND:VEVENT\r\n"+
+		"BEGIN:VEVENT\r\nUID:c\r\nSUMMARY:勤務\r\nDTSTART:20240616T000000Z\r\nDTEND:20240616T090000Z\r\nEND:VEVENT\r\n"+
+		"END:VCALENDAR\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		source *WorkSourceConfig
+		want   []string
+	}{
+		{&WorkSourceConfig{Type: "calendar"}, []string{"2024-05-07 calendar event", "2024-05-08 calendar event", "2024-05-09 calendar event", "2024-05-10 calendar event"}},
+		{&WorkSourceConfig{Type: "ics", URL: ics}, []string{"2024-05-14 calendar event"}},
+		{&WorkSourceConfig{Type: "csv", WorkCSV: writeTestWorkCSV(t, testWorkCSV)}, []string{"2024-05-08 csv", "2024-05-20 csv"}},
+		{&WorkSourceConfig{Type: "rule", Rule: &WorkDayRule{Weekdays: []string{"fri"}}}, []string{"2024-05-03 weekday rule", "2024-05-10 weekday rule", "2024-05-17 weekday rule", "2024-05-24 weekday rule", "2024-05-31 weekday rule"}},
+	} {
+		days, err := newWorkSourceResolver(test.source, config).resolveWorkDays(context.Background(), f.client(context.Background()), targetTime)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if got := workDaySources(days); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestMergeSourceWorkDays(t *testing.T) {
+	day := func(d int, source string) WorkDay {
+		return WorkDay{Date: time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC), Source: source}
+	}
+	sources := [][]WorkDay{
+		{day(9, "a"), day(7, "a"), day(8, "a")},
+		{day(8, "b"), day(20, "b")},
+		{day(3, "c"), day(8, "c"), day(9, "c")},
+	}
+
+	for _, test := range []struct {
+		override bool
+		want     []string
+	}{
+		{true, []string{"2024-05-03 c", "2024-05-07 a", "2024-05-08 c", "2024-05-09 c", "2024-05-20 b"}},
+		{false, []string{"2024-05-03 c", "2024-05-07 a", "2024-05-08 a", "2024-05-09 a", "2024-05-20 b"}},
+	} {
+		merged, duplicates := mergeSourceWorkDays(sources, test.override)
+		if got := workDaySources(merged); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("override %v: got %v, want %v", test.override, got, test.want)
+		}
+		if want := []string{"2024-05-08", "2024-05-09"}; !reflect.DeepEqual(duplicates, want) {
+			t.Errorf("override %v: got duplicates %v, want %v", test.override, duplicates, want)
+		}
+	}
+
+	if merged, duplicates := mergeSourceWorkDays(nil, true); len(merged) != 0 || len(duplicates) != 0 {
+		t.Errorf("no sources: got %v, %v", merged, duplicates)
+	}
+}
+
+// Tells the days of work_sources merged by work_source_merge, with the days
+// of the sources overlapping on 05-08 and 05-10
+func TestMergedWorkDayResolver(t *testing.T) {
+	for merge, want := range map[string][]string{
+		"": {"2024-05-03 weekday rule", "2024-05-07 calendar event", "2024-05-08 csv", "2024-05-09 calendar event",
+			"2024-05-10 weekday rule", "2024-05-17 weekday rule", "2024-05-20 csv", "2024-05-24 weekday rule", "2024-05-31 weekday rule"},
+		workSourceMergeKeepFirst: {"2024-05-03 weekday rule", "2024-05-07 calendar event", "2024-05-08 calendar event", "2024-05-09 calendar event",
+			"2024-05-10 calendar event", "2024-05-17 weekday rule", "2024-05-20 csv", "2024-05-24 weekday rule", "2024-05-31 weekday rule"},
+	} {
+		merge, want := merge, want
+		t.Run("merge "+merge, func(t *testing.T) {
+			f := newFakeAPI(t)
+			f.addEvents("work", "events.json")
+			config, targetTime := setUpTestRun(t)
+			config.WorkSource = "merge"
+			config.WorkSourceMerge = merge
+			config.WorkSources = []*WorkSourceConfig{
+				{Type: "calendar"},
+				{Type: "csv", WorkCSV: writeTestWorkCSV(t, testWorkCSV)},
+				{Type: "rule", Rule: &WorkDayRule{Weekdays: []string{"fri"}}},
+			}
+			if err := config.ValidateWorkSources(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := &mergedWorkDayResolver{config: config}
+			days, err := r.resolveWorkDays(context.Background(), f.client(context.Background()), targetTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := workDaySources(days); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			// The day of the source taken is kept whole
+			for _, d := range days {
+				if d.Date.Day() == 8 && d.Source == "csv" && (d.Start.Format("15:04") != "10:00" || d.Worked != 4*time.Hour+30*time.Minute) {
+					t.Errorf("got 05-08 from %s-%s worked %s, want the one of the csv", d.Start.Format("15:04"), d.End.Format("15:04"), d.Worked)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,1182 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/export"
+	"github.com/tsujio/make-invoices/internal/timesheet"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/sheets/v4"
+)
+
+// workSpreadsheet is the writing of the work of the month to a spreadsheet,
+// with what each step finds for the ones after it
+type workSpreadsheet struct {
+	sht       *sheets.Service
+	drv       *drive.Service
+	dcs       *docs.Service
+	gml       *gmail.Service
+	client    *http.Client
+	sc        *SpreadsheetConfig
+	config    *Config
+	backup    *Backup
+	files     *reservedFiles
+	logger    *log.Logger
+	progress  *spreadsheetError
+	workDays  []WorkDay
+	leaveDays []WorkDay
+	holidays  map[string]string
+
+	targetTime time.Time
+	// Sheets are read and written in the sandbox copy, while the state and
+	// the outputs are of the spreadsheet
+	spreadsheetID string
+	sheetsID      string
+	spreadsheet   *sheets.Spreadsheet
+
+	// Outputs reserved
+	formats              []*export.Format
+	pdfOptions           *PDFOptions
+	revision             int
+	fileNames            []string
+	outputPaths          map[string]string
+	documents            []*InvoiceDocumentConfig
+	documentPDFFileNames map[string]string
+	weeks                []weekSheet
+	weekFileNames        []string
+	clientBundle         string
+
+	// The sheet of the month, which is copied from copyFrom unless found.
+	// SheetId 0 is a valid ID, so whether it was found is tracked
+	// separately.
+	sheetTitle    string
+	targetSheet   *sheets.Sheet
+	targetSheetID int64
+	found         bool
+	created       bool
+	copyFrom      *sheets.Sheet
+	templateSheet *sheets.Sheet
+	// The spreadsheet without the template sheet
+	monthSpreadsheet *sheets.Spreadsheet
+	skippedColumns   map[string]string
+
+	// Cells written and the values of them
+	cellWriter        *valueWriter
+	sheetLoc          *time.Location
+	period            billingPeriod
+	rowCount          int
+	dateCell          string
+	columns           []dayColumn
+	columnRuns        map[string][]timesheet.Run
+	billing           *BillingConfig
+	tax               *TaxConfig
+	cur               *currency
+	breaks            *breakPolicy
+	amountCell        string
+	summaryCells      []summaryCell
+	invoiceNumberCell string
+	invoiceNumber     string
+	revisionCell      string
+	rev               *invoiceRevision
+	ranges            []string
+	rangePatterns     map[string]*regexp.Regexp
+	rows              []dayRow
+	amount            *billingAmount
+	record            *spreadsheetRecord
+	data              []*sheets.ValueRange
+	previous          [][][]interface{}
+	diffs             []cellDiff
+
+	// Values of the documents
+	invoicePlaceholders map[string]string
+	workTable           [][]string
+	workReport          []workReportEntry
+}
+
+func processWorkSpreadsheet(sht *sheets.Service, drv *drive.Service, dcs *docs.Service, gml *gmail.Service, client *http.Client, sc *SpreadsheetConfig, targetTime time.Time, workDays, leaveDays []WorkDay, holidays map[string]string, config *Config, backup *Backup, files *reservedFiles, logger *log.Logger, progress *spreadsheetError) error {
+	w := &workSpreadsheet{
+		sht:           sht,
+		drv:           drv,
+		dcs:           dcs,
+		gml:           gml,
+		client:        client,
+		sc:            sc,
+		config:        config,
+		backup:        backup,
+		files:         files,
+		logger:        logger,
+		progress:      progress,
+		workDays:      workDays,
+		leaveDays:     leaveDays,
+		holidays:      holidays,
+		targetTime:    targetTime,
+		spreadsheetID: sc.ID,
+		sheetsID:      sc.ID,
+	}
+	if sc.SandboxID != "" {
+		w.sheetsID = sc.SandboxID
+	}
+
+	// Nothing is written before all the checks pass
+	for _, step := range []func() error{
+		w.getSpreadsheet,
+		w.reserveOutputs,
+		w.locateSheet,
+		w.checkTemplate,
+		w.prepareSheet,
+		w.resolveCells,
+		w.assignInvoiceNumber,
+		w.buildValues,
+		w.checkHistory,
+		w.checkValues,
+		w.checkNonWorkingDays,
+		w.checkDocuments,
+		w.reserveClientBundle,
+	} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		w.logDryRun()
+		return applyRetention(sht, w.monthSpreadsheet, targetTime, config, logger)
+	}
+
+	for _, step := range []func() error{w.writeValues, w.export, w.writeWeekSheets} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	// Runs writing only the values export nothing, so the week sheets
+	// above are the last to write
+	if writeOnly {
+		return nil
+	}
+	for _, step := range []func() error{w.makeDocuments, w.lockSheet} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	progress.setStep("apply retention")
+	// Old month sheets are cleaned up only after a successful run
+	return applyRetention(sht, w.monthSpreadsheet, targetTime, config, logger)
+}
+
+// Returns the sheet of which the layout is written to: the sheet of the
+// month, or the source of it, whose copy has the same layout
+func (w *workSpreadsheet) layoutSheet() *sheets.Sheet {
+	if w.found {
+		return w.targetSheet
+	}
+	return w.copyFrom
+}
+
+func (w *workSpreadsheet) getSpreadsheet() error {
+	spreadsheet, err := getSpreadsheet(w.sht, w.sheetsID, spreadsheetRunFields)
+	if err != nil {
+		return fmt.Errorf("failed to get spreadsheet: %v", err)
+	}
+	w.logger.SetPrefix("[" + spreadsheet.Properties.Title + "] ")
+	w.progress.title = spreadsheet.Properties.Title
+
+	// Copies of month sheets left by interrupted runs are never used
+	w.progress.setStep("clean up orphans")
+	w.spreadsheet, err = cleanUpOrphanedCopies(w.sht, w.sheetsID, spreadsheet, w.targetTime.Location(), w.config, w.logger)
+	return err
+}
+
+// Reserves the output files, failing before writing anything if another
+// spreadsheet has the same one
+func (w *workSpreadsheet) reserveOutputs() error {
+	w.progress.setStep("check outputs")
+	config, sc, files := w.config, w.sc, w.files
+	var err error
+	if w.formats, err = getExportFormats(config, sc); err != nil {
+		return err
+	}
+	if w.pdfOptions, err = getPDFOptions(config, sc); err != nil {
+		return err
+	}
+	// Revisions are numbered after the ones made before
+	if revise {
+		if w.revision, err = getNextRevision(w.spreadsheetID, w.targetTime); err != nil {
+			return err
+		}
+		w.logger.Printf("Making revision %d of the invoice\n", w.revision)
+	}
+	title := w.spreadsheet.Properties.Title
+	stem := w.targetTime.Format("200601") + title + revisionSuffix(w.revision)
+	if w.fileNames, w.outputPaths, err = reserveFormatOutputs(stem, w.spreadsheetID, w.formats, files, config, w.logger); err != nil {
+		return err
+	}
+	if w.documents, err = config.GetDocuments(sc); err != nil {
+		return err
+	}
+	w.documentPDFFileNames = make(map[string]string)
+	for _, dc := range w.documents {
+		name := files.safeFileName(stem, "."+dc.Key+".pdf")
+		if name != stem+"."+dc.Key+".pdf" {
+			w.logger.Printf("Writing %s as %s\n", stem+"."+dc.Key+".pdf", name)
+		}
+		reserved, err := files.reserveOutput(name, w.spreadsheetID, config.OnExistingOutput, w.logger)
+		if err != nil {
+			return err
+		}
+		w.documentPDFFileNames[dc.Key] = reserved
+		w.outputPaths[dc.Key+"_pdf"] = name
+		if reserved != "" {
+			w.outputPaths[dc.Key+"_pdf"] = reserved
+		}
+	}
+	if sc.Period == weeklyPeriod {
+		w.weeks = getWeekSheets(getBillingPeriod(config.ForSpreadsheet(sc), w.targetTime), w.targetTime, sc.IncludeOutOfMonthDays)
+		if w.weekFileNames, err = reserveWeekOutputs(w.weeks, w.spreadsheetID, title+revisionSuffix(w.revision), files, config, w.logger); err != nil {
+			return err
+		}
+	}
+	return checkEmailAttachments(sc, w.outputPaths, config)
+}
+
+// Finds the sheet of the month, or the sheet to copy it from. Titles are
+// matched by month, e.g. "2024年5月" for 202405.
+func (w *workSpreadsheet) locateSheet() error {
+	w.progress.setStep("locate sheet")
+	sc, spreadsheet := w.sc, w.spreadsheet
+	w.sheetTitle = w.config.FormatSheetTitle(w.targetTime)
+	// The template sheet is left out of the month sheets, so that it is
+	// only ever copied
+	w.monthSpreadsheet = spreadsheet
+	if sc.TemplateSheet != "" {
+		for _, s := range spreadsheet.Sheets {
+			if s.Properties.Title == sc.TemplateSheet {
+				w.templateSheet = s
+			}
+		}
+		if w.templateSheet == nil {
+			return fmt.Errorf("no template sheet %s in the spreadsheet", sc.TemplateSheet)
+		}
+		if sc.TemplateSheet == w.sheetTitle {
+			return fmt.Errorf("template sheet %s has the title of the sheet of the month", sc.TemplateSheet)
+		}
+		w.monthSpreadsheet = timesheet.WithoutSheet(spreadsheet, sc.TemplateSheet)
+	}
+	months, err := timesheet.MonthSheets(w.monthSpreadsheet, w.targetTime.Location())
+	if err != nil {
+		return err
+	}
+	if s, ok := months[w.targetTime.Format("200601")]; ok {
+		w.sheetTitle = s.Properties.Title
+		w.targetSheet = s
+		w.targetSheetID = s.Properties.SheetId
+		w.found = true
+		return nil
+	}
+	if w.templateSheet != nil {
+		w.copyFrom = w.templateSheet
+		return nil
+	}
+	w.copyFrom, err = findCopySourceSheet(w.monthSpreadsheet, w.targetTime, w.config)
+	if err != nil && sc.GIDHint != nil {
+		for _, s := range spreadsheet.Sheets {
+			if s.Properties.SheetId == *sc.GIDHint {
+				w.logger.Printf("Using sheet %s of the spreadsheet URL as the copy source\n", s.Properties.Title)
+				w.copyFrom, err = s, nil
+			}
+		}
+	}
+	return err
+}
+
+// Checks that the layout is the one values are written for. Optional
+// columns missing in the template are not written.
+func (w *workSpreadsheet) checkTemplate() error {
+	w.progress.setStep("check template")
+	logger := w.logger
+	w.skippedColumns = make(map[string]string)
+	if !skipTemplateCheck {
+		checkedTitle := w.sheetTitle
+		if !w.found {
+			checkedTitle = w.copyFrom.Properties.Title
+		}
+		check, err := checkTemplateAnchors(w.sht, w.sheetsID, checkedTitle, w.config)
+		if err != nil {
+			return err
+		}
+		if len(check.mismatches) > 0 {
+			logger.Printf("Template of sheet %s does not match (use --skip-template-check to write anyway):\n", checkedTitle)
+			for _, m := range check.mismatches {
+				logger.Printf("  %s\n", m)
+			}
+			return fmt.Errorf("unexpected template in sheet %s", checkedTitle)
+		}
+		if len(check.skippedColumns) > 0 {
+			logWarnf(logger, "Warning: template of sheet %s has no optional columns %s, not writing them\n", checkedTitle, check.formatSkipped())
+		}
+		w.skippedColumns = check.skippedColumns
+	}
+	// The layout is also compared with the one of the last successful run,
+	// as edits keeping the anchors may still move the cells written
+	layoutSheet := w.layoutSheet()
+	fingerprint, err := getTemplateFingerprint(w.sht, w.sheetsID, layoutSheet, w.config)
+	if err != nil {
+		return err
+	}
+	if changes := compareTemplateFingerprint(w.spreadsheetID, fingerprint); len(changes) > 0 {
+		logWarnf(logger, "WARNING: the template of sheet %s changed since the last successful run, check the configured ranges:\n", layoutSheet.Properties.Title)
+		for _, c := range changes {
+			logWarnf(logger, "  %s\n", c)
+		}
+		if strictTemplate {
+			return fmt.Errorf("template of sheet %s changed (%d changes)", layoutSheet.Properties.Title, len(changes))
+		}
+	}
+	w.files.mu.Lock()
+	w.files.fingerprints[w.spreadsheetID] = fingerprint
+	w.files.mu.Unlock()
+	return nil
+}
+
+// Unlocks the sheet of the month or creates it, and marks it and keeps the
+// sheets in order as configured
+func (w *workSpreadsheet) prepareSheet() error {
+	sht, sheetsID, sheetTitle, config, logger := w.sht, w.sheetsID, w.sheetTitle, w.config, w.logger
+	// A sheet locked by a previous run is written again only with --force
+	if w.found {
+		own, others := getSheetProtections(w.targetSheet)
+		if len(others) > 0 {
+			return fmt.Errorf("sheet %s is protected by others: %s", sheetTitle, strings.Join(others, ", "))
+		}
+		if len(own) > 0 {
+			if !force {
+				return fmt.Errorf("sheet %s was locked after export (use --force to write anyway)", sheetTitle)
+			}
+			if dryRun {
+				logger.Printf("Sheet %s would be unlocked\n", sheetTitle)
+			} else {
+				logger.Printf("Unlocking sheet %s\n", sheetTitle)
+				if err := unprotectSheet(sht, sheetsID, own); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if !w.found && dryRun {
+		source := "the latest month sheet"
+		if w.copyFrom == w.templateSheet {
+			source = "the template sheet"
+		}
+		logger.Printf("Sheet %s would be created from %s (%s)\n", sheetTitle, w.copyFrom.Properties.Title, source)
+	} else if !w.found {
+		// Copy from the template or latest sheet if target sheet not found
+		w.progress.setStep("copy sheet")
+		logAt(logger, levelInfo, []logAttr{{"sheet", sheetTitle}, {"source_sheet", w.copyFrom.Properties.Title}}, "Creating sheet %s from %s\n", sheetTitle, w.copyFrom.Properties.Title)
+		var err error
+		w.targetSheetID, w.created, err = createMonthSheet(sht, sheetsID, w.copyFrom, sheetTitle)
+		if err != nil {
+			return err
+		}
+		if !w.created {
+			logger.Printf("Sheet %s was created by someone else meanwhile, using it\n", sheetTitle)
+		}
+		// The lock of the source sheet is copied along with it
+		if own, _ := getSheetProtections(w.copyFrom); w.created && len(own) > 0 {
+			own, err := getOwnProtections(sht, sheetsID, w.targetSheetID)
+			if err != nil {
+				return err
+			}
+			if err := unprotectSheet(sht, sheetsID, own); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Mark the sheet as generated with the tab color, which a duplicated
+	// sheet has taken over from its source
+	if config.TabColor != "" && (!w.found || config.TabColorExistingSheets) {
+		color, err := parseHexColor(config.TabColor)
+		if err != nil {
+			return fmt.Errorf("failed to parse tab_color: %v", err)
+		}
+		if !isTabColor(w.layoutSheet().Properties, color) {
+			if dryRun {
+				logger.Printf("Tab color of sheet %s would be set to %s\n", sheetTitle, config.TabColor)
+			} else {
+				sheetID := w.targetSheetID
+				w.files.deferUpdate(&deferredUpdate{
+					title:  w.spreadsheet.Properties.Title,
+					name:   "tab color of sheet " + sheetTitle,
+					update: func() error { return setTabColor(sht, sheetsID, sheetID, color) },
+					logger: logger,
+				})
+			}
+		}
+	}
+
+	// Keep month sheets in order, as a new sheet is inserted first
+	if dryRun {
+		return sortSheets(sht, sheetsID, config, logger)
+	}
+	if config.SheetOrder != "" && config.SheetOrder != "none" {
+		w.files.deferUpdate(&deferredUpdate{
+			title:  w.spreadsheet.Properties.Title,
+			name:   "order of the sheets",
+			update: func() error { return sortSheets(sht, sheetsID, config, logger) },
+			logger: logger,
+		})
+	}
+	return nil
+}
+
+// Resolves the cells written and how values are written to them
+func (w *workSpreadsheet) resolveCells() error {
+	config, sc, spreadsheet, logger := w.config, w.sc, w.spreadsheet, w.logger
+	// Values are written for the locale of the spreadsheet
+	w.cellWriter = newValueWriter(config.ValueWriteMode, spreadsheet.Properties.Locale)
+	logVerbose("Writing values of spreadsheet locale %q by %s\n", w.cellWriter.locale, w.cellWriter.mode)
+
+	// Times are written in the spreadsheet's timezone
+	w.sheetLoc = w.targetTime.Location()
+	if spreadsheet.Properties.TimeZone != "" {
+		if loc, err := time.LoadLocation(spreadsheet.Properties.TimeZone); err == nil {
+			w.sheetLoc = loc
+		}
+	}
+
+	// Day columns get a row for each day of the billing period. The rows
+	// after the last day are cleared only when they are known to belong to
+	// the tool.
+	w.period = getBillingPeriod(config.ForSpreadsheet(sc), w.targetTime)
+	if !w.period.isMonth() {
+		logger.Printf("Billing period: %s\n", w.period)
+	}
+	w.rowCount = w.period.days()
+	if config.ClearUnusedRows {
+		w.rowCount = 31
+	}
+	// Named ranges are located on the target sheet by their position
+	var err error
+	if w.dateCell, err = timesheet.ResolveA1Range(config.GetDateCell(), spreadsheet.NamedRanges); err != nil {
+		return fmt.Errorf("failed to resolve date cell: %v", err)
+	}
+	// The date cell tells the month of an existing sheet, unless it is a
+	// formula, with which date_cell_month_warning_only only warns
+	if w.found {
+		w.progress.setStep("check month")
+		if err := checkSheetMonth(w.sht, w.sheetsID, w.sheetTitle, w.dateCell, w.period, w.targetTime); err != nil {
+			if !config.DateCellMonthWarningOnly {
+				return err
+			}
+			logWarnf(logger, "Warning: %v\n", err)
+		}
+	}
+	if w.columns, w.columnRuns, err = getColumnRuns(config, spreadsheet.NamedRanges, w.rowCount, w.skippedColumns); err != nil {
+		return err
+	}
+	if dryRun {
+		names := make([]string, 0, len(w.columns))
+		for _, c := range w.columns {
+			names = append(names, c.name)
+		}
+		logger.Printf("Columns would be written: %s\n", strings.Join(names, ", "))
+	}
+
+	w.billing, w.tax = config.GetBilling(sc), config.GetTax(sc)
+	if w.billing == nil && w.tax != nil {
+		return fmt.Errorf("tax is set but billing is not configured")
+	}
+	if w.billing == nil && config.Summary != nil && config.Summary.HasAmountCells() {
+		return fmt.Errorf("amount cells are set in summary but billing is not configured")
+	}
+	if w.cur, err = getCurrency(config, sc); err != nil {
+		return err
+	}
+	if sc.AmountCell != "" {
+		if w.billing == nil && sc.AmountFormula == "" {
+			return fmt.Errorf("amount_cell is set but billing is not configured")
+		}
+		if w.amountCell, err = timesheet.ResolveA1Range(sc.AmountCell, spreadsheet.NamedRanges); err != nil {
+			return fmt.Errorf("failed to resolve amount_cell: %v", err)
+		}
+	}
+	if w.breaks, err = getBreakPolicy(config, sc); err != nil {
+		return err
+	}
+	w.summaryCells = getSummaryCells(config, w.period, w.billing, w.tax, w.cur, w.breaks)
+	for i, c := range w.summaryCells {
+		cell, err := timesheet.ResolveA1Range(c.cell, spreadsheet.NamedRanges)
+		if err != nil {
+			return fmt.Errorf("failed to resolve cell of %s: %v", c.name, err)
+		}
+		w.summaryCells[i].cell = cell
+	}
+	if config.InvoiceNumberCell != "" {
+		if w.invoiceNumberCell, err = timesheet.ResolveA1Range(config.InvoiceNumberCell, spreadsheet.NamedRanges); err != nil {
+			return fmt.Errorf("failed to resolve invoice number cell: %v", err)
+		}
+	}
+	// The revision cell is cleared in runs other than revisions
+	if rc := config.GetRevision(sc); rc.Cell != "" {
+		if w.revisionCell, err = timesheet.ResolveA1Range(rc.Cell, spreadsheet.NamedRanges); err != nil {
+			return fmt.Errorf("failed to resolve revision cell: %v", err)
+		}
+	}
+	return nil
+}
+
+// Assigns the invoice number, which is kept for the month once assigned.
+// Numbers are assigned when written to the sheet or to the invoice
+// document.
+func (w *workSpreadsheet) assignInvoiceNumber() error {
+	config, logger := w.config, w.logger
+	rc := config.GetRevision(w.sc)
+	if w.revision > 0 {
+		w.rev = &invoiceRevision{number: w.revision}
+	}
+	var err error
+	if (config.InvoiceNumberCell != "" || len(w.documents) > 0) && w.rev != nil {
+		w.invoiceNumber, w.rev.originalNumber, err = assignRevisionNumber(w.spreadsheetID, w.targetTime, w.revision, rc, config)
+		if err != nil {
+			return fmt.Errorf("failed to assign invoice number: %v", err)
+		}
+		logger.Printf("Invoice number: %s (revision of %s)\n", w.invoiceNumber, w.rev.originalNumber)
+	} else if config.InvoiceNumberCell != "" || len(w.documents) > 0 {
+		w.invoiceNumber, err = assignInvoiceNumber(w.spreadsheetID, w.targetTime, config, func() (int, error) {
+			if !config.InvoiceNumberFromSheet || w.invoiceNumberCell == "" {
+				return 0, nil
+			}
+			// Continue from the number of the previous month sheet
+			prev, err := findCopySourceSheet(w.monthSpreadsheet, w.targetTime, config)
+			if err != nil {
+				return 0, nil
+			}
+			values, err := getRenderedRangeValues(w.sht, w.sheetsID, prev.Properties.Title, []string{w.invoiceNumberCell}, "FORMATTED_VALUE")
+			if err != nil {
+				return 0, err
+			}
+			n, ok := parseInvoiceSeq(cellString(values[0], 0, 0))
+			if !ok {
+				return 0, fmt.Errorf("no invoice number in %s!%s", prev.Properties.Title, w.invoiceNumberCell)
+			}
+			logger.Printf("Continuing invoice numbers from %d in sheet %s\n", n, prev.Properties.Title)
+			return n, nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to assign invoice number: %v", err)
+		}
+		logger.Printf("Invoice number: %s\n", w.invoiceNumber)
+	}
+	if w.rev != nil {
+		w.rev.text = w.rev.getText(rc)
+	}
+	return nil
+}
+
+// Builds the rows of the days, the amount billed, and the values written
+func (w *workSpreadsheet) buildValues() error {
+	w.progress.setStep("build values")
+	config, sc, files, logger := w.config, w.sc, w.files, w.logger
+	w.ranges = []string{w.dateCell}
+	w.rangePatterns = make(map[string]*regexp.Regexp)
+	for _, c := range w.columns {
+		for _, run := range w.columnRuns[c.name] {
+			w.ranges = append(w.ranges, run.Range)
+			if p, ok := dayColumnPatterns[c.name]; ok {
+				if c.name == "work times" {
+					p = getWorkTimesPattern(config)
+				}
+				w.rangePatterns[run.Range] = p
+			}
+		}
+	}
+	for _, c := range w.summaryCells {
+		w.ranges = append(w.ranges, c.cell)
+	}
+	for _, cell := range []string{w.invoiceNumberCell, w.revisionCell, w.amountCell} {
+		if cell != "" {
+			w.ranges = append(w.ranges, cell)
+		}
+	}
+	// A copied sheet has the size of its source
+	grid := w.layoutSheet().Properties.GridProperties
+	if err := timesheet.ValidateRanges(w.ranges, grid); err != nil {
+		return fmt.Errorf("invalid ranges to write: %v", err)
+	}
+	if sc.PrintRange != "" {
+		if err := checkPrintRange(sc.PrintRange, grid); err != nil {
+			return err
+		}
+	}
+	w.rows = buildDayRows(w.period, w.rowCount, w.workDays, w.leaveDays, w.holidays, config, w.breaks, w.sheetLoc)
+	if len(config.EventKinds) > 0 {
+		logger.Printf("Work days by kind: %s\n", countEventKinds(w.rows, config.EventKinds))
+	}
+	var err error
+	if w.billing != nil {
+		w.amount, err = computeBilling(w.billing, w.rows, w.period, w.breaks, config.EventKinds, w.tax, w.cur)
+		if err != nil {
+			return fmt.Errorf("failed to compute billing: %v", err)
+		}
+		logger.Printf("Billing %s %s, subtotal %s, total %s\n", w.amount.Quantity, w.amount.RateUnit, w.cur.format(w.amount.Subtotal), w.cur.format(w.amount.Total))
+		files.mu.Lock()
+		files.billing[w.spreadsheetID] = w.amount
+		files.mu.Unlock()
+	}
+	if getDailyCSV(config) != nil {
+		records, err := getDailyRecords(w.spreadsheetID, w.spreadsheet.Properties.Title, w.rows, w.period, w.breaks, w.billing, config.EventKinds, w.cur)
+		if err != nil {
+			return fmt.Errorf("failed to get daily records: %v", err)
+		}
+		files.mu.Lock()
+		files.daily[w.spreadsheetID] = records
+		files.mu.Unlock()
+	}
+	totalHours, err := sumWorkHours(w.rows, w.breaks)
+	if err != nil {
+		return err
+	}
+	w.record = &spreadsheetRecord{
+		title:         w.spreadsheet.Properties.Title,
+		workDays:      len(w.workDays),
+		hours:         totalHours,
+		invoiceNumber: w.invoiceNumber,
+		createdSheet:  w.created,
+	}
+	if w.rev != nil {
+		w.record.revision, w.record.revisionOf = w.rev.number, w.rev.originalNumber
+	}
+	files.mu.Lock()
+	files.records[w.spreadsheetID] = w.record
+	files.mu.Unlock()
+	return w.buildData()
+}
+
+// Builds the values of the ranges, in the order of them
+func (w *workSpreadsheet) buildData() error {
+	sheetTitle, cellWriter, rows := w.sheetTitle, w.cellWriter, w.rows
+	w.data = []*sheets.ValueRange{timesheet.CellValue(sheetTitle, w.dateCell, cellWriter.date(w.period.start))}
+	for _, c := range w.columns {
+		for _, run := range w.columnRuns[c.name] {
+			w.data = append(w.data, timesheet.RunValues(sheetTitle, run, func(day int) interface{} {
+				// Cells of sparse columns are left as they are on days
+				// without values (nil values are skipped by the API)
+				if v := c.value(rows[day]); v != "" || !sparseDayColumns[c.name] {
+					return cellWriter.cell(c.name, v)
+				}
+				return nil
+			}))
+		}
+	}
+	// Totals are written in the same batch so that they agree with the rows
+	for _, c := range w.summaryCells {
+		v, err := c.value(rows)
+		if err != nil {
+			return fmt.Errorf("failed to compute %s: %v", c.name, err)
+		}
+		w.data = append(w.data, timesheet.CellValue(sheetTitle, c.cell, cellWriter.cell(c.name, v)))
+	}
+	if w.invoiceNumberCell != "" {
+		w.data = append(w.data, timesheet.CellValue(sheetTitle, w.invoiceNumberCell, w.invoiceNumber))
+	}
+	if w.revisionCell != "" {
+		text := ""
+		if w.rev != nil {
+			text = w.rev.text
+		}
+		w.data = append(w.data, timesheet.CellValue(sheetTitle, w.revisionCell, text))
+	}
+	// The amount is the subtotal of the invoice documents, written as a
+	// number so that the sheet formats it
+	if w.amountCell != "" {
+		var v interface{} = w.sc.AmountFormula
+		if w.sc.AmountFormula == "" {
+			v = parseSummaryNumber(w.cur.formatNumber(w.amount.Subtotal))
+		}
+		w.data = append(w.data, timesheet.CellValue(sheetTitle, w.amountCell, v))
+	}
+	return nil
+}
+
+// Checks the work against the one of the months before, as work far from it
+// is likely a mistake in the calendar or the config. First runs have
+// nothing to compare with.
+func (w *workSpreadsheet) checkHistory() error {
+	w.progress.setStep("check history")
+	month := w.targetTime.Format("200601")
+	state, err := loadState()
+	if err != nil {
+		return fmt.Errorf("failed to load state: %v", err)
+	}
+	history := getWorkHistory(state, w.spreadsheetID, w.targetTime)
+	hours, _ := strconv.ParseFloat(w.record.hours, 64)
+	anomalies := findWorkAnomalies(monthWork{Month: month, WorkDays: w.record.workDays, Hours: hours}, history, w.config.GetAnomalyThresholdPercent())
+	w.files.mu.Lock()
+	w.files.history[w.spreadsheetID] = history
+	if len(anomalies) > 0 {
+		w.files.anomalies[w.spreadsheetID] = anomalies
+	}
+	w.files.mu.Unlock()
+	if len(anomalies) == 0 {
+		return nil
+	}
+	w.logger.Printf("Work of %s is unusual compared with the months before:\n", month)
+	for _, a := range anomalies {
+		w.logger.Printf("  %s\n", a)
+	}
+	// Unattended runs go on, with the anomalies in the notification
+	if !dryRun && !unattended && !confirm(w.logger, msg("confirm_anomaly")) {
+		return fmt.Errorf("work of %s is unusual: %s", month, strings.Join(anomalies, "; "))
+	}
+	return nil
+}
+
+// Compares the values with the ones in the sheet, which are the ones of the
+// copy source for a sheet not created yet. Values not written by the tool
+// are changed only when forced or confirmed.
+func (w *workSpreadsheet) checkValues() error {
+	w.progress.setStep("check values")
+	sheetTitle, ranges, logger := w.sheetTitle, w.ranges, w.logger
+	readTitle := sheetTitle
+	if !w.found && dryRun {
+		readTitle = w.copyFrom.Properties.Title
+	}
+	var err error
+	if w.previous, err = getRangeValues(w.sht, w.sheetsID, readTitle, ranges); err != nil {
+		return err
+	}
+	if !force || dryRun || verbose {
+		formatted, err := getRenderedRangeValues(w.sht, w.sheetsID, readTitle, ranges, "FORMATTED_VALUE")
+		if err != nil {
+			return err
+		}
+		values := make([][][]interface{}, 0, len(w.data))
+		for _, vr := range w.data {
+			values = append(values, vr.Values)
+		}
+		if w.diffs, err = diffRangeValues(ranges, w.previous, formatted, values); err != nil {
+			return err
+		}
+		switch {
+		case !w.found && dryRun:
+			// The sheet is previewed as the copy of the source written
+			grid, err := newSheetGrid(ranges, w.previous, formatted, values)
+			if err != nil {
+				return err
+			}
+			if err := grid.apply(ranges, values); err != nil {
+				return err
+			}
+			logNewSheetDiffs(logger, sheetTitle, w.copyFrom.Properties.Title, w.diffs, countCells(values), grid)
+		case dryRun || verbose:
+			logCellDiffs(logger, sheetTitle, w.diffs, countCells(values))
+		}
+	}
+
+	// A new sheet may have leftovers of the template in the cells to write,
+	// which are overwritten only when confirmed
+	if !w.found && !force {
+		if unexpected := findUnexpectedCells(w.diffs, w.rangePatterns); len(unexpected) > 0 {
+			logger.Printf("Sheet %s has values not written by the tool which would be overwritten:\n", sheetTitle)
+			for _, d := range unexpected {
+				if strings.HasPrefix(d.Current, "=") {
+					logger.Printf("  %s (formula!)\n", d)
+				} else {
+					logger.Printf("  %s\n", d)
+				}
+			}
+			if !dryRun && !confirm(logger, msg("confirm_overwrite")) {
+				return fmt.Errorf("sheet %s has %d values not written by the tool (use --force to overwrite)", sheetTitle, len(unexpected))
+			}
+		}
+	}
+
+	// Refuse to change values already in the sheet, e.g. corrections made
+	// by hand, unless forced. Rewriting the same values is fine.
+	if w.found && !force {
+		changed := make([]cellDiff, 0)
+		for _, d := range w.diffs {
+			if d.Current != "" {
+				changed = append(changed, d)
+			}
+		}
+		if len(changed) > 0 {
+			logger.Printf("Sheet %s already has values which would be changed (use --force to overwrite):\n", sheetTitle)
+			for _, d := range changed {
+				logger.Printf("  %s\n", d)
+			}
+			return fmt.Errorf("sheet %s already has %d values which would be changed", sheetTitle, len(changed))
+		}
+	}
+	return nil
+}
+
+// Checks for work days on days the sheet marks as non-working, which are
+// likely mistakes in the calendar. A sheet not created yet has the marks of
+// the copy source, which are of another month.
+func (w *workSpreadsheet) checkNonWorkingDays() error {
+	c := w.config.NonWorkingDays
+	if c == nil {
+		return nil
+	}
+	if !w.found {
+		logVerbose("Not checking non-working days of sheet %s, which is not created yet\n", w.sheetTitle)
+		return nil
+	}
+	w.progress.setStep("check non-working days")
+	var markerRuns []timesheet.Run
+	if c.MarkerRange != "" {
+		rng, err := timesheet.ResolveA1Range(c.MarkerRange, w.spreadsheet.NamedRanges)
+		if err != nil {
+			return fmt.Errorf("failed to resolve marker_range: %v", err)
+		}
+		if w.config.RowLayout != nil {
+			var dayRows []int
+			if dayRows, err = w.config.RowLayout.Resolve(w.rowCount); err == nil {
+				markerRuns, err = timesheet.DayRuns(rng, dayRows)
+			}
+		} else {
+			rng, err = timesheet.ResizeA1Range(rng, w.rowCount)
+			markerRuns = []timesheet.Run{{Range: rng, First: 0, Count: w.rowCount}}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse marker_range: %v", err)
+		}
+	}
+	conflicts, err := findWorkOnNonWorkingDays(w.sht, w.sheetsID, w.sheetTitle, w.columnRuns["work times"], markerRuns, w.period, w.workDays, c)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	w.logger.Printf("Sheet %s marks work days as non-working:\n", w.sheetTitle)
+	for _, d := range conflicts {
+		w.logger.Printf("  %s\n", d)
+	}
+	if !dryRun && !confirm(w.logger, msg("confirm_non_working_days")) {
+		return fmt.Errorf("%d work days are marked as non-working in sheet %s", len(conflicts), w.sheetTitle)
+	}
+	return nil
+}
+
+// Computes the values of the documents, which are made from the same rows
+// as the sheet, and checks the templates with them
+func (w *workSpreadsheet) checkDocuments() error {
+	w.progress.setStep("check documents")
+	if len(w.documents) == 0 {
+		return nil
+	}
+	config, sc := w.config, w.sc
+	dates, err := getInvoiceDates(config, sc, w.targetTime, time.Now())
+	if err != nil {
+		return err
+	}
+	w.invoicePlaceholders, err = getInvoicePlaceholders(w.targetTime, w.period, w.rows, w.invoiceNumber, w.amount, dates, config.GetClient(sc), sc.DocumentData, w.breaks, w.rev)
+	if err != nil {
+		return fmt.Errorf("failed to compute invoice values: %v", err)
+	}
+	if w.workTable, err = getWorkTableRows(w.period, w.rows, w.breaks); err != nil {
+		return fmt.Errorf("failed to compute work table: %v", err)
+	}
+	if sc.ReportDocument != nil {
+		w.workReport = getWorkReportEntries(w.workDays, sc.ReportDocument.DefaultEntry)
+	}
+	for _, dc := range w.documents {
+		if dc.Local {
+			_, err = executeLocalTemplate(dc, getLocalTemplateData(w.invoicePlaceholders, w.workTable))
+		} else {
+			err = checkTemplatePlaceholders(w.dcs, dc, w.invoicePlaceholders, getDocumentPlaceholders(config, sc, dc))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reserves the bundle, which is named by the invoice number and so is
+// reserved after the other outputs
+func (w *workSpreadsheet) reserveClientBundle() error {
+	var err error
+	w.clientBundle, err = reserveClientBundle(w.spreadsheetID, w.spreadsheet.Properties.Title, w.invoiceNumber, w.revision, w.targetTime, w.files, w.config, w.logger)
+	if err != nil {
+		return err
+	}
+	if w.clientBundle != "" {
+		w.outputPaths["zip"] = w.clientBundle
+	}
+	return nil
+}
+
+// Logs what a run which is not dry would make
+func (w *workSpreadsheet) logDryRun() {
+	logger := w.logger
+	if w.clientBundle != "" {
+		logger.Printf("Bundle %s would be made\n", w.clientBundle)
+	}
+	types := make([]string, 0)
+	for _, d := range w.config.GetDeliveries(w.sc) {
+		types = append(types, d.Type)
+	}
+	logger.Printf("Outputs would be delivered by %s\n", strings.Join(types, ", "))
+	if w.invoicePlaceholders != nil {
+		keys := make([]string, 0, len(w.documents))
+		for _, dc := range w.documents {
+			keys = append(keys, dc.Key)
+		}
+		logger.Printf("Documents %s would be made with:\n", strings.Join(keys, ", "))
+		logInvoicePlaceholders(logger, w.invoicePlaceholders)
+		logger.Printf("  {{%s}} -> %d rows\n", workTablePlaceholder, len(w.workTable))
+		if w.workReport != nil {
+			logger.Printf("  {{%s}} -> %d entries\n", workReportPlaceholder, len(w.workReport))
+		}
+	}
+	for _, wk := range w.weeks {
+		logger.Printf("Week sheet %s would be written (%s to %s)\n", wk.title, wk.period.start.Format("01/02"), wk.period.end.AddDate(0, 0, -1).Format("01/02"))
+	}
+}
+
+// Backs up the values to be overwritten, writes the values at once and
+// checks that the sheet took them
+func (w *workSpreadsheet) writeValues() error {
+	sht, sheetsID, sheetTitle, ranges, logger := w.sht, w.sheetsID, w.sheetTitle, w.ranges, w.logger
+	backup := w.backup
+	sheetBackup := &SheetBackup{
+		SpreadsheetID: sheetsID,
+		SheetID:       w.targetSheetID,
+		SheetTitle:    sheetTitle,
+		Created:       w.created,
+	}
+	if w.sc.SandboxID != "" {
+		sheetBackup.SourceSpreadsheetID = w.spreadsheetID
+	}
+	for i, values := range w.previous {
+		sheetBackup.Ranges = append(sheetBackup.Ranges, &RangeBackup{
+			Range:    ranges[i],
+			Previous: values,
+			Values:   w.data[i].Values,
+		})
+	}
+	backup.mu.Lock()
+	backup.Sheets = append(backup.Sheets, sheetBackup)
+	backup.mu.Unlock()
+	if err := saveBackup(backup); err != nil {
+		return err
+	}
+
+	w.progress.setStep("write values")
+	if err := checkSheetUnchanged(sht, sheetsID, w.targetSheetID, sheetTitle); err != nil {
+		return err
+	}
+	// Update date, work times and totals at once
+	start := time.Now()
+	if err := callAPI("update values", func(ctx context.Context) error {
+		return newSheetReaderWriter(sht).UpdateValues(ctx, sheetsID, w.data)
+	}); err != nil {
+		return fmt.Errorf("failed to set values to sheet (%s): %v", strings.Join(ranges, ", "), err)
+	}
+	logAt(logger, levelInfo, []logAttr{{"sheet", sheetTitle}, {"range", ranges}, {"duration_ms", time.Since(start).Milliseconds()}},
+		"Wrote %d ranges of sheet %s\n", len(ranges), sheetTitle)
+	if w.amountCell != "" && w.sc.AmountNumberFormat != "" {
+		if err := setCurrencyFormat(sht, sheetsID, w.targetSheetID, w.amountCell, w.sc.AmountNumberFormat); err != nil {
+			return fmt.Errorf("failed to format amount_cell: %v", err)
+		}
+	}
+	if w.cellWriter.mode == valueWriteRawSerial {
+		serialRanges := map[string][]string{"date": {w.dateCell}}
+		for _, c := range w.columns {
+			if valueKinds[c.name] == "time" {
+				for _, run := range w.columnRuns[c.name] {
+					serialRanges["time"] = append(serialRanges["time"], run.Range)
+				}
+			}
+		}
+		if err := formatSerialCells(sht, sheetsID, sheetTitle, w.targetSheetID, serialRanges, logger); err != nil {
+			return err
+		}
+	}
+
+	// Record written values to detect later edits on rollback
+	written, err := getRangeValues(sht, sheetsID, sheetTitle, ranges)
+	if err != nil {
+		return err
+	}
+	backup.mu.Lock()
+	for i, values := range written {
+		sheetBackup.Ranges[i].Written = values
+	}
+	backup.mu.Unlock()
+	if err := saveBackup(backup); err != nil {
+		return err
+	}
+
+	// A value the sheet didn't take would make a wrong pdf, so nothing is
+	// exported then
+	if noVerify {
+		return nil
+	}
+	w.progress.setStep("verify values")
+	unwritten, err := verifyWrittenValues(sht, sheetsID, sheetTitle, ranges, written, w.data)
+	if err != nil {
+		return err
+	}
+	if len(unwritten) > 0 {
+		logger.Printf("Sheet %s doesn't have the values written (rejected by its data validation or protection?):\n", sheetTitle)
+		for _, d := range unwritten {
+			logger.Printf("  %s: %q, written %q\n", d.Cell, d.Current, d.New)
+		}
+		return fmt.Errorf("%d cells of sheet %s don't have the values written, not exporting (use --no-verify to export anyway)", len(unwritten), sheetTitle)
+	}
+	return nil
+}
+
+// Exports the sheet to the output files
+func (w *workSpreadsheet) export() error {
+	w.progress.setStep("export")
+	files := w.files
+	for i, f := range w.formats {
+		if w.fileNames[i] == "" {
+			continue
+		}
+		if err := exportSheet(w.drv, w.sht, w.client, w.spreadsheet, w.targetSheetID, f, w.fileNames[i], w.pdfOptions, w.config, w.logger); err != nil {
+			return err
+		}
+		n := len(w.workDays)
+		sheetID := w.targetSheetID
+		files.mu.Lock()
+		files.written = append(files.written, &outputFile{path: w.fileNames[i], title: w.spreadsheet.Properties.Title, spreadsheetID: w.spreadsheetID, sheetID: &sheetID, workDays: &n})
+		files.mu.Unlock()
+	}
+	files.mu.Lock()
+	files.pdfs[w.spreadsheetID] = w.outputPaths["pdf"]
+	files.mu.Unlock()
+	return nil
+}
+
+// Writes and exports the week sheets of weekly spreadsheets
+func (w *workSpreadsheet) writeWeekSheets() error {
+	if len(w.weeks) == 0 {
+		return nil
+	}
+	w.progress.setStep("write week sheets")
+	layout := &weekLayout{
+		dateCell:     w.dateCell,
+		columns:      w.columns,
+		columnRuns:   w.columnRuns,
+		rowCount:     w.rowCount,
+		summaryCells: w.summaryCells,
+		breaks:       w.breaks,
+		values:       w.cellWriter,
+	}
+	for _, cell := range []string{w.invoiceNumberCell, w.revisionCell, w.amountCell} {
+		if cell != "" {
+			layout.monthCells = append(layout.monthCells, cell)
+		}
+	}
+	monthSheet := &sheets.Sheet{Properties: &sheets.SheetProperties{SheetId: w.targetSheetID, Title: w.sheetTitle}}
+	outOfMonth := getOutOfMonthDays(w.sc)
+	weekWorkDays := append(append([]WorkDay{}, w.workDays...), outOfMonth.workDays...)
+	weekLeaveDays := append(append([]WorkDay{}, w.leaveDays...), outOfMonth.leaveDays...)
+	return writeWeekSheets(w.sht, w.drv, w.client, w.sheetsID, w.spreadsheetID, monthSheet, w.weeks, w.weekFileNames, layout, weekWorkDays, weekLeaveDays, w.holidays, w.sheetLoc, w.pdfOptions, w.config, w.backup, w.files, w.logger)
+}
+
+// Makes the documents from the templates and the bundle, and delivers the
+// outputs
+func (w *workSpreadsheet) makeDocuments() error {
+	config, files, logger, title := w.config, w.files, w.logger, w.spreadsheet.Properties.Title
+	// The pdf is uploaded by drive_upload, and so are the document pdfs
+	// with upload_pdf after it
+	uploads := make([]driveUpload, 0)
+	for i, f := range w.formats {
+		if f.Name == "pdf" && w.fileNames[i] != "" {
+			uploads = append(uploads, driveUpload{path: w.fileNames[i]})
+		}
+	}
+
+	w.progress.setStep("make documents")
+	for _, dc := range w.documents {
+		fileName := w.documentPDFFileNames[dc.Key]
+		// The timesheets are kept even if the document pdf fails
+		if dc.Local {
+			if fileName != "" {
+				if err := renderLocalPDF(dc, getLocalTemplateData(w.invoicePlaceholders, w.workTable), config.InvoiceFontPath, config.InvoiceFontIndex, fileName); err != nil {
+					return fmt.Errorf("failed to render document %s (the timesheets were exported): %v", dc.Key, err)
+				}
+				logger.Printf("Rendered %s document %s\n", dc.Key, fileName)
+			}
+		} else {
+			doc, err := createInvoiceDocument(w.drv, w.dcs, w.spreadsheetID, title, w.targetTime, w.revision, w.invoicePlaceholders, w.workTable, w.workReport, dc, logger)
+			if err != nil {
+				return err
+			}
+			logger.Printf("Made %s document %s: %s\n", dc.Key, doc.Name, doc.WebViewLink)
+			files.mu.Lock()
+			files.documents = append(files.documents, fmt.Sprintf("%s: %s (%s)", doc.Name, doc.Id, doc.WebViewLink))
+			files.mu.Unlock()
+			if fileName != "" {
+				if err := exportDocumentPDF(w.drv, doc.Id, fileName, logger); err != nil {
+					return fmt.Errorf("failed to export document %s to pdf (the timesheets were exported): %v", doc.Name, err)
+				}
+			}
+		}
+
+		if fileName != "" {
+			n := len(w.workDays)
+			files.mu.Lock()
+			files.written = append(files.written, &outputFile{path: fileName, title: title, spreadsheetID: w.spreadsheetID, workDays: &n})
+			files.mu.Unlock()
+			if dc.UploadPDF {
+				uploads = append(uploads, driveUpload{path: fileName, kind: dc.Key})
+			}
+		}
+		if dc.IncludeInCombinedPDF {
+			files.mu.Lock()
+			files.invoicePDFs[w.spreadsheetID] = append(files.invoicePDFs[w.spreadsheetID], w.outputPaths[dc.Key+"_pdf"])
+			files.mu.Unlock()
+		}
+	}
+
+	w.progress.setStep("make bundle")
+	if err := makeClientBundle(w.spreadsheetID, title, w.targetTime, w.clientBundle, w.outputPaths, w.weekFileNames, config, files, logger); err != nil {
+		return err
+	}
+
+	delivery := &deliveryOutputs{
+		spreadsheetID: w.spreadsheetID,
+		title:         title,
+		invoiceNumber: w.invoiceNumber,
+		revision:      w.revision,
+		targetTime:    w.targetTime,
+		period:        w.period,
+		workDays:      len(w.workDays),
+		amount:        w.amount,
+		client:        config.GetClient(w.sc),
+		uploads:       uploads,
+		clientBundle:  w.clientBundle,
+		outputPaths:   w.outputPaths,
+	}
+	return deliverOutputs(w.drv, w.gml, w.sc, delivery, w.fileNames, config, files, w.record, logger, w.progress)
+}
+
+// Locks the sheet so that it keeps agreeing with the pdf
+func (w *workSpreadsheet) lockSheet() error {
+	w.progress.setStep("lock sheet")
+	if !w.config.ProtectAfterExport {
+		return nil
+	}
+	if err := protectSheet(w.sht, w.sheetsID, w.targetSheetID, w.config.ProtectionWarningOnly); err != nil {
+		return err
+	}
+	w.logger.Printf("Locked sheet %s\n", w.sheetTitle)
+	return nil
+}
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/docs/v1"
+)
+
+// Marks where the table of work days goes in document templates. In a
+// table cell, the rows of work days are written from the row of the marker,
+// adding or deleting rows to fit. As a paragraph, it is replaced with a new
+// table having a header row.
+const workTablePlaceholder = "work_table"
+
+var workTableHeader = []string{"日付", "曜日", "開始", "終了", "時間", "備考"}
+
+// Returns a row of date, weekday, start, end, hours and note for each work
+// day of the billing period
+func getWorkTableRows(period billingPeriod, rows []dayRow, breaks *breakPolicy) ([][]string, error) {
+	table := make([][]string, 0)
+	for i, r := range rows {
+		weekday := r.Weekday
+		r.Weekday = ""
+		if r == (dayRow{}) || r.onLeave {
+			continue
+		}
+		date := period.day(i)
+		hours := ""
+		if r.Start != "" && r.End != "" {
+			start, err := parseClock(r.Start)
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseClock(r.End)
+			if err != nil {
+				return nil, err
+			}
+			d, _ := breaks.workDuration(start, end)
+			hours = strconv.FormatFloat(d.Hours(), 'f', -1, 64)
+		}
+		note := r.Note
+		if r.DayNote != "" {
+			note = strings.TrimSpace(note + " " + r.DayNote)
+		}
+		table = append(table, []string{date.Format("2006/01/02"), weekday, r.Start, r.End, hours, note})
+	}
+	return table, nil
+}
+
+// Returns the text of the structural elements
+func getElementsText(content []*docs.StructuralElement) string {
+	var b strings.Builder
+	for _, e := range content {
+		if e.Paragraph == nil {
+			continue
+		}
+		for _, pe := range e.Paragraph.Elements {
+			if pe.TextRun != nil {
+				b.WriteString(pe.TextRun.Content)
+			}
+		}
+	}
+	return b.String()
+}
+
+func isWorkTableMarker(content []*docs.StructuralElement) bool {
+	return strings.TrimSpace(getElementsText(content)) == "{{"+workTablePlaceholder+"}}"
+}
+
+// Finds the table having the marker in a cell and the row of the marker
+func findWorkTable(doc *docs.Document) (*docs.StructuralElement, int) {
+	for _, e := range doc.Body.Content {
+		if e.Table == nil {
+			continue
+		}
+		for i, row := range e.Table.TableRows {
+			for _, cell := range row.TableCells {
+				if isWorkTableMarker(cell.Content) {
+					return e, i
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+func getDocument(dcs *docs.Service, docID string) (*docs.Document, error) {
+	var doc *docs.Document
+	if err := callAPI("get document", func(ctx context.Context) (err error) {
+		doc, err = dcs.Documents.Get(docID).Context(ctx).Do()
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get document: %v", err)
+	}
+	return doc, nil
+}
+
+func batchUpdateDocument(dcs *docs.Service, docID string, requests []*docs.Request) error {
+	if len(requests) == 0 {
+		return nil
+	}
+	return callAPI("update document", func(ctx context.Context) error {
+		_, err := dcs.Documents.BatchUpdate(docID, &docs.BatchUpdateDocumentRequest{
+			Requests: requests,
+		}).Context(ctx).Do()
+		return err
+	})
+}
+
+// Writes the rows of work days to the table marked in the document. The
+// table is first resized, then its cells are filled with the indexes read
+// again, so that only the cells written change the indexes.
+func fillWorkTable(dcs *docs.Service, docID string, rows [][]string) error {
+	doc, err := getDocument(dcs, docID)
+	if err != nil {
+		return err
+	}
+
+	table, first := findWorkTable(doc)
+	if table == nil {
+		return insertWorkTable(dcs, doc, rows)
+	}
+	available := len(table.Table.TableRows) - first
+	requests := make([]*docs.Request, 0)
+	if first == 0 && len(rows) == 0 {
+		// No rows would be left
+		requests = append(requests, &docs.Request{
+			DeleteContentRange: &docs.DeleteContentRangeRequest{
+				Range: &docs.Range{StartIndex: table.StartIndex, EndIndex: table.EndIndex},
+			},
+		})
+		return batchUpdateDocument(dcs, docID, requests)
+	}
+	// Rows added below the last one get its style
+	for i := available; i < len(rows); i++ {
+		requests = append(requests, &docs.Request{
+			InsertTableRow: &docs.InsertTableRowRequest{
+				TableCellLocation: &docs.TableCellLocation{
+					TableStartLocation: &docs.Location{Index: table.StartIndex},
+					RowIndex:           int64(len(table.Table.TableRows) - 1),
+				},
+				InsertBelow: true,
+			},
+		})
+	}
+	// Surplus rows are deleted from the bottom so that row indexes of the
+	// ones above stay the same
+	for i := len(table.Table.TableRows) - 1; i >= first+len(rows); i-- {
+		requests = append(requests, &docs.Request{
+			DeleteTableRow: &docs.DeleteTableRowRequest{
+				TableCellLocation: &docs.TableCellLocation{
+					TableStartLocation: &docs.Location{Index: table.StartIndex},
+					RowIndex:           int64(i),
+				},
+			},
+		})
+	}
+	if err := batchUpdateDocument(dcs, docID, requests); err != nil {
+		return fmt.Errorf("failed to resize work table: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if doc, err = getDocument(dcs, docID); err != nil {
+		return err
+	}
+	if table, first = findWorkTable(doc); table == nil {
+		return fmt.Errorf("work table disappeared while resizing it")
+	}
+	return batchUpdateDocument(dcs, docID, getTableCellRequests(table.Table, first, rows))
+}
+
+// Replaces the marker paragraph with a table having the header row and the
+// rows of work days
+func insertWorkTable(dcs *docs.Service, doc *docs.Document, rows [][]string) error {
+	var marker *docs.StructuralElement
+	for _, e := range doc.Body.Content {
+		if e.Paragraph != nil && isWorkTableMarker([]*docs.StructuralElement{e}) {
+			marker = e
+			break
+		}
+	}
+	if marker == nil {
+		return nil
+	}
+	// The newline ending the paragraph is kept
+	requests := []*docs.Request{{
+		DeleteContentRange: &docs.DeleteContentRangeRequest{
+			Range: &docs.Range{StartIndex: marker.StartIndex, EndIndex: marker.EndIndex - 1},
+		},
+	}}
+	if len(rows) > 0 {
+		requests = append(requests, &docs.Request{
+			InsertTable: &docs.InsertTableRequest{
+				Rows:     int64(len(rows) + 1),
+				Columns:  int64(len(workTableHeader)),
+				Location: &docs.Location{Index: marker.StartIndex},
+			},
+		})
+	}
+	if err := batchUpdateDocument(dcs, doc.DocumentId, requests); err != nil {
+		return fmt.Errorf("failed to insert work table: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	doc, err := getDocument(dcs, doc.DocumentId)
+	if err != nil {
+		return err
+	}
+	for _, e := range doc.Body.Content {
+		if e.Table != nil && e.StartIndex >= marker.StartIndex {
+			return batchUpdateDocument(dcs, doc.DocumentId, getTableCellRequests(e.Table, 0, append([][]string{workTableHeader}, rows...)))
+		}
+	}
+	return fmt.Errorf("inserted work table is not found")
+}
+
+// Returns requests replacing the text of the cells from the first row with
+// the rows. They are made from the end of the table backwards, so that
+// each request leaves the indexes of the cells before it as they are.
+func getTableCellRequests(table *docs.Table, first int, rows [][]string) []*docs.Request {
+	requests := make([]*docs.Request, 0)
+	for i := len(rows) - 1; i >= 0; i-- {
+		cells := table.TableRows[first+i].TableCells
+		for j := len(cells) - 1; j >= 0; j-- {
+			content := cells[j].Content
+			if len(content) == 0 {
+				continue
+			}
+			start := content[0].StartIndex
+			// Each cell ends with a newline, which can't be deleted
+			end := content[len(content)-1].EndIndex - 1
+			text := ""
+			if j < len(rows[i]) {
+				text = rows[i][j]
+			}
+			if end > start {
+				requests = append(requests, &docs.Request{
+					DeleteContentRange: &docs.DeleteContentRangeRequest{
+						Range: &docs.Range{StartIndex: start, EndIndex: end},
+					},
+				})
+			}
+			if text != "" {
+				requests = append(requests, &docs.Request{
+					InsertText: &docs.InsertTextRequest{
+						Text:     text,
+						Location: &docs.Location{Index: start},
+					},
+				})
+			}
+		}
+	}
+	return requests
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/docs/v1"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of testdata")
+
+// Characters of the starts of tables, rows and cells and of the ends of
+// tables in the text of a document
+const (
+	testDocTableStart = '\x03'
+	testDocRowStart   = '\x02'
+	testDocCellStart  = '\x01'
+	testDocTableEnd   = '\x04'
+)
+
+// Returns the text of the document at the indexes of Docs, which count the
+// starts of tables, rows and cells and the ends of tables
+func flattenTestDocument(t *testing.T, doc *docs.Document) []rune {
+	t.Helper()
+	content := doc.Body.Content
+	text := make([]rune, content[len(content)-1].EndIndex)
+	var flatten func([]*docs.StructuralElement)
+	flatten = func(content []*docs.StructuralElement) {
+		for _, e := range content {
+			switch {
+			case e.Paragraph != nil:
+				for _, pe := range e.Paragraph.Elements {
+					if pe.TextRun != nil {
+						copy(text[pe.StartIndex:], []rune(pe.TextRun.Content))
+					}
+				}
+			case e.Table != nil:
+				text[e.StartIndex] = testDocTableStart
+				for _, row := range e.Table.TableRows {
+					text[row.StartIndex] = testDocRowStart
+					for _, cell := range row.TableCells {
+						text[cell.StartIndex] = testDocCellStart
+						flatten(cell.Content)
+					}
+				}
+				text[e.EndIndex-1] = testDocTableEnd
+			}
+		}
+	}
+	flatten(content)
+	return text
+}
+
+// Applies the deletions and insertions of text of the requests to the text
+// of a document in order, failing on other requests
+func applyTestDocRequests(t *testing.T, text []rune, requests []*docs.Request) []rune {
+	t.Helper()
+	for _, r := range requests {
+		switch {
+		case r.DeleteContentRange != nil:
+			rng := r.DeleteContentRange.Range
+			if deleted := string(text[rng.StartIndex:rng.EndIndex]); strings.ContainsAny(deleted, "\x01\x02\x03\x04") {
+				t.Fatalf("deletion of %q across cells", deleted)
+			}
+			text = append(text[:rng.StartIndex:rng.StartIndex], text[rng.EndIndex:]...)
+		case r.InsertText != nil:
+			i := r.InsertText.Location.Index
+			if i == 0 || text[i-1] != testDocCellStart && text[i-1] != '\n' {
+				t.Fatalf("insertion of %q inside %q", r.InsertText.Text, string(text[:i]))
+			}
+			text = append(text[:i:i], append([]rune(r.InsertText.Text), text[i:]...)...)
+		default:
+			t.Fatalf("unexpected request %+v", r)
+		}
+	}
+	return text
+}
+
+// Returns the texts of the cells of the first table of the text
+func getTestDocTable(text []rune) [][]string {
+	s := string(text)
+	s = s[strings.IndexRune(s, testDocTableStart)+1 : strings.IndexRune(s, testDocTableEnd)]
+	table := make([][]string, 0)
+	for _, row := range strings.Split(s, string(testDocRowStart))[1:] {
+		cells := make([]string, 0)
+		for _, cell := range strings.Split(row, string(testDocCellStart))[1:] {
+			cells = append(cells, strings.TrimSuffix(cell, "\n"))
+		}
+		table = append(table, cells)
+	}
+	return table
+}
+
+// Tells the requests filling the table of the recorded template, which has
+// a header row, the marker row and two more, with the ones of the golden
+// files, and the table the requests make of the recorded documents
+func TestFillWorkTable(t *testing.T) {
+	days := [][]string{
+		{"2024/05/07", "火", "9:00", "18:00", "8", "客先"},
+		{"2024/05/08", "水", "9:00", "18:00", "8", ""},
+		{"2024/05/09", "木", "10:00", "19:00", "8", "在宅"},
+		{"2024/05/10", "金", "9:00", "18:00", "8", ""},
+		{"2024/05/13", "月", "9:00", "12:00", "3", "午前のみ"},
+	}
+	tests := []struct {
+		name    string
+		rows    int
+		resized string
+	}{
+		{"grown", 5, "document_work_table_grown.json"},
+		{"fit", 3, ""},
+		{"shrunk", 1, "document_work_table_shrunk.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeAPI(t)
+			fixtures := []string{"document_work_table.json"}
+			if tt.resized != "" {
+				fixtures = append(fixtures, tt.resized)
+			}
+			f.addDocuments("invoice-doc", fixtures...)
+			filled := f.documents["invoice-doc"][len(fixtures)-1]
+			ctx := context.Background()
+			dcs, err := docs.NewService(ctx, getServiceOptions(f.client(ctx), "")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fillWorkTable(dcs, "invoice-doc", days[:tt.rows]); err != nil {
+				t.Fatal(err)
+			}
+
+			updates := f.docUpdates["invoice-doc"]
+			got, err := json.MarshalIndent(updates, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			golden := filepath.Join("testdata", "fakeapi", "document_work_table_"+tt.name+".golden.json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("requests differ from %s (go test -run TestFillWorkTable -update to update it):\n%s", golden, got)
+			}
+
+			// The table is resized in the first update, if at all, and
+			// filled in the last
+			if resized := len(updates) == 2; resized != (tt.resized != "") {
+				t.Fatalf("got %d updates", len(updates))
+			}
+			text := applyTestDocRequests(t, flattenTestDocument(t, filled), updates[len(updates)-1])
+			wantTable := [][]string{{"日付", "曜日", "開始", "終了", "時間", "備考"}}
+			wantTable = append(wantTable, days[:tt.rows]...)
+			if got := getTestDocTable(text); !reflect.DeepEqual(got, wantTable) {
+				t.Errorf("got table %q, want %q", got, wantTable)
+			}
+			if !strings.HasPrefix(string(text), "\x00請求書\n{{client_name}} 御中\n") || !strings.HasSuffix(string(text), "\x04合計 {{total_hours}} 時間\n") {
+				t.Errorf("text around the table changed: %q", string(text))
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Package auth keeps the oauth token of the command, refreshed and saved as
+// runs use it.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tsujio/make-invoices/internal/fileutil"
+	"golang.org/x/oauth2"
+)
+
+// TokenStore keeps the oauth token in a file with the scopes granted to it.
+// Writes go through a temporary file renamed into place, and runs take a
+// lock file around reading and writing so that concurrent runs don't
+// interleave.
+type TokenStore struct {
+	path string
+}
+
+// storedToken is the content of the token file
+type storedToken struct {
+	*oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Token files saved before the scopes were recorded have the scopes the tool
+// asked for then
+var legacyTokenScopes = []string{
+	"https://www.googleapis.com/auth/spreadsheets",
+	"https://www.googleapis.com/auth/drive",
+}
+
+// Scopes granting what other scopes do
+var scopeImplies = map[string][]string{
+	"https://www.googleapis.com/auth/spreadsheets":  {"https://www.googleapis.com/auth/spreadsheets.readonly"},
+	"https://www.googleapis.com/auth/drive":         {"https://www.googleapis.com/auth/drive.readonly", "https://www.googleapis.com/auth/drive.file"},
+	"https://www.googleapis.com/auth/calendar":      {"https://www.googleapis.com/auth/calendar.readonly"},
+	"https://www.googleapis.com/auth/documents":     {"https://www.googleapis.com/auth/documents.readonly"},
+	"https://www.googleapis.com/auth/gmail.compose": {"https://www.googleapis.com/auth/gmail.send"},
+}
+
+// Returns the scopes of wanted which granted doesn't cover
+func MissingScopes(granted, wanted []string) []string {
+	has := map[string]bool{}
+	for _, scope := range granted {
+		has[scope] = true
+		for _, implied := range scopeImplies[scope] {
+			has[implied] = true
+		}
+	}
+	var missing []string
+	for _, scope := range wanted {
+		if !has[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// Returns the scopes granted to the token just issued for the requested
+// ones. The server tells them unless they are what was requested, and the
+// user may have left some of them unchecked.
+func GrantedScopes(tok *oauth2.Token, requested []string) []string {
+	if scope, ok := tok.Extra("scope").(string); ok && scope != "" {
+		return strings.Fields(scope)
+	}
+	return requested
+}
+
+// Returns the store of the token file at path
+func NewTokenStore(path string) *TokenStore {
+	return &TokenStore{path: path}
+}
+
+// Takes the lock, waiting for other runs, and returns the function
+// releasing it
+func (s *TokenStore) lock() (func(), error) {
+	return fileutil.AcquireLockFile(s.path+".lock", "token file")
+}
+
+// Returns the saved token and its scopes, or nil if there is none. A file
+// which can't be decoded is kept with the .corrupt suffix and taken as no
+// token.
+func (s *TokenStore) Load() (*oauth2.Token, []string, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+	return s.load()
+}
+
+// Saves the token and its scopes, which are synced to the disk before
+// replacing the file
+func (s *TokenStore) Save(tok *oauth2.Token, scopes []string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.save(tok, scopes)
+}
+
+// Load without the lock
+func (s *TokenStore) load() (*oauth2.Token, []string, error) {
+	d, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read oauth token: %v", err)
+	}
+	st := &storedToken{}
+	if err := json.Unmarshal(d, st); err != nil || st.Token == nil || (st.AccessToken == "" && st.RefreshToken == "") {
+		log.Printf("Oauth token file %s is broken, moving it to %s.corrupt\n", s.path, s.path)
+		if err := os.Rename(s.path, s.path+".corrupt"); err != nil {
+			return nil, nil, fmt.Errorf("failed to move broken oauth token: %v", err)
+		}
+		return nil, nil, nil
+	}
+	if len(st.Scopes) == 0 {
+		st.Scopes = legacyTokenScopes
+	}
+	return st.Token, st.Scopes, nil
+}
+
+// Save without the lock
+func (s *TokenStore) save(tok *oauth2.Token, scopes []string) error {
+	d, err := json.Marshal(&storedToken{Token: tok, Scopes: scopes})
+	if err != nil {
+		return fmt.Errorf("failed to encode oauth token: %v", err)
+	}
+	if err := fileutil.WriteFileAtomic(s.path, d); err != nil {
+		return fmt.Errorf("failed to save oauth token: %v", err)
+	}
+	return nil
+}
+
+// savingTokenSource refreshes the token when it expires, holding the lock of
+// the store from reading the saved token to saving the refreshed one. Runs
+// refreshing at the same time would otherwise both use the refresh token,
+// which the server may rotate, and one of them would save a token of the
+// old one.
+type savingTokenSource struct {
+	ctx    context.Context
+	conf   *oauth2.Config
+	store  *TokenStore
+	scopes []string
+	mu     sync.Mutex
+	tok    *oauth2.Token
+}
+
+// Returns the source of the token, saved to the store with the scopes when
+// refreshed
+func NewSavingTokenSource(ctx context.Context, conf *oauth2.Config, store *TokenStore, scopes []string, tok *oauth2.Token) oauth2.TokenSource {
+	return &savingTokenSource{ctx: ctx, conf: conf, store: store, scopes: scopes, tok: tok}
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok.Valid() {
+		return s.tok, nil
+	}
+	unlock, err := s.store.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	saved, scopes, err := s.store.load()
+	if err != nil {
+		return nil, err
+	}
+	// A token authorized again in the meantime may have other scopes
+	if saved == nil || len(MissingScopes(scopes, s.scopes)) > 0 {
+		saved, scopes = nil, s.scopes
+	}
+	// Another run may have refreshed the token while this one waited
+	if saved.Valid() {
+		s.tok = saved
+		return saved, nil
+	}
+	if saved == nil {
+		saved = s.tok
+	}
+	tok, err := s.conf.TokenSource(s.ctx, saved).Token()
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	// The run goes on with the token even if it can't be saved
+	if err := s.store.save(tok, scopes); err != nil {
+		log.Printf("Failed to save refreshed oauth token: %v\n", err)
+	}
+	return tok, nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Returns the config of a token server issuing access tokens numbered by the
+// requests, and the number of the requests
+func newTestTokenServer(t *testing.T) (*oauth2.Config, *int32) {
+	t.Helper()
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "refreshed-%d", "token_type": "Bearer", "expires_in": 3600}`, n)
+	}))
+	t.Cleanup(srv.Close)
+	conf := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	return conf, &requests
+}
+
+func TestSavingTokenSourceRefresh(t *testing.T) {
+	conf, requests := newTestTokenServer(t)
+	store := NewTokenStore(filepath.Join(t.TempDir(), "token.json"))
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	if err := store.Save(expired, legacyTokenScopes); err != nil {
+		t.Fatal(err)
+	}
+	ts := &savingTokenSource{ctx: context.Background(), conf: conf, store: store, tok: expired}
+	for i := 0; i < 2; i++ {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != "refreshed-1" {
+			t.Errorf("access token = %q, want refreshed-1", tok.AccessToken)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+	saved, scopes, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "refreshed-1" || saved.RefreshToken != "refresh" {
+		t.Errorf("saved token = %q, %q; want refreshed-1 keeping the refresh token", saved.AccessToken, saved.RefreshToken)
+	}
+	if !reflect.DeepEqual(scopes, legacyTokenScopes) {
+		t.Errorf("saved scopes = %v, want %v", scopes, legacyTokenScopes)
+	}
+}
+
+// A token refreshed and saved by another run is used instead of refreshing
+// it again
+func TestSavingTokenSourceRefreshedByAnotherRun(t *testing.T) {
+	conf, requests := newTestTokenServer(t)
+	store := NewTokenStore(filepath.Join(t.TempDir(), "token.json"))
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	ts := &savingTokenSource{ctx: context.Background(), conf: conf, store: store, tok: expired}
+	other := &oauth2.Token{AccessToken: "other", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+	if err := store.Save(other, legacyTokenScopes); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "other" {
+		t.Errorf("access token = %q, want other", tok.AccessToken)
+	}
+	if n := atomic.LoadInt32(requests); n != 0 {
+		t.Errorf("refreshed %d times, want 0", n)
+	}
+}
+
+// Runs refreshing at the same time refresh the token once
+func TestSavingTokenSourceConcurrentRuns(t *testing.T) {
+	conf, requests := newTestTokenServer(t)
+	path := filepath.Join(t.TempDir(), "token.json")
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	if err := NewTokenStore(path).Save(expired, legacyTokenScopes); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		// Every run has its own store and source as separate processes do
+		ts := &savingTokenSource{ctx: context.Background(), conf: conf, store: NewTokenStore(path), tok: expired}
+		go func() {
+			_, err := ts.Token()
+			errs <- err
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+}
+
+func TestTokenStoreScopes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	store := NewTokenStore(path)
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+	scopes := []string{"https://www.googleapis.com/auth/gmail.send"}
+	if err := store.Save(tok, scopes); err != nil {
+		t.Fatal(err)
+	}
+	got, gotScopes, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "access" || got.RefreshToken != "refresh" || !reflect.DeepEqual(gotScopes, scopes) {
+		t.Errorf("Load() = %+v, %v; want the saved token and scopes", got, gotScopes)
+	}
+
+	// Token files of earlier versions have no scopes
+	if err := ioutil.WriteFile(path, []byte(`{"access_token": "access", "refresh_token": "refresh"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, gotScopes, err := store.Load(); err != nil || !reflect.DeepEqual(gotScopes, legacyTokenScopes) {
+		t.Errorf("scopes of a legacy token = %v, %v; want %v", gotScopes, err, legacyTokenScopes)
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	const (
+		sheetsScope   = "https://www.googleapis.com/auth/spreadsheets"
+		sheetsRO      = "https://www.googleapis.com/auth/spreadsheets.readonly"
+		driveScope    = "https://www.googleapis.com/auth/drive"
+		driveRO       = "https://www.googleapis.com/auth/drive.readonly"
+		calendarRO    = "https://www.googleapis.com/auth/calendar.readonly"
+		gmailSend     = "https://www.googleapis.com/auth/gmail.send"
+		gmailCompose  = "https://www.googleapis.com/auth/gmail.compose"
+		documentsRO   = "https://www.googleapis.com/auth/documents.readonly"
+		documentScope = "https://www.googleapis.com/auth/documents"
+	)
+	tests := []struct {
+		name    string
+		granted []string
+		wanted  []string
+		missing []string
+	}{
+		{"same", []string{sheetsScope, driveScope}, []string{sheetsScope, driveScope}, nil},
+		{"readonly of full", []string{sheetsScope, driveScope}, []string{sheetsRO, driveRO}, nil},
+		{"full of readonly", []string{sheetsRO}, []string{sheetsScope}, []string{sheetsScope}},
+		{"calendar", []string{sheetsScope, driveScope}, []string{calendarRO}, []string{calendarRO}},
+		{"send of compose", []string{gmailCompose}, []string{gmailSend}, nil},
+		{"compose of send", []string{gmailSend}, []string{gmailCompose}, []string{gmailCompose}},
+		{"documents", []string{documentScope}, []string{documentsRO, gmailSend}, []string{gmailSend}},
+		{"no token", nil, []string{sheetsScope}, []string{sheetsScope}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MissingScopes(tt.granted, tt.wanted); !reflect.DeepEqual(got, tt.missing) {
+				t.Errorf("MissingScopes() = %v, want %v", got, tt.missing)
+			}
+		})
+	}
+}
+
+// A token saved with other scopes by another run is not used for the scopes
+// of this one
+func TestSavingTokenSourceOtherScopes(t *testing.T) {
+	conf, requests := newTestTokenServer(t)
+	store := NewTokenStore(filepath.Join(t.TempDir(), "token.json"))
+	scopes := []string{"https://www.googleapis.com/auth/gmail.send"}
+	other := &oauth2.Token{AccessToken: "other", RefreshToken: "other", Expiry: time.Now().Add(time.Hour)}
+	if err := store.Save(other, legacyTokenScopes); err != nil {
+		t.Fatal(err)
+	}
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	ts := &savingTokenSource{ctx: context.Background(), conf: conf, store: store, scopes: scopes, tok: expired}
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "refreshed-1" || atomic.LoadInt32(requests) != 1 {
+		t.Errorf("access token = %q, want refreshed-1", tok.AccessToken)
+	}
+	if _, gotScopes, err := store.Load(); err != nil || !reflect.DeepEqual(gotScopes, scopes) {
+		t.Errorf("saved scopes = %v, %v; want %v", gotScopes, err, scopes)
+	}
+}
@@ -0,0 +1,70 @@
+package calendarsource
+
+import (
+	"strings"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// Reasons events are excluded by filters
+const (
+	ExcludedCancelled    = "cancelled"
+	ExcludedDeclined     = "declined"
+	ExcludedNotResponded = "not responded"
+	ExcludedByColor      = "color"
+	ExcludedByAttendee   = "attendee"
+)
+
+// Filter is what events of work days have other than the title: the color
+// and the attendee if not empty, and a response unless it is declined, or
+// not given with SkipNeedsAction
+type Filter struct {
+	ColorID         string
+	AttendeeEmail   string
+	SkipNeedsAction bool
+}
+
+// Returns why the event is excluded, or "" if it passes the filter
+func (f *Filter) Exclusion(e *calendar.Event) string {
+	if reason := SkipReason(e, f.SkipNeedsAction); reason != "" {
+		return reason
+	}
+	if f.ColorID != "" && e.ColorId != f.ColorID {
+		return ExcludedByColor
+	}
+	if f.AttendeeEmail != "" && !HasAttendee(e, f.AttendeeEmail) {
+		return ExcludedByAttendee
+	}
+	return ""
+}
+
+// Returns why an event doesn't count at all, or "" if it does
+func SkipReason(e *calendar.Event, skipNeedsAction bool) string {
+	if e.Status == "cancelled" {
+		return ExcludedCancelled
+	}
+	for _, a := range e.Attendees {
+		if !a.Self {
+			continue
+		}
+		switch a.ResponseStatus {
+		case "declined":
+			return ExcludedDeclined
+		case "needsAction":
+			if skipNeedsAction {
+				return ExcludedNotResponded
+			}
+		}
+	}
+	return ""
+}
+
+// Tells whether the email is one of the attendees of the event
+func HasAttendee(e *calendar.Event, email string) bool {
+	for _, a := range e.Attendees {
+		if strings.EqualFold(a.Email, email) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package calendarsource
+
+import (
+	"testing"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestFilterExclusion(t *testing.T) {
+	self := func(status string) []*calendar.EventAttendee {
+		return []*calendar.EventAttendee{{Email: "me@example.com", Self: true, ResponseStatus: status}}
+	}
+	filter := &Filter{ColorID: "5", AttendeeEmail: "Client@Example.com"}
+	client := &calendar.EventAttendee{Email: "client@example.com", ResponseStatus: "accepted"}
+	tests := []struct {
+		name            string
+		event           *calendar.Event
+		skipNeedsAction bool
+		want            string
+	}{
+		{"matching", &calendar.Event{ColorId: "5", Attendees: append(self("accepted"), client)}, false, ""},
+		{"cancelled", &calendar.Event{Status: "cancelled", ColorId: "5", Attendees: []*calendar.EventAttendee{client}}, false, ExcludedCancelled},
+		{"declined", &calendar.Event{ColorId: "5", Attendees: append(self("declined"), client)}, false, ExcludedDeclined},
+		{"not responded", &calendar.Event{ColorId: "5", Attendees: append(self("needsAction"), client)}, false, ""},
+		{"not responded skipped", &calendar.Event{ColorId: "5", Attendees: append(self("needsAction"), client)}, true, ExcludedNotResponded},
+		{"other color", &calendar.Event{ColorId: "6", Attendees: []*calendar.EventAttendee{client}}, false, ExcludedByColor},
+		{"no attendee", &calendar.Event{ColorId: "5", Attendees: self("accepted")}, false, ExcludedByAttendee},
+		// Responses of the other attendees don't matter
+		{"declined by other", &calendar.Event{ColorId: "5", Attendees: []*calendar.EventAttendee{{Email: "client@example.com", ResponseStatus: "declined"}}}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := *filter
+			f.SkipNeedsAction = tt.skipNeedsAction
+			if got := f.Exclusion(tt.event); got != tt.want {
+				t.Errorf("Exclusion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Filters with nothing set exclude only events not counting at all
+func TestFilterExclusionEmpty(t *testing.T) {
+	f := &Filter{}
+	if got := f.Exclusion(&calendar.Event{ColorId: "3"}); got != "" {
+		t.Errorf("Exclusion() = %q, want none", got)
+	}
+	if got := f.Exclusion(&calendar.Event{Status: "cancelled"}); got != ExcludedCancelled {
+		t.Errorf("Exclusion() = %q, want %q", got, ExcludedCancelled)
+	}
+}
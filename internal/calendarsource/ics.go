@@ -0,0 +1,738 @@
+package calendarsource
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+type icsComponent struct {
+	Name       string
+	Properties []*icsProperty
+	Components []*icsComponent
+}
+
+func (c *icsComponent) get(name string) *icsProperty {
+	for _, p := range c.Properties {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (c *icsComponent) getAll(name string) []*icsProperty {
+	props := make([]*icsProperty, 0)
+	for _, p := range c.Properties {
+		if p.Name == name {
+			props = append(props, p)
+		}
+	}
+	return props
+}
+
+func (c *icsComponent) getValue(name string) string {
+	if p := c.get(name); p != nil {
+		return p.Value
+	}
+	return ""
+}
+
+func readICS(source string) (io.ReadCloser, error) {
+	lower := strings.ToLower(source)
+	if strings.HasPrefix(lower, "webcal://") {
+		source = "https://" + source[len("webcal://"):]
+		lower = strings.ToLower(source)
+	}
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(source)
+}
+
+func parseICS(r io.Reader) (*icsComponent, error) {
+	// Unfold continuation lines
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	root := &icsComponent{}
+	stack := []*icsComponent{root}
+	for i, line := range lines {
+		p, err := parseICSProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		cur := stack[len(stack)-1]
+		switch p.Name {
+		case "BEGIN":
+			c := &icsComponent{Name: strings.ToUpper(p.Value)}
+			cur.Components = append(cur.Components, c)
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 1 || cur.Name != strings.ToUpper(p.Value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", i+1, p.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			cur.Properties = append(cur.Properties, p)
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("unterminated %s", stack[len(stack)-1].Name)
+	}
+	return root, nil
+}
+
+func parseICSProperty(line string) (*icsProperty, error) {
+	// Find the colon separating name and params from the value, skipping quoted params
+	quoted, sep := false, -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 {
+		return nil, fmt.Errorf("invalid content line: %q", line)
+	}
+	p := &icsProperty{Params: make(map[string]string), Value: line[sep+1:]}
+	parts := strings.Split(line[:sep], ";")
+	p.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		p.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return p, nil
+}
+
+func unescapeICSText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// icsTimezone resolves local times of a TZID defined by a VTIMEZONE component
+type icsTimezone struct {
+	name        string
+	observances []icsObservance
+}
+
+type icsObservance struct {
+	start      time.Time
+	offsetFrom int
+	offsetTo   int
+	rrule      string
+}
+
+func parseICSOffset(s string) (int, error) {
+	if len(s) != 5 && len(s) != 7 {
+		return 0, fmt.Errorf("invalid UTC offset: %q", s)
+	}
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	} else if s[0] != '+' {
+		return 0, fmt.Errorf("invalid UTC offset: %q", s)
+	}
+	h, err1 := strconv.Atoi(s[1:3])
+	m, err2 := strconv.Atoi(s[3:5])
+	sec := 0
+	var err3 error
+	if len(s) == 7 {
+		sec, err3 = strconv.Atoi(s[5:7])
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, fmt.Errorf("invalid UTC offset: %q", s)
+	}
+	return sign * (h*3600 + m*60 + sec), nil
+}
+
+func newICSTimezone(c *icsComponent) (*icsTimezone, error) {
+	tz := &icsTimezone{name: c.getValue("TZID")}
+	for _, o := range c.Components {
+		if o.Name != "STANDARD" && o.Name != "DAYLIGHT" {
+			continue
+		}
+		from, err := parseICSOffset(o.getValue("TZOFFSETFROM"))
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseICSOffset(o.getValue("TZOFFSETTO"))
+		if err != nil {
+			return nil, err
+		}
+		start, err := time.ParseInLocation("20060102T150405", o.getValue("DTSTART"), time.UTC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid observance start in %s: %v", tz.name, err)
+		}
+		tz.observances = append(tz.observances, icsObservance{
+			start:      start,
+			offsetFrom: from,
+			offsetTo:   to,
+			rrule:      o.getValue("RRULE"),
+		})
+	}
+	if len(tz.observances) == 0 {
+		return nil, fmt.Errorf("no observance in %s", tz.name)
+	}
+	return tz, nil
+}
+
+// Returns the instant of a local wall-clock time (given in UTC fields)
+func (tz *icsTimezone) resolve(local time.Time) (time.Time, error) {
+	// The latest observance onset at or before the local time decides the offset
+	var latest time.Time
+	offset := tz.observances[0].offsetFrom
+	for _, o := range tz.observances {
+		onsets := []time.Time{o.start}
+		if o.rrule != "" {
+			var err error
+			onsets, err = expandRRule(o.rrule, o.start, local.AddDate(0, 0, 1))
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid observance rule in %s: %v", tz.name, err)
+			}
+		}
+		for _, onset := range onsets {
+			if onset.After(local) {
+				break
+			}
+			if onset.After(latest) || latest.IsZero() {
+				latest = onset
+				offset = o.offsetTo
+			}
+		}
+	}
+	return local.Add(-time.Duration(offset) * time.Second).UTC(), nil
+}
+
+type icsTimeResolver struct {
+	loc       *time.Location
+	timezones map[string]*icsTimezone
+}
+
+// Parses a DATE or DATE-TIME property value. IANA timezone names are used
+// as is and other TZIDs are resolved with the VTIMEZONE components. Times
+// keep their own location so that recurrences follow its wall clock.
+func (r *icsTimeResolver) parse(p *icsProperty) (t time.Time, allDay bool, err error) {
+	return r.parseValue(p.Value, p.Params)
+}
+
+func (r *icsTimeResolver) parseValue(value string, params map[string]string) (t time.Time, allDay bool, err error) {
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err = time.ParseInLocation("20060102", value, r.loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	tzid := params["TZID"]
+	if tzid == "" {
+		// Floating time
+		t, err = time.ParseInLocation("20060102T150405", value, r.loc)
+		return t, false, err
+	}
+	if loc, lerr := time.LoadLocation(tzid); lerr == nil {
+		t, err = time.ParseInLocation("20060102T150405", value, loc)
+		return t, false, err
+	}
+	tz, ok := r.timezones[tzid]
+	if !ok {
+		return t, false, fmt.Errorf("unknown timezone: %q", tzid)
+	}
+	local, err := time.ParseInLocation("20060102T150405", value, time.UTC)
+	if err != nil {
+		return t, false, err
+	}
+	t, err = tz.resolve(local)
+	return t, false, err
+}
+
+var icsDurationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+func parseICSDuration(s string) (time.Duration, error) {
+	m := icsDurationPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, u := range units {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * u
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// Loads the events of an iCalendar source overlapping [start, end) as
+// Google Calendar events, expanding recurring events into single instances
+func getICSEvents(source string, start, end time.Time) ([]*calendar.Event, error) {
+	r, err := readICS(source)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	root, err := parseICS(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &icsTimeResolver{loc: start.Location(), timezones: make(map[string]*icsTimezone)}
+	vevents := make([]*icsComponent, 0)
+	for _, cal := range root.Components {
+		for _, c := range cal.Components {
+			switch c.Name {
+			case "VTIMEZONE":
+				tz, err := newICSTimezone(c)
+				if err != nil {
+					return nil, err
+				}
+				resolver.timezones[tz.name] = tz
+			case "VEVENT":
+				vevents = append(vevents, c)
+			}
+		}
+	}
+
+	// Instances modified individually replace the ones generated by the rule
+	overridden := make(map[string]bool)
+	for _, c := range vevents {
+		if p := c.get("RECURRENCE-ID"); p != nil {
+			t, _, err := resolver.parse(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RECURRENCE-ID of %s: %v", c.getValue("UID"), err)
+			}
+			overridden[c.getValue("UID")+"/"+t.UTC().Format(time.RFC3339)] = true
+		}
+	}
+
+	events := make([]*calendar.Event, 0)
+	for _, c := range vevents {
+		uid := c.getValue("UID")
+		dtstart := c.get("DTSTART")
+		if dtstart == nil {
+			return nil, fmt.Errorf("event %s has no DTSTART", uid)
+		}
+		first, allDay, err := resolver.parse(dtstart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DTSTART of %s: %v", uid, err)
+		}
+
+		// Event length
+		var length time.Duration
+		if p := c.get("DTEND"); p != nil {
+			t, _, err := resolver.parse(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DTEND of %s: %v", uid, err)
+			}
+			length = t.Sub(first)
+		} else if v := c.getValue("DURATION"); v != "" {
+			length, err = parseICSDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DURATION of %s: %v", uid, err)
+			}
+		} else if allDay {
+			length = 24 * time.Hour
+		}
+
+		// Instance start times
+		starts := []time.Time{first}
+		if rule := c.getValue("RRULE"); rule != "" && c.get("RECURRENCE-ID") == nil {
+			starts, err = expandRRule(rule, first, end)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RRULE of %s: %v", uid, err)
+			}
+			for _, p := range c.getAll("RDATE") {
+				for _, v := range strings.Split(p.Value, ",") {
+					t, _, err := resolver.parseValue(v, p.Params)
+					if err != nil {
+						return nil, fmt.Errorf("invalid RDATE of %s: %v", uid, err)
+					}
+					starts = append(starts, t)
+				}
+			}
+			excluded := make(map[string]bool)
+			for _, p := range c.getAll("EXDATE") {
+				for _, v := range strings.Split(p.Value, ",") {
+					t, _, err := resolver.parseValue(v, p.Params)
+					if err != nil {
+						return nil, fmt.Errorf("invalid EXDATE of %s: %v", uid, err)
+					}
+					excluded[t.UTC().Format(time.RFC3339)] = true
+				}
+			}
+			filtered := make([]time.Time, 0, len(starts))
+			for _, s := range starts {
+				key := s.UTC().Format(time.RFC3339)
+				if excluded[key] || overridden[uid+"/"+key] {
+					continue
+				}
+				filtered = append(filtered, s)
+			}
+			starts = filtered
+		}
+
+		for _, s := range starts {
+			e := s.Add(length)
+			if allDay {
+				e = s.AddDate(0, 0, int(length.Hours()/24))
+			}
+			if !s.Before(end) || !e.After(start) {
+				continue
+			}
+			events = append(events, newEventFromICS(c, uid, s.In(resolver.loc), e.In(resolver.loc), allDay))
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return EventStartKey(events[i]) < EventStartKey(events[j])
+	})
+	return events, nil
+}
+
+// Returns the start of the event as a key sorting events by start
+func EventStartKey(e *calendar.Event) string {
+	if e.Start.DateTime != "" {
+		t, _ := time.Parse(time.RFC3339, e.Start.DateTime)
+		return t.UTC().Format(time.RFC3339)
+	}
+	return e.Start.Date
+}
+
+func newEventFromICS(c *icsComponent, uid string, start, end time.Time, allDay bool) *calendar.Event {
+	e := &calendar.Event{
+		Id:          uid + "_" + start.UTC().Format("20060102T150405Z"),
+		Summary:     unescapeICSText(c.getValue("SUMMARY")),
+		Description: unescapeICSText(c.getValue("DESCRIPTION")),
+		Location:    unescapeICSText(c.getValue("LOCATION")),
+		Status:      strings.ToLower(c.getValue("STATUS")),
+	}
+	if allDay {
+		e.Start = &calendar.EventDateTime{Date: start.Format("2006-01-02")}
+		e.End = &calendar.EventDateTime{Date: end.Format("2006-01-02")}
+	} else {
+		e.Start = &calendar.EventDateTime{DateTime: start.Format(time.RFC3339)}
+		e.End = &calendar.EventDateTime{DateTime: end.Format(time.RFC3339)}
+	}
+	partstats := map[string]string{
+		"ACCEPTED":     "accepted",
+		"DECLINED":     "declined",
+		"TENTATIVE":    "tentative",
+		"NEEDS-ACTION": "needsAction",
+	}
+	for _, p := range c.getAll("ATTENDEE") {
+		email := p.Value
+		if i := strings.Index(strings.ToLower(email), "mailto:"); i >= 0 {
+			email = email[i+len("mailto:"):]
+		}
+		e.Attendees = append(e.Attendees, &calendar.EventAttendee{
+			Email:          email,
+			ResponseStatus: partstats[strings.ToUpper(p.Params["PARTSTAT"])],
+		})
+	}
+	return e
+}
+
+type recurrenceRule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []time.Month
+}
+
+type weekdayNum struct {
+	n       int
+	weekday time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func parseRRule(rule string, loc *time.Location) (*recurrenceRule, error) {
+	r := &recurrenceRule{interval: 1}
+	for _, part := range strings.Split(rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rule part: %q", part)
+		}
+		key, value := strings.ToUpper(kv[0]), kv[1]
+		var err error
+		switch key {
+		case "FREQ":
+			r.freq = strings.ToUpper(value)
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(value)
+		case "COUNT":
+			r.count, err = strconv.Atoi(value)
+		case "UNTIL":
+			if len(value) == 8 {
+				r.until, err = time.ParseInLocation("20060102", value, loc)
+				r.until = r.until.AddDate(0, 0, 1).Add(-time.Second)
+			} else if strings.HasSuffix(value, "Z") {
+				r.until, err = time.Parse("20060102T150405Z", value)
+			} else {
+				r.until, err = time.ParseInLocation("20060102T150405", value, loc)
+			}
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				if len(v) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY: %q", value)
+				}
+				wd, ok := icsWeekdays[strings.ToUpper(v[len(v)-2:])]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY: %q", value)
+				}
+				n := 0
+				if len(v) > 2 {
+					if n, err = strconv.Atoi(v[:len(v)-2]); err != nil {
+						return nil, fmt.Errorf("invalid BYDAY: %q", value)
+					}
+				}
+				r.byDay = append(r.byDay, weekdayNum{n: n, weekday: wd})
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid BYMONTHDAY: %q", value)
+				}
+				r.byMonthDay = append(r.byMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 || n > 12 {
+					return nil, fmt.Errorf("invalid BYMONTH: %q", value)
+				}
+				r.byMonth = append(r.byMonth, time.Month(n))
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", key, value)
+		}
+	}
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("unsupported FREQ: %q", r.freq)
+	}
+	if r.interval < 1 {
+		return nil, fmt.Errorf("invalid INTERVAL: %d", r.interval)
+	}
+	return r, nil
+}
+
+func (r *recurrenceRule) matchesMonth(t time.Time) bool {
+	if len(r.byMonth) == 0 {
+		return true
+	}
+	for _, m := range r.byMonth {
+		if t.Month() == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *recurrenceRule) matchesWeekday(t time.Time) bool {
+	if len(r.byDay) == 0 {
+		return true
+	}
+	for _, wd := range r.byDay {
+		if t.Weekday() == wd.weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *recurrenceRule) matchesMonthDay(t time.Time) bool {
+	if len(r.byMonthDay) == 0 {
+		return true
+	}
+	last := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	for _, d := range r.byMonthDay {
+		if t.Day() == d || (d < 0 && t.Day() == last+d+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the days of a month matching the rule's BYMONTHDAY/BYDAY, or the
+// day of dtstart when neither is given
+func (r *recurrenceRule) monthDays(year int, month time.Month, dtstart time.Time) []time.Time {
+	at := func(day int) time.Time {
+		return time.Date(year, month, day, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+	}
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, dtstart.Location()).Day()
+	days := make([]time.Time, 0)
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 {
+		if dtstart.Day() <= last {
+			days = append(days, at(dtstart.Day()))
+		}
+		return days
+	}
+	for d := 1; d <= last; d++ {
+		t := at(d)
+		if !r.matchesMonthDay(t) {
+			continue
+		}
+		if len(r.byDay) > 0 {
+			matched := false
+			for _, wd := range r.byDay {
+				if t.Weekday() != wd.weekday {
+					continue
+				}
+				nth := (d-1)/7 + 1
+				nthFromEnd := -((last-d)/7 + 1)
+				if wd.n == 0 || wd.n == nth || wd.n == nthFromEnd {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		days = append(days, t)
+	}
+	return days
+}
+
+// Expands a recurrence rule into the start times of instances beginning
+// before end. Wall-clock times are kept across DST changes.
+func expandRRule(rule string, dtstart, end time.Time) ([]time.Time, error) {
+	r, err := parseRRule(rule, dtstart.Location())
+	if err != nil {
+		return nil, err
+	}
+
+	starts := make([]time.Time, 0)
+	count := 0
+	for k := 0; ; k++ {
+		var periodStart time.Time
+		candidates := make([]time.Time, 0)
+		switch r.freq {
+		case "DAILY":
+			periodStart = dtstart.AddDate(0, 0, k*r.interval)
+			if r.matchesMonth(periodStart) && r.matchesMonthDay(periodStart) && r.matchesWeekday(periodStart) {
+				candidates = append(candidates, periodStart)
+			}
+		case "WEEKLY":
+			// Weeks start on Monday
+			offset := (int(dtstart.Weekday()) + 6) % 7
+			weekStart := time.Date(dtstart.Year(), dtstart.Month(), dtstart.Day()-offset+7*k*r.interval, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+			periodStart = weekStart
+			if len(r.byDay) == 0 {
+				candidates = append(candidates, weekStart.AddDate(0, 0, offset))
+			} else {
+				for i := 0; i < 7; i++ {
+					t := weekStart.AddDate(0, 0, i)
+					if r.matchesWeekday(t) {
+						candidates = append(candidates, t)
+					}
+				}
+			}
+			filtered := candidates[:0]
+			for _, t := range candidates {
+				if r.matchesMonth(t) {
+					filtered = append(filtered, t)
+				}
+			}
+			candidates = filtered
+		case "MONTHLY":
+			first := time.Date(dtstart.Year(), dtstart.Month()+time.Month(k*r.interval), 1, 0, 0, 0, 0, dtstart.Location())
+			periodStart = first
+			if r.matchesMonth(first) {
+				candidates = r.monthDays(first.Year(), first.Month(), dtstart)
+			}
+		case "YEARLY":
+			year := dtstart.Year() + k*r.interval
+			periodStart = time.Date(year, 1, 1, 0, 0, 0, 0, dtstart.Location())
+			months := r.byMonth
+			if len(months) == 0 {
+				months = []time.Month{dtstart.Month()}
+			}
+			for _, m := range months {
+				candidates = append(candidates, r.monthDays(year, m, dtstart)...)
+			}
+			sort.Slice(candidates, func(i, j int) bool {
+				return candidates[i].Before(candidates[j])
+			})
+		}
+
+		if k > 0 && !periodStart.Before(end) {
+			return starts, nil
+		}
+		for _, t := range candidates {
+			if t.Before(dtstart) {
+				continue
+			}
+			if !r.until.IsZero() && t.After(r.until) {
+				return starts, nil
+			}
+			count++
+			if r.count > 0 && count > r.count {
+				return starts, nil
+			}
+			if !t.Before(end) {
+				return starts, nil
+			}
+			starts = append(starts, t)
+		}
+		if k > 100000 {
+			return nil, fmt.Errorf("too many iterations expanding %q", rule)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Package calendarsource lists the events work days are found in, of Google
+// calendars or of iCalendar files and URLs, and filters them.
+package calendarsource
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// EventLister lists the events of a calendar overlapping [start, end),
+// ordered by their starts
+type EventLister interface {
+	ListEvents(ctx context.Context, calendarID string, start, end time.Time) ([]*calendar.Event, error)
+}
+
+// Google lists the events of Google calendars, expanding recurring events
+// into single instances
+type Google struct {
+	Service *calendar.Service
+}
+
+func (g *Google) ListEvents(ctx context.Context, calendarID string, start, end time.Time) ([]*calendar.Event, error) {
+	events := make([]*calendar.Event, 0)
+	err := g.Service.Events.List(calendarID).
+		ShowDeleted(false).
+		SingleEvents(true).
+		TimeMin(start.Format(time.RFC3339)).
+		TimeMax(end.Format(time.RFC3339)).
+		OrderBy("startTime").
+		Pages(ctx, func(page *calendar.Events) error {
+			events = append(events, page.Items...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ICS lists the events of iCalendar files and URLs, the calendar IDs being
+// their paths and URLs
+type ICS struct{}
+
+func (ICS) ListEvents(ctx context.Context, source string, start, end time.Time) ([]*calendar.Event, error) {
+	return getICSEvents(source, start, end)
+}
@@ -0,0 +1,74 @@
+package calendarsource
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+// Listers both implement EventLister
+var (
+	_ EventLister = &Google{}
+	_ EventLister = ICS{}
+)
+
+func TestGoogleListEventsPages(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("timeMin")+" "+r.URL.Query().Get("pageToken"))
+		page := &calendar.Events{Items: []*calendar.Event{{Id: "1"}}, NextPageToken: "next"}
+		if r.URL.Query().Get("pageToken") == "next" {
+			page = &calendar.Events{Items: []*calendar.Event{{Id: "2"}}}
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+	svc, err := calendar.NewService(context.Background(), option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/calendar/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	events, err := (&Google{Service: svc}).ListEvents(context.Background(), "work", start, start.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Id != "1" || events[1].Id != "2" {
+		t.Errorf("got %d events, want the ones of both pages", len(events))
+	}
+	if len(queries) != 2 || queries[0] != "2024-05-01T00:00:00Z " || queries[1] != "2024-05-01T00:00:00Z next" {
+		t.Errorf("got requests %q", queries)
+	}
+}
+
+func TestICSListEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "work.ics")
+	ics := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\nUID:a\r\nSUMMARY:勤務\r\nDTSTART:20240507T000000Z\r\nDTEND:20240507T090000Z\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:b\r\nSUMMARY:勤務\r\nDTSTART;VALUE=DATE:20240503\r\nDTEND;VALUE=DATE:20240504\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:c\r\nSUMMARY:勤務\r\nDTSTART:20240607T000000Z\r\nDTEND:20240607T090000Z\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	if err := ioutil.WriteFile(path, []byte(ics), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	events, err := ICS{}.ListEvents(context.Background(), path, start, start.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2 in the month", len(events))
+	}
+	if events[0].Start.Date != "2024-05-03" || events[1].Start.DateTime == "" {
+		t.Errorf("got events starting at %q, %q; want ordered by start", EventStartKey(events[0]), EventStartKey(events[1]))
+	}
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// BillingConfig tells how much the client is billed for the month. rate is
+// in the minor units of the currency (yen, or cents for USD) per
+// rate_unit, which is per_day, per_hour or per_month. Hours billed
+// per_hour are rounded to hours_rounding_unit by hours_rounding
+// ("up", "down", "nearest" or "none") and then kept within min_hours and
+// max_hours. per_hour rates may differ by weekday, in which case the hours
+// added or cut by rounding and the limits are billed at the default rate.
+type BillingConfig struct {
+	Rate              WeekdayRate `json:"rate"`
+	RateUnit          string      `json:"rate_unit"`
+	MinHours          *float64    `json:"min_hours"`
+	MaxHours          *float64    `json:"max_hours"`
+	HoursRounding     string      `json:"hours_rounding"`
+	HoursRoundingUnit string      `json:"hours_rounding_unit"`
+}
+
+// Returns the billing settings of the spreadsheet, which replace the global
+// ones if any, or nil if the spreadsheet is not billed
+func (c *Config) GetBilling(sc *SpreadsheetConfig) *BillingConfig {
+	if sc.Billing != nil {
+		return sc.Billing
+	}
+	return c.Billing
+}
+
+func (b *BillingConfig) Validate() error {
+	if err := b.Rate.Validate(); err != nil {
+		return err
+	}
+	switch b.RateUnit {
+	case "per_day", "per_month":
+		if b.MinHours != nil || b.MaxHours != nil || b.HoursRounding != "" {
+			return fmt.Errorf("min_hours, max_hours and hours_rounding are only for per_hour rates")
+		}
+		if b.Rate.ByWeekday() {
+			return fmt.Errorf("rates by weekday are only for per_hour rates")
+		}
+		return nil
+	case "per_hour":
+	default:
+		return fmt.Errorf("unknown rate_unit %q (want per_day, per_hour or per_month)", b.RateUnit)
+	}
+	// Fractional hours are billed only by a rule given explicitly
+	switch b.HoursRounding {
+	case "none":
+	case "up", "down", "nearest":
+		if _, err := b.RoundingUnit(); err != nil {
+			return err
+		}
+	case "":
+		return fmt.Errorf("hours_rounding is required for per_hour rates")
+	default:
+		return fmt.Errorf("unknown hours_rounding %q (want up, down, nearest or none)", b.HoursRounding)
+	}
+	if b.MinHours != nil && *b.MinHours < 0 {
+		return fmt.Errorf("min_hours must not be negative")
+	}
+	if b.MinHours != nil && b.MaxHours != nil && *b.MinHours > *b.MaxHours {
+		return fmt.Errorf("min_hours is greater than max_hours")
+	}
+	return nil
+}
+
+func (b *BillingConfig) RoundingUnit() (time.Duration, error) {
+	if b.HoursRoundingUnit == "" {
+		return 0, fmt.Errorf("hours_rounding_unit is required for hours_rounding %q", b.HoursRounding)
+	}
+	d, err := time.ParseDuration(b.HoursRoundingUnit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse hours_rounding_unit: %v", err)
+	}
+	if d < time.Minute || d%time.Minute != 0 {
+		return 0, fmt.Errorf("hours_rounding_unit must be whole minutes")
+	}
+	return d, nil
+}
@@ -0,0 +1,18 @@
+package config
+
+import "fmt"
+
+// BillingPeriodConfig bills periods starting on a day of the month other
+// than the 1st. The period of a month is the one ending in the month, e.g.
+// with start_day 16, 202405 is from 2024-04-16 to 2024-05-15. In months
+// shorter than start_day the period starts on the last day of the month.
+type BillingPeriodConfig struct {
+	StartDay int `json:"start_day"`
+}
+
+func (c *BillingPeriodConfig) Validate() error {
+	if c.StartDay < 1 || c.StartDay > 31 {
+		return fmt.Errorf("start_day must be from 1 to 31: %d", c.StartDay)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+package config
+
+// BreakRule deducts a break from the days spanning more than min_hours from
+// start to end. A day of exactly min_hours has no break by the rule, e.g.
+// with min_hours 6 and deduction_minutes 60, 9:00-15:00 is 6 hours and
+// 9:00-15:30 is 5.5 hours.
+type BreakRule struct {
+	MinHours         float64 `json:"min_hours"`
+	DeductionMinutes int     `json:"deduction_minutes"`
+}
@@ -0,0 +1,37 @@
+package config
+
+// BundleConfig is the ZIP bundles of the outputs, made for each spreadsheet
+// after its outputs are written and for the month after all of them are.
+// Names are output name templates like combined_pdf_name, the one of each
+// spreadsheet getting its title and invoice number too.
+type BundleConfig struct {
+	ClientName string `json:"client_name"`
+	MonthName  string `json:"month_name"`
+	// Path of each file in the bundles, a template getting the file name as
+	// .File with .Title, .Year and .Month. The month bundle has the files
+	// of each spreadsheet in a directory of its title by default.
+	ClientLayout string `json:"client_layout"`
+	MonthLayout  string `json:"month_layout"`
+	// Upload the bundle of each spreadsheet by drive_upload in place of its
+	// pdfs. Emails attach it as the "zip" attachment.
+	UploadBundle bool `json:"upload_bundle"`
+}
+
+func (bc *BundleConfig) GetClientLayout() string {
+	if bc.ClientLayout == "" {
+		return defaultClientBundleLayout
+	}
+	return bc.ClientLayout
+}
+
+func (bc *BundleConfig) GetMonthLayout() string {
+	if bc.MonthLayout == "" {
+		return defaultMonthBundleLayout
+	}
+	return bc.MonthLayout
+}
+
+const (
+	defaultClientBundleLayout = "{{.File}}"
+	defaultMonthBundleLayout  = "{{.Title}}/{{.File}}"
+)
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// ClientConfig is a client invoiced, referenced by the client of the
+// spreadsheets. The clients are in clients of the config, or in
+// clients_file like "clients.json" having an object of them by key. Their
+// values are the placeholders of documents like {{client_name}} and
+// {{attention}}, and the fields of the emails like {{.Attention}}. Emails
+// without to are sent to email of the client.
+type ClientConfig struct {
+	Name       string `json:"name"`
+	Department string `json:"department"`
+	// Lines of the postal address, like the postal code and the street
+	Address       []string `json:"address"`
+	ContactPerson string   `json:"contact_person"`
+	// Honorific after the name addressed, 様 by default, or 御中 without a
+	// contact person
+	Honorific    string   `json:"honorific"`
+	PaymentTerms string   `json:"payment_terms"`
+	Email        []string `json:"email"`
+}
+
+// Reads the clients of clients_file into the clients of the config, where
+// the same keys must not be
+func (c *Config) LoadClients() error {
+	if c.ClientsFile == "" {
+		return nil
+	}
+	d, err := ioutil.ReadFile(ResolvePath(c.ClientsFile))
+	if err != nil {
+		return fmt.Errorf("failed to read clients_file: %v", err)
+	}
+	var clients map[string]*ClientConfig
+	if err := json.Unmarshal(d, &clients); err != nil {
+		return fmt.Errorf("failed to decode clients_file %s: %v", c.ClientsFile, err)
+	}
+	if c.Clients == nil {
+		c.Clients = make(map[string]*ClientConfig)
+	}
+	for key, client := range clients {
+		if _, ok := c.Clients[key]; ok {
+			return fmt.Errorf("client %s is in both clients and clients_file", key)
+		}
+		c.Clients[key] = client
+	}
+	return nil
+}
+
+func (cc *ClientConfig) Validate() error {
+	if cc == nil {
+		return fmt.Errorf("no settings")
+	}
+	if cc.Name == "" {
+		return fmt.Errorf("no name")
+	}
+	return nil
+}
+
+// Returns the client of the spreadsheet, or nil if it has none
+func (c *Config) GetClient(sc *SpreadsheetConfig) *ClientConfig {
+	if sc.Client == "" {
+		return nil
+	}
+	return c.Clients[sc.Client]
+}
+
+// Returns whom the invoice is addressed to, like "山田 太郎 様" or "経理部
+// 御中" without a contact person
+func (cc *ClientConfig) Attention() string {
+	honorific := cc.Honorific
+	if cc.ContactPerson == "" {
+		if cc.Department == "" {
+			return ""
+		}
+		if honorific == "" {
+			honorific = "御中"
+		}
+		return cc.Department + " " + honorific
+	}
+	if honorific == "" {
+		honorific = "様"
+	}
+	return cc.ContactPerson + " " + honorific
+}
+
+// Returns the email addressed to the client if it has no recipients
+func (cc *ClientConfig) AddressEmail(ec *EmailConfig) *EmailConfig {
+	if cc == nil || len(ec.To) > 0 || len(cc.Email) == 0 {
+		return ec
+	}
+	e := *ec
+	e.To = cc.Email
+	return &e
+}
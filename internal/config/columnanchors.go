@@ -0,0 +1,27 @@
+package config
+
+// ColumnAnchor is a cell of the template telling that a day column is there,
+// like the header of the column, the column being given by its range
+// setting like "notes_range". Columns are required by default, a missing
+// anchor failing the run as template_anchors do. Sheets missing the anchor of
+// a column with required false are written without the column.
+type ColumnAnchor struct {
+	Column   string `json:"column"`
+	Cell     string `json:"cell"`
+	Text     string `json:"text"`
+	Required *bool  `json:"required"`
+}
+
+func (a *ColumnAnchor) IsRequired() bool {
+	return a.Required == nil || *a.Required
+}
+
+// Returns the anchor of the column, or nil if there is none
+func (c *Config) GetColumnAnchor(key string) *ColumnAnchor {
+	for _, a := range c.ColumnAnchors {
+		if a.Column == key {
+			return a
+		}
+	}
+	return nil
+}
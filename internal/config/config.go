@@ -0,0 +1,467 @@
+// Package config is the config file of make-invoices, with the defaults of
+// its settings.
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	CredentialsFileName      string                 `json:"credentials_file_name"`
+	OAuth2TokenFileName      string                 `json:"oauth2_token_file_name"`
+	CalendarID               string                 `json:"calendar_id"`
+	CalendarIDs              []string               `json:"calendar_ids"`
+	CalendarSource           string                 `json:"calendar_source"`
+	WorkSource               string                 `json:"work_source"`
+	WorkSources              []*WorkSourceConfig    `json:"work_sources"`
+	WorkSourceMerge          string                 `json:"work_source_merge"`
+	Locale                   string                 `json:"locale"`
+	Timezone                 string                 `json:"timezone"`
+	Serve                    *ServeConfig           `json:"serve"`
+	WorkCSV                  *WorkCSVConfig         `json:"work_csv"`
+	WorkDayTitle             string                 `json:"work_day_title"`
+	WorkDayTitles            []string               `json:"work_day_titles"`
+	EventColorID             string                 `json:"event_color_id"`
+	EventKinds               []*EventKind           `json:"event_kinds"`
+	EventKindRange           string                 `json:"event_kind_range"`
+	RequiredAttendeeEmail    string                 `json:"required_attendee_email"`
+	SkipNeedsAction          bool                   `json:"skip_needs_action"`
+	WorkStartTime            WeekdayString          `json:"work_start_time"`
+	WorkEndTime              WeekdayString          `json:"work_end_time"`
+	WorkEndTimeRange         string                 `json:"work_end_time_range"`
+	TimeSource               string                 `json:"time_source"`
+	ExtendedHours            bool                   `json:"extended_hours"`
+	HalfDayThresholdHours    float64                `json:"half_day_threshold_hours"`
+	HalfDayStartTime         string                 `json:"half_day_start_time"`
+	DayFractionRange         string                 `json:"day_fraction_range"`
+	RemarksRange             string                 `json:"remarks_range"`
+	LocationRange            string                 `json:"location_range"`
+	LocationDefault          string                 `json:"location_default"`
+	LocationRules            []LocationRule         `json:"location_rules"`
+	ClearUnusedRows          bool                   `json:"clear_unused_rows"`
+	CopySourceMaxMonthsBack  int                    `json:"copy_source_max_months_back"`
+	HolidayCalendarID        string                 `json:"holiday_calendar_id"`
+	HolidayOverrideMarker    string                 `json:"holiday_override_marker"`
+	LeaveTitles              map[string]string      `json:"leave_titles"`
+	LeaveRange               string                 `json:"leave_range"`
+	BreakRange               string                 `json:"break_range"`
+	BreakRules               []*BreakRule           `json:"break_rules"`
+	SummarySpreadsheetID     string                 `json:"summary_spreadsheet_id"`
+	SummarySheetName         string                 `json:"summary_sheet_name"`
+	AuditLogSpreadsheetID    string                 `json:"audit_log_spreadsheet_id"`
+	AuditLogSheetName        string                 `json:"audit_log_sheet_name"`
+	Holidays                 *HolidaysConfig        `json:"holidays"`
+	CalendarCacheTTL         string                 `json:"calendar_cache_ttl"`
+	MinWorkDays              int                    `json:"min_work_days"`
+	RetryMaxAttempts         int                    `json:"retry_max_attempts"`
+	RetryDeadline            string                 `json:"retry_deadline"`
+	WorkSpreadsheetIDs       []string               `json:"work_spreadsheet_ids"`
+	WorkSpreadsheets         []*SpreadsheetConfig   `json:"work_spreadsheets"`
+	WorkDocumentTemplateID   string                 `json:"work_document_template_id"`
+	InvoiceRenderer          string                 `json:"invoice_renderer"`
+	InvoiceFontPath          string                 `json:"invoice_font_path"`
+	InvoiceFontIndex         int                    `json:"invoice_font_index"`
+	IssueDate                string                 `json:"issue_date"`
+	DueDateRule              string                 `json:"due_date_rule"`
+	DateFormat               string                 `json:"date_format"`
+	InvoiceDocument          *InvoiceDocumentConfig `json:"invoice_document"`
+	Billing                  *BillingConfig         `json:"billing"`
+	BillingPeriod            *BillingPeriodConfig   `json:"billing_period"`
+	Tax                      *TaxConfig             `json:"tax"`
+	Currency                 string                 `json:"currency"`
+	DateCell                 string                 `json:"date_cell"`
+	DateCellMonthWarningOnly bool                   `json:"date_cell_month_warning_only"`
+	WorkStartTimeRange       string                 `json:"work_start_time_range"`
+	ProtectAfterExport       bool                   `json:"protect_after_export"`
+	ProtectionWarningOnly    bool                   `json:"protection_warning_only"`
+	RowLayout                *RowLayout             `json:"row_layout"`
+	NotesRange               string                 `json:"notes_range"`
+	NotesMaxLength           int                    `json:"notes_max_length"`
+	WeekdayRange             string                 `json:"weekday_range"`
+	WeekdayNames             []string               `json:"weekday_names"`
+	WeekdayFormat            string                 `json:"weekday_format"`
+	HolidayMarker            string                 `json:"holiday_marker"`
+	RetentionMonths          int                    `json:"retention_months"`
+	RetentionAction          string                 `json:"retention_action"`
+	ArchiveSpreadsheetID     string                 `json:"archive_spreadsheet_id"`
+	TabColor                 string                 `json:"tab_color"`
+	TabColorExistingSheets   bool                   `json:"tab_color_existing_sheets"`
+	SheetOrder               string                 `json:"sheet_order"`
+	NonMonthSheets           string                 `json:"non_month_sheets"`
+	InvoiceNumberCell        string                 `json:"invoice_number_cell"`
+	InvoiceNumberFormat      string                 `json:"invoice_number_format"`
+	InvoiceNumberFromSheet   bool                   `json:"invoice_number_from_sheet"`
+	InvoiceNumberYearlyReset bool                   `json:"invoice_number_yearly_reset"`
+	Revision                 *RevisionConfig        `json:"revision"`
+	StateFile                string                 `json:"state_file"`
+	SheetTitleFormat         string                 `json:"sheet_title_format"`
+	ExportMethod             string                 `json:"export_method"`
+	ExportTimeout            string                 `json:"export_timeout"`
+	APITimeout               string                 `json:"api_timeout"`
+	APIRequestsPerSecond     float64                `json:"api_requests_per_second"`
+	ValueWriteMode           string                 `json:"value_write_mode"`
+	SheetsWritesPerMinute    int                    `json:"sheets_writes_per_minute"`
+	LogFile                  string                 `json:"log_file"`
+	LogFileMaxSize           int64                  `json:"log_file_max_size"`
+	LogFileKeep              int                    `json:"log_file_keep"`
+	OnExistingOutput         string                 `json:"on_existing_output"`
+	CombinedPDFName          string                 `json:"combined_pdf_name"`
+	ExportDailyCSV           bool                   `json:"export_daily_csv"`
+	DailyCSV                 *DailyCSVConfig        `json:"daily_csv"`
+	Delivery                 []*DeliveryConfig      `json:"delivery"`
+	Bundle                   *BundleConfig          `json:"bundle"`
+	DriveUploadFolderID      string                 `json:"drive_upload_folder_id"`
+	DriveUploadSubfolder     string                 `json:"drive_upload_subfolder"`
+	DriveUploadName          string                 `json:"drive_upload_name"`
+	ExportFormats            []string               `json:"export_formats"`
+	ValuesCSVBOM             bool                   `json:"values_csv_bom"`
+	ValuesCSVDelimiter       string                 `json:"values_csv_delimiter"`
+	ExportPDFOptions         *PDFOptions            `json:"export_pdf_options"`
+	TemplateAnchors          map[string]string      `json:"template_anchors"`
+	ColumnAnchors            []*ColumnAnchor        `json:"column_anchors"`
+	SandboxFolderID          string                 `json:"sandbox_folder_id"`
+	SandboxMaxAge            string                 `json:"sandbox_max_age"`
+	RemindDay                int                    `json:"remind_day"`
+	RemindEmailTo            []string               `json:"remind_email_to"`
+	NonWorkingDays           *NonWorkingDaysConfig  `json:"non_working_days"`
+	AnomalyThresholdPercent  float64                `json:"anomaly_threshold_percent"`
+	Summary                  *SummaryConfig         `json:"summary"`
+	Notify                   *NotifyConfig          `json:"notify"`
+	Hooks                    *HooksConfig           `json:"hooks"`
+
+	// Clients referenced by the spreadsheets, and the file of more of them
+	Clients     map[string]*ClientConfig `json:"clients"`
+	ClientsFile string                   `json:"clients_file"`
+	// Month the fiscal years of archives start in, April by default
+	FiscalYearStartMonth int `json:"fiscal_year_start_month"`
+	// Checks for newer releases in the repository like "owner/name", also
+	// in unattended runs and serve with check_updates_unattended
+	CheckUpdates           bool   `json:"check_updates"`
+	CheckUpdatesUnattended bool   `json:"check_updates_unattended"`
+	UpdateRepository       string `json:"update_repository"`
+}
+
+// SpreadsheetConfig holds settings specific to a spreadsheet
+type SpreadsheetConfig struct {
+	ID                     string                   `json:"id"`
+	WorkDayRule            *WorkDayRule             `json:"work_day_rule"`
+	CalendarID             string                   `json:"calendar_id"`
+	CalendarIDs            []string                 `json:"calendar_ids"`
+	WorkDayTitle           string                   `json:"work_day_title"`
+	WorkDayTitles          []string                 `json:"work_day_titles"`
+	EventColorID           string                   `json:"event_color_id"`
+	RequiredAttendeeEmail  string                   `json:"required_attendee_email"`
+	ExportFormats          []string                 `json:"export_formats"`
+	ExportPDFOptions       *PDFOptions              `json:"export_pdf_options"`
+	Email                  *EmailConfig             `json:"email"`
+	WorkDocumentTemplateID string                   `json:"work_document_template_id"`
+	InvoiceRenderer        string                   `json:"invoice_renderer"`
+	IssueDate              string                   `json:"issue_date"`
+	DueDateRule            string                   `json:"due_date_rule"`
+	DateFormat             string                   `json:"date_format"`
+	InvoiceDocument        *InvoiceDocumentConfig   `json:"invoice_document"`
+	Documents              []*InvoiceDocumentConfig `json:"documents"`
+	ReportDocument         *InvoiceDocumentConfig   `json:"report_document"`
+	DocumentData           map[string]string        `json:"document_data"`
+	Client                 string                   `json:"client"`
+	Billing                *BillingConfig           `json:"billing"`
+	BillingPeriod          *BillingPeriodConfig     `json:"billing_period"`
+	Tax                    *TaxConfig               `json:"tax"`
+	Currency               string                   `json:"currency"`
+	BreakRules             []*BreakRule             `json:"break_rules"`
+	Revision               *RevisionConfig          `json:"revision"`
+	Delivery               []*DeliveryConfig        `json:"delivery"`
+	// Cell of the subtotal of the billing, or of amount_formula if given.
+	// amount_number_format like "¥#,##0" is set to the cell as a currency
+	// format.
+	AmountCell         string `json:"amount_cell"`
+	AmountFormula      string `json:"amount_formula"`
+	AmountNumberFormat string `json:"amount_number_format"`
+	// Tab copied for new months in place of the previous month sheet. It is
+	// never written, even if titled like a month.
+	TemplateSheet string `json:"template_sheet"`
+	// Range like "A1:N40" exported to pdf in place of the whole sheet
+	PrintRange string `json:"print_range"`
+	// "weekly" also writes and exports a sheet for each week of the month,
+	// having the days of the adjacent months in the weeks spanning the
+	// month boundaries with include_out_of_month_days
+	Period                string `json:"period"`
+	IncludeOutOfMonthDays bool   `json:"include_out_of_month_days"`
+
+	// gid of the spreadsheet URL, used as the copy source when there is no
+	// month sheet
+	GIDHint *int64 `json:"-"`
+	// Copy written to in place of the spreadsheet in sandbox runs
+	SandboxID string `json:"-"`
+}
+
+// Tells whether the spreadsheet finds work days by its own events or in its
+// own billing period
+func (sc *SpreadsheetConfig) HasOwnFilters() bool {
+	return sc.CalendarID != "" || len(sc.CalendarIDs) > 0 || sc.WorkDayTitle != "" || len(sc.WorkDayTitles) > 0 ||
+		sc.EventColorID != "" || sc.RequiredAttendeeEmail != "" || sc.BillingPeriod != nil
+}
+
+// Returns the config with the calendars, event filters and billing period of
+// the spreadsheet in place of the global ones
+func (c *Config) ForSpreadsheet(sc *SpreadsheetConfig) *Config {
+	cc := *c
+	if sc.CalendarID != "" || len(sc.CalendarIDs) > 0 {
+		cc.CalendarSource = ""
+		cc.CalendarID, cc.CalendarIDs = sc.CalendarID, sc.CalendarIDs
+	}
+	if sc.WorkDayTitle != "" || len(sc.WorkDayTitles) > 0 {
+		cc.WorkDayTitle, cc.WorkDayTitles = sc.WorkDayTitle, sc.WorkDayTitles
+	}
+	if sc.EventColorID != "" {
+		cc.EventColorID = sc.EventColorID
+	}
+	if sc.RequiredAttendeeEmail != "" {
+		cc.RequiredAttendeeEmail = sc.RequiredAttendeeEmail
+	}
+	if sc.BillingPeriod != nil {
+		cc.BillingPeriod = sc.BillingPeriod
+	}
+	return &cc
+}
+
+// Returns the kind of cached work events, which differs by the filters
+func (c *Config) WorkEventKind() string {
+	h := sha256.New()
+	h.Write([]byte(strings.Join(append([]string{c.WorkDayTitle}, c.WorkDayTitles...), "\n") + "\n"))
+	h.Write([]byte(c.EventColorID + "\n"))
+	h.Write([]byte(c.RequiredAttendeeEmail + "\n"))
+	return "work:" + hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+// WorkDayRule makes every day of Weekdays ("mon".."sun") a work day, except
+// for days having an AbsenceTitle event and holidays
+type WorkDayRule struct {
+	Weekdays             []string `json:"weekdays"`
+	AbsenceTitle         string   `json:"absence_title"`
+	IncludeWorkDayEvents bool     `json:"include_work_day_events"`
+}
+
+// Returns work_spreadsheet_ids followed by work_spreadsheets
+func (c *Config) GetSpreadsheets() []*SpreadsheetConfig {
+	spreadsheets := make([]*SpreadsheetConfig, 0)
+	for _, id := range c.WorkSpreadsheetIDs {
+		spreadsheets = append(spreadsheets, &SpreadsheetConfig{ID: id})
+	}
+	return append(spreadsheets, c.WorkSpreadsheets...)
+}
+
+// LocationRule maps events whose title or location matches Pattern to the
+// location value written to the sheet
+type LocationRule struct {
+	Pattern string `json:"pattern"`
+	Value   string `json:"value"`
+}
+
+// Tells whether an event title is one of the work day titles. With location
+// rules, the title may have a suffix matching one of them, e.g. "出勤(在宅)".
+func (c *Config) MatchesWorkDayTitle(summary string) bool {
+	titles := c.WorkDayTitles
+	if c.WorkDayTitle != "" || len(titles) == 0 {
+		titles = append([]string{c.WorkDayTitle}, titles...)
+	}
+	for _, title := range titles {
+		if summary == title {
+			return true
+		}
+		if len(c.LocationRules) == 0 || !strings.HasPrefix(summary, title) {
+			continue
+		}
+		suffix := strings.TrimSpace(strings.TrimPrefix(summary, title))
+		for _, r := range c.LocationRules {
+			if re, err := regexp.Compile(r.Pattern); err == nil && re.MatchString(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the calendars to look for work days in. An iCalendar file or URL
+// in calendar_source replaces the Google calendars. Work days read from a
+// work CSV use no calendars.
+func (c *Config) GetCalendarIDs() []string {
+	if c.WorkSource == "csv" {
+		return nil
+	}
+	if c.CalendarSource != "" {
+		return []string{c.CalendarSource}
+	}
+	ids := make([]string, 0)
+	if c.CalendarID != "" {
+		ids = append(ids, c.CalendarID)
+	}
+	for _, id := range c.CalendarIDs {
+		if id != c.CalendarID {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (c *Config) NeedsCalendarScope() bool {
+	if c.HolidayCalendarID != "" && !IsICSSource(c.HolidayCalendarID) {
+		return true
+	}
+	for _, id := range c.GetCalendarIDs() {
+		if !IsICSSource(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns date_cell, "M3" by default
+func (c *Config) GetDateCell() string {
+	if c.DateCell == "" {
+		return "M3"
+	}
+	return c.DateCell
+}
+
+// Returns work_start_time_range, "D7:D37" by default
+func (c *Config) GetWorkStartTimeRange() string {
+	if c.WorkStartTimeRange == "" {
+		return "D7:D37"
+	}
+	return c.WorkStartTimeRange
+}
+
+// Returns the anchor cells of the config sorted
+func (c *Config) GetTemplateAnchors() (map[string]string, []string) {
+	anchors := c.TemplateAnchors
+	if anchors == nil {
+		anchors = defaultTemplateAnchors
+	}
+	cells := make([]string, 0, len(anchors))
+	for cell := range anchors {
+		cells = append(cells, cell)
+	}
+	sort.Strings(cells)
+	return anchors, cells
+}
+
+func (c *Config) GetAnomalyThresholdPercent() float64 {
+	if c.AnomalyThresholdPercent <= 0 {
+		return defaultAnomalyThresholdPercent
+	}
+	return c.AnomalyThresholdPercent
+}
+
+const defaultAnomalyThresholdPercent = 30
+
+func (c *Config) GetFiscalYearStartMonth() time.Month {
+	if c.FiscalYearStartMonth == 0 {
+		return defaultFiscalYearStartMonth
+	}
+	return time.Month(c.FiscalYearStartMonth)
+}
+
+// Fiscal years start in April by default, as in Japan
+const defaultFiscalYearStartMonth = 4
+
+// Returns the timezone of the months and the days of runs, Asia/Tokyo
+// unless configured
+func (c *Config) GetLocation() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.LoadLocation(defaultTimezone)
+	}
+	return time.LoadLocation(c.Timezone)
+}
+
+const defaultTimezone = "Asia/Tokyo"
+
+// Returns the settings of the dates for the spreadsheet, each of which
+// falls back to the global one
+func (c *Config) GetInvoiceDateSettings(sc *SpreadsheetConfig) (issueDate, dueDateRule, dateFormat string) {
+	issueDate, dueDateRule, dateFormat = c.IssueDate, c.DueDateRule, c.DateFormat
+	if sc.IssueDate != "" {
+		issueDate = sc.IssueDate
+	}
+	if sc.DueDateRule != "" {
+		dueDateRule = sc.DueDateRule
+	}
+	if sc.DateFormat != "" {
+		dateFormat = sc.DateFormat
+	}
+	if dateFormat == "" {
+		dateFormat = defaultInvoiceDateFormat
+	}
+	return
+}
+
+const defaultInvoiceDateFormat = "2006/01/02"
+
+// Returns the titles of leave events sorted
+func (c *Config) GetLeaveTitles() []string {
+	titles := make([]string, 0, len(c.LeaveTitles))
+	for title := range c.LeaveTitles {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+// Returns the title of a new month sheet in sheet_title_format, "200601" by
+// default
+func (c *Config) FormatSheetTitle(targetTime time.Time) string {
+	if c.SheetTitleFormat == "" {
+		return targetTime.Format("200601")
+	}
+	return targetTime.Format(c.SheetTitleFormat)
+}
+
+// Returns the writes to Sheets allowed per minute, 0 for no limit if
+// sheets_writes_per_minute is negative
+func (c *Config) GetSheetsWritesPerMinute() int {
+	switch {
+	case c.SheetsWritesPerMinute < 0:
+		return 0
+	case c.SheetsWritesPerMinute == 0:
+		return defaultSheetsWritesPerMinute
+	}
+	return c.SheetsWritesPerMinute
+}
+
+// Writes to Sheets per minute by default, under the quota of 60 per user
+const defaultSheetsWritesPerMinute = 50
+
+func (c *Config) GetUpdateRepository() string {
+	if c.UpdateRepository != "" {
+		return c.UpdateRepository
+	}
+	return defaultUpdateRepository
+}
+
+const defaultUpdateRepository = "tsujio/make-invoices"
+
+func (c *Config) GetSandboxMaxAge() (time.Duration, error) {
+	if c.SandboxMaxAge == "" {
+		return defaultSandboxMaxAge, nil
+	}
+	d, err := time.ParseDuration(c.SandboxMaxAge)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sandbox_max_age: %v", err)
+	}
+	return d, nil
+}
+
+// Sandbox copies are trashed after a week by default
+const defaultSandboxMaxAge = 7 * 24 * time.Hour
+
+// Anchors matching the layout of the original template
+var defaultTemplateAnchors = map[string]string{
+	"C6": "日付",
+	"D6": "開始",
+}
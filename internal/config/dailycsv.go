@@ -0,0 +1,44 @@
+package config
+
+// DailyCSVConfig is the CSV of the work of each day written with
+// export_daily_csv or --daily-csv, for payroll and accounting software.
+// Days off are not written. Columns are the ones of defaultDailyCSVColumns
+// by default, and formats are Go layouts. The file has the days of every
+// spreadsheet, named by name like combined_pdf_name, or with per_client a
+// file for each of them named by name getting the title and invoice number
+// too. Amounts are of the rate of each day before rounding and tax.
+type DailyCSVConfig struct {
+	Name       string   `json:"name"`
+	PerClient  bool     `json:"per_client"`
+	Columns    []string `json:"columns"`
+	DateFormat string   `json:"date_format"`
+	TimeFormat string   `json:"time_format"`
+}
+
+func (c *DailyCSVConfig) GetColumns() []string {
+	if len(c.Columns) > 0 {
+		return c.Columns
+	}
+	return defaultDailyCSVColumns
+}
+
+func (c *DailyCSVConfig) GetDateFormat() string {
+	if c.DateFormat != "" {
+		return c.DateFormat
+	}
+	return defaultDailyCSVDateFormat
+}
+
+func (c *DailyCSVConfig) GetTimeFormat() string {
+	if c.TimeFormat != "" {
+		return c.TimeFormat
+	}
+	return defaultDailyCSVTimeFormat
+}
+
+var defaultDailyCSVColumns = []string{"date", "client", "start", "end", "break", "hours", "amount"}
+
+const (
+	defaultDailyCSVDateFormat = "2006-01-02"
+	defaultDailyCSVTimeFormat = "15:04"
+)
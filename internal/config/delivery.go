@@ -0,0 +1,92 @@
+package config
+
+import "fmt"
+
+// DeliveryConfig is a way the outputs of a spreadsheet reach the client, run
+// after all of them are made. "local" leaves them in the output directory,
+// "drive_upload" uploads the pdfs, or the bundle with upload_bundle, to
+// folder_id or else drive_upload_folder_id, "email" sends them by email,
+// or else the email of the spreadsheet, with --send-email or --draft, and
+// "webhook" posts the paths and hashes of the outputs to url.
+type DeliveryConfig struct {
+	Type     string       `json:"type"`
+	FolderID string       `json:"folder_id"`
+	Email    *EmailConfig `json:"email"`
+	URL      string       `json:"url"`
+}
+
+// Returns the deliveries of the spreadsheet, or else the global ones.
+// Without either, outputs are uploaded if drive_upload_folder_id is set and
+// emailed if the spreadsheet has an email, as before deliveries.
+func (c *Config) GetDeliveries(sc *SpreadsheetConfig) []*DeliveryConfig {
+	if len(sc.Delivery) > 0 {
+		return sc.Delivery
+	}
+	if len(c.Delivery) > 0 {
+		return c.Delivery
+	}
+	deliveries := []*DeliveryConfig{{Type: DeliveryLocal}}
+	if c.DriveUploadFolderID != "" {
+		deliveries = append(deliveries, &DeliveryConfig{Type: DeliveryDriveUpload})
+	}
+	if sc.Email != nil {
+		deliveries = append(deliveries, &DeliveryConfig{Type: DeliveryEmail})
+	}
+	return deliveries
+}
+
+func (c *Config) ValidateDeliveries(sc *SpreadsheetConfig) error {
+	for _, d := range c.GetDeliveries(sc) {
+		switch d.Type {
+		case DeliveryLocal:
+		case DeliveryDriveUpload:
+			if d.GetFolderID(c) == "" {
+				return fmt.Errorf("delivery drive_upload needs folder_id or drive_upload_folder_id")
+			}
+		case DeliveryEmail:
+			if d.GetEmail(sc) == nil {
+				return fmt.Errorf("delivery email needs email of the delivery or of the spreadsheet")
+			}
+		case DeliveryWebhook:
+			if d.URL == "" {
+				return fmt.Errorf("delivery webhook needs url")
+			}
+		default:
+			return fmt.Errorf("unknown delivery type: %q (must be local, drive_upload, email or webhook)", d.Type)
+		}
+	}
+	return nil
+}
+
+func (d *DeliveryConfig) GetFolderID(config *Config) string {
+	if d.FolderID != "" {
+		return d.FolderID
+	}
+	return config.DriveUploadFolderID
+}
+
+func (d *DeliveryConfig) GetEmail(sc *SpreadsheetConfig) *EmailConfig {
+	if d.Email != nil {
+		return d.Email
+	}
+	return sc.Email
+}
+
+// Returns the emails the spreadsheet is delivered by
+func (c *Config) GetDeliveryEmails(sc *SpreadsheetConfig) []*EmailConfig {
+	emails := make([]*EmailConfig, 0)
+	for _, d := range c.GetDeliveries(sc) {
+		if d.Type == DeliveryEmail {
+			emails = append(emails, d.GetEmail(sc))
+		}
+	}
+	return emails
+}
+
+// Ways outputs are delivered to the client
+const (
+	DeliveryLocal       = "local"
+	DeliveryDriveUpload = "drive_upload"
+	DeliveryEmail       = "email"
+	DeliveryWebhook     = "webhook"
+)
@@ -0,0 +1,12 @@
+package config
+
+// EmailConfig is the email sending the outputs of a spreadsheet to the
+// client. Subject and Body are templates.
+type EmailConfig struct {
+	To      []string `json:"to"`
+	Cc      []string `json:"cc"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+	// Export formats to attach, pdf by default, or "zip" for the bundle
+	Attachments []string `json:"attachments"`
+}
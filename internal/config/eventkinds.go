@@ -0,0 +1,39 @@
+package config
+
+// EventKind is a kind of work told by the color of its calendar events, like
+// on-site, remote or training. Days of the kind are billed at rate if
+// given, in place of the rate of billing, and written as value, or else the
+// name, to event_kind_range. Days of events of colors of no kind are of the
+// default kind, if any.
+type EventKind struct {
+	Name     string   `json:"name"`
+	ColorIDs []string `json:"color_ids"`
+	Rate     *int64   `json:"rate"`
+	Value    string   `json:"value"`
+	Default  bool     `json:"default"`
+}
+
+// Returns the kind of the color, or the default kind if the color is of no
+// kind. ok is false in the latter case.
+func (c *Config) GetEventKind(colorID string) (kind *EventKind, ok bool) {
+	var def *EventKind
+	for _, k := range c.EventKinds {
+		for _, id := range k.ColorIDs {
+			if id == colorID {
+				return k, true
+			}
+		}
+		if k.Default {
+			def = k
+		}
+	}
+	return def, false
+}
+
+// Returns the value of the kind written to the sheet
+func (k *EventKind) CellValue() string {
+	if k.Value != "" {
+		return k.Value
+	}
+	return k.Name
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// HolidaysConfig tells where the public holidays come from when
+// holiday_calendar_id is not set. source is a URL or a path of a CSV having
+// dates like 2024/1/1 and names in the first two columns, the Japanese ones
+// by default, or "none" for no holidays. Fetched CSVs are cached for
+// cache_ttl. encoding is "shift_jis" or "utf-8", detected if empty.
+type HolidaysConfig struct {
+	Source   string `json:"source"`
+	Encoding string `json:"encoding"`
+	CacheTTL string `json:"cache_ttl"`
+}
+
+func (c *HolidaysConfig) Validate() error {
+	switch c.Encoding {
+	case "", "shift_jis", "utf-8":
+	default:
+		return fmt.Errorf("unknown encoding %q (want shift_jis or utf-8)", c.Encoding)
+	}
+	if c.CacheTTL != "" {
+		if _, err := time.ParseDuration(c.CacheTTL); err != nil {
+			return fmt.Errorf("failed to parse cache_ttl: %v", err)
+		}
+	}
+	return nil
+}
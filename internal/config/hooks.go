@@ -0,0 +1,16 @@
+package config
+
+// HooksConfig holds commands run after exports, given the results as json
+// on stdin and in environment variables. post_export runs for each
+// spreadsheet after its outputs are exported, and post_run once after all
+// spreadsheets. A failing hook fails the spreadsheet or the run unless
+// fail_on_error is false.
+type HooksConfig struct {
+	PostExport  []string `json:"post_export"`
+	PostRun     []string `json:"post_run"`
+	FailOnError *bool    `json:"fail_on_error"`
+}
+
+func (h *HooksConfig) FailsOnError() bool {
+	return h.FailOnError == nil || *h.FailOnError
+}
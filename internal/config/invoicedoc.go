@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// InvoiceDocumentConfig tells how a document like the invoice is made from
+// a template. key tells the documents of a spreadsheet apart and names
+// their pdfs like 202405Title.invoice.pdf, which are attached to emails as
+// invoice_pdf. template_id defaults to work_document_template_id of the
+// spreadsheet or the top level. With invoice_renderer "local", the pdf is
+// rendered from local_template instead without making a document. The
+// amount comes from billing.
+type InvoiceDocumentConfig struct {
+	Key           string `json:"key"`
+	TemplateID    string `json:"template_id"`
+	LocalTemplate string `json:"local_template"`
+	FolderID      string `json:"folder_id"`
+	Name          string `json:"name"`
+	// The document is exported to a pdf, which can be uploaded with the
+	// timesheets and merged into the combined pdf
+	UploadPDF            bool `json:"upload_pdf"`
+	IncludeInCombinedPDF bool `json:"include_in_combined_pdf"`
+	// Entry of work report days without event descriptions
+	DefaultEntry string `json:"default_entry"`
+
+	// Whether rendered by the local renderer
+	Local bool `json:"-"`
+	// Whether the work report, which has {{work_report}} in place of the
+	// work table
+	Report bool `json:"-"`
+}
+
+// Returns the invoice document settings of the spreadsheet, which replace
+// the global ones if any
+func (c *Config) GetInvoiceDocument(sc *SpreadsheetConfig) *InvoiceDocumentConfig {
+	if sc.InvoiceDocument != nil {
+		return sc.InvoiceDocument
+	}
+	if c.InvoiceDocument != nil {
+		return c.InvoiceDocument
+	}
+	return &InvoiceDocumentConfig{}
+}
+
+// Returns the documents made for the spreadsheet with their keys and
+// templates filled in. documents of the spreadsheet replace the single
+// invoice document.
+func (c *Config) GetDocuments(sc *SpreadsheetConfig) ([]*InvoiceDocumentConfig, error) {
+	templateID := sc.WorkDocumentTemplateID
+	if templateID == "" {
+		templateID = c.WorkDocumentTemplateID
+	}
+	renderer := sc.InvoiceRenderer
+	if renderer == "" {
+		renderer = c.InvoiceRenderer
+	}
+	switch renderer {
+	case "", "docs", "local":
+	default:
+		return nil, fmt.Errorf("unknown invoice_renderer %q (want docs or local)", renderer)
+	}
+	local := renderer == "local"
+	if local && c.InvoiceFontPath == "" {
+		return nil, fmt.Errorf("invoice_font_path is required for the local renderer")
+	}
+	list := sc.Documents
+	if len(list) == 0 && (templateID != "" || local) {
+		list = []*InvoiceDocumentConfig{c.GetInvoiceDocument(sc)}
+	}
+	documents := make([]*InvoiceDocumentConfig, 0, len(list))
+	keys := make(map[string]bool)
+	for _, d := range list {
+		dc := *d
+		if dc.Key == "" {
+			dc.Key = DefaultDocumentKey
+		}
+		if !documentKeyPattern.MatchString(dc.Key) {
+			return nil, fmt.Errorf("invalid document key %q (use a-z, 0-9, _ and -)", dc.Key)
+		}
+		if keys[dc.Key] {
+			return nil, fmt.Errorf("duplicate document key %q", dc.Key)
+		}
+		keys[dc.Key] = true
+		if dc.TemplateID == "" {
+			dc.TemplateID = templateID
+		}
+		dc.Local = local
+		if local && dc.LocalTemplate == "" {
+			return nil, fmt.Errorf("document %s has no local_template", dc.Key)
+		}
+		if !local && dc.TemplateID == "" {
+			return nil, fmt.Errorf("document %s has no template_id", dc.Key)
+		}
+		documents = append(documents, &dc)
+	}
+	// The work report is always made in Docs, named 作業報告書 by default
+	if sc.ReportDocument != nil {
+		dc := *sc.ReportDocument
+		if dc.Key == "" {
+			dc.Key = defaultReportKey
+		}
+		if !documentKeyPattern.MatchString(dc.Key) {
+			return nil, fmt.Errorf("invalid document key %q (use a-z, 0-9, _ and -)", dc.Key)
+		}
+		if keys[dc.Key] {
+			return nil, fmt.Errorf("duplicate document key %q", dc.Key)
+		}
+		if dc.TemplateID == "" {
+			return nil, fmt.Errorf("report_document has no template_id")
+		}
+		if dc.Name == "" {
+			dc.Name = defaultReportDocumentName
+		}
+		dc.Report = true
+		documents = append(documents, &dc)
+	}
+	if len(documents) == 0 {
+		return nil, nil
+	}
+	return documents, nil
+}
+
+// Returns the default name of the document, which has the key in place of
+// 請求書 for other documents than the invoice
+func (dc *InvoiceDocumentConfig) NameTemplate() string {
+	if dc.Name != "" {
+		return dc.Name
+	}
+	if dc.Key != DefaultDocumentKey {
+		return strings.TrimSuffix(defaultInvoiceDocumentName, "請求書") + dc.Key
+	}
+	return defaultInvoiceDocumentName
+}
+
+const (
+	DefaultDocumentKey         = "invoice"
+	defaultInvoiceDocumentName = `{{.Year}}{{printf "%02d" .Month}}{{.Title}} 請求書`
+)
+
+var documentKeyPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+const (
+	defaultReportKey          = "report"
+	defaultReportDocumentName = `{{.Year}}{{printf "%02d" .Month}}{{.Title}} 作業報告書`
+)
@@ -0,0 +1,40 @@
+package config
+
+import "fmt"
+
+// RowLayout places the rows of days apart, e.g. for templates having a
+// separator row after each week. Rows lists the row of each day explicitly.
+// Otherwise days start at StartRow, and a row is skipped after each day of
+// the month in SkipRowsAfter.
+type RowLayout struct {
+	StartRow      int   `json:"start_row"`
+	SkipRowsAfter []int `json:"skip_rows_after"`
+	Rows          []int `json:"rows"`
+}
+
+// Returns the one-based sheet rows of the given number of days
+func (l *RowLayout) Resolve(days int) ([]int, error) {
+	if len(l.Rows) > 0 {
+		if len(l.Rows) < days {
+			return nil, fmt.Errorf("row layout has %d rows, which is fewer than %d days to write", len(l.Rows), days)
+		}
+		return l.Rows[:days], nil
+	}
+	if l.StartRow < 1 {
+		return nil, fmt.Errorf("start_row of row layout must be 1 or greater")
+	}
+	skip := make(map[int]bool)
+	for _, d := range l.SkipRowsAfter {
+		skip[d] = true
+	}
+	rows := make([]int, 0, days)
+	row := l.StartRow
+	for day := 1; day <= days; day++ {
+		rows = append(rows, row)
+		row++
+		if skip[day] {
+			row++
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,10 @@
+package config
+
+// NonWorkingDaysConfig finds the days the sheet marks as non-working, by the
+// background colors of the day rows of the work times column or by values
+// in marker_range, a column having a row for each day. Work days on them
+// are confirmed before writing.
+type NonWorkingDaysConfig struct {
+	Colors      []string `json:"colors"`
+	MarkerRange string   `json:"marker_range"`
+}
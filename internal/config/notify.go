@@ -0,0 +1,9 @@
+package config
+
+// NotifyConfig is a webhook posted a summary of each run. The message is
+// posted as {"<message_field>": "..."}, where message_field is "text" for
+// Slack and Teams by default, and "content" for Discord.
+type NotifyConfig struct {
+	WebhookURL   string `json:"webhook_url"`
+	MessageField string `json:"message_field"`
+}
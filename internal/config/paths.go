@@ -0,0 +1,26 @@
+package config
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Resolves paths in the config relative to the executable
+func ResolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return PathSiblingOfExecutable(path)
+}
+
+// Returns the path of the file in the directory of the executable, or in
+// the working directory if the executable can't be found
+func PathSiblingOfExecutable(filename string) string {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Warning: failed to get executable path, using the working directory: %v\n", err)
+		return filename
+	}
+	return filepath.Join(filepath.Dir(exe), filename)
+}
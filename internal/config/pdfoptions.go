@@ -0,0 +1,25 @@
+package config
+
+// PDFOptions are the layout parameters of the export URL for pdf. Unset
+// options are left to the defaults of Google Sheets.
+type PDFOptions struct {
+	Size                string   `json:"size"`
+	Portrait            *bool    `json:"portrait"`
+	FitWidth            *bool    `json:"fitw"`
+	Gridlines           *bool    `json:"gridlines"`
+	PrintTitle          *bool    `json:"printtitle"`
+	TopMargin           *float64 `json:"top_margin"`
+	BottomMargin        *float64 `json:"bottom_margin"`
+	LeftMargin          *float64 `json:"left_margin"`
+	RightMargin         *float64 `json:"right_margin"`
+	HorizontalAlignment string   `json:"horizontal_alignment"`
+	// print_range of the spreadsheet, exported in place of the whole sheet
+	PrintRange string `json:"-"`
+}
+
+func (sc *SpreadsheetConfig) PdfOptions() *PDFOptions {
+	if sc == nil {
+		return nil
+	}
+	return sc.ExportPDFOptions
+}
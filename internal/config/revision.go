@@ -0,0 +1,32 @@
+package config
+
+// RevisionConfig is how revised invoices are told apart from the originals.
+// They are reissued with the original number and the marker, or with
+// new_number, get a new number referring to the original.
+type RevisionConfig struct {
+	NewNumber bool   `json:"new_number"`
+	Marker    string `json:"marker"`
+	// Cell of the sheet the marker is written to, cleared in other runs
+	Cell string `json:"cell"`
+}
+
+// Returns the revision config of the spreadsheet, or else the global one
+func (c *Config) GetRevision(sc *SpreadsheetConfig) *RevisionConfig {
+	rc := c.Revision
+	if sc != nil && sc.Revision != nil {
+		rc = sc.Revision
+	}
+	if rc == nil {
+		rc = &RevisionConfig{}
+	}
+	return rc
+}
+
+func (rc *RevisionConfig) GetMarker() string {
+	if rc.Marker == "" {
+		return defaultRevisionMarker
+	}
+	return rc.Marker
+}
+
+const defaultRevisionMarker = "(再発行)"
@@ -0,0 +1,7 @@
+package config
+
+// ServeConfig is for the serve command. Every request must have the secret
+// in the X-Make-Invoices-Secret header.
+type ServeConfig struct {
+	Secret string `json:"secret"`
+}
@@ -0,0 +1,20 @@
+package config
+
+// SummaryConfig tells the cells to write totals of the month to. A formula,
+// when given, is written to the cell instead of the computed value. The
+// amounts need billing to be configured.
+type SummaryConfig struct {
+	TotalDaysCell     string `json:"total_days_cell"`
+	TotalDaysFormula  string `json:"total_days_formula"`
+	TotalHoursCell    string `json:"total_hours_cell"`
+	TotalHoursFormula string `json:"total_hours_formula"`
+	BreakDuration     string `json:"break_duration"`
+	SubtotalCell      string `json:"subtotal_cell"`
+	TaxCell           string `json:"tax_cell"`
+	WithholdingCell   string `json:"withholding_cell"`
+	TotalCell         string `json:"total_cell"`
+}
+
+func (c *SummaryConfig) HasAmountCells() bool {
+	return c.SubtotalCell != "" || c.TaxCell != "" || c.WithholdingCell != "" || c.TotalCell != ""
+}
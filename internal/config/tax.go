@@ -0,0 +1,34 @@
+package config
+
+import "fmt"
+
+// TaxConfig tells the consumption tax added to the subtotal and whether
+// withholding tax is deducted from it. rate is in percent and the tax is
+// rounded to minor units of the currency by rounding, which is "down"
+// (default), "up" or "half_up".
+type TaxConfig struct {
+	Rate        int64  `json:"rate"`
+	Rounding    string `json:"rounding"`
+	Withholding bool   `json:"withholding"`
+}
+
+// Returns the tax settings of the spreadsheet, which replace the global
+// ones if any, or nil if no tax is computed
+func (c *Config) GetTax(sc *SpreadsheetConfig) *TaxConfig {
+	if sc.Tax != nil {
+		return sc.Tax
+	}
+	return c.Tax
+}
+
+func (t *TaxConfig) Validate() error {
+	if t.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	switch t.Rounding {
+	case "", "down", "up", "half_up":
+	default:
+		return fmt.Errorf("unknown rounding %q (want down, up or half_up)", t.Rounding)
+	}
+	return nil
+}
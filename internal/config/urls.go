@@ -0,0 +1,123 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var spreadsheetURLPattern = regexp.MustCompile(`^/spreadsheets/d/([A-Za-z0-9_-]+)`)
+
+// Parses a spreadsheet ID, or a spreadsheet URL copied from the browser like
+// https://docs.google.com/spreadsheets/d/<id>/edit#gid=0, returning the ID
+// and the gid of the URL if any
+func parseSpreadsheetRef(ref string) (id string, gid *int64, err error) {
+	if !strings.Contains(ref, "://") {
+		return ref, nil, nil
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Host != "docs.google.com" {
+		return "", nil, fmt.Errorf("invalid spreadsheet URL: %q (must be a spreadsheet ID or like https://docs.google.com/spreadsheets/d/<id>/edit)", ref)
+	}
+	m := spreadsheetURLPattern.FindStringSubmatch(u.Path)
+	if m == nil {
+		return "", nil, fmt.Errorf("invalid spreadsheet URL: %q (must be a spreadsheet ID or like https://docs.google.com/spreadsheets/d/<id>/edit)", ref)
+	}
+	for _, q := range []string{u.Fragment, u.RawQuery} {
+		if v, err := url.ParseQuery(q); err == nil && v.Get("gid") != "" {
+			n, err := strconv.ParseInt(v.Get("gid"), 10, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid gid in spreadsheet URL: %q", ref)
+			}
+			gid = &n
+		}
+	}
+	return m[1], gid, nil
+}
+
+// Parses a calendar ID, or a calendar URL copied from the browser, which is
+// an embed URL like https://calendar.google.com/calendar/embed?src=<id> or
+// a settings URL ending with /settings/calendar/<encoded id>. Other URLs are
+// iCalendar sources and returned as they are.
+func parseCalendarRef(ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Host != "calendar.google.com" || strings.HasSuffix(strings.ToLower(u.Path), ".ics") {
+		return ref, nil
+	}
+	if src := u.Query().Get("src"); src != "" {
+		return src, nil
+	}
+	if i := strings.Index(u.Path, "/settings/calendar/"); i >= 0 {
+		encoded := strings.TrimRight(u.Path[i+len("/settings/calendar/"):], "/")
+		id, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err == nil && len(id) > 0 {
+			return string(id), nil
+		}
+	}
+	return "", fmt.Errorf("invalid calendar URL: %q (must be a calendar ID, an iCalendar URL, or like https://calendar.google.com/calendar/embed?src=<id>)", ref)
+}
+
+// Replaces spreadsheet and calendar URLs in the config with their IDs
+func (c *Config) NormalizeRefs() error {
+	spreadsheets := make([]*SpreadsheetConfig, 0)
+	for _, ref := range c.WorkSpreadsheetIDs {
+		spreadsheets = append(spreadsheets, &SpreadsheetConfig{ID: ref})
+	}
+	c.WorkSpreadsheets = append(spreadsheets, c.WorkSpreadsheets...)
+	c.WorkSpreadsheetIDs = nil
+
+	var err error
+	for _, sc := range c.WorkSpreadsheets {
+		if sc.ID, sc.GIDHint, err = parseSpreadsheetRef(sc.ID); err != nil {
+			return err
+		}
+		if sc.CalendarID, err = parseCalendarRef(sc.CalendarID); err != nil {
+			return err
+		}
+		for i := range sc.CalendarIDs {
+			if sc.CalendarIDs[i], err = parseCalendarRef(sc.CalendarIDs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if c.ArchiveSpreadsheetID != "" {
+		if c.ArchiveSpreadsheetID, _, err = parseSpreadsheetRef(c.ArchiveSpreadsheetID); err != nil {
+			return err
+		}
+	}
+	if c.SummarySpreadsheetID != "" {
+		if c.SummarySpreadsheetID, _, err = parseSpreadsheetRef(c.SummarySpreadsheetID); err != nil {
+			return err
+		}
+	}
+	if c.AuditLogSpreadsheetID != "" {
+		if c.AuditLogSpreadsheetID, _, err = parseSpreadsheetRef(c.AuditLogSpreadsheetID); err != nil {
+			return err
+		}
+	}
+	if c.CalendarID, err = parseCalendarRef(c.CalendarID); err != nil {
+		return err
+	}
+	for i := range c.CalendarIDs {
+		if c.CalendarIDs[i], err = parseCalendarRef(c.CalendarIDs[i]); err != nil {
+			return err
+		}
+	}
+	if c.HolidayCalendarID, err = parseCalendarRef(c.HolidayCalendarID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Tells whether a calendar source is an iCalendar file path or URL rather
+// than a Google Calendar ID
+func IsICSSource(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasSuffix(lower, ".ics") ||
+		strings.HasPrefix(lower, "http://") ||
+		strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "webcal://")
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WeekdayString is a config value given as a string, or as an object of
+// strings keyed by weekday ("mon".."sun") with "default" for the others,
+// e.g. {"default": "9:00", "fri": "10:00"}
+type WeekdayString struct {
+	byKey map[string]string
+}
+
+func (v *WeekdayString) UnmarshalJSON(d []byte) error {
+	var s string
+	if err := json.Unmarshal(d, &s); err == nil {
+		v.byKey = map[string]string{"default": s}
+		return nil
+	}
+	v.byKey = nil
+	return json.Unmarshal(d, &v.byKey)
+}
+
+func (v *WeekdayString) Validate() error {
+	if v.byKey == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(v.byKey))
+	for k := range v.byKey {
+		keys = append(keys, k)
+	}
+	return validateWeekdayKeys(keys)
+}
+
+// Returns the value for the weekday, or "" if not set
+func (v *WeekdayString) Get(wd time.Weekday) string {
+	if s, ok := v.byKey[getWeekdayKey(wd)]; ok {
+		return s
+	}
+	return v.byKey["default"]
+}
+
+// WeekdayRate is a rate given as a number, or as an object of numbers keyed
+// by weekday like WeekdayString
+type WeekdayRate struct {
+	byKey map[string]int64
+}
+
+func (r *WeekdayRate) UnmarshalJSON(d []byte) error {
+	var n int64
+	if err := json.Unmarshal(d, &n); err == nil {
+		r.byKey = map[string]int64{"default": n}
+		return nil
+	}
+	r.byKey = nil
+	return json.Unmarshal(d, &r.byKey)
+}
+
+func (r *WeekdayRate) Validate() error {
+	keys := make([]string, 0, len(r.byKey))
+	for k, n := range r.byKey {
+		if n < 0 {
+			return fmt.Errorf("rate must not be negative")
+		}
+		keys = append(keys, k)
+	}
+	if r.byKey == nil {
+		return nil
+	}
+	return validateWeekdayKeys(keys)
+}
+
+// Returns the rate for the weekday
+func (r *WeekdayRate) Get(wd time.Weekday) int64 {
+	if n, ok := r.byKey[getWeekdayKey(wd)]; ok {
+		return n
+	}
+	return r.byKey["default"]
+}
+
+// Returns the rate of the days not given by weekday
+func (r *WeekdayRate) DefaultRate() int64 {
+	return r.byKey["default"]
+}
+
+// Tells whether some weekdays have their own rates
+func (r *WeekdayRate) ByWeekday() bool {
+	return len(r.byKey) > 1
+}
+
+// Returns the key of the weekday in config values by weekday, like "mon"
+func getWeekdayKey(wd time.Weekday) string {
+	return strings.ToLower(wd.String()[:3])
+}
+
+// Checks the keys of a config value by weekday, which are "default" and
+// "mon".."sun"
+func validateWeekdayKeys(keys []string) error {
+	sort.Strings(keys)
+	hasDefault := false
+	for _, k := range keys {
+		if k == "default" {
+			hasDefault = true
+			continue
+		}
+		if _, ok := weekdayNames[k]; !ok {
+			return fmt.Errorf("unknown weekday %q (want mon..sun or default)", k)
+		}
+	}
+	if !hasDefault {
+		return fmt.Errorf("default is required for the days not given")
+	}
+	return nil
+}
+
+func (r *WorkDayRule) Validate() error {
+	if len(r.Weekdays) == 0 {
+		return fmt.Errorf("weekdays is required")
+	}
+	for _, name := range r.Weekdays {
+		if _, ok := weekdayNames[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("unknown weekday %q", name)
+		}
+	}
+	return nil
+}
+
+// Returns the weekday of a name like "mon"
+func ParseWeekday(name string) (time.Weekday, bool) {
+	wd, ok := weekdayNames[strings.ToLower(name)]
+	return wd, ok
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WorkCSVConfig reads the work records of work_source "csv" from a CSV file
+// having a header row, like the ones exported by time trackers. Columns are
+// found by their header. Formats are Go layouts, and end times before the
+// start are on the next day. With tags, only the rows having one of them
+// in the comma separated tags column are read.
+type WorkCSVConfig struct {
+	Path       string         `json:"path"`
+	Columns    WorkCSVColumns `json:"columns"`
+	DateFormat string         `json:"date_format"`
+	TimeFormat string         `json:"time_format"`
+	Tags       []string       `json:"tags"`
+}
+
+// WorkCSVColumns are the headers of the columns of a work CSV
+type WorkCSVColumns struct {
+	Date  string `json:"date"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Tags  string `json:"tags"`
+}
+
+func (c *WorkCSVConfig) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if c.Columns.Date == "" || c.Columns.Start == "" || c.Columns.End == "" {
+		return fmt.Errorf("columns date, start and end are required")
+	}
+	if len(c.Tags) > 0 && c.Columns.Tags == "" {
+		return fmt.Errorf("tags need the tags column")
+	}
+	return nil
+}
+
+func (c *WorkCSVConfig) GetDateFormat() string {
+	if c.DateFormat != "" {
+		return c.DateFormat
+	}
+	return defaultWorkCSVDateFormat
+}
+
+func (c *WorkCSVConfig) GetTimeFormat() string {
+	if c.TimeFormat != "" {
+		return c.TimeFormat
+	}
+	return defaultWorkCSVTimeFormat
+}
+
+// WorkSourceConfig is a source of the work days of work_source "merge".
+// "calendar" finds work day events in calendar_ids, or else in the
+// calendars, "ics" in the iCalendar file or URL of url, "csv" reads the
+// work_csv of the source, or else the global one, and "rule" makes the days
+// of the weekday rule.
+type WorkSourceConfig struct {
+	Type        string         `json:"type"`
+	CalendarIDs []string       `json:"calendar_ids"`
+	URL         string         `json:"url"`
+	WorkCSV     *WorkCSVConfig `json:"work_csv"`
+	Rule        *WorkDayRule   `json:"rule"`
+}
+
+func (c *Config) ValidateWorkSources() error {
+	if len(c.WorkSources) == 0 {
+		return fmt.Errorf("work_sources is required for work_source merge")
+	}
+	switch c.WorkSourceMerge {
+	case "", WorkSourceMergeOverride, WorkSourceMergeKeepFirst:
+	default:
+		return fmt.Errorf("unknown work_source_merge %q (want override or keep_first)", c.WorkSourceMerge)
+	}
+	for i, s := range c.WorkSources {
+		switch s.Type {
+		case "calendar":
+		case "ics":
+			if !IsICSSource(s.URL) {
+				return fmt.Errorf("work_sources[%d]: url must be an iCalendar file or URL", i)
+			}
+		case "csv":
+			wc := s.WorkCSV
+			if wc == nil {
+				wc = c.WorkCSV
+			}
+			if wc == nil {
+				return fmt.Errorf("work_sources[%d]: work_csv is required", i)
+			}
+			if err := wc.Validate(); err != nil {
+				return fmt.Errorf("work_sources[%d]: work_csv: %v", i, err)
+			}
+		case "rule":
+			if s.Rule == nil {
+				return fmt.Errorf("work_sources[%d]: rule with weekdays is required", i)
+			}
+			if err := s.Rule.Validate(); err != nil {
+				return fmt.Errorf("work_sources[%d]: rule: %v", i, err)
+			}
+		default:
+			return fmt.Errorf("work_sources[%d]: unknown type %q (want calendar, ics, csv or rule)", i, s.Type)
+		}
+	}
+	return nil
+}
+
+// Returns the config the source reads work days with, having the filters
+// of the config
+func (s *WorkSourceConfig) GetConfig(config *Config) *Config {
+	cc := *config
+	cc.WorkSource = "calendar"
+	switch s.Type {
+	case "calendar":
+		if len(s.CalendarIDs) > 0 {
+			cc.CalendarSource = ""
+			cc.CalendarID, cc.CalendarIDs = "", s.CalendarIDs
+		}
+	case "ics":
+		cc.CalendarSource = s.URL
+	case "csv":
+		cc.WorkSource = "csv"
+		if s.WorkCSV != nil {
+			cc.WorkCSV = s.WorkCSV
+		}
+	}
+	return &cc
+}
+
+// Returns the name of the source in logs
+func (s *WorkSourceConfig) String() string {
+	switch s.Type {
+	case "calendar":
+		if len(s.CalendarIDs) > 0 {
+			return "calendar " + strings.Join(s.CalendarIDs, ", ")
+		}
+	case "ics":
+		return "ics " + s.URL
+	case "csv":
+		if s.WorkCSV != nil {
+			return "csv " + s.WorkCSV.Path
+		}
+	}
+	return s.Type
+}
+
+const (
+	defaultWorkCSVDateFormat = "2006-01-02"
+	defaultWorkCSVTimeFormat = "15:04:05"
+)
+
+// Ways work days found on the same date by several sources are merged
+const (
+	WorkSourceMergeOverride  = "override"
+	WorkSourceMergeKeepFirst = "keep_first"
+)
@@ -0,0 +1,91 @@
+// Package export downloads spreadsheets in the formats invoices are made
+// in, checks the downloads and names the files they are saved to.
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formats an output name template, which gets the year and month of the
+// target month, the spreadsheet title and the invoice number if assigned
+func FormatNameTemplate(name, text string, targetTime time.Time, title, invoiceNumber string) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, struct {
+		Year          int
+		Month         int
+		Title         string
+		InvoiceNumber string
+	}{targetTime.Year(), int(targetTime.Month()), title, invoiceNumber}); err != nil {
+		return "", fmt.Errorf("failed to format %s: %v", name, err)
+	}
+	return b.String(), nil
+}
+
+// Format is a format which month sheets can be exported in
+type Format struct {
+	Name     string
+	Ext      string
+	MimeType string
+	// Whether the export has only the target sheet rather than the whole file
+	SheetOnly bool
+	// Checks the content type, the head and the size of the download
+	Check func(contentType string, head []byte, size int64) error
+}
+
+var Formats = map[string]*Format{
+	"pdf":  {"pdf", "pdf", "application/pdf", true, checkPDF},
+	"csv":  {"csv", "csv", "text/csv", true, checkCSV},
+	"xlsx": {"xlsx", "xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", false, checkZip},
+	"ods":  {"ods", "ods", "application/x-vnd.oasis.opendocument.spreadsheet", false, checkZip},
+	// Values of the sheet fetched by the Sheets API rather than exported
+	"values_csv": {"values_csv", "values.csv", "", true, nil},
+}
+
+var pdfMagic = []byte("%PDF-")
+
+// Even a blank page exports to a larger pdf than this
+const minPDFSize = 1024
+
+// Checks that the exported content is a pdf rather than e.g. a sign in page
+func checkPDF(contentType string, head []byte, size int64) error {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil && mt != "application/pdf" {
+		return fmt.Errorf("exported content is not a pdf (content type %s)", mt)
+	}
+	if !bytes.HasPrefix(head, pdfMagic) {
+		return fmt.Errorf("exported content is not a pdf")
+	}
+	if size < minPDFSize {
+		return fmt.Errorf("exported pdf is too small (%d bytes)", size)
+	}
+	return nil
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+// xlsx and ods files are zip archives
+func checkZip(contentType string, head []byte, size int64) error {
+	if !bytes.HasPrefix(head, zipMagic) {
+		return fmt.Errorf("exported content is not a zip archive")
+	}
+	return nil
+}
+
+func checkCSV(contentType string, head []byte, size int64) error {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil && mt == "text/html" {
+		return fmt.Errorf("exported content is html rather than csv")
+	}
+	h := strings.ToLower(string(bytes.TrimSpace(head)))
+	if strings.HasPrefix(h, "<!doctype html") || strings.HasPrefix(h, "<html") {
+		return fmt.Errorf("exported content is html rather than csv")
+	}
+	return nil
+}
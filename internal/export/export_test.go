@@ -0,0 +1,36 @@
+package export
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatsCheck(t *testing.T) {
+	pdf := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte{' '}, minPDFSize)...)
+	tests := []struct {
+		name        string
+		format      string
+		contentType string
+		content     []byte
+		wantErr     bool
+	}{
+		{"pdf", "pdf", "application/pdf", pdf, false},
+		{"pdf of no content type", "pdf", "", pdf, false},
+		{"sign in page as pdf", "pdf", "text/html; charset=utf-8", []byte("<html>"), true},
+		{"pdf of another content type", "pdf", "text/plain", pdf, true},
+		{"small pdf", "pdf", "application/pdf", []byte("%PDF-1.4\n"), true},
+		{"xlsx", "xlsx", "", []byte("PK\x03\x04..."), false},
+		{"ods of no zip", "ods", "", []byte("<html>"), true},
+		{"csv", "csv", "text/csv", []byte("a,b\n1,2\n"), false},
+		{"html as csv", "csv", "text/html", []byte("a,b\n"), true},
+		{"html content as csv", "csv", "", []byte("  <!DOCTYPE html><html>"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Formats[tt.format].Check(tt.contentType, tt.content, int64(len(tt.content)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
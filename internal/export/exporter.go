@@ -0,0 +1,145 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Exporter downloads a spreadsheet, or only its sheet for the formats of
+// SheetOnly, in a format. query has the extra parameters of the export like
+// the pdf options, and header the headers of the request like Range.
+type Exporter interface {
+	Export(ctx context.Context, spreadsheetID string, sheetID int64, format *Format, query string, header http.Header) (*http.Response, error)
+}
+
+// URL exports by the export URL of spreadsheets, which can have only a sheet
+// and takes the query
+type URL struct {
+	Client *http.Client
+	// Base of the URL like "https://docs.google.com/"
+	Base string
+}
+
+// Returns the URL the sheet is exported from
+func (u *URL) Location(spreadsheetID string, sheetID int64, format *Format, query string) string {
+	url := fmt.Sprintf("%sspreadsheets/d/%s/export?format=%s", u.Base, spreadsheetID, format.Name)
+	if format.SheetOnly {
+		url += fmt.Sprintf("&gid=%d", sheetID)
+	}
+	if query != "" {
+		url += "&" + query
+	}
+	return url
+}
+
+func (u *URL) Export(ctx context.Context, spreadsheetID string, sheetID int64, format *Format, query string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.Location(spreadsheetID, sheetID, format, query), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return u.Client.Do(req)
+}
+
+// Drive exports the whole spreadsheet by the Drive API, ignoring the sheet
+// and the query
+type Drive struct {
+	Service *drive.Service
+}
+
+func (d *Drive) Export(ctx context.Context, spreadsheetID string, sheetID int64, format *Format, query string, header http.Header) (*http.Response, error) {
+	call := d.Service.Files.Export(spreadsheetID, format.MimeType).Context(ctx)
+	for k := range header {
+		call.Header().Set(k, header.Get(k))
+	}
+	return call.Download()
+}
+
+// DriveSheet exports only the sheet by the Drive API, which exports every
+// visible sheet, or only the first in csv. The spreadsheet is copied with
+// its formulas, the other sheets of the copy are hidden and the sheet is
+// moved first, and the copy is deleted when the response is closed. The
+// query is ignored.
+type DriveSheet struct {
+	Drive  *drive.Service
+	Sheets *sheets.Service
+	// Called with the error of deleting the copy, which is left in Drive
+	OnDeleteError func(copyID string, err error)
+}
+
+func (d *DriveSheet) Export(ctx context.Context, spreadsheetID string, sheetID int64, format *Format, query string, header http.Header) (*http.Response, error) {
+	f := &drive.File{Name: fmt.Sprintf("%s (export of sheet %d)", spreadsheetID, sheetID)}
+	copied, err := d.Drive.Files.Copy(spreadsheetID, f).SupportsAllDrives(true).Fields("id").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy spreadsheet: %w", err)
+	}
+	resp, err := d.exportCopy(ctx, copied.Id, sheetID, format, header)
+	if err != nil {
+		d.delete(copied.Id)
+		return nil, err
+	}
+	resp.Body = &deletingBody{ReadCloser: resp.Body, delete: func() { d.delete(copied.Id) }}
+	return resp, nil
+}
+
+func (d *DriveSheet) exportCopy(ctx context.Context, copyID string, sheetID int64, format *Format, header http.Header) (*http.Response, error) {
+	s, err := d.Sheets.Spreadsheets.Get(copyID).Fields("sheets.properties(sheetId,hidden)").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the copy of the spreadsheet: %w", err)
+	}
+	// The sheet is shown first, since a spreadsheet can't have every sheet
+	// hidden
+	requests := []*sheets.Request{{UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+		Properties: &sheets.SheetProperties{SheetId: sheetID, Index: 0, Hidden: false, ForceSendFields: []string{"Index", "Hidden"}},
+		Fields:     "index,hidden",
+	}}}
+	found := false
+	for _, sh := range s.Sheets {
+		if sh.Properties.SheetId == sheetID {
+			found = true
+			continue
+		}
+		if !sh.Properties.Hidden {
+			requests = append(requests, &sheets.Request{UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+				Properties: &sheets.SheetProperties{SheetId: sh.Properties.SheetId, Hidden: true},
+				Fields:     "hidden",
+			}})
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no sheet %d in the spreadsheet", sheetID)
+	}
+	if _, err := d.Sheets.Spreadsheets.BatchUpdate(copyID, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).Context(ctx).Do(); err != nil {
+		return nil, fmt.Errorf("failed to hide the other sheets of the copy: %w", err)
+	}
+	return (&Drive{Service: d.Drive}).Export(ctx, copyID, sheetID, format, "", header)
+}
+
+// Deletes the copy, even after the export is canceled
+func (d *DriveSheet) delete(copyID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := d.Drive.Files.Delete(copyID).SupportsAllDrives(true).Context(ctx).Do(); err != nil && d.OnDeleteError != nil {
+		d.OnDeleteError(copyID, err)
+	}
+}
+
+// deletingBody deletes the copy exported once closed
+type deletingBody struct {
+	io.ReadCloser
+	once   sync.Once
+	delete func()
+}
+
+func (b *deletingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.delete)
+	return err
+}
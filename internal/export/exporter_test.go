@@ -0,0 +1,174 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestURLLocation(t *testing.T) {
+	u := &URL{Base: "https://docs.google.com/"}
+	tests := []struct {
+		name, format, query, want string
+	}{
+		{"sheet with the query", "pdf", "size=A4", "https://docs.google.com/spreadsheets/d/ss/export?format=pdf&gid=42&size=A4"},
+		{"whole file", "xlsx", "", "https://docs.google.com/spreadsheets/d/ss/export?format=xlsx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := u.Location("ss", 42, Formats[tt.format], tt.query); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURLExport(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte("a,b\n"))
+	}))
+	defer server.Close()
+
+	u := &URL{Client: server.Client(), Base: server.URL + "/"}
+	header := make(http.Header)
+	header.Set("Range", "bytes=10-")
+	resp, err := u.Export(context.Background(), "ss", 7, Formats["csv"], "", header)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "a,b\n" {
+		t.Errorf("got body %q", body)
+	}
+	if got.URL.String() != "/spreadsheets/d/ss/export?format=csv&gid=7" {
+		t.Errorf("got request to %s", got.URL)
+	}
+	if got.Header.Get("Range") != "bytes=10-" {
+		t.Errorf("got Range %q", got.Header.Get("Range"))
+	}
+}
+
+func TestURLExportCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	u := &URL{Client: server.Client(), Base: server.URL + "/"}
+	if _, err := u.Export(ctx, "ss", 0, Formats["pdf"], "", make(http.Header)); err == nil {
+		t.Fatal("want error of the cancelled context")
+	}
+}
+
+// Starts a server answering the requests of DriveSheet for the spreadsheet
+// "ss" having the sheets 1, 2 and 3, in which 3 is hidden, the export
+// answered with the status. The requests are kept with the bodies of
+// batchUpdate.
+func newDriveSheetServer(t *testing.T, exportStatus int) (*DriveSheet, *[]string, *sheets.BatchUpdateSpreadsheetRequest) {
+	t.Helper()
+	requests := make([]string, 0)
+	var update sheets.BatchUpdateSpreadsheetRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method + " " + r.URL.Path {
+		case "POST /drive/v3/files/ss/copy":
+			w.Write([]byte(`{"id": "copy"}`))
+		case "GET /v4/spreadsheets/copy":
+			w.Write([]byte(`{"sheets": [{"properties": {"sheetId": 1}}, {"properties": {"sheetId": 2}}, {"properties": {"sheetId": 3, "hidden": true}}]}`))
+		case "POST /v4/spreadsheets/copy:batchUpdate":
+			json.NewDecoder(r.Body).Decode(&update)
+			w.Write([]byte(`{}`))
+		case "GET /drive/v3/files/copy/export":
+			w.WriteHeader(exportStatus)
+			w.Write([]byte("a,b\n"))
+		case "DELETE /drive/v3/files/copy":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+	drv, err := drive.NewService(ctx, option.WithHTTPClient(server.Client()), option.WithEndpoint(server.URL+"/drive/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sht, err := sheets.NewService(ctx, option.WithHTTPClient(server.Client()), option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DriveSheet{Drive: drv, Sheets: sht}, &requests, &update
+}
+
+func TestDriveSheetExport(t *testing.T) {
+	d, requests, update := newDriveSheetServer(t, http.StatusOK)
+	resp, err := d.Export(context.Background(), "ss", 2, Formats["csv"], "size=A4", make(http.Header))
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "a,b\n" {
+		t.Errorf("got body %q", body)
+	}
+	if n := len(*requests); n != 4 {
+		t.Errorf("copy deleted before the response is closed: %v", *requests)
+	}
+	resp.Body.Close()
+	resp.Body.Close()
+
+	want := []string{
+		"POST /drive/v3/files/ss/copy",
+		"GET /v4/spreadsheets/copy",
+		"POST /v4/spreadsheets/copy:batchUpdate",
+		"GET /drive/v3/files/copy/export",
+		"DELETE /drive/v3/files/copy",
+	}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("got requests %v, want %v", *requests, want)
+	}
+	// The sheet is shown and moved first, and only the visible others are
+	// hidden
+	got := make([]string, 0)
+	for _, r := range update.Requests {
+		p := r.UpdateSheetProperties.Properties
+		got = append(got, fmt.Sprintf("%d %s index=%d hidden=%t", p.SheetId, r.UpdateSheetProperties.Fields, p.Index, p.Hidden))
+	}
+	if want := []string{"2 index,hidden index=0 hidden=false", "1 hidden index=0 hidden=true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got updates %v, want %v", got, want)
+	}
+}
+
+func TestDriveSheetExportFailed(t *testing.T) {
+	d, requests, _ := newDriveSheetServer(t, http.StatusInternalServerError)
+	if _, err := d.Export(context.Background(), "ss", 2, Formats["pdf"], "", make(http.Header)); err == nil {
+		t.Fatal("want error of the failed export")
+	}
+	if got := (*requests)[len(*requests)-1]; got != "DELETE /drive/v3/files/copy" {
+		t.Errorf("copy of the failed export not deleted: %v", *requests)
+	}
+}
+
+func TestDriveSheetExportNoSheet(t *testing.T) {
+	d, requests, _ := newDriveSheetServer(t, http.StatusOK)
+	if _, err := d.Export(context.Background(), "ss", 9, Formats["pdf"], "", make(http.Header)); err == nil {
+		t.Fatal("want error of the missing sheet")
+	}
+	want := []string{"POST /drive/v3/files/ss/copy", "GET /v4/spreadsheets/copy", "DELETE /drive/v3/files/copy"}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("got requests %v, want %v", *requests, want)
+	}
+}
@@ -0,0 +1,63 @@
+package export
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Most filesystems allow 255 bytes, from which room is left for suffixes
+// like " (2)" of on_existing_output and ".part" of downloads
+const maxFileNameBytes = 200
+
+// Names Windows doesn't allow for files, with any extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Returns the file name of stem and ext which is valid on Windows, macOS and
+// Linux. Characters not allowed are replaced with "_", runs of spaces are
+// collapsed, trailing dots and spaces are trimmed and the stem is cut at a
+// character boundary to fit maxFileNameBytes with ext.
+func SanitizeFileName(stem, ext string) string {
+	clean := func(s string) string {
+		s = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return ' '
+			}
+			if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+				return '_'
+			}
+			return r
+		}, s)
+		return strings.Join(strings.Fields(s), " ")
+	}
+	stem, ext = clean(stem), strings.TrimRight(clean(ext), ". ")
+	stem = strings.TrimRight(stem, ". ")
+	for len(stem)+len(ext) > maxFileNameBytes && stem != "" {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = strings.TrimRight(stem[:len(stem)-size], ". ")
+	}
+	if stem == "" {
+		stem = "_"
+	}
+	base := stem
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		stem = "_" + stem
+	}
+	return stem + ext
+}
+
+// Sanitizes the last element of the path, leaving the directories as they
+// are
+func SanitizeFilePath(path string) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	return dir + SanitizeFileName(strings.TrimSuffix(base, ext), ext)
+}
@@ -0,0 +1,72 @@
+package export
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name, stem, ext, want string
+	}{
+		{"valid name", "202405_invoice", ".pdf", "202405_invoice.pdf"},
+		{"characters not allowed", `a<b>c:d"e/f\g|h?i*j`, ".pdf", "a_b_c_d_e_f_g_h_i_j.pdf"},
+		{"control characters", "a\x01b\x7fc", ".pdf", "a_b_c.pdf"},
+		{"runs of spaces", "a \t\n b", ".pdf", "a b.pdf"},
+		{"trailing dots and spaces", "invoice. .", ".pdf", "invoice.pdf"},
+		{"empty stem", "", ".pdf", "_.pdf"},
+		{"reserved name", "con", ".pdf", "_con.pdf"},
+		{"reserved name with an extension", "NUL.tar", ".gz", "_NUL.tar.gz"},
+		{"not reserved", "console", ".pdf", "console.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFileName(tt.stem, tt.ext); got != tt.want {
+				t.Errorf("SanitizeFileName(%q, %q) = %q, want %q", tt.stem, tt.ext, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileNameLength(t *testing.T) {
+	got := SanitizeFileName(strings.Repeat("請求書", 100), ".pdf")
+	if len(got) > maxFileNameBytes {
+		t.Fatalf("got %d bytes, want at most %d", len(got), maxFileNameBytes)
+	}
+	if !utf8.ValidString(got) || !strings.HasSuffix(got, ".pdf") {
+		t.Errorf("got %q, want the stem cut at a character boundary", got)
+	}
+}
+
+func TestSanitizeFilePath(t *testing.T) {
+	got := SanitizeFilePath("out/2024:05/a?b.pdf")
+	if want := "out/2024:05/a_b.pdf"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFormatNameTemplate(t *testing.T) {
+	target := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name, text, want string
+		wantErr          bool
+	}{
+		{"year and month", "{{.Year}}{{printf \"%02d\" .Month}}", "202405", false},
+		{"title and number", "{{.Title}}_{{.InvoiceNumber}}", "A&B_INV-7", false},
+		{"parse error", "{{.Year", "", true},
+		{"unknown field", "{{.Client}}", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatNameTemplate("output_name", tt.text, target, "A&B", "INV-7")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FormatNameTemplate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
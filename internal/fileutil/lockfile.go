@@ -0,0 +1,73 @@
+// Package fileutil has the files shared by runs of the command: lock files
+// and files replaced atomically.
+package fileutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lock files without a pid are taken as left by crashed runs after this long.
+// The pid is written right after creating the file, so only a run which
+// crashed in between leaves such a file.
+const staleLockAge = 10 * time.Minute
+
+// How long to wait for other runs holding a lock
+var lockWait = 30 * time.Second
+
+// Takes the lock file of what, waiting for other runs holding it, and
+// returns the function releasing it. The lock is advisory: it keeps runs of
+// the tool from interleaving, having the pid of the holder in the file. A
+// lock whose holder is no longer running is removed.
+func AcquireLockFile(lockPath, what string) (func(), error) {
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to lock %s: %v", what, err)
+		}
+		if removeStaleLockFile(lockPath) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another run (remove %s if no run is going on)", what, lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Removes the lock file if its holder is not running, reporting whether it
+// was removed
+func removeStaleLockFile(lockPath string) bool {
+	d, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		// Released in the meantime
+		return os.IsNotExist(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(d)))
+	if err != nil || pid <= 0 {
+		fi, err := os.Stat(lockPath)
+		if err != nil || time.Since(fi.ModTime()) <= staleLockAge {
+			return false
+		}
+	} else if pid == os.Getpid() || processExists(pid) {
+		return false
+	}
+	// The lock may have been taken again by another run since it was read
+	if again, err := ioutil.ReadFile(lockPath); err != nil || string(again) != string(d) {
+		return false
+	}
+	log.Printf("Removing stale lock file %s\n", lockPath)
+	os.Remove(lockPath)
+	return true
+}
@@ -0,0 +1,85 @@
+package fileutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns the pid of a process which has exited
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func setLockWait(t *testing.T, d time.Duration) {
+	t.Helper()
+	saved := lockWait
+	lockWait = d
+	t.Cleanup(func() { lockWait = saved })
+}
+
+func writeLockFile(t *testing.T, content string, modTime time.Time) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token.json.lock")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAcquireLockFile(t *testing.T) {
+	setLockWait(t, 300*time.Millisecond)
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	tests := []struct {
+		name    string
+		content string
+		modTime time.Time
+		locked  bool
+	}{
+		{"holder exited", fmt.Sprintf("%d\n", exitedPID(t)), now, false},
+		{"holder running", fmt.Sprintf("%d\n", os.Getppid()), old, true},
+		{"this run", fmt.Sprintf("%d\n", os.Getpid()), old, true},
+		{"no pid", "", now, true},
+		{"no pid for long", "", old, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeLockFile(t, tt.content, tt.modTime)
+			unlock, err := AcquireLockFile(path, "token file")
+			if tt.locked {
+				if err == nil {
+					unlock()
+					t.Fatal("want locked")
+				}
+				if d, err := ioutil.ReadFile(path); err != nil || string(d) != tt.content {
+					t.Errorf("lock file = %q, %v; want kept", d, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := ioutil.ReadFile(path)
+			if err != nil || string(d) != fmt.Sprintf("%d\n", os.Getpid()) {
+				t.Errorf("lock file = %q, %v; want the pid of the run", d, err)
+			}
+			unlock()
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("lock file is left after unlocking: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package fileutil
+
+import "syscall"
+
+// Reports whether the process of the pid is running
+func processExists(pid int) bool {
+	// Signal 0 only checks the process. EPERM means it runs as another user.
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package fileutil
+
+import "os"
+
+// Reports whether the process of the pid is running
+func processExists(pid int) bool {
+	// Finding a process opens it, which fails if there is no such process
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
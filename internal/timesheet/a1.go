@@ -0,0 +1,100 @@
+// Package timesheet reads and writes the timesheets, which are the month
+// sheets of the spreadsheets, in A1 notation.
+package timesheet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Parses a cell reference like "D7" into zero-based column and row indexes
+func ParseA1Cell(ref string) (col, row int, err error) {
+	i := 0
+	for i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z' {
+		col = col*26 + int(ref[i]-'A'+1)
+		i++
+	}
+	if i == 0 || i == len(ref) {
+		return 0, 0, fmt.Errorf("invalid cell reference: %q", ref)
+	}
+	row, err = strconv.Atoi(ref[i:])
+	if err != nil || row < 1 {
+		return 0, 0, fmt.Errorf("invalid cell reference: %q", ref)
+	}
+	return col - 1, row - 1, nil
+}
+
+// Returns the number of rows and columns of a range like "D7:D37"
+func A1RangeSize(r string) (rows, cols int, err error) {
+	parts := strings.SplitN(r, ":", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	c1, r1, err := ParseA1Cell(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	c2, r2, err := ParseA1Cell(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return r2 - r1 + 1, c2 - c1 + 1, nil
+}
+
+// Formats zero-based column and row indexes as a cell reference like "D7"
+func FormatA1Cell(col, row int) string {
+	name := ""
+	for c := col + 1; c > 0; c = (c - 1) / 26 {
+		name = string(rune('A'+(c-1)%26)) + name
+	}
+	return name + strconv.Itoa(row+1)
+}
+
+// Returns the range of the given number of rows starting at the top-left
+// cell of r, e.g. "D7:D37" with 28 rows is "D7:D34"
+func ResizeA1Range(r string, rows int) (string, error) {
+	parts := strings.SplitN(r, ":", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	c1, r1, err := ParseA1Cell(parts[0])
+	if err != nil {
+		return "", err
+	}
+	c2, _, err := ParseA1Cell(parts[1])
+	if err != nil {
+		return "", err
+	}
+	return FormatA1Cell(c1, r1) + ":" + FormatA1Cell(c2, r1+rows-1), nil
+}
+
+// Quotes a sheet title for use in A1 notation, doubling single quotes in it
+func QuoteSheetTitle(title string) string {
+	return "'" + strings.ReplaceAll(title, "'", "''") + "'"
+}
+
+// Resolves a reference to a range, which is either in A1 notation or the
+// name of a named range prefixed with "name:", e.g. "name:InvoiceDate"
+func ResolveA1Range(ref string, namedRanges []*sheets.NamedRange) (string, error) {
+	if !strings.HasPrefix(ref, "name:") {
+		return ref, nil
+	}
+	name := strings.TrimPrefix(ref, "name:")
+	names := make([]string, 0, len(namedRanges))
+	for _, nr := range namedRanges {
+		if nr.Name != name {
+			names = append(names, nr.Name)
+			continue
+		}
+		gr := nr.Range
+		if gr == nil || gr.EndRowIndex == 0 || gr.EndColumnIndex == 0 {
+			return "", fmt.Errorf("named range %s is not bounded", name)
+		}
+		return FormatA1Cell(int(gr.StartColumnIndex), int(gr.StartRowIndex)) + ":" +
+			FormatA1Cell(int(gr.EndColumnIndex)-1, int(gr.EndRowIndex)-1), nil
+	}
+	return "", fmt.Errorf("named range %s not found (named ranges: %s)", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,31 @@
+package timesheet
+
+import (
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Day 0 of the serial numbers of dates and times in Google Sheets
+var SheetsEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// Returns the values of the run in a column of the sheet, from the cell of
+// each of its days. Nil cells are left as they are by the API.
+func RunValues(sheetTitle string, run Run, cell func(day int) interface{}) *sheets.ValueRange {
+	values := make([][]interface{}, 0, run.Count)
+	for i := run.First; i < run.First+run.Count; i++ {
+		values = append(values, []interface{}{cell(i)})
+	}
+	return &sheets.ValueRange{
+		Range:  QuoteSheetTitle(sheetTitle) + "!" + run.Range,
+		Values: values,
+	}
+}
+
+// Returns the value of a single cell of the sheet
+func CellValue(sheetTitle, cell string, v interface{}) *sheets.ValueRange {
+	return &sheets.ValueRange{
+		Range:  QuoteSheetTitle(sheetTitle) + "!" + cell,
+		Values: [][]interface{}{{v}},
+	}
+}
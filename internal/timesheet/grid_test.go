@@ -0,0 +1,48 @@
+package timesheet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDayRuns(t *testing.T) {
+	runs, err := DayRuns("D7:D37", []int{7, 8, 9, 11, 12, 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Run{
+		{Range: "D7:D9", First: 0, Count: 3},
+		{Range: "D11:D12", First: 3, Count: 2},
+		{Range: "D20:D20", First: 5, Count: 1},
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("got %+v, want %+v", runs, want)
+	}
+	if _, err := DayRuns("7:37", []int{7}); err == nil {
+		t.Errorf("want error of a range without a column")
+	}
+}
+
+func TestRunValues(t *testing.T) {
+	run := Run{Range: "D11:D12", First: 3, Count: 2}
+	vr := RunValues("2024'05", run, func(day int) interface{} {
+		if day == 4 {
+			return nil
+		}
+		return day
+	})
+	if vr.Range != "'2024''05'!D11:D12" {
+		t.Errorf("got range %s", vr.Range)
+	}
+	// A row for each day of the run, nil for the cells left as they are
+	if want := [][]interface{}{{3}, {nil}}; !reflect.DeepEqual(vr.Values, want) {
+		t.Errorf("got values %v, want %v", vr.Values, want)
+	}
+}
+
+func TestCellValue(t *testing.T) {
+	vr := CellValue("202405", "M3", "2024/05/01")
+	if vr.Range != "'202405'!M3" || !reflect.DeepEqual(vr.Values, [][]interface{}{{"2024/05/01"}}) {
+		t.Errorf("got %s %v", vr.Range, vr.Values)
+	}
+}
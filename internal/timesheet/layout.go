@@ -0,0 +1,70 @@
+package timesheet
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Run is a block of consecutive rows in a day column, holding the days from
+// First
+type Run struct {
+	Range string
+	First int
+	Count int
+}
+
+// Splits the column of rng into blocks of the rows of days
+func DayRuns(rng string, rows []int) ([]Run, error) {
+	col, _, err := ParseA1Cell(strings.SplitN(rng, ":", 2)[0])
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]Run, 0)
+	for i := 0; i < len(rows); {
+		j := i + 1
+		for j < len(rows) && rows[j] == rows[j-1]+1 {
+			j++
+		}
+		runs = append(runs, Run{
+			Range: FormatA1Cell(col, rows[i]-1) + ":" + FormatA1Cell(col, rows[j-1]-1),
+			First: i,
+			Count: j - i,
+		})
+		i = j
+	}
+	return runs, nil
+}
+
+// Checks that no cell is written twice and that all cells are in the sheet
+func ValidateRanges(ranges []string, props *sheets.GridProperties) error {
+	written := make(map[string]string)
+	for _, r := range ranges {
+		parts := strings.SplitN(r, ":", 2)
+		if len(parts) == 1 {
+			parts = append(parts, parts[0])
+		}
+		c1, r1, err := ParseA1Cell(parts[0])
+		if err != nil {
+			return err
+		}
+		c2, r2, err := ParseA1Cell(parts[1])
+		if err != nil {
+			return err
+		}
+		if props != nil && (int64(r2) >= props.RowCount || int64(c2) >= props.ColumnCount) {
+			return fmt.Errorf("range %s exceeds the sheet of %d rows and %d columns", r, props.RowCount, props.ColumnCount)
+		}
+		for row := r1; row <= r2; row++ {
+			for col := c1; col <= c2; col++ {
+				cell := FormatA1Cell(col, row)
+				if other, ok := written[cell]; ok {
+					return fmt.Errorf("ranges %s and %s overlap at %s", other, r, cell)
+				}
+				written[cell] = r
+			}
+		}
+	}
+	return nil
+}
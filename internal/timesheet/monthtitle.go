@@ -0,0 +1,84 @@
+package timesheet
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+var monthTitlePattern = regexp.MustCompile(`^([0-9]{4})(?:[/-]?([0-9]{2})|年([0-9]{1,2})月)$`)
+
+// Parses a sheet title naming a month, like "202405", "2024/05", "2024-05"
+// or "2024年5月"
+func ParseMonthTitle(title string, loc *time.Location) (time.Time, bool) {
+	m := monthTitlePattern.FindStringSubmatch(title)
+	if m == nil {
+		return time.Time{}, false
+	}
+	year, _ := strconv.Atoi(m[1])
+	monthStr := m[2]
+	if monthStr == "" {
+		monthStr = m[3]
+	}
+	month, _ := strconv.Atoi(monthStr)
+	if month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, loc), true
+}
+
+// Returns the month sheets keyed by month like "200601". Two sheets of the
+// same month are an error.
+func MonthSheets(spreadsheet *sheets.Spreadsheet, loc *time.Location) (map[string]*sheets.Sheet, error) {
+	months := make(map[string]*sheets.Sheet)
+	for _, s := range spreadsheet.Sheets {
+		month, ok := ParseMonthTitle(s.Properties.Title, loc)
+		if !ok {
+			continue
+		}
+		key := month.Format("200601")
+		if other, ok := months[key]; ok {
+			return nil, fmt.Errorf("sheets %s and %s are both of %s", other.Properties.Title, s.Properties.Title, key)
+		}
+		months[key] = s
+	}
+	return months, nil
+}
+
+// Returns a copy of the spreadsheet without the sheet titled title
+func WithoutSheet(spreadsheet *sheets.Spreadsheet, title string) *sheets.Spreadsheet {
+	s := *spreadsheet
+	s.Sheets = make([]*sheets.Sheet, 0, len(spreadsheet.Sheets))
+	for _, sheet := range spreadsheet.Sheets {
+		if sheet.Properties.Title != title {
+			s.Sheets = append(s.Sheets, sheet)
+		}
+	}
+	return &s
+}
+
+var dateCellLayouts = []string{"2006/1/2", "2006-1-2", "2006年1月2日"}
+
+// Returns the month of the date in a cell read unformatted, which is a
+// serial number, or text if the sheet doesn't take it as a date. ok is
+// false if the cell has no date.
+func ParseCellMonth(v interface{}, loc *time.Location) (month time.Time, ok bool) {
+	switch v := v.(type) {
+	case float64:
+		t := SheetsEpoch.AddDate(0, 0, int(v))
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc), true
+	case string:
+		s := strings.TrimSpace(v)
+		for _, layout := range dateCellLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc), true
+			}
+		}
+		return ParseMonthTitle(s, loc)
+	}
+	return time.Time{}, false
+}
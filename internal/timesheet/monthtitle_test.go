@@ -0,0 +1,155 @@
+package timesheet
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+func newTestSpreadsheet(sheetIDs map[string]int64, titles ...string) *sheets.Spreadsheet {
+	s := &sheets.Spreadsheet{}
+	for _, title := range titles {
+		s.Sheets = append(s.Sheets, &sheets.Sheet{
+			Properties: &sheets.SheetProperties{SheetId: sheetIDs[title], Title: title},
+		})
+	}
+	return s
+}
+
+func TestParseMonthTitle(t *testing.T) {
+	loc := time.FixedZone("JST", 9*60*60)
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"202405", "202405"},
+		{"2024/05", "202405"},
+		{"2024-05", "202405"},
+		{"2024年5月", "202405"},
+		{"2024年12月", "202412"},
+		{"202413", ""},
+		{"2024年0月", ""},
+		{"2024/5", ""},
+		{"202405 (再発行)", ""},
+		{"Summary", ""},
+		{"2024W19", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			month, ok := ParseMonthTitle(tt.title, loc)
+			got := ""
+			if ok {
+				got = month.Format("200601")
+				if month.Location() != loc || month.Day() != 1 || month.Hour() != 0 {
+					t.Errorf("got %v, want the first day of the month in loc", month)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("ParseMonthTitle(%q) = %q, want %q", tt.title, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCellMonth(t *testing.T) {
+	loc := time.FixedZone("JST", 9*60*60)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		// 45413 is 2024-05-01
+		{"serial number", 45413.0, "202405"},
+		{"date text", "2024/5/1", "202405"},
+		{"date text with dashes", " 2024-05-31 ", "202405"},
+		{"japanese date", "2024年5月1日", "202405"},
+		{"month text", "2024年5月", "202405"},
+		{"no date", "請求書", ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			month, ok := ParseCellMonth(tt.value, loc)
+			got := ""
+			if ok {
+				got = month.Format("200601")
+			}
+			if got != tt.want {
+				t.Errorf("ParseCellMonth(%v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonthSheets(t *testing.T) {
+	loc := time.FixedZone("JST", 9*60*60)
+	tests := []struct {
+		name    string
+		titles  []string
+		ids     map[string]int64
+		month   string
+		wantID  int64
+		found   bool
+		wantErr bool
+	}{
+		{
+			name:   "sheet of the month with ID 0",
+			titles: []string{"202206", "202205"},
+			ids:    map[string]int64{"202206": 0, "202205": 1234},
+			month:  "202206",
+			wantID: 0,
+			found:  true,
+		},
+		{
+			name:   "other sheet with ID 0",
+			titles: []string{"Summary", "202206"},
+			ids:    map[string]int64{"Summary": 0, "202206": 55},
+			month:  "202206",
+			wantID: 55,
+			found:  true,
+		},
+		{
+			name:   "only another month has ID 0",
+			titles: []string{"202205"},
+			ids:    map[string]int64{"202205": 0},
+			month:  "202206",
+		},
+		{
+			name:   "title forms",
+			titles: []string{"2022年6月", "2022/05"},
+			ids:    map[string]int64{"2022年6月": 0, "2022/05": 1},
+			month:  "202206",
+			wantID: 0,
+			found:  true,
+		},
+		{
+			name:    "two sheets of the month",
+			titles:  []string{"202206", "2022-06"},
+			ids:     map[string]int64{"202206": 0, "2022-06": 1},
+			month:   "202206",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			months, err := MonthSheets(newTestSpreadsheet(tt.ids, tt.titles...), loc)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MonthSheets: %v", err)
+			}
+			s, ok := months[tt.month]
+			if ok != tt.found {
+				t.Fatalf("found %v, want %v", ok, tt.found)
+			}
+			if ok && s.Properties.SheetId != tt.wantID {
+				t.Fatalf("got sheet ID %d, want %d", s.Properties.SheetId, tt.wantID)
+			}
+		})
+	}
+}
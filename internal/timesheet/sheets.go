@@ -0,0 +1,54 @@
+package timesheet
+
+import (
+	"context"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+// SheetReaderWriter gets spreadsheets and the values of their ranges, and
+// writes values. Ranges are in A1 notation with the sheet titles.
+type SheetReaderWriter interface {
+	// Returns the spreadsheet with only the fields
+	GetSpreadsheet(ctx context.Context, spreadsheetID string, fields googleapi.Field) (*sheets.Spreadsheet, error)
+	// Returns the values of each of the ranges, rendered by the option like
+	// "FORMULA" or "UNFORMATTED_VALUE"
+	GetValues(ctx context.Context, spreadsheetID string, ranges []string, valueRenderOption string) ([][][]interface{}, error)
+	// Writes the values as entered by the user
+	UpdateValues(ctx context.Context, spreadsheetID string, data []*sheets.ValueRange) error
+}
+
+// Google reads and writes spreadsheets of Google Sheets
+type Google struct {
+	Service *sheets.Service
+}
+
+func (g *Google) GetSpreadsheet(ctx context.Context, spreadsheetID string, fields googleapi.Field) (*sheets.Spreadsheet, error) {
+	return g.Service.Spreadsheets.Get(spreadsheetID).Fields(fields).Context(ctx).Do()
+}
+
+func (g *Google) GetValues(ctx context.Context, spreadsheetID string, ranges []string, valueRenderOption string) ([][][]interface{}, error) {
+	resp, err := g.Service.Spreadsheets.Values.BatchGet(spreadsheetID).
+		Ranges(ranges...).
+		ValueRenderOption(valueRenderOption).
+		Fields("valueRanges(range,values)").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+	values := make([][][]interface{}, 0, len(resp.ValueRanges))
+	for _, vr := range resp.ValueRanges {
+		values = append(values, vr.Values)
+	}
+	return values, nil
+}
+
+func (g *Google) UpdateValues(ctx context.Context, spreadsheetID string, data []*sheets.ValueRange) error {
+	_, err := g.Service.Spreadsheets.Values.BatchUpdate(spreadsheetID, &sheets.BatchUpdateValuesRequest{
+		Data:             data,
+		ValueInputOption: "USER_ENTERED",
+	}).Context(ctx).Do()
+	return err
+}
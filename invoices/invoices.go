@@ -0,0 +1,137 @@
+// Package invoices makes the invoices of make-invoices from other programs:
+// it finds the work days of a month in the calendars, writes them to the
+// timesheets and exports the month sheets, as the command does.
+//
+// Runs of a Runner never exit the process, and never prompt unless
+// interactive. Questions the command would ask, like whether to overwrite
+// values not written by it, are answered no, failing the spreadsheet, and
+// failures ending command runs are returned as errors. Every call stops when its context is done.
+// Calls are made one at a time, even from different Runners, as they share
+// the state of the run like the state file.
+package invoices
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/app"
+)
+
+// Config is the config of the runs, as in config.json of the command
+type Config = app.Config
+
+// Reads and validates the config file at path
+func LoadConfig(path string) (*Config, error) {
+	return app.LoadConfig(path)
+}
+
+// Runner makes the invoices of the config with the API client
+type Runner struct {
+	config *Config
+	client *http.Client
+	// Options of the calls, set before making them
+	Options Options
+}
+
+// Options change how the calls of a Runner are made
+type Options struct {
+	// Ask the questions of the runs on the terminal, as the command does,
+	// instead of answering no
+	Interactive bool
+	// Fail DetectWorkDays if a spreadsheet has fewer work days than
+	// min_work_days, as runs of the command do without --allow-empty
+	RequireWorkDays bool
+	// Show the changes to the sheets in the logs without making them
+	DryRun bool
+	// IDs of the only spreadsheets of the calls, every one if empty
+	Only []string
+}
+
+func (o Options) runOptions() app.RunOptions {
+	return app.RunOptions{
+		Interactive:     o.Interactive,
+		RequireWorkDays: o.RequireWorkDays,
+		DryRun:          o.DryRun,
+		Only:            o.Only,
+	}
+}
+
+// Returns the runner of the config, as returned by LoadConfig, with the
+// client authorized for the scopes of the Google APIs the config uses
+func NewRunner(config *Config, client *http.Client) *Runner {
+	return &Runner{config: config, client: client}
+}
+
+// Returns the work days and the days of leave of the month of each
+// spreadsheet by spreadsheet ID, ordered by date. Only the year and the
+// month of month are used. Spreadsheets may have no days unless
+// RequireWorkDays.
+func (r *Runner) DetectWorkDays(ctx context.Context, month time.Time) (map[string][]WorkDay, error) {
+	workDays, leaveDays, err := app.DetectWorkDays(ctx, r.client, r.config, month, r.Options.runOptions())
+	if err != nil {
+		return nil, err
+	}
+	days := make(map[string][]WorkDay)
+	for id, ds := range workDays {
+		days[id] = make([]WorkDay, 0, len(ds)+len(leaveDays[id]))
+		for _, d := range ds {
+			days[id] = append(days[id], newWorkDay(d))
+		}
+	}
+	for id, ds := range leaveDays {
+		for _, d := range ds {
+			days[id] = append(days[id], newWorkDay(d))
+		}
+	}
+	for _, ds := range days {
+		sort.SliceStable(ds, func(i, j int) bool { return ds[i].Date.Before(ds[j].Date) })
+	}
+	return days, nil
+}
+
+// Writes the days to the month sheets of the spreadsheets, creating the
+// sheets if needed, without exporting them. days are by spreadsheet ID as
+// returned by DetectWorkDays, and spreadsheets not in days get no days.
+// The error is non-nil if any spreadsheet failed, the results telling
+// which.
+func (r *Runner) UpdateTimesheets(ctx context.Context, month time.Time, days map[string][]WorkDay) ([]SpreadsheetResult, error) {
+	workDays, leaveDays := splitDays(days)
+	results, err := app.UpdateTimesheets(ctx, r.client, r.config, month, workDays, leaveDays, r.Options.runOptions())
+	return newSpreadsheetResults(results), err
+}
+
+// Writes the days to the month sheets of the spreadsheets and exports them
+// as ExportPDFs does, in one pass like the runs of the command. days are as
+// given to UpdateTimesheets. The error is non-nil if any spreadsheet
+// failed, the results telling which.
+func (r *Runner) MakeInvoices(ctx context.Context, month time.Time, days map[string][]WorkDay) ([]SpreadsheetResult, error) {
+	workDays, leaveDays := splitDays(days)
+	results, err := app.MakeInvoices(ctx, r.client, r.config, month, workDays, leaveDays, r.Options.runOptions())
+	return newSpreadsheetResults(results), err
+}
+
+// Returns the work days and the days of leave of the days
+func splitDays(days map[string][]WorkDay) (workDays, leaveDays map[string][]app.WorkDay) {
+	workDays = make(map[string][]app.WorkDay)
+	leaveDays = make(map[string][]app.WorkDay)
+	for id, ds := range days {
+		for _, d := range ds {
+			if d.Leave != "" {
+				leaveDays[id] = append(leaveDays[id], d.appWorkDay())
+			} else {
+				workDays[id] = append(workDays[id], d.appWorkDay())
+			}
+		}
+	}
+	return workDays, leaveDays
+}
+
+// Exports the month sheets of the spreadsheets in their export formats,
+// pdf unless configured, and delivers the files as configured. The error is
+// non-nil if any spreadsheet failed, the results telling which.
+func (r *Runner) ExportPDFs(ctx context.Context, month time.Time) ([]SpreadsheetResult, error) {
+	results, err := app.ExportPDFs(ctx, r.client, r.config, month, r.Options.runOptions())
+	return newSpreadsheetResults(results), err
+}
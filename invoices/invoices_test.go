@@ -0,0 +1,139 @@
+package invoices
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Sends the requests to the server instead of the hosts of Google
+type redirectTransport struct {
+	server *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.server.Scheme, t.server.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Returns a runner of a calendar and a spreadsheet whose API requests are
+// answered by handler
+func newTestRunner(t *testing.T, handler http.HandlerFunc) *Runner {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(`{
+	"calendar_id": "work",
+	"work_day_title": "勤務",
+	"holidays": {"source": "none"},
+	"state_file": %q,
+	"retry_max_attempts": 1,
+	"work_spreadsheets": [{"id": "timesheet"}]
+}`, filepath.Join(dir, "state.json"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return NewRunner(config, &http.Client{Transport: &redirectTransport{server: u}})
+}
+
+func TestDetectWorkDays(t *testing.T) {
+	r := newTestRunner(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"items": [
+			{"id": "b", "summary": "勤務", "start": {"dateTime": "2024-05-08T10:00:00+09:00"}, "end": {"dateTime": "2024-05-08T19:00:00+09:00"}},
+			{"id": "a", "summary": "勤務", "start": {"dateTime": "2024-05-07T09:00:00+09:00"}, "end": {"dateTime": "2024-05-07T18:00:00+09:00"}},
+			{"id": "c", "summary": "会議", "start": {"dateTime": "2024-05-09T09:00:00+09:00"}, "end": {"dateTime": "2024-05-09T10:00:00+09:00"}}
+		]}`)
+	})
+	days, err := r.DetectWorkDays(context.Background(), time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("DetectWorkDays: %v", err)
+	}
+	got := make([]string, 0)
+	for _, d := range days["timesheet"] {
+		got = append(got, d.Start.Format("2006-01-02 15:04")+"-"+d.End.Format("15:04"))
+	}
+	want := []string{"2024-05-07 09:00-18:00", "2024-05-08 10:00-19:00"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDetectWorkDaysReturnsFailure(t *testing.T) {
+	r := newTestRunner(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error": {"code": 404, "message": "Not Found"}}`, http.StatusNotFound)
+	})
+	// Command runs exit on the failure, which would end the test
+	if _, err := r.DetectWorkDays(context.Background(), time.Now()); err == nil {
+		t.Fatal("want error of the calendar not found")
+	}
+}
+
+func TestDetectWorkDaysContext(t *testing.T) {
+	r := newTestRunner(t, func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.DetectWorkDays(ctx, time.Now()); err == nil {
+		t.Fatal("want error of the context")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("returned after %v", d)
+	}
+}
+
+func TestUpdateTimesheetsContext(t *testing.T) {
+	var requests int32
+	r := newTestRunner(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := r.UpdateTimesheets(ctx, time.Now(), nil)
+	if err == nil {
+		t.Fatal("want error of the context")
+	}
+	if len(results) != 1 || results[0].SpreadsheetID != "timesheet" || results[0].Err == nil {
+		t.Errorf("got results %+v", results)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("got %d requests", n)
+	}
+}
+
+func TestRunnerOnly(t *testing.T) {
+	var requests int32
+	r := newTestRunner(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+	})
+	r.Options.Only = []string{"other"}
+	if _, err := r.MakeInvoices(context.Background(), time.Now(), nil); err == nil || !strings.Contains(err.Error(), "spreadsheet other is not in the config") {
+		t.Fatalf("got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("got %d requests", n)
+	}
+}
@@ -0,0 +1,76 @@
+package invoices
+
+import (
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/app"
+)
+
+// WorkDay is a day of work, or of leave, of a month
+type WorkDay struct {
+	// Day in the timezone of the month, the timezone of the config
+	Date time.Time
+	// Times of the work, zero for all-day events and days of leave
+	Start time.Time
+	End   time.Time
+	// Name of the event kind of the day, if event_kinds are configured
+	Kind string
+	// Where the work was, if the event has a location
+	Location string
+	// Value written for days of leave, like "有給", empty for work days
+	Leave string
+
+	// The day found by DetectWorkDays, with the events and the overrides of
+	// their descriptions
+	day app.WorkDay
+}
+
+func newWorkDay(d app.WorkDay) WorkDay {
+	return WorkDay{
+		Date:     d.Date,
+		Start:    d.Start,
+		End:      d.End,
+		Kind:     d.Kind,
+		Location: d.Location,
+		Leave:    d.Leave,
+		day:      d,
+	}
+}
+
+// Returns the day to write, which is the one found with the fields of d
+func (d WorkDay) appWorkDay() app.WorkDay {
+	day := d.day
+	day.Date, day.Start, day.End = d.Date, d.Start, d.End
+	day.Kind, day.Location, day.Leave = d.Kind, d.Location, d.Leave
+	return day
+}
+
+// SpreadsheetResult is the result of a spreadsheet of a call
+type SpreadsheetResult struct {
+	SpreadsheetID string
+	// Title of the spreadsheet, empty if it was not got
+	Title string
+	// Files written for the spreadsheet, like the pdf of the month sheet
+	Files []string
+	// Failure of the spreadsheet, nil if it succeeded
+	Err error
+	// Step which failed, like "write values"
+	Step string
+}
+
+func newSpreadsheetResults(results []*app.SpreadsheetResult) []SpreadsheetResult {
+	if results == nil {
+		return nil
+	}
+	rs := make([]SpreadsheetResult, 0, len(results))
+	for _, r := range results {
+		rs = append(rs, SpreadsheetResult{
+			SpreadsheetID: r.ID,
+			Title:         r.Title,
+			Files:         r.Files,
+			Err:           r.Err,
+			Step:          r.Step,
+		})
+	}
+	return rs
+}
@@ -0,0 +1,44 @@
+package invoices
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tsujio/make-invoices/internal/app"
+)
+
+func TestWorkDayKeepsFoundDay(t *testing.T) {
+	date := time.Date(2024, 5, 7, 0, 0, 0, 0, time.UTC)
+	found := app.WorkDay{
+		Date:      date,
+		Start:     date.Add(9 * time.Hour),
+		End:       date.Add(18 * time.Hour),
+		Overrides: app.EventOverrides{Note: "客先常駐"},
+		Source:    "calendar",
+	}
+	d := newWorkDay(found)
+	d.End = date.Add(20 * time.Hour)
+	got := d.appWorkDay()
+	if !got.End.Equal(d.End) || !got.Start.Equal(found.Start) {
+		t.Errorf("got times %v-%v", got.Start, got.End)
+	}
+	if got.Overrides.Note != "客先常駐" || got.Source != "calendar" {
+		t.Errorf("got overrides %+v of source %q", got.Overrides, got.Source)
+	}
+
+	// Days made by the caller have only their fields
+	got = WorkDay{Date: date, Leave: "有給"}.appWorkDay()
+	if !got.Date.Equal(date) || got.Leave != "有給" || len(got.Events) != 0 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestNewSpreadsheetResults(t *testing.T) {
+	if got := newSpreadsheetResults(nil); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+	got := newSpreadsheetResults([]*app.SpreadsheetResult{{ID: "timesheet", Title: "作業報告書", Files: []string{"202405作業報告書.pdf"}}})
+	if len(got) != 1 || got[0].SpreadsheetID != "timesheet" || got[0].Title != "作業報告書" || len(got[0].Files) != 1 || got[0].Err != nil {
+		t.Errorf("got %+v", got)
+	}
+}